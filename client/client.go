@@ -0,0 +1,352 @@
+// Package client is a Go client for the go_proxy API, for programs that
+// embed or drive a proxy. Its methods follow the operations of the API's
+// OpenAPI document, served at /api/openapi.json, and call the versioned
+// /api/v1/ routes.
+//
+// It is written by hand and covers only the captures, store, rules and
+// health operations: listRequests, getRequest, streamRequests,
+// pollRequests, clear, getStats, getStoreStats, snapshotStore,
+// compactStore, importStore, listRules, createRule, deleteRule and
+// health. The other operations of the document, such as reports,
+// exports, sessions, flows, monitors, rule lookups and edits, tenants,
+// audit and admin, have no method; call them over HTTP or generate a
+// client from the document.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+	"github.com/adamdrake/go_proxy/internal/rules"
+)
+
+// Capture is a captured request and its response
+type Capture = capture.CapturedRequest
+
+// MergeStats counts the outcome of an import
+type MergeStats = capture.MergeStats
+
+// CompactStats describes the store after compaction
+type CompactStats = capture.CompactStats
+
+// StoreStats describes what the store holds
+type StoreStats = capture.StoreStats
+
+// Rule is a rewrite rule
+type Rule = rules.Rule
+
+// Client calls the API of one go_proxy instance
+type Client struct {
+	baseURL string
+	token   string
+	tenant  string
+	http    *http.Client
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithToken sends token as a bearer token, for APIs run with -api-token
+func WithToken(token string) Option {
+	return func(c *Client) { c.token = token }
+}
+
+// WithTenant works on the captures of a tenant, for unscoped tokens
+func WithTenant(tenant string) Option {
+	return func(c *Client) { c.tenant = tenant }
+}
+
+// WithHTTPClient sends requests with hc instead of http.DefaultClient
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.http = hc }
+}
+
+// New returns a client for the API at baseURL, e.g. http://localhost:8081
+func New(baseURL string, opts ...Option) *Client {
+	c := &Client{baseURL: strings.TrimSuffix(baseURL, "/"), http: http.DefaultClient}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Error is a response with an unexpected status
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("go_proxy API: %d %s", e.StatusCode, e.Message)
+}
+
+// Filter selects captures like the /api/requests query parameters. Zero
+// fields do not filter.
+type Filter struct {
+	Query         string
+	Since         string // RFC 3339, Unix seconds, or a duration ago such as 15m
+	Until         string
+	Host          string
+	Tag           string
+	Session       string
+	Source        string
+	Party         string // "first" or "third"
+	UpstreamIP    string
+	Country       string
+	ASN           string
+	CorrelationID string
+	SHA256        string
+	Finding       string
+	Modified      *bool
+	PII           *bool
+	Secrets       *bool
+	Limit         int
+}
+
+// values encodes the filter as query parameters
+func (f Filter) values() url.Values {
+	v := url.Values{}
+	set := func(name, value string) {
+		if value != "" {
+			v.Set(name, value)
+		}
+	}
+	setBool := func(name string, value *bool) {
+		if value != nil {
+			v.Set(name, strconv.FormatBool(*value))
+		}
+	}
+	set("q", f.Query)
+	set("since", f.Since)
+	set("until", f.Until)
+	set("host", f.Host)
+	set("tag", f.Tag)
+	set("session", f.Session)
+	set("source", f.Source)
+	set("party", f.Party)
+	set("upstream_ip", f.UpstreamIP)
+	set("country", f.Country)
+	set("asn", f.ASN)
+	set("correlation_id", f.CorrelationID)
+	set("sha256", f.SHA256)
+	set("finding", f.Finding)
+	setBool("modified", f.Modified)
+	setBool("pii", f.PII)
+	setBool("secrets", f.Secrets)
+	if f.Limit > 0 {
+		v.Set("limit", strconv.Itoa(f.Limit))
+	}
+	return v
+}
+
+// ListRequests returns the captures matching filter, oldest first
+func (c *Client) ListRequests(ctx context.Context, filter Filter) ([]*Capture, error) {
+	var out struct {
+		Requests []*Capture `json:"requests"`
+	}
+	err := c.call(ctx, http.MethodGet, "/api/v1/requests", filter.values(), nil, "", &out)
+	return out.Requests, err
+}
+
+// GetRequest returns one capture by ID
+func (c *Client) GetRequest(ctx context.Context, id string) (*Capture, error) {
+	var out Capture
+	if err := c.call(ctx, http.MethodGet, "/api/v1/requests/"+url.PathEscape(id), nil, nil, "", &out); err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// StreamRequests calls fn with each new capture until ctx ends, the
+// stream is closed, or fn returns an error, which is returned
+func (c *Client) StreamRequests(ctx context.Context, fn func(*Capture) error) error {
+	resp, err := c.do(ctx, http.MethodGet, "/api/v1/requests/stream", nil, nil, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Server-sent events: "event:" and "data:" lines, ended by a blank line
+	var event string
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(nil, 64<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: ") && event == "request":
+			var req Capture
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &req); err != nil {
+				return err
+			}
+			if err := fn(&req); err != nil {
+				return err
+			}
+		case line == "":
+			event = ""
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return scanner.Err()
+}
+
+// PollRequests waits up to timeout for captures stored after sequence
+// number since, returning them with the number to poll from next. It
+// works where proxies in between break StreamRequests.
+func (c *Client) PollRequests(ctx context.Context, since uint64, timeout time.Duration) ([]*Capture, uint64, error) {
+	query := url.Values{}
+	query.Set("since_seq", strconv.FormatUint(since, 10))
+	query.Set("timeout", timeout.String())
+	var out struct {
+		Requests []*Capture `json:"requests"`
+		NextSeq  uint64     `json:"next_seq"`
+	}
+	err := c.call(ctx, http.MethodGet, "/api/v1/requests/poll", query, nil, "", &out)
+	return out.Requests, out.NextSeq, err
+}
+
+// Clear removes every capture
+func (c *Client) Clear(ctx context.Context) error {
+	return c.call(ctx, http.MethodPost, "/api/v1/clear", nil, nil, "", nil)
+}
+
+// GetStats returns request statistics
+func (c *Client) GetStats(ctx context.Context) (map[string]interface{}, error) {
+	var out map[string]interface{}
+	err := c.call(ctx, http.MethodGet, "/api/v1/stats", nil, nil, "", &out)
+	return out, err
+}
+
+// GetStoreStats returns the store's size, approximate memory use,
+// evictions and truncated or spooled bodies
+func (c *Client) GetStoreStats(ctx context.Context) (StoreStats, error) {
+	var out StoreStats
+	err := c.call(ctx, http.MethodGet, "/api/v1/stats/store", nil, nil, "", &out)
+	return out, err
+}
+
+// SnapshotStore writes a gzipped snapshot of the store to w
+func (c *Client) SnapshotStore(ctx context.Context, w io.Writer) error {
+	resp, err := c.do(ctx, http.MethodGet, "/api/v1/store/snapshot", nil, nil, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// CompactStore releases memory held after evictions
+func (c *Client) CompactStore(ctx context.Context) (CompactStats, error) {
+	var out CompactStats
+	err := c.call(ctx, http.MethodPost, "/api/v1/store/compact", nil, nil, "", &out)
+	return out, err
+}
+
+// ImportStore merges a snapshot or NDJSON export into the store. With
+// skipConflicts, captures whose ID is taken are dropped instead of
+// renamed; a non-empty tag labels the imported captures.
+func (c *Client) ImportStore(ctx context.Context, snapshot io.Reader, skipConflicts bool, tag string) (MergeStats, error) {
+	query := url.Values{}
+	if skipConflicts {
+		query.Set("on_conflict", "skip")
+	}
+	if tag != "" {
+		query.Set("tag", tag)
+	}
+	var out MergeStats
+	err := c.call(ctx, http.MethodPost, "/api/v1/store/import", query, snapshot, "application/octet-stream", &out)
+	return out, err
+}
+
+// ListRules returns the rewrite rules
+func (c *Client) ListRules(ctx context.Context) ([]Rule, error) {
+	var out struct {
+		Rules []Rule `json:"rules"`
+	}
+	err := c.call(ctx, http.MethodGet, "/api/v1/rules", nil, nil, "", &out)
+	return out.Rules, err
+}
+
+// CreateRule adds a rule, returning it with its assigned ID
+func (c *Client) CreateRule(ctx context.Context, rule Rule) (Rule, error) {
+	body, err := json.Marshal(rule)
+	if err != nil {
+		return Rule{}, err
+	}
+	var out Rule
+	err = c.call(ctx, http.MethodPost, "/api/v1/rules", nil, bytes.NewReader(body), "application/json", &out)
+	return out, err
+}
+
+// DeleteRule removes a rule
+func (c *Client) DeleteRule(ctx context.Context, id string) error {
+	return c.call(ctx, http.MethodDelete, "/api/v1/rules/"+url.PathEscape(id), nil, nil, "", nil)
+}
+
+// Health checks that the API is up
+func (c *Client) Health(ctx context.Context) error {
+	return c.call(ctx, http.MethodGet, "/health", nil, nil, "", nil)
+}
+
+// call makes a request and decodes its JSON response into out, if not nil
+func (c *Client) call(ctx context.Context, method, path string, query url.Values, body io.Reader, contentType string, out interface{}) error {
+	resp, err := c.do(ctx, method, path, query, body, contentType)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		_, err = io.Copy(io.Discard, resp.Body)
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// do sends a request, turning unsuccessful statuses into an *Error
+func (c *Client) do(ctx context.Context, method, path string, query url.Values, body io.Reader, contentType string) (*http.Response, error) {
+	if c.tenant != "" {
+		if query == nil {
+			query = url.Values{}
+		}
+		query.Set("tenant", c.tenant)
+	}
+	target := c.baseURL + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(msg))}
+	}
+	return resp, nil
+}
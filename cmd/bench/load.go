@@ -0,0 +1,139 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// runHTTPLoad drives concurrent GETs through the proxy and reports
+// throughput and latency percentiles
+func runHTTPLoad(env *benchEnv, concurrency int, duration time.Duration) {
+	fmt.Printf("== http (c=%d, d=%s) ==\n", concurrency, duration)
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy:               http.ProxyURL(env.proxyURL),
+			MaxIdleConnsPerHost: concurrency,
+		},
+		Timeout: 30 * time.Second,
+	}
+
+	var (
+		mu        sync.Mutex
+		latencies []time.Duration
+		errors    atomic.Int64
+		wg        sync.WaitGroup
+	)
+
+	deadline := time.Now().Add(duration)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var local []time.Duration
+			for time.Now().Before(deadline) {
+				start := time.Now()
+				resp, err := client.Get(env.upstream.URL + "/load")
+				if err != nil {
+					errors.Add(1)
+					continue
+				}
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					errors.Add(1)
+					continue
+				}
+				local = append(local, time.Since(start))
+			}
+			mu.Lock()
+			latencies = append(latencies, local...)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	fmt.Printf("requests:   %d (%d errors)\n", len(latencies), errors.Load())
+	fmt.Printf("throughput: %.0f req/s\n", float64(len(latencies))/duration.Seconds())
+	fmt.Printf("latency:    p50=%s p90=%s p99=%s max=%s\n",
+		percentile(latencies, 0.50), percentile(latencies, 0.90),
+		percentile(latencies, 0.99), percentile(latencies, 1))
+}
+
+// runConnectLoad opens CONNECT tunnels to a TCP sink and pushes data
+// through them, reporting aggregate tunnel throughput
+func runConnectLoad(env *benchEnv, concurrency int, duration time.Duration) {
+	fmt.Printf("== connect (c=%d, d=%s) ==\n", concurrency, duration)
+
+	var (
+		bytes  atomic.Int64
+		errors atomic.Int64
+		wg     sync.WaitGroup
+	)
+
+	chunk := make([]byte, 32*1024)
+	deadline := time.Now().Add(duration)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := openTunnel(env.proxyURL.Host, env.sink.Addr().String())
+			if err != nil {
+				errors.Add(1)
+				return
+			}
+			defer conn.Close()
+
+			for time.Now().Before(deadline) {
+				n, err := conn.Write(chunk)
+				bytes.Add(int64(n))
+				if err != nil {
+					errors.Add(1)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	mb := float64(bytes.Load()) / (1024 * 1024)
+	fmt.Printf("transferred: %.1f MiB (%d errors)\n", mb, errors.Load())
+	fmt.Printf("throughput:  %.1f MiB/s\n", mb/duration.Seconds())
+}
+
+// openTunnel establishes a CONNECT tunnel through the proxy
+func openTunnel(proxyAddr, target string) (net.Conn, error) {
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("CONNECT returned %s", resp.Status)
+	}
+	return conn, nil
+}
+
+// percentile returns the p-th percentile of sorted durations
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(p * float64(len(sorted)-1))
+	return sorted[i]
+}
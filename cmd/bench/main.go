@@ -0,0 +1,127 @@
+// Command bench load tests a live proxy end to end: HTTP forwarding and
+// CONNECT tunnel throughput. The store and handler micro benchmarks live
+// with their packages and run with go test -bench.
+//
+//	go run ./cmd/bench                         # everything, in-process proxy
+//	go run ./cmd/bench -mode http -c 64 -d 30s
+//	go run ./cmd/bench -mode http -target-proxy http://localhost:8080
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+	"github.com/adamdrake/go_proxy/internal/proxy"
+)
+
+func main() {
+	mode := flag.String("mode", "all", "What to run: all, http, connect")
+	concurrency := flag.Int("c", 32, "Concurrent clients for load modes")
+	duration := flag.Duration("d", 10*time.Second, "Duration of each load mode")
+	bodySize := flag.Int("body", 4096, "Upstream response body size in bytes")
+	targetProxy := flag.String("target-proxy", "", "Benchmark an already running proxy instead of an in-process one")
+	flag.Parse()
+
+	// Keep proxy request logging out of the results
+	log.SetOutput(io.Discard)
+
+	env, err := newBenchEnv(*targetProxy, *bodySize)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "bench: %v\n", err)
+		os.Exit(1)
+	}
+	defer env.Close()
+
+	run := func(name string) bool {
+		return *mode == "all" || *mode == name
+	}
+
+	if run("http") {
+		runHTTPLoad(env, *concurrency, *duration)
+	}
+	if run("connect") {
+		runConnectLoad(env, *concurrency, *duration)
+	}
+}
+
+// benchEnv is the set of servers a benchmark run talks to
+type benchEnv struct {
+	upstream   *httptest.Server
+	sink       net.Listener
+	proxyURL   *url.URL
+	proxy      *proxy.Server
+	proxyStore *capture.Store
+	body       []byte
+}
+
+// newBenchEnv starts a local upstream, a TCP sink for CONNECT throughput
+// and, unless targetProxy is set, an in-process proxy
+func newBenchEnv(targetProxy string, bodySize int) (*benchEnv, error) {
+	env := &benchEnv{
+		body: []byte(strings.Repeat("x", bodySize)),
+	}
+
+	env.upstream = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write(env.body)
+	}))
+
+	sink, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	env.sink = sink
+	go func() {
+		for {
+			conn, err := sink.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(io.Discard, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	if targetProxy != "" {
+		env.proxyURL, err = url.Parse(targetProxy)
+		return env, err
+	}
+
+	config := proxy.DefaultConfig()
+	config.ConnectPorts = nil // the sink listens on a random port
+	config.CaptureQueueSize = 100000
+	env.proxyStore = capture.NewStore(10000)
+	env.proxy = proxy.NewServer(config, env.proxyStore)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	go env.proxy.Serve(listener)
+	env.proxyURL = &url.URL{Scheme: "http", Host: listener.Addr().String()}
+
+	return env, nil
+}
+
+// Close stops every server started for the run
+func (e *benchEnv) Close() {
+	e.upstream.Close()
+	e.sink.Close()
+	if e.proxy != nil {
+		e.proxy.Shutdown(context.Background())
+	}
+}
@@ -0,0 +1,15 @@
+package main
+
+import "strings"
+
+// stringList is a flag.Value collecting repeated string flags
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
@@ -5,36 +5,548 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"os"
+	"os/exec"
 	"os/signal"
+	"runtime"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/adamdrake/go_proxy/internal/allowlist"
+	"github.com/adamdrake/go_proxy/internal/anomaly"
 	"github.com/adamdrake/go_proxy/internal/api"
+	"github.com/adamdrake/go_proxy/internal/blocklist"
 	"github.com/adamdrake/go_proxy/internal/capture"
+	"github.com/adamdrake/go_proxy/internal/collector"
+	"github.com/adamdrake/go_proxy/internal/export"
+	"github.com/adamdrake/go_proxy/internal/geoip"
+	"github.com/adamdrake/go_proxy/internal/mdns"
+	"github.com/adamdrake/go_proxy/internal/monitor"
 	"github.com/adamdrake/go_proxy/internal/proxy"
+	"github.com/adamdrake/go_proxy/internal/seal"
+	"github.com/adamdrake/go_proxy/internal/webhook"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "service" {
+		if err := runService(os.Args[2:]); err != nil {
+			log.Fatalf("Service: %v", err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && (os.Args[1] == "enable-system-proxy" || os.Args[1] == "disable-system-proxy") {
+		if err := runSystemProxy(os.Args[1], os.Args[2:]); err != nil {
+			log.Fatalf("System proxy: %v", err)
+		}
+		return
+	}
+
 	// Command line flags
 	proxyAddr := flag.String("proxy", ":8080", "Proxy server listen address")
 	apiAddr := flag.String("api", ":8081", "API server listen address")
+	grpcAddr := flag.String("grpc", "", "gRPC API listen address, e.g. :8082 (see proto/goproxy.proto; empty disables it)")
 	maxRequests := flag.Int("max-requests", 1000, "Maximum number of requests to store in memory")
+	maxBodySize := flag.Int64("max-body-size", 10*1024*1024, "Bytes of each request and response body kept in a capture; longer bodies are forwarded whole but truncated in the capture")
+	http2 := flag.Bool("http2", true, "Accept cleartext HTTP/2 (prior knowledge) from clients; extended CONNECT also needs GODEBUG=http2xconnect=1")
+	captureKeyFile := flag.String("capture-key-file", "", "File holding a 256-bit key (hex or base64) that encrypts capture data written to disk; default: $GO_PROXY_CAPTURE_KEY")
+	uploadSpool := flag.Int64("upload-spool", 0, "Stream request bodies larger than this many bytes to disk, recording their size and SHA-256 (0 disables)")
+	uploadDir := flag.String("upload-dir", "", "Directory for spooled uploads (default: system temp directory)")
+	uploadRetention := flag.Duration("upload-retention", time.Hour, "How long spooled uploads are kept for download (0 removes them once forwarded)")
+	mediaPlaceholders := flag.Int64("media-placeholders", 0, "Replace image and video responses of at least this many bytes with tiny placeholders (0 disables)")
+	captureRaw := flag.Bool("capture-raw", false, "Keep HTTP/1 requests and responses exactly as sent on the wire (doubles capture memory)")
+	faithful := flag.Bool("faithful", false, "Faithful forwarding: keep header order and case, add no Accept-Encoding or User-Agent, and match the client's HTTP/1 version")
+	attach304Bodies := flag.Bool("attach-304-bodies", false, "Give 304 captures the body of the earlier 200 capture they revalidated")
+	scanPII := flag.Bool("scan-pii", false, "Flag captures containing likely personal data: emails, card numbers, SSNs, UK NINOs, IBANs")
+	scanSecrets := flag.Bool("scan-secrets", false, "Flag outgoing requests carrying credentials: AWS keys, GitHub, GitLab, Slack and Stripe tokens, private keys")
+	blockSecrets := flag.Bool("block-secrets", false, "Refuse to forward requests carrying credentials (implies -scan-secrets)")
+	correlationHeader := flag.String("correlation-header", "", "Header carrying a correlation ID upstream and back, e.g. X-Request-ID; the client's value is kept when it sends one")
+	preserveHeaderOrder := flag.Bool("preserve-header-order", false, "Forward HTTP/1 request headers in the order and case the client sent them")
+	captureQueue := flag.Int("capture-queue", 1024, "Captures buffered for background storage before new ones are dropped")
+	defaults := proxy.DefaultTimeouts()
+	connectTimeout := flag.Duration("connect-timeout", defaults.Connect, "Upstream connect timeout (DNS + TCP, 0 for no limit)")
+	tlsTimeout := flag.Duration("tls-timeout", defaults.TLSHandshake, "Upstream TLS handshake timeout (0 for no limit)")
+	headerTimeout := flag.Duration("response-header-timeout", defaults.ResponseHeader, "Time to wait for upstream response headers (0 for no limit)")
+	bodyTimeout := flag.Duration("body-read-timeout", defaults.BodyRead, "Time allowed to read an upstream response body (0 for no limit)")
+	var timeoutRules stringList
+	flag.Var(&timeoutRules, "timeout-rule", "Per-host timeouts as pattern=phase:duration,... with phases connect, tls, header, body (repeatable)")
+	retries := flag.Int("retries", 0, "Retries for failed upstream requests (0 disables)")
+	retryBackoff := flag.Duration("retry-backoff", 100*time.Millisecond, "Delay before the first retry, doubling each time")
+	retryMaxBackoff := flag.Duration("retry-max-backoff", 2*time.Second, "Maximum delay between retries")
+	retryOn := flag.String("retry-on", "connect,502,503,504", "Retry conditions: connect, timeout, 5xx, or status codes")
+	circuitThreshold := flag.Int("circuit-threshold", 0, "Consecutive upstream failures that open a host's circuit (0 disables)")
+	circuitCooldown := flag.Duration("circuit-cooldown", 30*time.Second, "How long an open circuit fails fast before a trial request")
+	ipMode := flag.String("ip-mode", "dual", "Upstream address families: dual, prefer-ipv4, prefer-ipv6, ipv4-only, ipv6-only")
+	bindOutbound := flag.String("bind-outbound", "", "Local IP address or interface name for upstream connections")
+	var bindRules stringList
+	flag.Var(&bindRules, "bind-outbound-rule", "Per-host outbound binding as pattern=address (repeatable, e.g. '*.corp.example=utun3')")
+	connectPorts := flag.String("connect-ports", "443", "Ports CONNECT tunnels may target, e.g. '443,8443,9000-9100' or 'any'")
+	var tcpForwards, udpForwards stringList
+	flag.Var(&tcpForwards, "tcp-forward", "Forward a local TCP port as [bind:]port:host:port, e.g. 5432:db.internal:5432 (repeatable)")
+	flag.Var(&udpForwards, "udp-forward", "Forward a local UDP port as [bind:]port:host:port (repeatable)")
+	var smtpForwards, imapForwards stringList
+	flag.Var(&smtpForwards, "smtp-forward", "Forward a local port to an SMTP server, recording commands and envelopes until STARTTLS (repeatable)")
+	flag.Var(&imapForwards, "imap-forward", "Forward a local port to an IMAP server, recording commands until STARTTLS (repeatable)")
+	mailBodies := flag.Bool("mail-bodies", false, "Capture message bodies sent through -smtp-forward instead of redacting them")
+	forwardSample := flag.Int("forward-sample", 0, "Bytes of each direction of a forwarded connection to capture as a hex dump")
+	connectUDPPorts := flag.String("connect-udp-ports", "443", "Ports CONNECT-UDP (MASQUE) may target, in the same form as -connect-ports")
+	upstreamTLSMin := flag.String("upstream-tls-min", "", "Minimum TLS version for upstream connections (1.0-1.3)")
+	upstreamCiphers := flag.String("upstream-ciphers", "", "Comma-separated TLS 1.2 cipher suites allowed upstream")
+	upstreamCAFile := flag.String("upstream-ca-file", "", "PEM bundle of root CAs to trust upstream (replaces system roots)")
+	upstreamInsecure := flag.Bool("upstream-insecure", false, "Skip upstream TLS certificate verification (INSECURE)")
+	upstreamHTTP2 := flag.Bool("upstream-http2", true, "Offer HTTP/2 to HTTPS upstreams (off with -capture-raw; WebSocket upgrades and -preserve-header-order requests use HTTP/1.1)")
+	var clientCerts stringList
+	flag.Var(&clientCerts, "client-cert", "Upstream mTLS client certificate as pattern=cert.pem,key.pem (repeatable)")
+	crawlDelay := flag.Duration("crawl-delay", 0, "Crawl assist: minimum time between requests to the same host (0 disables pacing)")
+	crawlMaxWait := flag.Duration("crawl-max-wait", 30*time.Second, "Crawl assist: longest a request waits for its slot before a 429")
+	crawlRobots := flag.Bool("crawl-robots", false, "Crawl assist: flag requests disallowed by robots.txt and honor Crawl-delay")
+	crawlRobotsEnforce := flag.Bool("crawl-robots-enforce", false, "Crawl assist: refuse requests disallowed by robots.txt with 403")
+	crawlUserAgent := flag.String("crawl-user-agent", "", "Crawl assist: robots.txt user-agent token (default: from each request)")
+	allowClients := flag.String("allow-clients", "", "Comma-separated CIDRs/IPs allowed to connect to the proxy ports (default: everyone)")
+	apiAllowClients := flag.String("api-allow-clients", "", "Comma-separated CIDRs/IPs allowed to connect to the API port (default: everyone)")
+	corsOrigins := flag.String("cors-origins", "", "Comma-separated browser origins allowed to call the API, e.g. https://dash.example.com (default: any origin)")
+	corsCredentials := flag.Bool("cors-credentials", false, "Let the -cors-origins origins send credentials (cookies, Authorization) to the API")
+	auditFile := flag.String("audit-log", "", "Append an audit entry for every state-changing API call to this file (JSON lines)")
+	setSystemProxy := flag.Bool("set-system-proxy", false, "Point the OS proxy settings (macOS, Windows, GNOME) at this proxy while it runs, turning them off on shutdown")
+	advertiseHost := flag.String("advertise-host", "", "Address other devices use to reach this machine, for setup pages, QR codes and mDNS (default: first LAN IPv4 address)")
+	advertiseMDNS := flag.Bool("mdns", false, "Advertise the proxy on the local network over mDNS/Bonjour (_http-proxy._tcp)")
+	var apiTokens stringList
+	flag.Var(&apiTokens, "api-token", "API bearer token as role:token or role@tenant:token with role read, operator or admin (repeatable; none leaves the API open)")
+	var tenantSpecs stringList
+	flag.Var(&tenantSpecs, "tenant", "Isolated capture namespace as name:user=U,password=P,listen=ADDR,max=N, selected by proxy credentials or its own listener (repeatable)")
+	session := flag.String("session", "", "Name of the recording session to stamp captures with, e.g. the app build under test (switch with /api/sessions)")
+	warcFile := flag.String("warc", "", "Append every completed exchange to this WARC file as it is captured (gzipped per record when the name ends in .gz)")
+	var webhooks stringList
+	flag.Var(&webhooks, "webhook", "URL to POST JSON events to, such as failing synthetic monitors and detected secrets (repeatable)")
+	notifyConfig := flag.String("notify-config", "", "JSON file of notification sinks (Slack, email, PagerDuty, webhook) and the events each receives")
+	anomalyWindow := flag.Duration("anomaly-window", 0, "Compare each host's traffic over rolling windows this long and report error-rate spikes, latency doubling and watched hosts going quiet (0 turns detection off)")
+	anomalyMinRequests := flag.Int("anomaly-min-requests", anomaly.DefaultMinRequests, "Requests a window needs before its error rate and latency are judged")
+	var anomalyWatch stringList
+	flag.Var(&anomalyWatch, "anomaly-watch", "Host whose traffic dropping to zero for a window is reported, e.g. api.example.com or *.example.com (repeatable)")
+	collectorMode := flag.Bool("collector", false, "Accept captures forwarded by other instances at /api/collect")
+	forwardTo := flag.String("forward-captures", "", "API URL of a -collector instance to forward every capture to, e.g. http://collector:8081")
+	forwardToken := flag.String("forward-token", "", "API token for the collector (operator role) when it requires one")
+	forwardSource := flag.String("forward-source", "", "Name this instance's captures carry on the collector (default: hostname)")
+	forwardBatch := flag.Int("forward-batch", 100, "Captures sent to the collector per batch")
+	forwardInterval := flag.Duration("forward-interval", 2*time.Second, "Longest a capture waits before its batch is sent to the collector")
+	var pathTemplates stringList
+	flag.Var(&pathTemplates, "path-template", "Endpoint template for per-endpoint reports as regex=template, e.g. '^/blog/[^/]+=/blog/{slug}' (repeatable, first match wins)")
+	pathAutoIDs := flag.Bool("path-auto-ids", true, "Fold numeric, UUID and long hex path segments into {id} for per-endpoint reports")
+	var blocklists stringList
+	flag.Var(&blocklists, "blocklist", "Ad/tracker filter list to block, as a file or URL in hosts or EasyList format (repeatable)")
+	var geoipDBs stringList
+	flag.Var(&geoipDBs, "geoip-db", "MaxMind DB file (.mmdb) for the ASN and country of upstream addresses, e.g. GeoLite2-ASN and GeoLite2-Country (repeatable)")
+	reverseDNS := flag.Bool("reverse-dns", false, "Record the reverse DNS names of upstream addresses")
+	probeTunnelCerts := flag.Bool("probe-tunnel-certs", false, "Fetch the certificate chain of CONNECT tunnel hosts over a separate connection, for certificate details and expiry/mismatch warnings")
+	var firstParty stringList
+	flag.Var(&firstParty, "first-party", "First-party domain, covering its subdomains; captures to other hosts are classified third-party (repeatable)")
+	blockThirdParty := flag.Bool("block-third-party", false, "Refuse requests to hosts outside the first-party domains")
+	bypassHosts := flag.String("bypass", "", "NO_PROXY-style hosts, domains and CIDRs kept out of capture, e.g. 'internal.example.com,.corp,10.0.0.0/8' (default: $GO_PROXY_BYPASS)")
+	bypassMode := flag.String("bypass-mode", proxy.BypassDirect, "What happens to bypassed hosts: direct (forwarded without capture or rules) or refuse (403)")
+	dryRun := flag.Bool("dry-run", false, "Evaluate rules, header rules, filter lists, third-party and secret blocking and crawl pacing, recording what they would do without doing it")
+	var addHeaders, removeHeaders stringList
+	flag.Var(&addHeaders, "add-header", "Header to set on every forwarded request, as 'Name: value' (repeatable)")
+	flag.Var(&removeHeaders, "remove-header", "Header to strip from every forwarded request (repeatable)")
+	dnsCache := flag.Bool("dns-cache", true, "Cache upstream DNS lookups")
+	dnsTTL := flag.Duration("dns-ttl", 30*time.Second, "DNS cache TTL when the record TTL is unknown")
+	dnsMaxTTL := flag.Duration("dns-max-ttl", 10*time.Minute, "Upper bound on cached DNS record TTLs")
+	dnsNegativeTTL := flag.Duration("dns-negative-ttl", 5*time.Second, "How long failed (NXDOMAIN) DNS lookups are cached")
+	dnsCacheEntries := flag.Int("dns-cache-entries", 10000, "Maximum number of hosts in the DNS cache (0 = unbounded)")
 	flag.Parse()
 
+	if *maxBodySize <= 0 {
+		log.Fatalf("Invalid -max-body-size: %d is not positive", *maxBodySize)
+	}
+
+	mode, err := proxy.ParseIPMode(*ipMode)
+	if err != nil {
+		log.Fatalf("Invalid -ip-mode: %v", err)
+	}
+
+	var bind proxy.BindAddr
+	if *bindOutbound != "" {
+		if bind, err = proxy.ParseBindAddr(*bindOutbound); err != nil {
+			log.Fatalf("Invalid -bind-outbound: %v", err)
+		}
+		log.Printf("Binding upstream connections to %s", bind)
+	}
+
+	ports, err := proxy.ParsePortPolicy(*connectPorts)
+	if err != nil {
+		log.Fatalf("Invalid -connect-ports: %v", err)
+	}
+	udpPorts, err := proxy.ParsePortPolicy(*connectUDPPorts)
+	if err != nil {
+		log.Fatalf("Invalid -connect-udp-ports: %v", err)
+	}
+
+	if _, err := proxy.ParseBypassMode(*bypassMode); err != nil {
+		log.Fatalf("Invalid -bypass-mode: %v", err)
+	}
+	bypassSource, bypassList := "GO_PROXY_BYPASS", os.Getenv("GO_PROXY_BYPASS")
+	if *bypassHosts != "" {
+		bypassSource, bypassList = "-bypass", *bypassHosts
+	}
+	bypass, err := proxy.NewBypass(proxy.ParseBypassList(bypassList), *bypassMode)
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", bypassSource, err)
+	}
+	if entries, mode := bypass.List(); len(entries) > 0 {
+		log.Printf("Bypassing capture (%s) for %s", mode, strings.Join(entries, ","))
+	}
+
+	upstreamTLS := proxy.UpstreamTLSConfig{InsecureSkipVerify: *upstreamInsecure}
+	if upstreamTLS.MinVersion, err = proxy.ParseTLSVersion(*upstreamTLSMin); err != nil {
+		log.Fatalf("Invalid -upstream-tls-min: %v", err)
+	}
+	if upstreamTLS.CipherSuites, err = proxy.ParseCipherSuites(*upstreamCiphers); err != nil {
+		log.Fatalf("Invalid -upstream-ciphers: %v", err)
+	}
+	if *upstreamCAFile != "" {
+		if upstreamTLS.RootCAs, err = proxy.LoadCertPool(*upstreamCAFile); err != nil {
+			log.Fatalf("Invalid -upstream-ca-file: %v", err)
+		}
+	}
+
+	var certRules []proxy.ClientCertRule
+	for _, raw := range clientCerts {
+		rule, err := proxy.LoadClientCertRule(raw)
+		if err != nil {
+			log.Fatalf("Invalid -client-cert: %v", err)
+		}
+		log.Printf("Using client certificate %q for %s", rule.Identity, rule.Pattern)
+		certRules = append(certRules, rule)
+	}
+
+	var headerValues []proxy.HeaderValue
+	for _, raw := range addHeaders {
+		header, err := proxy.ParseHeaderValue(raw)
+		if err != nil {
+			log.Fatalf("Invalid -add-header: %v", err)
+		}
+		headerValues = append(headerValues, header)
+	}
+
+	var forwards []proxy.Forward
+	for _, raw := range tcpForwards {
+		fwd, err := proxy.ParseForward("tcp", raw)
+		if err != nil {
+			log.Fatalf("Invalid -tcp-forward: %v", err)
+		}
+		forwards = append(forwards, fwd)
+	}
+	for protocol, list := range map[string]stringList{proxy.MailSMTP: smtpForwards, proxy.MailIMAP: imapForwards} {
+		for _, raw := range list {
+			fwd, err := proxy.ParseForward("tcp", raw)
+			if err != nil {
+				log.Fatalf("Invalid -%s-forward: %v", protocol, err)
+			}
+			fwd.Protocol = protocol
+			forwards = append(forwards, fwd)
+		}
+	}
+	for _, raw := range udpForwards {
+		fwd, err := proxy.ParseForward("udp", raw)
+		if err != nil {
+			log.Fatalf("Invalid -udp-forward: %v", err)
+		}
+		forwards = append(forwards, fwd)
+	}
+
+	for name, d := range map[string]time.Duration{"connect-timeout": *connectTimeout, "tls-timeout": *tlsTimeout, "response-header-timeout": *headerTimeout, "body-read-timeout": *bodyTimeout} {
+		if d < 0 {
+			log.Fatalf("Invalid -%s: must not be negative", name)
+		}
+	}
+	var hostTimeouts []proxy.TimeoutRule
+	for _, raw := range timeoutRules {
+		rule, err := proxy.ParseTimeoutRule(raw)
+		if err != nil {
+			log.Fatalf("Invalid -timeout-rule: %v", err)
+		}
+		hostTimeouts = append(hostTimeouts, rule)
+	}
+
+	retryPolicy := proxy.RetryPolicy{
+		MaxRetries: *retries,
+		Backoff:    *retryBackoff,
+		MaxBackoff: *retryMaxBackoff,
+	}
+	if err := retryPolicy.ParseRetryOn(*retryOn); err != nil {
+		log.Fatalf("Invalid -retry-on: %v", err)
+	}
+
+	var rules []proxy.BindRule
+	for _, raw := range bindRules {
+		rule, err := proxy.ParseBindRule(raw)
+		if err != nil {
+			log.Fatalf("Invalid -bind-outbound-rule: %v", err)
+		}
+		rules = append(rules, rule)
+	}
+
+	proxyAllow, err := allowlist.Parse(*allowClients)
+	if err != nil {
+		log.Fatalf("Invalid -allow-clients: %v", err)
+	}
+	apiAllow, err := allowlist.Parse(*apiAllowClients)
+	if err != nil {
+		log.Fatalf("Invalid -api-allow-clients: %v", err)
+	}
+
+	var forwarder *collector.Forwarder
+	if *forwardTo != "" {
+		source := *forwardSource
+		if source == "" {
+			source, _ = os.Hostname()
+		}
+		forwarder, err = collector.New(collector.Config{
+			URL:           *forwardTo,
+			Token:         *forwardToken,
+			Source:        source,
+			BatchSize:     *forwardBatch,
+			FlushInterval: *forwardInterval,
+		})
+		if err != nil {
+			log.Fatalf("Invalid -forward-captures: %v", err)
+		}
+	}
+
+	var tenants []proxy.Tenant
+	for _, raw := range tenantSpecs {
+		tenant, err := proxy.ParseTenant(raw)
+		if err != nil {
+			log.Fatalf("Invalid -tenant: %v", err)
+		}
+		for _, other := range tenants {
+			if other.Name == tenant.Name {
+				log.Fatalf("Invalid -tenant: %s is defined twice", tenant.Name)
+			}
+		}
+		if tenant.MaxRequests == 0 {
+			tenant.MaxRequests = *maxRequests
+		}
+		tenants = append(tenants, tenant)
+	}
+
 	// Print banner
 	printBanner(*proxyAddr, *apiAddr)
 
 	// Create the capture store
 	store := capture.NewStore(*maxRequests)
 
+	// Events for webhooks, from the proxy and from monitors
+	notifier := webhook.New(webhooks)
+	if *notifyConfig != "" {
+		data, err := os.ReadFile(*notifyConfig)
+		if err != nil {
+			log.Fatalf("Invalid -notify-config: %v", err)
+		}
+		sinks, err := webhook.ParseSinks(data)
+		if err != nil {
+			log.Fatalf("Invalid -notify-config: %v", err)
+		}
+		for _, sink := range sinks {
+			if err := notifier.AddSink(sink); err != nil {
+				log.Fatalf("Invalid -notify-config: %v", err)
+			}
+		}
+		log.Printf("Sending events to %d notification sinks", len(sinks))
+	}
+
+	// Traffic anomalies, reported through the notifier
+	var anomalies *anomaly.Detector
+	if *anomalyWindow < 0 {
+		log.Fatalf("Invalid -anomaly-window: must not be negative")
+	}
+	if *anomalyWindow > 0 {
+		if *anomalyMinRequests < 1 {
+			log.Fatalf("Invalid -anomaly-min-requests: must be at least 1")
+		}
+		anomalies = anomaly.New(anomaly.Config{
+			Window:      *anomalyWindow,
+			MinRequests: *anomalyMinRequests,
+			Watch:       anomalyWatch,
+		}, notifier)
+		log.Printf("Reporting traffic anomalies over %s windows", *anomalyWindow)
+	}
+
 	// Create and configure the proxy server
 	proxyConfig := proxy.DefaultConfig()
 	proxyConfig.ListenAddr = *proxyAddr
+	proxyConfig.MaxRequestSize = *maxBodySize
+	proxyConfig.AllowClients = proxyAllow
+	proxyConfig.CaptureQueueSize = *captureQueue
+	proxyConfig.CaptureRaw = *captureRaw
+	proxyConfig.PreserveHeaderOrder = *preserveHeaderOrder
+	proxyConfig.Faithful = *faithful
+	proxyConfig.CorrelationHeader = *correlationHeader
+	proxyConfig.Attach304Bodies = *attach304Bodies
+	proxyConfig.ScanPII = *scanPII
+	proxyConfig.ScanSecrets = *scanSecrets
+	proxyConfig.FirstParty = firstParty
+	proxyConfig.ReverseDNS = *reverseDNS
+	proxyConfig.ProbeTunnelCerts = *probeTunnelCerts
+	proxyConfig.BlockThirdParty = *blockThirdParty
+	proxyConfig.Bypass = bypass
+	proxyConfig.BlockSecrets = *blockSecrets
+	proxyConfig.DryRun = *dryRun
+	proxyConfig.Notifier = notifier
+	proxyConfig.Anomalies = anomalies
+	proxyConfig.Tenants = tenants
+	proxyConfig.Session = *session
+	proxyConfig.IPMode = mode
+	proxyConfig.BindOutbound = bind
+	proxyConfig.BindRules = rules
+	proxyConfig.ConnectPorts = ports
+	proxyConfig.ConnectUDPPorts = udpPorts
+	proxyConfig.UpstreamTLS = upstreamTLS
+	proxyConfig.ClientCerts = certRules
+	proxyConfig.Timeouts = &proxy.Timeouts{
+		Connect:        *connectTimeout,
+		TLSHandshake:   *tlsTimeout,
+		ResponseHeader: *headerTimeout,
+		BodyRead:       *bodyTimeout,
+	}
+	proxyConfig.TimeoutRules = hostTimeouts
+	proxyConfig.Retry = retryPolicy
+	proxyConfig.CircuitBreaker = proxy.CircuitBreakerConfig{
+		Threshold: *circuitThreshold,
+		Cooldown:  *circuitCooldown,
+	}
+	proxyConfig.AddHeaders = headerValues
+	proxyConfig.RemoveHeaders = removeHeaders
+	proxyConfig.Forwards = forwards
+	proxyConfig.ForwardSampleSize = *forwardSample
+	proxyConfig.MailBodies = *mailBodies
+	proxyConfig.MediaPlaceholderSize = *mediaPlaceholders
+	proxyConfig.UploadSpoolSize = *uploadSpool
+	proxyConfig.UploadDir = *uploadDir
+	proxyConfig.UploadRetention = *uploadRetention
+	proxyConfig.Crawl = proxy.CrawlConfig{
+		Delay:         *crawlDelay,
+		MaxWait:       *crawlMaxWait,
+		Robots:        *crawlRobots || *crawlRobotsEnforce,
+		EnforceRobots: *crawlRobotsEnforce,
+		UserAgent:     *crawlUserAgent,
+	}
+	if len(geoipDBs) > 0 {
+		db, err := geoip.Open(geoipDBs)
+		if err != nil {
+			log.Fatalf("Invalid -geoip-db: %v", err)
+		}
+		proxyConfig.GeoIP = db
+	}
+	if len(blocklists) > 0 {
+		proxyConfig.Blocklist = blocklist.New()
+		for _, source := range blocklists {
+			n, err := proxyConfig.Blocklist.LoadSource(source)
+			if err != nil {
+				log.Fatalf("Invalid -blocklist %s: %v", source, err)
+			}
+			log.Printf("Loaded %d blocking rules from %s", n, source)
+		}
+	}
+	keySource, rawKey := "GO_PROXY_CAPTURE_KEY", os.Getenv("GO_PROXY_CAPTURE_KEY")
+	if *captureKeyFile != "" {
+		data, err := os.ReadFile(*captureKeyFile)
+		if err != nil {
+			log.Fatalf("Invalid -capture-key-file: %v", err)
+		}
+		keySource, rawKey = "-capture-key-file", string(data)
+	}
+	if rawKey != "" {
+		if proxyConfig.CaptureKey, err = seal.ParseKey(rawKey); err != nil {
+			log.Fatalf("Invalid %s: %v", keySource, err)
+		}
+		if *warcFile != "" {
+			log.Fatalf("-warc writes captures unencrypted and cannot be combined with %s", keySource)
+		}
+		log.Printf("Encrypting capture data at rest with the key from %s", keySource)
+	}
+	// Files to close and settings to undo on the way out, last first. They
+	// run explicitly after the servers stop rather than deferred, since a
+	// restart replaces the process and skips deferred calls.
+	var cleanups []func()
+	if *warcFile != "" {
+		f, err := os.OpenFile(*warcFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			log.Fatalf("Invalid -warc: %v", err)
+		}
+		cleanups = append(cleanups, func() { f.Close() })
+		if proxyConfig.WARC, err = export.NewWARCWriter(f, strings.HasSuffix(*warcFile, ".gz")); err != nil {
+			log.Fatalf("Invalid -warc: %v", err)
+		}
+		log.Printf("Archiving exchanges to %s", *warcFile)
+	}
+	proxyConfig.HTTP2 = *http2
+	proxyConfig.UpstreamHTTP2 = *upstreamHTTP2
+	proxyConfig.DNSCache = *dnsCache
+	proxyConfig.DNSCacheConfig.DefaultTTL = *dnsTTL
+	proxyConfig.DNSCacheConfig.MaxTTL = *dnsMaxTTL
+	proxyConfig.DNSCacheConfig.NegativeTTL = *dnsNegativeTTL
+	proxyConfig.DNSCacheConfig.MaxEntries = *dnsCacheEntries
 	proxyServer := proxy.NewServer(proxyConfig, store)
 
 	// Create the API server
-	apiServer := api.NewServer(store, *apiAddr)
+	setupHost := *advertiseHost
+	if setupHost == "" {
+		setupHost = "127.0.0.1"
+		if ip, err := mdns.LocalIPv4(); err == nil {
+			setupHost = ip.String()
+		}
+	}
+	_, proxyPort, _ := net.SplitHostPort(*proxyAddr)
+	_, apiPort, _ := net.SplitHostPort(*apiAddr)
+
+	apiConfig := api.Config{
+		Addr:            *apiAddr,
+		GRPCAddr:        *grpcAddr,
+		AllowClients:    apiAllow,
+		CORSCredentials: *corsCredentials,
+		Setup: api.Setup{
+			ProxyAddr: net.JoinHostPort(setupHost, proxyPort),
+			APIURL:    "http://" + net.JoinHostPort(setupHost, apiPort),
+		},
+		PathTemplates: capture.NewPathTemplates(*pathAutoIDs),
+		Monitors:      monitor.NewScheduler(notifier),
+		Anomalies:     anomalies,
+		Collector:     *collectorMode,
+	}
+	for _, spec := range pathTemplates {
+		if err := apiConfig.PathTemplates.Add(spec); err != nil {
+			log.Fatalf("Invalid -path-template: %v", err)
+		}
+	}
+	if *auditFile != "" {
+		f, err := os.OpenFile(*auditFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			log.Fatalf("Invalid -audit-log: %v", err)
+		}
+		cleanups = append(cleanups, func() { f.Close() })
+		apiConfig.AuditLog = f
+	}
+	for _, origin := range strings.Split(*corsOrigins, ",") {
+		if origin = strings.TrimSuffix(strings.TrimSpace(origin), "/"); origin != "" {
+			apiConfig.CORSOrigins = append(apiConfig.CORSOrigins, origin)
+		}
+	}
+	if *corsCredentials && len(apiConfig.CORSOrigins) == 0 {
+		log.Fatalf("Invalid -cors-credentials: needs -cors-origins, since credentials would go to any origin")
+	}
+	for _, raw := range apiTokens {
+		token, err := api.ParseToken(raw)
+		if err != nil {
+			log.Fatalf("Invalid -api-token: %v", err)
+		}
+		if token.Tenant != "" && proxyServer.TenantStore(token.Tenant) == nil {
+			log.Fatalf("Invalid -api-token: unknown tenant %q", token.Tenant)
+		}
+		apiConfig.Tokens = append(apiConfig.Tokens, token)
+	}
+	apiServer := api.NewServer(proxyServer, apiConfig)
 
 	// Set up graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
@@ -44,7 +556,7 @@ func main() {
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
 	// Start servers in goroutines
-	errChan := make(chan error, 2)
+	errChan := make(chan error, 3)
 
 	go func() {
 		if err := proxyServer.Start(); err != nil {
@@ -58,16 +570,63 @@ func main() {
 		}
 	}()
 
-	// Wait for shutdown signal or error
+	go func() {
+		if err := apiServer.StartGRPC(); err != nil {
+			errChan <- fmt.Errorf("gRPC server error: %w", err)
+		}
+	}()
+
+	if *setSystemProxy {
+		host, port, err := systemProxyTarget(*proxyAddr)
+		if err == nil {
+			err = enableSystemProxy(host, port)
+		}
+		if err != nil {
+			log.Printf("Could not set the system proxy: %v", err)
+		} else {
+			log.Printf("System proxy set to %s:%s", host, port)
+			cleanups = append(cleanups, func() {
+				if err := disableSystemProxy(); err != nil {
+					log.Printf("Could not disable the system proxy: %v", err)
+				}
+			})
+		}
+	}
+
+	forwarded := make(chan struct{})
+	if forwarder != nil {
+		log.Printf("Forwarding captures to %s", *forwardTo)
+		go func() {
+			defer close(forwarded)
+			forwarder.Run(ctx, store)
+		}()
+	} else {
+		close(forwarded)
+	}
+
+	if *advertiseMDNS {
+		go func() {
+			if err := advertise(ctx, setupHost, proxyPort, apiConfig.Setup); err != nil {
+				log.Printf("mDNS advertisement failed: %v", err)
+			}
+		}()
+	}
+
+	// Wait for shutdown signal, admin request or error
+	restart := false
 	select {
 	case sig := <-sigChan:
 		log.Printf("Received signal %v, shutting down...", sig)
+	case action := <-apiServer.AdminActions():
+		log.Printf("Received %s request through the API, shutting down...", action)
+		restart = action == api.AdminRestart
 	case err := <-errChan:
 		log.Printf("Server error: %v", err)
 	}
 
 	// Graceful shutdown with timeout
-	shutdownCtx, shutdownCancel := context.WithTimeout(ctx, 10*time.Second)
+	cancel()
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer shutdownCancel()
 
 	if err := proxyServer.Shutdown(shutdownCtx); err != nil {
@@ -76,8 +635,71 @@ func main() {
 	if err := apiServer.Shutdown(shutdownCtx); err != nil {
 		log.Printf("API server shutdown error: %v", err)
 	}
+	apiConfig.Monitors.Close()
+	if anomalies != nil {
+		anomalies.Close()
+	}
+	<-forwarded
 
 	log.Println("Servers stopped")
+	for i := len(cleanups) - 1; i >= 0; i-- {
+		cleanups[i]()
+	}
+
+	if restart {
+		log.Println("Restarting")
+		if err := restartProcess(); err != nil {
+			log.Fatalf("Restart failed: %v", err)
+		}
+	}
+}
+
+// restartProcess replaces the process with a fresh copy, same flags and
+// environment; captures held in memory do not survive. Windows cannot
+// replace a running process, so there a copy is started and the caller
+// exits.
+func restartProcess() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if runtime.GOOS == "windows" {
+		cmd := exec.Command(exe, os.Args[1:]...)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+		return cmd.Start()
+	}
+	return syscall.Exec(exe, os.Args, os.Environ())
+}
+
+// advertise announces the proxy over mDNS until ctx is done
+func advertise(ctx context.Context, host, port string, setup api.Setup) error {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return fmt.Errorf("-advertise-host %q is not an IP address", host)
+	}
+	portNum, err := strconv.Atoi(port)
+	if err != nil {
+		return fmt.Errorf("invalid proxy port %q", port)
+	}
+	hostname, _ := os.Hostname()
+	hostname, _, _ = strings.Cut(hostname, ".")
+	if hostname == "" {
+		hostname = "go-proxy"
+	}
+
+	log.Printf("Advertising the proxy over mDNS as %s.local", hostname)
+	return mdns.Advertise(ctx, mdns.Service{
+		Instance: "Go Proxy on " + hostname,
+		Type:     "_http-proxy._tcp",
+		Host:     hostname,
+		IP:       ip,
+		Port:     portNum,
+		TXT: []string{
+			"proxy=" + setup.ProxyAddr,
+			"api=" + setup.APIURL,
+			"qr=" + setup.APIURL + "/api/setup/qr",
+		},
+	})
 }
 
 func printBanner(proxyAddr, apiAddr string) {
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"text/template"
+)
+
+const (
+	// serviceName names the systemd unit and the Windows task
+	serviceName = "go_proxy"
+	// serviceLabel names the launchd agent
+	serviceLabel = "com.github.adamdrake.go_proxy"
+)
+
+const serviceUsage = `usage: proxy service install [proxy flags...]
+       proxy service uninstall|start|stop|status
+
+Runs the proxy in the background for the current user, started at login:
+a systemd user unit on Linux, a launchd agent on macOS and a logon task on
+Windows. Flags given to install are used every time the service starts.
+`
+
+// runService handles the service subcommand
+func runService(args []string) error {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, serviceUsage)
+		return fmt.Errorf("missing service command")
+	}
+
+	var svc serviceManager
+	switch runtime.GOOS {
+	case "linux":
+		svc = systemdService{}
+	case "darwin":
+		svc = launchdService{}
+	case "windows":
+		svc = windowsService{}
+	default:
+		return fmt.Errorf("services are not supported on %s", runtime.GOOS)
+	}
+
+	switch command, flags := args[0], args[1:]; command {
+	case "install":
+		exe, err := os.Executable()
+		if err != nil {
+			return err
+		}
+		if exe, err = filepath.EvalSymlinks(exe); err != nil {
+			return err
+		}
+		if err := svc.install(exe, flags); err != nil {
+			return err
+		}
+		fmt.Println("Installed; start it now with: proxy service start")
+		return nil
+	case "uninstall":
+		return svc.uninstall()
+	case "start":
+		return svc.start()
+	case "stop":
+		return svc.stop()
+	case "status":
+		return svc.status()
+	default:
+		fmt.Fprint(os.Stderr, serviceUsage)
+		return fmt.Errorf("unknown service command %q", command)
+	}
+}
+
+// serviceManager installs and controls the proxy as a per-user service
+type serviceManager interface {
+	install(exe string, flags []string) error
+	uninstall() error
+	start() error
+	stop() error
+	status() error
+}
+
+// run executes a service manager command with its output shown
+func run(name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s %s: %w", name, strings.Join(args, " "), err)
+	}
+	return nil
+}
+
+// writeServiceFile renders tmpl with data into path
+func writeServiceFile(path string, tmpl *template.Template, data interface{}) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := tmpl.Execute(f, data); err != nil {
+		f.Close()
+		return err
+	}
+	fmt.Println("Wrote", path)
+	return f.Close()
+}
+
+// systemdService manages a systemd user unit
+type systemdService struct{}
+
+var systemdUnit = template.Must(template.New("unit").Parse(`[Unit]
+Description=Go Proxy
+After=network-online.target
+
+[Service]
+ExecStart={{.Command}}
+Restart=on-failure
+RestartSec=5
+
+[Install]
+WantedBy=default.target
+`))
+
+func (systemdService) unitPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "systemd", "user", serviceName+".service"), nil
+}
+
+func (s systemdService) install(exe string, flags []string) error {
+	path, err := s.unitPath()
+	if err != nil {
+		return err
+	}
+	// systemd splits ExecStart like a shell, honouring double quotes, and
+	// expands % specifiers and $ variables
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "%", "%%", "$", "$$")
+	words := make([]string, 0, len(flags)+1)
+	for _, word := range append([]string{exe}, flags...) {
+		words = append(words, `"`+escape.Replace(word)+`"`)
+	}
+	if err := writeServiceFile(path, systemdUnit, map[string]string{"Command": strings.Join(words, " ")}); err != nil {
+		return err
+	}
+	if err := run("systemctl", "--user", "daemon-reload"); err != nil {
+		return err
+	}
+	return run("systemctl", "--user", "enable", serviceName)
+}
+
+func (s systemdService) uninstall() error {
+	path, err := s.unitPath()
+	if err != nil {
+		return err
+	}
+	run("systemctl", "--user", "disable", "--now", serviceName)
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	return run("systemctl", "--user", "daemon-reload")
+}
+
+func (systemdService) start() error {
+	return run("systemctl", "--user", "start", serviceName)
+}
+
+func (systemdService) stop() error {
+	return run("systemctl", "--user", "stop", serviceName)
+}
+
+func (systemdService) status() error {
+	return run("systemctl", "--user", "status", serviceName)
+}
+
+// launchdService manages a launchd agent
+type launchdService struct{}
+
+var launchdPlist = template.Must(template.New("plist").Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>{{.Label}}</string>
+	<key>ProgramArguments</key>
+	<array>
+{{- range .Args}}
+		<string>{{.}}</string>
+{{- end}}
+	</array>
+	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	<dict>
+		<key>SuccessfulExit</key>
+		<false/>
+	</dict>
+	<key>StandardOutPath</key>
+	<string>{{.Log}}</string>
+	<key>StandardErrorPath</key>
+	<string>{{.Log}}</string>
+</dict>
+</plist>
+`))
+
+func (launchdService) plistPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, "Library", "LaunchAgents", serviceLabel+".plist"), nil
+}
+
+func (s launchdService) install(exe string, flags []string) error {
+	path, err := s.plistPath()
+	if err != nil {
+		return err
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return err
+	}
+	// text/template does not escape, so arguments are escaped here
+	args := make([]string, 0, len(flags)+1)
+	for _, arg := range append([]string{exe}, flags...) {
+		args = append(args, xmlEscape(arg))
+	}
+	return writeServiceFile(path, launchdPlist, map[string]interface{}{
+		"Label": serviceLabel,
+		"Args":  args,
+		"Log":   xmlEscape(filepath.Join(home, "Library", "Logs", serviceName+".log")),
+	})
+}
+
+func (s launchdService) uninstall() error {
+	path, err := s.plistPath()
+	if err != nil {
+		return err
+	}
+	run("launchctl", "unload", path)
+	return os.Remove(path)
+}
+
+func (s launchdService) start() error {
+	path, err := s.plistPath()
+	if err != nil {
+		return err
+	}
+	return run("launchctl", "load", "-w", path)
+}
+
+func (s launchdService) stop() error {
+	path, err := s.plistPath()
+	if err != nil {
+		return err
+	}
+	return run("launchctl", "unload", path)
+}
+
+func (launchdService) status() error {
+	return run("launchctl", "list", serviceLabel)
+}
+
+// windowsService manages a scheduled task started at logon. A real
+// Windows service would have to speak the service control protocol; a
+// logon task runs the proxy as the user, which also lets it change the
+// user's proxy settings.
+type windowsService struct{}
+
+func (windowsService) install(exe string, flags []string) error {
+	words := make([]string, 0, len(flags)+1)
+	for _, word := range append([]string{exe}, flags...) {
+		words = append(words, `"`+strings.ReplaceAll(word, `"`, `\"`)+`"`)
+	}
+	return run("schtasks", "/Create", "/F", "/TN", serviceName, "/SC", "ONLOGON", "/RL", "LIMITED", "/TR", strings.Join(words, " "))
+}
+
+func (windowsService) uninstall() error {
+	run("schtasks", "/End", "/TN", serviceName)
+	return run("schtasks", "/Delete", "/F", "/TN", serviceName)
+}
+
+func (windowsService) start() error {
+	return run("schtasks", "/Run", "/TN", serviceName)
+}
+
+func (windowsService) stop() error {
+	return run("schtasks", "/End", "/TN", serviceName)
+}
+
+func (windowsService) status() error {
+	return run("schtasks", "/Query", "/TN", serviceName, "/V", "/FO", "LIST")
+}
+
+// xmlEscape escapes s for a plist string
+func xmlEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
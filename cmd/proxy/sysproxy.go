@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// windowsInternetSettings is the registry key holding the user's proxy
+const windowsInternetSettings = `HKCU\Software\Microsoft\Windows\CurrentVersion\Internet Settings`
+
+// runSystemProxy handles the enable-system-proxy and
+// disable-system-proxy subcommands
+func runSystemProxy(command string, args []string) error {
+	fs := flag.NewFlagSet(command, flag.ExitOnError)
+	proxyAddr := fs.String("proxy", ":8080", "Proxy listen address to point the system at")
+	fs.Parse(args)
+
+	if command == "disable-system-proxy" {
+		if err := disableSystemProxy(); err != nil {
+			return err
+		}
+		fmt.Println("System proxy disabled")
+		return nil
+	}
+	host, port, err := systemProxyTarget(*proxyAddr)
+	if err != nil {
+		return err
+	}
+	if err := enableSystemProxy(host, port); err != nil {
+		return err
+	}
+	fmt.Printf("System proxy set to %s:%s\n", host, port)
+	return nil
+}
+
+// systemProxyTarget turns a listen address into the host and port local
+// applications should use; wildcard listeners are reached on loopback
+func systemProxyTarget(listenAddr string) (string, string, error) {
+	host, port, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid proxy address %q: %w", listenAddr, err)
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+	return host, port, nil
+}
+
+// enableSystemProxy points the OS HTTP and HTTPS proxy settings at
+// host:port: every network service on macOS, the user's Internet
+// settings on Windows, and the desktop proxy settings on GNOME
+func enableSystemProxy(host, port string) error {
+	switch runtime.GOOS {
+	case "darwin":
+		services, err := macNetworkServices()
+		if err != nil {
+			return err
+		}
+		for _, svc := range services {
+			if err := runQuiet("networksetup", "-setwebproxy", svc, host, port); err != nil {
+				return err
+			}
+			if err := runQuiet("networksetup", "-setsecurewebproxy", svc, host, port); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "windows":
+		if err := runQuiet("reg", "add", windowsInternetSettings, "/v", "ProxyServer", "/t", "REG_SZ", "/d", net.JoinHostPort(host, port), "/f"); err != nil {
+			return err
+		}
+		return runQuiet("reg", "add", windowsInternetSettings, "/v", "ProxyEnable", "/t", "REG_DWORD", "/d", "1", "/f")
+	case "linux":
+		for _, schema := range []string{"org.gnome.system.proxy.http", "org.gnome.system.proxy.https"} {
+			if err := runQuiet("gsettings", "set", schema, "host", host); err != nil {
+				return fmt.Errorf("%w (only GNOME desktops are supported)", err)
+			}
+			if err := runQuiet("gsettings", "set", schema, "port", port); err != nil {
+				return err
+			}
+		}
+		return runQuiet("gsettings", "set", "org.gnome.system.proxy", "mode", "manual")
+	default:
+		return fmt.Errorf("system proxy configuration is not supported on %s", runtime.GOOS)
+	}
+}
+
+// disableSystemProxy turns the OS HTTP and HTTPS proxy settings off
+func disableSystemProxy() error {
+	switch runtime.GOOS {
+	case "darwin":
+		services, err := macNetworkServices()
+		if err != nil {
+			return err
+		}
+		for _, svc := range services {
+			if err := runQuiet("networksetup", "-setwebproxystate", svc, "off"); err != nil {
+				return err
+			}
+			if err := runQuiet("networksetup", "-setsecurewebproxystate", svc, "off"); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "windows":
+		return runQuiet("reg", "add", windowsInternetSettings, "/v", "ProxyEnable", "/t", "REG_DWORD", "/d", "0", "/f")
+	case "linux":
+		if err := runQuiet("gsettings", "set", "org.gnome.system.proxy", "mode", "none"); err != nil {
+			return fmt.Errorf("%w (only GNOME desktops are supported)", err)
+		}
+		return nil
+	default:
+		return fmt.Errorf("system proxy configuration is not supported on %s", runtime.GOOS)
+	}
+}
+
+// macNetworkServices lists the enabled macOS network services
+func macNetworkServices() ([]string, error) {
+	out, err := exec.Command("networksetup", "-listallnetworkservices").Output()
+	if err != nil {
+		return nil, fmt.Errorf("networksetup -listallnetworkservices: %w", err)
+	}
+	var services []string
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		// The first line is a legend; disabled services start with '*'
+		if line == "" || strings.HasPrefix(line, "*") || strings.HasPrefix(line, "An asterisk") {
+			continue
+		}
+		services = append(services, line)
+	}
+	return services, nil
+}
+
+// runQuiet runs a command, reporting its output only on failure
+func runQuiet(name string, args ...string) error {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			fmt.Fprintln(os.Stderr, msg)
+		}
+		return fmt.Errorf("%s %s: %w", name, strings.Join(args, " "), err)
+	}
+	return nil
+}
@@ -1,5 +1,5 @@
 module github.com/adamdrake/go_proxy
 
-go 1.21
+go 1.24
 
 require github.com/google/uuid v1.6.0
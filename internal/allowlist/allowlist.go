@@ -0,0 +1,89 @@
+package allowlist
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"strings"
+)
+
+// List is a set of client networks. An empty List allows everyone.
+type List []netip.Prefix
+
+// Parse parses a comma-separated list of CIDR prefixes and single
+// addresses, e.g. "10.0.0.0/8,192.168.1.20,::1"
+func Parse(s string) (List, error) {
+	var list List
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		if prefix, err := netip.ParsePrefix(part); err == nil {
+			list = append(list, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(part)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", part)
+		}
+		list = append(list, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return list, nil
+}
+
+// Allows reports whether the address of a connection is on the list
+func (l List) Allows(addr net.Addr) bool {
+	if len(l) == 0 {
+		return true
+	}
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return false
+	}
+	// IPv4 clients of dual-stack listeners arrive as ::ffff:a.b.c.d
+	ip := ap.Addr().Unmap()
+	for _, prefix := range l {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// String lists the networks for logs
+func (l List) String() string {
+	parts := make([]string, len(l))
+	for i, prefix := range l {
+		parts[i] = prefix.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+// Listener closes connections from clients not on list as soon as they
+// are accepted
+func Listener(inner net.Listener, list List) net.Listener {
+	if len(list) == 0 {
+		return inner
+	}
+	return &listener{Listener: inner, list: list}
+}
+
+type listener struct {
+	net.Listener
+	list List
+}
+
+func (l *listener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if l.list.Allows(conn.RemoteAddr()) {
+			return conn, nil
+		}
+		log.Printf("Rejected connection from %s to %s", conn.RemoteAddr(), l.Addr())
+		conn.Close()
+	}
+}
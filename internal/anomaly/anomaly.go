@@ -0,0 +1,399 @@
+// Package anomaly watches proxied traffic over rolling windows and reports
+// sudden changes per host, such as an error-rate spike, latency doubling
+// or a watched host going quiet, as events for webhooks and the live
+// stream. It is meant for long soak tests, where nobody watches the
+// captures as they arrive.
+package anomaly
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+	"github.com/adamdrake/go_proxy/internal/hostmatch"
+	"github.com/adamdrake/go_proxy/internal/webhook"
+)
+
+// Anomaly kinds
+const (
+	// KindErrorSpike is a host's share of failed requests (5xx or no
+	// response) at least doubling, to errorSpikeMin or more
+	KindErrorSpike = "error_spike"
+	// KindLatencySpike is a host's median latency at least doubling, by
+	// latencySpikeMin or more
+	KindLatencySpike = "latency_spike"
+	// KindTrafficDrop is a watched host getting no requests in a window
+	// after getting some
+	KindTrafficDrop = "traffic_drop"
+)
+
+// eventTypes are the webhook event types per kind
+var eventTypes = map[string]string{
+	KindErrorSpike:   webhook.EventAnomalyErrorSpike,
+	KindLatencySpike: webhook.EventAnomalyLatencySpike,
+	KindTrafficDrop:  webhook.EventAnomalyTrafficDrop,
+}
+
+// DefaultMinRequests is how many requests a window needs before its error
+// rate and latency are judged
+const DefaultMinRequests = 20
+
+const (
+	// baselineWindows is how many normal windows make up a host's baseline
+	baselineWindows = 5
+	// errorSpikeMin is the lowest error rate that counts as a spike
+	errorSpikeMin = 0.1
+	// latencySpikeMin is the least a median must rise by to count as a
+	// spike, so that noise on sub-millisecond baselines does not
+	latencySpikeMin = 25 * time.Millisecond
+	// maxEvents is how many recent events are kept
+	maxEvents = 100
+)
+
+// Config tunes a detector
+type Config struct {
+	// Window is the length of the rolling windows compared
+	Window time.Duration
+	// MinRequests is how many requests a window needs before its error
+	// rate and latency are judged (DefaultMinRequests when 0)
+	MinRequests int
+	// Watch lists the hosts whose traffic dropping to zero is reported,
+	// as hostmatch patterns
+	Watch []string
+}
+
+// Event is an anomaly starting or, with Resolved, ending
+type Event struct {
+	Kind     string    `json:"kind"`
+	Host     string    `json:"host"`
+	Tenant   string    `json:"tenant,omitempty"`
+	Time     time.Time `json:"time"`
+	Resolved bool      `json:"resolved,omitempty"`
+	Summary  string    `json:"summary"`
+
+	// Current is the window's error rate (0 to 1), median latency in
+	// milliseconds or request count, by kind, and Baseline the same over
+	// the host's recent normal windows
+	Current  float64 `json:"current"`
+	Baseline float64 `json:"baseline"`
+	// Requests the window saw
+	Requests int `json:"requests"`
+}
+
+// window collects one host's requests until the window closes
+type window struct {
+	requests  int
+	errors    int
+	latencies []time.Duration
+}
+
+// summary is a closed window
+type summary struct {
+	requests int
+	errors   int
+	median   time.Duration
+}
+
+// key identifies a host within a tenant
+type key struct {
+	tenant string
+	host   string
+}
+
+// hostState is the traffic of one host
+type hostState struct {
+	current window
+	// history holds the latest normal windows, oldest first
+	history []summary
+	// active holds the kinds of anomaly currently open
+	active map[string]bool
+	// idle counts the windows in a row without requests
+	idle int
+}
+
+// Detector compares each host's latest window with its recent normal ones
+// and emits an event when an anomaly starts or ends
+type Detector struct {
+	mu          sync.Mutex
+	config      Config
+	hosts       map[key]*hostState
+	events      []Event
+	subscribers map[chan Event]struct{}
+	notifier    *webhook.Notifier
+
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// New starts a detector closing a window every config.Window and
+// reporting anomalies through notifier (nil for none)
+func New(config Config, notifier *webhook.Notifier) *Detector {
+	if config.MinRequests <= 0 {
+		config.MinRequests = DefaultMinRequests
+	}
+	d := &Detector{
+		config:      config,
+		hosts:       make(map[key]*hostState),
+		subscribers: make(map[chan Event]struct{}),
+		notifier:    notifier,
+		stop:        make(chan struct{}),
+	}
+	go d.run()
+	return d
+}
+
+// run closes a window on every tick until the detector is closed
+func (d *Detector) run() {
+	ticker := time.NewTicker(d.config.Window)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			d.tick(now)
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+// Close stops the detector
+func (d *Detector) Close() {
+	d.closeOnce.Do(func() { close(d.stop) })
+}
+
+// Observe counts a finished capture in its host's current window.
+// Tunnels, whose duration is the connection's, and requests the proxy
+// blocked are left out.
+func (d *Detector) Observe(req *capture.CapturedRequest) {
+	if req.IsTunnel || req.Blocked {
+		return
+	}
+	k := key{tenant: req.Tenant, host: hostmatch.Normalize(req.Host)}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	h := d.hosts[k]
+	if h == nil {
+		h = &hostState{active: make(map[string]bool)}
+		d.hosts[k] = h
+	}
+	h.current.requests++
+	if req.StatusCode == 0 || req.StatusCode >= 500 {
+		h.current.errors++
+	}
+	h.current.latencies = append(h.current.latencies, req.Duration)
+}
+
+// tick closes every host's window, compares it with the baseline and
+// emits the anomalies that started or ended
+func (d *Detector) tick(now time.Time) {
+	var events []Event
+
+	d.mu.Lock()
+	for k, h := range d.hosts {
+		s := h.current.close()
+		h.current = window{}
+		watched := hostmatch.MatchAny(d.config.Watch, k.host)
+
+		for _, e := range d.evaluate(k, h, s, watched) {
+			e.Time = now
+			events = append(events, e)
+		}
+
+		if s.requests == 0 {
+			h.idle++
+		} else {
+			h.idle = 0
+		}
+		if s.requests > 0 && len(h.active) == 0 {
+			h.history = append(h.history, s)
+			if len(h.history) > baselineWindows {
+				h.history = h.history[1:]
+			}
+		}
+		if h.idle >= baselineWindows && len(h.active) == 0 && !watched {
+			delete(d.hosts, k)
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].Host != events[j].Host {
+			return events[i].Host < events[j].Host
+		}
+		return events[i].Kind < events[j].Kind
+	})
+	d.events = append(d.events, events...)
+	if len(d.events) > maxEvents {
+		d.events = d.events[len(d.events)-maxEvents:]
+	}
+	for _, e := range events {
+		for ch := range d.subscribers {
+			select {
+			case ch <- e:
+			default:
+			}
+		}
+	}
+	d.mu.Unlock()
+
+	for _, e := range events {
+		log.Printf("[ANOMALY] %s", e.Summary)
+		if d.notifier != nil {
+			d.notifier.Notify(webhook.Event{
+				Type:     eventTypes[e.Kind],
+				Time:     e.Time,
+				Summary:  e.Summary,
+				Data:     e,
+				Key:      "anomaly/" + e.Tenant + "/" + e.Host + "/" + e.Kind,
+				Resolved: e.Resolved,
+			})
+		}
+	}
+}
+
+// close summarizes a window
+func (w window) close() summary {
+	s := summary{requests: w.requests, errors: w.errors}
+	if len(w.latencies) > 0 {
+		slices.Sort(w.latencies)
+		s.median = w.latencies[len(w.latencies)/2]
+	}
+	return s
+}
+
+// evaluate opens and closes h's anomalies for its latest window s
+func (d *Detector) evaluate(k key, h *hostState, s summary, watched bool) []Event {
+	var baseRequests, baseErrors, judged int
+	var baseLatency time.Duration
+	for _, past := range h.history {
+		baseRequests += past.requests
+		baseErrors += past.errors
+		if past.requests >= d.config.MinRequests {
+			baseLatency += past.median
+			judged++
+		}
+	}
+
+	var events []Event
+	set := func(kind string, on bool, e Event) {
+		if on == h.active[kind] {
+			return
+		}
+		if on {
+			h.active[kind] = true
+		} else {
+			delete(h.active, kind)
+		}
+		e.Kind, e.Host, e.Tenant, e.Resolved, e.Requests = kind, k.host, k.tenant, !on, s.requests
+		events = append(events, e)
+	}
+
+	if s.requests >= d.config.MinRequests && baseRequests >= d.config.MinRequests {
+		rate := float64(s.errors) / float64(s.requests)
+		baseRate := float64(baseErrors) / float64(baseRequests)
+		e := Event{Current: rate, Baseline: baseRate}
+		spike := rate >= max(errorSpikeMin, 2*baseRate)
+		if spike {
+			e.Summary = fmt.Sprintf("Error rate on %s rose to %.0f%% (baseline %.0f%%) in the last %s", k.host, 100*rate, 100*baseRate, d.config.Window)
+		} else {
+			e.Summary = fmt.Sprintf("Error rate on %s back to %.0f%% (baseline %.0f%%)", k.host, 100*rate, 100*baseRate)
+		}
+		set(KindErrorSpike, spike, e)
+	}
+
+	if s.requests >= d.config.MinRequests && judged > 0 {
+		base := baseLatency / time.Duration(judged)
+		e := Event{Current: milliseconds(s.median), Baseline: milliseconds(base)}
+		spike := s.median >= 2*base && s.median-base >= latencySpikeMin
+		if spike {
+			e.Summary = fmt.Sprintf("Median latency on %s doubled to %s (baseline %s) in the last %s", k.host, s.median.Round(time.Millisecond), base.Round(time.Millisecond), d.config.Window)
+		} else {
+			e.Summary = fmt.Sprintf("Median latency on %s back to %s (baseline %s)", k.host, s.median.Round(time.Millisecond), base.Round(time.Millisecond))
+		}
+		set(KindLatencySpike, spike, e)
+	}
+
+	if watched && len(h.history) > 0 {
+		base := float64(baseRequests) / float64(len(h.history))
+		e := Event{Current: float64(s.requests), Baseline: base}
+		if s.requests == 0 {
+			e.Summary = fmt.Sprintf("No traffic to %s in the last %s (baseline %.0f requests per window)", k.host, d.config.Window, base)
+		} else {
+			e.Summary = fmt.Sprintf("Traffic to %s resumed: %d requests in the last %s", k.host, s.requests, d.config.Window)
+		}
+		set(KindTrafficDrop, s.requests == 0, e)
+	}
+	return events
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// Config returns the detector's settings
+func (d *Detector) Config() Config {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	config := d.config
+	config.Watch = append([]string{}, d.config.Watch...)
+	return config
+}
+
+// SetWatch replaces the hosts watched for traffic drops
+func (d *Detector) SetWatch(hosts []string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.config.Watch = append([]string{}, hosts...)
+}
+
+// Events returns the recent events, oldest first
+func (d *Detector) Events() []Event {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]Event{}, d.events...)
+}
+
+// Active returns the event that opened each anomaly still open
+func (d *Detector) Active() []Event {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	open := make(map[string]Event)
+	for _, e := range d.events {
+		id := e.Tenant + "/" + e.Host + "/" + e.Kind
+		if e.Resolved {
+			delete(open, id)
+		} else {
+			open[id] = e
+		}
+	}
+	active := make([]Event, 0, len(open))
+	for k, h := range d.hosts {
+		for kind := range h.active {
+			if e, ok := open[k.tenant+"/"+k.host+"/"+kind]; ok {
+				active = append(active, e)
+			}
+		}
+	}
+	sort.Slice(active, func(i, j int) bool { return active[i].Time.Before(active[j].Time) })
+	return active
+}
+
+// Subscribe returns a channel receiving events as they happen
+func (d *Detector) Subscribe() chan Event {
+	ch := make(chan Event, 16)
+	d.mu.Lock()
+	d.subscribers[ch] = struct{}{}
+	d.mu.Unlock()
+	return ch
+}
+
+// Unsubscribe stops sending events to ch
+func (d *Detector) Unsubscribe(ch chan Event) {
+	d.mu.Lock()
+	delete(d.subscribers, ch)
+	d.mu.Unlock()
+}
@@ -0,0 +1,48 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// AdminAction is a lifecycle change requested through the API
+type AdminAction string
+
+const (
+	AdminShutdown AdminAction = "shutdown"
+	AdminRestart  AdminAction = "restart"
+)
+
+// AdminActions delivers shutdown and restart requests made through the
+// API; the process acts on them
+func (s *Server) AdminActions() <-chan AdminAction {
+	return s.admin
+}
+
+// handleAdminAction returns a handler requesting action. Admin endpoints
+// need an admin token, so they are unavailable while the API is open.
+func (s *Server) handleAdminAction(action AdminAction) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if len(s.tokens) == 0 {
+			http.Error(w, "Forbidden: admin endpoints need -api-token", http.StatusForbidden)
+			return
+		}
+
+		select {
+		case s.admin <- action:
+		default:
+			http.Error(w, "Another admin action is in progress", http.StatusConflict)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": string(action),
+		})
+	}
+}
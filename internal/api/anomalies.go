@@ -0,0 +1,54 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// anomalyWatchRequest is the body of PUT /api/anomalies
+type anomalyWatchRequest struct {
+	Watch []string `json:"watch"`
+}
+
+// handleAnomalies reports the traffic anomalies open and recently seen
+// (GET), or replaces the hosts watched for traffic drops (PUT)
+func (s *Server) handleAnomalies(w http.ResponseWriter, r *http.Request) {
+	if s.anomalies == nil {
+		http.Error(w, "Anomaly detection is off (start with -anomaly-window)", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req anomalyWatchRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		watch := []string{}
+		for _, host := range req.Watch {
+			if host = strings.TrimSpace(host); host != "" {
+				watch = append(watch, host)
+			}
+		}
+		s.anomalies.SetWatch(watch)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	config := s.anomalies.Config()
+	if config.Watch == nil {
+		config.Watch = []string{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"window":       config.Window.String(),
+		"min_requests": config.MinRequests,
+		"watch":        config.Watch,
+		"active":       s.anomalies.Active(),
+		"events":       s.anomalies.Events(),
+	})
+}
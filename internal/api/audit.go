@@ -0,0 +1,197 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/adamdrake/go_proxy/internal/collector"
+)
+
+const (
+	// maxAuditEntries is how many audit entries are kept in memory; the
+	// audit file, if any, keeps them all
+	maxAuditEntries = 10000
+
+	// maxAuditPayload is how much of a request body an entry records
+	maxAuditPayload = 64 * 1024
+)
+
+// AuditEntry records one state-changing API call
+type AuditEntry struct {
+	Time       time.Time `json:"time"`
+	Actor      string    `json:"actor"`
+	ClientAddr string    `json:"client_addr"`
+	Method     string    `json:"method"`
+	Path       string    `json:"path"`
+	Query      string    `json:"query,omitempty"`
+	Status     int       `json:"status"`
+	Payload    string    `json:"payload,omitempty"`
+	Truncated  bool      `json:"payload_truncated,omitempty"`
+}
+
+// auditLog is an append-only record of API mutations, kept in memory and
+// optionally written to a file as JSON lines
+type auditLog struct {
+	mu      sync.Mutex
+	entries []AuditEntry
+	out     io.Writer
+}
+
+func (a *auditLog) append(entry AuditEntry) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if len(a.entries) == maxAuditEntries {
+		copy(a.entries, a.entries[1:])
+		a.entries = a.entries[:len(a.entries)-1]
+	}
+	a.entries = append(a.entries, entry)
+
+	if a.out != nil {
+		line, _ := json.Marshal(entry)
+		if _, err := a.out.Write(append(line, '\n')); err != nil {
+			log.Printf("Audit log write failed: %v", err)
+		}
+	}
+}
+
+// list returns the entries since a time, oldest first
+func (a *auditLog) list(since time.Time) []AuditEntry {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	entries := []AuditEntry{}
+	for _, e := range a.entries {
+		if !e.Time.Before(since) {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// tokenKey carries the token a request authenticated with
+type tokenKey struct{}
+
+// actor names the holder of a token without revealing it: its role,
+// tenant and a fingerprint
+func (t *Token) actor() string {
+	sum := sha256.Sum256([]byte(t.Value))
+	name := t.Role.String()
+	if t.Tenant != "" {
+		name += "@" + t.Tenant
+	}
+	return name + "#" + hex.EncodeToString(sum[:4])
+}
+
+// statusRecorder captures the status code a handler responds with
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(p)
+}
+
+// auditMiddleware records every request that may change state, with the
+// token that made it and the request body. Batches forwarded to a
+// collector are capture traffic, not changes, and are left out, as are
+// read-only queries.
+func (s *Server) auditMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead || r.Method == http.MethodOptions || r.URL.Path == collector.Path || queryPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		entry := AuditEntry{
+			Time:       time.Now(),
+			Actor:      "anonymous",
+			ClientAddr: r.RemoteAddr,
+			Method:     r.Method,
+			Path:       r.URL.Path,
+			Query:      redactToken(r.URL.Query()),
+		}
+		if token, ok := r.Context().Value(tokenKey{}).(*Token); ok {
+			entry.Actor = token.actor()
+		}
+		if r.Body != nil {
+			head, _ := io.ReadAll(io.LimitReader(r.Body, maxAuditPayload+1))
+			if len(head) > maxAuditPayload {
+				entry.Truncated = true
+				entry.Payload = string(head[:maxAuditPayload])
+			} else {
+				entry.Payload = string(head)
+			}
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(head), r.Body), r.Body}
+		}
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		entry.Status = rec.status
+		if entry.Status == 0 {
+			entry.Status = http.StatusOK
+		}
+		s.audit.append(entry)
+	})
+}
+
+// redactToken encodes a query with any token parameter masked
+func redactToken(query url.Values) string {
+	if query.Has("token") {
+		query.Set("token", "REDACTED")
+	}
+	return query.Encode()
+}
+
+// handleAudit lists recorded API mutations
+func (s *Server) handleAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var since time.Time
+	if v := r.URL.Query().Get("since"); v != "" {
+		t, err := parseTimeParam(v)
+		if err != nil {
+			http.Error(w, "Invalid since parameter: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		since = t
+	}
+	entries := s.audit.list(since)
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n >= 0 && n < len(entries) {
+			entries = entries[len(entries)-n:]
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"entries": entries,
+		"count":   len(entries),
+	})
+}
@@ -0,0 +1,148 @@
+package api
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Role is the access level of an API token. Each role includes the ones
+// below it.
+type Role int
+
+const (
+	// RoleRead may list, get, search, stream and export captures
+	RoleRead Role = iota + 1
+	// RoleOperator may also clear captures, edit rules and inject
+	// WebSocket messages
+	RoleOperator
+	// RoleAdmin may also use the administrative endpoints
+	RoleAdmin
+)
+
+var roleNames = map[Role]string{
+	RoleRead:     "read",
+	RoleOperator: "operator",
+	RoleAdmin:    "admin",
+}
+
+func (r Role) String() string {
+	return roleNames[r]
+}
+
+// Token is an API bearer token with its role. A token with a Tenant
+// only sees that tenant's captures.
+type Token struct {
+	Role   Role
+	Tenant string
+	Value  string
+}
+
+// ParseToken parses a token given as role:value or role@tenant:value,
+// where role is read, operator or admin
+func ParseToken(s string) (Token, error) {
+	name, value, ok := strings.Cut(s, ":")
+	if !ok || value == "" {
+		return Token{}, fmt.Errorf("token must be role:value or role@tenant:value, got %q", s)
+	}
+	name, tenant, scoped := strings.Cut(name, "@")
+	if scoped && tenant == "" {
+		return Token{}, fmt.Errorf("token %q names an empty tenant", s)
+	}
+	for role, n := range roleNames {
+		if n == name {
+			return Token{Role: role, Tenant: tenant, Value: value}, nil
+		}
+	}
+	return Token{}, fmt.Errorf("unknown role %q (want read, operator or admin)", name)
+}
+
+// queryPaths take POST requests that only read, such as GraphQL queries
+var queryPaths = map[string]bool{
+	"/api/graphql": true,
+}
+
+// adminRoutes are the changes outside /api/admin/ that need RoleAdmin,
+// keyed by method and path: those that decide which traffic escapes
+// capture or gets blocked for everyone
+var adminRoutes = map[string]bool{
+	"PUT /api/bypass":  true,
+	"PUT /api/parties": true,
+}
+
+// requiredRole is the role a request needs: reads need RoleRead, changes
+// RoleOperator, and the audit log, adminRoutes and anything under
+// /api/admin/ RoleAdmin
+func requiredRole(r *http.Request) Role {
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/api/admin/"), r.URL.Path == "/api/audit", adminRoutes[r.Method+" "+r.URL.Path]:
+		return RoleAdmin
+	case r.Method == http.MethodGet || r.Method == http.MethodHead, queryPaths[r.URL.Path]:
+		return RoleRead
+	default:
+		return RoleOperator
+	}
+}
+
+// tokenFor returns the token a request presents, as a bearer token or,
+// for EventSource clients that cannot set headers, a token query
+// parameter. It returns nil for a missing or unknown token.
+func (s *Server) tokenFor(r *http.Request) *Token {
+	presented, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		presented = r.URL.Query().Get("token")
+	}
+	if presented == "" {
+		return nil
+	}
+	for i, t := range s.tokens {
+		if subtle.ConstantTimeCompare([]byte(presented), []byte(t.Value)) == 1 {
+			return &s.tokens[i]
+		}
+	}
+	return nil
+}
+
+// openPaths need no token: the health check, for probes, the device
+// setup page, PAC file and QR code, which hold no capture data and are
+// opened by devices being set up, and the OpenAPI document
+var openPaths = map[string]bool{
+	"/":                 true,
+	"/health":           true,
+	"/proxy.pac":        true,
+	"/api/setup":        true,
+	"/api/setup/qr":     true,
+	"/api/openapi.json": true,
+}
+
+// authMiddleware enforces token roles per route when tokens are
+// configured. The paths in openPaths stay open.
+func (s *Server) authMiddleware(next http.Handler) http.Handler {
+	if len(s.tokens) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if openPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		token := s.tokenFor(r)
+		if token == nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="go_proxy"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if need := requiredRole(r); token.Role < need {
+			http.Error(w, fmt.Sprintf("Forbidden: %s role required", need), http.StatusForbidden)
+			return
+		}
+		ctx := context.WithValue(r.Context(), tokenKey{}, token)
+		if token.Tenant != "" {
+			ctx = context.WithValue(ctx, scopedTenantKey{}, token.Tenant)
+		}
+		r = r.WithContext(ctx)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,29 @@
+package api
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequiredRole(t *testing.T) {
+	for _, tc := range []struct {
+		method, path string
+		want         Role
+	}{
+		{"GET", "/api/requests", RoleRead},
+		{"POST", "/api/graphql", RoleRead},
+		{"DELETE", "/api/requests", RoleOperator},
+		{"PUT", "/api/rules", RoleOperator},
+		{"GET", "/api/bypass", RoleRead},
+		{"PUT", "/api/bypass", RoleAdmin},
+		{"GET", "/api/parties", RoleRead},
+		{"PUT", "/api/parties", RoleAdmin},
+		{"GET", "/api/audit", RoleAdmin},
+		{"POST", "/api/admin/shutdown", RoleAdmin},
+	} {
+		r := httptest.NewRequest(tc.method, tc.path, nil)
+		if got := requiredRole(r); got != tc.want {
+			t.Errorf("%s %s needs %s, want %s", tc.method, tc.path, got, tc.want)
+		}
+	}
+}
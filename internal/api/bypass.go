@@ -0,0 +1,49 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// handleBypass returns the hosts kept out of capture and what happens to
+// their requests (GET), or replaces them (PUT) with
+// {"hosts": ["internal.example.com", "10.0.0.0/8"], "mode": "refuse"}.
+// Either field may be left out to keep its current value.
+func (s *Server) handleBypass(w http.ResponseWriter, r *http.Request) {
+	bypass := s.proxy.Bypass()
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req struct {
+			Hosts []string `json:"hosts"`
+			Mode  string   `json:"mode"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		hosts, mode := bypass.List()
+		if req.Hosts != nil {
+			hosts = req.Hosts
+		}
+		if req.Mode != "" {
+			mode = req.Mode
+		}
+		if err := bypass.Set(hosts, mode); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	hosts, mode := bypass.List()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"hosts":    hosts,
+		"mode":     mode,
+		"bypassed": bypass.Bypassed(),
+	})
+}
@@ -0,0 +1,121 @@
+package api
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+	"github.com/adamdrake/go_proxy/internal/collector"
+)
+
+// CollectorSource summarizes what one forwarding instance has sent
+type CollectorSource struct {
+	Name       string    `json:"name"`
+	Addr       string    `json:"addr"`
+	FirstSeen  time.Time `json:"first_seen"`
+	LastSeen   time.Time `json:"last_seen"`
+	Batches    int       `json:"batches"`
+	Captures   int       `json:"captures"`
+	Duplicates int       `json:"duplicates"`
+}
+
+// collectorSources tracks the instances forwarding to this collector
+type collectorSources struct {
+	mu      sync.Mutex
+	sources map[string]*CollectorSource
+}
+
+// record counts a batch from source
+func (c *collectorSources) record(name, addr string, stats capture.MergeStats) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	src, ok := c.sources[name]
+	if !ok {
+		src = &CollectorSource{Name: name, FirstSeen: time.Now()}
+		c.sources[name] = src
+	}
+	src.Addr = addr
+	src.LastSeen = time.Now()
+	src.Batches++
+	src.Captures += stats.Imported
+	src.Duplicates += stats.Duplicates
+}
+
+// list returns the sources, most recently seen first
+func (c *collectorSources) list() []CollectorSource {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	list := make([]CollectorSource, 0, len(c.sources))
+	for _, src := range c.sources {
+		list = append(list, *src)
+	}
+	slices.SortFunc(list, func(a, b CollectorSource) int { return b.LastSeen.Compare(a.LastSeen) })
+	return list
+}
+
+// handleCollect ingests a batch of captures forwarded by another instance
+// (see the collector package): JSON lines, usually gzipped, naming the
+// instance in the X-GoProxy-Source header. Captures are stamped with that
+// source and merged like /api/store/import, so a retried batch is not
+// stored twice.
+func (s *Server) handleCollect(w http.ResponseWriter, r *http.Request) {
+	if !s.collecting {
+		http.Error(w, "Collector mode is off (start with -collector)", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	addr, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		addr = r.RemoteAddr
+	}
+	source := strings.TrimSpace(r.Header.Get(collector.SourceHeader))
+	if source == "" {
+		source = addr
+	}
+
+	requests, err := capture.ReadSnapshot(http.MaxBytesReader(w, r.Body, maxImportSize), maxImportSize)
+	if err != nil {
+		http.Error(w, "Invalid batch: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, req := range requests {
+		// Keep the original source of captures relayed by another collector
+		if req.Source == "" {
+			req.Source = source
+		}
+	}
+
+	stats := s.storeFor(r).Merge(requests, false)
+	s.sources.record(source, addr, stats)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// handleCollectSources lists the instances forwarding to this collector
+func (s *Server) handleCollectSources(w http.ResponseWriter, r *http.Request) {
+	if !s.collecting {
+		http.Error(w, "Collector mode is off (start with -collector)", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sources := s.sources.list()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"sources": sources,
+		"count":   len(sources),
+	})
+}
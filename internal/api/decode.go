@@ -0,0 +1,47 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/adamdrake/go_proxy/internal/binproto"
+	"github.com/adamdrake/go_proxy/internal/capture"
+)
+
+// maxSchemalessDecode bounds the decoded body handed to the schemaless
+// decoders, whose JSON output is several times the size of its input
+const maxSchemalessDecode = 4 << 20
+
+// handleRequestDecode decodes a binary body without its schema as
+// protobuf or Thrift: the response body, or the request body with
+// part=request. format=protobuf or format=thrift skips detection.
+func (s *Server) handleRequestDecode(w http.ResponseWriter, r *http.Request, req *capture.CapturedRequest) {
+	header, body := http.Header(req.ResponseHeaders), req.ResponseBody
+	switch part := r.URL.Query().Get("part"); part {
+	case "", "response":
+	case "request":
+		header, body = http.Header(req.RequestHeaders), req.RequestBody
+	default:
+		http.Error(w, "part must be request or response", http.StatusBadRequest)
+		return
+	}
+
+	decoded, err := capture.DecodeBody(header.Get("Content-Encoding"), body, maxSchemalessDecode)
+	if errors.Is(err, capture.ErrDecodedTooLarge) {
+		http.Error(w, "Decoded body exceeds the decode limit", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Unsupported Content-Encoding "+header.Get("Content-Encoding"), http.StatusUnsupportedMediaType)
+		return
+	}
+	result, err := binproto.Decode(decoded, header.Get("Content-Type"), r.URL.Query().Get("format"))
+	if err != nil {
+		http.Error(w, "Cannot decode body: "+err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,43 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// handleDNSCache inspects (GET) or flushes (DELETE) the upstream DNS cache.
+// DELETE accepts an optional host parameter to evict a single entry.
+func (s *Server) handleDNSCache(w http.ResponseWriter, r *http.Request) {
+	cache := s.proxy.DNSCache()
+	if cache == nil {
+		http.Error(w, "DNS cache disabled", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"entries": cache.Snapshot(),
+			"stats":   cache.Stats(),
+		})
+
+	case http.MethodDelete:
+		w.Header().Set("Content-Type", "application/json")
+		if host := r.URL.Query().Get("host"); host != "" {
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"status":  "removed",
+				"host":    host,
+				"removed": cache.Remove(host),
+			})
+			return
+		}
+		cache.Flush()
+		json.NewEncoder(w).Encode(map[string]string{
+			"status": "flushed",
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,30 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+)
+
+// handleDownloads coalesces ranged downloads into one entry per resource
+// with how much of it was received. It accepts the /api/requests filters.
+func (s *Server) handleDownloads(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filter, err := parseRequestFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	downloads := capture.Downloads(filter.apply(s.storeFor(r)))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"downloads": downloads,
+		"count":     len(downloads),
+	})
+}
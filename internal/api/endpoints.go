@@ -0,0 +1,100 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+)
+
+// defaultReportSize is how many endpoints a report lists by default
+const defaultReportSize = 20
+
+// endpointReport aggregates the requests matching the /api/requests
+// filters in r's query per endpoint and returns the first n of those
+// keep accepts, ordered by less. The window parameter limits the report
+// to recent requests.
+func (s *Server) endpointReport(r *http.Request, less func(a, b *capture.EndpointStats) bool, keep func(*capture.EndpointStats) bool) ([]*capture.EndpointStats, error) {
+	query := r.URL.Query()
+	filter, err := parseRequestFilter(query)
+	if err != nil {
+		return nil, err
+	}
+	if v := query.Get("window"); v != "" {
+		window, err := time.ParseDuration(v)
+		if err != nil || window <= 0 {
+			return nil, fmt.Errorf("invalid window parameter")
+		}
+		if since := time.Now().Add(-window); since.After(filter.since) {
+			filter.since = since
+		}
+	}
+	n := defaultReportSize
+	if v := query.Get("n"); v != "" {
+		if n, err = strconv.Atoi(v); err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid n parameter")
+		}
+	}
+
+	var endpoints []*capture.EndpointStats
+	for _, e := range capture.Endpoints(filter.apply(s.storeFor(r)), s.templates) {
+		if keep(e) {
+			endpoints = append(endpoints, e)
+		}
+	}
+	sort.SliceStable(endpoints, func(i, j int) bool { return less(endpoints[i], endpoints[j]) })
+	return endpoints[:min(n, len(endpoints))], nil
+}
+
+// handleEndpointReport serves an endpoint report ordered by less,
+// dropping endpoints keep rejects
+func (s *Server) handleEndpointReport(less func(a, b *capture.EndpointStats) bool, keep func(*capture.EndpointStats) bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		endpoints, err := s.endpointReport(r, less, keep)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"endpoints": endpoints,
+			"count":     len(endpoints),
+		})
+	}
+}
+
+// Endpoint reports: slowest by p95 latency, most failures, and largest
+// responses
+var (
+	bySlowest = func(a, b *capture.EndpointStats) bool {
+		if a.P95MS != b.P95MS {
+			return a.P95MS > b.P95MS
+		}
+		return a.MaxMS > b.MaxMS
+	}
+	byErrors = func(a, b *capture.EndpointStats) bool {
+		if a.Errors != b.Errors {
+			return a.Errors > b.Errors
+		}
+		return a.Count < b.Count
+	}
+	byLargest = func(a, b *capture.EndpointStats) bool {
+		if a.MaxBytes != b.MaxBytes {
+			return a.MaxBytes > b.MaxBytes
+		}
+		return a.TotalBytes > b.TotalBytes
+	}
+
+	anyEndpoint = func(*capture.EndpointStats) bool { return true }
+	hasErrors   = func(e *capture.EndpointStats) bool { return e.Errors > 0 }
+)
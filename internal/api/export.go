@@ -0,0 +1,193 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+	"github.com/adamdrake/go_proxy/internal/export"
+	"github.com/google/uuid"
+)
+
+// maxImportSize bounds uploaded capture files
+const maxImportSize = 512 << 20
+
+// handleExportMitmproxy downloads captures as a mitmproxy flow file. It
+// accepts the same filters as /api/requests.
+func (s *Server) handleExportMitmproxy(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filter, err := parseRequestFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="captures.mitm"`)
+	export.WriteMitmproxy(w, filter.apply(s.storeFor(r)))
+}
+
+// handleExportSAZ downloads captures as a Fiddler session archive. It
+// accepts the same filters as /api/requests.
+func (s *Server) handleExportSAZ(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filter, err := parseRequestFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="captures.saz"`)
+	export.WriteSAZ(w, filter.apply(s.storeFor(r)))
+}
+
+// handleExportPcapng downloads captures as fabricated TCP traffic in a
+// pcapng file, or a classic pcap file with format=pcap. It accepts the same
+// filters as /api/requests.
+func (s *Server) handleExportPcapng(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "pcap" && format != "pcapng" {
+		http.Error(w, "format must be pcap or pcapng", http.StatusBadRequest)
+		return
+	}
+
+	filter, err := parseRequestFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if format == "pcap" {
+		w.Header().Set("Content-Type", "application/vnd.tcpdump.pcap")
+		w.Header().Set("Content-Disposition", `attachment; filename="captures.pcap"`)
+		export.WritePcap(w, filter.apply(s.storeFor(r)))
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="captures.pcapng"`)
+	export.WritePcapng(w, filter.apply(s.storeFor(r)))
+}
+
+// handleExportWARC downloads captures as a gzipped WARC file, or an
+// uncompressed one with gzip=false. It accepts the same filters as
+// /api/requests.
+func (s *Server) handleExportWARC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	gz := true
+	if v := r.URL.Query().Get("gzip"); v != "" {
+		var err error
+		if gz, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, "invalid gzip parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	filter, err := parseRequestFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	name := "captures.warc"
+	if gz {
+		name += ".gz"
+	}
+	w.Header().Set("Content-Type", "application/warc")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	export.WriteWARC(w, filter.apply(s.storeFor(r)), gz)
+}
+
+// handleExportNDJSON downloads captures as JSON lines, one capture per
+// line as /api/requests returns them. It accepts the same filters as
+// /api/requests.
+func (s *Server) handleExportNDJSON(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filter, err := parseRequestFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="captures.ndjson"`)
+	enc := json.NewEncoder(w)
+	for _, req := range filter.apply(s.storeFor(r)) {
+		if err := enc.Encode(req); err != nil {
+			return
+		}
+	}
+}
+
+// handleRequestCode renders a captured request as client code in the
+// language given by lang, Go by default
+func (s *Server) handleRequestCode(w http.ResponseWriter, r *http.Request, req *capture.CapturedRequest) {
+	lang := r.URL.Query().Get("lang")
+	if lang == "" {
+		lang = "go"
+	}
+
+	code, err := export.Code(req, lang)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(code))
+}
+
+// handleImportMitmproxy loads the HTTP flows of an uploaded mitmproxy flow
+// file into the store
+func (s *Server) handleImportMitmproxy(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	requests, err := export.ReadMitmproxy(http.MaxBytesReader(w, r.Body, maxImportSize))
+	if err != nil {
+		http.Error(w, "Invalid flow file: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":   "imported",
+		"imported": importCaptures(s.storeFor(r), requests),
+	})
+}
+
+// importCaptures adds imported captures to store, renaming any whose ID
+// is already taken
+func importCaptures(store *capture.Store, requests []*capture.CapturedRequest) int {
+	for _, req := range requests {
+		if store.GetByID(req.ID) != nil {
+			req.ID = uuid.New().String()
+		}
+		store.Add(req)
+	}
+	return len(requests)
+}
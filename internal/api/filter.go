@@ -0,0 +1,254 @@
+package api
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+	"github.com/adamdrake/go_proxy/internal/hostmatch"
+)
+
+// requestFilter holds the /api/requests query parameters
+type requestFilter struct {
+	query    string
+	since    time.Time
+	until    time.Time
+	host     string
+	tag      string
+	session  string
+	source   string
+	party    string
+	ip       string
+	country  string
+	asn      uint64
+	corrID   string
+	sha256   string
+	finding  string
+	redirect string
+	params   []paramFilter
+	modified *bool
+	would    *bool
+	pii      *bool
+	secrets  *bool
+	creds    *bool
+	limit    int
+}
+
+// paramFilter requires a query parameter, with a given value when hasValue
+type paramFilter struct {
+	name     string
+	value    string
+	hasValue bool
+}
+
+// parseRequestFilter reads filter parameters from a query string
+func parseRequestFilter(values url.Values) (requestFilter, error) {
+	var f requestFilter
+	var err error
+
+	f.query = values.Get("q")
+	f.host = values.Get("host")
+	f.tag = values.Get("tag")
+	f.session = values.Get("session")
+	f.source = values.Get("source")
+	f.party = values.Get("party")
+	f.ip = values.Get("upstream_ip")
+	f.country = strings.ToUpper(values.Get("country"))
+	f.corrID = values.Get("correlation_id")
+	f.sha256 = strings.ToLower(values.Get("sha256"))
+	f.finding = values.Get("finding")
+	f.redirect = values.Get("redirect_chain")
+
+	// param=name:value, or param=name for any value; repeated params all
+	// have to match
+	for _, v := range values["param"] {
+		name, value, hasValue := strings.Cut(v, ":")
+		if name == "" {
+			return f, fmt.Errorf("invalid param parameter %q (want name:value)", v)
+		}
+		f.params = append(f.params, paramFilter{name: name, value: value, hasValue: hasValue})
+	}
+
+	if v := values.Get("since"); v != "" {
+		if f.since, err = parseTimeParam(v); err != nil {
+			return f, fmt.Errorf("invalid since parameter: %w", err)
+		}
+	}
+	if v := values.Get("until"); v != "" {
+		if f.until, err = parseTimeParam(v); err != nil {
+			return f, fmt.Errorf("invalid until parameter: %w", err)
+		}
+	}
+
+	if v := values.Get("modified"); v != "" {
+		modified, err := strconv.ParseBool(v)
+		if err != nil {
+			return f, fmt.Errorf("invalid modified parameter")
+		}
+		f.modified = &modified
+	}
+
+	if v := values.Get("would_apply"); v != "" {
+		would, err := strconv.ParseBool(v)
+		if err != nil {
+			return f, fmt.Errorf("invalid would_apply parameter")
+		}
+		f.would = &would
+	}
+
+	if v := values.Get("pii"); v != "" {
+		pii, err := strconv.ParseBool(v)
+		if err != nil {
+			return f, fmt.Errorf("invalid pii parameter")
+		}
+		f.pii = &pii
+	}
+
+	if v := values.Get("secrets"); v != "" {
+		secrets, err := strconv.ParseBool(v)
+		if err != nil {
+			return f, fmt.Errorf("invalid secrets parameter")
+		}
+		f.secrets = &secrets
+	}
+
+	if v := values.Get("credentials"); v != "" {
+		creds, err := strconv.ParseBool(v)
+		if err != nil {
+			return f, fmt.Errorf("invalid credentials parameter")
+		}
+		f.creds = &creds
+	}
+
+	if v := values.Get("asn"); v != "" {
+		f.asn, err = strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(v), "AS"), 10, 32)
+		if err != nil || f.asn == 0 {
+			return f, fmt.Errorf("invalid asn parameter")
+		}
+	}
+
+	if v := values.Get("limit"); v != "" {
+		f.limit, err = strconv.Atoi(v)
+		if err != nil || f.limit < 0 {
+			return f, fmt.Errorf("invalid limit parameter")
+		}
+	}
+
+	return f, nil
+}
+
+// parseTimeParam accepts an RFC 3339 timestamp, Unix seconds, or a duration
+// meaning that long ago (e.g. "15m")
+func parseTimeParam(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+		return t, nil
+	}
+	if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	if d, err := time.ParseDuration(strings.TrimPrefix(v, "-")); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("%q is not a timestamp or duration", v)
+}
+
+// apply returns the stored requests matching the filter, oldest first. The
+// most selective index available narrows the candidates before the
+// remaining conditions are checked.
+func (f requestFilter) apply(store *capture.Store) []*capture.CapturedRequest {
+	var candidates []*capture.CapturedRequest
+	switch {
+	case f.query != "":
+		candidates = store.Search(f.query)
+	case !f.since.IsZero() || !f.until.IsZero() || f.host != "":
+		candidates = store.GetRange(f.since, f.until, f.host)
+	case f.limit > 0 && f.modified == nil && f.would == nil && f.pii == nil && f.secrets == nil && f.creds == nil && f.tag == "" && f.session == "" && f.source == "" && f.party == "" && f.ip == "" && f.country == "" && f.asn == 0 && f.corrID == "" && f.sha256 == "" && f.finding == "" && f.redirect == "" && len(f.params) == 0:
+		return store.GetRecent(f.limit)
+	default:
+		candidates = store.GetAll()
+	}
+
+	result := candidates[:0]
+	for _, req := range candidates {
+		if f.matches(req) {
+			result = append(result, req)
+		}
+	}
+
+	if f.limit > 0 && f.limit < len(result) {
+		result = result[len(result)-f.limit:]
+	}
+	return result
+}
+
+// matches checks the non-index conditions against a single request
+func (f requestFilter) matches(req *capture.CapturedRequest) bool {
+	if !f.since.IsZero() && req.Timestamp.Before(f.since) {
+		return false
+	}
+	if !f.until.IsZero() && req.Timestamp.After(f.until) {
+		return false
+	}
+	if f.host != "" && hostmatch.Normalize(req.Host) != hostmatch.Normalize(f.host) {
+		return false
+	}
+	if f.modified != nil && req.Modified() != *f.modified {
+		return false
+	}
+	if f.would != nil && (len(req.WouldApply) > 0) != *f.would {
+		return false
+	}
+	if f.pii != nil && (len(req.PIIFindings) > 0) != *f.pii {
+		return false
+	}
+	if f.secrets != nil && (len(req.SecretFindings) > 0) != *f.secrets {
+		return false
+	}
+	if f.creds != nil && (len(req.Credentials) > 0) != *f.creds {
+		return false
+	}
+	if f.tag != "" && !slices.Contains(req.Tags, f.tag) {
+		return false
+	}
+	if f.session != "" && req.Session != f.session {
+		return false
+	}
+	if f.source != "" && req.Source != f.source {
+		return false
+	}
+	if f.party != "" && req.Party != f.party {
+		return false
+	}
+	if f.ip != "" && req.UpstreamIP != f.ip {
+		return false
+	}
+	if f.country != "" && req.UpstreamCountry != f.country {
+		return false
+	}
+	if f.asn != 0 && uint64(req.UpstreamASN) != f.asn {
+		return false
+	}
+	if f.corrID != "" && req.CorrelationID != f.corrID {
+		return false
+	}
+	if f.sha256 != "" && req.RequestBodySHA256 != f.sha256 && req.ResponseBodySHA256 != f.sha256 {
+		return false
+	}
+	if f.finding != "" && !slices.ContainsFunc(req.Findings, func(x capture.Finding) bool { return x.Type == f.finding }) {
+		return false
+	}
+	if f.redirect != "" && req.RedirectChain != f.redirect {
+		return false
+	}
+	for _, p := range f.params {
+		values, ok := req.QueryParams[p.name]
+		if !ok || p.hasValue && !slices.Contains(values, p.value) {
+			return false
+		}
+	}
+	return true
+}
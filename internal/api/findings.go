@@ -0,0 +1,115 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+	"github.com/adamdrake/go_proxy/internal/hostmatch"
+)
+
+// handleFindings summarizes the security findings on captured requests by
+// type and by host. It accepts the /api/requests filters.
+func (s *Server) handleFindings(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filter, err := parseRequestFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	total, affected := 0, 0
+	byType := make(map[string]int)
+	bySeverity := make(map[string]int)
+	byHost := make(map[string]map[string]int)
+	for _, req := range filter.apply(s.storeFor(r)) {
+		if len(req.Findings) == 0 {
+			continue
+		}
+		affected++
+		host := hostmatch.Normalize(req.Host)
+		if byHost[host] == nil {
+			byHost[host] = make(map[string]int)
+		}
+		for _, f := range req.Findings {
+			total++
+			byType[f.Type]++
+			bySeverity[f.Severity]++
+			byHost[host][f.Type]++
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"total":             total,
+		"affected_requests": affected,
+		"by_type":           byType,
+		"by_severity":       bySeverity,
+		"by_host":           byHost,
+	})
+}
+
+// handleCredentials lists the endpoints that received Basic or Digest
+// credentials or query-string tokens, by default only those that got them
+// in plain HTTP; all=true adds the rest. It accepts the /api/requests
+// filters.
+func (s *Server) handleCredentials(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	filter, err := parseRequestFilter(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	all := query.Get("all") == "true"
+
+	endpoints := []*capture.CredentialEndpoint{}
+	cleartext := 0
+	for _, e := range capture.CredentialEndpoints(filter.apply(s.storeFor(r)), s.templates) {
+		cleartext += e.Cleartext
+		if all || e.Cleartext > 0 {
+			endpoints = append(endpoints, e)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"endpoints":          endpoints,
+		"count":              len(endpoints),
+		"cleartext_requests": cleartext,
+	})
+}
+
+// handleHeaderGrades grades the security headers each host sends
+// (Strict-Transport-Security, Content-Security-Policy,
+// X-Content-Type-Options and Referrer-Policy), worst host first, with what
+// to fix. It accepts the /api/requests filters.
+func (s *Server) handleHeaderGrades(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filter, err := parseRequestFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	hosts := capture.GradeHeaders(filter.apply(s.storeFor(r)))
+	if hosts == nil {
+		hosts = []*capture.HostHeaderGrades{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"hosts": hosts,
+		"count": len(hosts),
+	})
+}
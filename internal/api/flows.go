@@ -0,0 +1,190 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+)
+
+// Flow is a named, ordered sequence of captures recorded between a start
+// and a stop, for monitors and other consumers to replay as a unit
+type Flow struct {
+	Name string `json:"name"`
+	// Filter is the /api/requests query captures had to match
+	Filter    string     `json:"filter,omitempty"`
+	Started   time.Time  `json:"started"`
+	Stopped   *time.Time `json:"stopped,omitempty"`
+	Recording bool       `json:"recording"`
+	Steps     int        `json:"steps"`
+
+	filter   requestFilter
+	store    *capture.Store
+	requests []*capture.CapturedRequest
+}
+
+// flowRegistry holds recorded and recording flows by name
+type flowRegistry struct {
+	mu    sync.Mutex
+	flows map[string]*Flow
+}
+
+// steps returns a flow's captures in the order they were made. While
+// recording, they are collected from the store as they arrive.
+func (f *Flow) steps() []*capture.CapturedRequest {
+	if !f.Recording {
+		return f.requests
+	}
+	filter := f.filter
+	if f.Started.After(filter.since) {
+		filter.since = f.Started
+	}
+	return filter.apply(f.store)
+}
+
+// summary returns a copy of f with its step count, for listing
+func (f *Flow) summary() Flow {
+	summary := *f
+	summary.Steps = len(f.steps())
+	return summary
+}
+
+// get returns the named flow and its steps
+func (fr *flowRegistry) get(name string) (Flow, []*capture.CapturedRequest, bool) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	f, ok := fr.flows[name]
+	if !ok {
+		return Flow{}, nil, false
+	}
+	return f.summary(), f.steps(), true
+}
+
+// handleFlowRecord starts (POST /api/flows/record/start?name=N&FILTERS)
+// or stops (POST /api/flows/record/stop?name=N) recording a flow. The
+// /api/requests filters, such as host or tag, select which captures made
+// while recording become steps; starting again under a name replaces
+// that flow.
+func (s *Server) handleFlowRecord(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := r.URL.Query()
+	name := query.Get("name")
+	if name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+
+	s.flows.mu.Lock()
+	defer s.flows.mu.Unlock()
+
+	var flow *Flow
+	switch strings.TrimPrefix(r.URL.Path, "/api/flows/record/") {
+	case "start":
+		filterQuery := url.Values{}
+		for key, values := range query {
+			if key != "name" && key != "token" && key != "tenant" {
+				filterQuery[key] = values
+			}
+		}
+		filter, err := parseRequestFilter(filterQuery)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		flow = &Flow{
+			Name:      name,
+			Filter:    filterQuery.Encode(),
+			Started:   time.Now(),
+			Recording: true,
+			filter:    filter,
+			store:     s.storeFor(r),
+		}
+		s.flows.flows[name] = flow
+
+	case "stop":
+		flow = s.flows.flows[name]
+		if flow == nil || !flow.Recording {
+			http.Error(w, "No flow is recording under that name", http.StatusNotFound)
+			return
+		}
+		flow.requests = flow.steps()
+		stopped := time.Now()
+		flow.Stopped = &stopped
+		flow.Recording = false
+
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(flow.summary())
+}
+
+// handleFlows lists recorded and recording flows
+func (s *Server) handleFlows(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.flows.mu.Lock()
+	flows := make([]Flow, 0, len(s.flows.flows))
+	for _, f := range s.flows.flows {
+		flows = append(flows, f.summary())
+	}
+	s.flows.mu.Unlock()
+	sort.Slice(flows, func(i, j int) bool { return flows[i].Started.Before(flows[j].Started) })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"flows": flows,
+		"count": len(flows),
+	})
+}
+
+// handleFlowByName returns a flow with its steps (GET) or deletes it
+// (DELETE)
+func (s *Server) handleFlowByName(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/api/flows/")
+	if strings.HasPrefix(name, "record/") {
+		s.handleFlowRecord(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		flow, steps, ok := s.flows.get(name)
+		if !ok {
+			http.Error(w, "Flow not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"flow":  flow,
+			"steps": steps,
+		})
+
+	case http.MethodDelete:
+		s.flows.mu.Lock()
+		_, ok := s.flows.flows[name]
+		delete(s.flows.flows, name)
+		s.flows.mu.Unlock()
+		if !ok {
+			http.Error(w, "Flow not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,37 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+	"github.com/adamdrake/go_proxy/internal/fuzz"
+	"github.com/adamdrake/go_proxy/internal/replay"
+)
+
+// fuzzTimeout bounds each request of a fuzz run
+const fuzzTimeout = 10 * time.Second
+
+// handleRequestFuzz mutates a capture's query parameters, JSON fields and
+// headers with generated payloads, replays each mutation, and reports the
+// ones answered differently from the unmodified request. The optional
+// JSON body holds fuzz.Options.
+func (s *Server) handleRequestFuzz(w http.ResponseWriter, r *http.Request, req *capture.CapturedRequest) {
+	var opts fuzz.Options
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+			http.Error(w, "Invalid fuzz options JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	report, err := fuzz.Run(r.Context(), replay.NewClient(fuzzTimeout), req, opts)
+	if err != nil {
+		http.Error(w, "Cannot fuzz request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,560 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+	"github.com/adamdrake/go_proxy/internal/graphql"
+)
+
+// maxGraphQLQuery bounds the size of a GraphQL request
+const maxGraphQLQuery = 1 << 20
+
+// graphQLSDL describes the schema served at /api/graphql
+const graphQLSDL = `# Captures matching a filter. The REST filter parameters keep their
+# /api/requests meaning; the others narrow by method, status and speed.
+input RequestFilter {
+  q: String
+  since: String          # RFC 3339, Unix seconds or a duration ago, e.g. "10m"
+  until: String
+  host: String
+  tag: String
+  session: String
+  source: String
+  party: String
+  upstreamIp: String
+  country: String
+  asn: Int
+  correlationId: String
+  sha256: String
+  finding: String
+  param: String          # name:value, or name for any value
+  redirectChain: String
+  modified: Boolean
+  pii: Boolean
+  secrets: Boolean
+  credentials: Boolean
+  method: String
+  status: Int
+  minStatus: Int
+  maxStatus: Int
+  failed: Boolean        # status >= 400 or no response
+  minDurationMs: Int
+}
+
+type Query {
+  # Oldest first; limit keeps the most recent
+  requests(filter: RequestFilter, limit: Int): [Capture!]!
+  request(id: ID!): Capture
+  count(filter: RequestFilter): Int!
+  # Busiest first
+  hosts(filter: RequestFilter, limit: Int): [HostSummary!]!
+}
+
+type Capture {
+  id: ID!
+  timestamp: String!
+  method: String!
+  url: String!
+  host: String!
+  hostUnicode: String
+  path: String!
+  queryParams: [Header!]!
+  proto: String
+  status: Int!
+  durationMs: Int!
+  error: String
+  isHttps: Boolean!
+  isTunnel: Boolean!
+  blocked: Boolean!
+  blockReason: String
+  tags: [String!]!
+  session: String
+  source: String
+  tenant: String
+  party: String
+  correlationId: String
+  redirectChain: String
+  redirectFrom: String
+  redirectHop: Int!
+  contentType: String
+  requestSize: Int!
+  responseSize: Int!
+  # Bodies as text, cut to maxBytes when given
+  requestBody(maxBytes: Int): String
+  responseBody(maxBytes: Int): String
+  requestHeaders: [Header!]!
+  responseHeaders: [Header!]!
+  requestHeader(name: String!): [String!]
+  responseHeader(name: String!): [String!]
+  upstreamIp: String
+  upstreamAsn: Int
+  upstreamOrg: String
+  upstreamCountry: String
+  upstreamProto: String
+  tlsVersion: String
+  findings(type: String, severity: String): [Finding!]!
+  # The whole capture as /api/requests/{id} returns it
+  json: String!
+}
+
+type Header {
+  name: String!
+  values: [String!]!
+}
+
+type Finding {
+  type: String!
+  severity: String!
+  detail: String
+}
+
+type HostSummary {
+  host: String!
+  count: Int!
+  errors: Int!
+  avgDurationMs: Int!
+}
+`
+
+// graphQLSchema is built once; query fields resolve against the store
+// passed as the root value
+var graphQLSchema = newGraphQLSchema()
+
+// graphQLFilter is a RequestFilter input: the shared /api/requests
+// filter plus conditions only GraphQL offers
+type graphQLFilter struct {
+	requestFilter
+	method        string
+	status        int
+	minStatus     int
+	maxStatus     int
+	failed        *bool
+	minDurationMS int
+}
+
+// restFilterArgs maps RequestFilter fields to /api/requests parameters
+var restFilterArgs = map[string]string{
+	"q":             "q",
+	"since":         "since",
+	"until":         "until",
+	"host":          "host",
+	"tag":           "tag",
+	"session":       "session",
+	"source":        "source",
+	"party":         "party",
+	"upstreamIp":    "upstream_ip",
+	"country":       "country",
+	"correlationId": "correlation_id",
+	"sha256":        "sha256",
+	"finding":       "finding",
+	"param":         "param",
+	"redirectChain": "redirect_chain",
+}
+
+// parseGraphQLFilter reads a filter argument
+func parseGraphQLFilter(args graphql.Args) (graphQLFilter, error) {
+	var f graphQLFilter
+	input, err := args.Object("filter")
+	if err != nil {
+		return f, err
+	}
+
+	values := url.Values{}
+	for field, param := range restFilterArgs {
+		v, err := input.String(field)
+		if err != nil {
+			return f, err
+		}
+		if v != "" {
+			values.Set(param, v)
+		}
+	}
+	for _, field := range []string{"modified", "pii", "secrets", "credentials"} {
+		v, ok, err := input.Bool(field)
+		if err != nil {
+			return f, err
+		}
+		if ok {
+			values.Set(field, strconv.FormatBool(v))
+		}
+	}
+	if asn, err := input.Int("asn", 0); err != nil {
+		return f, err
+	} else if asn != 0 {
+		values.Set("asn", strconv.Itoa(asn))
+	}
+	if f.requestFilter, err = parseRequestFilter(values); err != nil {
+		return f, err
+	}
+
+	if f.method, err = input.String("method"); err != nil {
+		return f, err
+	}
+	for field, dst := range map[string]*int{"status": &f.status, "minStatus": &f.minStatus, "maxStatus": &f.maxStatus, "minDurationMs": &f.minDurationMS} {
+		if *dst, err = input.Int(field, 0); err != nil {
+			return f, err
+		}
+	}
+	if failed, ok, err := input.Bool("failed"); err != nil {
+		return f, err
+	} else if ok {
+		f.failed = &failed
+	}
+	return f, nil
+}
+
+// limitArg reads a limit argument; 0 means no limit
+func limitArg(args graphql.Args) (int, error) {
+	limit, err := args.Int("limit", 0)
+	if err == nil && limit < 0 {
+		err = fmt.Errorf("limit must not be negative")
+	}
+	return limit, err
+}
+
+// apply returns the matching captures, oldest first, keeping the most
+// recent limit of them (0 keeps all)
+func (f graphQLFilter) apply(store *capture.Store, limit int) []*capture.CapturedRequest {
+	requests := f.requestFilter.apply(store)
+	result := requests[:0]
+	for _, req := range requests {
+		if f.matches(req) {
+			result = append(result, req)
+		}
+	}
+	if limit > 0 && limit < len(result) {
+		result = result[len(result)-limit:]
+	}
+	return result
+}
+
+// matches checks the GraphQL-only conditions
+func (f graphQLFilter) matches(req *capture.CapturedRequest) bool {
+	switch {
+	case f.method != "" && !strings.EqualFold(req.Method, f.method):
+		return false
+	case f.status != 0 && req.StatusCode != f.status:
+		return false
+	case f.minStatus != 0 && req.StatusCode < f.minStatus:
+		return false
+	case f.maxStatus != 0 && req.StatusCode > f.maxStatus:
+		return false
+	case f.failed != nil && (req.StatusCode >= 400 || req.StatusCode == 0) != *f.failed:
+		return false
+	case f.minDurationMS != 0 && req.Duration < time.Duration(f.minDurationMS)*time.Millisecond:
+		return false
+	}
+	return true
+}
+
+// hostSummary is a HostSummary
+type hostSummary struct {
+	host     string
+	count    int
+	errors   int
+	duration time.Duration
+}
+
+func newGraphQLSchema() *graphql.Schema {
+	query := &graphql.Object{Name: "Query", Fields: map[string]*graphql.Field{
+		"requests": {Type: "[Capture!]!", Resolve: func(source interface{}, args graphql.Args) (interface{}, error) {
+			limit, err := limitArg(args)
+			if err != nil {
+				return nil, err
+			}
+			f, err := parseGraphQLFilter(args)
+			if err != nil {
+				return nil, err
+			}
+			return f.apply(source.(*capture.Store), limit), nil
+		}},
+		"request": {Type: "Capture", Resolve: func(source interface{}, args graphql.Args) (interface{}, error) {
+			id, err := args.String("id")
+			if err != nil || id == "" {
+				return nil, fmt.Errorf("argument id is required")
+			}
+			return source.(*capture.Store).GetByID(id), nil
+		}},
+		"count": {Type: "Int!", Resolve: func(source interface{}, args graphql.Args) (interface{}, error) {
+			f, err := parseGraphQLFilter(args)
+			if err != nil {
+				return nil, err
+			}
+			return len(f.apply(source.(*capture.Store), 0)), nil
+		}},
+		"hosts": {Type: "[HostSummary!]!", Resolve: func(source interface{}, args graphql.Args) (interface{}, error) {
+			limit, err := limitArg(args)
+			if err != nil {
+				return nil, err
+			}
+			f, err := parseGraphQLFilter(args)
+			if err != nil {
+				return nil, err
+			}
+			byHost := make(map[string]*hostSummary)
+			for _, req := range f.apply(source.(*capture.Store), 0) {
+				h := byHost[req.Host]
+				if h == nil {
+					h = &hostSummary{host: req.Host}
+					byHost[req.Host] = h
+				}
+				h.count++
+				h.duration += req.Duration
+				if req.StatusCode >= 400 || req.StatusCode == 0 {
+					h.errors++
+				}
+			}
+			hosts := make([]*hostSummary, 0, len(byHost))
+			for _, h := range byHost {
+				hosts = append(hosts, h)
+			}
+			slices.SortFunc(hosts, func(a, b *hostSummary) int {
+				if a.count != b.count {
+					return b.count - a.count
+				}
+				return strings.Compare(a.host, b.host)
+			})
+			if limit > 0 && limit < len(hosts) {
+				hosts = hosts[:limit]
+			}
+			return hosts, nil
+		}},
+	}}
+
+	captureType := &graphql.Object{Name: "Capture", Fields: map[string]*graphql.Field{
+		"id":            captureField("ID!", func(r *capture.CapturedRequest) interface{} { return r.ID }),
+		"timestamp":     captureField("String!", func(r *capture.CapturedRequest) interface{} { return r.Timestamp.Format(time.RFC3339Nano) }),
+		"method":        captureField("String!", func(r *capture.CapturedRequest) interface{} { return r.Method }),
+		"url":           captureField("String!", func(r *capture.CapturedRequest) interface{} { return r.URL }),
+		"host":          captureField("String!", func(r *capture.CapturedRequest) interface{} { return r.Host }),
+		"hostUnicode":   captureField("String", func(r *capture.CapturedRequest) interface{} { return optional(r.HostUnicode) }),
+		"path":          captureField("String!", func(r *capture.CapturedRequest) interface{} { return r.Path }),
+		"proto":         captureField("String", func(r *capture.CapturedRequest) interface{} { return optional(r.Proto) }),
+		"status":        captureField("Int!", func(r *capture.CapturedRequest) interface{} { return r.StatusCode }),
+		"durationMs":    captureField("Int!", func(r *capture.CapturedRequest) interface{} { return r.Duration.Milliseconds() }),
+		"error":         captureField("String", func(r *capture.CapturedRequest) interface{} { return optional(r.Error) }),
+		"isHttps":       captureField("Boolean!", func(r *capture.CapturedRequest) interface{} { return r.IsHTTPS }),
+		"isTunnel":      captureField("Boolean!", func(r *capture.CapturedRequest) interface{} { return r.IsTunnel }),
+		"blocked":       captureField("Boolean!", func(r *capture.CapturedRequest) interface{} { return r.Blocked }),
+		"blockReason":   captureField("String", func(r *capture.CapturedRequest) interface{} { return optional(r.BlockReason) }),
+		"tags":          captureField("[String!]!", func(r *capture.CapturedRequest) interface{} { return append([]string{}, r.Tags...) }),
+		"session":       captureField("String", func(r *capture.CapturedRequest) interface{} { return optional(r.Session) }),
+		"source":        captureField("String", func(r *capture.CapturedRequest) interface{} { return optional(r.Source) }),
+		"tenant":        captureField("String", func(r *capture.CapturedRequest) interface{} { return optional(r.Tenant) }),
+		"party":         captureField("String", func(r *capture.CapturedRequest) interface{} { return optional(r.Party) }),
+		"correlationId": captureField("String", func(r *capture.CapturedRequest) interface{} { return optional(r.CorrelationID) }),
+		"redirectChain": captureField("String", func(r *capture.CapturedRequest) interface{} { return optional(r.RedirectChain) }),
+		"redirectFrom":  captureField("String", func(r *capture.CapturedRequest) interface{} { return optional(r.RedirectFrom) }),
+		"redirectHop":   captureField("Int!", func(r *capture.CapturedRequest) interface{} { return r.RedirectHop }),
+		"contentType": captureField("String", func(r *capture.CapturedRequest) interface{} {
+			return optional(http.Header(r.ResponseHeaders).Get("Content-Type"))
+		}),
+		"requestSize":     captureField("Int!", func(r *capture.CapturedRequest) interface{} { return len(r.RequestBody) }),
+		"responseSize":    captureField("Int!", func(r *capture.CapturedRequest) interface{} { return responseSize(r) }),
+		"queryParams":     captureField("[Header!]!", func(r *capture.CapturedRequest) interface{} { return headerList(r.QueryParams) }),
+		"requestHeaders":  captureField("[Header!]!", func(r *capture.CapturedRequest) interface{} { return headerList(r.RequestHeaders) }),
+		"responseHeaders": captureField("[Header!]!", func(r *capture.CapturedRequest) interface{} { return headerList(r.ResponseHeaders) }),
+		"upstreamIp":      captureField("String", func(r *capture.CapturedRequest) interface{} { return optional(r.UpstreamIP) }),
+		"upstreamAsn": captureField("Int", func(r *capture.CapturedRequest) interface{} {
+			if r.UpstreamASN == 0 {
+				return nil
+			}
+			return r.UpstreamASN
+		}),
+		"upstreamOrg":     captureField("String", func(r *capture.CapturedRequest) interface{} { return optional(r.UpstreamOrg) }),
+		"upstreamCountry": captureField("String", func(r *capture.CapturedRequest) interface{} { return optional(r.UpstreamCountry) }),
+		"upstreamProto":   captureField("String", func(r *capture.CapturedRequest) interface{} { return optional(r.UpstreamProto) }),
+		"tlsVersion":      captureField("String", func(r *capture.CapturedRequest) interface{} { return optional(r.TLSVersion) }),
+		"json": captureField("String!", func(r *capture.CapturedRequest) interface{} {
+			data, _ := json.Marshal(r)
+			return string(data)
+		}),
+		"requestBody":    bodyField(func(r *capture.CapturedRequest) []byte { return r.RequestBody }),
+		"responseBody":   bodyField(func(r *capture.CapturedRequest) []byte { return r.ResponseBody }),
+		"requestHeader":  headerField(func(r *capture.CapturedRequest) map[string][]string { return r.RequestHeaders }),
+		"responseHeader": headerField(func(r *capture.CapturedRequest) map[string][]string { return r.ResponseHeaders }),
+		"findings": {Type: "[Finding!]!", Resolve: func(source interface{}, args graphql.Args) (interface{}, error) {
+			typ, err := args.String("type")
+			if err != nil {
+				return nil, err
+			}
+			severity, err := args.String("severity")
+			if err != nil {
+				return nil, err
+			}
+			findings := []capture.Finding{}
+			for _, f := range source.(*capture.CapturedRequest).Findings {
+				if (typ == "" || f.Type == typ) && (severity == "" || f.Severity == severity) {
+					findings = append(findings, f)
+				}
+			}
+			return findings, nil
+		}},
+	}}
+
+	headerType := &graphql.Object{Name: "Header", Fields: map[string]*graphql.Field{
+		"name":   {Type: "String!", Resolve: func(source interface{}, _ graphql.Args) (interface{}, error) { return source.(header).name, nil }},
+		"values": {Type: "[String!]!", Resolve: func(source interface{}, _ graphql.Args) (interface{}, error) { return source.(header).values, nil }},
+	}}
+
+	findingType := &graphql.Object{Name: "Finding", Fields: map[string]*graphql.Field{
+		"type": {Type: "String!", Resolve: func(source interface{}, _ graphql.Args) (interface{}, error) {
+			return source.(capture.Finding).Type, nil
+		}},
+		"severity": {Type: "String!", Resolve: func(source interface{}, _ graphql.Args) (interface{}, error) {
+			return source.(capture.Finding).Severity, nil
+		}},
+		"detail": {Type: "String", Resolve: func(source interface{}, _ graphql.Args) (interface{}, error) {
+			return optional(source.(capture.Finding).Detail), nil
+		}},
+	}}
+
+	hostType := &graphql.Object{Name: "HostSummary", Fields: map[string]*graphql.Field{
+		"host":  {Type: "String!", Resolve: func(source interface{}, _ graphql.Args) (interface{}, error) { return source.(*hostSummary).host, nil }},
+		"count": {Type: "Int!", Resolve: func(source interface{}, _ graphql.Args) (interface{}, error) { return source.(*hostSummary).count, nil }},
+		"errors": {Type: "Int!", Resolve: func(source interface{}, _ graphql.Args) (interface{}, error) {
+			return source.(*hostSummary).errors, nil
+		}},
+		"avgDurationMs": {Type: "Int!", Resolve: func(source interface{}, _ graphql.Args) (interface{}, error) {
+			h := source.(*hostSummary)
+			return (h.duration / time.Duration(h.count)).Milliseconds(), nil
+		}},
+	}}
+
+	return graphql.NewSchema(graphQLSDL, query, captureType, headerType, findingType, hostType)
+}
+
+// captureField is a Capture field without arguments
+func captureField(typ string, fn func(*capture.CapturedRequest) interface{}) *graphql.Field {
+	return &graphql.Field{Type: typ, Resolve: func(source interface{}, _ graphql.Args) (interface{}, error) {
+		return fn(source.(*capture.CapturedRequest)), nil
+	}}
+}
+
+// bodyField is a body as text, optionally cut to maxBytes without
+// splitting a character
+func bodyField(body func(*capture.CapturedRequest) []byte) *graphql.Field {
+	return &graphql.Field{Type: "String", Resolve: func(source interface{}, args graphql.Args) (interface{}, error) {
+		maxBytes, err := args.Int("maxBytes", 0)
+		if err != nil {
+			return nil, err
+		}
+		b := body(source.(*capture.CapturedRequest))
+		if len(b) == 0 {
+			return nil, nil
+		}
+		if maxBytes > 0 && len(b) > maxBytes {
+			b = b[:maxBytes]
+			for len(b) > 0 && !utf8.Valid(b) {
+				b = b[:len(b)-1]
+			}
+		}
+		return strings.ToValidUTF8(string(b), "�"), nil
+	}}
+}
+
+// headerField is the values of one header, by case-insensitive name
+func headerField(headers func(*capture.CapturedRequest) map[string][]string) *graphql.Field {
+	return &graphql.Field{Type: "[String!]", Resolve: func(source interface{}, args graphql.Args) (interface{}, error) {
+		name, err := args.String("name")
+		if err != nil || name == "" {
+			return nil, fmt.Errorf("argument name is required")
+		}
+		for k, v := range headers(source.(*capture.CapturedRequest)) {
+			if strings.EqualFold(k, name) {
+				return v, nil
+			}
+		}
+		return nil, nil
+	}}
+}
+
+// header is a Header
+type header struct {
+	name   string
+	values []string
+}
+
+// headerList returns headers sorted by name
+func headerList(h map[string][]string) []header {
+	list := make([]header, 0, len(h))
+	for name, values := range h {
+		list = append(list, header{name: name, values: values})
+	}
+	slices.SortFunc(list, func(a, b header) int { return strings.Compare(a.name, b.name) })
+	return list
+}
+
+// optional returns nil for an empty string, so nullable fields are null
+// rather than ""
+func optional(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// responseSize is the size of the response as received, before any
+// placeholder replaced it
+func responseSize(req *capture.CapturedRequest) int64 {
+	if req.OriginalSize > 0 {
+		return req.OriginalSize
+	}
+	return int64(len(req.ResponseBody))
+}
+
+// handleGraphQL runs a GraphQL query against the store: POST a JSON
+// {"query", "variables", "operationName"} body, or GET with query and
+// variables parameters. GET /api/graphql/schema returns the SDL.
+func (s *Server) handleGraphQL(w http.ResponseWriter, r *http.Request) {
+	var req graphql.Request
+	switch r.Method {
+	case http.MethodGet:
+		req.Query = r.URL.Query().Get("query")
+		req.OperationName = r.URL.Query().Get("operationName")
+		if v := r.URL.Query().Get("variables"); v != "" {
+			if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+				http.Error(w, "Invalid variables: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+	case http.MethodPost:
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxGraphQLQuery)).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if req.Query == "" {
+		http.Error(w, "query is required", http.StatusBadRequest)
+		return
+	}
+
+	resp := graphQLSchema.Execute(req, s.storeFor(r))
+	w.Header().Set("Content-Type", "application/json")
+	if resp.Data == nil {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// handleGraphQLSchema returns the GraphQL schema definition
+func (s *Server) handleGraphQLSchema(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(graphQLSchema.SDL()))
+}
@@ -0,0 +1,282 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+	"github.com/adamdrake/go_proxy/internal/grpc"
+	"github.com/adamdrake/go_proxy/internal/replay"
+)
+
+// grpcService is the gRPC service name, from proto/goproxy.proto
+const grpcService = "/goproxy.v1.Captures/"
+
+// grpcTenantHeader is the metadata an unscoped token picks a tenant with
+const grpcTenantHeader = "X-Goproxy-Tenant"
+
+// replayTimeout bounds a replay made through the gRPC API
+const replayTimeout = 30 * time.Second
+
+// newGRPCServer registers the Captures service of proto/goproxy.proto
+func (s *Server) newGRPCServer() *grpc.Server {
+	g := grpc.NewServer()
+	g.Unary(grpcService+"ListRequests", s.grpcCall(RoleRead, s.grpcListRequests))
+	g.Unary(grpcService+"GetRequest", s.grpcCall(RoleRead, s.grpcGetRequest))
+	g.Stream(grpcService+"StreamRequests", s.grpcStreamRequests)
+	g.Unary(grpcService+"Replay", s.grpcCall(RoleOperator, s.grpcReplay))
+	g.Unary(grpcService+"Clear", s.grpcCall(RoleOperator, s.grpcClear))
+	return g
+}
+
+// grpcCall checks the token and tenant of a unary call before running it,
+// auditing calls that need more than read access
+func (s *Server) grpcCall(need Role, fn func(*http.Request, *capture.Store, []byte) ([]byte, error)) grpc.UnaryHandler {
+	return func(r *http.Request, in []byte) ([]byte, error) {
+		token, store, err := s.grpcAuthorize(r, need)
+		if err != nil {
+			return nil, err
+		}
+		out, err := fn(r, store, in)
+		if need > RoleRead {
+			entry := AuditEntry{
+				Time:       time.Now(),
+				Actor:      "anonymous",
+				ClientAddr: r.RemoteAddr,
+				Method:     "gRPC",
+				Path:       r.URL.Path,
+				Status:     http.StatusOK,
+			}
+			if token != nil {
+				entry.Actor = token.actor()
+			}
+			if err != nil {
+				entry.Status = http.StatusInternalServerError
+			}
+			s.audit.append(entry)
+		}
+		return out, err
+	}
+}
+
+// grpcAuthorize applies the REST API's token roles and tenant scoping to
+// a gRPC call, returning the token and the capture store it works on
+func (s *Server) grpcAuthorize(r *http.Request, need Role) (*Token, *capture.Store, error) {
+	var token *Token
+	tenant := r.Header.Get(grpcTenantHeader)
+	if len(s.tokens) > 0 {
+		if token = s.tokenFor(r); token == nil {
+			return nil, nil, grpc.Errorf(grpc.Unauthenticated, "a bearer token is required")
+		}
+		if token.Role < need {
+			return nil, nil, grpc.Errorf(grpc.PermissionDenied, "%s role required", need)
+		}
+		if token.Tenant != "" {
+			tenant = token.Tenant
+		}
+	}
+	store := s.proxy.TenantStore(tenant)
+	if store == nil {
+		return nil, nil, grpc.Errorf(grpc.NotFound, "unknown tenant %q", tenant)
+	}
+	return token, store, nil
+}
+
+// decodeFilter reads the filter map of a list or stream request
+func decodeFilter(in []byte) (requestFilter, error) {
+	values := url.Values{}
+	err := grpc.Decode(in, func(f grpc.Field) error {
+		if f.Number != 1 {
+			return nil
+		}
+		m := make(map[string]string, 1)
+		if err := grpc.DecodeMap(f.Data, m); err != nil {
+			return err
+		}
+		for k, v := range m {
+			values.Set(k, v)
+		}
+		return nil
+	})
+	if err != nil {
+		return requestFilter{}, grpc.Errorf(grpc.InvalidArgument, "%v", err)
+	}
+	filter, err := parseRequestFilter(values)
+	if err != nil {
+		return filter, grpc.Errorf(grpc.InvalidArgument, "%v", err)
+	}
+	return filter, nil
+}
+
+// decodeID reads field 1 of a request naming a capture
+func decodeID(in []byte) (string, error) {
+	var id string
+	err := grpc.Decode(in, func(f grpc.Field) error {
+		if f.Number == 1 {
+			id = f.String()
+		}
+		return nil
+	})
+	if err != nil {
+		return "", grpc.Errorf(grpc.InvalidArgument, "%v", err)
+	}
+	if id == "" {
+		return "", grpc.Errorf(grpc.InvalidArgument, "id is required")
+	}
+	return id, nil
+}
+
+func (s *Server) grpcListRequests(r *http.Request, store *capture.Store, in []byte) ([]byte, error) {
+	filter, err := decodeFilter(in)
+	if err != nil {
+		return nil, err
+	}
+	requests := filter.apply(store)
+
+	var e grpc.Encoder
+	for _, req := range requests {
+		e.Message(1, func(e *grpc.Encoder) { encodeCapture(e, req) })
+	}
+	e.Int64(2, int64(len(requests)))
+	return e.Bytes(), nil
+}
+
+func (s *Server) grpcGetRequest(r *http.Request, store *capture.Store, in []byte) ([]byte, error) {
+	id, err := decodeID(in)
+	if err != nil {
+		return nil, err
+	}
+	req := store.GetByID(id)
+	if req == nil {
+		return nil, grpc.Errorf(grpc.NotFound, "request %s not found", id)
+	}
+	var e grpc.Encoder
+	encodeCapture(&e, req)
+	return e.Bytes(), nil
+}
+
+// grpcStreamRequests sends captures matching the filter as they are
+// stored, like /api/requests/stream
+func (s *Server) grpcStreamRequests(r *http.Request, in []byte, send func([]byte) error) error {
+	_, store, err := s.grpcAuthorize(r, RoleRead)
+	if err != nil {
+		return err
+	}
+	filter, err := decodeFilter(in)
+	if err != nil {
+		return err
+	}
+	if filter.query != "" || filter.limit > 0 {
+		return grpc.Errorf(grpc.InvalidArgument, "q and limit do not apply to streams")
+	}
+
+	ch := store.Subscribe()
+	defer store.Unsubscribe(ch)
+	for {
+		select {
+		case req, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			if !filter.matches(req) {
+				continue
+			}
+			var e grpc.Encoder
+			encodeCapture(&e, req)
+			if err := send(e.Bytes()); err != nil {
+				return err
+			}
+		case <-r.Context().Done():
+			return r.Context().Err()
+		}
+	}
+}
+
+func (s *Server) grpcReplay(r *http.Request, store *capture.Store, in []byte) ([]byte, error) {
+	var id, target string
+	err := grpc.Decode(in, func(f grpc.Field) error {
+		switch f.Number {
+		case 1:
+			id = f.String()
+		case 2:
+			target = f.String()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, grpc.Errorf(grpc.InvalidArgument, "%v", err)
+	}
+	req := store.GetByID(id)
+	if req == nil {
+		return nil, grpc.Errorf(grpc.NotFound, "request %q not found", id)
+	}
+	if req.IsTunnel {
+		return nil, grpc.Errorf(grpc.FailedPrecondition, "request %s is an opaque tunnel", id)
+	}
+
+	result := replay.Send(r.Context(), replay.NewClient(replayTimeout), req, target, nil)
+	var e grpc.Encoder
+	e.Int64(1, int64(result.StatusCode))
+	e.Int64(2, int64(result.ExpectedStatus))
+	e.Int64(3, result.DurationMS)
+	e.Int64(4, result.Size)
+	e.String(5, result.Error)
+	e.Bool(6, result.OK)
+	e.String(7, result.URL)
+	return e.Bytes(), nil
+}
+
+func (s *Server) grpcClear(r *http.Request, store *capture.Store, in []byte) ([]byte, error) {
+	cleared := store.Count()
+	store.Clear()
+	var e grpc.Encoder
+	e.Int64(1, int64(cleared))
+	return e.Bytes(), nil
+}
+
+// encodeCapture encodes a Capture message
+func encodeCapture(e *grpc.Encoder, req *capture.CapturedRequest) {
+	e.String(1, req.ID)
+	e.Int64(2, req.Timestamp.UnixNano())
+	e.String(3, req.Method)
+	e.String(4, req.URL)
+	e.String(5, req.Host)
+	e.String(6, req.Path)
+	encodeHeaders(e, 7, req.RequestHeaders)
+	e.RawBytes(8, req.RequestBody)
+	e.Int64(9, int64(req.StatusCode))
+	encodeHeaders(e, 10, req.ResponseHeaders)
+	e.RawBytes(11, req.ResponseBody)
+	e.Int64(12, req.Duration.Milliseconds())
+	e.Bool(13, req.IsHTTPS)
+	e.Bool(14, req.IsTunnel)
+	e.Bool(15, req.Blocked)
+	e.String(16, req.BlockReason)
+	e.String(17, req.Error)
+	e.Strings(18, req.Tags)
+	e.String(19, req.Session)
+	e.String(20, req.Tenant)
+	e.String(21, req.Source)
+	if data, err := json.Marshal(req); err == nil {
+		e.RawBytes(22, data)
+	}
+}
+
+// encodeHeaders encodes headers as repeated Header messages, sorted by
+// name
+func encodeHeaders(e *grpc.Encoder, field int, header map[string][]string) {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		e.Message(field, func(e *grpc.Encoder) {
+			e.String(1, name)
+			e.Strings(2, header[name])
+		})
+	}
+}
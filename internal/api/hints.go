@@ -0,0 +1,50 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+)
+
+// handleHints audits resource hints: each capture matching the
+// /api/requests filters whose response preloaded resources, with the
+// captures that fetched them in the time the within parameter allows
+func (s *Server) handleHints(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filter, err := parseRequestFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	within := capture.DefaultHintWindow
+	if v := r.URL.Query().Get("within"); v != "" {
+		if within, err = time.ParseDuration(v); err != nil || within <= 0 {
+			http.Error(w, "invalid within parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Hinted resources often live on other hosts than the page, so
+	// fetches are looked for among every capture
+	store := s.storeFor(r)
+	pages := capture.AuditHints(filter.apply(store), store.GetAll(), within)
+	used, unused := 0, 0
+	for _, page := range pages {
+		used += page.Used
+		unused += page.Unused
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"pages":  pages,
+		"count":  len(pages),
+		"used":   used,
+		"unused": unused,
+	})
+}
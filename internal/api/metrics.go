@@ -0,0 +1,100 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// handleConnections reports the upstream connection pool: reuse, time
+// spent waiting for a connection, and open connections per host
+func (s *Server) handleConnections(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.proxy.ConnPool().Stats())
+}
+
+// handleMetrics serves metrics in the Prometheus text format, for scraping
+// with the same token as the API
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m := &metricsWriter{w: w}
+
+	store := s.proxy.Store()
+	usage := store.Stats()
+	m.gauge("go_proxy_captures", "Captures in the store", float64(usage.Count))
+	m.gauge("go_proxy_store_capacity", "Captures the store holds before evicting", float64(usage.Capacity))
+	m.gauge("go_proxy_store_bytes", "Approximate memory held by captures", float64(usage.ApproxBytes))
+	m.gauge("go_proxy_store_body_bytes", "Request and response body bytes held by captures", float64(usage.BodyBytes))
+	m.counter("go_proxy_store_evictions_total", "Captures dropped to make room", float64(usage.Evictions))
+	m.gauge("go_proxy_store_truncated_bodies", "Captures whose body was cut off at the body size limit", float64(usage.TruncatedRequests), "direction", "request")
+	m.gauge("go_proxy_store_truncated_bodies", "Captures whose body was cut off at the body size limit", float64(usage.TruncatedResponses), "direction", "response")
+	m.gauge("go_proxy_store_spilled_bodies", "Captures whose request body was spooled to disk", float64(usage.Spilled))
+	m.gauge("go_proxy_active_tunnels", "CONNECT tunnels open", float64(s.proxy.ActiveTunnels()))
+	m.counter("go_proxy_bypassed_total", "Requests and tunnels to bypassed hosts, forwarded without capture or refused", float64(s.proxy.Bypass().Bypassed()))
+
+	pool := s.proxy.ConnPool().Stats()
+	m.counter("go_proxy_upstream_requests_total", "Requests given an upstream connection", float64(pool.Requests))
+	m.counter("go_proxy_upstream_conn_reused_total", "Requests given a connection that carried earlier requests", float64(pool.Reused))
+	m.counter("go_proxy_upstream_conn_wait_seconds_total", "Time requests waited for an upstream connection, dialing included", pool.WaitTotalMS/1000)
+	for _, h := range pool.Hosts {
+		m.gauge("go_proxy_upstream_conns", "Open upstream connections by host and state", float64(h.Idle), "host", h.Host, "state", "idle")
+		m.gauge("go_proxy_upstream_conns", "Open upstream connections by host and state", float64(h.Active), "host", h.Host, "state", "active")
+	}
+}
+
+// metricsWriter writes samples in the Prometheus text exposition format,
+// declaring each metric before its first sample. Samples of one metric
+// must be written together.
+type metricsWriter struct {
+	w    io.Writer
+	last string
+}
+
+func (m *metricsWriter) counter(name, help string, value float64, labels ...string) {
+	m.sample(name, "counter", help, value, labels)
+}
+
+func (m *metricsWriter) gauge(name, help string, value float64, labels ...string) {
+	m.sample(name, "gauge", help, value, labels)
+}
+
+// sample writes one sample; labels are name/value pairs
+func (m *metricsWriter) sample(name, typ, help string, value float64, labels []string) {
+	if name != m.last {
+		fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+		m.last = name
+	}
+	var b strings.Builder
+	b.WriteString(name)
+	if len(labels) > 0 {
+		b.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(labels[i])
+			b.WriteString(`="`)
+			b.WriteString(labelEscaper.Replace(labels[i+1]))
+			b.WriteByte('"')
+		}
+		b.WriteByte('}')
+	}
+	b.WriteByte(' ')
+	b.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	b.WriteByte('\n')
+	io.WriteString(m.w, b.String())
+}
+
+// labelEscaper escapes label values
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
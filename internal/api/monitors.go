@@ -0,0 +1,125 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+	"github.com/adamdrake/go_proxy/internal/monitor"
+)
+
+// monitorRequest is the body of POST /api/monitors: a monitor spec and
+// the captures to replay, by ID, all of a recorded session, or the steps
+// of a recorded flow
+type monitorRequest struct {
+	monitor.Spec
+	RequestIDs []string `json:"request_ids,omitempty"`
+	Session    string   `json:"session,omitempty"`
+	Flow       string   `json:"flow,omitempty"`
+}
+
+// handleMonitors lists (GET) or creates (POST) synthetic monitors
+func (s *Server) handleMonitors(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		monitors := s.monitors.List()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"monitors": monitors,
+			"count":    len(monitors),
+		})
+
+	case http.MethodPost:
+		var req monitorRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid monitor JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		sources := 0
+		for _, set := range []bool{len(req.RequestIDs) > 0, req.Session != "", req.Flow != ""} {
+			if set {
+				sources++
+			}
+		}
+		if sources != 1 {
+			http.Error(w, "Exactly one of request_ids, session or flow is required", http.StatusBadRequest)
+			return
+		}
+
+		var captures []*capture.CapturedRequest
+		store := s.storeFor(r)
+		if req.Session != "" {
+			captures = requestFilter{session: req.Session}.apply(store)
+		}
+		if req.Flow != "" {
+			var ok bool
+			if _, captures, ok = s.flows.get(req.Flow); !ok {
+				http.Error(w, "Flow not found: "+req.Flow, http.StatusNotFound)
+				return
+			}
+		}
+		for _, id := range req.RequestIDs {
+			captured := store.GetByID(id)
+			if captured == nil {
+				http.Error(w, "Request not found: "+id, http.StatusNotFound)
+				return
+			}
+			captures = append(captures, captured)
+		}
+
+		created, err := s.monitors.Add(req.Spec, captures)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(created)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleMonitorByID returns a monitor with its run series (GET) or
+// removes it (DELETE); POST /api/monitors/{id}/run replays it now
+func (s *Server) handleMonitorByID(w http.ResponseWriter, r *http.Request) {
+	id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/monitors/"), "/")
+
+	switch {
+	case action == "run" && r.Method == http.MethodPost:
+		run, ok := s.monitors.RunNow(r.Context(), id)
+		if !ok {
+			http.Error(w, "Monitor not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(run)
+
+	case action != "":
+		http.NotFound(w, r)
+
+	case r.Method == http.MethodGet:
+		m, runs, ok := s.monitors.Get(id)
+		if !ok {
+			http.Error(w, "Monitor not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"monitor": m,
+			"runs":    runs,
+		})
+
+	case r.Method == http.MethodDelete:
+		if !s.monitors.Remove(id) {
+			http.Error(w, "Monitor not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
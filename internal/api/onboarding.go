@@ -0,0 +1,201 @@
+package api
+
+import (
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/adamdrake/go_proxy/internal/proxy"
+)
+
+// platform is a device type with its proxy setup steps
+type platform struct {
+	ID    string
+	Name  string
+	Steps []string
+}
+
+// platforms returns setup steps for each supported device type, for a
+// proxy at host:port and a PAC file at pacURL
+func platforms(host, port, pacURL string) []platform {
+	return []platform{
+		{"ios", "iPhone / iPad", []string{
+			"Open Settings → Wi-Fi and tap ⓘ next to your network.",
+			"Scroll to Configure Proxy and choose Manual.",
+			fmt.Sprintf("Server: %s, Port: %s, then tap Save.", host, port),
+			"Or choose Automatic and enter the PAC URL: " + pacURL,
+		}},
+		{"android", "Android", []string{
+			"Open Settings → Network & internet → Wi-Fi and tap your network, then the edit (pencil) icon.",
+			"Open Advanced options and set Proxy to Manual.",
+			fmt.Sprintf("Proxy hostname: %s, Proxy port: %s, then Save.", host, port),
+			"Or set Proxy to Proxy Auto-Config with the PAC URL: " + pacURL,
+		}},
+		{"macos", "macOS", []string{
+			"Open System Settings → Network, select your network and click Details → Proxies.",
+			fmt.Sprintf("Enable Web proxy (HTTP) and Secure web proxy (HTTPS) with server %s, port %s.", host, port),
+			"Or enable Automatic proxy configuration with the PAC URL: " + pacURL,
+			"On the proxy machine itself, ./proxy -set-system-proxy does this for you.",
+		}},
+		{"windows", "Windows", []string{
+			"Open Settings → Network & internet → Proxy.",
+			fmt.Sprintf("Under Manual proxy setup, click Set up, turn on Use a proxy server and enter %s port %s.", host, port),
+			"Or under Automatic proxy setup, turn on Use setup script with the PAC URL: " + pacURL,
+		}},
+		{"linux", "Linux", []string{
+			fmt.Sprintf("GNOME: Settings → Network → Network Proxy → Manual, HTTP and HTTPS proxy %s port %s.", host, port),
+			fmt.Sprintf("Shell: export http_proxy=http://%s:%s https_proxy=http://%s:%s", host, port, host, port),
+		}},
+	}
+}
+
+// detectPlatform guesses a visitor's platform from its User-Agent
+func detectPlatform(userAgent string) string {
+	ua := strings.ToLower(userAgent)
+	switch {
+	case strings.Contains(ua, "iphone"), strings.Contains(ua, "ipad"):
+		return "ios"
+	case strings.Contains(ua, "android"):
+		return "android"
+	case strings.Contains(ua, "mac os x"), strings.Contains(ua, "macintosh"):
+		return "macos"
+	case strings.Contains(ua, "windows"):
+		return "windows"
+	case strings.Contains(ua, "linux"):
+		return "linux"
+	}
+	return ""
+}
+
+var onboardingPage = template.Must(template.New("onboarding").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Go Proxy setup</title>
+<style>
+body { font-family: -apple-system, system-ui, sans-serif; max-width: 40em; margin: 1em auto; padding: 0 1em; line-height: 1.5; }
+code { background: #f2f2f2; padding: 0 .3em; }
+details { margin: .5em 0; }
+summary { font-weight: bold; cursor: pointer; }
+#check { padding: .7em 1em; border-radius: .4em; background: #eee; }
+#check.ok { background: #d8f5d8; }
+#check.fail { background: #fbe0e0; }
+</style>
+</head>
+<body>
+<h1>Go Proxy setup</h1>
+<p>Proxy: <code>{{.Host}}:{{.Port}}</code><br>
+PAC file: <a href="{{.PACURL}}"><code>{{.PACURL}}</code></a></p>
+
+<p id="check">Checking whether this device's traffic goes through the proxy…</p>
+
+<h2>Configure this device</h2>
+{{range .Platforms}}
+<details{{if eq .ID $.Detected}} open{{end}}>
+<summary>{{.Name}}</summary>
+<ol>{{range .Steps}}<li>{{.}}</li>{{end}}</ol>
+</details>
+{{end}}
+
+<h2>Certificates</h2>
+<p>No CA certificate is needed: HTTPS traffic is tunneled, not intercepted,
+so captures show the hosts and timing of HTTPS connections but not their
+contents.</p>
+
+<p><img src="/api/setup/qr" alt="QR code of this page" width="200"><br>
+Scan to open this page on a phone.</p>
+
+<script>
+(function () {
+  var el = document.getElementById("check");
+  function check() {
+    fetch("http://{{.CheckHost}}/?" + Date.now(), {cache: "no-store"})
+      .then(function (r) { return r.json(); })
+      .then(function (d) {
+        el.className = "ok";
+        el.textContent = "✓ Traffic from this device is flowing through the proxy (seen from " + d.client_addr + ").";
+      })
+      .catch(function () {
+        el.className = "fail";
+        el.textContent = "✗ This device is not using the proxy yet. Follow the steps below; this check repeats every few seconds.";
+        setTimeout(check, 3000);
+      });
+  }
+  check();
+})();
+</script>
+</body>
+</html>
+`))
+
+// handleOnboarding serves the device setup page at the API root
+func (s *Server) handleOnboarding(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	host, port, _ := net.SplitHostPort(s.setup.ProxyAddr)
+	pacURL := s.setup.APIURL + "/proxy.pac"
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	onboardingPage.Execute(w, map[string]interface{}{
+		"Host":      host,
+		"Port":      port,
+		"PACURL":    pacURL,
+		"Platforms": platforms(host, port, pacURL),
+		"Detected":  detectPlatform(r.UserAgent()),
+		"CheckHost": proxy.CheckHost,
+	})
+}
+
+// handlePAC serves a proxy auto-config file pointing at the proxy. Hosts
+// bypassed in direct mode go direct.
+func (s *Server) handlePAC(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	fmt.Fprintf(w, "function FindProxyForURL(url, host) {\n")
+	if hosts, mode := s.proxy.Bypass().List(); mode == proxy.BypassDirect {
+		for _, cond := range pacConditions(hosts) {
+			fmt.Fprintf(w, "  if (%s) return \"DIRECT\";\n", cond)
+		}
+	}
+	fmt.Fprintf(w, "  return \"PROXY %s; DIRECT\";\n}\n", s.setup.ProxyAddr)
+}
+
+// pacConditions translates bypass entries into PAC expressions. Entries
+// limited to a port and IPv6 networks are left to the proxy.
+func pacConditions(hosts []string) []string {
+	var conds []string
+	for _, h := range hosts {
+		if _, _, err := net.SplitHostPort(h); err == nil {
+			continue
+		}
+		if ip, network, err := net.ParseCIDR(h); err == nil {
+			if ip.To4() != nil {
+				conds = append(conds, fmt.Sprintf("isInNet(host, %q, %q)", network.IP.String(), net.IP(network.Mask).String()))
+			}
+			continue
+		}
+		switch {
+		case h == "*":
+			conds = append(conds, "true")
+		case net.ParseIP(h) != nil:
+			conds = append(conds, fmt.Sprintf("host == %q", h))
+		case strings.HasPrefix(h, "."), strings.HasPrefix(h, "*."):
+			conds = append(conds, fmt.Sprintf("dnsDomainIs(host, %q)", strings.TrimPrefix(h, "*")))
+		default:
+			conds = append(conds, fmt.Sprintf("host == %q || dnsDomainIs(host, %q)", h, "."+h))
+		}
+	}
+	return conds
+}
@@ -0,0 +1,642 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+	"github.com/adamdrake/go_proxy/internal/monitor"
+	"github.com/adamdrake/go_proxy/internal/rules"
+)
+
+// operation documents one method of an API route for /api/openapi.json.
+// Params name entries of openAPIParams; Request and Response name
+// component schemas, or are one of the content shortcuts in
+// openAPIContent. An empty Response means 204 No Content.
+type operation struct {
+	Method   string
+	ID       string
+	Summary  string
+	Params   []string
+	Request  string
+	Response string
+}
+
+// filterParams are the /api/requests filter parameters
+var filterParams = []string{"q", "since", "until", "host", "tag", "session", "source", "party", "upstream_ip", "country", "asn", "correlation_id", "sha256", "finding", "param", "redirect_chain", "modified", "would_apply", "pii", "secrets", "credentials", "limit"}
+
+// pollFilterParams are the filter parameters that apply to captures one
+// at a time, for streams and polls
+var pollFilterParams = slices.DeleteFunc(slices.Clone(filterParams), func(p string) bool { return p == "q" || p == "limit" })
+
+// operations documents every route NewServer registers, by pattern.
+// The client package follows the operation IDs.
+var operations = map[string][]operation{
+	"/api/requests": {
+		{http.MethodGet, "listRequests", "Captured requests matching the filters, oldest first", filterParams, "", "CaptureList"},
+	},
+	"/api/requests/{id}": {
+		{http.MethodGet, "getRequest", "One capture by ID", nil, "", "Capture"},
+	},
+	"/api/requests/{id}/code": {
+		{http.MethodGet, "getRequestCode", "A capture rendered as client code", []string{"lang"}, "", "text"},
+	},
+	"/api/requests/{id}/raw": {
+		{http.MethodGet, "getRequestRaw", "The request or response exactly as it crossed the wire (-capture-raw)", []string{"part"}, "", "binary"},
+	},
+	"/api/requests/{id}/upload": {
+		{http.MethodGet, "getRequestUpload", "Full body of an upload spooled to disk; unencrypted ones honor Range", nil, "", "binary"},
+	},
+	"/api/requests/{id}/decode": {
+		{http.MethodGet, "decodeRequestBody", "Schema-less decoding of a protobuf or Thrift body", []string{"part", "format"}, "", "object"},
+	},
+	"/api/requests/{id}/fuzz": {
+		{http.MethodPost, "fuzzRequest", "Replay a capture with mutated inputs and report responses that differ", nil, "object", "object"},
+	},
+	"/api/requests/{id}/preview": {
+		{http.MethodGet, "previewRequestBody", "Body decompressed and transcoded to UTF-8", []string{"part"}, "", "text"},
+	},
+	"/api/requests/{id}/redirects": {
+		{http.MethodGet, "getRequestRedirects", "The redirect chain a capture belongs to, first hop first", nil, "", "object"},
+	},
+	"/api/requests/stream": {
+		{http.MethodGet, "streamRequests", "Server-sent events with each new capture, periodic store stats and traffic anomalies", []string{"stats_interval"}, "", "events"},
+	},
+	"/api/requests/poll": {
+		{http.MethodGet, "pollRequests", "Captures stored after since_seq, waiting up to timeout for one", append([]string{"since_seq", "timeout"}, pollFilterParams...), "", "PollResult"},
+	},
+	"/api/clear": {
+		{http.MethodPost, "clear", "Remove every capture", nil, "", "Status"},
+		{http.MethodDelete, "clearDelete", "Remove every capture", nil, "", "Status"},
+	},
+	"/api/search": {
+		{http.MethodGet, "search", "Full-text search with highlighted snippets", []string{"q", "limit"}, "", "object"},
+	},
+	"/api/downloads": {
+		{http.MethodGet, "listDownloads", "Ranged downloads coalesced per resource", filterParams, "", "object"},
+	},
+	"/api/findings": {
+		{http.MethodGet, "listFindings", "Security findings by type, severity and host", filterParams, "", "object"},
+	},
+	"/api/analysis/headers": {
+		{http.MethodGet, "gradeHeaders", "Security header grades per host, worst first", filterParams, "", "object"},
+	},
+	"/api/analysis/credentials": {
+		{http.MethodGet, "listCredentialEndpoints", "Endpoints receiving credentials, cleartext first", append([]string{"all"}, filterParams...), "", "object"},
+	},
+	"/api/transactions": {
+		{http.MethodGet, "listTransactions", "Requests grouped into page loads and app actions", append([]string{"gap", "kind"}, filterParams...), "", "object"},
+	},
+	"/api/hints": {
+		{http.MethodGet, "auditHints", "Preloaded and early-hinted resources and whether clients fetched them", append([]string{"within"}, filterParams...), "", "object"},
+	},
+	"/api/transactions/{id}": {
+		{http.MethodGet, "getTransaction", "One transaction with its requests", nil, "", "object"},
+	},
+	"/api/transactions/{id}/waterfall": {
+		{http.MethodGet, "getTransactionWaterfall", "Network waterfall of a transaction", nil, "", "object"},
+	},
+	"/api/sessions": {
+		{http.MethodGet, "listSessions", "Recorded sessions and the active one", nil, "", "object"},
+		{http.MethodPost, "startSession", "Start a named recording session", nil, "object", "object"},
+		{http.MethodDelete, "endSession", "End the active session", nil, "", "object"},
+	},
+	"/api/parties": {
+		{http.MethodGet, "getParties", "First-party domain lists and the third-party block toggle", nil, "", "object"},
+		{http.MethodPut, "setParties", "Set a first-party domain list or the block toggle", nil, "object", "object"},
+	},
+	"/api/bypass": {
+		{http.MethodGet, "getBypass", "Hosts kept out of capture and whether they are forwarded or refused", nil, "", "object"},
+		{http.MethodPut, "setBypass", "Replace the bypassed hosts or the bypass mode", nil, "object", "object"},
+	},
+	"/api/stats": {
+		{http.MethodGet, "getStats", "Request statistics", nil, "", "object"},
+	},
+	"/api/stats/circuits": {
+		{http.MethodGet, "listCircuits", "Per-host circuit breaker states", nil, "", "object"},
+		{http.MethodDelete, "resetCircuits", "Close every circuit", nil, "", "Status"},
+	},
+	"/api/stats/connections": {
+		{http.MethodGet, "getConnections", "Upstream connection reuse, wait times and open connections per host", nil, "", "object"},
+	},
+	"/api/stats/compare": {
+		{http.MethodGet, "compareSessions", "Contrast two sessions", append([]string{"a", "b"}, filterParams...), "", "object"},
+	},
+	"/api/stats/store": {
+		{http.MethodGet, "getStoreStats", "Store size, approximate memory use, evictions and truncated or spooled bodies", nil, "", "StoreStats"},
+	},
+	"/api/stats/slowest": {
+		{http.MethodGet, "slowestEndpoints", "Slowest endpoints by p95 latency", append([]string{"n", "window"}, filterParams...), "", "object"},
+	},
+	"/api/stats/errors": {
+		{http.MethodGet, "failingEndpoints", "Endpoints with the most errors", append([]string{"n", "window"}, filterParams...), "", "object"},
+	},
+	"/api/stats/largest": {
+		{http.MethodGet, "largestEndpoints", "Endpoints with the largest responses", append([]string{"n", "window"}, filterParams...), "", "object"},
+	},
+	"/api/store/snapshot": {
+		{http.MethodGet, "snapshotStore", "Point-in-time snapshot of the store as gzipped JSON lines", nil, "", "binary"},
+	},
+	"/api/store/compact": {
+		{http.MethodPost, "compactStore", "Release memory held after evictions", nil, "", "CompactStats"},
+	},
+	"/api/store/import": {
+		{http.MethodPost, "importStore", "Merge a snapshot or NDJSON export from another instance", []string{"on_conflict", "tag"}, "binary", "MergeStats"},
+	},
+	"/api/collect": {
+		{http.MethodPost, "collect", "Ingest a batch of captures forwarded by another instance (-collector)", nil, "binary", "MergeStats"},
+	},
+	"/api/collect/sources": {
+		{http.MethodGet, "listCollectorSources", "Instances forwarding to this collector", nil, "", "object"},
+	},
+	"/api/graphql": {
+		{http.MethodGet, "graphqlGet", "Run a GraphQL query", []string{"query", "variables", "operationName"}, "", "object"},
+		{http.MethodPost, "graphql", "Run a GraphQL query", nil, "object", "object"},
+	},
+	"/api/graphql/schema": {
+		{http.MethodGet, "graphqlSchema", "GraphQL schema definition", nil, "", "text"},
+	},
+	"/api/openapi.json": {
+		{http.MethodGet, "openapi", "This document", nil, "", "object"},
+	},
+	"/api/flows": {
+		{http.MethodGet, "listFlows", "Recorded flows with their step counts", nil, "", "object"},
+	},
+	"/api/flows/record/{action}": {
+		{http.MethodPost, "recordFlow", "Start or stop recording a named flow", append([]string{"name"}, filterParams...), "", "Flow"},
+	},
+	"/api/flows/{name}": {
+		{http.MethodGet, "getFlow", "A flow with its ordered captures", nil, "", "object"},
+		{http.MethodDelete, "deleteFlow", "Remove a flow", nil, "", ""},
+	},
+	"/api/monitors": {
+		{http.MethodGet, "listMonitors", "Synthetic monitors", nil, "", "object"},
+		{http.MethodPost, "createMonitor", "Create a monitor replaying captures on a schedule", nil, "object", "Monitor"},
+	},
+	"/api/monitors/{id}": {
+		{http.MethodGet, "getMonitor", "A monitor with its recent runs", nil, "", "object"},
+		{http.MethodDelete, "deleteMonitor", "Remove a monitor", nil, "", ""},
+	},
+	"/api/monitors/{id}/run": {
+		{http.MethodPost, "runMonitor", "Replay a monitor now", nil, "", "Run"},
+	},
+	"/api/anomalies": {
+		{http.MethodGet, "getAnomalies", "Traffic anomalies open and recently seen", nil, "", "object"},
+		{http.MethodPut, "setAnomalyWatch", "Replace the hosts watched for traffic drops", nil, "object", "object"},
+	},
+	"/api/dns/cache": {
+		{http.MethodGet, "getDNSCache", "Upstream DNS cache entries", nil, "", "object"},
+		{http.MethodDelete, "flushDNSCache", "Flush the DNS cache or one host", []string{"host"}, "", "object"},
+	},
+	"/api/rules": {
+		{http.MethodGet, "listRules", "Rewrite rules", nil, "", "object"},
+		{http.MethodPost, "createRule", "Add a rewrite rule", nil, "Rule", "Rule"},
+		{http.MethodDelete, "clearRules", "Remove every rule", nil, "", "Status"},
+	},
+	"/api/rules/{id}": {
+		{http.MethodGet, "getRule", "One rule", nil, "", "Rule"},
+		{http.MethodPut, "replaceRule", "Replace a rule", nil, "Rule", "Rule"},
+		{http.MethodDelete, "deleteRule", "Remove a rule", nil, "", "Status"},
+	},
+	"/api/rules/profiles": {
+		{http.MethodGet, "listProfiles", "Built-in device profiles", nil, "", "object"},
+	},
+	"/api/rules/dry-run": {
+		{http.MethodGet, "getDryRun", "Whether rules, blocking and pacing only record what they would do", nil, "", "object"},
+		{http.MethodPut, "setDryRun", "Turn dry-run mode on or off", nil, "object", "object"},
+	},
+	"/api/rules/test": {
+		{http.MethodPost, "testRules", "Run a rule set over a sample request or a capture without installing it", nil, "object", "object"},
+	},
+	"/api/rules/import": {
+		{http.MethodPost, "importRules", "Add the rules of a Charles Proxy, Proxyman or ModHeader export", []string{"format", "dry_run", "preview"}, "binary", "object"},
+	},
+	"/api/websockets": {
+		{http.MethodGet, "listWebSockets", "Live WebSocket connections", nil, "", "object"},
+	},
+	"/api/websockets/{id}": {
+		{http.MethodGet, "getWebSocket", "A live connection with its messages", nil, "", "object"},
+	},
+	"/api/websockets/{id}/inject": {
+		{http.MethodPost, "injectWebSocketMessage", "Send a synthetic message to the client or server", nil, "object", "object"},
+	},
+	"/api/export/mitmproxy": {
+		{http.MethodGet, "exportMitmproxy", "Captures as a mitmproxy flow file", filterParams, "", "binary"},
+	},
+	"/api/export/saz": {
+		{http.MethodGet, "exportSAZ", "Captures as a Fiddler SAZ archive", filterParams, "", "binary"},
+	},
+	"/api/export/pcapng": {
+		{http.MethodGet, "exportPcapng", "Captures as fabricated TCP traffic for Wireshark", append([]string{"format"}, filterParams...), "", "binary"},
+	},
+	"/api/export/warc": {
+		{http.MethodGet, "exportWARC", "Captures as a WARC archive", append([]string{"gzip"}, filterParams...), "", "binary"},
+	},
+	"/api/export/ndjson": {
+		{http.MethodGet, "exportNDJSON", "Captures as JSON lines", filterParams, "", "binary"},
+	},
+	"/api/import/mitmproxy": {
+		{http.MethodPost, "importMitmproxy", "Load HTTP flows from a mitmproxy flow file", nil, "binary", "object"},
+	},
+	"/api/setup": {
+		{http.MethodGet, "getSetup", "Proxy address and setup URL for other devices", nil, "", "object"},
+	},
+	"/api/setup/qr": {
+		{http.MethodGet, "getSetupQR", "PNG QR code of the setup URL", []string{"scale"}, "", "png"},
+	},
+	"/api/tenants": {
+		{http.MethodGet, "listTenants", "Configured tenants with their capture counts", nil, "", "object"},
+	},
+	"/api/audit": {
+		{http.MethodGet, "listAudit", "Audit log of state-changing API calls (admin)", []string{"since", "limit"}, "", "AuditList"},
+	},
+	"/api/admin/shutdown": {
+		{http.MethodPost, "shutdown", "Stop the proxy gracefully (admin)", nil, "", "Status"},
+	},
+	"/api/admin/restart": {
+		{http.MethodPost, "restart", "Stop gracefully and re-exec with the same flags (admin)", nil, "", "Status"},
+	},
+	"/health": {
+		{http.MethodGet, "health", "Health check", nil, "", "Status"},
+	},
+	"/metrics": {
+		{http.MethodGet, "metrics", "Metrics in the Prometheus text format", nil, "", "text"},
+	},
+	"/proxy.pac": {
+		{http.MethodGet, "proxyPAC", "Proxy auto-config file", nil, "", "pac"},
+	},
+	"/": {
+		{http.MethodGet, "setupPage", "Device setup page", nil, "", "html"},
+	},
+}
+
+// successStatus lists operations answering other than 200 OK
+var successStatus = map[string]int{
+	"createRule":    http.StatusCreated,
+	"createMonitor": http.StatusCreated,
+	"shutdown":      http.StatusAccepted,
+	"restart":       http.StatusAccepted,
+}
+
+// failureStatus lists the errors particular to some operations, besides
+// the ones every operation may answer
+var failureStatus = map[string][]int{
+	"getRequestUpload":   {http.StatusGone, http.StatusRequestedRangeNotSatisfiable},
+	"decodeRequestBody":  {http.StatusUnsupportedMediaType, http.StatusUnprocessableEntity},
+	"previewRequestBody": {http.StatusUnsupportedMediaType},
+	"shutdown":           {http.StatusConflict},
+	"restart":            {http.StatusConflict},
+}
+
+// openAPIParams describes the query parameters operations refer to
+var openAPIParams = map[string]struct {
+	Type        string
+	Description string
+}{
+	"q":              {"string", "Terms that must all appear in the URL, headers or text bodies"},
+	"since":          {"string", "Start of a time range: RFC 3339, Unix seconds, or a duration ago such as 15m"},
+	"until":          {"string", "End of a time range, in the same forms as since"},
+	"host":           {"string", "Host, with or without port"},
+	"tag":            {"string", "Label sent with X-GoProxy-Tag, or given on import"},
+	"session":        {"string", "Recording session name"},
+	"source":         {"string", "Instance that forwarded the captures to this collector"},
+	"party":          {"string", "first or third"},
+	"upstream_ip":    {"string", "Upstream IP address"},
+	"country":        {"string", "ISO country code of the upstream address"},
+	"asn":            {"string", "Autonomous system of the upstream address, e.g. AS15169"},
+	"correlation_id": {"string", "Correlation ID"},
+	"sha256":         {"string", "SHA-256 of the request or response body"},
+	"finding":        {"string", "Security finding type"},
+	"param":          {"string", "Query parameter name:value, or name for any value; repeatable"},
+	"redirect_chain": {"string", "Redirect chain, named by the ID of its first capture"},
+	"modified":       {"boolean", "Only captures touched (true) or untouched (false) by rules"},
+	"would_apply":    {"boolean", "Only captures dry-run rules would (true) or would not (false) have touched"},
+	"pii":            {"boolean", "Only captures with (true) or without (false) personal data"},
+	"secrets":        {"boolean", "Only captures with (true) or without (false) credentials"},
+	"credentials":    {"boolean", "Only captures that carried (true) or did not carry (false) Basic, Digest or query-string credentials"},
+	"all":            {"boolean", "Include endpoints that only received credentials over HTTPS"},
+	"limit":          {"integer", "Keep only the most recent N"},
+	"lang":           {"string", "go, python or js"},
+	"part":           {"string", "request or response"},
+	"format":         {"string", "Encoding or file format variant"},
+	"dry_run":        {"boolean", "Add the rules in dry-run mode"},
+	"preview":        {"boolean", "Only return the translated rules"},
+	"gap":            {"string", "Idle time that ends a transaction, e.g. 2s"},
+	"kind":           {"string", "Transaction kind"},
+	"within":         {"string", "How long after a page a fetch of a hinted resource counts as using it, e.g. 30s"},
+	"a":              {"string", "First session"},
+	"b":              {"string", "Second session"},
+	"n":              {"integer", "Number of endpoints"},
+	"window":         {"string", "How far back to look, e.g. 15m"},
+	"on_conflict":    {"string", "rename (default) or skip captures whose ID is taken"},
+	"name":           {"string", "Name"},
+	"query":          {"string", "GraphQL query"},
+	"variables":      {"string", "GraphQL variables as JSON"},
+	"operationName":  {"string", "GraphQL operation to run"},
+	"gzip":           {"boolean", "Compress the archive (default true)"},
+	"scale":          {"integer", "Pixels per QR module"},
+	"stats_interval": {"string", "How often to send stats events, e.g. 5s (0 disables them)"},
+	"since_seq":      {"integer", "Sequence number to continue from, the next_seq of the last poll (default: the latest capture)"},
+	"timeout":        {"string", "How long to wait for a capture, e.g. 30s (at most 2m)"},
+}
+
+// openAPISchemas are the component schemas, derived from the Go types
+// the handlers encode
+var openAPISchemas = []struct {
+	Name string
+	Type reflect.Type
+}{
+	{"Capture", reflect.TypeFor[capture.CapturedRequest]()},
+	{"MergeStats", reflect.TypeFor[capture.MergeStats]()},
+	{"CompactStats", reflect.TypeFor[capture.CompactStats]()},
+	{"StoreStats", reflect.TypeFor[storeStats]()},
+	{"Rule", reflect.TypeFor[rules.Rule]()},
+	{"Monitor", reflect.TypeFor[monitor.Monitor]()},
+	{"Run", reflect.TypeFor[monitor.Run]()},
+	{"Flow", reflect.TypeFor[Flow]()},
+	{"AuditEntry", reflect.TypeFor[AuditEntry]()},
+	{"CollectorSource", reflect.TypeFor[CollectorSource]()},
+}
+
+// buildOpenAPI returns the OpenAPI document for the registered route
+// patterns. It panics when a route is not documented in operations, so a
+// new endpoint cannot be added without its entry.
+func buildOpenAPI(patterns []string) []byte {
+	schemas := &schemaSet{defs: map[string]interface{}{}, names: map[reflect.Type]string{}}
+	for _, s := range openAPISchemas {
+		schemas.names[s.Type] = s.Name
+	}
+	for _, s := range openAPISchemas {
+		schemas.ref(s.Type)
+	}
+	schemas.defs["CaptureList"] = object(map[string]interface{}{
+		"requests": map[string]interface{}{"type": "array", "items": ref("Capture")},
+		"count":    map[string]interface{}{"type": "integer"},
+	})
+	schemas.defs["AuditList"] = object(map[string]interface{}{
+		"entries": map[string]interface{}{"type": "array", "items": ref("AuditEntry")},
+		"count":   map[string]interface{}{"type": "integer"},
+	})
+	schemas.defs["PollResult"] = object(map[string]interface{}{
+		"requests": map[string]interface{}{"type": "array", "items": ref("Capture")},
+		"count":    map[string]interface{}{"type": "integer"},
+		"next_seq": map[string]interface{}{"type": "integer"},
+	})
+	schemas.defs["Status"] = object(map[string]interface{}{
+		"status": map[string]interface{}{"type": "string"},
+	})
+
+	paths := map[string]interface{}{}
+	documented := map[string]bool{}
+	for path, ops := range operations {
+		// Documented paths name their parameters; the mux pattern is the
+		// prefix before the first one
+		pattern := path
+		if i := strings.Index(path, "{"); i >= 0 {
+			pattern = path[:i]
+		}
+		documented[pattern] = true
+
+		item := map[string]interface{}{}
+		for _, op := range ops {
+			item[strings.ToLower(op.Method)] = openAPIOperation(path, op)
+		}
+		paths[versionedPath(path)] = item
+	}
+	for _, pattern := range patterns {
+		if !documented[pattern] {
+			panic(fmt.Sprintf("api: route %s is missing from the OpenAPI operations", pattern))
+		}
+	}
+
+	doc := map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":       "go_proxy API",
+			"version":     strings.TrimPrefix(APIVersion, "v"),
+			"description": "Captures, rules, reports and administration of a go_proxy instance. Paths under /api/" + APIVersion + "/ keep the fields and parameters described here; the unversioned /api/ paths are aliases of the current version. With -api-token, send Authorization: Bearer TOKEN; GET needs the read role, other methods operator, the admin/ and audit routes admin. Unscoped tokens pick a tenant with ?tenant=NAME.",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": schemas.defs,
+			"securitySchemes": map[string]interface{}{
+				"bearer": map[string]interface{}{"type": "http", "scheme": "bearer"},
+			},
+		},
+		"security": []interface{}{map[string]interface{}{"bearer": []string{}}},
+	}
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+// openAPIOperation builds the operation object for op on path
+func openAPIOperation(path string, op operation) map[string]interface{} {
+	var params []interface{}
+	for _, segment := range strings.Split(path, "/") {
+		if name, ok := strings.CutPrefix(segment, "{"); ok {
+			params = append(params, map[string]interface{}{
+				"name": strings.TrimSuffix(name, "}"), "in": "path", "required": true,
+				"schema": map[string]interface{}{"type": "string"},
+			})
+		}
+	}
+	for _, name := range op.Params {
+		p, ok := openAPIParams[name]
+		if !ok {
+			panic(fmt.Sprintf("api: parameter %s of %s is not described", name, op.ID))
+		}
+		params = append(params, map[string]interface{}{
+			"name": name, "in": "query", "description": p.Description,
+			"schema": map[string]interface{}{"type": p.Type},
+		})
+	}
+
+	responses := map[string]interface{}{
+		"400": map[string]interface{}{"description": "Invalid parameters"},
+		"401": map[string]interface{}{"description": "Missing or unknown token"},
+		"403": map[string]interface{}{"description": "Token role too weak"},
+		"404": map[string]interface{}{"description": "Unknown ID, or the feature is off"},
+	}
+	for _, code := range failureStatus[op.ID] {
+		responses[strconv.Itoa(code)] = map[string]interface{}{"description": http.StatusText(code)}
+	}
+	if op.Response == "" {
+		responses["204"] = map[string]interface{}{"description": "No Content"}
+	} else {
+		status := http.StatusOK
+		if code, ok := successStatus[op.ID]; ok {
+			status = code
+		}
+		responses[strconv.Itoa(status)] = map[string]interface{}{
+			"description": http.StatusText(status),
+			"content":     openAPIContent(op.Response),
+		}
+	}
+	result := map[string]interface{}{
+		"operationId": op.ID,
+		"summary":     op.Summary,
+		"responses":   responses,
+	}
+	if len(params) > 0 {
+		result["parameters"] = params
+	}
+	if op.Request != "" {
+		result["requestBody"] = map[string]interface{}{"required": true, "content": openAPIContent(op.Request)}
+	}
+	return result
+}
+
+// openAPIContent maps a schema name or content shortcut to a content
+// object
+func openAPIContent(kind string) map[string]interface{} {
+	media := func(typ string, schema interface{}) map[string]interface{} {
+		return map[string]interface{}{typ: map[string]interface{}{"schema": schema}}
+	}
+	switch kind {
+	case "object":
+		return media("application/json", map[string]interface{}{"type": "object"})
+	case "text":
+		return media("text/plain", map[string]interface{}{"type": "string"})
+	case "pac":
+		return media("application/x-ns-proxy-autoconfig", map[string]interface{}{"type": "string"})
+	case "html":
+		return media("text/html", map[string]interface{}{"type": "string"})
+	case "events":
+		return media("text/event-stream", map[string]interface{}{"type": "string"})
+	case "png":
+		return media("image/png", map[string]interface{}{"type": "string", "format": "binary"})
+	case "binary":
+		return media("application/octet-stream", map[string]interface{}{"type": "string", "format": "binary"})
+	}
+	return media("application/json", ref(kind))
+}
+
+func ref(name string) map[string]interface{} {
+	return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+}
+
+func object(properties map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"type": "object", "properties": properties}
+}
+
+// schemaSet derives JSON schemas from Go types as encoding/json writes
+// them. Named structs become components, referred to by name.
+type schemaSet struct {
+	defs  map[string]interface{}
+	names map[reflect.Type]string
+}
+
+var timeType = reflect.TypeFor[time.Time]()
+
+// ref returns a reference to the component for struct type t, defining
+// it on first use
+func (s *schemaSet) ref(t reflect.Type) map[string]interface{} {
+	name, ok := s.names[t]
+	if !ok {
+		// Types of the same name from different packages keep theirs apart
+		name = t.Name()
+		if _, taken := s.defs[name]; taken {
+			name = path.Base(t.PkgPath()) + "." + name
+		}
+		s.names[t] = name
+	}
+	if _, defined := s.defs[name]; !defined {
+		s.defs[name] = nil // placeholder against recursion
+		s.defs[name] = s.structSchema(t)
+	}
+	return ref(name)
+}
+
+func (s *schemaSet) schema(t reflect.Type) map[string]interface{} {
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return s.schema(t.Elem())
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": s.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": s.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return s.structSchema(t)
+		}
+		return s.ref(t)
+	}
+	return map[string]interface{}{}
+}
+
+// structSchema lists the fields of a struct under their JSON names,
+// flattening embedded structs
+func (s *schemaSet) structSchema(t reflect.Type) map[string]interface{} {
+	properties := map[string]interface{}{}
+	var required []string
+	var add func(t reflect.Type)
+	add = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			tag := f.Tag.Get("json")
+			if tag == "-" || (!f.IsExported() && !f.Anonymous) {
+				continue
+			}
+			name, opts, _ := strings.Cut(tag, ",")
+			if f.Anonymous && name == "" {
+				ft := f.Type
+				if ft.Kind() == reflect.Pointer {
+					ft = ft.Elem()
+				}
+				if ft.Kind() == reflect.Struct {
+					add(ft)
+					continue
+				}
+			}
+			if name == "" {
+				name = f.Name
+			}
+			properties[name] = s.schema(f.Type)
+			if !strings.Contains(opts, "omitempty") && f.Type.Kind() != reflect.Pointer {
+				required = append(required, name)
+			}
+		}
+	}
+	add(t)
+	schema := object(properties)
+	if len(required) > 0 {
+		slices.Sort(required)
+		schema["required"] = required
+	}
+	return schema
+}
+
+// handleOpenAPI serves the OpenAPI document of this API
+func (s *Server) handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(s.openapi)
+}
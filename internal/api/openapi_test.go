@@ -0,0 +1,207 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adamdrake/go_proxy/internal/anomaly"
+	"github.com/adamdrake/go_proxy/internal/capture"
+	"github.com/adamdrake/go_proxy/internal/monitor"
+	"github.com/adamdrake/go_proxy/internal/proxy"
+)
+
+// openAPIDoc is the part of the served document the conformance test reads
+type openAPIDoc struct {
+	Paths map[string]map[string]struct {
+		OperationID string `json:"operationId"`
+		Parameters  []struct {
+			Name string `json:"name"`
+			In   string `json:"in"`
+		} `json:"parameters"`
+		RequestBody *struct {
+			Content map[string]json.RawMessage `json:"content"`
+		} `json:"requestBody"`
+		Responses map[string]struct {
+			Content map[string]struct {
+				Schema struct {
+					Ref  string `json:"$ref"`
+					Type string `json:"type"`
+				} `json:"schema"`
+			} `json:"content"`
+		} `json:"responses"`
+	} `json:"paths"`
+	Components struct {
+		Schemas map[string]struct {
+			Properties map[string]json.RawMessage `json:"properties"`
+		} `json:"schemas"`
+	} `json:"components"`
+}
+
+// newTestServer serves the API of a proxy holding one capture, with every
+// optional feature on
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	store := capture.NewStore(100)
+	store.Add(&capture.CapturedRequest{
+		ID:         "c1",
+		Timestamp:  time.Now(),
+		Method:     http.MethodGet,
+		URL:        "http://example.com/a",
+		Host:       "example.com",
+		Path:       "/a",
+		Proto:      "HTTP/1.1",
+		StatusCode: http.StatusOK,
+	})
+	monitors := monitor.NewScheduler(nil)
+	t.Cleanup(monitors.Close)
+	anomalies := anomaly.New(anomaly.Config{Window: time.Hour}, nil)
+	t.Cleanup(anomalies.Close)
+
+	s := NewServer(proxy.NewServer(proxy.DefaultConfig(), store), Config{
+		Monitors:  monitors,
+		Anomalies: anomalies,
+		Collector: true,
+	})
+	ts := httptest.NewServer(s.server.Handler)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// conformanceQuery holds query parameters operations need to answer at
+// once
+var conformanceQuery = map[string]string{
+	"pollRequests": "timeout=1ms",
+}
+
+// TestOpenAPIConformance calls every operation of /api/openapi.json on the
+// real routes and checks that documented methods are routed, undocumented
+// ones refused, and that successful responses have the documented status,
+// media type and, for component schemas, only documented fields.
+func TestOpenAPIConformance(t *testing.T) {
+	ts := newTestServer(t)
+
+	resp, err := http.Get(ts.URL + "/api/openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc openAPIDoc
+	err = json.NewDecoder(resp.Body).Decode(&doc)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for path, item := range doc.Paths {
+		target := strings.NewReplacer("{id}", "c1", "{name}", "missing", "{action}", "missing").Replace(path)
+		hasParams := target != path
+
+		for method, op := range item {
+			method = strings.ToUpper(method)
+			t.Run(op.OperationID, func(t *testing.T) {
+				for _, p := range op.Parameters {
+					if p.In == "query" && p.Name == "" {
+						t.Error("unnamed query parameter")
+					}
+				}
+
+				url := ts.URL + target
+				if query, ok := conformanceQuery[op.OperationID]; ok {
+					url += "?" + query
+				}
+				var body io.Reader
+				contentType := ""
+				if op.RequestBody != nil {
+					for contentType = range op.RequestBody.Content {
+					}
+					if contentType == "application/json" {
+						body = strings.NewReader("{}")
+					}
+				}
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				req, err := http.NewRequestWithContext(ctx, method, url, body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if contentType != "" {
+					req.Header.Set("Content-Type", contentType)
+				}
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer resp.Body.Close()
+
+				// Every feature is on, so only a sample path parameter
+				// naming nothing may be missing
+				msg := func() string {
+					b, _ := io.ReadAll(io.LimitReader(resp.Body, 200))
+					return strings.TrimSpace(string(b))
+				}
+				if resp.StatusCode == http.StatusNotFound && !hasParams {
+					t.Fatalf("%s %s is not found: %s", method, target, msg())
+				}
+				documented, ok := op.Responses[strconv.Itoa(resp.StatusCode)]
+				if !ok {
+					t.Fatalf("%s %s answered %d, which is not documented: %s", method, target, resp.StatusCode, msg())
+				}
+				if resp.StatusCode >= 300 || len(documented.Content) == 0 {
+					return
+				}
+
+				for media, content := range documented.Content {
+					got, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+					if got != media && media != "application/octet-stream" {
+						t.Errorf("Content-Type is %q, documented %q", got, media)
+					}
+					if media != "application/json" {
+						continue
+					}
+					var fields map[string]json.RawMessage
+					if err := json.NewDecoder(resp.Body).Decode(&fields); err != nil {
+						t.Fatalf("response is not a JSON object: %v", err)
+					}
+					name, ok := strings.CutPrefix(content.Schema.Ref, "#/components/schemas/")
+					if !ok {
+						continue
+					}
+					schema, ok := doc.Components.Schemas[name]
+					if !ok {
+						t.Fatalf("schema %s is not defined", name)
+					}
+					for field := range fields {
+						if _, ok := schema.Properties[field]; !ok {
+							t.Errorf("field %q is not in schema %s", field, name)
+						}
+					}
+				}
+			})
+		}
+
+		for _, method := range []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete} {
+			if _, ok := item[strings.ToLower(method)]; ok || path == "/" {
+				continue
+			}
+			req, err := http.NewRequest(method, ts.URL+target, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusMethodNotAllowed && !(resp.StatusCode == http.StatusNotFound && hasParams) {
+				t.Errorf("undocumented %s %s answered %d, want 405", method, target, resp.StatusCode)
+			}
+		}
+	}
+}
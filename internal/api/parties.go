@@ -0,0 +1,48 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// handleParties returns the first-party domain lists and whether third
+// parties are blocked (GET), or changes them (PUT). A PUT body sets a
+// session's list with {"session": "v2", "domains": ["example.com"]} (no
+// session for the default list, an empty list to clear it) and toggles
+// blocking with {"block_third_party": true}.
+func (s *Server) handleParties(w http.ResponseWriter, r *http.Request) {
+	parties := s.proxy.Parties()
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req struct {
+			Session         string   `json:"session"`
+			Domains         []string `json:"domains"`
+			BlockThirdParty *bool    `json:"block_third_party"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Domains != nil {
+			parties.SetFirstParty(req.Session, req.Domains)
+		}
+		if req.BlockThirdParty != nil {
+			parties.SetBlockThirdParty(*req.BlockThirdParty)
+		}
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	lists := parties.FirstParty()
+	defaults := lists[""]
+	delete(lists, "")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"first_party":       defaults,
+		"sessions":          lists,
+		"block_third_party": parties.BlockThirdParty(),
+	})
+}
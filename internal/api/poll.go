@@ -0,0 +1,113 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+)
+
+// Long-poll timeouts: the default, and the most a client may ask for
+const (
+	defaultPollTimeout = 30 * time.Second
+	maxPollTimeout     = 2 * time.Minute
+)
+
+// handlePoll returns the captures stored after since_seq, waiting up to
+// timeout for one to arrive. It stands in for /api/requests/stream where
+// proxies or firewalls break SSE: clients pass the returned next_seq as
+// since_seq of their next poll. Without since_seq, only captures stored
+// from now on are returned.
+func (s *Server) handlePoll(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	filter, err := parseRequestFilter(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if filter.query != "" || filter.limit > 0 {
+		http.Error(w, "q and limit do not apply to polling", http.StatusBadRequest)
+		return
+	}
+
+	timeout := defaultPollTimeout
+	if v := query.Get("timeout"); v != "" {
+		timeout, err = time.ParseDuration(v)
+		if err != nil || timeout < 0 {
+			http.Error(w, "Invalid timeout", http.StatusBadRequest)
+			return
+		}
+		timeout = min(timeout, maxPollTimeout)
+	}
+
+	store := s.storeFor(r)
+
+	// Subscribe before looking, so a capture stored in between still
+	// wakes the poll
+	ch := store.Subscribe()
+	defer store.Unsubscribe(ch)
+
+	var since uint64
+	if v := query.Get("since_seq"); v != "" {
+		since, err = strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid since_seq", http.StatusBadRequest)
+			return
+		}
+	} else {
+		since = store.LastSeq()
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		requests, next := store.After(since)
+		var matched []*capture.CapturedRequest
+		for _, req := range requests {
+			if filter.matches(req) {
+				matched = append(matched, req)
+			}
+		}
+		if len(matched) > 0 {
+			writePoll(w, matched, next)
+			return
+		}
+		// Captures the filter drops need not be looked at again
+		since = next
+
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				writePoll(w, matched, since)
+				return
+			}
+		case <-timer.C:
+			writePoll(w, matched, since)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// writePoll answers a poll with the captures found and the sequence
+// number to poll from next
+func writePoll(w http.ResponseWriter, requests []*capture.CapturedRequest, next uint64) {
+	if requests == nil {
+		requests = []*capture.CapturedRequest{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"requests": requests,
+		"count":    len(requests),
+		"next_seq": next,
+	})
+}
@@ -0,0 +1,58 @@
+package api
+
+import (
+	"errors"
+	"mime"
+	"net/http"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+)
+
+// handleRequestPreview serves a captured body decompressed and
+// transcoded to UTF-8 for display: the response body, or the request body
+// with part=request
+func (s *Server) handleRequestPreview(w http.ResponseWriter, r *http.Request, req *capture.CapturedRequest) {
+	header, body := http.Header(req.ResponseHeaders), req.ResponseBody
+	contentType, charset := req.DetectedContentType, req.DetectedCharset
+	switch part := r.URL.Query().Get("part"); part {
+	case "", "response":
+	case "request":
+		header, body = http.Header(req.RequestHeaders), req.RequestBody
+		contentType, charset = "", ""
+	default:
+		http.Error(w, "part must be request or response", http.StatusBadRequest)
+		return
+	}
+
+	decoded, err := capture.DecodeBody(header.Get("Content-Encoding"), body, capture.MaxDecodedBody)
+	if errors.Is(err, capture.ErrDecodedTooLarge) {
+		http.Error(w, "Decoded body exceeds the preview limit", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Unsupported Content-Encoding "+header.Get("Content-Encoding"), http.StatusUnsupportedMediaType)
+		return
+	}
+	if contentType == "" {
+		// Not sniffed at capture time; go by the declared type
+		var params map[string]string
+		contentType, params, _ = mime.ParseMediaType(header.Get("Content-Type"))
+		charset = capture.DetectCharset(decoded, params["charset"])
+	}
+	if contentType != "" && !capture.IsText(contentType) {
+		http.Error(w, "Body is not text ("+contentType+")", http.StatusUnsupportedMediaType)
+		return
+	}
+	text, ok := capture.ToUTF8(decoded, charset)
+	if !ok {
+		http.Error(w, "Cannot transcode charset "+charset, http.StatusUnsupportedMediaType)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if charset != "" {
+		w.Header().Set("X-Source-Charset", charset)
+	}
+	w.Write(text)
+}
@@ -0,0 +1,57 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+)
+
+// redirectHop is one capture of a redirect chain
+type redirectHop struct {
+	ID         string    `json:"id"`
+	Timestamp  time.Time `json:"timestamp"`
+	Method     string    `json:"method"`
+	URL        string    `json:"url"`
+	StatusCode int       `json:"status_code"`
+	Location   string    `json:"location,omitempty"`
+	DurationMS int64     `json:"duration_ms"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// handleRequestRedirects returns the redirect chain a capture belongs to,
+// first hop first. The chain is complete when its last hop is not a
+// redirect, i.e. the client got to a final response.
+func (s *Server) handleRequestRedirects(w http.ResponseWriter, r *http.Request, req *capture.CapturedRequest) {
+	members := s.storeFor(r).RedirectChain(req.RedirectChain)
+	if len(members) == 0 {
+		http.Error(w, "Capture is not part of a redirect chain", http.StatusNotFound)
+		return
+	}
+
+	hops := make([]redirectHop, 0, len(members))
+	for _, m := range members {
+		hops = append(hops, redirectHop{
+			ID:         m.ID,
+			Timestamp:  m.Timestamp,
+			Method:     m.Method,
+			URL:        m.URL,
+			StatusCode: m.StatusCode,
+			Location:   http.Header(m.ResponseHeaders).Get("Location"),
+			DurationMS: m.Duration.Milliseconds(),
+			Error:      m.Error,
+		})
+	}
+	last := members[len(members)-1]
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"chain":        req.RedirectChain,
+		"hops":         hops,
+		"count":        len(hops),
+		"final_url":    last.URL,
+		"final_status": last.StatusCode,
+		"complete":     !capture.IsRedirect(last.StatusCode),
+		"duration_ms":  last.Timestamp.Add(last.Duration).Sub(members[0].Timestamp).Milliseconds(),
+	})
+}
@@ -0,0 +1,363 @@
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+	"github.com/adamdrake/go_proxy/internal/proxy"
+	"github.com/adamdrake/go_proxy/internal/rules"
+)
+
+// handleRules lists (GET), creates (POST) or clears (DELETE) rules
+func (s *Server) handleRules(w http.ResponseWriter, r *http.Request) {
+	engine := s.proxy.Rules()
+
+	switch r.Method {
+	case http.MethodGet:
+		list := engine.List()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"rules":   list,
+			"count":   len(list),
+			"dry_run": engine.DryRun(),
+		})
+
+	case http.MethodPost:
+		var rule rules.Rule
+		if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+			http.Error(w, "Invalid rule JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		created, err := engine.Add(rule)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(created)
+
+	case http.MethodDelete:
+		engine.Clear()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"status": "cleared",
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleRuleByID gets (GET), replaces (PUT) or deletes (DELETE) a single rule
+func (s *Server) handleRuleByID(w http.ResponseWriter, r *http.Request) {
+	engine := s.proxy.Rules()
+
+	// Extract ID from path /api/rules/{id}
+	id := r.URL.Path[len("/api/rules/"):]
+	if id == "" {
+		http.Error(w, "Rule ID required", http.StatusBadRequest)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		rule, ok := engine.Get(id)
+		if !ok {
+			http.Error(w, "Rule not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rule)
+
+	case http.MethodPut:
+		var rule rules.Rule
+		if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+			http.Error(w, "Invalid rule JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		rule.ID = id
+		found, err := engine.Update(rule)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !found {
+			http.Error(w, "Rule not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rule)
+
+	case http.MethodDelete:
+		if !engine.Remove(id) {
+			http.Error(w, "Rule not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"status": "deleted",
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleDryRun reports (GET) or switches (PUT) dry-run mode, in which
+// rules, header rules, filter lists, third-party and secret blocking and
+// crawl pacing record what they would do instead of doing it
+func (s *Server) handleDryRun(w http.ResponseWriter, r *http.Request) {
+	engine := s.proxy.Rules()
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var req struct {
+			DryRun *bool `json:"dry_run"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.DryRun == nil {
+			http.Error(w, "dry_run is required", http.StatusBadRequest)
+			return
+		}
+		engine.SetDryRun(*req.DryRun)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]bool{
+		"dry_run": engine.DryRun(),
+	})
+}
+
+// maxRuleTest bounds the body of a rule test
+const maxRuleTest = 16 << 20
+
+// ruleTestRequest is a sample request to try rules on
+type ruleTestRequest struct {
+	Method  string              `json:"method"`
+	URL     string              `json:"url"`
+	Headers map[string][]string `json:"headers"`
+	Body    string              `json:"body,omitempty"`
+}
+
+// ruleTestResponse is a sample response to try rules on
+type ruleTestResponse struct {
+	StatusCode int                 `json:"status_code"`
+	Headers    map[string][]string `json:"headers"`
+	Body       string              `json:"body,omitempty"`
+}
+
+// ruleMatch identifies a rule that matched the sample request
+type ruleMatch struct {
+	// Index is the rule's position in the tested set
+	Index  int    `json:"index"`
+	ID     string `json:"id,omitempty"`
+	Name   string `json:"name,omitempty"`
+	DryRun bool   `json:"dry_run,omitempty"`
+}
+
+// handleRuleTest runs a rule set over a sample request, and its response
+// when one is given, without forwarding anything or installing the
+// rules. The sample is given inline or taken from a capture (capture_id);
+// rules defaults to the active set and dry_run to the current mode. The
+// result lists the rules that matched, what they did and would have done,
+// and the request and response as rewritten.
+func (s *Server) handleRuleTest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req struct {
+		CaptureID string            `json:"capture_id"`
+		Request   *ruleTestRequest  `json:"request"`
+		Response  *ruleTestResponse `json:"response"`
+		Rules     []rules.Rule      `json:"rules"`
+		DryRun    *bool             `json:"dry_run"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRuleTest)).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if req.CaptureID != "" {
+		captured := s.storeFor(r).GetByID(req.CaptureID)
+		if captured == nil {
+			http.Error(w, "Capture not found", http.StatusNotFound)
+			return
+		}
+		if req.Request == nil {
+			req.Request = &ruleTestRequest{
+				Method:  captured.Method,
+				URL:     captured.URL,
+				Headers: captured.RequestHeaders,
+				Body:    string(captured.RequestBody),
+			}
+		}
+		if req.Response == nil && captured.StatusCode != 0 {
+			req.Response = &ruleTestResponse{
+				StatusCode: captured.StatusCode,
+				Headers:    captured.ResponseHeaders,
+				Body:       string(captured.ResponseBody),
+			}
+		}
+	}
+	if req.Request == nil {
+		http.Error(w, "request or capture_id is required", http.StatusBadRequest)
+		return
+	}
+	method := req.Request.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	sample, err := http.NewRequestWithContext(r.Context(), method, req.Request.URL, strings.NewReader(req.Request.Body))
+	if err != nil || sample.URL.Host == "" {
+		http.Error(w, "request url must be an absolute URL", http.StatusBadRequest)
+		return
+	}
+	requestHeader := http.Header(req.Request.Headers).Clone()
+	if requestHeader == nil {
+		requestHeader = http.Header{}
+	}
+	sample.Header = requestHeader.Clone()
+
+	engine := s.proxy.Rules()
+	set := req.Rules
+	if set == nil {
+		set = engine.List()
+	}
+	dryRun := engine.DryRun()
+	if req.DryRun != nil {
+		dryRun = *req.DryRun
+	}
+	outcome, matched, err := rules.Evaluate(set, sample, dryRun)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	result := &capture.CapturedRequest{}
+	result.RecordActions(outcome.Actions...)
+	result.RecordWouldApply(outcome.WouldApply...)
+
+	matches := make([]ruleMatch, len(matched))
+	for i, index := range matched {
+		rule := set[index]
+		matches[i] = ruleMatch{Index: index, ID: rule.ID, Name: rule.Name, DryRun: dryRun || rule.DryRun}
+	}
+	out := map[string]interface{}{
+		"matched": matches,
+		"request": ruleTestRequest{
+			Method:  sample.Method,
+			URL:     sample.URL.String(),
+			Headers: sample.Header,
+			Body:    req.Request.Body,
+		},
+	}
+	if outcome.Backend != "" {
+		out["backend"] = outcome.Backend
+	}
+	if outcome.Timeouts != nil {
+		out["timeouts"] = outcome.Timeouts
+	}
+	if req.Response != nil {
+		header := http.Header(req.Response.Headers).Clone()
+		if header == nil {
+			header = http.Header{}
+		}
+		body := proxy.RewriteResponse(outcome, requestHeader, header, []byte(req.Response.Body), capture.MaxDecodedBody, result)
+		out["response"] = ruleTestResponse{
+			StatusCode: req.Response.StatusCode,
+			Headers:    header,
+			Body:       string(body),
+		}
+	}
+	out["actions"] = append([]capture.ActionRecord{}, result.AppliedActions...)
+	out["would_apply"] = append([]capture.ActionRecord{}, result.WouldApply...)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// maxRuleImport bounds an uploaded rule export
+const maxRuleImport = 16 << 20
+
+// handleRuleImport translates a Charles Proxy, Proxyman or ModHeader rule
+// export into native rules and adds them. format picks the tool, detected
+// from the upload when empty; dry_run=true adds the rules in dry-run mode
+// and preview=true only returns the translation. Rules that fail
+// validation are skipped with a warning.
+func (s *Server) handleRuleImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRuleImport))
+	if err != nil {
+		http.Error(w, "Failed to read upload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	query := r.URL.Query()
+	result, err := rules.Import(query.Get("format"), data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for i := range result.Rules {
+		result.Rules[i].DryRun = query.Get("dry_run") == "true"
+	}
+
+	status := http.StatusOK
+	imported := result.Rules
+	if query.Get("preview") != "true" {
+		imported = []rules.Rule{}
+		engine := s.proxy.Rules()
+		for _, rule := range result.Rules {
+			created, err := engine.Add(rule)
+			if err != nil {
+				result.Warnings = append(result.Warnings, rule.Name+": "+err.Error()+", skipped")
+				continue
+			}
+			imported = append(imported, created)
+		}
+		if len(imported) > 0 {
+			status = http.StatusCreated
+		}
+	}
+	if result.Warnings == nil {
+		result.Warnings = []string{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"format":   result.Format,
+		"rules":    imported,
+		"count":    len(imported),
+		"warnings": result.Warnings,
+	})
+}
+
+// handleProfiles lists the built-in device profiles usable in rules
+func (s *Server) handleProfiles(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"profiles": rules.Profiles(),
+	})
+}
@@ -0,0 +1,60 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+)
+
+// defaultSearchLimit caps search results when no limit is given
+const defaultSearchLimit = 100
+
+// handleSearch runs a full-text search over captured requests and returns
+// the newest matches with highlighted snippets
+func (s *Server) handleSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query().Get("q")
+	if q == "" {
+		http.Error(w, "Query parameter q required", http.StatusBadRequest)
+		return
+	}
+
+	limit := defaultSearchLimit
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		var err error
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit < 0 {
+			http.Error(w, "Invalid limit parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	matches := s.storeFor(r).Search(q)
+	total := len(matches)
+	if limit > 0 && limit < len(matches) {
+		matches = matches[len(matches)-limit:]
+	}
+
+	// Newest first
+	results := make([]capture.SearchResult, 0, len(matches))
+	for i := len(matches) - 1; i >= 0; i-- {
+		results = append(results, capture.SearchResult{
+			Request:    matches[i],
+			Highlights: capture.Highlights(matches[i], q),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"query":   q,
+		"results": results,
+		"count":   len(results),
+		"total":   total,
+	})
+}
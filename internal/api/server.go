@@ -3,52 +3,240 @@ package api
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
 	"log"
+	"net"
 	"net/http"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/adamdrake/go_proxy/internal/allowlist"
+	"github.com/adamdrake/go_proxy/internal/anomaly"
 	"github.com/adamdrake/go_proxy/internal/capture"
+	"github.com/adamdrake/go_proxy/internal/hostmatch"
+	"github.com/adamdrake/go_proxy/internal/monitor"
+	"github.com/adamdrake/go_proxy/internal/proxy"
 )
 
+// Config holds the API server configuration
+type Config struct {
+	Addr string
+
+	// gRPC listen address for the Captures service (empty disables it)
+	GRPCAddr string
+
+	// Client networks allowed to connect (empty allows all)
+	AllowClients allowlist.List
+
+	// Browser origins allowed to call the API, as scheme://host[:port]
+	// (empty allows all), and whether they may send credentials, which
+	// needs an origin list
+	CORSOrigins     []string
+	CORSCredentials bool
+
+	// Bearer tokens allowed to use the API; empty leaves it open
+	Tokens []Token
+
+	// How devices on the network reach the proxy, for setup endpoints
+	Setup Setup
+
+	// Where audit entries of API mutations are appended as JSON lines,
+	// besides memory (nil keeps them in memory only)
+	AuditLog io.Writer
+
+	// How request paths are normalized into endpoints for per-endpoint
+	// reports (nil folds ID segments automatically)
+	PathTemplates *capture.PathTemplates
+
+	// Scheduler for synthetic monitors replaying captures
+	Monitors *monitor.Scheduler
+
+	// Detector of traffic anomalies, reported at /api/anomalies and on the
+	// request stream (nil when off)
+	Anomalies *anomaly.Detector
+
+	// Accept captures forwarded by other instances at /api/collect
+	Collector bool
+}
+
 // Server provides an HTTP API for accessing captured requests
 type Server struct {
 	store  *capture.Store
+	proxy  *proxy.Server
 	server *http.Server
+	grpc   *http.Server
+	tokens []Token
+	allow  allowlist.List
+
+	corsOrigins     []string
+	corsCredentials bool
+
+	audit *auditLog
+	admin chan AdminAction
+	setup Setup
+
+	templates *capture.PathTemplates
+	monitors  *monitor.Scheduler
+	anomalies *anomaly.Detector
+	flows     flowRegistry
+
+	collecting bool
+	sources    collectorSources
+
+	openapi []byte
 }
 
-// NewServer creates a new API server
-func NewServer(store *capture.Store, addr string) *Server {
+// NewServer creates a new API server for the given proxy
+func NewServer(proxyServer *proxy.Server, config Config) *Server {
 	s := &Server{
-		store: store,
+		store:  proxyServer.Store(),
+		proxy:  proxyServer,
+		tokens: config.Tokens,
+		allow:  config.AllowClients,
+
+		corsOrigins:     config.CORSOrigins,
+		corsCredentials: config.CORSCredentials,
+
+		templates: config.PathTemplates,
+		monitors:  config.Monitors,
+		anomalies: config.Anomalies,
+		flows:     flowRegistry{flows: make(map[string]*Flow)},
+
+		collecting: config.Collector,
+		sources:    collectorSources{sources: make(map[string]*CollectorSource)},
+
+		audit: &auditLog{out: config.AuditLog},
+		admin: make(chan AdminAction, 1),
+		setup: config.Setup,
 	}
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("/api/requests", s.handleRequests)
-	mux.HandleFunc("/api/requests/", s.handleRequestByID)
-	mux.HandleFunc("/api/requests/stream", s.handleStream)
-	mux.HandleFunc("/api/clear", s.handleClear)
-	mux.HandleFunc("/api/stats", s.handleStats)
-	mux.HandleFunc("/health", s.handleHealth)
+	// Every route is recorded so the OpenAPI document can insist on
+	// describing it
+	var patterns []string
+	handle := func(pattern string, handler http.HandlerFunc) {
+		patterns = append(patterns, pattern)
+		mux.HandleFunc(pattern, handler)
+	}
+	handle("/api/requests", s.handleRequests)
+	handle("/api/requests/", s.handleRequestByID)
+	handle("/api/requests/stream", s.handleStream)
+	handle("/api/requests/poll", s.handlePoll)
+	handle("/api/clear", s.handleClear)
+	handle("/api/search", s.handleSearch)
+	handle("/api/downloads", s.handleDownloads)
+	handle("/api/findings", s.handleFindings)
+	handle("/api/analysis/headers", s.handleHeaderGrades)
+	handle("/api/analysis/credentials", s.handleCredentials)
+	handle("/api/transactions", s.handleTransactions)
+	handle("/api/transactions/", s.handleTransactionByID)
+	handle("/api/hints", s.handleHints)
+	handle("/api/sessions", s.handleSessions)
+	handle("/api/parties", s.handleParties)
+	handle("/api/bypass", s.handleBypass)
+	handle("/api/stats", s.handleStats)
+	handle("/api/stats/circuits", s.handleCircuits)
+	handle("/api/stats/connections", s.handleConnections)
+	handle("/api/stats/compare", s.handleCompare)
+	handle("/api/stats/store", s.handleStoreStats)
+	handle("/api/stats/slowest", s.handleEndpointReport(bySlowest, anyEndpoint))
+	handle("/api/stats/errors", s.handleEndpointReport(byErrors, hasErrors))
+	handle("/api/stats/largest", s.handleEndpointReport(byLargest, anyEndpoint))
+	handle("/api/store/snapshot", s.handleStoreSnapshot)
+	handle("/api/store/compact", s.handleStoreCompact)
+	handle("/api/store/import", s.handleStoreImport)
+	handle("/api/collect", s.handleCollect)
+	handle("/api/collect/sources", s.handleCollectSources)
+	handle("/api/graphql", s.handleGraphQL)
+	handle("/api/graphql/schema", s.handleGraphQLSchema)
+	handle("/api/openapi.json", s.handleOpenAPI)
+	handle("/api/flows", s.handleFlows)
+	handle("/api/flows/", s.handleFlowByName)
+	handle("/api/monitors", s.handleMonitors)
+	handle("/api/monitors/", s.handleMonitorByID)
+	handle("/api/anomalies", s.handleAnomalies)
+	handle("/api/dns/cache", s.handleDNSCache)
+	handle("/api/rules", s.handleRules)
+	handle("/api/rules/", s.handleRuleByID)
+	handle("/api/rules/profiles", s.handleProfiles)
+	handle("/api/rules/dry-run", s.handleDryRun)
+	handle("/api/rules/test", s.handleRuleTest)
+	handle("/api/rules/import", s.handleRuleImport)
+	handle("/api/websockets", s.handleWebSockets)
+	handle("/api/websockets/", s.handleWebSocketByID)
+	handle("/api/export/mitmproxy", s.handleExportMitmproxy)
+	handle("/api/export/saz", s.handleExportSAZ)
+	handle("/api/export/pcapng", s.handleExportPcapng)
+	handle("/api/export/warc", s.handleExportWARC)
+	handle("/api/export/ndjson", s.handleExportNDJSON)
+	handle("/api/import/mitmproxy", s.handleImportMitmproxy)
+	handle("/api/setup", s.handleSetup)
+	handle("/api/setup/qr", s.handleSetupQR)
+	handle("/api/tenants", s.handleTenants)
+	handle("/api/audit", s.handleAudit)
+	handle("/api/admin/shutdown", s.handleAdminAction(AdminShutdown))
+	handle("/api/admin/restart", s.handleAdminAction(AdminRestart))
+	handle("/health", s.handleHealth)
+	handle("/metrics", s.handleMetrics)
+	handle("/proxy.pac", s.handlePAC)
+	handle("/", s.handleOnboarding)
+	s.openapi = buildOpenAPI(patterns)
 
 	s.server = &http.Server{
-		Addr:         addr,
-		Handler:      corsMiddleware(mux),
+		Addr:         config.Addr,
+		Handler:      s.versionMiddleware(s.corsMiddleware(s.authMiddleware(s.auditMiddleware(s.tenantMiddleware(mux))))),
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 0, // Disable for SSE
 	}
 
+	if config.GRPCAddr != "" {
+		// gRPC clients speak HTTP/2 with prior knowledge
+		protocols := new(http.Protocols)
+		protocols.SetUnencryptedHTTP2(true)
+		s.grpc = &http.Server{
+			Addr:      config.GRPCAddr,
+			Handler:   s.newGRPCServer(),
+			Protocols: protocols,
+		}
+	}
+
 	return s
 }
 
 // Start begins serving the API
 func (s *Server) Start() error {
+	listener, err := net.Listen("tcp", s.server.Addr)
+	if err != nil {
+		return err
+	}
 	log.Printf("API server listening on %s", s.server.Addr)
-	return s.server.ListenAndServe()
+	return s.server.Serve(allowlist.Listener(listener, s.allow))
+}
+
+// StartGRPC begins serving the gRPC API; it returns at once when no gRPC
+// address is configured
+func (s *Server) StartGRPC() error {
+	if s.grpc == nil {
+		return nil
+	}
+	listener, err := net.Listen("tcp", s.grpc.Addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("gRPC API listening on %s", s.grpc.Addr)
+	return s.grpc.Serve(allowlist.Listener(listener, s.allow))
 }
 
 // Shutdown gracefully stops the server
 func (s *Server) Shutdown(ctx context.Context) error {
+	if s.grpc != nil {
+		// Streams only end when their clients go away
+		s.grpc.Close()
+	}
 	return s.server.Shutdown(ctx)
 }
 
@@ -59,20 +247,12 @@ func (s *Server) handleRequests(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Check for limit parameter
-	limitStr := r.URL.Query().Get("limit")
-	var requests []*capture.CapturedRequest
-
-	if limitStr != "" {
-		limit, err := strconv.Atoi(limitStr)
-		if err != nil || limit < 0 {
-			http.Error(w, "Invalid limit parameter", http.StatusBadRequest)
-			return
-		}
-		requests = s.store.GetRecent(limit)
-	} else {
-		requests = s.store.GetAll()
+	filter, err := parseRequestFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
+	requests := filter.apply(s.storeFor(r))
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
@@ -83,26 +263,110 @@ func (s *Server) handleRequests(w http.ResponseWriter, r *http.Request) {
 
 // handleRequestByID returns a specific request by ID
 func (s *Server) handleRequestByID(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
+	// Extract ID from path /api/requests/{id}[/code|/raw|/upload|/preview|/decode|/fuzz|/redirects]
+	id, action, _ := strings.Cut(r.URL.Path[len("/api/requests/"):], "/")
+	method := http.MethodGet
+	if action == "fuzz" {
+		method = http.MethodPost
+	}
+	if r.Method != method {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
-
-	// Extract ID from path /api/requests/{id}
-	id := r.URL.Path[len("/api/requests/"):]
 	if id == "" || id == "stream" {
 		http.Error(w, "Request ID required", http.StatusBadRequest)
 		return
 	}
 
-	req := s.store.GetByID(id)
+	req := s.storeFor(r).GetByID(id)
 	if req == nil {
 		http.Error(w, "Request not found", http.StatusNotFound)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(req)
+	switch action {
+	case "":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(req)
+	case "code":
+		s.handleRequestCode(w, r, req)
+	case "raw":
+		s.handleRequestRaw(w, r, req)
+	case "upload":
+		s.handleRequestUpload(w, r, req)
+	case "preview":
+		s.handleRequestPreview(w, r, req)
+	case "decode":
+		s.handleRequestDecode(w, r, req)
+	case "fuzz":
+		s.handleRequestFuzz(w, r, req)
+	case "redirects":
+		s.handleRequestRedirects(w, r, req)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// handleRequestRaw serves a capture's request and response as they crossed
+// the wire, back to back, or one of them with part=request or part=response.
+// X-Raw-Request-Length gives the offset of the response.
+func (s *Server) handleRequestRaw(w http.ResponseWriter, r *http.Request, req *capture.CapturedRequest) {
+	if req.RawRequest == nil && req.RawResponse == nil {
+		http.Error(w, "No raw capture for this request (enable -capture-raw; HTTP/1 only)", http.StatusNotFound)
+		return
+	}
+
+	var body []byte
+	switch part := r.URL.Query().Get("part"); part {
+	case "":
+		body = append(append([]byte{}, req.RawRequest...), req.RawResponse...)
+	case "request":
+		body = req.RawRequest
+	case "response":
+		body = req.RawResponse
+	default:
+		http.Error(w, "part must be request or response", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("X-Raw-Request-Length", strconv.Itoa(len(req.RawRequest)))
+	if req.RawTruncated {
+		w.Header().Set("X-Raw-Truncated", "true")
+	}
+	w.Write(body)
+}
+
+// handleRequestUpload serves the full body of a request spooled to disk,
+// while the file is retained
+func (s *Server) handleRequestUpload(w http.ResponseWriter, r *http.Request, req *capture.CapturedRequest) {
+	if req.Upload == nil {
+		http.Error(w, "Request body was not spooled (see -upload-spool)", http.StatusNotFound)
+		return
+	}
+	body, err := s.proxy.OpenUpload(req.Upload)
+	if errors.Is(err, fs.ErrNotExist) {
+		http.Error(w, "Spooled upload no longer retained", http.StatusGone)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer body.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("X-Upload-SHA256", req.Upload.SHA256)
+
+	// A plain spool file serves ranges, so large downloads can resume;
+	// an encrypted one can only be decrypted from the start
+	if f, ok := body.(io.ReadSeeker); ok && !req.Upload.Encrypted {
+		w.Header().Set("ETag", `"`+req.Upload.SHA256+`"`)
+		http.ServeContent(w, r, "", time.Time{}, f)
+		return
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(req.Upload.Size, 10))
+	io.Copy(w, body)
 }
 
 // handleStream provides Server-Sent Events for real-time request updates
@@ -123,17 +387,50 @@ func (s *Server) handleStream(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	statsInterval := defaultStatsInterval
+	if v := r.URL.Query().Get("stats_interval"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			http.Error(w, "Invalid stats_interval", http.StatusBadRequest)
+			return
+		}
+		statsInterval = d
+	}
+
 	// Subscribe to new requests
-	ch := s.store.Subscribe()
-	defer s.store.Unsubscribe(ch)
+	store := s.storeFor(r)
+	ch := store.Subscribe()
+	defer store.Unsubscribe(ch)
+
+	// Anomalies go to streams of the tenant whose traffic they are about
+	var anomalies <-chan anomaly.Event
+	if s.anomalies != nil {
+		sub := s.anomalies.Subscribe()
+		defer s.anomalies.Unsubscribe(sub)
+		anomalies = sub
+	}
+	tenant := tenantName(r)
 
 	// Send initial connection message
 	w.Write([]byte("event: connected\ndata: {\"status\":\"connected\"}\n\n"))
+
+	// Stats go out at once and then periodically, doubling as a heartbeat
+	var statsTick <-chan time.Time
+	if statsInterval > 0 {
+		s.writeStreamStats(w, store)
+		ticker := time.NewTicker(statsInterval)
+		defer ticker.Stop()
+		statsTick = ticker.C
+	}
 	flusher.Flush()
 
 	// Stream new requests
 	for {
 		select {
+		case <-statsTick:
+			s.writeStreamStats(w, store)
+			flusher.Flush()
+
 		case req, ok := <-ch:
 			if !ok {
 				return
@@ -148,6 +445,20 @@ func (s *Server) handleStream(w http.ResponseWriter, r *http.Request) {
 			w.Write([]byte("\n\n"))
 			flusher.Flush()
 
+		case event := <-anomalies:
+			if event.Tenant != tenant {
+				continue
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				log.Printf("Error marshaling anomaly: %v", err)
+				continue
+			}
+			w.Write([]byte("event: anomaly\ndata: "))
+			w.Write(data)
+			w.Write([]byte("\n\n"))
+			flusher.Flush()
+
 		case <-r.Context().Done():
 			return
 		}
@@ -161,7 +472,7 @@ func (s *Server) handleClear(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	s.store.Clear()
+	s.storeFor(r).Clear()
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{
@@ -169,6 +480,34 @@ func (s *Server) handleClear(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// defaultStatsInterval is how often /api/requests/stream sends stats
+const defaultStatsInterval = 5 * time.Second
+
+// streamStats is the payload of a stats event on the request stream
+type streamStats struct {
+	Count         int   `json:"count"`
+	Capacity      int   `json:"capacity"`
+	Evictions     int64 `json:"evictions"`
+	ActiveTunnels int64 `json:"active_tunnels"`
+}
+
+// writeStreamStats writes a stats event with the store's usage and the
+// proxy's open tunnels
+func (s *Server) writeStreamStats(w io.Writer, store *capture.Store) {
+	data, err := json.Marshal(streamStats{
+		Count:         store.Count(),
+		Capacity:      store.Capacity(),
+		Evictions:     store.Evictions(),
+		ActiveTunnels: s.proxy.ActiveTunnels(),
+	})
+	if err != nil {
+		return
+	}
+	w.Write([]byte("event: stats\ndata: "))
+	w.Write(data)
+	w.Write([]byte("\n\n"))
+}
+
 // handleStats returns statistics about captured requests
 func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
@@ -176,10 +515,12 @@ func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	requests := s.store.GetAll()
+	requests := s.storeFor(r).GetAll()
 
 	var httpCount, httpsCount int
 	var totalDuration time.Duration
+	parties := make(map[string]int)
+	thirdPartyHosts := make(map[string]int)
 
 	for _, req := range requests {
 		if req.IsHTTPS {
@@ -188,6 +529,12 @@ func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
 			httpCount++
 		}
 		totalDuration += req.Duration
+		if req.Party != "" {
+			parties[req.Party]++
+		}
+		if req.Party == capture.PartyThird {
+			thirdPartyHosts[hostmatch.Normalize(req.Host)]++
+		}
 	}
 
 	avgDuration := time.Duration(0)
@@ -197,15 +544,48 @@ func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"total_requests":       len(requests),
-		"http_requests":        httpCount,
-		"https_requests":       httpsCount,
-		"average_duration_ms":  avgDuration.Milliseconds(),
+		"total_requests":      len(requests),
+		"http_requests":       httpCount,
+		"https_requests":      httpsCount,
+		"average_duration_ms": avgDuration.Milliseconds(),
+		"first_party":         parties[capture.PartyFirst],
+		"third_party":         parties[capture.PartyThird],
+		"third_party_hosts":   thirdPartyHosts,
+		"protocols":           capture.Protocols(requests),
+		"capture_pipeline":    s.proxy.CaptureStats(),
 	})
 }
 
+// handleCircuits returns (GET) or resets (DELETE) per-host circuit breaker state
+func (s *Server) handleCircuits(w http.ResponseWriter, r *http.Request) {
+	circuits := s.proxy.Circuits()
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"enabled":  circuits.Enabled(),
+			"circuits": circuits.Snapshot(),
+		})
+
+	case http.MethodDelete:
+		circuits.Reset()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"status": "reset",
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
 // handleHealth returns a simple health check
 func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{
 		"status": "healthy",
@@ -213,13 +593,38 @@ func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
 }
 
 // corsMiddleware adds CORS headers to allow browser access
-func corsMiddleware(next http.Handler) http.Handler {
+func (s *Server) corsMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		origin := r.Header.Get("Origin")
+		allowed := s.corsAllowed(origin)
+		if len(s.corsOrigins) > 0 {
+			w.Header().Add("Vary", "Origin")
+		}
+
+		switch {
+		case !allowed:
+			// No CORS headers, so browsers keep the response from the page
+		case len(s.corsOrigins) == 0:
+			// Any origin, never with credentials
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		case origin == "":
+			// Not a cross-origin browser request
+		default:
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+			if s.corsCredentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+		}
+		if allowed {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+			w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		}
 
 		if r.Method == http.MethodOptions {
+			if origin != "" && !allowed {
+				http.Error(w, "Origin not allowed", http.StatusForbidden)
+				return
+			}
 			w.WriteHeader(http.StatusOK)
 			return
 		}
@@ -227,3 +632,12 @@ func corsMiddleware(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// corsAllowed reports whether a browser page from origin may read API
+// responses. Without an allowlist every origin may.
+func (s *Server) corsAllowed(origin string) bool {
+	if len(s.corsOrigins) == 0 {
+		return true
+	}
+	return origin != "" && slices.Contains(s.corsOrigins, origin)
+}
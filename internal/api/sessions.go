@@ -0,0 +1,79 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+)
+
+// handleSessions lists the recorded sessions and the active one (GET),
+// starts a session (POST {"name": "v2"}) or ends it (DELETE)
+func (s *Server) handleSessions(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req struct {
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Name == "" {
+			http.Error(w, "name is required", http.StatusBadRequest)
+			return
+		}
+		s.proxy.SetSession(req.Name)
+	case http.MethodDelete:
+		s.proxy.SetSession("")
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sessions := capture.Sessions(s.storeFor(r).GetAll())
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"current":  s.proxy.Session(),
+		"sessions": sessions,
+		"count":    len(sessions),
+	})
+}
+
+// handleCompare contrasts sessions a and b: request counts, latency
+// percentiles, payload sizes, and new, removed and changed endpoints.
+// Other /api/requests filters apply to both sessions.
+func (s *Server) handleCompare(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	nameA, nameB := query.Get("a"), query.Get("b")
+	if nameA == "" || nameB == "" {
+		http.Error(w, "a and b sessions are required", http.StatusBadRequest)
+		return
+	}
+	filter, err := parseRequestFilter(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	store := s.storeFor(r)
+	filter.session = nameA
+	a := filter.apply(store)
+	filter.session = nameB
+	b := filter.apply(store)
+	for name, requests := range map[string][]*capture.CapturedRequest{nameA: a, nameB: b} {
+		if len(requests) == 0 {
+			http.Error(w, "No captures in session "+name, http.StatusNotFound)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(capture.Compare(a, b, nameA, nameB, s.templates))
+}
@@ -0,0 +1,70 @@
+package api
+
+import (
+	"encoding/json"
+	"image/png"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/adamdrake/go_proxy/internal/qr"
+)
+
+// Setup describes how other devices on the network reach the proxy
+type Setup struct {
+	// Address of the proxy as devices should enter it, host:port
+	ProxyAddr string
+	// Base URL of this API as devices reach it
+	APIURL string
+}
+
+// setupURL is the URL devices open to configure themselves: the API
+// root, carrying the proxy address
+func (s Setup) setupURL() string {
+	return s.APIURL + "/?" + url.Values{"proxy": {s.ProxyAddr}}.Encode()
+}
+
+// handleSetup returns the settings devices need to use the proxy
+func (s *Server) handleSetup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	host, port, _ := net.SplitHostPort(s.setup.ProxyAddr)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"proxy_host": host,
+		"proxy_port": port,
+		"api_url":    s.setup.APIURL,
+		"setup_url":  s.setup.setupURL(),
+	})
+}
+
+// handleSetupQR renders the setup URL as a QR code for phones to scan
+func (s *Server) handleSetupQR(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	scale := 8
+	if v := r.URL.Query().Get("scale"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 40 {
+			http.Error(w, "Invalid scale parameter", http.StatusBadRequest)
+			return
+		}
+		scale = n
+	}
+
+	code, err := qr.Encode([]byte(s.setup.setupURL()))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-cache")
+	png.Encode(w, code.Image(scale))
+}
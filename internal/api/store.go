@@ -0,0 +1,102 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"slices"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+)
+
+// handleStoreSnapshot downloads a consistent point-in-time copy of the
+// store as a gzip-compressed JSON lines file, for backup or transfer.
+// Captures keep arriving while it is written.
+func (s *Server) handleStoreSnapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	snap := s.storeFor(r).Snapshot()
+	name := "go_proxy-" + snap.Taken.UTC().Format("20060102T150405Z") + ".snapshot.gz"
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+name+`"`)
+	if _, err := snap.WriteTo(w); err != nil {
+		log.Printf("Error writing snapshot: %v", err)
+	}
+}
+
+// storeStats is the store's usage with the limits that bound it
+type storeStats struct {
+	capture.StoreStats
+	// MaxBodySize is the bytes of each body a capture keeps
+	MaxBodySize int64 `json:"max_body_size"`
+}
+
+// handleStoreStats reports what the store holds and roughly how much
+// memory it takes, for sizing -max-requests and -max-body-size
+func (s *Server) handleStoreStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(storeStats{
+		StoreStats:  s.storeFor(r).Stats(),
+		MaxBodySize: s.proxy.MaxBodySize(),
+	})
+}
+
+// handleStoreCompact releases memory held by evicted captures and
+// rebuilds the search index
+func (s *Server) handleStoreCompact(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.storeFor(r).Compact())
+}
+
+// handleStoreImport merges an uploaded snapshot or NDJSON export from
+// another instance into the store. Captures already present are skipped;
+// other captures whose ID is taken get a new one, or are skipped with
+// on_conflict=skip. tag=NAME labels every imported capture, e.g. with the
+// tester it came from.
+func (s *Server) handleStoreImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	var skipConflicts bool
+	switch query.Get("on_conflict") {
+	case "", "rename":
+	case "skip":
+		skipConflicts = true
+	default:
+		http.Error(w, "on_conflict must be rename or skip", http.StatusBadRequest)
+		return
+	}
+
+	requests, err := capture.ReadSnapshot(http.MaxBytesReader(w, r.Body, maxImportSize), maxImportSize)
+	if err != nil {
+		http.Error(w, "Invalid snapshot: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if tag := query.Get("tag"); tag != "" {
+		for _, req := range requests {
+			if !slices.Contains(req.Tags, tag) {
+				req.Tags = append(req.Tags, tag)
+			}
+		}
+	}
+
+	stats := s.storeFor(r).Merge(requests, skipConflicts)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
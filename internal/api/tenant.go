@@ -0,0 +1,125 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+)
+
+// scopedTenantKey carries the tenant a request's token is limited to
+type scopedTenantKey struct{}
+
+// storeKey carries the capture store a request works on
+type storeKey struct{}
+
+// tenantRoutes are the endpoints open to tenant tokens, exactly or, for
+// entries ending in a slash, by prefix; everything else is shared by all
+// tenants (rules, live WebSockets, DNS, circuit breakers) and needs an
+// unscoped token
+var tenantRoutes = []string{
+	"/api/requests",
+	"/api/requests/",
+	"/api/clear",
+	"/api/search",
+	"/api/downloads",
+	"/api/findings",
+	"/api/analysis/headers",
+	"/api/analysis/credentials",
+	"/api/transactions",
+	"/api/transactions/",
+	"/api/hints",
+	"/api/stats",
+	"/api/stats/compare",
+	"/api/stats/store",
+	"/api/stats/slowest",
+	"/api/stats/errors",
+	"/api/stats/largest",
+	"/api/export/",
+	"/api/import/",
+	"/api/store/snapshot",
+	"/api/store/compact",
+	"/api/store/import",
+	"/api/collect",
+	"/api/graphql",
+	"/api/graphql/schema",
+}
+
+// tenantMiddleware picks the capture store for a request: the tenant of a
+// tenant token, or the one named by the tenant query parameter, or the
+// default store
+func (s *Server) tenantMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, scoped := r.Context().Value(scopedTenantKey{}).(string); scoped && !tenantRoute(r.URL.Path) {
+			http.Error(w, "Forbidden: not available to tenant tokens", http.StatusForbidden)
+			return
+		}
+
+		store := s.proxy.TenantStore(tenantName(r))
+		if store == nil {
+			http.Error(w, "Unknown tenant", http.StatusNotFound)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), storeKey{}, store)))
+	})
+}
+
+// tenantName returns the tenant a request works on: its token's, or the
+// one named by the tenant query parameter ("" for the default)
+func tenantName(r *http.Request) string {
+	if name, scoped := r.Context().Value(scopedTenantKey{}).(string); scoped {
+		return name
+	}
+	return r.URL.Query().Get("tenant")
+}
+
+func tenantRoute(path string) bool {
+	for _, route := range tenantRoutes {
+		if path == route || (strings.HasSuffix(route, "/") && strings.HasPrefix(path, route)) {
+			return true
+		}
+	}
+	return false
+}
+
+// storeFor returns the capture store a request works on
+func (s *Server) storeFor(r *http.Request) *capture.Store {
+	if store, ok := r.Context().Value(storeKey{}).(*capture.Store); ok {
+		return store
+	}
+	return s.store
+}
+
+// handleTenants lists the configured tenants with their capture counts
+func (s *Server) handleTenants(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	type tenantInfo struct {
+		Name        string `json:"name"`
+		Listen      string `json:"listen,omitempty"`
+		User        string `json:"user,omitempty"`
+		MaxRequests int    `json:"max_requests"`
+		Count       int    `json:"count"`
+	}
+	tenants := []tenantInfo{}
+	for _, t := range s.proxy.Tenants() {
+		tenants = append(tenants, tenantInfo{
+			Name:        t.Name,
+			Listen:      t.ListenAddr,
+			User:        t.Username,
+			MaxRequests: t.MaxRequests,
+			Count:       s.proxy.TenantStore(t.Name).Count(),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"tenants": tenants,
+		"count":   len(tenants),
+	})
+}
@@ -0,0 +1,120 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+)
+
+// transactions groups the requests matching the /api/requests filters in
+// r's query into transactions, with the gap parameter as idle gap
+func (s *Server) transactions(r *http.Request) ([]*capture.Transaction, error) {
+	filter, err := parseRequestFilter(r.URL.Query())
+	if err != nil {
+		return nil, err
+	}
+	gap := capture.DefaultTransactionGap
+	if v := r.URL.Query().Get("gap"); v != "" {
+		if gap, err = time.ParseDuration(v); err != nil || gap <= 0 {
+			return nil, fmt.Errorf("invalid gap parameter")
+		}
+	}
+	return capture.Transactions(filter.apply(s.storeFor(r)), gap), nil
+}
+
+// handleTransactions lists page loads and app actions, newest last. It
+// accepts the /api/requests filters.
+func (s *Server) handleTransactions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	transactions, err := s.transactions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if kind := r.URL.Query().Get("kind"); kind != "" {
+		kept := transactions[:0]
+		for _, t := range transactions {
+			if t.Kind == kind {
+				kept = append(kept, t)
+			}
+		}
+		transactions = kept
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"transactions": transactions,
+		"count":        len(transactions),
+	})
+}
+
+// transactionRequest summarizes a member of a transaction
+type transactionRequest struct {
+	ID         string    `json:"id"`
+	Timestamp  time.Time `json:"timestamp"`
+	Method     string    `json:"method"`
+	URL        string    `json:"url"`
+	StatusCode int       `json:"status_code"`
+	DurationMS int64     `json:"duration_ms"`
+	Size       int       `json:"size"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// handleTransactionByID returns one transaction, identified by its
+// triggering request, with its requests, or its waterfall at
+// /api/transactions/{id}/waterfall
+func (s *Server) handleTransactionByID(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/transactions/"), "/")
+	if action != "" && action != "waterfall" {
+		http.NotFound(w, r)
+		return
+	}
+	transactions, err := s.transactions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, t := range transactions {
+		if t.ID != id {
+			continue
+		}
+		if action == "waterfall" {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(capture.BuildWaterfall(t))
+			return
+		}
+		requests := make([]transactionRequest, 0, len(t.Requests))
+		for _, req := range t.Requests {
+			requests = append(requests, transactionRequest{
+				ID:         req.ID,
+				Timestamp:  req.Timestamp,
+				Method:     req.Method,
+				URL:        req.URL,
+				StatusCode: req.StatusCode,
+				DurationMS: req.Duration.Milliseconds(),
+				Size:       len(req.ResponseBody),
+				Error:      req.Error,
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"transaction": t,
+			"requests":    requests,
+		})
+		return
+	}
+	http.Error(w, "Transaction not found", http.StatusNotFound)
+}
@@ -0,0 +1,46 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+)
+
+// APIVersion is the current version of the API. Routes are served under
+// /api/v1/, whose paths, parameters and response fields stay as
+// /api/openapi.json describes them: later changes to the capture model
+// add fields, and renaming or removing one means a new version. The
+// unversioned /api/ paths are aliases of the current version, kept for
+// existing scripts and dashboards.
+const APIVersion = "v1"
+
+// versionPrefix is the path prefix of the current version
+const versionPrefix = "/api/" + APIVersion + "/"
+
+// versionMiddleware serves /api/v1/ paths by their unversioned route, so
+// auth, tenants, auditing and the handlers see one path for both
+func (s *Server) versionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rest, ok := strings.CutPrefix(r.URL.Path, versionPrefix); ok {
+			r2 := new(http.Request)
+			*r2 = *r
+			u := *r.URL
+			u.Path = "/api/" + rest
+			if u.RawPath != "" {
+				u.RawPath = "/api/" + strings.TrimPrefix(u.RawPath, versionPrefix)
+			}
+			r2.URL = &u
+			w.Header().Set("X-GoProxy-API-Version", APIVersion)
+			r = r2
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// versionedPath returns the /api/v1/ path of an /api/ route, and other
+// paths as they are
+func versionedPath(path string) string {
+	if rest, ok := strings.CutPrefix(path, "/api/"); ok {
+		return versionPrefix + rest
+	}
+	return path
+}
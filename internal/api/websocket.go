@@ -0,0 +1,93 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/adamdrake/go_proxy/internal/proxy"
+)
+
+// injectRequest is the body of POST /api/websockets/{id}/inject. Exactly
+// one of Text or Binary (base64 in JSON) must be set.
+type injectRequest struct {
+	Direction string  `json:"direction"`
+	Text      *string `json:"text,omitempty"`
+	Binary    []byte  `json:"binary,omitempty"`
+}
+
+// handleWebSockets lists live WebSocket connections
+func (s *Server) handleWebSockets(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sessions := s.proxy.WebSockets().List()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"connections": sessions,
+		"count":       len(sessions),
+	})
+}
+
+// handleWebSocketByID returns a live connection with its messages (GET
+// /api/websockets/{id}) or injects a message into it (POST
+// /api/websockets/{id}/inject)
+func (s *Server) handleWebSocketByID(w http.ResponseWriter, r *http.Request) {
+	websockets := s.proxy.WebSockets()
+
+	// Extract ID from path /api/websockets/{id}[/inject]
+	id, action, _ := strings.Cut(r.URL.Path[len("/api/websockets/"):], "/")
+	if id == "" {
+		http.Error(w, "Connection ID required", http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		session, ok := websockets.Get(id)
+		if !ok {
+			http.Error(w, "Connection not found", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(session)
+
+	case action == "inject" && r.Method == http.MethodPost:
+		var req injectRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid JSON: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if (req.Text == nil) == (req.Binary == nil) {
+			http.Error(w, "Exactly one of text or binary is required", http.StatusBadRequest)
+			return
+		}
+		payload, binary := req.Binary, true
+		if req.Text != nil {
+			payload, binary = []byte(*req.Text), false
+		}
+
+		err := websockets.Inject(id, req.Direction, binary, payload)
+		switch {
+		case errors.Is(err, proxy.ErrWebSocketNotFound):
+			http.Error(w, "Connection not found", http.StatusNotFound)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"status": "injected",
+		})
+
+	case action == "" || action == "inject":
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
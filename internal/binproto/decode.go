@@ -0,0 +1,60 @@
+package binproto
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Payload formats
+const (
+	FormatProtobuf = "protobuf"
+	FormatThrift   = "thrift"
+)
+
+// ErrUnknownFormat is returned when a payload decodes as no known format
+var ErrUnknownFormat = errors.New("payload is neither protobuf nor Thrift")
+
+// Decoded is a payload decoded without its schema
+type Decoded struct {
+	Format   string         `json:"format"`
+	Protobuf []ProtoField   `json:"protobuf,omitempty"`
+	Thrift   *ThriftMessage `json:"thrift,omitempty"`
+}
+
+// Decode decodes data as format, or with format empty as the format its
+// Content-Type names, trying the other formats when that fails. Thrift
+// envelopes are recognized by their version bytes; other payloads are
+// tried as protobuf before bare Thrift structs.
+func Decode(data []byte, contentType, format string) (*Decoded, error) {
+	switch format {
+	case FormatProtobuf:
+		fields, err := DecodeProtobuf(data)
+		if err != nil {
+			return nil, err
+		}
+		return &Decoded{Format: FormatProtobuf, Protobuf: fields}, nil
+	case FormatThrift:
+		msg, err := DecodeThrift(data)
+		if err != nil {
+			return nil, err
+		}
+		return &Decoded{Format: FormatThrift, Thrift: msg}, nil
+	case "":
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+
+	order := []string{FormatProtobuf, FormatThrift}
+	contentType = strings.ToLower(contentType)
+	thriftEnvelope := len(data) >= 2 && (data[0] == 0x80 && data[1] == 0x01 || data[0] == 0x82)
+	if strings.Contains(contentType, "thrift") || thriftEnvelope && !strings.Contains(contentType, "proto") {
+		order = []string{FormatThrift, FormatProtobuf}
+	}
+	for _, f := range order {
+		if decoded, err := Decode(data, "", f); err == nil {
+			return decoded, nil
+		}
+	}
+	return nil, ErrUnknownFormat
+}
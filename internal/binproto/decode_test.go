@@ -0,0 +1,96 @@
+package binproto
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        string
+		contentType string
+		want        *Decoded
+	}{
+		{
+			name: "protobuf varint",
+			data: "\x08\x96\x01",
+			want: &Decoded{Format: FormatProtobuf, Protobuf: []ProtoField{
+				{Number: 1, WireType: "varint", Value: uint64(150), ZigZag: int64p(75)},
+			}},
+		},
+		{
+			name: "protobuf string",
+			data: "\x12\x02hi",
+			want: &Decoded{Format: FormatProtobuf, Protobuf: []ProtoField{
+				{Number: 2, WireType: "bytes", Value: "hi"},
+			}},
+		},
+		{
+			name: "thrift binary call",
+			data: "\x80\x01\x00\x01\x00\x00\x00\x03foo\x00\x00\x00\x07\x08\x00\x01\x00\x00\x00\x2a\x00",
+			want: &Decoded{Format: FormatThrift, Thrift: &ThriftMessage{
+				Protocol: ThriftBinary, Name: "foo", Type: "call", SeqID: 7,
+				Fields: []ThriftField{{ID: 1, Type: thriftI32, Value: int32(42)}},
+			}},
+		},
+		{
+			name: "thrift compact call",
+			data: "\x82\x21\x07\x03foo\x15\x54\x00",
+			want: &Decoded{Format: FormatThrift, Thrift: &ThriftMessage{
+				Protocol: ThriftCompact, Name: "foo", Type: "call", SeqID: 7,
+				Fields: []ThriftField{{ID: 1, Type: thriftI32, Value: int32(42)}},
+			}},
+		},
+		{
+			name:        "thrift compact list",
+			data:        "\x19\x25\x02\x04\x00",
+			contentType: "application/x-thrift",
+			want: &Decoded{Format: FormatThrift, Thrift: &ThriftMessage{
+				Protocol: ThriftCompact,
+				Fields:   []ThriftField{{ID: 1, Type: thriftList, Value: []interface{}{int32(1), int32(2)}}},
+			}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Decode([]byte(tt.data), tt.contentType, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeRejectsOversizedCompactSizes(t *testing.T) {
+	for _, data := range []string{
+		"+\x88\x88\x88\x88\x88\x88\x88\x88A00",
+		"\x1b\xff\xff\xff\xff\xff\xff\xff\xff\x7f\x55",
+		"\x18\xff\xff\xff\xff\x0f",
+	} {
+		if _, err := DecodeThrift([]byte(data)); err == nil {
+			t.Errorf("%q decoded as Thrift", data)
+		}
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	for _, seed := range []string{
+		"\x08\x96\x01",
+		"\x80\x01\x00\x01\x00\x00\x00\x03foo\x00\x00\x00\x07\x08\x00\x01\x00\x00\x00\x2a\x00",
+		"\x82\x21\x07\x03foo\x15\x54\x00",
+		"+\x88\x88\x88\x88\x88\x88\x88\x88A00",
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, format := range []string{"", FormatProtobuf, FormatThrift} {
+			Decode(data, "", format)
+		}
+	})
+}
+
+func int64p(v int64) *int64 { return &v }
@@ -0,0 +1,189 @@
+// Package binproto decodes binary API payloads without their schema, for
+// previews: protobuf messages as field numbers and wire types, and Thrift
+// messages in the binary and compact protocols
+package binproto
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxDepth bounds message nesting
+const maxDepth = 32
+
+// ErrNotProtobuf is returned for payloads that do not parse as a
+// protobuf message
+var ErrNotProtobuf = errors.New("not a protobuf message")
+
+// Protobuf wire types
+const (
+	wireVarint     = 0
+	wireFixed64    = 1
+	wireBytes      = 2
+	wireStartGroup = 3
+	wireEndGroup   = 4
+	wireFixed32    = 5
+)
+
+// ProtoField is one field of a message decoded without a schema. Value
+// holds the most likely reading; the other members hold alternative
+// readings of the same bytes where they differ.
+type ProtoField struct {
+	Number   int         `json:"field"`
+	WireType string      `json:"wire_type"`
+	Value    interface{} `json:"value,omitempty"`
+
+	// Varints as signed (two's complement and zigzag) integers
+	Signed *int64 `json:"signed,omitempty"`
+	ZigZag *int64 `json:"zigzag,omitempty"`
+
+	// Fixed-width values as floating point
+	Float *float64 `json:"float,omitempty"`
+
+	// Length-delimited fields that parse as a message (also for groups)
+	Message []ProtoField `json:"message,omitempty"`
+}
+
+// DecodeProtobuf decodes a protobuf message without its schema.
+// Length-delimited fields are shown as text when they are printable
+// UTF-8, as nested messages when they parse as one, and as bytes
+// otherwise.
+func DecodeProtobuf(data []byte) ([]ProtoField, error) {
+	if len(data) == 0 {
+		return nil, ErrNotProtobuf
+	}
+	fields, rest, err := decodeMessage(data, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) != 0 {
+		return nil, ErrNotProtobuf
+	}
+	return fields, nil
+}
+
+// decodeMessage decodes fields until data ends or, inside a group,
+// until the end-group tag for group
+func decodeMessage(data []byte, depth, group int) ([]ProtoField, []byte, error) {
+	if depth > maxDepth {
+		return nil, nil, fmt.Errorf("messages nested deeper than %d", maxDepth)
+	}
+	var fields []ProtoField
+	for len(data) > 0 {
+		tag, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, nil, ErrNotProtobuf
+		}
+		data = data[n:]
+		number, wireType := tag>>3, int(tag&7)
+		if number == 0 || number > math.MaxInt32>>2 {
+			return nil, nil, ErrNotProtobuf
+		}
+
+		field := ProtoField{Number: int(number)}
+		switch wireType {
+		case wireVarint:
+			v, n := binary.Uvarint(data)
+			if n <= 0 {
+				return nil, nil, ErrNotProtobuf
+			}
+			data = data[n:]
+			field.WireType = "varint"
+			field.Value = v
+			if signed := int64(v); signed < 0 {
+				field.Signed = &signed
+			}
+			if zz := int64(v>>1) ^ -int64(v&1); v > 1 {
+				field.ZigZag = &zz
+			}
+
+		case wireFixed64:
+			if len(data) < 8 {
+				return nil, nil, ErrNotProtobuf
+			}
+			v := binary.LittleEndian.Uint64(data)
+			data = data[8:]
+			f := math.Float64frombits(v)
+			field.WireType = "fixed64"
+			field.Value = v
+			if !math.IsNaN(f) && !math.IsInf(f, 0) {
+				field.Float = &f
+			}
+
+		case wireFixed32:
+			if len(data) < 4 {
+				return nil, nil, ErrNotProtobuf
+			}
+			v := binary.LittleEndian.Uint32(data)
+			data = data[4:]
+			f := float64(math.Float32frombits(v))
+			field.WireType = "fixed32"
+			field.Value = v
+			if !math.IsNaN(f) && !math.IsInf(f, 0) {
+				field.Float = &f
+			}
+
+		case wireBytes:
+			length, n := binary.Uvarint(data)
+			if n <= 0 || length > uint64(len(data)-n) {
+				return nil, nil, ErrNotProtobuf
+			}
+			value := data[n : n+int(length)]
+			data = data[n+int(length):]
+			field.WireType = "bytes"
+			switch {
+			case printable(value):
+				field.Value = string(value)
+			default:
+				if nested, rest, err := decodeMessage(value, depth+1, -1); err == nil && len(rest) == 0 && len(nested) > 0 {
+					field.WireType = "message"
+					field.Message = nested
+				} else {
+					field.Value = value
+				}
+			}
+
+		case wireStartGroup:
+			nested, rest, err := decodeMessage(data, depth+1, int(number))
+			if err != nil {
+				return nil, nil, err
+			}
+			data = rest
+			field.WireType = "group"
+			field.Message = nested
+
+		case wireEndGroup:
+			if int(number) != group {
+				return nil, nil, ErrNotProtobuf
+			}
+			return fields, data, nil
+
+		default:
+			return nil, nil, ErrNotProtobuf
+		}
+		fields = append(fields, field)
+	}
+	if group >= 0 {
+		// Unterminated group
+		return nil, nil, ErrNotProtobuf
+	}
+	return fields, data, nil
+}
+
+// printable reports whether b is non-empty UTF-8 text without control
+// characters other than whitespace
+func printable(b []byte) bool {
+	if len(b) == 0 || !utf8.Valid(b) {
+		return false
+	}
+	for _, r := range string(b) {
+		if !unicode.IsPrint(r) && !unicode.IsSpace(r) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,373 @@
+package binproto
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// ErrNotThrift is returned for payloads that do not parse as a Thrift
+// message
+var ErrNotThrift = errors.New("not a Thrift message")
+
+// Thrift protocols
+const (
+	ThriftBinary  = "binary"
+	ThriftCompact = "compact"
+)
+
+// ThriftMessage is a Thrift message decoded without its IDL
+type ThriftMessage struct {
+	Protocol string `json:"protocol"`
+	// Name, type (call, reply, exception or oneway) and sequence ID of
+	// the message envelope; empty for a bare struct
+	Name   string        `json:"name,omitempty"`
+	Type   string        `json:"type,omitempty"`
+	SeqID  int32         `json:"seq_id,omitempty"`
+	Fields []ThriftField `json:"fields"`
+}
+
+// ThriftField is one field of a struct. Value is a bool, an integer, a
+// float64, a string (or bytes when not printable), a []ThriftField for a
+// struct, a []interface{} for a list or set, or a []ThriftMapEntry.
+type ThriftField struct {
+	ID    int16       `json:"id"`
+	Type  string      `json:"type"`
+	Value interface{} `json:"value"`
+}
+
+// ThriftMapEntry is one entry of a map
+type ThriftMapEntry struct {
+	Key   interface{} `json:"key"`
+	Value interface{} `json:"value"`
+}
+
+var thriftMessageTypes = map[byte]string{1: "call", 2: "reply", 3: "exception", 4: "oneway"}
+
+// DecodeThrift decodes a Thrift message in the binary or compact
+// protocol, with or without a message envelope
+func DecodeThrift(data []byte) (*ThriftMessage, error) {
+	for _, decode := range []func([]byte) (*ThriftMessage, error){decodeThriftBinary, decodeThriftCompact} {
+		if msg, err := decode(data); err == nil {
+			return msg, nil
+		}
+	}
+	return nil, ErrNotThrift
+}
+
+// thriftReader reads Thrift values from a byte slice. Both protocols
+// share it; compact selects the compact encoding.
+type thriftReader struct {
+	data    []byte
+	compact bool
+	err     error
+}
+
+func (r *thriftReader) fail() {
+	if r.err == nil {
+		r.err = ErrNotThrift
+	}
+}
+
+func (r *thriftReader) bytes(n int) []byte {
+	if r.err != nil || n < 0 || n > len(r.data) {
+		r.fail()
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *thriftReader) byte() byte {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *thriftReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.data)
+	if n <= 0 {
+		r.fail()
+		return 0
+	}
+	r.data = r.data[n:]
+	return v
+}
+
+// varsize reads a compact protocol length or collection size, which the
+// spec limits to an i32
+func (r *thriftReader) varsize() int64 {
+	v := r.uvarint()
+	if v > math.MaxInt32 {
+		r.fail()
+		return 0
+	}
+	return int64(v)
+}
+
+func (r *thriftReader) zigzag() int64 {
+	v := r.uvarint()
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+func (r *thriftReader) i16() int16 {
+	if r.compact {
+		return int16(r.zigzag())
+	}
+	if b := r.bytes(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (r *thriftReader) i32() int32 {
+	if r.compact {
+		return int32(r.zigzag())
+	}
+	if b := r.bytes(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (r *thriftReader) i64() int64 {
+	if r.compact {
+		return r.zigzag()
+	}
+	if b := r.bytes(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (r *thriftReader) double() float64 {
+	b := r.bytes(8)
+	if b == nil {
+		return 0
+	}
+	if r.compact {
+		return math.Float64frombits(binary.LittleEndian.Uint64(b))
+	}
+	return math.Float64frombits(binary.BigEndian.Uint64(b))
+}
+
+// binary reads a length-prefixed string or binary
+func (r *thriftReader) binary() []byte {
+	var n int64
+	if r.compact {
+		n = r.varsize()
+	} else {
+		n = int64(r.i32())
+	}
+	if n > int64(len(r.data)) {
+		r.fail()
+		return nil
+	}
+	return r.bytes(int(n))
+}
+
+// size reads a collection size and checks that the elements could fit
+// in what is left, so a corrupt size cannot allocate much
+func (r *thriftReader) size(n int64, minElem int) int {
+	if n < 0 || n > int64(len(r.data))/int64(minElem) {
+		r.fail()
+		return 0
+	}
+	return int(n)
+}
+
+// Type names shared by both protocols
+const (
+	thriftBool   = "bool"
+	thriftByte   = "byte"
+	thriftDouble = "double"
+	thriftI16    = "i16"
+	thriftI32    = "i32"
+	thriftI64    = "i64"
+	thriftString = "string"
+	thriftStruct = "struct"
+	thriftMap    = "map"
+	thriftSet    = "set"
+	thriftList   = "list"
+)
+
+var binaryTypes = map[byte]string{
+	2: thriftBool, 3: thriftByte, 4: thriftDouble, 6: thriftI16, 8: thriftI32,
+	10: thriftI64, 11: thriftString, 12: thriftStruct, 13: thriftMap, 14: thriftSet, 15: thriftList,
+}
+
+var compactTypes = map[byte]string{
+	1: thriftBool, 2: thriftBool, 3: thriftByte, 4: thriftI16, 5: thriftI32, 6: thriftI64,
+	7: thriftDouble, 8: thriftString, 9: thriftList, 10: thriftSet, 11: thriftMap, 12: thriftStruct,
+}
+
+func (r *thriftReader) typeName(t byte) string {
+	types := binaryTypes
+	if r.compact {
+		types = compactTypes
+	}
+	name, ok := types[t]
+	if !ok {
+		r.fail()
+	}
+	return name
+}
+
+// value reads one value of the named type
+func (r *thriftReader) value(typ string, depth int) interface{} {
+	if depth > maxDepth {
+		r.err = fmt.Errorf("structs nested deeper than %d", maxDepth)
+		return nil
+	}
+	switch typ {
+	case thriftBool:
+		b := r.byte()
+		if r.compact {
+			return b == 1
+		}
+		return b != 0
+	case thriftByte:
+		return int8(r.byte())
+	case thriftI16:
+		return r.i16()
+	case thriftI32:
+		return r.i32()
+	case thriftI64:
+		return r.i64()
+	case thriftDouble:
+		return r.double()
+	case thriftString:
+		b := r.binary()
+		if printable(b) || len(b) == 0 {
+			return string(b)
+		}
+		return b
+	case thriftStruct:
+		return r.structFields(depth + 1)
+	case thriftList, thriftSet:
+		var elemType string
+		var n int
+		if r.compact {
+			header := r.byte()
+			elemType = r.typeName(header & 0x0f)
+			count := int64(header >> 4)
+			if count == 15 {
+				count = r.varsize()
+			}
+			n = r.size(count, 1)
+		} else {
+			elemType = r.typeName(r.byte())
+			n = r.size(int64(r.i32()), 1)
+		}
+		list := make([]interface{}, 0, n)
+		for i := 0; i < n && r.err == nil; i++ {
+			list = append(list, r.value(elemType, depth+1))
+		}
+		return list
+	case thriftMap:
+		var keyType, valueType string
+		var n int
+		if r.compact {
+			n = r.size(r.varsize(), 2)
+			if n > 0 {
+				types := r.byte()
+				keyType, valueType = r.typeName(types>>4), r.typeName(types&0x0f)
+			}
+		} else {
+			keyType, valueType = r.typeName(r.byte()), r.typeName(r.byte())
+			n = r.size(int64(r.i32()), 2)
+		}
+		entries := make([]ThriftMapEntry, 0, n)
+		for i := 0; i < n && r.err == nil; i++ {
+			key := r.value(keyType, depth+1)
+			entries = append(entries, ThriftMapEntry{Key: key, Value: r.value(valueType, depth+1)})
+		}
+		return entries
+	}
+	r.fail()
+	return nil
+}
+
+// structFields reads fields up to the stop field
+func (r *thriftReader) structFields(depth int) []ThriftField {
+	fields := []ThriftField{}
+	var lastID int16
+	for r.err == nil {
+		header := r.byte()
+		if header == 0 {
+			return fields
+		}
+
+		var field ThriftField
+		if r.compact {
+			if delta := header >> 4; delta != 0 {
+				field.ID = lastID + int16(delta)
+			} else {
+				field.ID = r.i16()
+			}
+			ctype := header & 0x0f
+			field.Type = r.typeName(ctype)
+			if field.Type == thriftBool {
+				// The value is in the field header
+				field.Value = ctype == 1
+			} else {
+				field.Value = r.value(field.Type, depth)
+			}
+		} else {
+			field.Type = r.typeName(header)
+			field.ID = r.i16()
+			field.Value = r.value(field.Type, depth)
+		}
+		lastID = field.ID
+		fields = append(fields, field)
+	}
+	return nil
+}
+
+// decodeThriftBinary decodes the binary protocol: a strict envelope
+// (version 0x8001), an old-style one (name first), or a bare struct
+func decodeThriftBinary(data []byte) (*ThriftMessage, error) {
+	r := &thriftReader{data: data}
+	msg := &ThriftMessage{Protocol: ThriftBinary}
+	if len(data) >= 4 && data[0] == 0x80 && data[1] == 0x01 {
+		r.bytes(3)
+		msg.Type = thriftMessageTypes[r.byte()]
+		msg.Name = string(r.binary())
+		msg.SeqID = r.i32()
+		if msg.Type == "" {
+			return nil, ErrNotThrift
+		}
+	}
+	msg.Fields = r.structFields(0)
+	if r.err != nil || len(r.data) != 0 {
+		return nil, ErrNotThrift
+	}
+	return msg, nil
+}
+
+// decodeThriftCompact decodes the compact protocol, whose envelope starts
+// with 0x82, or a bare compact struct
+func decodeThriftCompact(data []byte) (*ThriftMessage, error) {
+	r := &thriftReader{data: data, compact: true}
+	msg := &ThriftMessage{Protocol: ThriftCompact}
+	if len(data) >= 2 && data[0] == 0x82 && data[1]&0x1f == 1 {
+		r.bytes(1)
+		msg.Type = thriftMessageTypes[r.byte()>>5]
+		msg.SeqID = int32(r.uvarint())
+		msg.Name = string(r.binary())
+		if msg.Type == "" {
+			return nil, ErrNotThrift
+		}
+	}
+	msg.Fields = r.structFields(0)
+	if r.err != nil || len(r.data) != 0 {
+		return nil, ErrNotThrift
+	}
+	return msg, nil
+}
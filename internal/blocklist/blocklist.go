@@ -0,0 +1,263 @@
+// Package blocklist matches requests against ad and tracker filter lists in
+// hosts file and Adblock Plus (EasyList) formats
+package blocklist
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/adamdrake/go_proxy/internal/hostmatch"
+)
+
+// List is a set of blocking rules loaded from one or more filter lists
+type List struct {
+	mu sync.RWMutex
+
+	// hosts blocks exact host names (hosts file entries)
+	hosts map[string]string
+	// domains blocks a domain and its subdomains (||example.com^ filters)
+	domains map[string]string
+	// exceptDomains allows a domain and its subdomains (@@||example.com^)
+	exceptDomains map[string]string
+
+	filters    []*filter
+	exceptions []*filter
+}
+
+// New creates an empty list
+func New() *List {
+	return &List{
+		hosts:         make(map[string]string),
+		domains:       make(map[string]string),
+		exceptDomains: make(map[string]string),
+	}
+}
+
+// LoadSource loads a filter list from a file path or an http(s) URL,
+// returning the number of rules added
+func (l *List) LoadSource(source string) (int, error) {
+	var r io.ReadCloser
+	if strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://") {
+		resp, err := http.Get(source)
+		if err != nil {
+			return 0, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return 0, fmt.Errorf("fetching %s: %s", source, resp.Status)
+		}
+		r = resp.Body
+	} else {
+		f, err := os.Open(source)
+		if err != nil {
+			return 0, err
+		}
+		r = f
+	}
+	defer r.Close()
+
+	return l.Load(r)
+}
+
+// Load reads a filter list, detecting the format of each line: hosts file
+// entries ("0.0.0.0 ads.example.com"), bare domains, and Adblock Plus
+// network filters. Cosmetic filters, regular expression filters and filters
+// with options the proxy cannot evaluate are skipped. It returns the number
+// of rules added.
+func (l *List) Load(r io.Reader) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	added := 0
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if l.addLine(strings.TrimSpace(scanner.Text())) {
+			added++
+		}
+	}
+	return added, scanner.Err()
+}
+
+// addLine parses one line, reporting whether it added a rule
+func (l *List) addLine(line string) bool {
+	if line == "" || line[0] == '!' || line[0] == '#' || line[0] == '[' {
+		return false
+	}
+
+	// hosts file entry
+	if fields := strings.Fields(line); len(fields) >= 2 && net.ParseIP(fields[0]) != nil {
+		added := false
+		for _, host := range fields[1:] {
+			if strings.HasPrefix(host, "#") {
+				break
+			}
+			host = hostmatch.Normalize(host)
+			switch host {
+			case "localhost", "localhost.localdomain", "local", "broadcasthost", "ip6-localhost", "ip6-loopback", "0.0.0.0":
+				continue
+			}
+			l.hosts[host] = line
+			added = true
+		}
+		return added
+	}
+
+	// bare domain
+	if isHostname(line) {
+		l.hosts[strings.ToLower(line)] = line
+		return true
+	}
+
+	return l.addFilter(line)
+}
+
+// addFilter parses an Adblock Plus network filter
+func (l *List) addFilter(line string) bool {
+	if strings.Contains(line, "##") || strings.Contains(line, "#@#") ||
+		strings.Contains(line, "#?#") || strings.Contains(line, "#$#") {
+		return false
+	}
+
+	f := &filter{raw: line}
+	pattern := line
+	exception := strings.HasPrefix(pattern, "@@")
+	pattern = strings.TrimPrefix(pattern, "@@")
+
+	if i := strings.LastIndex(pattern, "$"); i >= 0 {
+		if !f.parseOptions(pattern[i+1:]) {
+			return false
+		}
+		pattern = pattern[:i]
+	}
+	if len(pattern) > 1 && pattern[0] == '/' && pattern[len(pattern)-1] == '/' {
+		// regular expression filters are rare and costly; skip them
+		return false
+	}
+	pattern = strings.ToLower(pattern)
+
+	switch {
+	case strings.HasPrefix(pattern, "||"):
+		f.hostAnchor = true
+		pattern = pattern[2:]
+	case strings.HasPrefix(pattern, "|"):
+		f.startAnchor = true
+		pattern = pattern[1:]
+	}
+	if strings.HasSuffix(pattern, "|") {
+		f.endAnchor = true
+		pattern = pattern[:len(pattern)-1]
+	}
+	if strings.Trim(pattern, "*") == "" {
+		// would match everything
+		return false
+	}
+
+	// ||example.com^ without options is a plain domain block
+	if f.hostAnchor && !f.endAnchor && f.unconditional() {
+		if host := strings.TrimSuffix(pattern, "^"); isHostname(host) {
+			if exception {
+				l.exceptDomains[host] = line
+			} else {
+				l.domains[host] = line
+			}
+			return true
+		}
+	}
+
+	f.parts = strings.Split(pattern, "*")
+	if exception {
+		l.exceptions = append(l.exceptions, f)
+	} else {
+		l.filters = append(l.filters, f)
+	}
+	return true
+}
+
+// isHostname reports whether s looks like a domain name
+func isHostname(s string) bool {
+	if !strings.Contains(s, ".") {
+		return false
+	}
+	for _, c := range s {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '-' || c == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// Len returns the number of rules loaded
+func (l *List) Len() int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return len(l.hosts) + len(l.domains) + len(l.exceptDomains) + len(l.filters) + len(l.exceptions)
+}
+
+// Match checks a request URL against the list. referer is the URL of the
+// page that made the request (Referer or Origin), used by third-party and
+// domain options; it may be empty. It returns the filter that blocked the
+// request.
+func (l *List) Match(rawURL, referer string) (string, bool) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", false
+	}
+	host := hostmatch.Normalize(u.Host)
+	lowered := strings.ToLower(rawURL)
+	hostStart := strings.Index(lowered, "://") + 3
+	if hostStart < 3 {
+		hostStart = 0
+	}
+
+	var page string
+	if ref, err := url.Parse(referer); err == nil {
+		page = hostmatch.Normalize(ref.Host)
+	}
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if _, ok := lookupDomain(l.exceptDomains, host); ok {
+		return "", false
+	}
+	for _, f := range l.exceptions {
+		if f.matches(lowered, hostStart, host, page) {
+			return "", false
+		}
+	}
+
+	if rule, ok := l.hosts[host]; ok {
+		return rule, true
+	}
+	if rule, ok := lookupDomain(l.domains, host); ok {
+		return rule, true
+	}
+	for _, f := range l.filters {
+		if f.matches(lowered, hostStart, host, page) {
+			return f.raw, true
+		}
+	}
+	return "", false
+}
+
+// lookupDomain finds host or its closest parent domain in m
+func lookupDomain(m map[string]string, host string) (string, bool) {
+	for {
+		if rule, ok := m[host]; ok {
+			return rule, true
+		}
+		i := strings.IndexByte(host, '.')
+		if i < 0 {
+			return "", false
+		}
+		host = host[i+1:]
+	}
+}
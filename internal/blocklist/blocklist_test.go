@@ -0,0 +1,132 @@
+package blocklist
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+const testList = `! comment
+[Adblock Plus 2.0]
+0.0.0.0 ads.example.com tracker.example.com # trailing
+127.0.0.1 localhost
+banner.example
+||doubleclick.net^
+@@||ok.doubleclick.net^
+||cdn.example.org/ads/*.js|
+|https://start.example/
+/pixel.gif^
+||social.example^$third-party
+||analytics.example^$domain=news.example|~blog.news.example
+example.net##.ad
+/regex/
+||popup.example^$popup
+@@/pixel.gif^$domain=allowed.example
+`
+
+func TestLoad(t *testing.T) {
+	l := New()
+	n, err := l.Load(strings.NewReader(testList))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 10 || l.Len() != 11 {
+		t.Fatalf("loaded %d lines into %d rules, want 10 into 11", n, l.Len())
+	}
+}
+
+func TestMatch(t *testing.T) {
+	l := New()
+	if _, err := l.Load(strings.NewReader(testList)); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		url, referer string
+		rule         string
+	}{
+		{"http://ads.example.com/x", "", "0.0.0.0 ads.example.com tracker.example.com # trailing"},
+		{"http://sub.ads.example.com/x", "", ""},
+		{"http://localhost/", "", ""},
+		{"https://banner.example/", "", "banner.example"},
+		{"https://x.doubleclick.net/ad", "", "||doubleclick.net^"},
+		{"https://ok.doubleclick.net/ad", "", ""},
+		{"https://notdoubleclick.net/", "", ""},
+		{"https://cdn.example.org/ads/a/b.js", "", "||cdn.example.org/ads/*.js|"},
+		{"https://cdn.example.org/ads/a.js?v=1", "", ""},
+		{"https://start.example/path", "", "|https://start.example/"},
+		{"http://start.example/path", "", ""},
+		{"https://any.example/img/pixel.gif", "", "/pixel.gif^"},
+		{"https://any.example/img/pixel.gif?x", "", "/pixel.gif^"},
+		{"https://any.example/img/pixel.gifs", "", ""},
+		{"https://any.example/pixel.gif", "https://allowed.example/", ""},
+		{"https://social.example/like", "https://page.example/", "||social.example^$third-party"},
+		{"https://social.example/like", "https://www.social.example/", ""},
+		{"https://social.example/like", "", ""},
+		{"https://analytics.example/t", "https://news.example/", "||analytics.example^$domain=news.example|~blog.news.example"},
+		{"https://analytics.example/t", "https://blog.news.example/", ""},
+		{"https://analytics.example/t", "https://other.example/", ""},
+		{"https://popup.example/", "", ""},
+		{"https://HOST.Example.Net/", "", ""},
+		{"::not a url", "", ""},
+	}
+	for _, tt := range tests {
+		rule, blocked := l.Match(tt.url, tt.referer)
+		if rule != tt.rule || blocked != (tt.rule != "") {
+			t.Errorf("Match(%q, %q) = %q, %v; want %q", tt.url, tt.referer, rule, blocked, tt.rule)
+		}
+	}
+}
+
+func TestMatchPartsIsLinear(t *testing.T) {
+	l := New()
+	l.Load(strings.NewReader("a*a*a*a*a*a*a*a*a*a*a*a*b|\n"))
+	start := time.Now()
+	l.Match("http://x.example/"+strings.Repeat("a", 4000), "")
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("matching took %s", d)
+	}
+}
+
+// backtrackParts is the exhaustive matcher matchParts must agree with
+func backtrackParts(s string, pos int, parts []string, anchored, endAnchor bool) bool {
+	if len(parts) == 0 {
+		return !endAnchor || pos == len(s)
+	}
+	if anchored {
+		end, ok := matchPart(s, pos, parts[0])
+		return ok && backtrackParts(s, end, parts[1:], false, endAnchor)
+	}
+	for i := pos; i <= len(s); i++ {
+		if end, ok := matchPart(s, i, parts[0]); ok && backtrackParts(s, end, parts[1:], false, endAnchor) {
+			return true
+		}
+	}
+	return false
+}
+
+func FuzzMatchParts(f *testing.F) {
+	f.Add("a^b*c", "xa/bzc", false, true)
+	f.Add("/ads/*.js", "http://cdn/ads/a/b.js", true, false)
+	f.Add("^*^", "a", false, true)
+	f.Fuzz(func(t *testing.T, pattern, s string, anchored, endAnchor bool) {
+		if len(pattern) > 32 || len(s) > 64 {
+			return
+		}
+		parts := strings.Split(pattern, "*")
+		if got, want := matchParts(s, 0, parts, anchored, endAnchor), backtrackParts(s, 0, parts, anchored, endAnchor); got != want {
+			t.Fatalf("matchParts(%q, %q, %v, %v) = %v, want %v", s, pattern, anchored, endAnchor, got, want)
+		}
+	})
+}
+
+func FuzzList(f *testing.F) {
+	f.Add(testList, "https://x.doubleclick.net/ad", "https://page.example/")
+	f.Add("||a^$domain=b|~c,third-party\n@@|http://a/*x|\n", "http://a/yx", "")
+	f.Fuzz(func(t *testing.T, list, url, referer string) {
+		l := New()
+		l.Load(strings.NewReader(list))
+		if rule, blocked := l.Match(url, referer); blocked && rule == "" {
+			t.Fatal("blocked without a rule")
+		}
+	})
+}
@@ -0,0 +1,207 @@
+package blocklist
+
+import "strings"
+
+// filter is an Adblock Plus network filter. The pattern is split on '*'
+// wildcards; '^' in a part matches a separator character or the end of
+// the URL.
+type filter struct {
+	raw   string
+	parts []string
+
+	hostAnchor  bool // ||: starts at the host or one of its subdomains
+	startAnchor bool // |: starts at the beginning of the URL
+	endAnchor   bool // |: ends at the end of the URL
+
+	// thirdParty is 1 for $third-party, -1 for $~third-party, else 0
+	thirdParty int
+	// domains and notDomains restrict the pages the filter applies on
+	domains    []string
+	notDomains []string
+}
+
+// ignoredOptions restrict filters by resource type, which a proxy cannot
+// tell reliably; filters carrying them apply to every type
+var ignoredOptions = map[string]bool{
+	"script": true, "image": true, "stylesheet": true, "object": true,
+	"xmlhttprequest": true, "xhr": true, "subdocument": true, "frame": true,
+	"ping": true, "media": true, "font": true, "other": true,
+	"websocket": true, "document": true, "doc": true, "css": true,
+	"important": true, "match-case": true, "all": true,
+}
+
+// parseOptions reads the $options of a filter, reporting false for filters
+// that should be skipped
+func (f *filter) parseOptions(options string) bool {
+	for _, opt := range strings.Split(options, ",") {
+		opt = strings.ToLower(strings.TrimSpace(opt))
+		switch {
+		case opt == "third-party" || opt == "3p" || opt == "~first-party" || opt == "~1p":
+			f.thirdParty = 1
+		case opt == "~third-party" || opt == "~3p" || opt == "first-party" || opt == "1p":
+			f.thirdParty = -1
+		case strings.HasPrefix(opt, "domain="):
+			for _, d := range strings.Split(opt[len("domain="):], "|") {
+				if strings.HasPrefix(d, "~") {
+					f.notDomains = append(f.notDomains, d[1:])
+				} else if d != "" {
+					f.domains = append(f.domains, d)
+				}
+			}
+		case ignoredOptions[strings.TrimPrefix(opt, "~")]:
+		default:
+			// popup, csp=, redirect= and friends don't block requests
+			return false
+		}
+	}
+	return true
+}
+
+// unconditional reports whether the filter applies on every page
+func (f *filter) unconditional() bool {
+	return f.thirdParty == 0 && len(f.domains) == 0 && len(f.notDomains) == 0
+}
+
+// matches reports whether the filter applies to a lowercased URL whose host
+// starts at hostStart, requested from page (empty when unknown)
+func (f *filter) matches(u string, hostStart int, host, page string) bool {
+	if !f.appliesOn(host, page) {
+		return false
+	}
+
+	switch {
+	case f.startAnchor:
+		return matchParts(u, 0, f.parts, true, f.endAnchor)
+	case f.hostAnchor:
+		hostEnd := hostStart + len(host)
+		for i := hostStart; i < hostEnd && i <= len(u); i++ {
+			if (i == hostStart || u[i-1] == '.') && matchParts(u, i, f.parts, true, f.endAnchor) {
+				return true
+			}
+		}
+		return false
+	default:
+		return matchParts(u, 0, f.parts, false, f.endAnchor)
+	}
+}
+
+// appliesOn checks the third-party and domain options. Requests without a
+// referring page count as first-party.
+func (f *filter) appliesOn(host, page string) bool {
+	if f.thirdParty != 0 {
+		third := page != "" && siteOf(page) != siteOf(host)
+		if third != (f.thirdParty == 1) {
+			return false
+		}
+	}
+	for _, d := range f.notDomains {
+		if onDomain(page, d) {
+			return false
+		}
+	}
+	if len(f.domains) == 0 {
+		return true
+	}
+	for _, d := range f.domains {
+		if onDomain(page, d) {
+			return true
+		}
+	}
+	return false
+}
+
+// siteOf approximates a host's registrable domain by its last two labels
+func siteOf(host string) string {
+	i := strings.LastIndexByte(host, '.')
+	if i < 0 {
+		return host
+	}
+	if j := strings.LastIndexByte(host[:i], '.'); j >= 0 {
+		return host[j+1:]
+	}
+	return host
+}
+
+// onDomain reports whether host is domain or one of its subdomains
+func onDomain(host, domain string) bool {
+	return host != "" && (host == domain || strings.HasSuffix(host, "."+domain))
+}
+
+// matchParts matches wildcard-separated parts against s from pos. The first
+// part must match at pos when anchored; later parts may match anywhere
+// after the previous one. Each part takes its earliest match, which ends
+// no later than any other, so no backtracking is needed and hostile URLs
+// cannot make matching exponential; only a part that must end the URL
+// looks further.
+func matchParts(s string, pos int, parts []string, anchored, endAnchor bool) bool {
+	if len(parts) == 0 {
+		return !endAnchor || pos == len(s)
+	}
+	for k, part := range parts {
+		mustEnd := endAnchor && k == len(parts)-1
+		if k == 0 && anchored {
+			end, ok := matchPart(s, pos, part)
+			if !ok || mustEnd && end != len(s) {
+				return false
+			}
+			pos = end
+			continue
+		}
+		end, ok := findPart(s, pos, part, mustEnd)
+		if !ok {
+			return false
+		}
+		pos = end
+	}
+	return true
+}
+
+// findPart finds the earliest match of part at or after pos, one ending
+// the string when mustEnd is set, returning where it ended
+func findPart(s string, pos int, part string, mustEnd bool) (int, bool) {
+	for i := pos; i <= len(s); i++ {
+		if part != "" && !strings.Contains(part, "^") {
+			// jump straight to the next literal occurrence
+			j := strings.Index(s[i:], part)
+			if j < 0 {
+				return 0, false
+			}
+			i += j
+		}
+		if end, ok := matchPart(s, i, part); ok && (!mustEnd || end == len(s)) {
+			return end, true
+		}
+	}
+	return 0, false
+}
+
+// matchPart matches a wildcard-free part at pos, returning where it ended
+func matchPart(s string, pos int, part string) (int, bool) {
+	i := pos
+	for j := 0; j < len(part); j++ {
+		c := part[j]
+		if c == '^' {
+			if i == len(s) {
+				// the separator matches the end of the URL
+				continue
+			}
+			if !isSeparator(s[i]) {
+				return 0, false
+			}
+			i++
+			continue
+		}
+		if i >= len(s) || s[i] != c {
+			return 0, false
+		}
+		i++
+	}
+	return i, true
+}
+
+// isSeparator reports whether c is an Adblock Plus separator character:
+// anything but a letter, a digit or one of _-.%
+func isSeparator(c byte) bool {
+	return !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		c == '_' || c == '-' || c == '.' || c == '%')
+}
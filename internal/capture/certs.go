@@ -0,0 +1,110 @@
+package capture
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/adamdrake/go_proxy/internal/hostmatch"
+)
+
+// CertExpiryWarning is how close to expiry a certificate is flagged
+const CertExpiryWarning = 30 * 24 * time.Hour
+
+// CertInfo describes one certificate of an upstream chain
+type CertInfo struct {
+	Subject string `json:"subject"`
+	Issuer  string `json:"issuer"`
+	// SANs are the DNS names and IP addresses the certificate covers
+	SANs      []string  `json:"sans,omitempty"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	SHA256    string    `json:"sha256"`
+}
+
+// CertChain describes certificates as presented, leaf first
+func CertChain(certs []*x509.Certificate) []CertInfo {
+	chain := make([]CertInfo, 0, len(certs))
+	for _, cert := range certs {
+		info := CertInfo{
+			Subject:   cert.Subject.String(),
+			Issuer:    cert.Issuer.String(),
+			SANs:      append([]string(nil), cert.DNSNames...),
+			NotBefore: cert.NotBefore,
+			NotAfter:  cert.NotAfter,
+		}
+		for _, ip := range cert.IPAddresses {
+			info.SANs = append(info.SANs, ip.String())
+		}
+		sum := sha256.Sum256(cert.Raw)
+		info.SHA256 = hex.EncodeToString(sum[:])
+		chain = append(chain, info)
+	}
+	return chain
+}
+
+// AnalyzeCerts returns findings for a capture's upstream certificate
+// chain: certificates expired or expiring within CertExpiryWarning, and a
+// leaf that does not cover the host
+func AnalyzeCerts(req *CapturedRequest) []Finding {
+	if len(req.UpstreamCerts) == 0 {
+		return nil
+	}
+	var findings []Finding
+	now := time.Now()
+	for _, cert := range req.UpstreamCerts {
+		switch left := cert.NotAfter.Sub(now); {
+		case left <= 0:
+			findings = append(findings, Finding{
+				Type:     FindingCertExpired,
+				Severity: "high",
+				Detail:   fmt.Sprintf("%s expired %s", cert.Subject, cert.NotAfter.Format(time.DateOnly)),
+			})
+		case left < CertExpiryWarning:
+			findings = append(findings, Finding{
+				Type:     FindingCertExpiring,
+				Severity: "medium",
+				Detail:   fmt.Sprintf("%s expires %s, in %d days", cert.Subject, cert.NotAfter.Format(time.DateOnly), int(left.Hours()/24)),
+			})
+		}
+	}
+
+	host := hostmatch.Normalize(req.Host)
+	if leaf := req.UpstreamCerts[0]; !certCovers(leaf, host) {
+		findings = append(findings, Finding{
+			Type:     FindingCertMismatch,
+			Severity: "high",
+			Detail:   fmt.Sprintf("certificate for %s does not cover %s", strings.Join(leaf.SANs, ", "), host),
+		})
+	}
+	return findings
+}
+
+// certCovers reports whether a certificate's SANs name host, with
+// wildcards covering a single label as browsers apply them
+func certCovers(cert CertInfo, host string) bool {
+	if net.ParseIP(host) != nil {
+		for _, san := range cert.SANs {
+			if ip := net.ParseIP(san); ip != nil && ip.Equal(net.ParseIP(host)) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, san := range cert.SANs {
+		san = strings.ToLower(san)
+		if san == host {
+			return true
+		}
+		if suffix, ok := strings.CutPrefix(san, "*."); ok {
+			if _, rest, found := strings.Cut(host, "."); found && rest == suffix {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,178 @@
+package capture
+
+import (
+	"sort"
+	"time"
+)
+
+// SessionSummary describes the captures of one recording session
+type SessionSummary struct {
+	Name     string    `json:"name"`
+	Requests int       `json:"requests"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+}
+
+// Sessions summarizes the named sessions among requests, in the order
+// they started
+func Sessions(requests []*CapturedRequest) []SessionSummary {
+	byName := make(map[string]*SessionSummary)
+	var names []string
+	for _, req := range requests {
+		if req.Session == "" {
+			continue
+		}
+		s := byName[req.Session]
+		if s == nil {
+			s = &SessionSummary{Name: req.Session, Start: req.Timestamp}
+			byName[req.Session] = s
+			names = append(names, req.Session)
+		}
+		s.Requests++
+		if req.Timestamp.Before(s.Start) {
+			s.Start = req.Timestamp
+		}
+		if end := req.Timestamp.Add(req.Duration); end.After(s.End) {
+			s.End = end
+		}
+	}
+
+	result := make([]SessionSummary, len(names))
+	for i, name := range names {
+		result[i] = *byName[name]
+	}
+	sort.SliceStable(result, func(i, j int) bool { return result[i].Start.Before(result[j].Start) })
+	return result
+}
+
+// SessionStats are the aggregate figures of one side of a comparison
+type SessionStats struct {
+	Session   string  `json:"session"`
+	Requests  int     `json:"requests"`
+	Errors    int     `json:"errors"`
+	ErrorRate float64 `json:"error_rate"`
+	Endpoints int     `json:"endpoints"`
+
+	P50MS int64 `json:"p50_ms"`
+	P90MS int64 `json:"p90_ms"`
+	P95MS int64 `json:"p95_ms"`
+	P99MS int64 `json:"p99_ms"`
+
+	TotalBytes int64 `json:"total_bytes"`
+	AvgBytes   int64 `json:"avg_bytes"`
+}
+
+// EndpointChange contrasts an endpoint seen in both sessions
+type EndpointChange struct {
+	Method   string `json:"method"`
+	Host     string `json:"host"`
+	Template string `json:"template"`
+
+	CountA int `json:"count_a"`
+	CountB int `json:"count_b"`
+
+	P95MSA     int64 `json:"p95_ms_a"`
+	P95MSB     int64 `json:"p95_ms_b"`
+	P95DeltaMS int64 `json:"p95_delta_ms"`
+
+	ErrorsA int `json:"errors_a"`
+	ErrorsB int `json:"errors_b"`
+
+	AvgBytesA int64 `json:"avg_bytes_a"`
+	AvgBytesB int64 `json:"avg_bytes_b"`
+}
+
+// Comparison contrasts two sessions: overall figures, endpoints only
+// the second one called (added) or only the first (removed), and the
+// endpoints both called, largest p95 latency change first
+type Comparison struct {
+	A SessionStats `json:"a"`
+	B SessionStats `json:"b"`
+
+	Added   []*EndpointStats `json:"added"`
+	Removed []*EndpointStats `json:"removed"`
+	Changed []EndpointChange `json:"changed"`
+}
+
+// Compare contrasts the requests of session a with those of session b,
+// grouping endpoints with templates
+func Compare(a, b []*CapturedRequest, nameA, nameB string, templates *PathTemplates) *Comparison {
+	endpointsA := Endpoints(a, templates)
+	endpointsB := Endpoints(b, templates)
+	c := &Comparison{
+		A:       sessionStats(nameA, a, len(endpointsA)),
+		B:       sessionStats(nameB, b, len(endpointsB)),
+		Added:   []*EndpointStats{},
+		Removed: []*EndpointStats{},
+		Changed: []EndpointChange{},
+	}
+
+	key := func(e *EndpointStats) string { return e.Method + " " + e.Host + e.Template }
+	inA := make(map[string]*EndpointStats, len(endpointsA))
+	for _, e := range endpointsA {
+		inA[key(e)] = e
+	}
+	inB := make(map[string]bool, len(endpointsB))
+	for _, eb := range endpointsB {
+		inB[key(eb)] = true
+		ea := inA[key(eb)]
+		if ea == nil {
+			c.Added = append(c.Added, eb)
+			continue
+		}
+		c.Changed = append(c.Changed, EndpointChange{
+			Method:     eb.Method,
+			Host:       eb.Host,
+			Template:   eb.Template,
+			CountA:     ea.Count,
+			CountB:     eb.Count,
+			P95MSA:     ea.P95MS,
+			P95MSB:     eb.P95MS,
+			P95DeltaMS: eb.P95MS - ea.P95MS,
+			ErrorsA:    ea.Errors,
+			ErrorsB:    eb.Errors,
+			AvgBytesA:  ea.TotalBytes / int64(ea.Count),
+			AvgBytesB:  eb.TotalBytes / int64(eb.Count),
+		})
+	}
+	for _, ea := range endpointsA {
+		if !inB[key(ea)] {
+			c.Removed = append(c.Removed, ea)
+		}
+	}
+
+	sort.SliceStable(c.Changed, func(i, j int) bool {
+		return abs(c.Changed[i].P95DeltaMS) > abs(c.Changed[j].P95DeltaMS)
+	})
+	return c
+}
+
+// sessionStats aggregates the requests of one session
+func sessionStats(name string, requests []*CapturedRequest, endpoints int) SessionStats {
+	stats := SessionStats{Session: name, Requests: len(requests), Endpoints: endpoints}
+	durations := make([]time.Duration, len(requests))
+	for i, req := range requests {
+		durations[i] = req.Duration
+		if failed(req) {
+			stats.Errors++
+		}
+		stats.TotalBytes += responseSize(req)
+	}
+	sorted := sortedDurations(durations)
+	stats.P50MS = percentile(sorted, 50).Milliseconds()
+	stats.P90MS = percentile(sorted, 90).Milliseconds()
+	stats.P95MS = percentile(sorted, 95).Milliseconds()
+	stats.P99MS = percentile(sorted, 99).Milliseconds()
+	if len(requests) > 0 {
+		stats.ErrorRate = float64(stats.Errors) / float64(len(requests))
+		stats.AvgBytes = stats.TotalBytes / int64(len(requests))
+	}
+	return stats
+}
+
+func abs(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
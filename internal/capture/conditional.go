@@ -0,0 +1,58 @@
+package capture
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/adamdrake/go_proxy/internal/hostmatch"
+)
+
+// FindValidated returns the newest stored 200 response to a GET of rawURL
+// that a conditional request's validators match: an entity tag listed in
+// ifNoneMatch (weak comparison), or, when ifNoneMatch is empty, a
+// Last-Modified no later than ifModifiedSince. It returns nil if none does.
+func (s *Store) FindValidated(host, rawURL, ifNoneMatch, ifModifiedSince string) *CapturedRequest {
+	if ifNoneMatch == "" && ifModifiedSince == "" {
+		return nil
+	}
+	since, sinceErr := http.ParseTime(ifModifiedSince)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := s.byHost[hostmatch.Normalize(host)]
+	for i := len(list) - 1; i >= 0; i-- {
+		req := list[i]
+		if req.URL != rawURL || req.Method != http.MethodGet || req.StatusCode != http.StatusOK {
+			continue
+		}
+		header := http.Header(req.ResponseHeaders)
+		if ifNoneMatch != "" {
+			if etagListed(ifNoneMatch, header.Get("ETag")) {
+				return req
+			}
+			continue
+		}
+		modified, err := http.ParseTime(header.Get("Last-Modified"))
+		if sinceErr == nil && err == nil && !modified.After(since) {
+			return req
+		}
+	}
+	return nil
+}
+
+// etagListed reports whether etag weakly matches an entry of an
+// If-None-Match list
+func etagListed(list, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,182 @@
+package capture
+
+import (
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Credential kinds
+const (
+	CredentialBasic  = "basic"
+	CredentialDigest = "digest"
+	// CredentialQueryToken is a token, key or password in the query string
+	CredentialQueryToken = "query_token"
+)
+
+// redactedCredential stands in for Basic and Digest credentials, of which
+// nothing is kept
+const redactedCredential = "[redacted]"
+
+// credentialParams are query parameter names that carry credentials,
+// lowercased with dashes as underscores
+var credentialParams = map[string]bool{
+	"access_token":  true,
+	"api_key":       true,
+	"apikey":        true,
+	"auth":          true,
+	"auth_token":    true,
+	"client_secret": true,
+	"id_token":      true,
+	"jwt":           true,
+	"passwd":        true,
+	"password":      true,
+	"pwd":           true,
+	"refresh_token": true,
+	"secret":        true,
+	"session_token": true,
+	"token":         true,
+}
+
+// Credential is a credential an outgoing request carried, redacted
+type Credential struct {
+	// Kind is one of the Credential* constants
+	Kind string `json:"kind"`
+	// Location is request_headers or url
+	Location string `json:"location"`
+	// Name is the header or query parameter carrying the credential
+	Name string `json:"name"`
+	// Value is "[redacted]" for Basic and Digest, and the token masked
+	// for query tokens
+	Value string `json:"value"`
+	// Set when the credential crossed the network in plain HTTP
+	Cleartext bool `json:"cleartext,omitempty"`
+}
+
+// DetectCredentials returns the credentials a capture's request carried:
+// Basic and Digest Authorization headers and tokens in the query string.
+// Tunnels are opaque and yield none.
+func DetectCredentials(req *CapturedRequest) []Credential {
+	if req.IsTunnel {
+		return nil
+	}
+	cleartext := !strings.HasPrefix(req.URL, "https://") && !strings.HasPrefix(req.URL, "wss://")
+
+	var found []Credential
+	scheme, _, _ := strings.Cut(strings.TrimSpace(http.Header(req.RequestHeaders).Get("Authorization")), " ")
+	switch strings.ToLower(scheme) {
+	case "basic":
+		found = append(found, Credential{Kind: CredentialBasic, Location: "request_headers", Name: "Authorization", Value: redactedCredential, Cleartext: cleartext})
+	case "digest":
+		found = append(found, Credential{Kind: CredentialDigest, Location: "request_headers", Name: "Authorization", Value: redactedCredential, Cleartext: cleartext})
+	}
+
+	params := req.QueryParams
+	if params == nil {
+		params = queryParams(req.URL)
+	}
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !credentialParams[strings.ReplaceAll(strings.ToLower(name), "-", "_")] {
+			continue
+		}
+		for _, value := range params[name] {
+			if value != "" {
+				found = append(found, Credential{Kind: CredentialQueryToken, Location: "url", Name: name, Value: maskSecret(value), Cleartext: cleartext})
+				break
+			}
+		}
+	}
+	return found
+}
+
+// CredentialEndpoint sums up the requests to one method, host and path
+// template that carried credentials
+type CredentialEndpoint struct {
+	Method   string `json:"method"`
+	Host     string `json:"host"`
+	Template string `json:"template"`
+
+	// Requests that carried credentials, and how many of them in plain
+	// HTTP
+	Requests  int `json:"requests"`
+	Cleartext int `json:"cleartext"`
+
+	// Requests per credential kind, and the headers and parameters seen
+	// carrying them
+	Kinds map[string]int `json:"kinds"`
+	Names []string       `json:"names"`
+
+	LastSeen time.Time `json:"last_seen"`
+	// SampleIDs are the latest captures, cleartext ones first
+	SampleIDs []string `json:"sample_ids"`
+
+	requests []*CapturedRequest
+}
+
+// CredentialEndpoints groups the requests that carried credentials per
+// endpoint, naming endpoints with templates (automatic ID detection when
+// nil). Endpoints with the most cleartext requests come first.
+func CredentialEndpoints(requests []*CapturedRequest, templates *PathTemplates) []*CredentialEndpoint {
+	byKey := make(map[string]*CredentialEndpoint)
+	var result []*CredentialEndpoint
+
+	for _, req := range requests {
+		if len(req.Credentials) == 0 {
+			continue
+		}
+		tmpl := templates.Template(req.Path)
+		host := endpointHost(req)
+		key := req.Method + " " + host + tmpl
+		e := byKey[key]
+		if e == nil {
+			e = &CredentialEndpoint{Method: req.Method, Host: host, Template: tmpl, Kinds: make(map[string]int)}
+			byKey[key] = e
+			result = append(result, e)
+		}
+
+		e.Requests++
+		if slices.ContainsFunc(req.Credentials, func(c Credential) bool { return c.Cleartext }) {
+			e.Cleartext++
+		}
+		kinds := make(map[string]bool)
+		for _, c := range req.Credentials {
+			if !kinds[c.Kind] {
+				kinds[c.Kind] = true
+				e.Kinds[c.Kind]++
+			}
+			if !slices.Contains(e.Names, c.Name) {
+				e.Names = append(e.Names, c.Name)
+			}
+		}
+		if req.Timestamp.After(e.LastSeen) {
+			e.LastSeen = req.Timestamp
+		}
+		e.requests = append(e.requests, req)
+	}
+
+	for _, e := range result {
+		sort.SliceStable(e.requests, func(i, j int) bool {
+			ci, cj := e.requests[i].Credentials[0].Cleartext, e.requests[j].Credentials[0].Cleartext
+			if ci != cj {
+				return ci
+			}
+			return e.requests[i].Timestamp.After(e.requests[j].Timestamp)
+		})
+		e.SampleIDs = ids(e.requests[:min(samples, len(e.requests))])
+		e.requests = nil
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		if result[i].Cleartext != result[j].Cleartext {
+			return result[i].Cleartext > result[j].Cleartext
+		}
+		return result[i].Requests > result[j].Requests
+	})
+	return result
+}
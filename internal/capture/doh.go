@@ -0,0 +1,337 @@
+package capture
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// dnsMessageType is the media type of DNS-over-HTTPS messages (RFC 8484)
+const dnsMessageType = "application/dns-message"
+
+// DNSExchange is a DNS-over-HTTPS lookup: the query the client sent and
+// the answer it got
+type DNSExchange struct {
+	Query    *DNSMessage `json:"query,omitempty"`
+	Response *DNSMessage `json:"response,omitempty"`
+}
+
+// DNSMessage is a decoded DNS message
+type DNSMessage struct {
+	ID     uint16 `json:"id"`
+	Opcode int    `json:"opcode,omitempty"`
+	// RCode is the response code, such as NOERROR or NXDOMAIN
+	RCode string `json:"rcode,omitempty"`
+	// Flags set in the header: qr, aa, tc, rd, ra, ad, cd
+	Flags      []string      `json:"flags,omitempty"`
+	Questions  []DNSQuestion `json:"questions"`
+	Answers    []DNSRecord   `json:"answers,omitempty"`
+	Authority  []DNSRecord   `json:"authority,omitempty"`
+	Additional []DNSRecord   `json:"additional,omitempty"`
+	// Malformed is set when the message ends early; the sections hold
+	// what was read
+	Malformed bool `json:"malformed,omitempty"`
+}
+
+// DNSQuestion is an entry of the question section
+type DNSQuestion struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	Class string `json:"class,omitempty"`
+}
+
+// DNSRecord is a resource record. Data is its presentation form, e.g. an
+// address, a target name or "10 mail.example.com." for MX.
+type DNSRecord struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	TTL  uint32 `json:"ttl"`
+	Data string `json:"data"`
+}
+
+// Record types, by number
+var dnsTypes = map[uint16]string{
+	1: "A", 2: "NS", 5: "CNAME", 6: "SOA", 12: "PTR", 15: "MX", 16: "TXT",
+	28: "AAAA", 33: "SRV", 35: "NAPTR", 41: "OPT", 43: "DS", 46: "RRSIG",
+	47: "NSEC", 48: "DNSKEY", 64: "SVCB", 65: "HTTPS", 255: "ANY", 257: "CAA",
+}
+
+var dnsRCodes = [...]string{
+	"NOERROR", "FORMERR", "SERVFAIL", "NXDOMAIN", "NOTIMP", "REFUSED",
+	"YXDOMAIN", "YXRRSET", "NXRRSET", "NOTAUTH", "NOTZONE",
+}
+
+var errDNSShort = errors.New("dns message too short")
+
+// maxDNSName bounds a name in wire format (RFC 1035), which keeps
+// compression pointers from expanding a small message into long names
+const maxDNSName = 255
+
+// maxDoHMessage is the largest DNS message DNS-over-HTTPS can carry;
+// bodies that are or decode to anything larger are not decoded
+const maxDoHMessage = 65535
+
+// DecodeDoH sets req.DNS when the request is a DNS-over-HTTPS lookup: a
+// POST with an application/dns-message body, or a GET carrying the query
+// in its dns parameter. The response is decoded when it is a DNS message.
+func DecodeDoH(req *CapturedRequest) {
+	reqHeader := http.Header(req.RequestHeaders)
+	respHeader := http.Header(req.ResponseHeaders)
+
+	var query []byte
+	switch {
+	case req.Method == http.MethodPost && isDNSMessage(reqHeader):
+		query = decodeDoHBody(reqHeader, req.RequestBody)
+	case req.Method == http.MethodGet:
+		u, err := url.Parse(req.URL)
+		if err != nil {
+			return
+		}
+		param := u.Query().Get("dns")
+		if param == "" {
+			return
+		}
+		// The dns parameter is only a lookup when one side says so
+		if !strings.Contains(reqHeader.Get("Accept"), dnsMessageType) && !isDNSMessage(respHeader) {
+			return
+		}
+		query, _ = base64.RawURLEncoding.DecodeString(strings.TrimRight(param, "="))
+	default:
+		return
+	}
+
+	exchange := &DNSExchange{}
+	if len(query) > 0 {
+		exchange.Query = ParseDNSMessage(query)
+	}
+	if isDNSMessage(respHeader) && req.OriginalSize == 0 {
+		if body := decodeDoHBody(respHeader, req.ResponseBody); len(body) > 0 {
+			exchange.Response = ParseDNSMessage(body)
+		}
+	}
+	if exchange.Query != nil || exchange.Response != nil {
+		req.DNS = exchange
+	}
+}
+
+// decodeDoHBody returns a DoH body with its Content-Encoding removed, or
+// nil when it cannot be decoded or is larger than a DNS message can be
+func decodeDoHBody(header http.Header, body []byte) []byte {
+	decoded, err := DecodeBody(header.Get("Content-Encoding"), body, maxDoHMessage)
+	if err != nil || len(decoded) > maxDoHMessage {
+		return nil
+	}
+	return decoded
+}
+
+func isDNSMessage(header http.Header) bool {
+	mediaType, _, _ := mime.ParseMediaType(header.Get("Content-Type"))
+	return mediaType == dnsMessageType
+}
+
+// ParseDNSMessage decodes a DNS message in wire format
+func ParseDNSMessage(msg []byte) *DNSMessage {
+	m := &DNSMessage{Questions: []DNSQuestion{}}
+	if len(msg) < 12 {
+		m.Malformed = true
+		return m
+	}
+	m.ID = binary.BigEndian.Uint16(msg)
+	flags := binary.BigEndian.Uint16(msg[2:])
+	m.Opcode = int(flags>>11) & 0xf
+	for _, f := range []struct {
+		bit  uint16
+		name string
+	}{{1 << 15, "qr"}, {1 << 10, "aa"}, {1 << 9, "tc"}, {1 << 8, "rd"}, {1 << 7, "ra"}, {1 << 5, "ad"}, {1 << 4, "cd"}} {
+		if flags&f.bit != 0 {
+			m.Flags = append(m.Flags, f.name)
+		}
+	}
+	if flags&(1<<15) != 0 {
+		m.RCode = dnsRCode(int(flags & 0xf))
+	}
+	counts := [4]int{}
+	for i := range counts {
+		counts[i] = int(binary.BigEndian.Uint16(msg[4+2*i:]))
+	}
+
+	off := 12
+	var err error
+	for i := 0; i < counts[0]; i++ {
+		var q DNSQuestion
+		if q.Name, off, err = readDNSName(msg, off); err != nil || off+4 > len(msg) {
+			m.Malformed = true
+			return m
+		}
+		q.Type = dnsType(binary.BigEndian.Uint16(msg[off:]))
+		if class := binary.BigEndian.Uint16(msg[off+2:]); class != 1 {
+			q.Class = strconv.Itoa(int(class))
+		}
+		off += 4
+		m.Questions = append(m.Questions, q)
+	}
+	for section, records := range []*[]DNSRecord{&m.Answers, &m.Authority, &m.Additional} {
+		for i := 0; i < counts[section+1]; i++ {
+			var rr DNSRecord
+			if rr, off, err = readDNSRecord(msg, off); err != nil {
+				m.Malformed = true
+				return m
+			}
+			*records = append(*records, rr)
+		}
+	}
+	return m
+}
+
+// readDNSRecord reads the resource record at off
+func readDNSRecord(msg []byte, off int) (DNSRecord, int, error) {
+	var rr DNSRecord
+	var err error
+	if rr.Name, off, err = readDNSName(msg, off); err != nil {
+		return rr, 0, err
+	}
+	if off+10 > len(msg) {
+		return rr, 0, errDNSShort
+	}
+	typ := binary.BigEndian.Uint16(msg[off:])
+	class := binary.BigEndian.Uint16(msg[off+2:])
+	rr.Type = dnsType(typ)
+	rr.TTL = binary.BigEndian.Uint32(msg[off+4:])
+	end := off + 10 + int(binary.BigEndian.Uint16(msg[off+8:]))
+	if end > len(msg) {
+		return rr, 0, errDNSShort
+	}
+	if typ == 41 {
+		// OPT carries the EDNS payload size in the class field
+		rr.TTL = 0
+		rr.Data = fmt.Sprintf("udp=%d", class)
+	} else {
+		rr.Data = dnsRData(msg, typ, off+10, end)
+	}
+	return rr, end, nil
+}
+
+// dnsRData formats the data of a record in msg[start:end]
+func dnsRData(msg []byte, typ uint16, start, end int) string {
+	data := msg[start:end]
+	name := func(off int) (string, int, bool) {
+		s, next, err := readDNSName(msg[:end], off)
+		return s, next, err == nil
+	}
+	switch typ {
+	case 1, 28: // A, AAAA
+		if len(data) == net.IPv4len || len(data) == net.IPv6len {
+			return net.IP(data).String()
+		}
+	case 2, 5, 12: // NS, CNAME, PTR
+		if s, _, ok := name(start); ok {
+			return s
+		}
+	case 15: // MX
+		if len(data) > 2 {
+			if s, _, ok := name(start + 2); ok {
+				return fmt.Sprintf("%d %s", binary.BigEndian.Uint16(data), s)
+			}
+		}
+	case 16: // TXT
+		var parts []string
+		for i := 0; i < len(data); {
+			n := int(data[i])
+			if i+1+n > len(data) {
+				break
+			}
+			parts = append(parts, strconv.Quote(string(data[i+1:i+1+n])))
+			i += 1 + n
+		}
+		return strings.Join(parts, " ")
+	case 33: // SRV
+		if len(data) > 6 {
+			if s, _, ok := name(start + 6); ok {
+				return fmt.Sprintf("%d %d %d %s", binary.BigEndian.Uint16(data), binary.BigEndian.Uint16(data[2:]), binary.BigEndian.Uint16(data[4:]), s)
+			}
+		}
+	case 6: // SOA
+		if mname, next, ok := name(start); ok {
+			if rname, next, ok := name(next); ok && next+20 <= end {
+				v := msg[next:]
+				return fmt.Sprintf("%s %s %d %d %d %d %d", mname, rname,
+					binary.BigEndian.Uint32(v), binary.BigEndian.Uint32(v[4:]), binary.BigEndian.Uint32(v[8:]),
+					binary.BigEndian.Uint32(v[12:]), binary.BigEndian.Uint32(v[16:]))
+			}
+		}
+	case 64, 65: // SVCB, HTTPS: priority and target; parameters stay hex
+		if len(data) > 2 {
+			if s, next, ok := name(start + 2); ok {
+				out := fmt.Sprintf("%d %s", binary.BigEndian.Uint16(data), s)
+				if next < end {
+					out += " " + hex.EncodeToString(msg[next:end])
+				}
+				return out
+			}
+		}
+	}
+	return hex.EncodeToString(data)
+}
+
+// readDNSName reads the possibly compressed name at off, returning it
+// with a trailing dot and the offset past it
+func readDNSName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	next, size := -1, 0
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errDNSShort
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, ".") + ".", next, nil
+		case l&0xC0 == 0xC0:
+			if off+1 >= len(msg) {
+				return "", 0, errDNSShort
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			// Pointers loop in hostile messages
+			if jumps++; jumps > 64 {
+				return "", 0, errors.New("dns name pointer loop")
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3FFF)
+		default:
+			if off+1+l > len(msg) {
+				return "", 0, errDNSShort
+			}
+			if size += 1 + l; size >= maxDNSName {
+				return "", 0, errors.New("dns name too long")
+			}
+			labels = append(labels, string(msg[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+}
+
+func dnsType(typ uint16) string {
+	if name, ok := dnsTypes[typ]; ok {
+		return name
+	}
+	return "TYPE" + strconv.Itoa(int(typ))
+}
+
+func dnsRCode(code int) string {
+	if code < len(dnsRCodes) {
+		return dnsRCodes[code]
+	}
+	return "RCODE" + strconv.Itoa(code)
+}
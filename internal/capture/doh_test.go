@@ -0,0 +1,185 @@
+package capture
+
+import (
+	"encoding/base64"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Wire-format pieces of the test messages
+const (
+	dnsQueryHeader  = "\xab\xcd\x01\x00\x00\x01\x00\x00\x00\x00\x00\x00"
+	dnsExampleName  = "\x07example\x03com\x00"
+	dnsQuestionA    = dnsExampleName + "\x00\x01\x00\x01"
+	dnsNamePointer  = "\xc0\x0c"
+	dnsAnswerHeader = "\xab\xcd\x81\x80\x00\x01\x00\x01\x00\x00\x00\x00"
+)
+
+func TestParseDNSMessage(t *testing.T) {
+	tests := []struct {
+		name string
+		msg  string
+		want *DNSMessage
+	}{
+		{
+			name: "query",
+			msg:  dnsQueryHeader + dnsQuestionA,
+			want: &DNSMessage{ID: 0xabcd, Flags: []string{"rd"}, Questions: []DNSQuestion{{Name: "example.com.", Type: "A"}}},
+		},
+		{
+			name: "answer with compressed name",
+			msg:  dnsAnswerHeader + dnsQuestionA + dnsNamePointer + "\x00\x01\x00\x01\x00\x00\x0e\x10\x00\x04\x5d\xb8\xd8\x22",
+			want: &DNSMessage{
+				ID: 0xabcd, RCode: "NOERROR", Flags: []string{"qr", "rd", "ra"},
+				Questions: []DNSQuestion{{Name: "example.com.", Type: "A"}},
+				Answers:   []DNSRecord{{Name: "example.com.", Type: "A", TTL: 3600, Data: "93.184.216.34"}},
+			},
+		},
+		{
+			name: "nxdomain",
+			msg:  "\x00\x01\x81\x83\x00\x01\x00\x00\x00\x00\x00\x00" + dnsExampleName + "\x00\x1c\x00\x03",
+			want: &DNSMessage{ID: 1, RCode: "NXDOMAIN", Flags: []string{"qr", "rd", "ra"}, Questions: []DNSQuestion{{Name: "example.com.", Type: "AAAA", Class: "3"}}},
+		},
+		{
+			name: "mx, txt and opt",
+			msg: "\x00\x02\x80\x00\x00\x00\x00\x02\x00\x00\x00\x01" +
+				dnsExampleName + "\x00\x0f\x00\x01\x00\x00\x00\x3c\x00\x09\x00\x0a\x04mail\xc0\x0c" +
+				"\x00\x00\x10\x00\x01\x00\x00\x00\x3c\x00\x06\x02hi\x02yo" +
+				"\x00\x00\x29\x04\xd0\x00\x00\x00\x00\x00\x00",
+			want: &DNSMessage{
+				ID: 2, RCode: "NOERROR", Flags: []string{"qr"}, Questions: []DNSQuestion{},
+				Answers: []DNSRecord{
+					{Name: "example.com.", Type: "MX", TTL: 60, Data: "10 mail.example.com."},
+					{Name: ".", Type: "TXT", TTL: 60, Data: `"hi" "yo"`},
+				},
+				Additional: []DNSRecord{{Name: ".", Type: "OPT", Data: "udp=1232"}},
+			},
+		},
+		{
+			name: "short header",
+			msg:  "\x00\x01",
+			want: &DNSMessage{Questions: []DNSQuestion{}, Malformed: true},
+		},
+		{
+			name: "truncated question",
+			msg:  dnsQueryHeader + "\x07exam",
+			want: &DNSMessage{ID: 0xabcd, Flags: []string{"rd"}, Questions: []DNSQuestion{}, Malformed: true},
+		},
+		{
+			name: "pointer loop",
+			msg:  dnsQueryHeader + dnsNamePointer + "\x00\x01\x00\x01",
+			want: &DNSMessage{ID: 0xabcd, Flags: []string{"rd"}, Questions: []DNSQuestion{}, Malformed: true},
+		},
+		{
+			name: "record past the end",
+			msg:  dnsAnswerHeader + dnsQuestionA + dnsNamePointer + "\x00\x01\x00\x01\x00\x00\x0e\x10\x00\x10\x01",
+			want: &DNSMessage{
+				ID: 0xabcd, RCode: "NOERROR", Flags: []string{"qr", "rd", "ra"},
+				Questions: []DNSQuestion{{Name: "example.com.", Type: "A"}}, Malformed: true,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ParseDNSMessage([]byte(tt.msg)); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseDNSMessageBoundsNames(t *testing.T) {
+	// Compression pointers could otherwise repeat these labels into names
+	// far longer than the message
+	label := "\x3f" + strings.Repeat("a", 63)
+	msg := dnsQueryHeader + strings.Repeat(label, 4) + "\x00\x00\x01\x00\x01"
+	if got := ParseDNSMessage([]byte(msg)); !got.Malformed {
+		t.Fatalf("name longer than 255 bytes parsed: %+v", got.Questions)
+	}
+	msg = dnsQueryHeader + strings.Repeat(label, 3) + "\x3d" + strings.Repeat("a", 61) + "\x00\x00\x01\x00\x01"
+	if got := ParseDNSMessage([]byte(msg)); got.Malformed {
+		t.Fatal("255-byte name rejected")
+	}
+}
+
+func TestDecodeDoH(t *testing.T) {
+	query := dnsQueryHeader + dnsQuestionA
+	post := &CapturedRequest{
+		Method:          "POST",
+		URL:             "https://dns.example/dns-query",
+		RequestHeaders:  map[string][]string{"Content-Type": {"application/dns-message"}},
+		RequestBody:     []byte(query),
+		ResponseHeaders: map[string][]string{"Content-Type": {"application/dns-message"}},
+		ResponseBody:    []byte("\xab\xcd\x81\x80\x00\x00\x00\x00\x00\x00\x00\x00"),
+	}
+	DecodeDoH(post)
+	if post.DNS == nil || post.DNS.Query.Questions[0].Name != "example.com." || post.DNS.Response.RCode != "NOERROR" {
+		t.Fatalf("POST lookup decoded as %+v", post.DNS)
+	}
+
+	get := &CapturedRequest{
+		Method:         "GET",
+		URL:            "https://dns.example/dns-query?dns=" + base64.RawURLEncoding.EncodeToString([]byte(query)),
+		RequestHeaders: map[string][]string{"Accept": {"application/dns-message"}},
+	}
+	DecodeDoH(get)
+	if get.DNS == nil || get.DNS.Query.Questions[0].Type != "A" {
+		t.Fatalf("GET lookup decoded as %+v", get.DNS)
+	}
+
+	other := &CapturedRequest{Method: "GET", URL: "https://example.com/?dns=AAAA"}
+	if DecodeDoH(other); other.DNS != nil {
+		t.Fatalf("plain request decoded as %+v", other.DNS)
+	}
+}
+
+func TestDecodeDoHSkipsOversizedBodies(t *testing.T) {
+	query := dnsQueryHeader + dnsQuestionA
+	padded := []byte(query + strings.Repeat("\x00", maxDoHMessage))
+	for name, req := range map[string]*CapturedRequest{
+		"identity": {RequestBody: padded},
+		"gzip": {
+			RequestHeaders: map[string][]string{"Content-Encoding": {"gzip"}},
+			RequestBody:    gzipped(t, padded),
+		},
+	} {
+		req.Method = "POST"
+		req.URL = "https://dns.example/dns-query"
+		if req.RequestHeaders == nil {
+			req.RequestHeaders = map[string][]string{}
+		}
+		req.RequestHeaders["Content-Type"] = []string{"application/dns-message"}
+		if DecodeDoH(req); req.DNS != nil {
+			t.Errorf("%s: oversized body decoded as %+v", name, req.DNS)
+		}
+	}
+
+	compressed := &CapturedRequest{
+		Method: "POST",
+		URL:    "https://dns.example/dns-query",
+		RequestHeaders: map[string][]string{
+			"Content-Type":     {"application/dns-message"},
+			"Content-Encoding": {"gzip"},
+		},
+		RequestBody: gzipped(t, []byte(query)),
+	}
+	if DecodeDoH(compressed); compressed.DNS == nil || compressed.DNS.Query.Questions[0].Name != "example.com." {
+		t.Fatalf("compressed lookup decoded as %+v", compressed.DNS)
+	}
+}
+
+func FuzzParseDNSMessage(f *testing.F) {
+	f.Add([]byte(dnsQueryHeader + dnsQuestionA))
+	f.Add([]byte(dnsAnswerHeader + dnsQuestionA + dnsNamePointer + "\x00\x01\x00\x01\x00\x00\x0e\x10\x00\x04\x5d\xb8\xd8\x22"))
+	f.Add([]byte("\x00\x00\x80\x00\x00\x00\x00\x01\x00\x00\x00\x00\xc0\x0c\x00\x06\x00\x01\x00\x00\x00\x00\x00\x18\xc0\x0c\xc0\x0c\x00\x00\x00\x01\x00\x00\x00\x02\x00\x00\x00\x03\x00\x00\x00\x04\x00\x00\x00\x05"))
+	f.Add([]byte("\x00\x00\x80\x00\x00\x00\x00\x01\x00\x00\x00\x00\x00\x00\x41\x00\x01\x00\x00\x00\x00\x00\x06\x00\x01\x00\xff\x00\x01"))
+	f.Fuzz(func(t *testing.T, msg []byte) {
+		m := ParseDNSMessage(msg)
+		for _, q := range m.Questions {
+			if len(q.Name) > maxDNSName {
+				t.Fatalf("question name of %d bytes", len(q.Name))
+			}
+		}
+	})
+}
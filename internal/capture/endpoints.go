@@ -0,0 +1,154 @@
+package capture
+
+import (
+	"sort"
+	"time"
+
+	"github.com/adamdrake/go_proxy/internal/hostmatch"
+)
+
+// samples is how many capture IDs an endpoint keeps per report
+const samples = 3
+
+// EndpointStats aggregates the requests to one method, host and path
+// template
+type EndpointStats struct {
+	Method   string `json:"method"`
+	Host     string `json:"host"`
+	Template string `json:"template"`
+
+	Count int `json:"count"`
+
+	AvgMS int64 `json:"avg_ms"`
+	P95MS int64 `json:"p95_ms"`
+	MaxMS int64 `json:"max_ms"`
+
+	// Failed requests (4xx, 5xx or no response) and their statuses, 0
+	// standing for a forwarding error
+	Errors   int         `json:"errors"`
+	Statuses map[int]int `json:"statuses"`
+
+	TotalBytes int64 `json:"total_bytes"`
+	MaxBytes   int64 `json:"max_bytes"`
+
+	// Sample captures: the slowest, the latest failures and the largest
+	SlowestIDs []string `json:"slowest_ids"`
+	ErrorIDs   []string `json:"error_ids,omitempty"`
+	LargestIDs []string `json:"largest_ids"`
+
+	durations []time.Duration
+	requests  []*CapturedRequest
+	failed    []*CapturedRequest
+}
+
+// endpointHost is the canonical host of a capture, so imported captures
+// and ones written differently by clients share endpoints
+func endpointHost(req *CapturedRequest) string {
+	scheme := "http"
+	if req.IsHTTPS {
+		scheme = "https"
+	}
+	return hostmatch.Canonical(req.Host, scheme)
+}
+
+// Endpoints aggregates requests per endpoint, naming endpoints with
+// templates (automatic ID detection when nil)
+func Endpoints(requests []*CapturedRequest, templates *PathTemplates) []*EndpointStats {
+	byKey := make(map[string]*EndpointStats)
+	var result []*EndpointStats
+
+	for _, req := range requests {
+		tmpl := templates.Template(req.Path)
+		host := endpointHost(req)
+		key := req.Method + " " + host + tmpl
+		e := byKey[key]
+		if e == nil {
+			e = &EndpointStats{Method: req.Method, Host: host, Template: tmpl, Statuses: make(map[int]int)}
+			byKey[key] = e
+			result = append(result, e)
+		}
+
+		e.Count++
+		e.durations = append(e.durations, req.Duration)
+		e.requests = append(e.requests, req)
+		e.Statuses[req.StatusCode]++
+		if failed(req) {
+			e.Errors++
+			e.failed = append(e.failed, req)
+		}
+		size := responseSize(req)
+		e.TotalBytes += size
+		e.MaxBytes = max(e.MaxBytes, size)
+	}
+
+	for _, e := range result {
+		e.finish()
+	}
+	return result
+}
+
+// finish computes the latency figures and picks sample captures
+func (e *EndpointStats) finish() {
+	var total time.Duration
+	for _, d := range e.durations {
+		total += d
+	}
+	sorted := sortedDurations(e.durations)
+	e.AvgMS = (total / time.Duration(len(sorted))).Milliseconds()
+	e.P95MS = percentile(sorted, 95).Milliseconds()
+	e.MaxMS = sorted[len(sorted)-1].Milliseconds()
+
+	sort.SliceStable(e.failed, func(i, j int) bool { return e.failed[i].Timestamp.After(e.failed[j].Timestamp) })
+	e.ErrorIDs = ids(e.failed[:min(samples, len(e.failed))])
+
+	byDuration := append([]*CapturedRequest(nil), e.requests...)
+	sort.SliceStable(byDuration, func(i, j int) bool { return byDuration[i].Duration > byDuration[j].Duration })
+	e.SlowestIDs = ids(byDuration[:min(samples, len(byDuration))])
+
+	bySize := append([]*CapturedRequest(nil), e.requests...)
+	sort.SliceStable(bySize, func(i, j int) bool { return responseSize(bySize[i]) > responseSize(bySize[j]) })
+	e.LargestIDs = ids(bySize[:min(samples, len(bySize))])
+
+	e.durations, e.requests, e.failed = nil, nil, nil
+}
+
+// sortedDurations returns a sorted copy of durations
+func sortedDurations(durations []time.Duration) []time.Duration {
+	sorted := append([]time.Duration(nil), durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted
+}
+
+// percentile returns the nearest-rank pth percentile of sorted, or 0 when
+// it is empty
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	return sorted[(len(sorted)*p+99)/100-1]
+}
+
+// failed reports whether req got an error status or no response
+func failed(req *CapturedRequest) bool {
+	return req.Error != "" || req.StatusCode == 0 || req.StatusCode >= 400
+}
+
+// responseSize is the size of a response body as received, including
+// any part that was not kept
+func responseSize(req *CapturedRequest) int64 {
+	if req.OriginalSize > 0 {
+		return req.OriginalSize
+	}
+	if req.BytesReceived > 0 {
+		return req.BytesReceived
+	}
+	return int64(len(req.ResponseBody))
+}
+
+func ids(requests []*CapturedRequest) []string {
+	result := make([]string, len(requests))
+	for i, req := range requests {
+		result[i] = req.ID
+	}
+	return result
+}
@@ -0,0 +1,122 @@
+package capture
+
+import (
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// Finding is a passive security observation about an exchange
+type Finding struct {
+	// Type is one of the Finding* constants
+	Type string `json:"type"`
+	// Severity is "high", "medium" or "low"
+	Severity string `json:"severity"`
+	Detail   string `json:"detail,omitempty"`
+}
+
+// Finding types
+const (
+	FindingMissingHSTS         = "missing_hsts"
+	FindingMissingCSP          = "missing_csp"
+	FindingInsecureCookie      = "insecure_cookie"
+	FindingBasicAuthOverHTTP   = "basic_auth_cleartext"
+	FindingDigestAuthCleartext = "digest_auth_cleartext"
+	FindingCredentialInURL     = "credential_in_url"
+	FindingMixedContent        = "mixed_content"
+	FindingCertExpired         = "cert_expired"
+	FindingCertExpiring        = "cert_expiring"
+	FindingCertMismatch        = "cert_name_mismatch"
+)
+
+// maxMixedContentFindings caps the mixed-content references reported per
+// page
+const maxMixedContentFindings = 10
+
+// mixedContentRef matches http:// URLs loaded as subresources: src
+// attributes, <link href> and CSS url()
+var mixedContentRef = regexp.MustCompile(`(?i)(?:\bsrc\s*=\s*["']?|<link\b[^>]*?\bhref\s*=\s*["']?|url\(\s*["']?)(http://[^"'\s>)]+)`)
+
+// AnalyzeSecurity returns basic security findings for a completed capture:
+// HTTPS responses without HSTS, HTML without a CSP, cookies set without
+// Secure or HttpOnly, Basic or Digest credentials sent over plain HTTP,
+// tokens in the query string, and HTTPS pages loading http://
+// subresources. Credentials are those DetectCredentials recorded. Tunnels
+// are opaque and yield none.
+func AnalyzeSecurity(req *CapturedRequest) []Finding {
+	if req.IsTunnel || req.StatusCode == 0 {
+		return nil
+	}
+	var findings []Finding
+	https := strings.HasPrefix(req.URL, "https://")
+	respHeader := http.Header(req.ResponseHeaders)
+
+	for _, c := range req.Credentials {
+		switch {
+		case c.Kind == CredentialBasic && c.Cleartext:
+			findings = append(findings, Finding{Type: FindingBasicAuthOverHTTP, Severity: "high", Detail: "Authorization: Basic sent in cleartext"})
+		case c.Kind == CredentialDigest && c.Cleartext:
+			// The digest is replayable within the nonce and open to
+			// offline guessing
+			findings = append(findings, Finding{Type: FindingDigestAuthCleartext, Severity: "medium", Detail: "Authorization: Digest sent in cleartext"})
+		case c.Kind == CredentialQueryToken:
+			// URLs end up in logs, history and Referer headers
+			severity := "medium"
+			if c.Cleartext {
+				severity = "high"
+			}
+			findings = append(findings, Finding{Type: FindingCredentialInURL, Severity: severity, Detail: "query parameter " + c.Name})
+		}
+	}
+
+	if https && respHeader.Get("Strict-Transport-Security") == "" {
+		findings = append(findings, Finding{Type: FindingMissingHSTS, Severity: "low"})
+	}
+
+	html := false
+	if mediaType, _, err := mime.ParseMediaType(respHeader.Get("Content-Type")); err == nil {
+		html = mediaType == "text/html"
+	}
+	if html && respHeader.Get("Content-Security-Policy") == "" {
+		findings = append(findings, Finding{Type: FindingMissingCSP, Severity: "low"})
+	}
+
+	for _, line := range respHeader.Values("Set-Cookie") {
+		cookie, err := http.ParseSetCookie(line)
+		if err != nil {
+			continue
+		}
+		var missing []string
+		if !cookie.Secure {
+			missing = append(missing, "Secure")
+		}
+		if !cookie.HttpOnly {
+			missing = append(missing, "HttpOnly")
+		}
+		if len(missing) > 0 {
+			severity := "low"
+			if !cookie.Secure && https {
+				severity = "medium"
+			}
+			findings = append(findings, Finding{Type: FindingInsecureCookie, Severity: severity, Detail: cookie.Name + " without " + strings.Join(missing, ", ")})
+		}
+	}
+
+	if https && html {
+		if text, ok := textBody(req.ResponseBody); ok {
+			seen := make(map[string]bool)
+			for _, m := range mixedContentRef.FindAllStringSubmatch(text, -1) {
+				if seen[m[1]] {
+					continue
+				}
+				seen[m[1]] = true
+				findings = append(findings, Finding{Type: FindingMixedContent, Severity: "medium", Detail: m[1]})
+				if len(seen) == maxMixedContentFindings {
+					break
+				}
+			}
+		}
+	}
+	return findings
+}
@@ -0,0 +1,328 @@
+package capture
+
+import (
+	"mime"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/adamdrake/go_proxy/internal/hostmatch"
+)
+
+// Header check grades
+const (
+	GradePass    = "pass"
+	GradeWeak    = "weak"
+	GradeMissing = "missing"
+	// GradeNotApplicable is for headers no response called for, such as
+	// HSTS on a plain HTTP host
+	GradeNotApplicable = "n/a"
+)
+
+// maxGradeValues caps the distinct values a header check reports
+const maxGradeValues = 5
+
+// hstsMinMaxAge is the shortest HSTS max-age that passes: 180 days
+const hstsMinMaxAge = 180 * 24 * 60 * 60
+
+// HeaderCheck is how one security header fared across a host's responses
+type HeaderCheck struct {
+	Header string `json:"header"`
+	// Grade is pass when every applicable response sends a sound value,
+	// missing when none sends the header, n/a when none calls for it,
+	// and weak otherwise
+	Grade string `json:"grade"`
+
+	// Applicable responses, and how many passed, sent a weak value or
+	// lacked the header
+	Checked int `json:"checked"`
+	Passed  int `json:"passed"`
+	Weak    int `json:"weak"`
+	Missing int `json:"missing"`
+
+	// Values are distinct values seen; Issues what is wrong with them
+	Values []string `json:"values,omitempty"`
+	Issues []string `json:"issues,omitempty"`
+	// Advice says how to fix a check that did not pass
+	Advice string `json:"advice,omitempty"`
+	// FailingIDs are sample captures that did not pass
+	FailingIDs []string `json:"failing_ids,omitempty"`
+}
+
+// HostHeaderGrades grades the security headers a host sends
+type HostHeaderGrades struct {
+	Host      string `json:"host"`
+	Responses int    `json:"responses"`
+	// Score is 0 to 100, each applicable header counting equally and weak
+	// ones half; Grade is its letter, A (90+) to F (under 40)
+	Score   int           `json:"score"`
+	Grade   string        `json:"grade"`
+	Headers []HeaderCheck `json:"headers"`
+}
+
+// headerRule grades one security header on the responses it applies to
+type headerRule struct {
+	header  string
+	advice  string
+	applies func(req *CapturedRequest, html bool) bool
+	// check returns "" for a sound value, or what is wrong with it
+	check func(values []string) string
+}
+
+// headerRules are the graded headers: HSTS on HTTPS responses, CSP and
+// Referrer-Policy on HTML documents, X-Content-Type-Options on everything
+var headerRules = []headerRule{
+	{
+		header:  "Strict-Transport-Security",
+		advice:  "Send Strict-Transport-Security: max-age=31536000; includeSubDomains on every HTTPS response",
+		applies: func(req *CapturedRequest, _ bool) bool { return strings.HasPrefix(req.URL, "https://") },
+		check:   checkHSTS,
+	},
+	{
+		header:  "Content-Security-Policy",
+		advice:  "Send a Content-Security-Policy with a script-src or default-src that avoids 'unsafe-inline', 'unsafe-eval' and wildcard sources",
+		applies: func(_ *CapturedRequest, html bool) bool { return html },
+		check:   checkCSP,
+	},
+	{
+		header:  "X-Content-Type-Options",
+		advice:  "Send X-Content-Type-Options: nosniff on every response",
+		applies: func(*CapturedRequest, bool) bool { return true },
+		check: func(values []string) string {
+			if !strings.EqualFold(strings.TrimSpace(values[0]), "nosniff") {
+				return "value is not nosniff"
+			}
+			return ""
+		},
+	},
+	{
+		header:  "Referrer-Policy",
+		advice:  "Send Referrer-Policy: strict-origin-when-cross-origin (or stricter) on HTML documents",
+		applies: func(_ *CapturedRequest, html bool) bool { return html },
+		check:   checkReferrerPolicy,
+	},
+}
+
+// GradeHeaders grades the security headers of each host's responses,
+// worst host first. Tunnels, failed exchanges and 304 responses, which
+// may leave headers out, are skipped.
+func GradeHeaders(requests []*CapturedRequest) []*HostHeaderGrades {
+	byHost := make(map[string]*HostHeaderGrades)
+	var result []*HostHeaderGrades
+
+	for _, req := range requests {
+		if req.IsTunnel || req.StatusCode < 200 || req.StatusCode == http.StatusNotModified {
+			continue
+		}
+		host := hostmatch.Normalize(req.Host)
+		g := byHost[host]
+		if g == nil {
+			g = &HostHeaderGrades{Host: host, Headers: make([]HeaderCheck, len(headerRules))}
+			for i, rule := range headerRules {
+				g.Headers[i].Header = rule.header
+			}
+			byHost[host] = g
+			result = append(result, g)
+		}
+		g.Responses++
+
+		header := http.Header(req.ResponseHeaders)
+		html := false
+		if mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type")); err == nil {
+			html = mediaType == "text/html"
+		}
+		for i, rule := range headerRules {
+			if !rule.applies(req, html) {
+				continue
+			}
+			g.Headers[i].add(req, header.Values(rule.header), rule.check)
+		}
+	}
+
+	for _, g := range result {
+		g.finish()
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		if result[i].Score != result[j].Score {
+			return result[i].Score < result[j].Score
+		}
+		return result[i].Host < result[j].Host
+	})
+	return result
+}
+
+// add grades one response's values of the header
+func (c *HeaderCheck) add(req *CapturedRequest, values []string, check func([]string) string) {
+	c.Checked++
+	if len(values) == 0 {
+		c.Missing++
+		c.fail(req)
+		return
+	}
+	value := strings.Join(values, ", ")
+	if len(c.Values) < maxGradeValues && !slices.Contains(c.Values, value) {
+		c.Values = append(c.Values, value)
+	}
+	if issue := check(values); issue != "" {
+		c.Weak++
+		if !slices.Contains(c.Issues, issue) {
+			c.Issues = append(c.Issues, issue)
+		}
+		c.fail(req)
+		return
+	}
+	c.Passed++
+}
+
+// fail keeps a sample of the captures that did not pass
+func (c *HeaderCheck) fail(req *CapturedRequest) {
+	if len(c.FailingIDs) < samples {
+		c.FailingIDs = append(c.FailingIDs, req.ID)
+	}
+}
+
+// finish sets the header grades, the score and the letter grade
+func (g *HostHeaderGrades) finish() {
+	points, applicable := 0, 0
+	for i := range g.Headers {
+		c := &g.Headers[i]
+		switch {
+		case c.Checked == 0:
+			c.Grade = GradeNotApplicable
+			continue
+		case c.Passed == c.Checked:
+			c.Grade = GradePass
+			points += 2
+		case c.Missing == c.Checked:
+			c.Grade = GradeMissing
+		default:
+			c.Grade = GradeWeak
+			points++
+			if c.Missing > 0 {
+				c.Issues = append(c.Issues, "missing on "+strconv.Itoa(c.Missing)+" of "+strconv.Itoa(c.Checked)+" responses")
+			}
+		}
+		if c.Grade != GradePass {
+			c.Advice = headerRules[i].advice
+		}
+		applicable++
+	}
+
+	g.Score = 100
+	if applicable > 0 {
+		g.Score = points * 100 / (2 * applicable)
+	}
+	switch {
+	case g.Score >= 90:
+		g.Grade = "A"
+	case g.Score >= 75:
+		g.Grade = "B"
+	case g.Score >= 60:
+		g.Grade = "C"
+	case g.Score >= 40:
+		g.Grade = "D"
+	default:
+		g.Grade = "F"
+	}
+}
+
+// checkHSTS requires a max-age of at least 180 days
+func checkHSTS(values []string) string {
+	for _, directive := range strings.Split(values[0], ";") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		if !strings.EqualFold(strings.TrimSpace(name), "max-age") {
+			continue
+		}
+		maxAge, err := strconv.ParseInt(strings.Trim(strings.TrimSpace(value), `"`), 10, 64)
+		switch {
+		case err != nil:
+			return "invalid max-age"
+		case maxAge == 0:
+			return "max-age=0 turns HSTS off"
+		case maxAge < hstsMinMaxAge:
+			return "max-age under 180 days"
+		}
+		return ""
+	}
+	return "no max-age"
+}
+
+// checkCSP flags policies that leave script injection open: no script-src
+// or default-src, or one allowing inline scripts without a nonce or hash,
+// eval, or any host
+func checkCSP(values []string) string {
+	// Every policy applies, so one sound policy is enough
+	var issue string
+	for _, policy := range values {
+		directives := make(map[string][]string)
+		for _, directive := range strings.Split(policy, ";") {
+			fields := strings.Fields(strings.ToLower(directive))
+			if len(fields) > 0 {
+				if _, ok := directives[fields[0]]; !ok {
+					directives[fields[0]] = fields[1:]
+				}
+			}
+		}
+		sources, ok := directives["script-src"]
+		if !ok {
+			sources, ok = directives["default-src"]
+		}
+		if issue = cspScriptIssue(sources, ok); issue == "" {
+			return ""
+		}
+	}
+	return issue
+}
+
+// cspScriptIssue checks the sources scripts may load from
+func cspScriptIssue(sources []string, ok bool) string {
+	if !ok {
+		return "no script-src or default-src"
+	}
+	nonce := slices.ContainsFunc(sources, func(s string) bool {
+		return strings.HasPrefix(s, "'nonce-") || strings.HasPrefix(s, "'sha256-") || strings.HasPrefix(s, "'sha384-") || strings.HasPrefix(s, "'sha512-")
+	})
+	for _, s := range sources {
+		switch {
+		case s == "'unsafe-inline'" && !nonce:
+			return "scripts allow 'unsafe-inline'"
+		case s == "'unsafe-eval'":
+			return "scripts allow 'unsafe-eval'"
+		case s == "*" || s == "http:" || s == "https:" || s == "data:":
+			return "scripts allow " + s + " sources"
+		}
+	}
+	return ""
+}
+
+// strictReferrerPolicies are the policies that keep paths and queries
+// from other origins
+var strictReferrerPolicies = map[string]bool{
+	"no-referrer":                     true,
+	"same-origin":                     true,
+	"strict-origin":                   true,
+	"strict-origin-when-cross-origin": true,
+}
+
+// checkReferrerPolicy requires a policy that does not send full URLs
+// cross-origin. Browsers use the last policy they recognize.
+func checkReferrerPolicy(values []string) string {
+	var policy string
+	for _, value := range values {
+		for _, token := range strings.Split(value, ",") {
+			token = strings.ToLower(strings.TrimSpace(token))
+			if strictReferrerPolicies[token] || slices.Contains([]string{"no-referrer-when-downgrade", "origin", "origin-when-cross-origin", "unsafe-url"}, token) {
+				policy = token
+			}
+		}
+	}
+	switch {
+	case policy == "":
+		return "no recognized policy"
+	case !strictReferrerPolicies[policy]:
+		return policy + " leaks referrers cross-origin"
+	}
+	return ""
+}
@@ -0,0 +1,169 @@
+package capture
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DefaultHintWindow is how long after a page's request a fetch of one of
+// its hinted resources counts as using the hint
+const DefaultHintWindow = 30 * time.Second
+
+// ResourceHint is a resource a response told the client to fetch early,
+// with a Link header in the response or in a 103 Early Hints response
+type ResourceHint struct {
+	// URL is resolved against the request URL
+	URL string `json:"url"`
+	// Rel is preload, modulepreload or prefetch
+	Rel string `json:"rel"`
+	// As is the destination the hint declares, e.g. script or style
+	As        string `json:"as,omitempty"`
+	EarlyHint bool   `json:"early_hint,omitempty"`
+}
+
+// hintRels are the link relations that fetch a resource
+var hintRels = map[string]bool{"preload": true, "modulepreload": true, "prefetch": true}
+
+// ParseLinkHints returns the resource hints in Link header values, with
+// URLs resolved against base
+func ParseLinkHints(links []string, base string, early bool) []ResourceHint {
+	baseURL, _ := url.Parse(base)
+	var hints []ResourceHint
+	for _, value := range links {
+		for _, link := range splitLinks(value) {
+			target, params, ok := parseLink(link)
+			if !ok {
+				continue
+			}
+			if baseURL != nil {
+				if u, err := baseURL.Parse(target); err == nil {
+					target = u.String()
+				}
+			}
+			for _, rel := range strings.Fields(strings.ToLower(params["rel"])) {
+				if hintRels[rel] {
+					hints = append(hints, ResourceHint{URL: target, Rel: rel, As: params["as"], EarlyHint: early})
+					break
+				}
+			}
+		}
+	}
+	return hints
+}
+
+// RecordHints adds the hints in a capture's final response headers to
+// those from early hints
+func RecordHints(req *CapturedRequest) {
+	links := http.Header(req.ResponseHeaders).Values("Link")
+	req.Hints = append(req.Hints, ParseLinkHints(links, req.URL, false)...)
+}
+
+// splitLinks splits a Link header value at the commas between links,
+// leaving commas inside <...> and quoted strings alone
+func splitLinks(value string) []string {
+	var links []string
+	start, inURL, inQuote := 0, false, false
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; {
+		case inQuote:
+			if c == '\\' {
+				i++
+			} else if c == '"' {
+				inQuote = false
+			}
+		case c == '"':
+			inQuote = true
+		case c == '<':
+			inURL = true
+		case c == '>':
+			inURL = false
+		case c == ',' && !inURL:
+			links = append(links, value[start:i])
+			start = i + 1
+		}
+	}
+	return append(links, value[start:])
+}
+
+// parseLink splits one link into its target and lowercased parameters
+func parseLink(link string) (string, map[string]string, bool) {
+	link = strings.TrimSpace(link)
+	if !strings.HasPrefix(link, "<") {
+		return "", nil, false
+	}
+	end := strings.IndexByte(link, '>')
+	if end < 0 {
+		return "", nil, false
+	}
+	params := make(map[string]string)
+	for _, param := range strings.Split(link[end+1:], ";") {
+		name, value, _ := strings.Cut(param, "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if _, seen := params[name]; !seen {
+			params[name] = strings.Trim(strings.TrimSpace(value), `"`)
+		}
+	}
+	return strings.TrimSpace(link[1:end]), params, true
+}
+
+// HintedPage is a capture whose response hinted resources, with the
+// requests that fetched them
+type HintedPage struct {
+	RequestID string    `json:"request_id"`
+	URL       string    `json:"url"`
+	Timestamp time.Time `json:"timestamp"`
+	Hints     []HintUse `json:"hints"`
+	// Hints fetched by the client within the window, and the rest
+	Used   int `json:"used"`
+	Unused int `json:"unused"`
+}
+
+// HintUse is a hint and the captures that fetched its resource
+type HintUse struct {
+	ResourceHint
+	UsedBy []string `json:"used_by,omitempty"`
+}
+
+// AuditHints matches the hints of pages against the captures in all: a
+// hint is used when the same client address requested its URL within
+// window of the page's request. Pages are returned in the order given.
+func AuditHints(pages, all []*CapturedRequest, window time.Duration) []HintedPage {
+	// Fetches by client IP and URL, oldest first
+	type fetchKey struct{ client, url string }
+	fetches := make(map[fetchKey][]*CapturedRequest)
+	for _, req := range all {
+		key := fetchKey{clientIP(req.ClientAddr), req.URL}
+		fetches[key] = append(fetches[key], req)
+	}
+
+	var result []HintedPage
+	for _, page := range pages {
+		if len(page.Hints) == 0 {
+			continue
+		}
+		hinted := HintedPage{RequestID: page.ID, URL: page.URL, Timestamp: page.Timestamp}
+		client := clientIP(page.ClientAddr)
+		for _, hint := range page.Hints {
+			use := HintUse{ResourceHint: hint}
+			for _, req := range fetches[fetchKey{client, hint.URL}] {
+				if req.ID == page.ID || req.Timestamp.Before(page.Timestamp) || req.Timestamp.Sub(page.Timestamp) > window {
+					continue
+				}
+				use.UsedBy = append(use.UsedBy, req.ID)
+			}
+			if len(use.UsedBy) > 0 {
+				hinted.Used++
+			} else {
+				hinted.Unused++
+			}
+			hinted.Hints = append(hinted.Hints, use)
+		}
+		result = append(result, hinted)
+	}
+	return result
+}
@@ -0,0 +1,167 @@
+package capture
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxIndexedBodyBytes limits how much of each body is indexed
+const maxIndexedBodyBytes = 256 * 1024
+
+// index is an inverted index from tokens to request IDs. It is not
+// thread-safe; the Store guards it with indexMu.
+type index struct {
+	postings map[string]map[string]struct{}
+	docs     map[string][]string
+}
+
+func newIndex() *index {
+	return &index{
+		postings: make(map[string]map[string]struct{}),
+		docs:     make(map[string][]string),
+	}
+}
+
+// indexTokens returns the distinct tokens of a request's URL, header values
+// and text bodies. It is pure so it can run outside the store's locks.
+func indexTokens(req *CapturedRequest) []string {
+	seen := make(map[string]struct{})
+	for _, text := range searchableText(req) {
+		for _, tok := range tokenize(text) {
+			seen[tok] = struct{}{}
+		}
+	}
+
+	tokens := make([]string, 0, len(seen))
+	for tok := range seen {
+		tokens = append(tokens, tok)
+	}
+	return tokens
+}
+
+// add records precomputed tokens for a request
+func (ix *index) add(id string, tokens []string) {
+	for _, tok := range tokens {
+		ids, ok := ix.postings[tok]
+		if !ok {
+			ids = make(map[string]struct{})
+			ix.postings[tok] = ids
+		}
+		ids[id] = struct{}{}
+	}
+	ix.docs[id] = tokens
+}
+
+// remove drops a request from the index
+func (ix *index) remove(id string) {
+	for _, tok := range ix.docs[id] {
+		ids := ix.postings[tok]
+		delete(ids, id)
+		if len(ids) == 0 {
+			delete(ix.postings, tok)
+		}
+	}
+	delete(ix.docs, id)
+}
+
+// lookup returns the IDs of requests containing every token in query
+func (ix *index) lookup(query string) map[string]struct{} {
+	terms := tokenize(query)
+	if len(terms) == 0 {
+		return nil
+	}
+
+	// Start from the rarest term to keep the intersection small
+	smallest := terms[0]
+	for _, term := range terms[1:] {
+		if len(ix.postings[term]) < len(ix.postings[smallest]) {
+			smallest = term
+		}
+	}
+
+	result := make(map[string]struct{})
+	for id := range ix.postings[smallest] {
+		matchesAll := true
+		for _, term := range terms {
+			if _, ok := ix.postings[term][id]; !ok {
+				matchesAll = false
+				break
+			}
+		}
+		if matchesAll {
+			result[id] = struct{}{}
+		}
+	}
+	return result
+}
+
+// searchableText returns the fields of a request that are indexed, keyed
+// by field name
+func searchableText(req *CapturedRequest) map[string]string {
+	fields := map[string]string{
+		"url": req.URL,
+	}
+	if req.HostUnicode != "" {
+		fields["host_unicode"] = req.HostUnicode
+	}
+
+	var headers strings.Builder
+	for _, values := range req.RequestHeaders {
+		for _, v := range values {
+			headers.WriteString(v)
+			headers.WriteByte('\n')
+		}
+	}
+	fields["request_headers"] = headers.String()
+
+	headers.Reset()
+	for _, values := range req.ResponseHeaders {
+		for _, v := range values {
+			headers.WriteString(v)
+			headers.WriteByte('\n')
+		}
+	}
+	fields["response_headers"] = headers.String()
+
+	if text, ok := textBody(req.RequestBody); ok {
+		fields["request_body"] = text
+	}
+	if text, ok := textBody(req.ResponseBody); ok {
+		fields["response_body"] = text
+	}
+	return fields
+}
+
+// textBody returns the indexable prefix of a body if it looks like text
+func textBody(body []byte) (string, bool) {
+	if len(body) == 0 {
+		return "", false
+	}
+	if len(body) > maxIndexedBodyBytes {
+		body = body[:maxIndexedBodyBytes]
+	}
+	// Allow a rune cut in half by the size limit
+	for i := 0; i < utf8.UTFMax && !utf8.Valid(body); i++ {
+		body = body[:len(body)-1]
+	}
+	if !utf8.Valid(body) {
+		return "", false
+	}
+	return string(body), true
+}
+
+// tokenize splits text into lowercase alphanumeric tokens
+func tokenize(text string) []string {
+	fields := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	tokens := fields[:0]
+	for _, f := range fields {
+		if len(f) >= 2 && len(f) <= 64 {
+			tokens = append(tokens, f)
+		}
+	}
+	return tokens
+}
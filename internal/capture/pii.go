@@ -0,0 +1,186 @@
+package capture
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// maxPIIFindings caps the findings recorded per capture
+const maxPIIFindings = 50
+
+// PIIFinding is a likely piece of personal data seen in a capture
+type PIIFinding struct {
+	// Type is "email", "credit_card", "us_ssn", "uk_nino" or "iban"
+	Type string `json:"type"`
+	// Location is url, request_headers, response_headers, request_body
+	// or response_body
+	Location string `json:"location"`
+	// Match is the value found, masked
+	Match string `json:"match"`
+}
+
+// piiDetector finds one kind of personal data; valid filters out pattern
+// matches that fail a checksum or are impossible values
+type piiDetector struct {
+	kind    string
+	pattern *regexp.Regexp
+	valid   func(string) bool
+	mask    func(string) string
+}
+
+var piiDetectors = []piiDetector{
+	{
+		kind:    "email",
+		pattern: regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9-]+(?:\.[A-Za-z0-9-]+)*\.[A-Za-z]{2,}`),
+		mask:    maskEmail,
+	},
+	{
+		kind:    "credit_card",
+		pattern: regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`),
+		valid:   validCardNumber,
+		mask:    maskTail,
+	},
+	{
+		kind:    "us_ssn",
+		pattern: regexp.MustCompile(`\b\d{3}-\d{2}-\d{4}\b`),
+		valid:   validSSN,
+		mask:    maskTail,
+	},
+	{
+		kind:    "uk_nino",
+		pattern: regexp.MustCompile(`\b[A-CEGHJ-PR-TW-Z][A-CEGHJ-NPR-TW-Z] ?\d{2} ?\d{2} ?\d{2} ?[A-D]\b`),
+		mask:    maskTail,
+	},
+	{
+		kind:    "iban",
+		pattern: regexp.MustCompile(`\b[A-Z]{2}\d{2}(?: ?[A-Z0-9]{4}){2,7}(?: ?[A-Z0-9]{1,3})?\b`),
+		valid:   validIBAN,
+		mask:    maskTail,
+	},
+}
+
+// ScanPII looks for likely personal data in a capture's URL, headers and
+// text bodies. Matches are deduplicated per location and masked.
+func ScanPII(req *CapturedRequest) []PIIFinding {
+	fields := searchableText(req)
+	if decoded, err := url.QueryUnescape(req.URL); err == nil {
+		fields["url"] = decoded
+	}
+
+	var findings []PIIFinding
+	seen := make(map[PIIFinding]struct{})
+	for _, location := range []string{"url", "request_headers", "request_body", "response_headers", "response_body"} {
+		text := fields[location]
+		if text == "" {
+			continue
+		}
+		for _, d := range piiDetectors {
+			for _, m := range d.pattern.FindAllString(text, -1) {
+				if d.valid != nil && !d.valid(m) {
+					continue
+				}
+				f := PIIFinding{Type: d.kind, Location: location, Match: d.mask(m)}
+				if _, ok := seen[f]; ok {
+					continue
+				}
+				seen[f] = struct{}{}
+				findings = append(findings, f)
+				if len(findings) == maxPIIFindings {
+					return findings
+				}
+			}
+		}
+	}
+	return findings
+}
+
+// digitsOnly strips separators from a number
+func digitsOnly(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, s)
+}
+
+// validCardNumber accepts 13-19 digit numbers with a major network prefix
+// and a valid Luhn check digit. The prefix check keeps millisecond
+// timestamps and other long IDs out.
+func validCardNumber(s string) bool {
+	d := digitsOnly(s)
+	if len(d) < 13 || len(d) > 19 {
+		return false
+	}
+	switch {
+	case d[0] == '4', // Visa
+		d[:2] >= "51" && d[:2] <= "55", d[:4] >= "2221" && d[:4] <= "2720", // Mastercard
+		d[:2] == "34", d[:2] == "37", // American Express
+		d[:4] == "6011", d[:2] == "65": // Discover
+	default:
+		return false
+	}
+
+	sum := 0
+	for i := 0; i < len(d); i++ {
+		n := int(d[len(d)-1-i] - '0')
+		if i%2 == 1 {
+			if n *= 2; n > 9 {
+				n -= 9
+			}
+		}
+		sum += n
+	}
+	return sum%10 == 0
+}
+
+// validSSN rejects area, group and serial numbers never issued
+func validSSN(s string) bool {
+	area, group, serial := s[0:3], s[4:6], s[7:11]
+	return area != "000" && area != "666" && area[0] != '9' && group != "00" && serial != "0000"
+}
+
+// validIBAN checks the ISO 13616 mod-97 checksum
+func validIBAN(s string) bool {
+	s = strings.ReplaceAll(s, " ", "")
+	if len(s) < 15 || len(s) > 34 {
+		return false
+	}
+	rearranged := s[4:] + s[:4]
+	rem := 0
+	for _, r := range rearranged {
+		switch {
+		case r >= '0' && r <= '9':
+			rem = (rem*10 + int(r-'0')) % 97
+		case r >= 'A' && r <= 'Z':
+			rem = (rem*100 + int(r-'A') + 10) % 97
+		default:
+			return false
+		}
+	}
+	return rem == 1
+}
+
+// maskTail hides all but the last four characters, keeping separators
+func maskTail(s string) string {
+	keep := 4
+	b := []byte(s)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] == ' ' || b[i] == '-' {
+			continue
+		}
+		if keep > 0 {
+			keep--
+			continue
+		}
+		b[i] = '*'
+	}
+	return string(b)
+}
+
+// maskEmail hides the local part of an address but its first character
+func maskEmail(s string) string {
+	local, domain, _ := strings.Cut(s, "@")
+	return local[:1] + strings.Repeat("*", len(local)-1) + "@" + domain
+}
@@ -0,0 +1,132 @@
+package capture
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// PipelineStats holds capture pipeline counters
+type PipelineStats struct {
+	Submitted  int64 `json:"submitted"`
+	Stored     int64 `json:"stored"`
+	Dropped    int64 `json:"dropped"`
+	QueueDepth int   `json:"queue_depth"`
+	QueueSize  int   `json:"queue_size"`
+}
+
+// job is a capture waiting to be stored
+type job struct {
+	req     *CapturedRequest
+	prepare func()
+}
+
+// Pipeline stores captures on background workers so that storage and
+// indexing cost never adds latency to proxied traffic. When the queue is
+// full, captures are dropped rather than blocking the request path.
+type Pipeline struct {
+	store *Store
+	queue chan job
+	wg    sync.WaitGroup
+
+	closeOnce sync.Once
+	closed    chan struct{}
+
+	submitted atomic.Int64
+	stored    atomic.Int64
+	dropped   atomic.Int64
+}
+
+// NewPipeline starts workers that add queued captures to store
+func NewPipeline(store *Store, workers, queueSize int) *Pipeline {
+	if workers <= 0 {
+		workers = 1
+	}
+	if queueSize <= 0 {
+		queueSize = 1024
+	}
+
+	p := &Pipeline{
+		store:  store,
+		queue:  make(chan job, queueSize),
+		closed: make(chan struct{}),
+	}
+
+	p.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.worker()
+	}
+	return p
+}
+
+// Submit queues a capture for storage without blocking. prepare, if set,
+// runs on the worker before the capture is stored and is the place for
+// deferred work such as cloning headers. Submit reports whether the capture
+// was queued.
+func (p *Pipeline) Submit(req *CapturedRequest, prepare func()) bool {
+	p.submitted.Add(1)
+
+	select {
+	case <-p.closed:
+		p.dropped.Add(1)
+		return false
+	default:
+	}
+
+	select {
+	case p.queue <- job{req: req, prepare: prepare}:
+		return true
+	default:
+		p.dropped.Add(1)
+		return false
+	}
+}
+
+// worker stores queued captures until the pipeline is closed and drained
+func (p *Pipeline) worker() {
+	defer p.wg.Done()
+
+	for {
+		select {
+		case j := <-p.queue:
+			p.process(j)
+		case <-p.closed:
+			// Drain whatever is left before exiting
+			for {
+				select {
+				case j := <-p.queue:
+					p.process(j)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// process prepares and stores a single capture
+func (p *Pipeline) process(j job) {
+	if j.prepare != nil {
+		j.prepare()
+	}
+	p.store.Add(j.req)
+	p.stored.Add(1)
+}
+
+// Close stops accepting captures and waits for queued ones to be stored
+func (p *Pipeline) Close() {
+	p.closeOnce.Do(func() {
+		close(p.closed)
+	})
+	p.wg.Wait()
+}
+
+// Stats returns the pipeline counters
+func (p *Pipeline) Stats() PipelineStats {
+	return PipelineStats{
+		Submitted:  p.submitted.Load(),
+		Stored:     p.stored.Load(),
+		Dropped:    p.dropped.Load(),
+		QueueDepth: len(p.queue),
+		QueueSize:  cap(p.queue),
+	}
+}
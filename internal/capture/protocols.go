@@ -0,0 +1,60 @@
+package capture
+
+import "net/http"
+
+// ProtocolStats summarizes how exchanges were carried on each side of
+// the proxy, for telling apart behavior the proxy introduces: requests
+// converted to another HTTP version, and connections reused or opened
+// per request
+type ProtocolStats struct {
+	// Exchanges by client protocol and upstream protocol, keyed like
+	// "HTTP/1.1 -> HTTP/2.0"
+	Pairs map[string]int `json:"pairs"`
+
+	// Exchanges sent upstream in an older or newer HTTP version than
+	// the client used
+	DownConverted int `json:"down_converted"`
+	UpConverted   int `json:"up_converted"`
+
+	// Exchanges on connections that carried earlier ones, and on new
+	// connections, client side and upstream
+	ClientConnReused   int `json:"client_conn_reused"`
+	ClientConnNew      int `json:"client_conn_new"`
+	UpstreamConnReused int `json:"upstream_conn_reused"`
+	UpstreamConnNew    int `json:"upstream_conn_new"`
+}
+
+// Protocols computes ProtocolStats over the HTTP exchanges among requests
+// that got a response from upstream
+func Protocols(requests []*CapturedRequest) ProtocolStats {
+	stats := ProtocolStats{Pairs: make(map[string]int)}
+	for _, req := range requests {
+		if req.UpstreamProto == "" {
+			continue
+		}
+		stats.Pairs[req.Proto+" -> "+req.UpstreamProto]++
+
+		clientMajor, clientMinor, ok1 := http.ParseHTTPVersion(req.Proto)
+		upMajor, upMinor, ok2 := http.ParseHTTPVersion(req.UpstreamProto)
+		if ok1 && ok2 {
+			switch client, up := clientMajor*10+clientMinor, upMajor*10+upMinor; {
+			case up < client:
+				stats.DownConverted++
+			case up > client:
+				stats.UpConverted++
+			}
+		}
+
+		if req.ClientConnReused {
+			stats.ClientConnReused++
+		} else {
+			stats.ClientConnNew++
+		}
+		if req.UpstreamConnReused {
+			stats.UpstreamConnReused++
+		} else {
+			stats.UpstreamConnNew++
+		}
+	}
+	return stats
+}
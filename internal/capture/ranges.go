@@ -0,0 +1,144 @@
+package capture
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Download is one resource fetched in byte ranges, coalesced from its 206
+// captures
+type Download struct {
+	URL string `json:"url"`
+
+	// Size of the whole resource, 0 if no response stated it
+	Size int64 `json:"size"`
+
+	// Distinct bytes received, their share of Size, and the merged
+	// inclusive byte ranges covering them
+	Received        int64      `json:"received"`
+	CompletePercent float64    `json:"complete_percent"`
+	Ranges          [][2]int64 `json:"ranges"`
+
+	// Captures of the partial responses, oldest first
+	RequestIDs []string `json:"request_ids"`
+}
+
+// Downloads groups the 206 captures among requests by URL and works out
+// how much of each resource they cover. Multipart byte-range responses
+// count every part. Resources are returned in order of first request.
+func Downloads(requests []*CapturedRequest) []Download {
+	var order []string
+	byURL := make(map[string]*Download)
+	spans := make(map[string][][2]int64)
+
+	for _, req := range requests {
+		if req.StatusCode != http.StatusPartialContent {
+			continue
+		}
+		d := byURL[req.URL]
+		if d == nil {
+			d = &Download{URL: req.URL}
+			byURL[req.URL] = d
+			order = append(order, req.URL)
+		}
+		d.RequestIDs = append(d.RequestIDs, req.ID)
+		for _, cr := range responseRanges(req) {
+			start, end, size, ok := ParseContentRange(cr)
+			if !ok {
+				continue
+			}
+			if size > 0 {
+				d.Size = size
+			}
+			spans[req.URL] = append(spans[req.URL], [2]int64{start, end})
+		}
+	}
+
+	result := make([]Download, 0, len(order))
+	for _, url := range order {
+		d := byURL[url]
+		d.Ranges = mergeRanges(spans[url])
+		for _, r := range d.Ranges {
+			d.Received += r[1] - r[0] + 1
+		}
+		if d.Size > 0 {
+			d.CompletePercent = float64(d.Received) * 100 / float64(d.Size)
+		}
+		result = append(result, *d)
+	}
+	return result
+}
+
+// responseRanges returns the Content-Range values of a 206 capture: its
+// header, or each part's for a multipart/byteranges body
+func responseRanges(req *CapturedRequest) []string {
+	if req.ContentRange != "" {
+		return []string{req.ContentRange}
+	}
+	mediaType, params, err := mime.ParseMediaType(http.Header(req.ResponseHeaders).Get("Content-Type"))
+	if err != nil || mediaType != "multipart/byteranges" {
+		return nil
+	}
+	var ranges []string
+	mr := multipart.NewReader(bytes.NewReader(req.ResponseBody), params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			return ranges
+		}
+		if cr := part.Header.Get("Content-Range"); cr != "" {
+			ranges = append(ranges, cr)
+		}
+		io.Copy(io.Discard, part)
+	}
+}
+
+// ParseContentRange parses a "bytes first-last/size" Content-Range value.
+// size is 0 when the server sent "*".
+func ParseContentRange(v string) (first, last, size int64, ok bool) {
+	spec, found := strings.CutPrefix(strings.TrimSpace(v), "bytes ")
+	if !found {
+		return 0, 0, 0, false
+	}
+	span, total, found := strings.Cut(spec, "/")
+	if !found {
+		return 0, 0, 0, false
+	}
+	a, b, found := strings.Cut(span, "-")
+	if !found {
+		return 0, 0, 0, false
+	}
+	first, err1 := strconv.ParseInt(a, 10, 64)
+	last, err2 := strconv.ParseInt(b, 10, 64)
+	if err1 != nil || err2 != nil || first < 0 || last < first {
+		return 0, 0, 0, false
+	}
+	if total != "*" {
+		var err error
+		if size, err = strconv.ParseInt(total, 10, 64); err != nil || size <= last {
+			return 0, 0, 0, false
+		}
+	}
+	return first, last, size, true
+}
+
+// mergeRanges sorts inclusive byte ranges and joins overlapping or
+// adjacent ones
+func mergeRanges(ranges [][2]int64) [][2]int64 {
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i][0] < ranges[j][0] })
+	var merged [][2]int64
+	for _, r := range ranges {
+		if n := len(merged); n > 0 && r[0] <= merged[n-1][1]+1 {
+			merged[n-1][1] = max(merged[n-1][1], r[1])
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
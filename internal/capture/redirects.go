@@ -0,0 +1,137 @@
+package capture
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/adamdrake/go_proxy/internal/hostmatch"
+)
+
+// redirectWindow is how long after a redirect response ends its client
+// may take to request the Location and still continue the chain
+const redirectWindow = 10 * time.Second
+
+// redirectStatuses are the statuses clients follow to Location
+var redirectStatuses = map[int]bool{
+	http.StatusMovedPermanently:  true,
+	http.StatusFound:             true,
+	http.StatusSeeOther:          true,
+	http.StatusTemporaryRedirect: true,
+	http.StatusPermanentRedirect: true,
+}
+
+// IsRedirect reports whether clients follow a response with status to
+// its Location
+func IsRedirect(status int) bool {
+	return redirectStatuses[status]
+}
+
+// redirectKey identifies a redirect awaiting its follow-up: the client
+// and the canonical URL it was sent to
+type redirectKey struct {
+	client string
+	url    string
+}
+
+// redirectTarget returns the canonical URL a redirect response sends its
+// client to, or "" when req is not a redirect
+func redirectTarget(req *CapturedRequest) string {
+	if req.IsTunnel || !IsRedirect(req.StatusCode) {
+		return ""
+	}
+	location := http.Header(req.ResponseHeaders).Get("Location")
+	if location == "" {
+		return ""
+	}
+	base, err := url.Parse(req.URL)
+	if err != nil {
+		return ""
+	}
+	target, err := base.Parse(location)
+	if err != nil {
+		return ""
+	}
+	return canonicalTarget(target)
+}
+
+// canonicalTarget returns u without its fragment, which clients keep to
+// themselves, and with its host in canonical form
+func canonicalTarget(u *url.URL) string {
+	u.Fragment, u.RawFragment = "", ""
+	return hostmatch.CanonicalURL(u.String())
+}
+
+// linkRedirect joins req to the chain of the redirect its client was
+// following: a redirect from the same client address whose Location is
+// req's URL and that ended at most redirectWindow before req started.
+// A redirect starts a chain named by its ID when it follows none, and
+// waits for its own follow-up. The caller must hold s.mu, before req is
+// visible to readers.
+func (s *Store) linkRedirect(req *CapturedRequest) {
+	client := clientIP(req.ClientAddr)
+	if req.RedirectChain == "" {
+		if u, err := url.Parse(req.URL); err == nil {
+			key := redirectKey{client: client, url: canonicalTarget(u)}
+			pending := s.redirects[key]
+			for i := len(pending) - 1; i >= 0; i-- {
+				prev := pending[i]
+				if req.Timestamp.Before(prev.Timestamp) || req.Timestamp.Sub(prev.Timestamp.Add(prev.Duration)) > redirectWindow {
+					continue
+				}
+				req.RedirectChain = prev.RedirectChain
+				req.RedirectFrom = prev.ID
+				req.RedirectHop = prev.RedirectHop + 1
+				s.dropRedirect(key, prev)
+				break
+			}
+		}
+	}
+
+	if target := redirectTarget(req); target != "" {
+		if req.RedirectChain == "" {
+			req.RedirectChain = req.ID
+		}
+		key := redirectKey{client: client, url: target}
+		s.redirects[key] = append(s.redirects[key], req)
+	}
+}
+
+// forgetRedirect stops an evicted redirect from awaiting its follow-up.
+// The caller must hold s.mu.
+func (s *Store) forgetRedirect(req *CapturedRequest) {
+	if target := redirectTarget(req); target != "" {
+		s.dropRedirect(redirectKey{client: clientIP(req.ClientAddr), url: target}, req)
+	}
+}
+
+// dropRedirect removes req from the redirects awaiting key
+func (s *Store) dropRedirect(key redirectKey, req *CapturedRequest) {
+	pending := slices.DeleteFunc(s.redirects[key], func(r *CapturedRequest) bool { return r == req })
+	if len(pending) == 0 {
+		delete(s.redirects, key)
+	} else {
+		s.redirects[key] = pending
+	}
+}
+
+// RedirectChain returns the stored members of a redirect chain, first hop
+// first
+func (s *Store) RedirectChain(chain string) []*CapturedRequest {
+	if chain == "" {
+		return nil
+	}
+	s.mu.RLock()
+	var members []*CapturedRequest
+	for _, req := range s.requests {
+		if req.RedirectChain == chain {
+			members = append(members, req)
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.SliceStable(members, func(i, j int) bool { return members[i].RedirectHop < members[j].RedirectHop })
+	return members
+}
@@ -2,7 +2,11 @@ package capture
 
 import (
 	"encoding/json"
+	"net/url"
+	"strings"
 	"time"
+
+	"github.com/adamdrake/go_proxy/internal/hostmatch"
 )
 
 // CapturedRequest represents a captured HTTP request and its response
@@ -12,25 +16,212 @@ type CapturedRequest struct {
 	Method         string              `json:"method"`
 	URL            string              `json:"url"`
 	Host           string              `json:"host"`
+	HostUnicode    string              `json:"host_unicode,omitempty"`
 	Path           string              `json:"path"`
+	QueryParams    map[string][]string `json:"query_params,omitempty"`
 	Proto          string              `json:"proto"`
 	RequestHeaders map[string][]string `json:"request_headers"`
 	RequestBody    []byte              `json:"request_body,omitempty"`
 
+	// SHA-256 of the whole request body, including any part past what
+	// RequestBody keeps
+	RequestBodySHA256 string `json:"request_body_sha256,omitempty"`
+
+	// Set when RequestBody was cut off at the body size limit
+	RequestBodyTruncated bool `json:"request_body_truncated,omitempty"`
+
+	// Set when the request body was spooled to disk; RequestBody then
+	// holds only its first bytes
+	Upload *Upload `json:"upload,omitempty"`
+
+	// Request headers in the order and case the client sent them,
+	// duplicates included
+	RequestHeaderOrder []HeaderField `json:"request_header_order,omitempty"`
+
 	// Response (filled in after)
 	StatusCode      int                 `json:"status_code"`
 	ResponseHeaders map[string][]string `json:"response_headers"`
 	ResponseBody    []byte              `json:"response_body,omitempty"`
 
+	// SHA-256 of the whole response body as received from upstream,
+	// before body rewrites or truncation to ResponseBody
+	ResponseBodySHA256 string `json:"response_body_sha256,omitempty"`
+
+	// Set when ResponseBody was cut off at the body size limit
+	ResponseBodyTruncated bool `json:"response_body_truncated,omitempty"`
+
+	// Response headers in the order and case the upstream sent them
+	ResponseHeaderOrder []HeaderField `json:"response_header_order,omitempty"`
+
+	// HTTP/1 messages exactly as they crossed the wire, when raw capture
+	// is enabled; served by /api/requests/{id}/raw rather than inline
+	RawRequest   []byte `json:"-"`
+	RawResponse  []byte `json:"-"`
+	RawTruncated bool   `json:"raw_truncated,omitempty"`
+
+	// Range the client asked for and the Content-Range of a partial
+	// response
+	Range        string `json:"range,omitempty"`
+	ContentRange string `json:"content_range,omitempty"`
+
+	// For a 304, the capture of the 200 response its validators matched;
+	// CachedBody is set when ResponseBody was taken from that capture
+	NotModifiedOf string `json:"not_modified_of,omitempty"`
+	CachedBody    bool   `json:"cached_body,omitempty"`
+
+	// Resources the response hinted with Link preload headers, in 103
+	// Early Hints and then in the final response
+	Hints []ResourceHint `json:"hints,omitempty"`
+
+	// Size of a media body replaced by a placeholder
+	OriginalSize int64 `json:"original_size,omitempty"`
+
 	// Timing
 	Duration time.Duration `json:"duration_ms"`
 
+	// Backend that served the request when a map-remote rule applied
+	Backend string `json:"backend,omitempty"`
+
+	// Error forwarding the request upstream, if any
+	Error string `json:"error,omitempty"`
+
+	// Upstream attempts, recorded when retries are enabled
+	Attempts []Attempt `json:"attempts,omitempty"`
+
 	// Connection type
 	IsHTTPS bool `json:"is_https"`
 
 	// For HTTPS CONNECT tunneling, we only see metadata
 	IsTunnel bool `json:"is_tunnel"`
 
+	// Payload bytes relayed for UDP proxying and port forwards, client to
+	// target and back
+	BytesSent     int64 `json:"bytes_sent,omitempty"`
+	BytesReceived int64 `json:"bytes_received,omitempty"`
+
+	// Hex dumps of the first bytes each way through a port forward
+	PayloadSentSample     string `json:"payload_sent_sample,omitempty"`
+	PayloadReceivedSample string `json:"payload_received_sample,omitempty"`
+
+	// Plaintext part of a forwarded SMTP or IMAP session
+	Mail *MailSession `json:"mail,omitempty"`
+
+	// MQTT packets seen in a tunnel, port forward or WebSocket
+	MQTT *MQTTSession `json:"mqtt,omitempty"`
+
+	// Decoded query and answer of a DNS-over-HTTPS request
+	DNS *DNSExchange `json:"dns,omitempty"`
+
+	// Protocol the proxy spoke upstream, which differs from Proto when
+	// the exchange was converted, e.g. HTTP/1.1 from the client and
+	// HTTP/2.0 upstream
+	UpstreamProto string `json:"upstream_proto,omitempty"`
+
+	// Whether the exchange reused a connection that carried earlier
+	// ones: the client's connection to the proxy, and the proxy's
+	// connection upstream
+	ClientConnReused   bool `json:"client_conn_reused,omitempty"`
+	UpstreamConnReused bool `json:"upstream_conn_reused,omitempty"`
+
+	// Time the request waited for an upstream connection, dialing
+	// included
+	UpstreamConnWaitMS float64 `json:"upstream_conn_wait_ms,omitempty"`
+
+	// Address the upstream connection reached and, with GeoIP databases,
+	// its autonomous system and country
+	UpstreamIP      string `json:"upstream_ip,omitempty"`
+	UpstreamASN     uint   `json:"upstream_asn,omitempty"`
+	UpstreamOrg     string `json:"upstream_org,omitempty"`
+	UpstreamCountry string `json:"upstream_country,omitempty"`
+
+	// Reverse DNS names of UpstreamIP, when reverse lookups are on
+	UpstreamPTR []string `json:"upstream_ptr,omitempty"`
+
+	// Negotiated upstream TLS parameters (when the proxy spoke TLS upstream)
+	TLSVersion     string `json:"tls_version,omitempty"`
+	TLSCipherSuite string `json:"tls_cipher_suite,omitempty"`
+
+	// Certificate chain the upstream presented, leaf first: on connections
+	// the proxy made, or fetched separately for tunnels when probing is on
+	UpstreamCerts []CertInfo `json:"upstream_certs,omitempty"`
+
+	// Identity of the client certificate configured for the upstream host
+	ClientCertIdentity string `json:"client_cert_identity,omitempty"`
+
+	// Set when the client disconnected before the response was delivered;
+	// ResponseBody then holds only what was received upstream
+	ClientAborted bool `json:"client_aborted,omitempty"`
+
+	// Set when the proxy refused to forward the request
+	Blocked     bool   `json:"blocked,omitempty"`
+	BlockReason string `json:"block_reason,omitempty"`
+
+	// robots.txt rule disallowing the request, in crawl assist mode
+	RobotsDisallowed string `json:"robots_disallowed,omitempty"`
+
+	// ID sent upstream in the correlation header, for joining captures
+	// with backend logs
+	CorrelationID string `json:"correlation_id,omitempty"`
+
+	// Redirect chain the capture belongs to, named by the ID of its first
+	// redirect, the capture whose redirect the client followed here, and
+	// the capture's place in the chain (0 for the first)
+	RedirectChain string `json:"redirect_chain,omitempty"`
+	RedirectFrom  string `json:"redirect_from,omitempty"`
+	RedirectHop   int    `json:"redirect_hop,omitempty"`
+
+	// Content type and charset of the response body as detected from its
+	// bytes, and whether they contradict the declared Content-Type
+	DetectedContentType string `json:"detected_content_type,omitempty"`
+	DetectedCharset     string `json:"detected_charset,omitempty"`
+	ContentTypeMismatch bool   `json:"content_type_mismatch,omitempty"`
+
+	// Passive security observations, such as missing HSTS or insecure
+	// cookies
+	Findings []Finding `json:"findings,omitempty"`
+
+	// Likely personal data seen in the exchange, when PII scanning is on
+	PIIFindings []PIIFinding `json:"pii_findings,omitempty"`
+
+	// Credentials seen in the outgoing request, when secret scanning is on
+	SecretFindings []SecretFinding `json:"secret_findings,omitempty"`
+
+	// Basic and Digest credentials and query-string tokens the request
+	// carried, redacted
+	Credentials []Credential `json:"credentials,omitempty"`
+
+	// PartyFirst or PartyThird when a first-party domain list applies to
+	// the capture's session
+	Party string `json:"party,omitempty"`
+
+	// Labels the client attached with the X-GoProxy-Tag header
+	Tags []string `json:"tags,omitempty"`
+
+	// Capture namespace the request was recorded in (empty for the
+	// default store)
+	Tenant string `json:"tenant,omitempty"`
+
+	// Named recording session the request was captured in, e.g. the app
+	// build being exercised
+	Session string `json:"session,omitempty"`
+
+	// Proxy instance that forwarded the capture, when this instance runs
+	// as a collector
+	Source string `json:"source,omitempty"`
+
+	// Order in which the store received the capture, for polling clients
+	Seq uint64 `json:"seq,omitempty"`
+
+	// Modifications the proxy made to the exchange, in the order applied
+	AppliedActions []ActionRecord `json:"applied_actions,omitempty"`
+
+	// Modifications rules in dry-run mode would have made, had they been
+	// enforced; the exchange was left alone
+	WouldApply []ActionRecord `json:"would_apply,omitempty"`
+
+	// Messages exchanged after a WebSocket upgrade, in order
+	WebSocketMessages []WebSocketMessage `json:"websocket_messages,omitempty"`
+
 	// Client address for process resolution
 	ClientAddr string `json:"client_addr,omitempty"`
 
@@ -39,6 +230,199 @@ type CapturedRequest struct {
 	ProcessID   int    `json:"process_id,omitempty"`
 }
 
+// Attempt is a single try at forwarding a request upstream
+type Attempt struct {
+	Number     int    `json:"number"`
+	StatusCode int    `json:"status_code,omitempty"`
+	Error      string `json:"error,omitempty"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+// WebSocketMessage is a single message relayed over a WebSocket connection.
+// Fragmented messages are reassembled; control frames other than close are
+// not recorded.
+type WebSocketMessage struct {
+	Timestamp time.Time `json:"timestamp"`
+	// Direction is "upstream" (client to server) or "downstream"
+	Direction string `json:"direction"`
+	// Type is "text", "binary" or "close"
+	Type    string `json:"type"`
+	Payload []byte `json:"payload,omitempty"`
+
+	// RuleID is the rule that rewrote or dropped the message
+	RuleID   string `json:"rule_id,omitempty"`
+	Modified bool   `json:"modified,omitempty"`
+	Dropped  bool   `json:"dropped,omitempty"`
+	// WouldRuleID is the dry-run rule that would have rewritten the
+	// message, or dropped it when WouldDrop is set
+	WouldRuleID string `json:"would_rule_id,omitempty"`
+	WouldDrop   bool   `json:"would_drop,omitempty"`
+	// Injected messages were sent through the API rather than by a peer
+	Injected bool `json:"injected,omitempty"`
+}
+
+// MailSession is the decoded plaintext part of an SMTP or IMAP session
+type MailSession struct {
+	Transcript []MailLine     `json:"transcript"`
+	Envelopes  []MailEnvelope `json:"envelopes,omitempty"`
+	// StartTLS is set when the session switched to TLS; nothing after
+	// the switch is recorded
+	StartTLS bool `json:"starttls"`
+}
+
+// MailLine is one command or reply line. Credentials are redacted.
+type MailLine struct {
+	// Direction is "upstream" (client to server) or "downstream"
+	Direction string `json:"direction"`
+	Line      string `json:"line"`
+}
+
+// MailEnvelope is a message submitted over SMTP
+type MailEnvelope struct {
+	From string   `json:"from"`
+	To   []string `json:"to"`
+	Size int      `json:"size"`
+	// Body is "[redacted]" unless body capture is enabled
+	Body string `json:"body,omitempty"`
+}
+
+// MQTTSession is the MQTT traffic of a connection: the client it
+// identified as and the packets exchanged, as child events of the
+// connection's capture. Passwords are never recorded.
+type MQTTSession struct {
+	// Version is the protocol level: 3 (3.1), 4 (3.1.1) or 5
+	Version  int         `json:"version"`
+	ClientID string      `json:"client_id,omitempty"`
+	Username string      `json:"username,omitempty"`
+	Events   []MQTTEvent `json:"events"`
+	// Truncated is set when events stopped being recorded: too many, or
+	// a packet too large to decode
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// MQTTEvent is one MQTT packet. Keep-alive pings are not recorded.
+type MQTTEvent struct {
+	Timestamp time.Time `json:"timestamp"`
+	// Direction is "upstream" (client to broker) or "downstream"
+	Direction string `json:"direction"`
+	// Type is the packet type, e.g. PUBLISH or SUBSCRIBE
+	Type     string `json:"type"`
+	PacketID uint16 `json:"packet_id,omitempty"`
+
+	// PUBLISH: the topic, delivery flags, and the payload size and first
+	// bytes
+	Topic         string `json:"topic,omitempty"`
+	QoS           int    `json:"qos,omitempty"`
+	Retain        bool   `json:"retain,omitempty"`
+	PayloadSize   int    `json:"payload_size,omitempty"`
+	PayloadSample []byte `json:"payload_sample,omitempty"`
+
+	// SUBSCRIBE and UNSUBSCRIBE: topic filters, with the requested QoS of
+	// each subscription
+	Filters []MQTTFilter `json:"filters,omitempty"`
+
+	// CONNACK, SUBACK and other acknowledgements: return or reason codes
+	Codes []int `json:"codes,omitempty"`
+}
+
+// MQTTFilter is a topic filter of a subscription
+type MQTTFilter struct {
+	Filter string `json:"filter"`
+	QoS    int    `json:"qos"`
+}
+
+// Upload describes a large request body spooled to disk
+type Upload struct {
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	// File holds the body until the retention period ends, encrypted with
+	// the capture key when Encrypted is set
+	File      string `json:"file"`
+	Encrypted bool   `json:"encrypted,omitempty"`
+}
+
+// HeaderField is a single header line as it appeared on the wire
+type HeaderField struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// Action types recorded in AppliedActions
+const (
+	ActionHeader           = "header"
+	ActionDeviceProfile    = "device_profile"
+	ActionBlock            = "block"
+	ActionCircuitBreaker   = "circuit_breaker"
+	ActionMapRemote        = "map_remote"
+	ActionWebSocket        = "websocket"
+	ActionBodyReplace      = "body_replace"
+	ActionRelaxHeaders     = "relax_headers"
+	ActionInjectHTML       = "inject_html"
+	ActionCookies          = "cookies"
+	ActionMediaPlaceholder = "media_placeholder"
+	ActionCrawl            = "crawl"
+)
+
+// Party classifications
+const (
+	PartyFirst = "first"
+	PartyThird = "third"
+)
+
+// ActionRecord describes a single modification made by a rule or proxy feature
+type ActionRecord struct {
+	Type   string `json:"type"`
+	RuleID string `json:"rule_id,omitempty"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// RecordActions appends actions to the capture
+func (c *CapturedRequest) RecordActions(actions ...ActionRecord) {
+	c.AppliedActions = append(c.AppliedActions, actions...)
+}
+
+// RecordWouldApply appends actions that dry-run rules would have taken
+func (c *CapturedRequest) RecordWouldApply(actions ...ActionRecord) {
+	c.WouldApply = append(c.WouldApply, actions...)
+}
+
+// SetHost records a host:port in canonical form for scheme: lowercase,
+// punycode labels and no default port, with the Unicode form alongside
+// when they differ
+func (c *CapturedRequest) SetHost(hostport, scheme string) {
+	c.Host = hostmatch.Canonical(hostport, scheme)
+	c.HostUnicode = unicodeHost(c.Host)
+}
+
+// unicodeHost returns the Unicode form of a canonical host, or "" when it
+// has no punycode labels
+func unicodeHost(host string) string {
+	if u := hostmatch.ToUnicode(host); u != host {
+		return u
+	}
+	return ""
+}
+
+// queryParams parses the query string of rawURL, keeping the parameters
+// that decode when some do not
+func queryParams(rawURL string) map[string][]string {
+	_, query, ok := strings.Cut(rawURL, "?")
+	if !ok {
+		return nil
+	}
+	query, _, _ = strings.Cut(query, "#")
+	params, _ := url.ParseQuery(query)
+	if len(params) == 0 {
+		return nil
+	}
+	return params
+}
+
+// Modified reports whether any action touched the exchange
+func (c *CapturedRequest) Modified() bool {
+	return len(c.AppliedActions) > 0
+}
+
 // MarshalJSON custom marshaler to handle Duration as milliseconds
 func (c CapturedRequest) MarshalJSON() ([]byte, error) {
 	type Alias CapturedRequest
@@ -51,6 +435,21 @@ func (c CapturedRequest) MarshalJSON() ([]byte, error) {
 	})
 }
 
+// UnmarshalJSON reads captures written by MarshalJSON, taking duration_ms
+// as milliseconds
+func (c *CapturedRequest) UnmarshalJSON(data []byte) error {
+	type Alias CapturedRequest
+	aux := struct {
+		*Alias
+		DurationMS int64 `json:"duration_ms"`
+	}{Alias: (*Alias)(c)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	c.Duration = time.Duration(aux.DurationMS) * time.Millisecond
+	return nil
+}
+
 // NewCapturedRequest creates a new CapturedRequest with a generated ID and timestamp
 func NewCapturedRequest() *CapturedRequest {
 	return &CapturedRequest{
@@ -0,0 +1,128 @@
+package capture
+
+import (
+	"sort"
+	"strings"
+)
+
+// snippetContext is how many bytes of context surround a highlighted match
+const snippetContext = 40
+
+// Highlight is a snippet of a request field with matched terms marked
+type Highlight struct {
+	Field   string `json:"field"`
+	Snippet string `json:"snippet"`
+}
+
+// SearchResult is a request matching a search with its highlights
+type SearchResult struct {
+	Request    *CapturedRequest `json:"request"`
+	Highlights []Highlight      `json:"highlights"`
+}
+
+// Search returns stored requests containing every term in query, oldest first
+func (s *Store) Search(query string) []*CapturedRequest {
+	s.indexMu.RLock()
+	ids := s.index.lookup(query)
+	s.indexMu.RUnlock()
+
+	if len(ids) == 0 {
+		return []*CapturedRequest{}
+	}
+
+	// Entries evicted since the lookup simply don't match below
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make([]*CapturedRequest, 0, len(ids))
+	for _, req := range s.requests {
+		if _, ok := ids[req.ID]; ok {
+			result = append(result, req)
+		}
+	}
+	return result
+}
+
+// Highlights returns one snippet per field of req in which a query term
+// occurs, with each occurrence wrapped in <mark> tags
+func Highlights(req *CapturedRequest, query string) []Highlight {
+	terms := tokenize(query)
+	fields := searchableText(req)
+
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var result []Highlight
+	for _, name := range names {
+		if snippet, ok := highlightSnippet(fields[name], terms); ok {
+			result = append(result, Highlight{Field: name, Snippet: snippet})
+		}
+	}
+	return result
+}
+
+// highlightSnippet marks terms in a window around the first match in text
+func highlightSnippet(text string, terms []string) (string, bool) {
+	lower := strings.ToLower(text)
+
+	first := -1
+	for _, term := range terms {
+		if i := strings.Index(lower, term); i >= 0 && (first < 0 || i < first) {
+			first = i
+		}
+	}
+	if first < 0 {
+		return "", false
+	}
+
+	start := max(0, first-snippetContext)
+	end := min(len(text), first+snippetContext*2)
+
+	// Keep the window on rune boundaries
+	for start > 0 && !isRuneStart(text[start]) {
+		start--
+	}
+	for end < len(text) && !isRuneStart(text[end]) {
+		end++
+	}
+	window := text[start:end]
+	windowLower := strings.ToLower(window)
+	if len(windowLower) != len(window) {
+		// Case mapping changed byte lengths; only exact-case matches are marked
+		windowLower = window
+	}
+
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	for i := 0; i < len(window); {
+		matched := ""
+		for _, term := range terms {
+			if strings.HasPrefix(windowLower[i:], term) && len(term) > len(matched) {
+				matched = term
+			}
+		}
+		if matched == "" {
+			b.WriteByte(window[i])
+			i++
+			continue
+		}
+		b.WriteString("<mark>")
+		b.WriteString(window[i : i+len(matched)])
+		b.WriteString("</mark>")
+		i += len(matched)
+	}
+	if end < len(text) {
+		b.WriteString("…")
+	}
+	return b.String(), true
+}
+
+// isRuneStart reports whether b begins a UTF-8 sequence
+func isRuneStart(b byte) bool {
+	return b&0xC0 != 0x80
+}
@@ -0,0 +1,154 @@
+package capture
+
+import (
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/adamdrake/go_proxy/internal/hostmatch"
+)
+
+// maxSecretFindings caps the findings recorded per capture
+const maxSecretFindings = 20
+
+// SecretFinding is a credential seen in an outgoing request
+type SecretFinding struct {
+	// Type is "aws_access_key", "aws_secret_key", "github_token",
+	// "gitlab_token", "slack_token", "stripe_secret_key",
+	// "google_api_key" or "private_key"
+	Type string `json:"type"`
+	// Location is url, request_headers or request_body
+	Location string `json:"location"`
+	// Match is the value found, masked
+	Match string `json:"match"`
+}
+
+// secretDetector finds one kind of credential. Requests to the issuer's
+// own hosts are expected to carry it and are not flagged.
+type secretDetector struct {
+	kind    string
+	pattern *regexp.Regexp
+	issuers []string
+}
+
+var secretDetectors = []secretDetector{
+	{
+		kind:    "aws_access_key",
+		pattern: regexp.MustCompile(`\b(?:AKIA|ASIA|ABIA|ACCA)[0-9A-Z]{16}\b`),
+		issuers: []string{"*.amazonaws.com", "*.aws.amazon.com"},
+	},
+	{
+		kind:    "aws_secret_key",
+		pattern: regexp.MustCompile(`(?i)aws_?secret_?(?:access_?)?key["']?\s*[:=]\s*["']?([A-Za-z0-9/+]{40})\b`),
+		issuers: []string{"*.amazonaws.com", "*.aws.amazon.com"},
+	},
+	{
+		kind:    "github_token",
+		pattern: regexp.MustCompile(`\b(?:gh[pousr]_[A-Za-z0-9]{36}|github_pat_[A-Za-z0-9_]{82})\b`),
+		issuers: []string{"*.github.com", "*.githubusercontent.com"},
+	},
+	{
+		kind:    "gitlab_token",
+		pattern: regexp.MustCompile(`\bglpat-[A-Za-z0-9_-]{20}\b`),
+		issuers: []string{"*.gitlab.com"},
+	},
+	{
+		kind:    "slack_token",
+		pattern: regexp.MustCompile(`\bxox[abprs]-[A-Za-z0-9-]{10,}`),
+		issuers: []string{"*.slack.com"},
+	},
+	{
+		kind:    "stripe_secret_key",
+		pattern: regexp.MustCompile(`\b[rs]k_live_[A-Za-z0-9]{24,}\b`),
+		issuers: []string{"*.stripe.com"},
+	},
+	{
+		kind:    "google_api_key",
+		pattern: regexp.MustCompile(`\bAIza[0-9A-Za-z_-]{35}\b`),
+		issuers: []string{"*.googleapis.com", "*.google.com"},
+	},
+	{
+		kind:    "private_key",
+		pattern: regexp.MustCompile(`-----BEGIN (?:[A-Z0-9]+ )*PRIVATE KEY(?: BLOCK)?-----`),
+	},
+}
+
+// ScanSecrets looks for well-known credential formats in an outgoing
+// request's URL, headers and text body, before it is forwarded. Matches
+// are deduplicated per location and masked.
+func ScanSecrets(rawURL string, header map[string][]string, body []byte) []SecretFinding {
+	var host string
+	if u, err := url.Parse(rawURL); err == nil {
+		host = u.Host
+	}
+
+	fields := map[string]string{"url": rawURL}
+	if decoded, err := url.QueryUnescape(rawURL); err == nil {
+		fields["url"] = decoded
+	}
+	var headers strings.Builder
+	for name, values := range header {
+		for _, v := range values {
+			headers.WriteString(name)
+			headers.WriteString(": ")
+			headers.WriteString(v)
+			headers.WriteByte('\n')
+		}
+	}
+	fields["request_headers"] = headers.String()
+	if text, ok := textBody(body); ok {
+		fields["request_body"] = text
+	}
+
+	var findings []SecretFinding
+	seen := make(map[SecretFinding]struct{})
+	for _, location := range []string{"url", "request_headers", "request_body"} {
+		text := fields[location]
+		if text == "" {
+			continue
+		}
+		for _, d := range secretDetectors {
+			if hostmatch.MatchAny(d.issuers, host) {
+				continue
+			}
+			for _, m := range d.pattern.FindAllStringSubmatch(text, -1) {
+				match := m[len(m)-1]
+				if d.kind != "private_key" {
+					match = maskSecret(match)
+				}
+				f := SecretFinding{Type: d.kind, Location: location, Match: match}
+				if _, ok := seen[f]; ok {
+					continue
+				}
+				seen[f] = struct{}{}
+				findings = append(findings, f)
+				if len(findings) == maxSecretFindings {
+					return findings
+				}
+			}
+		}
+	}
+	return findings
+}
+
+// SecretTypes lists the distinct types among findings, in order of first
+// appearance
+func SecretTypes(findings []SecretFinding) []string {
+	var types []string
+	for _, f := range findings {
+		if !slices.Contains(types, f.Type) {
+			types = append(types, f.Type)
+		}
+	}
+	return types
+}
+
+// maskSecret keeps a credential's first four characters, which name its
+// kind, and hides the rest
+func maskSecret(s string) string {
+	if len(s) <= 8 {
+		return strings.Repeat("*", len(s))
+	}
+	return s[:4] + strings.Repeat("*", len(s)-4)
+}
@@ -0,0 +1,265 @@
+package capture
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// SnapshotFormat identifies snapshot files in their header line
+const SnapshotFormat = "go_proxy-snapshot"
+
+// Snapshot is a point-in-time view of a store's captures. Taking one is
+// O(1): it is the view the store last published, which the store never
+// changes. Captures themselves are not modified once stored, so they are
+// shared as they are.
+type Snapshot struct {
+	Taken    time.Time
+	Requests []*CapturedRequest
+}
+
+// SnapshotHeader is the first line of a snapshot file
+type SnapshotHeader struct {
+	Format  string    `json:"format"`
+	Version int       `json:"version"`
+	Taken   time.Time `json:"taken"`
+	Count   int       `json:"count"`
+}
+
+// snapshotRecord is one capture line of a snapshot file. Raw wire bytes
+// are not part of a capture's JSON, so they are carried alongside.
+type snapshotRecord struct {
+	Capture     *CapturedRequest `json:"capture"`
+	RawRequest  []byte           `json:"raw_request,omitempty"`
+	RawResponse []byte           `json:"raw_response,omitempty"`
+}
+
+// Snapshot returns the store's captures as of now, oldest first, without
+// copying them
+func (s *Store) Snapshot() *Snapshot {
+	return &Snapshot{
+		Taken:    time.Now(),
+		Requests: s.view.Load().requests,
+	}
+}
+
+// WriteTo writes the snapshot as gzip-compressed JSON lines: a
+// SnapshotHeader, then one capture per line
+func (snap *Snapshot) WriteTo(w io.Writer) (int64, error) {
+	counter := &countingWriter{w: w}
+	gz := gzip.NewWriter(counter)
+	buf := bufio.NewWriter(gz)
+	enc := json.NewEncoder(buf)
+
+	err := enc.Encode(SnapshotHeader{
+		Format:  SnapshotFormat,
+		Version: 1,
+		Taken:   snap.Taken,
+		Count:   len(snap.Requests),
+	})
+	for _, req := range snap.Requests {
+		if err != nil {
+			break
+		}
+		err = enc.Encode(snapshotRecord{
+			Capture:     req,
+			RawRequest:  req.RawRequest,
+			RawResponse: req.RawResponse,
+		})
+	}
+	if err == nil {
+		err = buf.Flush()
+	}
+	if err == nil {
+		err = gz.Close()
+	}
+	return counter.n, err
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// CompactStats reports the result of a compaction
+type CompactStats struct {
+	Requests    int   `json:"requests"`
+	Hosts       int   `json:"hosts"`
+	IndexTokens int   `json:"index_tokens"`
+	DurationMS  int64 `json:"duration_ms"`
+}
+
+// Compact releases memory the store holds on to after evictions: the
+// request list and host lists are reallocated to fit, and the search
+// index, whose maps never shrink, is rebuilt from its documents. Captures
+// arriving meanwhile wait in the capture pipeline, not on the request path.
+func (s *Store) Compact() CompactStats {
+	start := time.Now()
+
+	s.mu.Lock()
+	requests := make([]*CapturedRequest, len(s.requests), s.maxSize)
+	copy(requests, s.requests)
+	s.requests = requests
+	byHost := make(map[string][]*CapturedRequest, len(s.byHost))
+	for host, list := range s.byHost {
+		byHost[host] = append([]*CapturedRequest(nil), list...)
+	}
+	s.byHost = byHost
+	s.publish()
+	stats := CompactStats{Requests: len(s.requests), Hosts: len(s.byHost)}
+
+	s.indexMu.Lock()
+	s.mu.Unlock()
+	index := newIndex()
+	for id, tokens := range s.index.docs {
+		index.add(id, tokens)
+	}
+	s.index = index
+	stats.IndexTokens = len(index.postings)
+	s.indexMu.Unlock()
+
+	stats.DurationMS = time.Since(start).Milliseconds()
+	return stats
+}
+
+// ReadSnapshot reads captures from a snapshot file or from JSON lines of
+// captures as /api/export/ndjson writes them, gzip-compressed or not. It
+// fails once more than maxSize bytes have been read after decompression,
+// so a small compressed file cannot expand without bound.
+func ReadSnapshot(r io.Reader, maxSize int64) ([]*CapturedRequest, error) {
+	buf := bufio.NewReader(r)
+	if magic, _ := buf.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(buf)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		buf = bufio.NewReader(gz)
+	}
+	buf = bufio.NewReader(&cappedReader{r: buf, n: maxSize})
+
+	var requests []*CapturedRequest
+	dec := json.NewDecoder(buf)
+	for line := 1; ; line++ {
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		var probe struct {
+			Format  string          `json:"format"`
+			Version int             `json:"version"`
+			Capture json.RawMessage `json:"capture"`
+		}
+		if err := json.Unmarshal(raw, &probe); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		switch {
+		case probe.Format == SnapshotFormat:
+			if probe.Version != 1 {
+				return nil, fmt.Errorf("unsupported snapshot version %d", probe.Version)
+			}
+			continue
+		case probe.Capture != nil:
+			var record snapshotRecord
+			if err := json.Unmarshal(raw, &record); err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			record.Capture.RawRequest, record.Capture.RawResponse = record.RawRequest, record.RawResponse
+			requests = append(requests, record.Capture)
+		default:
+			req := &CapturedRequest{}
+			if err := json.Unmarshal(raw, req); err != nil {
+				return nil, fmt.Errorf("line %d: %w", line, err)
+			}
+			requests = append(requests, req)
+		}
+		if req := requests[len(requests)-1]; req == nil || req.ID == "" || req.Timestamp.IsZero() {
+			return nil, fmt.Errorf("line %d: not a capture (id and timestamp are required)", line)
+		}
+	}
+	return requests, nil
+}
+
+// cappedReader fails reads past its first n bytes
+type cappedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *cappedReader) Read(p []byte) (int, error) {
+	// Reading one byte past the limit tells a stream that is too large
+	// from one that ends there
+	if int64(len(p)) > c.n+1 {
+		p = p[:c.n+1]
+	}
+	n, err := c.r.Read(p)
+	if c.n -= int64(n); c.n < 0 {
+		return 0, errors.New("snapshot is too large")
+	}
+	return n, err
+}
+
+// MergeStats reports the outcome of a merge
+type MergeStats struct {
+	Imported int `json:"imported"`
+	// Duplicates are captures the store already had: same ID, time and URL
+	Duplicates int `json:"duplicates"`
+	// Renamed and Skipped are captures whose ID was taken by another
+	// capture
+	Renamed int `json:"renamed"`
+	Skipped int `json:"skipped"`
+}
+
+// Merge adds captures from another store, such as another instance's
+// snapshot. Captures the store already has are left out, so merging the
+// same file twice is harmless. A different capture under a taken ID gets
+// a new ID, or is skipped with skipConflicts.
+//
+// Merged captures come from elsewhere, so they lose their Upload, whose
+// file belongs to another machine and must not be opened here, and their
+// Tenant, which is the store's to decide.
+func (s *Store) Merge(requests []*CapturedRequest, skipConflicts bool) MergeStats {
+	s.mu.RLock()
+	existing := make(map[string]*CapturedRequest, len(s.requests))
+	for _, req := range s.requests {
+		existing[req.ID] = req
+	}
+	s.mu.RUnlock()
+
+	var stats MergeStats
+	for _, req := range requests {
+		req.Upload, req.Tenant = nil, ""
+		if other, ok := existing[req.ID]; ok {
+			switch {
+			case other.Timestamp.Equal(req.Timestamp) && other.URL == req.URL:
+				stats.Duplicates++
+				continue
+			case skipConflicts:
+				stats.Skipped++
+				continue
+			}
+			req.ID = uuid.New().String()
+			stats.Renamed++
+		}
+		existing[req.ID] = req
+		s.Add(req)
+		stats.Imported++
+	}
+	return stats
+}
@@ -0,0 +1,37 @@
+package capture
+
+import (
+	"bytes"
+	"compress/gzip"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadSnapshotCapsDecompressedSize(t *testing.T) {
+	line := `{"id":"a","timestamp":"2026-01-01T00:00:00Z","url":"http://example.com/","note":"` + strings.Repeat("x", 1<<20) + `"}` + "\n"
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write([]byte(line))
+	gz.Close()
+
+	if _, err := ReadSnapshot(bytes.NewReader(buf.Bytes()), int64(len(line))); err != nil {
+		t.Fatalf("snapshot within the limit: %v", err)
+	}
+	if _, err := ReadSnapshot(bytes.NewReader(buf.Bytes()), int64(buf.Len())*4); err == nil {
+		t.Fatalf("%d compressed bytes expanding to %d were read", buf.Len(), len(line))
+	}
+}
+
+func TestMergeDropsUploadAndTenant(t *testing.T) {
+	store := NewStore(10)
+	req := NewCapturedRequest()
+	req.ID, req.Timestamp, req.Tenant = "a", time.Now(), "other"
+	req.Upload = &Upload{Size: 1, File: "/etc/passwd"}
+
+	store.Merge([]*CapturedRequest{req}, false)
+	got := store.GetByID("a")
+	if got == nil || got.Upload != nil || got.Tenant != "" {
+		t.Fatalf("merged capture is %+v, want no upload or tenant", got)
+	}
+}
@@ -0,0 +1,254 @@
+package capture
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// Errors from DecodeBody
+var (
+	ErrUnsupportedEncoding = errors.New("unsupported Content-Encoding")
+	ErrDecodedTooLarge     = errors.New("decoded body too large")
+)
+
+// MaxDecodedBody bounds bodies decompressed for the API, so a small
+// compressed body cannot expand without bound
+const MaxDecodedBody = 64 << 20
+
+// sniffDecodeLimit bounds a body decompressed for sniffing; larger
+// compressed bodies are not sniffed
+const sniffDecodeLimit = 1 << 20
+
+// DecodeBody undoes a gzip or deflate Content-Encoding. It fails with
+// ErrDecodedTooLarge once the decompressed body passes limit bytes, and
+// with ErrUnsupportedEncoding for encodings it cannot read. Bodies
+// without an encoding are returned as they are.
+func DecodeBody(encoding string, body []byte, limit int64) ([]byte, error) {
+	var r io.ReadCloser
+	var err error
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return body, nil
+	case "gzip", "x-gzip":
+		r, err = gzip.NewReader(bytes.NewReader(body))
+	case "deflate":
+		r, err = zlib.NewReader(bytes.NewReader(body))
+	default:
+		return nil, ErrUnsupportedEncoding
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	decoded, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(decoded)) > limit {
+		return nil, ErrDecodedTooLarge
+	}
+	return decoded, nil
+}
+
+// Byte order marks
+var (
+	bomUTF8    = []byte{0xEF, 0xBB, 0xBF}
+	bomUTF16LE = []byte{0xFF, 0xFE}
+	bomUTF16BE = []byte{0xFE, 0xFF}
+)
+
+// documentCharset matches a charset declared inside an HTML or XML
+// document: <meta charset>, <meta http-equiv content> or <?xml encoding?>
+var documentCharset = regexp.MustCompile(`(?i)(?:<meta[^>]+charset\s*=\s*["']?|<\?xml[^>]+encoding\s*=\s*["'])([\w.:-]+)`)
+
+// sniffLimit is how much of a body is searched for a document charset
+const sniffLimit = 1024
+
+// SniffContent sets the detected content type and charset of a
+// response body, and flags a Content-Type that is missing or
+// contradicted by the body
+func SniffContent(req *CapturedRequest) {
+	header := http.Header(req.ResponseHeaders)
+	body, err := DecodeBody(header.Get("Content-Encoding"), req.ResponseBody, sniffDecodeLimit)
+	if err != nil || len(body) == 0 || req.OriginalSize > 0 {
+		return
+	}
+	declared, params, _ := mime.ParseMediaType(header.Get("Content-Type"))
+
+	req.DetectedContentType = sniffType(body)
+	if IsText(req.DetectedContentType) {
+		req.DetectedCharset = DetectCharset(body, params["charset"])
+	}
+	typeMismatch := contentFamily(declared) != contentFamily(req.DetectedContentType) &&
+		!compatible(declared, req.DetectedContentType)
+	req.ContentTypeMismatch = declared == "" || typeMismatch || charsetMismatch(params["charset"], body)
+}
+
+// sniffType detects a body's media type, telling JSON apart from plain
+// text
+func sniffType(body []byte) string {
+	trimmed := bytes.TrimLeft(bytes.TrimPrefix(body, bomUTF8), " \t\r\n")
+	if len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') && json.Valid(trimmed) {
+		return "application/json"
+	}
+	if bytes.HasPrefix(body, bomUTF16LE) || bytes.HasPrefix(body, bomUTF16BE) {
+		return "text/plain"
+	}
+	detected, _, _ := mime.ParseMediaType(http.DetectContentType(body))
+	return detected
+}
+
+// DetectCharset detects the charset of a text body: a byte order mark,
+// then valid UTF-8, then a charset the document or the header declares,
+// and windows-1252 (what browsers assume) as a last resort
+func DetectCharset(body []byte, declared string) string {
+	switch {
+	case bytes.HasPrefix(body, bomUTF8):
+		return "utf-8"
+	case bytes.HasPrefix(body, bomUTF16LE):
+		return "utf-16le"
+	case bytes.HasPrefix(body, bomUTF16BE):
+		return "utf-16be"
+	case utf8.Valid(body):
+		return "utf-8"
+	}
+	if m := documentCharset.FindSubmatch(body[:min(len(body), sniffLimit)]); m != nil && !isUTF8(string(m[1])) {
+		return strings.ToLower(string(m[1]))
+	}
+	if declared != "" && !isUTF8(declared) {
+		return strings.ToLower(declared)
+	}
+	return "windows-1252"
+}
+
+// charsetMismatch reports a declared charset the body cannot be in: UTF-8
+// for invalid UTF-8, or a single-byte charset for a UTF-16 body
+func charsetMismatch(declared string, body []byte) bool {
+	if declared == "" {
+		return false
+	}
+	utf16Body := bytes.HasPrefix(body, bomUTF16LE) || bytes.HasPrefix(body, bomUTF16BE)
+	if isUTF8(declared) {
+		return utf16Body || !utf8.Valid(body)
+	}
+	return utf16Body && !strings.HasPrefix(strings.ToLower(declared), "utf-16")
+}
+
+func isUTF8(charset string) bool {
+	charset = strings.ToLower(charset)
+	return charset == "utf-8" || charset == "utf8"
+}
+
+// contentFamily groups media types whose bodies look alike
+func contentFamily(mediaType string) string {
+	switch {
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		return "json"
+	case mediaType == "text/html" || mediaType == "application/xhtml+xml":
+		return "html"
+	case mediaType == "text/xml" || mediaType == "application/xml" || strings.HasSuffix(mediaType, "+xml"):
+		return "xml"
+	case IsText(mediaType):
+		return "text"
+	}
+	if family, _, ok := strings.Cut(mediaType, "/"); ok && family != "application" {
+		return family
+	}
+	return mediaType
+}
+
+// compatible reports declared and detected types that differ only
+// because sniffing is coarse: plain text detected for any textual type,
+// and generic binary detected for any non-textual one
+func compatible(declared, detected string) bool {
+	switch detected {
+	case "text/plain":
+		return IsText(declared)
+	case "application/octet-stream":
+		return !IsText(declared)
+	}
+	return false
+}
+
+// IsText reports whether a media type is textual
+func IsText(mediaType string) bool {
+	if strings.HasPrefix(mediaType, "text/") ||
+		strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml") {
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/javascript", "application/ecmascript",
+		"application/xml", "application/xhtml+xml", "application/x-www-form-urlencoded",
+		"application/graphql", "image/svg+xml":
+		return true
+	}
+	return false
+}
+
+// windows1252 maps bytes 0x80-0x9F, where windows-1252 differs from
+// ISO-8859-1; zero entries are unassigned and kept as C1 controls
+var windows1252 = [32]rune{
+	0x20AC, 0, 0x201A, 0x0192, 0x201E, 0x2026, 0x2020, 0x2021,
+	0x02C6, 0x2030, 0x0160, 0x2039, 0x0152, 0, 0x017D, 0,
+	0, 0x2018, 0x2019, 0x201C, 0x201D, 0x2022, 0x2013, 0x2014,
+	0x02DC, 0x2122, 0x0161, 0x203A, 0x0153, 0, 0x017E, 0x0178,
+}
+
+// ToUTF8 transcodes a text body in charset to UTF-8, dropping any byte
+// order mark. It knows UTF-8, UTF-16, and windows-1252 along with the
+// ISO-8859-1 and ASCII labels browsers decode as windows-1252, and
+// reports false for other charsets.
+func ToUTF8(body []byte, charset string) ([]byte, bool) {
+	switch strings.ToLower(charset) {
+	case "", "utf-8", "utf8":
+		return bytes.ToValidUTF8(bytes.TrimPrefix(body, bomUTF8), []byte("\uFFFD")), true
+	case "utf-16le", "utf-16be", "utf-16":
+		return fromUTF16(body, strings.ToLower(charset) == "utf-16le"), true
+	case "windows-1252", "cp1252", "x-cp1252", "iso-8859-1", "latin1", "l1", "us-ascii", "ascii":
+		return fromWindows1252(body), true
+	}
+	return nil, false
+}
+
+// fromUTF16 decodes UTF-16, honoring a byte order mark over littleEndian
+func fromUTF16(body []byte, littleEndian bool) []byte {
+	switch {
+	case bytes.HasPrefix(body, bomUTF16LE):
+		body, littleEndian = body[2:], true
+	case bytes.HasPrefix(body, bomUTF16BE):
+		body, littleEndian = body[2:], false
+	}
+	units := make([]uint16, len(body)/2)
+	for i := range units {
+		if littleEndian {
+			units[i] = uint16(body[2*i]) | uint16(body[2*i+1])<<8
+		} else {
+			units[i] = uint16(body[2*i])<<8 | uint16(body[2*i+1])
+		}
+	}
+	return []byte(string(utf16.Decode(units)))
+}
+
+// fromWindows1252 decodes windows-1252
+func fromWindows1252(body []byte) []byte {
+	out := make([]byte, 0, len(body))
+	for _, b := range body {
+		r := rune(b)
+		if b >= 0x80 && b < 0xA0 && windows1252[b-0x80] != 0 {
+			r = windows1252[b-0x80]
+		}
+		out = utf8.AppendRune(out, r)
+	}
+	return out
+}
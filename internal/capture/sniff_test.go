@@ -0,0 +1,51 @@
+package capture
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"testing"
+)
+
+func gzipped(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(data)
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecodeBodyCapsDecompressedSize(t *testing.T) {
+	plain := bytes.Repeat([]byte("{}"), 4<<20)
+	body := gzipped(t, plain)
+
+	if _, err := DecodeBody("gzip", body, int64(len(plain))-1); !errors.Is(err, ErrDecodedTooLarge) {
+		t.Fatalf("%d compressed bytes expanding to %d: error %v", len(body), len(plain), err)
+	}
+	decoded, err := DecodeBody("gzip", body, int64(len(plain)))
+	if err != nil || !bytes.Equal(decoded, plain) {
+		t.Fatalf("body within the limit: %d bytes, %v", len(decoded), err)
+	}
+	if _, err := DecodeBody("br", body, 1); !errors.Is(err, ErrUnsupportedEncoding) {
+		t.Fatalf("unknown encoding: error %v", err)
+	}
+}
+
+func TestSniffContentSkipsExpandingBodies(t *testing.T) {
+	req := NewCapturedRequest()
+	req.ResponseHeaders = map[string][]string{"Content-Encoding": {"gzip"}, "Content-Type": {"application/json"}}
+	req.ResponseBody = gzipped(t, bytes.Repeat([]byte(" "), sniffDecodeLimit+1))
+	SniffContent(req)
+	if req.DetectedContentType != "" {
+		t.Fatalf("sniffed %q from a body past the decode limit", req.DetectedContentType)
+	}
+
+	req.ResponseBody = gzipped(t, []byte(`{"a":1}`))
+	SniffContent(req)
+	if req.DetectedContentType != "application/json" || req.ContentTypeMismatch {
+		t.Fatalf("sniffed %q, mismatch %v", req.DetectedContentType, req.ContentTypeMismatch)
+	}
+}
@@ -1,43 +1,126 @@
 package capture
 
 import (
+	"cmp"
+	"slices"
 	"sync"
+	"sync/atomic"
+
+	"github.com/adamdrake/go_proxy/internal/hostmatch"
 )
 
-// Store provides thread-safe in-memory storage for captured requests
+// Store provides thread-safe in-memory storage for captured requests.
+//
+// API reads should not hold up capture. After every change, writers
+// publish the time-ordered list as an immutable view, which readers load
+// atomically without locking. The list and the host lists only change in
+// place past the length any reader has seen: appends land beyond it, and
+// inserting or removing within it copies the list first (insertByTime,
+// removeByID). As captures mostly arrive in order, most adds copy nothing.
+//
+// mu serializes writers and guards the host index, whose lists readers
+// take under a brief read lock, while indexMu guards the search index.
+// Writers take indexMu before releasing mu so index updates apply in the
+// same order as list updates; readers never hold both.
 type Store struct {
 	mu       sync.RWMutex
 	requests []*CapturedRequest
+	view     atomic.Pointer[storeView]
 	maxSize  int
+	byHost   map[string][]*CapturedRequest
+
+	// Redirects whose follow-up request has not been seen yet
+	redirects map[redirectKey][]*CapturedRequest
+
+	// Captures dropped to make room since the store was created
+	evictions int64
+
+	// Sequence number of the latest capture added
+	seq uint64
+
+	indexMu sync.RWMutex
+	index   *index
 
 	// Subscribers for real-time updates
 	subMu       sync.RWMutex
 	subscribers map[chan *CapturedRequest]struct{}
 }
 
+// storeView is the store as of its latest change
+type storeView struct {
+	requests  []*CapturedRequest
+	seq       uint64
+	evictions int64
+}
+
 // NewStore creates a new Store with the specified maximum size
 func NewStore(maxSize int) *Store {
 	if maxSize <= 0 {
 		maxSize = 1000 // Default to 1000 requests
 	}
-	return &Store{
+	s := &Store{
 		requests:    make([]*CapturedRequest, 0, maxSize),
 		maxSize:     maxSize,
+		index:       newIndex(),
+		byHost:      make(map[string][]*CapturedRequest),
+		redirects:   make(map[redirectKey][]*CapturedRequest),
 		subscribers: make(map[chan *CapturedRequest]struct{}),
 	}
+	s.publish()
+	return s
+}
+
+// publish makes the list as it stands the one readers see. Its capacity
+// is cut to its length, so nothing appended to a view reaches the store.
+// The caller must hold s.mu.
+func (s *Store) publish() {
+	s.view.Store(&storeView{
+		requests:  s.requests[:len(s.requests):len(s.requests)],
+		seq:       s.seq,
+		evictions: s.evictions,
+	})
 }
 
-// Add stores a new captured request
+// Add stores a new captured request, keeping the store ordered by Timestamp
 func (s *Store) Add(req *CapturedRequest) {
+	if req.HostUnicode == "" {
+		req.HostUnicode = unicodeHost(hostmatch.Normalize(req.Host))
+	}
+	if req.QueryParams == nil {
+		req.QueryParams = queryParams(req.URL)
+	}
+
+	// Tokenizing bodies is the expensive part of indexing; do it unlocked
+	tokens := indexTokens(req)
+
 	s.mu.Lock()
-	defer s.mu.Unlock()
 
 	// If at capacity, remove oldest request
+	var evicted *CapturedRequest
 	if len(s.requests) >= s.maxSize {
+		evicted = s.requests[0]
+		s.removeFromHostIndex(evicted)
+		s.forgetRedirect(evicted)
 		s.requests = s.requests[1:]
+		s.evictions++
 	}
 
-	s.requests = append(s.requests, req)
+	s.linkRedirect(req)
+	s.seq++
+	req.Seq = s.seq
+	s.requests = insertByTime(s.requests, req)
+	host := hostmatch.Normalize(req.Host)
+	s.byHost[host] = insertByTime(s.byHost[host], req)
+	s.publish()
+
+	s.indexMu.Lock()
+	s.mu.Unlock()
+
+	if evicted != nil {
+		s.index.remove(evicted.ID)
+	}
+	s.index.add(req.ID, tokens)
+	s.indexMu.Unlock()
 
 	// Notify subscribers (non-blocking)
 	s.notifySubscribers(req)
@@ -45,36 +128,30 @@ func (s *Store) Add(req *CapturedRequest) {
 
 // GetAll returns all captured requests
 func (s *Store) GetAll() []*CapturedRequest {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+	requests := s.view.Load().requests
 
 	// Return a copy to prevent external modification
-	result := make([]*CapturedRequest, len(s.requests))
-	copy(result, s.requests)
+	result := make([]*CapturedRequest, len(requests))
+	copy(result, requests)
 	return result
 }
 
 // GetRecent returns the most recent n requests
 func (s *Store) GetRecent(n int) []*CapturedRequest {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-
-	if n <= 0 || n > len(s.requests) {
-		n = len(s.requests)
+	requests := s.view.Load().requests
+	if n <= 0 || n > len(requests) {
+		n = len(requests)
 	}
 
-	start := len(s.requests) - n
+	start := len(requests) - n
 	result := make([]*CapturedRequest, n)
-	copy(result, s.requests[start:])
+	copy(result, requests[start:])
 	return result
 }
 
 // GetByID returns a specific request by ID
 func (s *Store) GetByID(id string) *CapturedRequest {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-
-	for _, req := range s.requests {
+	for _, req := range s.view.Load().requests {
 		if req.ID == id {
 			return req
 		}
@@ -82,19 +159,70 @@ func (s *Store) GetByID(id string) *CapturedRequest {
 	return nil
 }
 
+// LastSeq returns the sequence number of the latest capture added
+func (s *Store) LastSeq() uint64 {
+	return s.view.Load().seq
+}
+
+// After returns the stored captures added after sequence number seq, in
+// the order they were added, and the sequence number of the latest
+// capture to continue from
+func (s *Store) After(seq uint64) ([]*CapturedRequest, uint64) {
+	v := s.view.Load()
+
+	var result []*CapturedRequest
+	if seq < v.seq {
+		for _, req := range v.requests {
+			if req.Seq > seq {
+				result = append(result, req)
+			}
+		}
+		slices.SortFunc(result, func(a, b *CapturedRequest) int { return cmp.Compare(a.Seq, b.Seq) })
+	}
+	return result, v.seq
+}
+
 // Clear removes all stored requests
 func (s *Store) Clear() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	s.requests = make([]*CapturedRequest, 0, s.maxSize)
+	s.byHost = make(map[string][]*CapturedRequest)
+	s.redirects = make(map[redirectKey][]*CapturedRequest)
+	s.publish()
+
+	s.indexMu.Lock()
+	s.index = newIndex()
+	s.indexMu.Unlock()
+}
+
+// removeFromHostIndex drops an evicted request from the host index. The
+// caller must hold s.mu.
+func (s *Store) removeFromHostIndex(req *CapturedRequest) {
+	host := hostmatch.Normalize(req.Host)
+	list := removeByID(s.byHost[host], req.ID)
+	if len(list) == 0 {
+		delete(s.byHost, host)
+	} else {
+		s.byHost[host] = list
+	}
 }
 
 // Count returns the number of stored requests
 func (s *Store) Count() int {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
-	return len(s.requests)
+	return len(s.view.Load().requests)
+}
+
+// Capacity returns the most captures the store keeps
+func (s *Store) Capacity() int {
+	return s.maxSize
+}
+
+// Evictions returns how many captures were dropped to make room for
+// newer ones
+func (s *Store) Evictions() int64 {
+	return s.view.Load().evictions
 }
 
 // Subscribe returns a channel that receives new captured requests
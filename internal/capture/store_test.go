@@ -0,0 +1,139 @@
+package capture
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// benchCapture builds a representative capture
+func benchCapture(n int64) *CapturedRequest {
+	req := NewCapturedRequest()
+	req.ID = strconv.FormatInt(n, 10)
+	req.Method = http.MethodGet
+	req.Host = "bench.local"
+	req.URL = "http://bench.local/api/widgets/" + req.ID
+	req.Path = "/api/widgets/" + req.ID
+	req.RequestHeaders = map[string][]string{"User-Agent": {"bench"}}
+	req.ResponseHeaders = map[string][]string{"Content-Type": {"application/json"}}
+	req.ResponseBody = []byte(`{"widget": ` + req.ID + `, "name": "bench widget"}`)
+	req.StatusCode = http.StatusOK
+	return req
+}
+
+// fullStore returns a store filled to capacity
+func fullStore(b *testing.B) *Store {
+	b.Helper()
+	store := NewStore(10000)
+	for i := int64(0); i < 10000; i++ {
+		store.Add(benchCapture(-i))
+	}
+	return store
+}
+
+func TestStoreViewsUnchanged(t *testing.T) {
+	store := NewStore(3)
+	start := time.Now()
+	add := func(id string, offset time.Duration) {
+		req := NewCapturedRequest()
+		req.ID, req.Host, req.Timestamp = id, "example.com", start.Add(offset)
+		store.Add(req)
+	}
+	ids := func(requests []*CapturedRequest) string {
+		var s []string
+		for _, req := range requests {
+			s = append(s, req.ID)
+		}
+		return strings.Join(s, ",")
+	}
+
+	add("a", 1*time.Second)
+	add("c", 3*time.Second)
+	snap := store.Snapshot()
+	hostList := store.byHost["example.com"]
+
+	// In order, out of order, then evicting
+	add("d", 4*time.Second)
+	add("b", 2*time.Second)
+	add("e", 5*time.Second)
+
+	if got := ids(snap.Requests); got != "a,c" {
+		t.Errorf("snapshot holds %s, want a,c", got)
+	}
+	if got := ids(hostList); got != "a,c" {
+		t.Errorf("old host list holds %s, want a,c", got)
+	}
+	if got := ids(store.GetAll()); got != "c,d,e" {
+		t.Errorf("store holds %s, want c,d,e", got)
+	}
+	if got := ids(store.GetRange(time.Time{}, time.Time{}, "example.com")); got != "c,d,e" {
+		t.Errorf("host range holds %s, want c,d,e", got)
+	}
+	if store.Evictions() != 2 || store.LastSeq() != 5 {
+		t.Errorf("evictions = %d, last seq = %d, want 2 and 5", store.Evictions(), store.LastSeq())
+	}
+}
+
+func BenchmarkStoreAdd(b *testing.B) {
+	store := NewStore(10000)
+	var n atomic.Int64
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			store.Add(benchCapture(n.Add(1)))
+		}
+	})
+}
+
+func BenchmarkStoreAddWithReaders(b *testing.B) {
+	store := fullStore(b)
+
+	// Simulate a UI polling the API while capture runs
+	stop := make(chan struct{})
+	for i := 0; i < 4; i++ {
+		go func() {
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					store.GetRecent(100)
+					store.GetRange(time.Now().Add(-time.Minute), time.Time{}, "bench.local")
+				}
+			}
+		}()
+	}
+	defer close(stop)
+
+	var n atomic.Int64
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			store.Add(benchCapture(n.Add(1)))
+		}
+	})
+}
+
+func BenchmarkStoreGetRecent(b *testing.B) {
+	store := fullStore(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			store.GetRecent(100)
+		}
+	})
+}
+
+func BenchmarkStoreSearch(b *testing.B) {
+	store := fullStore(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		store.Search("widget 42")
+	}
+}
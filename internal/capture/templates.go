@@ -0,0 +1,79 @@
+package capture
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// idSegment matches path segments that are identifiers rather than
+// names: numbers, UUIDs and long hex strings
+var idSegment = regexp.MustCompile(`^(\d+|[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}|[0-9a-fA-F]{16,})$`)
+
+// PathTemplate replaces identifier segments of path with {id}, so that
+// /users/123/orders and /users/456/orders are one endpoint
+func PathTemplate(path string) string {
+	segments := strings.Split(path, "/")
+	for i, seg := range segments {
+		if idSegment.MatchString(seg) {
+			segments[i] = "{id}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// PathTemplates normalizes request paths into endpoint templates, so
+// per-endpoint aggregates aren't fragmented by IDs and slugs. Rules are
+// tried in order and the first whose pattern matches rewrites the
+// matched part of the path; automatic detection then folds any
+// remaining ID segments. A nil *PathTemplates applies automatic
+// detection only.
+type PathTemplates struct {
+	rules []templateRule
+	auto  bool
+}
+
+type templateRule struct {
+	pattern  *regexp.Regexp
+	template string
+}
+
+// NewPathTemplates returns templates with no rules, folding ID segments
+// automatically when auto is set
+func NewPathTemplates(auto bool) *PathTemplates {
+	return &PathTemplates{auto: auto}
+}
+
+// Add appends a rule given as regex=template, e.g.
+// ^/blog/[^/]+=/blog/{slug}. The template may refer to submatches as $1
+// or ${name}.
+func (t *PathTemplates) Add(spec string) error {
+	i := strings.LastIndex(spec, "=")
+	if i <= 0 {
+		return fmt.Errorf("path template %q: want regex=template", spec)
+	}
+	pattern, err := regexp.Compile(spec[:i])
+	if err != nil {
+		return fmt.Errorf("path template %q: %w", spec, err)
+	}
+	t.rules = append(t.rules, templateRule{pattern: pattern, template: spec[i+1:]})
+	return nil
+}
+
+// Template returns the endpoint template for path
+func (t *PathTemplates) Template(path string) string {
+	if t == nil {
+		return PathTemplate(path)
+	}
+	for _, rule := range t.rules {
+		if loc := rule.pattern.FindStringSubmatchIndex(path); loc != nil {
+			replaced := rule.pattern.ExpandString(nil, rule.template, path, loc)
+			path = path[:loc[0]] + string(replaced) + path[loc[1]:]
+			break
+		}
+	}
+	if t.auto {
+		path = PathTemplate(path)
+	}
+	return path
+}
@@ -0,0 +1,97 @@
+package capture
+
+import (
+	"sort"
+	"time"
+
+	"github.com/adamdrake/go_proxy/internal/hostmatch"
+)
+
+// insertByTime inserts req into list, which is sorted by Timestamp. Requests
+// are stored when they complete, so a long request may finish after one that
+// started later; those land slightly before the end rather than appended.
+//
+// Readers may hold list as it was, so it only changes in place past its
+// length: an insert before the end copies the list first.
+func insertByTime(list []*CapturedRequest, req *CapturedRequest) []*CapturedRequest {
+	i := len(list)
+	for i > 0 && list[i-1].Timestamp.After(req.Timestamp) {
+		i--
+	}
+	if i < len(list) {
+		list = append(make([]*CapturedRequest, 0, cap(list)+1), list...)
+	}
+	list = append(list, nil)
+	copy(list[i+1:], list[i:])
+	list[i] = req
+	return list
+}
+
+// removeByID removes the request with the given ID from list, copying it
+// unless the request is the first, as insertByTime does
+func removeByID(list []*CapturedRequest, id string) []*CapturedRequest {
+	for i, req := range list {
+		if req.ID == id {
+			if i == 0 {
+				// The common case: evicting the oldest entry
+				return list[1:]
+			}
+			return append(list[:i:i], list[i+1:]...)
+		}
+	}
+	return list
+}
+
+// timeRange returns the sub-slice of a Timestamp-sorted list within
+// [since, until]. Zero bounds are open.
+func timeRange(list []*CapturedRequest, since, until time.Time) []*CapturedRequest {
+	start := 0
+	if !since.IsZero() {
+		start = sort.Search(len(list), func(i int) bool {
+			return !list[i].Timestamp.Before(since)
+		})
+	}
+	end := len(list)
+	if !until.IsZero() {
+		end = sort.Search(len(list), func(i int) bool {
+			return list[i].Timestamp.After(until)
+		})
+	}
+	if start >= end {
+		return nil
+	}
+	return list[start:end]
+}
+
+// GetRange returns requests that started within [since, until], oldest
+// first, optionally limited to a single host. Zero bounds are open. Both
+// the time bounds and the host use indexes, so the cost is proportional to
+// the size of the result rather than the store.
+func (s *Store) GetRange(since, until time.Time, host string) []*CapturedRequest {
+	list := s.view.Load().requests
+	if host != "" {
+		// Host lists only change in place past their length, so one can
+		// be read after the lock is released
+		s.mu.RLock()
+		list = s.byHost[hostmatch.Normalize(host)]
+		s.mu.RUnlock()
+	}
+
+	matched := timeRange(list, since, until)
+	result := make([]*CapturedRequest, len(matched))
+	copy(result, matched)
+	return result
+}
+
+// Hosts returns the normalized hosts currently in the store with their
+// request counts
+func (s *Store) Hosts() map[string]int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	result := make(map[string]int, len(s.byHost))
+	for host, list := range s.byHost {
+		result[host] = len(list)
+	}
+	return result
+}
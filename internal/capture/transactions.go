@@ -0,0 +1,166 @@
+package capture
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Transaction kinds
+const (
+	// TransactionPageLoad starts with a browser navigation
+	TransactionPageLoad = "page_load"
+	// TransactionAppAction is a burst of requests with no navigation,
+	// such as an app's API calls after a tap
+	TransactionAppAction = "app_action"
+)
+
+// DefaultTransactionGap is how long a client may stay idle before its
+// next request starts a new transaction
+const DefaultTransactionGap = 2 * time.Second
+
+// refererWindow is how long after a transaction's last request a request
+// whose Referer names one of its URLs still joins it
+const refererWindow = 30 * time.Second
+
+// Transaction groups the requests of one page load or app action
+type Transaction struct {
+	// ID is the ID of the triggering request
+	ID   string `json:"id"`
+	Kind string `json:"kind"`
+	// URL of the triggering request
+	URL string `json:"url"`
+	// Client IP address the requests came from
+	Client string `json:"client"`
+
+	Start      time.Time `json:"start"`
+	End        time.Time `json:"end"`
+	DurationMS int64     `json:"duration_ms"`
+
+	RequestIDs    []string `json:"request_ids"`
+	Errors        int      `json:"errors"`
+	ResponseBytes int64    `json:"response_bytes"`
+
+	// Requests in start order
+	Requests []*CapturedRequest `json:"-"`
+}
+
+// Transactions groups requests into page loads and app actions. A
+// navigation (Sec-Fetch-Mode: navigate, or a GET for an HTML document)
+// starts a page load; other requests join the client's transaction whose
+// URLs their Referer names, else one on the same connection or from the
+// same client that was active within gap, else they start an app action.
+// Transactions are returned oldest first.
+func Transactions(requests []*CapturedRequest, gap time.Duration) []*Transaction {
+	if gap <= 0 {
+		gap = DefaultTransactionGap
+	}
+	sorted := make([]*CapturedRequest, len(requests))
+	copy(sorted, requests)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Timestamp.Before(sorted[j].Timestamp) })
+
+	var result []*Transaction
+	// Transactions still open to new members, per client IP
+	open := make(map[string][]*Transaction)
+	// Transaction of each URL and connection seen, for Referer and
+	// connection matching
+	byURL := make(map[string]*Transaction)
+	byConn := make(map[string]*Transaction)
+
+	for _, req := range sorted {
+		client := clientIP(req.ClientAddr)
+		var t *Transaction
+		if !isNavigation(req) {
+			t = joinable(req, open[client], byURL, byConn, gap)
+		}
+		if t == nil {
+			kind := TransactionAppAction
+			if isNavigation(req) {
+				kind = TransactionPageLoad
+			}
+			t = &Transaction{ID: req.ID, Kind: kind, URL: req.URL, Client: client, Start: req.Timestamp}
+			result = append(result, t)
+			open[client] = append(open[client], t)
+		}
+
+		t.Requests = append(t.Requests, req)
+		t.RequestIDs = append(t.RequestIDs, req.ID)
+		if end := req.Timestamp.Add(req.Duration); end.After(t.End) {
+			t.End = end
+		}
+		if req.Error != "" || req.StatusCode >= 400 {
+			t.Errors++
+		}
+		t.ResponseBytes += int64(len(req.ResponseBody))
+		byURL[req.URL] = t
+		if req.ClientAddr != "" {
+			byConn[req.ClientAddr] = t
+		}
+
+		// Drop transactions that can no longer grow
+		kept := open[client][:0]
+		for _, o := range open[client] {
+			if req.Timestamp.Sub(o.End) <= refererWindow {
+				kept = append(kept, o)
+			}
+		}
+		open[client] = kept
+	}
+
+	for _, t := range result {
+		t.DurationMS = t.End.Sub(t.Start).Milliseconds()
+	}
+	return result
+}
+
+// joinable finds the open transaction req belongs to, if any
+func joinable(req *CapturedRequest, open []*Transaction, byURL, byConn map[string]*Transaction, gap time.Duration) *Transaction {
+	isOpen := func(t *Transaction) bool {
+		for _, o := range open {
+			if o == t {
+				return true
+			}
+		}
+		return false
+	}
+
+	if referer := http.Header(req.RequestHeaders).Get("Referer"); referer != "" {
+		if t := byURL[referer]; t != nil && isOpen(t) {
+			return t
+		}
+	}
+	if t := byConn[req.ClientAddr]; t != nil && isOpen(t) && req.Timestamp.Sub(t.End) <= gap {
+		return t
+	}
+	var latest *Transaction
+	for _, t := range open {
+		if req.Timestamp.Sub(t.End) <= gap && (latest == nil || t.Start.After(latest.Start)) {
+			latest = t
+		}
+	}
+	return latest
+}
+
+// isNavigation reports whether req is a browser loading a page
+func isNavigation(req *CapturedRequest) bool {
+	header := http.Header(req.RequestHeaders)
+	if mode := header.Get("Sec-Fetch-Mode"); mode != "" {
+		return mode == "navigate"
+	}
+	if req.Method != http.MethodGet || req.IsTunnel {
+		return false
+	}
+	accept := header.Get("Accept")
+	contentType := http.Header(req.ResponseHeaders).Get("Content-Type")
+	return strings.HasPrefix(accept, "text/html") && strings.HasPrefix(contentType, "text/html")
+}
+
+// clientIP returns the IP part of a client address
+func clientIP(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
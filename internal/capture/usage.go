@@ -0,0 +1,99 @@
+package capture
+
+// captureOverhead approximates the memory of a capture beyond its bodies,
+// headers and messages: the struct itself and its short strings
+const captureOverhead = 1024
+
+// StoreStats describes what the store holds, for sizing -max-requests and
+// -max-body-size. Byte counts are approximations of memory held.
+type StoreStats struct {
+	Count       int     `json:"count"`
+	Capacity    int     `json:"capacity"`
+	UsedPercent float64 `json:"used_percent"`
+	Evictions   int64   `json:"evictions"`
+
+	ApproxBytes       int64  `json:"approx_bytes"`
+	BodyBytes         int64  `json:"body_bytes"`
+	HeaderBytes       int64  `json:"header_bytes"`
+	RawBytes          int64  `json:"raw_bytes"`
+	MessageBytes      int64  `json:"message_bytes"`
+	AvgEntryBytes     int64  `json:"avg_entry_bytes"`
+	LargestEntryBytes int64  `json:"largest_entry_bytes"`
+	LargestEntryID    string `json:"largest_entry_id,omitempty"`
+
+	// Request bodies spooled to disk and their full size, which the
+	// store does not hold
+	Spilled      int   `json:"spilled"`
+	SpilledBytes int64 `json:"spilled_bytes"`
+
+	// Bodies cut off at the body size limit
+	TruncatedRequests  int `json:"truncated_requests"`
+	TruncatedResponses int `json:"truncated_responses"`
+
+	Hosts       int `json:"hosts"`
+	IndexTokens int `json:"index_tokens"`
+}
+
+// Stats reports the store's size and what takes up its memory
+func (s *Store) Stats() StoreStats {
+	s.mu.RLock()
+	stats := StoreStats{
+		Count:     len(s.requests),
+		Capacity:  s.maxSize,
+		Evictions: s.evictions,
+		Hosts:     len(s.byHost),
+	}
+	for _, req := range s.requests {
+		body := int64(len(req.RequestBody) + len(req.ResponseBody))
+		headers := headerBytes(req.RequestHeaders) + headerBytes(req.ResponseHeaders)
+		raw := int64(len(req.RawRequest) + len(req.RawResponse))
+		var messages int64
+		for _, msg := range req.WebSocketMessages {
+			messages += int64(len(msg.Payload))
+		}
+		size := captureOverhead + body + headers + raw + messages + headerBytes(req.QueryParams)
+
+		stats.BodyBytes += body
+		stats.HeaderBytes += headers
+		stats.RawBytes += raw
+		stats.MessageBytes += messages
+		stats.ApproxBytes += size
+		if size > stats.LargestEntryBytes {
+			stats.LargestEntryBytes, stats.LargestEntryID = size, req.ID
+		}
+		if req.Upload != nil {
+			stats.Spilled++
+			stats.SpilledBytes += req.Upload.Size
+		}
+		if req.RequestBodyTruncated {
+			stats.TruncatedRequests++
+		}
+		if req.ResponseBodyTruncated {
+			stats.TruncatedResponses++
+		}
+	}
+	s.mu.RUnlock()
+
+	s.indexMu.RLock()
+	stats.IndexTokens = len(s.index.postings)
+	s.indexMu.RUnlock()
+
+	if stats.Count > 0 {
+		stats.AvgEntryBytes = stats.ApproxBytes / int64(stats.Count)
+	}
+	if stats.Capacity > 0 {
+		stats.UsedPercent = float64(stats.Count) * 100 / float64(stats.Capacity)
+	}
+	return stats
+}
+
+// headerBytes counts the names and values of headers
+func headerBytes(header map[string][]string) int64 {
+	var n int64
+	for name, values := range header {
+		for _, v := range values {
+			n += int64(len(name) + len(v))
+		}
+	}
+	return n
+}
@@ -0,0 +1,125 @@
+package capture
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// WaterfallEntry is one request's bar in a network waterfall. Offsets and
+// durations are in milliseconds from the start of the transaction.
+type WaterfallEntry struct {
+	ID         string  `json:"id"`
+	Method     string  `json:"method"`
+	URL        string  `json:"url"`
+	StatusCode int     `json:"status_code"`
+	Size       int     `json:"size"`
+	StartMS    float64 `json:"start_ms"`
+	DurationMS float64 `json:"duration_ms"`
+	EndMS      float64 `json:"end_ms"`
+
+	// Other requests in flight at any point while this one ran
+	Parallel int `json:"parallel"`
+	// Set when nothing else was in flight for the whole request, so it
+	// alone held the page up
+	Blocking bool `json:"blocking"`
+	// Request of the transaction whose URL is this one's Referer
+	Initiator string `json:"initiator,omitempty"`
+}
+
+// Waterfall lays out a transaction's requests on a timeline
+type Waterfall struct {
+	TransactionID string  `json:"transaction_id"`
+	TotalMS       float64 `json:"total_ms"`
+
+	// Most requests in flight at once
+	MaxConcurrency int `json:"max_concurrency"`
+	// Time with exactly one request in flight, and with none
+	SerialMS float64 `json:"serial_ms"`
+	IdleMS   float64 `json:"idle_ms"`
+
+	Entries []WaterfallEntry `json:"entries"`
+}
+
+// BuildWaterfall computes the waterfall of t
+func BuildWaterfall(t *Transaction) Waterfall {
+	w := Waterfall{
+		TransactionID: t.ID,
+		TotalMS:       ms(t.End.Sub(t.Start)),
+		Entries:       make([]WaterfallEntry, 0, len(t.Requests)),
+	}
+
+	idByURL := make(map[string]string)
+	for _, req := range t.Requests {
+		if _, ok := idByURL[req.URL]; !ok {
+			idByURL[req.URL] = req.ID
+		}
+	}
+
+	for i, req := range t.Requests {
+		start, end := req.Timestamp, req.Timestamp.Add(req.Duration)
+		e := WaterfallEntry{
+			ID:         req.ID,
+			Method:     req.Method,
+			URL:        req.URL,
+			StatusCode: req.StatusCode,
+			Size:       len(req.ResponseBody),
+			StartMS:    ms(start.Sub(t.Start)),
+			DurationMS: ms(req.Duration),
+			EndMS:      ms(end.Sub(t.Start)),
+		}
+		for j, other := range t.Requests {
+			if j != i && other.Timestamp.Before(end) && start.Before(other.Timestamp.Add(other.Duration)) {
+				e.Parallel++
+			}
+		}
+		e.Blocking = e.Parallel == 0
+		if referer := http.Header(req.RequestHeaders).Get("Referer"); referer != "" {
+			if id := idByURL[referer]; id != req.ID {
+				e.Initiator = id
+			}
+		}
+		w.Entries = append(w.Entries, e)
+	}
+
+	// Sweep the start and end events for concurrency over time
+	type event struct {
+		at    time.Time
+		delta int
+	}
+	events := make([]event, 0, 2*len(t.Requests))
+	for _, req := range t.Requests {
+		events = append(events, event{req.Timestamp, 1}, event{req.Timestamp.Add(req.Duration), -1})
+	}
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].at.Equal(events[j].at) {
+			return events[i].delta < events[j].delta
+		}
+		return events[i].at.Before(events[j].at)
+	})
+	inFlight, last := 0, t.Start
+	for _, ev := range events {
+		switch span := ms(ev.at.Sub(last)); inFlight {
+		case 0:
+			w.IdleMS += span
+		case 1:
+			w.SerialMS += span
+		}
+		inFlight += ev.delta
+		w.MaxConcurrency = max(w.MaxConcurrency, inFlight)
+		last = ev.at
+	}
+	w.IdleMS = round3(w.IdleMS)
+	w.SerialMS = round3(w.SerialMS)
+	return w
+}
+
+// ms converts d to milliseconds, to the microsecond
+func ms(d time.Duration) float64 {
+	return round3(float64(d) / float64(time.Millisecond))
+}
+
+func round3(f float64) float64 {
+	return math.Round(f*1000) / 1000
+}
@@ -0,0 +1,237 @@
+// Package collector forwards captures to a central go_proxy instance
+// running in collector mode, so proxies on many devices and CI agents can
+// be watched in one place
+package collector
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+)
+
+// Path is the collector's ingestion endpoint
+const Path = "/api/collect"
+
+// SourceHeader names the forwarding instance in each batch
+const SourceHeader = "X-GoProxy-Source"
+
+const (
+	deliveryTimeout = 30 * time.Second
+	maxBackoff      = time.Minute
+)
+
+// Config configures a Forwarder
+type Config struct {
+	// Collector API base URL, e.g. http://collector.example:8081
+	URL string
+
+	// Bearer token for the collector's API, when it requires one
+	Token string
+
+	// Name captures are labelled with on the collector
+	Source string
+
+	// Captures per batch (default 100) and the longest a capture waits
+	// before its batch is sent (default 2s)
+	BatchSize     int
+	FlushInterval time.Duration
+
+	// Captures held while the collector is unreachable; beyond this the
+	// oldest are dropped (default 10000)
+	MaxPending int
+}
+
+// Forwarder sends a store's new captures to a collector in gzipped NDJSON
+// batches, retrying failed batches with exponential backoff
+type Forwarder struct {
+	config Config
+	client *http.Client
+
+	mu      sync.Mutex
+	pending []*capture.CapturedRequest
+	dropped int
+	kick    chan struct{}
+}
+
+// New validates config and returns a forwarder for it
+func New(config Config) (*Forwarder, error) {
+	u, err := url.Parse(config.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("collector URL must be http(s)://host[:port], got %q", config.URL)
+	}
+	if config.Source == "" {
+		return nil, fmt.Errorf("a source name is required")
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = 100
+	}
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = 2 * time.Second
+	}
+	if config.MaxPending <= 0 {
+		config.MaxPending = 10000
+	}
+	config.URL = strings.TrimSuffix(config.URL, "/") + Path
+	return &Forwarder{
+		config: config,
+		client: &http.Client{Timeout: deliveryTimeout},
+		kick:   make(chan struct{}, 1),
+	}, nil
+}
+
+// Run forwards captures added to store until ctx is done, then makes one
+// last attempt to deliver what is pending
+func (f *Forwarder) Run(ctx context.Context, store *capture.Store) {
+	updates := store.Subscribe()
+	defer store.Unsubscribe(updates)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f.deliver(ctx)
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			<-done
+			final, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			f.flush(final)
+			return
+		case req := <-updates:
+			f.enqueue(req)
+		}
+	}
+}
+
+// enqueue adds a capture to the pending batch, dropping the oldest when
+// the collector has fallen too far behind
+func (f *Forwarder) enqueue(req *capture.CapturedRequest) {
+	f.mu.Lock()
+	f.pending = append(f.pending, req)
+	if over := len(f.pending) - f.config.MaxPending; over > 0 {
+		f.pending = f.pending[over:]
+		f.dropped += over
+	}
+	full := len(f.pending) >= f.config.BatchSize
+	f.mu.Unlock()
+
+	if full {
+		select {
+		case f.kick <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// deliver sends pending batches whenever one fills up or the flush
+// interval passes, backing off while the collector is failing
+func (f *Forwarder) deliver(ctx context.Context) {
+	ticker := time.NewTicker(f.config.FlushInterval)
+	defer ticker.Stop()
+
+	var backoff time.Duration
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-f.kick:
+		}
+
+		if err := f.flush(ctx); err != nil {
+			backoff = min(max(2*backoff, f.config.FlushInterval), maxBackoff)
+			log.Printf("Forwarding captures to %s failed, retrying in %s: %v", f.config.URL, backoff, err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(backoff):
+			}
+			continue
+		}
+		if backoff > 0 {
+			log.Printf("Forwarding captures to %s resumed", f.config.URL)
+			backoff = 0
+		}
+	}
+}
+
+// flush sends every pending capture, one batch at a time. Captures stay
+// pending until the collector accepts their batch; a batch delivered
+// twice is harmless since the collector skips captures it already has.
+func (f *Forwarder) flush(ctx context.Context) error {
+	for {
+		f.mu.Lock()
+		batch := f.pending[:min(len(f.pending), f.config.BatchSize)]
+		dropped := f.dropped
+		f.dropped = 0
+		f.mu.Unlock()
+
+		if dropped > 0 {
+			log.Printf("Dropped %d captures the collector could not take in time", dropped)
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := f.send(ctx, batch); err != nil {
+			return err
+		}
+
+		f.mu.Lock()
+		// enqueue may have trimmed the front while the batch was in flight
+		if n := len(batch); len(f.pending) >= n && f.pending[0] == batch[0] {
+			f.pending = f.pending[n:]
+		}
+		f.mu.Unlock()
+	}
+}
+
+// send posts one batch as gzipped JSON lines
+func (f *Forwarder) send(ctx context.Context, batch []*capture.CapturedRequest) error {
+	var body bytes.Buffer
+	zw := gzip.NewWriter(&body)
+	enc := json.NewEncoder(zw)
+	for _, req := range batch {
+		if err := enc.Encode(req); err != nil {
+			return err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, deliveryTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, f.config.URL, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	req.Header.Set("Content-Encoding", "gzip")
+	req.Header.Set(SourceHeader, f.config.Source)
+	if f.config.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+f.config.Token)
+	}
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 256))
+		return fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
@@ -0,0 +1,308 @@
+package dnscache
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// lookupTimeout bounds a single shared upstream lookup
+const lookupTimeout = 10 * time.Second
+
+// sweepInterval is how often inserts also drop expired entries
+const sweepInterval = time.Minute
+
+// Config controls how long resolved and failed lookups are cached
+type Config struct {
+	// DefaultTTL is used when the record TTL is unknown (e.g. /etc/hosts entries)
+	DefaultTTL time.Duration
+	// MinTTL and MaxTTL clamp the TTLs reported by the resolver
+	MinTTL time.Duration
+	MaxTTL time.Duration
+	// NegativeTTL is how long NXDOMAIN / no-such-host results are cached
+	NegativeTTL time.Duration
+	// MaxEntries bounds the number of cached hosts; the entry closest to
+	// expiry is evicted to make room. Zero means unbounded.
+	MaxEntries int
+}
+
+// DefaultConfig returns a Config with sensible defaults
+func DefaultConfig() Config {
+	return Config{
+		DefaultTTL:  30 * time.Second,
+		MinTTL:      5 * time.Second,
+		MaxTTL:      10 * time.Minute,
+		NegativeTTL: 5 * time.Second,
+		MaxEntries:  10000,
+	}
+}
+
+// Entry is a point-in-time view of a cached lookup
+type Entry struct {
+	Host     string    `json:"host"`
+	Addrs    []string  `json:"addrs,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Negative bool      `json:"negative"`
+	Expires  time.Time `json:"expires"`
+	TTL      int64     `json:"ttl_seconds"`
+	Hits     int64     `json:"hits"`
+	Pending  bool      `json:"pending,omitempty"`
+}
+
+// Stats holds cache-wide counters
+type Stats struct {
+	Entries int   `json:"entries"`
+	Hits    int64 `json:"hits"`
+	Misses  int64 `json:"misses"`
+}
+
+// entry is a cached (or in-flight) lookup
+type entry struct {
+	addrs   []net.IPAddr
+	err     error
+	expires time.Time
+	hits    int64
+	ready   chan struct{}
+}
+
+// Cache is a thread-safe DNS cache for upstream lookups. Concurrent lookups
+// for the same host share a single resolver query.
+type Cache struct {
+	config   Config
+	resolver *net.Resolver
+	lookup   func(ctx context.Context, host string) ([]net.IPAddr, error)
+
+	mu        sync.Mutex
+	entries   map[string]*entry
+	lastSweep time.Time
+	hits      int64
+	misses    int64
+}
+
+// New creates a new Cache with the given configuration
+func New(config Config) *Cache {
+	c := &Cache{
+		config:  config,
+		entries: make(map[string]*entry),
+	}
+
+	// Use the pure Go resolver so answers pass through recordingDial,
+	// which is where record TTLs are observed
+	dialer := &net.Dialer{}
+	c.resolver = &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return recordingDial(ctx, dialer, network, address)
+		},
+	}
+	c.lookup = c.resolver.LookupIPAddr
+
+	return c
+}
+
+// LookupIPAddr returns the addresses for host, from the cache when fresh
+func (c *Cache) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IPAddr{{IP: ip}}, nil
+	}
+
+	c.mu.Lock()
+	if e, ok := c.entries[host]; ok {
+		select {
+		case <-e.ready:
+			if time.Now().Before(e.expires) {
+				e.hits++
+				c.hits++
+				addrs, err := e.addrs, e.err
+				c.mu.Unlock()
+				return addrs, err
+			}
+		default:
+			// Another caller is already resolving this host
+			c.hits++
+			c.mu.Unlock()
+			select {
+			case <-e.ready:
+				c.mu.Lock()
+				addrs, err := e.addrs, e.err
+				c.mu.Unlock()
+				return addrs, err
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+	}
+
+	e := &entry{ready: make(chan struct{})}
+	c.makeRoom(host)
+	c.entries[host] = e
+	c.misses++
+	c.mu.Unlock()
+
+	addrs, ttl, err := c.resolve(host)
+
+	c.mu.Lock()
+	e.addrs, e.err = addrs, err
+	e.expires = time.Now().Add(ttl)
+	if ttl <= 0 && c.entries[host] == e {
+		// Transient failures are handed to waiters but not cached
+		delete(c.entries, host)
+	}
+	c.mu.Unlock()
+	close(e.ready)
+
+	return addrs, err
+}
+
+// resolve performs an uncached lookup and decides how long to keep the result
+func (c *Cache) resolve(host string) ([]net.IPAddr, time.Duration, error) {
+	// Detach from the caller's context: other callers may be waiting on
+	// this lookup, so one client going away must not fail it for everyone
+	ctx, cancel := context.WithTimeout(context.Background(), lookupTimeout)
+	defer cancel()
+
+	rec := &ttlRecorder{}
+	addrs, err := c.lookup(withRecorder(ctx, rec), host)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, c.config.NegativeTTL, err
+		}
+		return nil, 0, err
+	}
+
+	ttl := c.config.DefaultTTL
+	if seconds, ok := rec.min(); ok {
+		ttl = time.Duration(seconds) * time.Second
+	}
+	if ttl < c.config.MinTTL {
+		ttl = c.config.MinTTL
+	}
+	if c.config.MaxTTL > 0 && ttl > c.config.MaxTTL {
+		ttl = c.config.MaxTTL
+	}
+
+	return addrs, ttl, nil
+}
+
+// makeRoom drops expired entries when a sweep is due or the cache is full,
+// then evicts the resolved entry closest to expiry while it is still full.
+// host is about to be inserted. The caller holds c.mu.
+func (c *Cache) makeRoom(host string) {
+	if _, ok := c.entries[host]; ok {
+		return
+	}
+	full := c.config.MaxEntries > 0 && len(c.entries) >= c.config.MaxEntries
+	now := time.Now()
+	if !full && now.Sub(c.lastSweep) < sweepInterval {
+		return
+	}
+
+	c.lastSweep = now
+	for h, e := range c.entries {
+		if isReady(e) && !now.Before(e.expires) {
+			delete(c.entries, h)
+		}
+	}
+
+	for c.config.MaxEntries > 0 && len(c.entries) >= c.config.MaxEntries {
+		var victim string
+		var soonest time.Time
+		for h, e := range c.entries {
+			if isReady(e) && (victim == "" || e.expires.Before(soonest)) {
+				victim, soonest = h, e.expires
+			}
+		}
+		if victim == "" {
+			// Every entry is an in-flight lookup; those finish on their own
+			return
+		}
+		delete(c.entries, victim)
+	}
+}
+
+// isReady reports whether an entry's lookup has completed
+func isReady(e *entry) bool {
+	select {
+	case <-e.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// Snapshot returns the current cache contents sorted by host
+func (c *Cache) Snapshot() []Entry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	result := make([]Entry, 0, len(c.entries))
+	for host, e := range c.entries {
+		out := Entry{Host: host}
+		select {
+		case <-e.ready:
+		default:
+			out.Pending = true
+			result = append(result, out)
+			continue
+		}
+		if !now.Before(e.expires) {
+			continue
+		}
+		for _, addr := range e.addrs {
+			out.Addrs = append(out.Addrs, addr.String())
+		}
+		if e.err != nil {
+			out.Error = e.err.Error()
+			out.Negative = true
+		}
+		out.Expires = e.expires
+		out.TTL = int64(e.expires.Sub(now).Seconds())
+		out.Hits = e.hits
+		result = append(result, out)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Host < result[j].Host
+	})
+	return result
+}
+
+// Stats returns cache-wide counters
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return Stats{
+		Entries: len(c.entries),
+		Hits:    c.hits,
+		Misses:  c.misses,
+	}
+}
+
+// Flush removes all cached entries. In-flight lookups still complete for
+// their waiters but are not cached.
+func (c *Cache) Flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[string]*entry)
+}
+
+// Remove evicts a single host, reporting whether it was cached
+func (c *Cache) Remove(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, ok := c.entries[host]
+	delete(c.entries, host)
+	return ok
+}
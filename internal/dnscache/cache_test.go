@@ -0,0 +1,171 @@
+package dnscache
+
+import (
+	"context"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeLookup answers every host with 192.0.2.1 and reports ttl to the
+// lookup's recorder, counting the queries it serves
+func fakeLookup(ttl uint32, queries *atomic.Int64) func(context.Context, string) ([]net.IPAddr, error) {
+	return func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		queries.Add(1)
+		ctx.Value(recorderKey{}).(*ttlRecorder).observe(ttl)
+		return []net.IPAddr{{IP: net.IPv4(192, 0, 2, 1)}}, nil
+	}
+}
+
+// expiresIn returns how long host's entry has left to live
+func expiresIn(t *testing.T, c *Cache, host string) time.Duration {
+	t.Helper()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[host]
+	if !ok {
+		t.Fatalf("%s not cached", host)
+	}
+	return time.Until(e.expires)
+}
+
+func TestTTLClamping(t *testing.T) {
+	config := Config{MinTTL: 5 * time.Second, MaxTTL: time.Minute}
+	for _, tc := range []struct {
+		record uint32
+		want   time.Duration
+	}{
+		{record: 1, want: 5 * time.Second},
+		{record: 30, want: 30 * time.Second},
+		{record: 3600, want: time.Minute},
+	} {
+		var queries atomic.Int64
+		c := New(config)
+		c.lookup = fakeLookup(tc.record, &queries)
+		if _, err := c.LookupIPAddr(context.Background(), "example.com"); err != nil {
+			t.Fatal(err)
+		}
+		if got := expiresIn(t, c, "example.com"); got > tc.want || got < tc.want-time.Second {
+			t.Errorf("record TTL %ds cached for %v, want %v", tc.record, got, tc.want)
+		}
+	}
+}
+
+func TestNegativeCaching(t *testing.T) {
+	var queries atomic.Int64
+	c := New(Config{NegativeTTL: time.Minute})
+	c.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		queries.Add(1)
+		if host == "missing.example" {
+			return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		return nil, &net.DNSError{Err: "server misbehaving", Name: host, IsTemporary: true}
+	}
+
+	for range 3 {
+		if _, err := c.LookupIPAddr(context.Background(), "missing.example"); err == nil {
+			t.Fatal("lookup of missing host succeeded")
+		}
+	}
+	if n := queries.Load(); n != 1 {
+		t.Fatalf("NXDOMAIN looked up %d times, want 1", n)
+	}
+	if got := expiresIn(t, c, "missing.example"); got < 59*time.Second {
+		t.Errorf("NXDOMAIN cached for %v, want NegativeTTL", got)
+	}
+
+	queries.Store(0)
+	for range 2 {
+		c.LookupIPAddr(context.Background(), "flaky.example")
+	}
+	if n := queries.Load(); n != 2 {
+		t.Errorf("transient failure looked up %d times, want 2 (uncached)", n)
+	}
+}
+
+func TestLookupsCoalesce(t *testing.T) {
+	release := make(chan struct{})
+	var queries atomic.Int64
+	c := New(Config{DefaultTTL: time.Minute})
+	c.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		queries.Add(1)
+		<-release
+		return []net.IPAddr{{IP: net.IPv4(192, 0, 2, 1)}}, nil
+	}
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			addrs, err := c.LookupIPAddr(context.Background(), "Example.COM.")
+			if err != nil || len(addrs) != 1 {
+				t.Errorf("lookup = %v, %v", addrs, err)
+			}
+		}()
+	}
+	// Wait until every caller is either resolving or waiting
+	for {
+		stats := c.Stats()
+		if stats.Hits+stats.Misses == 10 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	if n := queries.Load(); n != 1 {
+		t.Errorf("concurrent lookups made %d queries, want 1", n)
+	}
+}
+
+func TestFlush(t *testing.T) {
+	var queries atomic.Int64
+	c := New(DefaultConfig())
+	c.lookup = fakeLookup(60, &queries)
+
+	c.LookupIPAddr(context.Background(), "a.example")
+	c.LookupIPAddr(context.Background(), "b.example")
+	c.Flush()
+	if n := c.Stats().Entries; n != 0 {
+		t.Fatalf("%d entries after Flush", n)
+	}
+	c.LookupIPAddr(context.Background(), "a.example")
+	if n := queries.Load(); n != 3 {
+		t.Errorf("lookup after Flush served from cache (%d queries)", n)
+	}
+}
+
+func TestMaxEntriesEvicts(t *testing.T) {
+	c := New(Config{NegativeTTL: time.Minute, MaxEntries: 2})
+	c.lookup = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	for _, host := range []string{"a.example", "b.example", "c.example", "d.example"} {
+		c.LookupIPAddr(context.Background(), host)
+		if n := c.Stats().Entries; n > 2 {
+			t.Fatalf("%d entries after %s, want at most 2", n, host)
+		}
+	}
+}
+
+func TestInsertSweepsExpired(t *testing.T) {
+	var queries atomic.Int64
+	c := New(Config{DefaultTTL: time.Minute})
+	c.lookup = fakeLookup(60, &queries)
+
+	c.LookupIPAddr(context.Background(), "a.example")
+	c.mu.Lock()
+	c.entries["a.example"].expires = time.Now().Add(-time.Second)
+	c.lastSweep = time.Now().Add(-sweepInterval)
+	c.mu.Unlock()
+
+	c.LookupIPAddr(context.Background(), "b.example")
+	if _, ok := c.entries["a.example"]; ok {
+		t.Error("expired entry survived the sweep")
+	}
+}
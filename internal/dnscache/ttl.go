@@ -0,0 +1,175 @@
+package dnscache
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+)
+
+// DNS record types whose TTLs bound the lifetime of an address lookup
+const (
+	typeA     = 1
+	typeCNAME = 5
+	typeAAAA  = 28
+)
+
+// ttlRecorder collects the smallest answer TTL seen during a lookup
+type ttlRecorder struct {
+	mu   sync.Mutex
+	ttl  uint32
+	seen bool
+}
+
+// observe records a TTL, keeping the minimum
+func (r *ttlRecorder) observe(ttl uint32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.seen || ttl < r.ttl {
+		r.ttl = ttl
+		r.seen = true
+	}
+}
+
+// min returns the smallest TTL observed, if any
+func (r *ttlRecorder) min() (uint32, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.ttl, r.seen
+}
+
+type recorderKey struct{}
+
+// withRecorder attaches a ttlRecorder to the lookup context. The Go resolver
+// passes the lookup context through to Resolver.Dial.
+func withRecorder(ctx context.Context, rec *ttlRecorder) context.Context {
+	return context.WithValue(ctx, recorderKey{}, rec)
+}
+
+// recordingDial dials the nameserver and wraps the connection so that
+// answer TTLs are reported to the recorder in ctx
+func recordingDial(ctx context.Context, dialer *net.Dialer, network, address string) (net.Conn, error) {
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	rec, ok := ctx.Value(recorderKey{}).(*ttlRecorder)
+	if !ok {
+		return conn, nil
+	}
+
+	// The resolver uses datagram framing only for net.PacketConn, so the
+	// UDP wrapper must keep that interface
+	if udp, ok := conn.(*net.UDPConn); ok {
+		return &recordingPacketConn{UDPConn: udp, rec: rec}, nil
+	}
+	return &recordingStreamConn{Conn: conn, rec: rec}, nil
+}
+
+// recordingPacketConn inspects each DNS response datagram
+type recordingPacketConn struct {
+	*net.UDPConn
+	rec *ttlRecorder
+}
+
+func (c *recordingPacketConn) Read(b []byte) (int, error) {
+	n, err := c.UDPConn.Read(b)
+	if n > 0 {
+		if ttl, ok := minAnswerTTL(b[:n]); ok {
+			c.rec.observe(ttl)
+		}
+	}
+	return n, err
+}
+
+// recordingStreamConn inspects length-prefixed DNS responses over TCP
+type recordingStreamConn struct {
+	net.Conn
+	rec *ttlRecorder
+	buf []byte
+}
+
+func (c *recordingStreamConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.buf = append(c.buf, b[:n]...)
+		for len(c.buf) >= 2 {
+			size := int(binary.BigEndian.Uint16(c.buf))
+			if len(c.buf) < 2+size {
+				break
+			}
+			if ttl, ok := minAnswerTTL(c.buf[2 : 2+size]); ok {
+				c.rec.observe(ttl)
+			}
+			c.buf = c.buf[2+size:]
+		}
+	}
+	return n, err
+}
+
+var errShortMessage = errors.New("dns message too short")
+
+// minAnswerTTL returns the smallest TTL among the address and CNAME answers
+// in a DNS response message
+func minAnswerTTL(msg []byte) (uint32, bool) {
+	if len(msg) < 12 {
+		return 0, false
+	}
+
+	questions := int(binary.BigEndian.Uint16(msg[4:6]))
+	answers := int(binary.BigEndian.Uint16(msg[6:8]))
+
+	off := 12
+	var err error
+	for i := 0; i < questions; i++ {
+		if off, err = skipName(msg, off); err != nil {
+			return 0, false
+		}
+		off += 4 // type + class
+	}
+
+	var ttl uint32
+	found := false
+	for i := 0; i < answers; i++ {
+		if off, err = skipName(msg, off); err != nil {
+			return 0, false
+		}
+		if off+10 > len(msg) {
+			return 0, false
+		}
+		typ := binary.BigEndian.Uint16(msg[off:])
+		recTTL := binary.BigEndian.Uint32(msg[off+4:])
+		rdLen := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10 + rdLen
+
+		if typ == typeA || typ == typeAAAA || typ == typeCNAME {
+			if !found || recTTL < ttl {
+				ttl = recTTL
+				found = true
+			}
+		}
+	}
+
+	return ttl, found
+}
+
+// skipName returns the offset just past the (possibly compressed) name at off
+func skipName(msg []byte, off int) (int, error) {
+	for {
+		if off >= len(msg) {
+			return 0, errShortMessage
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			return off + 1, nil
+		case l&0xC0 == 0xC0:
+			return off + 2, nil
+		default:
+			off += 1 + l
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package export
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+)
+
+// CodeLanguages lists the languages accepted by Code
+var CodeLanguages = []string{"go", "python", "js"}
+
+var (
+	// ErrUnknownLanguage is returned by Code for a language it cannot render
+	ErrUnknownLanguage = errors.New("unknown language")
+	// ErrNotHTTP is returned by Code for tunnels and non-HTTP captures
+	ErrNotHTTP = errors.New("capture is not an HTTP request")
+)
+
+// codeSkipHeaders are set by the HTTP client itself, or only meaningful
+// on the hop to the proxy
+var codeSkipHeaders = map[string]bool{
+	"Host":                true,
+	"Content-Length":      true,
+	"Connection":          true,
+	"Proxy-Connection":    true,
+	"Proxy-Authorization": true,
+	"Keep-Alive":          true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+}
+
+// Code renders a captured request as client code: a Go test using
+// net/http, a Python script using requests, or JavaScript using fetch.
+// The Go test asserts the captured status code.
+func Code(req *capture.CapturedRequest, lang string) (string, error) {
+	if req.IsTunnel {
+		return "", ErrNotHTTP
+	}
+	if u, err := url.Parse(req.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return "", ErrNotHTTP
+	}
+
+	switch lang {
+	case "go":
+		return goCode(req), nil
+	case "python":
+		return pythonCode(req), nil
+	case "js":
+		return jsCode(req), nil
+	}
+	return "", fmt.Errorf("%w %q, want one of %s", ErrUnknownLanguage, lang, strings.Join(CodeLanguages, ", "))
+}
+
+// codeHeader is one header with all its values
+type codeHeader struct {
+	name   string
+	values []string
+}
+
+// codeHeaders returns the headers worth reproducing, sorted by name
+func codeHeaders(req *capture.CapturedRequest) []codeHeader {
+	var headers []codeHeader
+	for name, values := range req.RequestHeaders {
+		if codeSkipHeaders[http.CanonicalHeaderKey(name)] {
+			continue
+		}
+		headers = append(headers, codeHeader{name, values})
+	}
+	sort.Slice(headers, func(i, j int) bool { return headers[i].name < headers[j].name })
+	return headers
+}
+
+// joined folds repeated values into one, the only form requests and fetch
+// accept; cookies use their own separator
+func (h codeHeader) joined() string {
+	if http.CanonicalHeaderKey(h.name) == "Cookie" {
+		return strings.Join(h.values, "; ")
+	}
+	return strings.Join(h.values, ", ")
+}
+
+// jsonQuote quotes a string in a form both Python and JavaScript accept
+func jsonQuote(s string) string {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	enc.Encode(s)
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+func goCode(req *capture.CapturedRequest) string {
+	var b strings.Builder
+	b.WriteString("package replay_test\n\nimport (\n\t\"io\"\n\t\"net/http\"\n")
+	if len(req.RequestBody) > 0 {
+		b.WriteString("\t\"strings\"\n")
+	}
+	b.WriteString("\t\"testing\"\n)\n\n")
+
+	name := "TestReplay"
+	if id := strings.ReplaceAll(req.ID, "-", ""); len(id) >= 8 {
+		name += "_" + id[:8]
+	}
+	fmt.Fprintf(&b, "func %s(t *testing.T) {\n", name)
+	body := "nil"
+	if len(req.RequestBody) > 0 {
+		body = "strings.NewReader(" + strconv.Quote(string(req.RequestBody)) + ")"
+	}
+	fmt.Fprintf(&b, "\treq, err := http.NewRequest(%s, %s, %s)\n", strconv.Quote(req.Method), strconv.Quote(req.URL), body)
+	b.WriteString("\tif err != nil {\n\t\tt.Fatal(err)\n\t}\n")
+	for _, h := range codeHeaders(req) {
+		for _, v := range h.values {
+			fmt.Fprintf(&b, "\treq.Header.Add(%s, %s)\n", strconv.Quote(h.name), strconv.Quote(v))
+		}
+	}
+	b.WriteString("\n\tclient := &http.Client{\n")
+	b.WriteString("\t\tCheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },\n\t}\n")
+	b.WriteString("\tresp, err := client.Do(req)\n")
+	b.WriteString("\tif err != nil {\n\t\tt.Fatal(err)\n\t}\n")
+	b.WriteString("\tdefer resp.Body.Close()\n\n")
+	b.WriteString("\tbody, err := io.ReadAll(resp.Body)\n")
+	b.WriteString("\tif err != nil {\n\t\tt.Fatal(err)\n\t}\n")
+	if req.StatusCode != 0 {
+		fmt.Fprintf(&b, "\tif resp.StatusCode != %d {\n", req.StatusCode)
+		fmt.Fprintf(&b, "\t\tt.Fatalf(\"status = %%d, want %d; body: %%s\", resp.StatusCode, body)\n\t}\n", req.StatusCode)
+	} else {
+		b.WriteString("\tt.Logf(\"status %d; body: %s\", resp.StatusCode, body)\n")
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func pythonCode(req *capture.CapturedRequest) string {
+	var b strings.Builder
+	b.WriteString("import requests\n\n")
+
+	headers := codeHeaders(req)
+	if len(headers) > 0 {
+		b.WriteString("headers = {\n")
+		for _, h := range headers {
+			fmt.Fprintf(&b, "    %s: %s,\n", jsonQuote(h.name), jsonQuote(h.joined()))
+		}
+		b.WriteString("}\n")
+	}
+	if len(req.RequestBody) > 0 {
+		fmt.Fprintf(&b, "data = %s\n", pythonBytes(req.RequestBody))
+	}
+	b.WriteString("\n")
+
+	fmt.Fprintf(&b, "response = requests.request(\n    %s,\n    %s,\n", jsonQuote(req.Method), jsonQuote(req.URL))
+	if len(headers) > 0 {
+		b.WriteString("    headers=headers,\n")
+	}
+	if len(req.RequestBody) > 0 {
+		b.WriteString("    data=data,\n")
+	}
+	b.WriteString("    allow_redirects=False,\n)\n")
+	b.WriteString("print(response.status_code)\nprint(response.text)\n")
+	return b.String()
+}
+
+// pythonBytes renders a bytes literal, escaping anything not printable ASCII
+func pythonBytes(data []byte) string {
+	var b strings.Builder
+	b.WriteString(`b"`)
+	for _, c := range data {
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c == '\n':
+			b.WriteString(`\n`)
+		case c == '\r':
+			b.WriteString(`\r`)
+		case c == '\t':
+			b.WriteString(`\t`)
+		case c < 0x20 || c >= 0x7f:
+			fmt.Fprintf(&b, `\x%02x`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteString(`"`)
+	return b.String()
+}
+
+func jsCode(req *capture.CapturedRequest) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "const response = await fetch(%s, {\n", jsonQuote(req.URL))
+	fmt.Fprintf(&b, "  method: %s,\n", jsonQuote(req.Method))
+
+	if headers := codeHeaders(req); len(headers) > 0 {
+		b.WriteString("  headers: {\n")
+		for _, h := range headers {
+			fmt.Fprintf(&b, "    %s: %s,\n", jsonQuote(h.name), jsonQuote(h.joined()))
+		}
+		b.WriteString("  },\n")
+	}
+	if len(req.RequestBody) > 0 {
+		if utf8.Valid(req.RequestBody) {
+			fmt.Fprintf(&b, "  body: %s,\n", jsonQuote(string(req.RequestBody)))
+		} else {
+			fmt.Fprintf(&b, "  body: Uint8Array.from(atob(%s), (c) => c.charCodeAt(0)),\n",
+				jsonQuote(base64.StdEncoding.EncodeToString(req.RequestBody)))
+		}
+	}
+	b.WriteString("  redirect: \"manual\",\n});\n")
+	b.WriteString("console.log(response.status);\nconsole.log(await response.text());\n")
+	return b.String()
+}
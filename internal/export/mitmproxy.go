@@ -0,0 +1,316 @@
+// Package export converts captures to and from other tools' file formats
+package export
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+	"github.com/google/uuid"
+)
+
+// mitmproxyFlowVersion is the flow format written by WriteMitmproxy. It is
+// mitmproxy 7's format, which later mitmproxy releases migrate on load.
+const mitmproxyFlowVersion = 14
+
+// WriteMitmproxy writes HTTP captures as a mitmproxy flow file. Tunnels
+// and non-HTTP captures have no mitmproxy equivalent and are skipped; the
+// number of flows written is returned.
+func WriteMitmproxy(w io.Writer, requests []*capture.CapturedRequest) (int, error) {
+	written := 0
+	for _, req := range requests {
+		flow, ok := mitmproxyFlow(req)
+		if !ok {
+			continue
+		}
+		if _, err := w.Write(appendTNetstring(nil, flow)); err != nil {
+			return written, err
+		}
+		written++
+	}
+	return written, nil
+}
+
+// mitmproxyFlow converts a capture to an HTTP flow's state dictionary
+func mitmproxyFlow(req *capture.CapturedRequest) (tnetDict, bool) {
+	if req.IsTunnel {
+		return nil, false
+	}
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, false
+	}
+
+	start := unixSeconds(req.Timestamp)
+	end := unixSeconds(req.Timestamp.Add(req.Duration))
+
+	port := 80
+	if u.Scheme == "https" {
+		port = 443
+	}
+	if p, err := strconv.Atoi(u.Port()); err == nil {
+		port = p
+	}
+
+	proto := req.Proto
+	if proto == "" {
+		proto = "HTTP/1.1"
+	}
+
+	request := tnetDict{
+		"http_version":    []byte(proto),
+		"headers":         headerPairs(req.RequestHeaders),
+		"content":         req.RequestBody,
+		"trailers":        nil,
+		"timestamp_start": start,
+		"timestamp_end":   start,
+		"host":            u.Hostname(),
+		"port":            port,
+		"method":          []byte(req.Method),
+		"scheme":          []byte(u.Scheme),
+		"authority":       []byte(""),
+		"path":            []byte(u.RequestURI()),
+	}
+
+	var response interface{}
+	if req.StatusCode != 0 && req.Error == "" {
+		response = tnetDict{
+			"http_version":    []byte(proto),
+			"headers":         headerPairs(req.ResponseHeaders),
+			"content":         req.ResponseBody,
+			"trailers":        nil,
+			"timestamp_start": end,
+			"timestamp_end":   end,
+			"status_code":     req.StatusCode,
+			"reason":          []byte(http.StatusText(req.StatusCode)),
+		}
+	}
+
+	var flowErr interface{}
+	if req.Error != "" {
+		flowErr = tnetDict{"msg": req.Error, "timestamp": end}
+	}
+
+	clientHost, clientPort := splitAddr(req.ClientAddr)
+	serverAddr := []interface{}{u.Hostname(), port}
+
+	return tnetDict{
+		"version":     mitmproxyFlowVersion,
+		"type":        "http",
+		"id":          req.ID,
+		"error":       flowErr,
+		"intercepted": false,
+		"is_replay":   nil,
+		"marked":      false,
+		"metadata":    tnetDict{},
+		"request":     request,
+		"response":    response,
+		"websocket":   nil,
+		"client_conn": clientConn(req.ID, clientHost, clientPort, start, end),
+		"server_conn": serverConn(serverAddr, start, end, u.Scheme == "https"),
+	}, true
+}
+
+// clientConn is the state of mitmproxy's Client connection object
+func clientConn(flowID, host string, port int, start, end float64) tnetDict {
+	return tnetDict{
+		"id":                  uuid.NewSHA1(uuid.NameSpaceURL, []byte("client/"+flowID)).String(),
+		"address":             []interface{}{host, port},
+		"sockname":            []interface{}{"", 0},
+		"alpn":                nil,
+		"alpn_offers":         []interface{}{},
+		"cipher_name":         nil,
+		"cipher_list":         []interface{}{},
+		"certificate_list":    []interface{}{},
+		"mitmcert":            nil,
+		"sni":                 nil,
+		"tls":                 false,
+		"tls_established":     false,
+		"tls_extensions":      []interface{}{},
+		"tls_version":         nil,
+		"state":               0,
+		"error":               nil,
+		"timestamp_start":     start,
+		"timestamp_end":       end,
+		"timestamp_tls_setup": nil,
+	}
+}
+
+// serverConn is the state of mitmproxy's Server connection object
+func serverConn(address []interface{}, start, end float64, tls bool) tnetDict {
+	return tnetDict{
+		"id":                  uuid.New().String(),
+		"address":             address,
+		"ip_address":          nil,
+		"source_address":      nil,
+		"via":                 nil,
+		"via2":                nil,
+		"alpn":                nil,
+		"alpn_offers":         []interface{}{},
+		"cipher_name":         nil,
+		"cipher_list":         []interface{}{},
+		"certificate_list":    []interface{}{},
+		"sni":                 nil,
+		"tls":                 tls,
+		"tls_established":     tls,
+		"tls_version":         nil,
+		"state":               0,
+		"error":               nil,
+		"timestamp_start":     start,
+		"timestamp_end":       end,
+		"timestamp_tcp_setup": start,
+		"timestamp_tls_setup": nil,
+	}
+}
+
+// headerPairs flattens headers into mitmproxy's [name, value] byte pairs
+func headerPairs(h map[string][]string) []interface{} {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := []interface{}{}
+	for _, name := range names {
+		for _, value := range h[name] {
+			pairs = append(pairs, []interface{}{[]byte(name), []byte(value)})
+		}
+	}
+	return pairs
+}
+
+func unixSeconds(t time.Time) float64 {
+	return float64(t.UnixNano()) / 1e9
+}
+
+func fromUnixSeconds(s float64) time.Time {
+	return time.Unix(0, int64(s*1e9))
+}
+
+// splitAddr splits "host:port", returning port 0 when absent
+func splitAddr(addr string) (string, int) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr, 0
+	}
+	port, _ := strconv.Atoi(portStr)
+	return host, port
+}
+
+// ReadMitmproxy reads the HTTP flows from a mitmproxy flow file of any
+// version. Other flow types (TCP, UDP, DNS) are skipped.
+func ReadMitmproxy(r io.Reader) ([]*capture.CapturedRequest, error) {
+	br := bufio.NewReader(r)
+
+	var requests []*capture.CapturedRequest
+	for {
+		v, err := readTNetstring(br)
+		if err == io.EOF {
+			return requests, nil
+		}
+		if err != nil {
+			return requests, fmt.Errorf("flow %d: %w", len(requests)+1, err)
+		}
+
+		flow := asDict(v)
+		if flow == nil {
+			return requests, fmt.Errorf("flow %d: not a dictionary", len(requests)+1)
+		}
+		if typ := asString(flow["type"]); typ != "" && typ != "http" {
+			continue
+		}
+		if req := capturedFromFlow(flow); req != nil {
+			requests = append(requests, req)
+		}
+	}
+}
+
+// capturedFromFlow converts an HTTP flow's state dictionary
+func capturedFromFlow(flow map[string]interface{}) *capture.CapturedRequest {
+	request := asDict(flow["request"])
+	if request == nil {
+		return nil
+	}
+
+	captured := capture.NewCapturedRequest()
+	captured.ID = asString(flow["id"])
+	if captured.ID == "" {
+		captured.ID = uuid.New().String()
+	}
+
+	scheme := asString(request["scheme"])
+	host := asString(request["host"])
+	port := asInt(request["port"])
+	hostPort := host
+	if port != 0 && !(scheme == "http" && port == 80) && !(scheme == "https" && port == 443) {
+		hostPort = net.JoinHostPort(host, strconv.Itoa(port))
+	} else if strings.Contains(host, ":") {
+		hostPort = "[" + host + "]"
+	}
+	path := asString(request["path"])
+
+	captured.Method = asString(request["method"])
+	captured.Proto = asString(request["http_version"])
+	captured.URL = scheme + "://" + hostPort + path
+	captured.Host = hostPort
+	captured.Path, _, _ = strings.Cut(path, "?")
+	captured.IsHTTPS = scheme == "https"
+	captured.RequestHeaders = headersFromPairs(request["headers"])
+	captured.RequestBody = asBytes(request["content"])
+
+	start := asFloat(request["timestamp_start"])
+	if start == 0 {
+		start = asFloat(flow["timestamp_created"])
+	}
+	captured.Timestamp = fromUnixSeconds(start)
+
+	end := asFloat(request["timestamp_end"])
+	if response := asDict(flow["response"]); response != nil {
+		captured.StatusCode = asInt(response["status_code"])
+		captured.ResponseHeaders = headersFromPairs(response["headers"])
+		captured.ResponseBody = asBytes(response["content"])
+		end = asFloat(response["timestamp_end"])
+	}
+	if flowErr := asDict(flow["error"]); flowErr != nil {
+		captured.Error = asString(flowErr["msg"])
+	}
+	if end > start {
+		captured.Duration = fromUnixSeconds(end).Sub(captured.Timestamp)
+	}
+
+	if client := asDict(flow["client_conn"]); client != nil {
+		address := client["peername"]
+		if address == nil {
+			address = client["address"]
+		}
+		if pair, ok := address.([]interface{}); ok && len(pair) >= 2 {
+			captured.ClientAddr = net.JoinHostPort(asString(pair[0]), strconv.Itoa(asInt(pair[1])))
+		}
+	}
+
+	return captured
+}
+
+// headersFromPairs rebuilds headers from mitmproxy's [name, value] pairs
+func headersFromPairs(v interface{}) map[string][]string {
+	headers := make(map[string][]string)
+	pairs, _ := v.([]interface{})
+	for _, p := range pairs {
+		pair, ok := p.([]interface{})
+		if !ok || len(pair) != 2 {
+			continue
+		}
+		name := http.CanonicalHeaderKey(asString(pair[0]))
+		headers[name] = append(headers[name], asString(pair[1]))
+	}
+	return headers
+}
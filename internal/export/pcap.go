@@ -0,0 +1,318 @@
+package export
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+)
+
+// Captures hold HTTP messages rather than packets, so the pcap exporters
+// fabricate a TCP connection per exchange: handshake, request, response and
+// close, timed from the capture. The connection runs from the client's
+// address to a documentation address on port 8080, the proxy's view of the
+// exchange, which Wireshark decodes as HTTP without configuration.
+
+const (
+	// linkTypeRaw frames packets as bare IPv4 or IPv6
+	linkTypeRaw = 101
+
+	pcapProxyPort = 8080
+	pcapMSS       = 1460
+)
+
+var (
+	pcapProxyIPv4  = net.IPv4(192, 0, 2, 1).To4()
+	pcapProxyIPv6  = net.ParseIP("2001:db8::1")
+	pcapClientIPv4 = net.IPv4(192, 0, 2, 2).To4()
+)
+
+// pcapPacket is one fabricated IP packet
+type pcapPacket struct {
+	at   time.Time
+	data []byte
+	// comment labels a connection's first packet with its capture ID
+	comment string
+}
+
+// tcpFlow builds the packets of one fabricated connection
+type tcpFlow struct {
+	client, proxy         net.IP
+	clientPort, proxyPort uint16
+	clientSeq, proxySeq   uint32
+	packets               []pcapPacket
+}
+
+const (
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpPSH = 0x08
+	tcpACK = 0x10
+)
+
+// pcapPackets fabricates the packets for a capture, reporting false for
+// tunnels and non-HTTP captures whose payload was not recorded
+func pcapPackets(req *capture.CapturedRequest, n int) ([]pcapPacket, bool) {
+	if req.IsTunnel {
+		return nil, false
+	}
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, false
+	}
+
+	f := &tcpFlow{
+		client:     pcapClientIPv4,
+		proxy:      pcapProxyIPv4,
+		clientPort: uint16(49152 + n%16384),
+		proxyPort:  pcapProxyPort,
+		clientSeq:  uint32(n) * 100000,
+		proxySeq:   uint32(n)*100000 + 50000,
+	}
+	if host, _, err := net.SplitHostPort(req.ClientAddr); err == nil {
+		if ip := net.ParseIP(host); ip != nil {
+			if ip4 := ip.To4(); ip4 != nil {
+				f.client = ip4
+			} else {
+				f.client, f.proxy = ip, pcapProxyIPv6
+			}
+		}
+	}
+
+	start := req.Timestamp
+	end := start.Add(req.Duration)
+	step := time.Microsecond
+
+	f.segment(true, start, tcpSYN, nil)
+	f.packets[0].comment = req.ID
+	f.segment(false, start.Add(step), tcpSYN|tcpACK, nil)
+	f.segment(true, start.Add(2*step), tcpACK, nil)
+	f.send(true, start.Add(3*step), rawRequest(req))
+	if resp := rawResponse(req); len(resp) > 0 {
+		f.segment(true, start.Add(4*step), tcpACK, nil)
+		if end.Before(start.Add(5 * step)) {
+			end = start.Add(5 * step)
+		}
+		f.send(false, end, resp)
+	}
+	f.segment(false, end.Add(step), tcpFIN|tcpACK, nil)
+	f.segment(true, end.Add(2*step), tcpFIN|tcpACK, nil)
+	f.segment(false, end.Add(3*step), tcpACK, nil)
+	return f.packets, true
+}
+
+// send splits a payload into MSS sized segments
+func (f *tcpFlow) send(fromClient bool, at time.Time, payload []byte) {
+	for len(payload) > 0 {
+		n := len(payload)
+		if n > pcapMSS {
+			n = pcapMSS
+		}
+		flags := byte(tcpACK)
+		if n == len(payload) {
+			flags |= tcpPSH
+		}
+		f.segment(fromClient, at, flags, payload[:n])
+		payload = payload[n:]
+	}
+}
+
+// segment appends one TCP segment and advances the sender's sequence number
+func (f *tcpFlow) segment(fromClient bool, at time.Time, flags byte, payload []byte) {
+	src, dst := f.client, f.proxy
+	srcPort, dstPort := f.clientPort, f.proxyPort
+	seq, ack := &f.clientSeq, f.proxySeq
+	if !fromClient {
+		src, dst = dst, src
+		srcPort, dstPort = dstPort, srcPort
+		seq, ack = &f.proxySeq, f.clientSeq
+	}
+	if flags&tcpACK == 0 {
+		ack = 0
+	} else if flags&tcpSYN != 0 {
+		// the SYN-ACK acknowledges the client's SYN
+		ack = f.clientSeq
+	}
+
+	tcp := make([]byte, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], srcPort)
+	binary.BigEndian.PutUint16(tcp[2:], dstPort)
+	binary.BigEndian.PutUint32(tcp[4:], *seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535)
+	copy(tcp[20:], payload)
+
+	*seq += uint32(len(payload))
+	if flags&(tcpSYN|tcpFIN) != 0 {
+		*seq++
+	}
+
+	f.packets = append(f.packets, pcapPacket{at: at, data: ipPacket(src, dst, tcp)})
+}
+
+// ipPacket wraps a TCP segment in an IPv4 or IPv6 header, filling in the
+// checksums
+func ipPacket(src, dst net.IP, tcp []byte) []byte {
+	var pseudo []byte
+	var packet []byte
+	if src.To4() != nil {
+		packet = make([]byte, 20, 20+len(tcp))
+		packet[0] = 0x45
+		binary.BigEndian.PutUint16(packet[2:], uint16(20+len(tcp)))
+		packet[8] = 64
+		packet[9] = 6
+		copy(packet[12:], src.To4())
+		copy(packet[16:], dst.To4())
+		binary.BigEndian.PutUint16(packet[10:], checksum(packet))
+
+		pseudo = append(pseudo, src.To4()...)
+		pseudo = append(pseudo, dst.To4()...)
+		pseudo = append(pseudo, 0, 6)
+		pseudo = binary.BigEndian.AppendUint16(pseudo, uint16(len(tcp)))
+	} else {
+		packet = make([]byte, 40, 40+len(tcp))
+		packet[0] = 0x60
+		binary.BigEndian.PutUint16(packet[4:], uint16(len(tcp)))
+		packet[6] = 6
+		packet[7] = 64
+		copy(packet[8:], src.To16())
+		copy(packet[24:], dst.To16())
+
+		pseudo = append(pseudo, src.To16()...)
+		pseudo = append(pseudo, dst.To16()...)
+		pseudo = binary.BigEndian.AppendUint32(pseudo, uint32(len(tcp)))
+		pseudo = append(pseudo, 0, 0, 0, 6)
+	}
+
+	binary.BigEndian.PutUint16(tcp[16:], checksum(append(pseudo, tcp...)))
+	return append(packet, tcp...)
+}
+
+// checksum is the Internet checksum of RFC 1071
+func checksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// WritePcap writes captures as a classic libpcap file of fabricated TCP
+// connections, returning the number of exchanges written. Tunnels and
+// non-HTTP captures are skipped.
+func WritePcap(w io.Writer, requests []*capture.CapturedRequest) (int, error) {
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], 65535)
+	binary.LittleEndian.PutUint32(header[20:], linkTypeRaw)
+	if _, err := w.Write(header); err != nil {
+		return 0, err
+	}
+
+	written := 0
+	for _, req := range requests {
+		packets, ok := pcapPackets(req, written)
+		if !ok {
+			continue
+		}
+		for _, p := range packets {
+			record := make([]byte, 16, 16+len(p.data))
+			binary.LittleEndian.PutUint32(record[0:], uint32(p.at.Unix()))
+			binary.LittleEndian.PutUint32(record[4:], uint32(p.at.Nanosecond()/1000))
+			binary.LittleEndian.PutUint32(record[8:], uint32(len(p.data)))
+			binary.LittleEndian.PutUint32(record[12:], uint32(len(p.data)))
+			if _, err := w.Write(append(record, p.data...)); err != nil {
+				return written, err
+			}
+		}
+		written++
+	}
+	return written, nil
+}
+
+// WritePcapng writes captures as a pcapng file of fabricated TCP
+// connections, returning the number of exchanges written. Each
+// connection's first packet carries the capture ID as a comment.
+func WritePcapng(w io.Writer, requests []*capture.CapturedRequest) (int, error) {
+	// section header: byte order magic, version 1.0, unknown length
+	shb := binary.LittleEndian.AppendUint32(nil, 0x1a2b3c4d)
+	shb = binary.LittleEndian.AppendUint16(shb, 1)
+	shb = binary.LittleEndian.AppendUint16(shb, 0)
+	shb = binary.LittleEndian.AppendUint64(shb, 0xffffffffffffffff)
+	shb = appendPcapngOption(shb, 4, []byte("go_proxy"))
+	shb = appendPcapngOption(shb, 0, nil)
+	if err := writePcapngBlock(w, 0x0a0d0d0a, shb); err != nil {
+		return 0, err
+	}
+
+	// interface description: raw IP, no snap length, microsecond stamps
+	idb := binary.LittleEndian.AppendUint16(nil, linkTypeRaw)
+	idb = binary.LittleEndian.AppendUint16(idb, 0)
+	idb = binary.LittleEndian.AppendUint32(idb, 0)
+	if err := writePcapngBlock(w, 1, idb); err != nil {
+		return 0, err
+	}
+
+	written := 0
+	for _, req := range requests {
+		packets, ok := pcapPackets(req, written)
+		if !ok {
+			continue
+		}
+		for _, p := range packets {
+			us := uint64(p.at.UnixMicro())
+			epb := binary.LittleEndian.AppendUint32(nil, 0)
+			epb = binary.LittleEndian.AppendUint32(epb, uint32(us>>32))
+			epb = binary.LittleEndian.AppendUint32(epb, uint32(us))
+			epb = binary.LittleEndian.AppendUint32(epb, uint32(len(p.data)))
+			epb = binary.LittleEndian.AppendUint32(epb, uint32(len(p.data)))
+			epb = append(epb, p.data...)
+			epb = append(epb, make([]byte, pad4(len(p.data)))...)
+			if p.comment != "" {
+				epb = appendPcapngOption(epb, 1, []byte(p.comment))
+				epb = appendPcapngOption(epb, 0, nil)
+			}
+			if err := writePcapngBlock(w, 6, epb); err != nil {
+				return written, err
+			}
+		}
+		written++
+	}
+	return written, nil
+}
+
+// appendPcapngOption appends a padded option; code 0 ends the option list
+func appendPcapngOption(b []byte, code uint16, value []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, code)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(value)))
+	b = append(b, value...)
+	return append(b, make([]byte, pad4(len(value)))...)
+}
+
+// writePcapngBlock frames a block body with its type and both length fields
+func writePcapngBlock(w io.Writer, blockType uint32, body []byte) error {
+	length := uint32(12 + len(body))
+	block := binary.LittleEndian.AppendUint32(nil, blockType)
+	block = binary.LittleEndian.AppendUint32(block, length)
+	block = append(block, body...)
+	block = binary.LittleEndian.AppendUint32(block, length)
+	_, err := w.Write(block)
+	return err
+}
+
+func pad4(n int) int {
+	return (4 - n%4) % 4
+}
@@ -0,0 +1,214 @@
+package export
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+)
+
+// Fiddler SAZ archives are zip files holding, per session, the raw request
+// (raw/N_c.txt), the raw response (raw/N_s.txt) and session metadata
+// (raw/N_m.xml).
+
+// sazTimeFormat is the .NET round-trip format Fiddler writes
+const sazTimeFormat = "2006-01-02T15:04:05.0000000-07:00"
+
+const sazContentTypes = `<?xml version="1.0" encoding="utf-8" ?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">
+<Default Extension="htm" ContentType="text/html" />
+<Default Extension="xml" ContentType="application/xml" />
+<Default Extension="txt" ContentType="text/plain" />
+</Types>`
+
+// WriteSAZ writes captures as a Fiddler session archive, returning the
+// number of sessions written
+func WriteSAZ(w io.Writer, requests []*capture.CapturedRequest) (int, error) {
+	zw := zip.NewWriter(w)
+
+	if err := writeZipFile(zw, "[Content_Types].xml", []byte(sazContentTypes)); err != nil {
+		return 0, err
+	}
+
+	// Fiddler pads session numbers to the width of the largest one
+	width := len(strconv.Itoa(len(requests)))
+	if width < 2 {
+		width = 2
+	}
+
+	var index bytes.Buffer
+	index.WriteString("<html><head><title>go_proxy session archive</title></head><body>\n<table>\n")
+	index.WriteString("<tr><th>#</th><th>Result</th><th>URL</th></tr>\n")
+
+	for i, req := range requests {
+		n := fmt.Sprintf("%0*d", width, i+1)
+		files := []struct {
+			name string
+			data []byte
+		}{
+			{"raw/" + n + "_c.txt", rawRequest(req)},
+			{"raw/" + n + "_s.txt", rawResponse(req)},
+			{"raw/" + n + "_m.xml", sazMetadata(i+1, req)},
+		}
+		for _, f := range files {
+			if err := writeZipFile(zw, f.name, f.data); err != nil {
+				return i, err
+			}
+		}
+		fmt.Fprintf(&index, "<tr><td><a href=\"raw/%s_c.txt\">%s</a></td><td>%d</td><td>%s</td></tr>\n",
+			n, n, req.StatusCode, html.EscapeString(req.URL))
+	}
+
+	index.WriteString("</table>\n</body></html>\n")
+	if err := writeZipFile(zw, "_index.htm", index.Bytes()); err != nil {
+		return len(requests), err
+	}
+	return len(requests), zw.Close()
+}
+
+func writeZipFile(zw *zip.Writer, name string, data []byte) error {
+	f, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	return err
+}
+
+// rawRequest renders the raw client request. Tunnels appear as the
+// CONNECT that opened them.
+func rawRequest(req *capture.CapturedRequest) []byte {
+	proto := req.Proto
+	if proto == "" || req.IsTunnel {
+		proto = "HTTP/1.1"
+	}
+
+	var b bytes.Buffer
+	if req.Method == http.MethodConnect {
+		fmt.Fprintf(&b, "CONNECT %s %s\r\n", req.Host, proto)
+	} else {
+		fmt.Fprintf(&b, "%s %s %s\r\n", req.Method, req.URL, proto)
+	}
+	headers := http.Header(req.RequestHeaders)
+	if headers.Get("Host") == "" {
+		if u, err := url.Parse(req.URL); err == nil && u.Host != "" {
+			fmt.Fprintf(&b, "Host: %s\r\n", u.Host)
+		}
+	}
+	headers.Write(&b)
+	b.WriteString("\r\n")
+	b.Write(req.RequestBody)
+	return b.Bytes()
+}
+
+// rawResponse renders the raw response. Failed requests get a proxy
+// generated error body, as Fiddler does.
+func rawResponse(req *capture.CapturedRequest) []byte {
+	status := req.StatusCode
+	body := req.ResponseBody
+	if req.Error != "" && len(body) == 0 {
+		body = []byte("[go_proxy] " + req.Error)
+		if status == 0 {
+			status = http.StatusBadGateway
+		}
+	}
+	if status == 0 {
+		return nil
+	}
+
+	var b bytes.Buffer
+	if req.Method == http.MethodConnect && status == http.StatusOK {
+		b.WriteString("HTTP/1.1 200 Connection Established\r\n")
+	} else {
+		fmt.Fprintf(&b, "HTTP/1.1 %d %s\r\n", status, http.StatusText(status))
+	}
+	http.Header(req.ResponseHeaders).Write(&b)
+	b.WriteString("\r\n")
+	b.Write(body)
+	return b.Bytes()
+}
+
+// sazSession is the root element of a session's metadata file
+type sazSession struct {
+	XMLName  xml.Name  `xml:"Session"`
+	SID      int       `xml:"SID,attr"`
+	BitFlags int       `xml:"BitFlags,attr"`
+	Timers   sazTimers `xml:"SessionTimers"`
+	PipeInfo struct{}  `xml:"PipeInfo"`
+	Flags    []sazFlag `xml:"SessionFlags>SessionFlag"`
+}
+
+type sazTimers struct {
+	ClientConnected     string `xml:"ClientConnected,attr"`
+	ClientBeginRequest  string `xml:"ClientBeginRequest,attr"`
+	GotRequestHeaders   string `xml:"GotRequestHeaders,attr"`
+	ClientDoneRequest   string `xml:"ClientDoneRequest,attr"`
+	GatewayTime         int    `xml:"GatewayTime,attr"`
+	DNSTime             int    `xml:"DNSTime,attr"`
+	TCPConnectTime      int    `xml:"TCPConnectTime,attr"`
+	HTTPSHandshakeTime  int    `xml:"HTTPSHandshakeTime,attr"`
+	ServerConnected     string `xml:"ServerConnected,attr"`
+	FiddlerBeginRequest string `xml:"FiddlerBeginRequest,attr"`
+	ServerGotRequest    string `xml:"ServerGotRequest,attr"`
+	ServerBeginResponse string `xml:"ServerBeginResponse,attr"`
+	GotResponseHeaders  string `xml:"GotResponseHeaders,attr"`
+	ServerDoneResponse  string `xml:"ServerDoneResponse,attr"`
+	ClientBeginResponse string `xml:"ClientBeginResponse,attr"`
+	ClientDoneResponse  string `xml:"ClientDoneResponse,attr"`
+}
+
+type sazFlag struct {
+	N string `xml:"N,attr"`
+	V string `xml:"V,attr"`
+}
+
+// sazMetadata renders a session's timers and flags. Only request start and
+// end are known, so intermediate timers take one or the other.
+func sazMetadata(sid int, req *capture.CapturedRequest) []byte {
+	start := req.Timestamp.Format(sazTimeFormat)
+	end := req.Timestamp.Add(req.Duration).Format(sazTimeFormat)
+
+	session := sazSession{
+		SID: sid,
+		Timers: sazTimers{
+			ClientConnected:     start,
+			ClientBeginRequest:  start,
+			GotRequestHeaders:   start,
+			ClientDoneRequest:   start,
+			ServerConnected:     start,
+			FiddlerBeginRequest: start,
+			ServerGotRequest:    start,
+			ServerBeginResponse: end,
+			GotResponseHeaders:  end,
+			ServerDoneResponse:  end,
+			ClientBeginResponse: end,
+			ClientDoneResponse:  end,
+		},
+	}
+
+	if host, port, err := net.SplitHostPort(req.ClientAddr); err == nil {
+		session.Flags = append(session.Flags,
+			sazFlag{N: "x-clientip", V: host},
+			sazFlag{N: "x-clientport", V: port})
+	}
+	if req.ProcessName != "" {
+		session.Flags = append(session.Flags, sazFlag{N: "x-processinfo", V: fmt.Sprintf("%s:%d", req.ProcessName, req.ProcessID)})
+	}
+	session.Flags = append(session.Flags,
+		sazFlag{N: "x-responsebodytransferlength", V: strconv.Itoa(len(req.ResponseBody))},
+		sazFlag{N: "x-go-proxy-id", V: req.ID})
+	if req.Error != "" {
+		session.Flags = append(session.Flags, sazFlag{N: "x-go-proxy-error", V: req.Error})
+	}
+
+	out, _ := xml.MarshalIndent(session, "", "  ")
+	return append([]byte(xml.Header), out...)
+}
@@ -0,0 +1,206 @@
+package export
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+)
+
+// tnetstrings (https://tnetstrings.info) as used by mitmproxy: every value
+// is "length:payload" followed by a type tag. mitmproxy distinguishes
+// byte strings (",") from unicode strings (";").
+
+// maxTNetstring bounds a single value read from a file
+const maxTNetstring = 512 << 20
+
+// maxTNetDepth bounds list and dictionary nesting; mitmproxy flows nest
+// fewer than ten levels and parsing recurses once per level
+const maxTNetDepth = 64
+
+// tnetDict is an encoded dictionary; keys are written in sorted order
+type tnetDict map[string]interface{}
+
+// appendTNetstring encodes v, which must be nil, bool, int, int64,
+// float64, string, []byte, []interface{} or tnetDict
+func appendTNetstring(b []byte, v interface{}) []byte {
+	var payload []byte
+	var tag byte
+	switch v := v.(type) {
+	case nil:
+		tag = '~'
+	case bool:
+		payload, tag = strconv.AppendBool(nil, v), '!'
+	case int:
+		payload, tag = strconv.AppendInt(nil, int64(v), 10), '#'
+	case int64:
+		payload, tag = strconv.AppendInt(nil, v, 10), '#'
+	case float64:
+		payload, tag = strconv.AppendFloat(nil, v, 'f', -1, 64), '^'
+	case string:
+		payload, tag = []byte(v), ';'
+	case []byte:
+		payload, tag = v, ','
+	case []interface{}:
+		for _, item := range v {
+			payload = appendTNetstring(payload, item)
+		}
+		tag = ']'
+	case tnetDict:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			payload = appendTNetstring(payload, k)
+			payload = appendTNetstring(payload, v[k])
+		}
+		tag = '}'
+	default:
+		panic(fmt.Sprintf("tnetstring: unsupported type %T", v))
+	}
+
+	b = strconv.AppendInt(b, int64(len(payload)), 10)
+	b = append(b, ':')
+	b = append(b, payload...)
+	return append(b, tag)
+}
+
+// readTNetstring decodes the next value from r. It returns io.EOF when r
+// is exhausted between values. Strings of either kind decode to []byte or
+// string as tagged; dictionaries decode to map[string]interface{}.
+func readTNetstring(r *bufio.Reader) (interface{}, error) {
+	length, err := r.ReadString(':')
+	if err != nil {
+		if err == io.EOF && length == "" {
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("tnetstring: truncated length: %w", io.ErrUnexpectedEOF)
+	}
+	n, err := strconv.Atoi(length[:len(length)-1])
+	if err != nil || n < 0 || n > maxTNetstring {
+		return nil, fmt.Errorf("tnetstring: invalid length %q", length)
+	}
+
+	payload := make([]byte, n+1)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, fmt.Errorf("tnetstring: truncated value: %w", io.ErrUnexpectedEOF)
+	}
+	return parseTNetstring(payload[:n], payload[n], 0)
+}
+
+func parseTNetstring(payload []byte, tag byte, depth int) (interface{}, error) {
+	switch tag {
+	case '~':
+		return nil, nil
+	case '!':
+		return string(payload) == "true", nil
+	case '#':
+		return strconv.ParseInt(string(payload), 10, 64)
+	case '^':
+		return strconv.ParseFloat(string(payload), 64)
+	case ',':
+		return payload, nil
+	case ';':
+		return string(payload), nil
+	case ']', '}':
+		if depth >= maxTNetDepth {
+			return nil, fmt.Errorf("tnetstring: nested deeper than %d levels", maxTNetDepth)
+		}
+		var items []interface{}
+		for rest := payload; len(rest) > 0; {
+			item, n, err := splitTNetstring(rest, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+			rest = rest[n:]
+		}
+		if tag == ']' {
+			return items, nil
+		}
+		if len(items)%2 != 0 {
+			return nil, fmt.Errorf("tnetstring: dictionary with odd number of items")
+		}
+		dict := make(map[string]interface{}, len(items)/2)
+		for i := 0; i < len(items); i += 2 {
+			dict[asString(items[i])] = items[i+1]
+		}
+		return dict, nil
+	}
+	return nil, fmt.Errorf("tnetstring: unknown type tag %q", tag)
+}
+
+// splitTNetstring decodes the value at the start of b, nested depth levels
+// deep, and its encoded size
+func splitTNetstring(b []byte, depth int) (interface{}, int, error) {
+	colon := -1
+	for i := 0; i < len(b) && i < 12; i++ {
+		if b[i] == ':' {
+			colon = i
+			break
+		}
+	}
+	if colon < 0 {
+		return nil, 0, fmt.Errorf("tnetstring: missing length")
+	}
+	n, err := strconv.Atoi(string(b[:colon]))
+	if err != nil || n < 0 || colon+1+n >= len(b) {
+		return nil, 0, fmt.Errorf("tnetstring: invalid nested length")
+	}
+	end := colon + 1 + n
+	v, err := parseTNetstring(b[colon+1:end], b[end], depth)
+	return v, end + 1, err
+}
+
+// asString reads a decoded byte or unicode string
+func asString(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	}
+	return ""
+}
+
+// asBytes reads a decoded byte or unicode string as bytes
+func asBytes(v interface{}) []byte {
+	switch v := v.(type) {
+	case []byte:
+		return v
+	case string:
+		return []byte(v)
+	}
+	return nil
+}
+
+// asFloat reads a decoded number
+func asFloat(v interface{}) float64 {
+	switch v := v.(type) {
+	case float64:
+		return v
+	case int64:
+		return float64(v)
+	}
+	return 0
+}
+
+// asInt reads a decoded integer
+func asInt(v interface{}) int {
+	switch v := v.(type) {
+	case int64:
+		return int(v)
+	case float64:
+		return int(v)
+	}
+	return 0
+}
+
+// asDict reads a decoded dictionary
+func asDict(v interface{}) map[string]interface{} {
+	d, _ := v.(map[string]interface{})
+	return d
+}
@@ -0,0 +1,40 @@
+package export
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+)
+
+func TestReadMitmproxyRejectsDeepNesting(t *testing.T) {
+	value := []byte("0:]")
+	for i := 0; i < 1000; i++ {
+		value = append(strconv.AppendInt(nil, int64(len(value)), 10), append(append([]byte{':'}, value...), ']')...)
+	}
+	_, err := ReadMitmproxy(bytes.NewReader(value))
+	if err == nil || !strings.Contains(err.Error(), "nested deeper") {
+		t.Fatalf("1000 nested lists read with error %v", err)
+	}
+}
+
+func TestReadMitmproxyRoundTrip(t *testing.T) {
+	req := capture.NewCapturedRequest()
+	req.ID, req.Timestamp = "a", time.Unix(1700000000, 0)
+	req.Method, req.URL = "GET", "http://example.com/path"
+
+	var buf bytes.Buffer
+	if _, err := WriteMitmproxy(&buf, []*capture.CapturedRequest{req}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadMitmproxy(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Method != "GET" || got[0].URL != req.URL {
+		t.Fatalf("read back %+v", got)
+	}
+}
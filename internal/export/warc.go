@@ -0,0 +1,195 @@
+package export
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+	"github.com/google/uuid"
+)
+
+// WARC (ISO 28500) files are sequences of records, each a WARC/1.1 header
+// block and a content block. An exchange becomes a response record holding
+// the HTTP response as received and a request record concurrent to it.
+// In .warc.gz files every record is a gzip member of its own, so tools can
+// seek to one without inflating the rest.
+
+// warcVersion is the WARC format written
+const warcVersion = "WARC/1.1"
+
+// WARCWriter appends captures to a WARC file. It is safe for concurrent
+// use.
+type WARCWriter struct {
+	mu   sync.Mutex
+	w    io.Writer
+	gzip bool
+}
+
+// NewWARCWriter starts a WARC file on w with a warcinfo record,
+// compressing each record when gz is set
+func NewWARCWriter(w io.Writer, gz bool) (*WARCWriter, error) {
+	ww := &WARCWriter{w: w, gzip: gz}
+	info := []byte("software: go_proxy\r\nformat: WARC File Format 1.1\r\n" +
+		"conformsTo: http://iipc.github.io/warc-specifications/specifications/warc-format/warc-1.1/\r\n")
+	header := warcHeader{
+		{"WARC-Type", "warcinfo"},
+		{"WARC-Record-ID", warcRecordID("")},
+		{"WARC-Date", warcDate(time.Now())},
+		{"Content-Type", "application/warc-fields"},
+	}
+	return ww, ww.writeRecord(header, info)
+}
+
+// Write appends the request and response records of an exchange.
+// Tunnels and requests that got no upstream response have no HTTP
+// exchange to archive and are skipped, reporting false.
+func (ww *WARCWriter) Write(req *capture.CapturedRequest) (bool, error) {
+	if !archivable(req) {
+		return false, nil
+	}
+	responseID := warcRecordID(req.ID)
+	date := warcDate(req.Timestamp)
+
+	response := rawResponse(req)
+	responseHeader := warcHeader{
+		{"WARC-Type", "response"},
+		{"WARC-Record-ID", responseID},
+		{"WARC-Date", date},
+		{"WARC-Target-URI", req.URL},
+		{"Content-Type", "application/http;msgtype=response"},
+		{"WARC-Payload-Digest", warcDigest(req.ResponseBody)},
+	}
+	if req.ResponseBodySHA256 != "" && req.ResponseBodySHA256 != sha256Hex(req.ResponseBody) {
+		// The body kept is not the body received: cut at the capture
+		// size limit, rewritten by a rule, or a media placeholder
+		responseHeader = append(responseHeader, [2]string{"WARC-Truncated", "unspecified"})
+	}
+
+	request := warcRequest(req)
+	requestHeader := warcHeader{
+		{"WARC-Type", "request"},
+		{"WARC-Record-ID", warcRecordID("")},
+		{"WARC-Date", date},
+		{"WARC-Target-URI", req.URL},
+		{"WARC-Concurrent-To", responseID},
+		{"Content-Type", "application/http;msgtype=request"},
+	}
+
+	ww.mu.Lock()
+	defer ww.mu.Unlock()
+	if err := ww.writeRecord(responseHeader, response); err != nil {
+		return false, err
+	}
+	return true, ww.writeRecord(requestHeader, request)
+}
+
+// WriteWARC writes captures as a WARC file, returning the number of
+// exchanges archived
+func WriteWARC(w io.Writer, requests []*capture.CapturedRequest, gz bool) (int, error) {
+	ww, err := NewWARCWriter(w, gz)
+	if err != nil {
+		return 0, err
+	}
+	written := 0
+	for _, req := range requests {
+		ok, err := ww.Write(req)
+		if err != nil {
+			return written, err
+		}
+		if ok {
+			written++
+		}
+	}
+	return written, nil
+}
+
+// archivable reports whether req is an HTTP exchange with a response
+// from upstream
+func archivable(req *capture.CapturedRequest) bool {
+	if req.IsTunnel || req.StatusCode == 0 || (req.Error != "" && len(req.ResponseHeaders) == 0) {
+		return false
+	}
+	u, err := url.Parse(req.URL)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https")
+}
+
+// warcHeader is an ordered list of WARC header fields
+type warcHeader [][2]string
+
+// writeRecord writes one record, adding the block digest and length
+func (ww *WARCWriter) writeRecord(header warcHeader, block []byte) error {
+	var b bytes.Buffer
+	b.WriteString(warcVersion + "\r\n")
+	for _, field := range header {
+		fmt.Fprintf(&b, "%s: %s\r\n", field[0], field[1])
+	}
+	fmt.Fprintf(&b, "WARC-Block-Digest: %s\r\n", warcDigest(block))
+	fmt.Fprintf(&b, "Content-Length: %d\r\n\r\n", len(block))
+	b.Write(block)
+	b.WriteString("\r\n\r\n")
+
+	if !ww.gzip {
+		_, err := ww.w.Write(b.Bytes())
+		return err
+	}
+	zw := gzip.NewWriter(ww.w)
+	if _, err := zw.Write(b.Bytes()); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// warcRequest renders the request as forwarded upstream, in origin form
+func warcRequest(req *capture.CapturedRequest) []byte {
+	u, _ := url.Parse(req.URL)
+	target := u.RequestURI()
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s %s HTTP/1.1\r\n", req.Method, target)
+	headers := http.Header(req.RequestHeaders).Clone()
+	if headers.Get("Host") == "" {
+		fmt.Fprintf(&b, "Host: %s\r\n", u.Host)
+	}
+	// Meant for the proxy, not forwarded
+	headers.Del("Proxy-Connection")
+	headers.Del("Proxy-Authorization")
+	headers.Write(&b)
+	b.WriteString("\r\n")
+	b.Write(req.RequestBody)
+	return b.Bytes()
+}
+
+// warcRecordID returns a record ID, derived from a capture ID when it is
+// a UUID so that the response record of a capture keeps its ID
+func warcRecordID(captureID string) string {
+	id, err := uuid.Parse(captureID)
+	if err != nil {
+		id = uuid.New()
+	}
+	return "<urn:uuid:" + id.String() + ">"
+}
+
+func warcDate(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000000Z")
+}
+
+// warcDigest is the labelled base32 SHA-1 digest web archives use
+func warcDigest(data []byte) string {
+	sum := sha1.Sum(data)
+	return "sha1:" + base32.StdEncoding.EncodeToString(sum[:])
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
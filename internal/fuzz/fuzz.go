@@ -0,0 +1,374 @@
+// Package fuzz mutates captured requests with generated payloads and
+// reports the mutations whose responses differ from the unmodified
+// request, as a quick security smoke test from real traffic
+package fuzz
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+	"github.com/adamdrake/go_proxy/internal/replay"
+)
+
+// Parts names the parts of a request that can be mutated
+var Parts = []string{"query", "json", "headers"}
+
+// maxShapeBody bounds how much of a response is read to work out its shape
+const maxShapeBody = 1 << 20
+
+// Options selects what to mutate and bounds the run
+type Options struct {
+	// Parts and Generators default to all of them
+	Parts      []string `json:"parts,omitempty"`
+	Generators []string `json:"generators,omitempty"`
+	// Fields limits mutation to these query parameters, JSON paths
+	// (user.name, items[0].id) and header names
+	Fields []string `json:"fields,omitempty"`
+	// Target replaces the captured scheme and host, as for replays
+	Target string `json:"target,omitempty"`
+	// MaxRequests caps the mutated requests sent (default 200)
+	MaxRequests int `json:"max_requests,omitempty"`
+}
+
+// Response summarizes a response for comparison with the baseline
+type Response struct {
+	StatusCode int    `json:"status_code,omitempty"`
+	Shape      string `json:"shape,omitempty"`
+	Size       int64  `json:"size"`
+	DurationMS int64  `json:"duration_ms"`
+	Error      string `json:"error,omitempty"`
+}
+
+// Finding is a mutation whose response differs from the baseline
+type Finding struct {
+	Part      string `json:"part"`
+	Field     string `json:"field"`
+	Generator string `json:"generator"`
+	Payload   string `json:"payload"`
+	Reason    string `json:"reason"`
+	Response
+}
+
+// Report is the outcome of fuzzing one capture
+type Report struct {
+	RequestID string    `json:"request_id"`
+	Baseline  Response  `json:"baseline"`
+	Sent      int       `json:"sent"`
+	Truncated bool      `json:"truncated,omitempty"`
+	Findings  []Finding `json:"findings"`
+}
+
+// mutation is one payload applied to one field of a request
+type mutation struct {
+	part    string
+	field   string
+	payload Payload
+	request *capture.CapturedRequest
+}
+
+// Run sends captured unmodified as the baseline, then once per mutation,
+// and reports mutations answered with another status, another response
+// shape, or an error. Mutations are sent one at a time.
+func Run(ctx context.Context, client *http.Client, captured *capture.CapturedRequest, opts Options) (*Report, error) {
+	if len(opts.Parts) == 0 {
+		opts.Parts = Parts
+	}
+	if len(opts.Generators) == 0 {
+		opts.Generators = Generators
+	}
+	if opts.MaxRequests <= 0 {
+		opts.MaxRequests = 200
+	}
+	for _, part := range opts.Parts {
+		if !slices.Contains(Parts, part) {
+			return nil, fmt.Errorf("unknown part %q (want query, json or headers)", part)
+		}
+	}
+	for _, name := range opts.Generators {
+		if !slices.Contains(Generators, name) {
+			return nil, fmt.Errorf("unknown generator %q (want boundary, long or injection)", name)
+		}
+	}
+	if _, err := replay.NewRequest(ctx, captured, opts.Target); err != nil {
+		return nil, err
+	}
+
+	mutations, err := mutate(captured, opts)
+	if err != nil {
+		return nil, err
+	}
+	report := &Report{RequestID: captured.ID, Findings: []Finding{}}
+	if len(mutations) > opts.MaxRequests {
+		mutations = mutations[:opts.MaxRequests]
+		report.Truncated = true
+	}
+
+	report.Baseline = send(ctx, client, captured, opts.Target)
+	if report.Baseline.Error != "" {
+		return nil, fmt.Errorf("baseline request failed: %s", report.Baseline.Error)
+	}
+	for _, m := range mutations {
+		if ctx.Err() != nil {
+			break
+		}
+		resp := send(ctx, client, m.request, opts.Target)
+		report.Sent++
+
+		var reason string
+		switch {
+		case resp.Error != "":
+			reason = "request failed"
+		case resp.StatusCode != report.Baseline.StatusCode:
+			reason = fmt.Sprintf("status %d, baseline %d", resp.StatusCode, report.Baseline.StatusCode)
+		case resp.Shape != report.Baseline.Shape:
+			reason = "response shape changed"
+		default:
+			continue
+		}
+		report.Findings = append(report.Findings, Finding{
+			Part:      m.part,
+			Field:     m.field,
+			Generator: m.payload.Generator,
+			Payload:   m.payload.Label,
+			Reason:    reason,
+			Response:  resp,
+		})
+	}
+	return report, nil
+}
+
+// mutate builds a mutated copy of captured per selected field and payload
+func mutate(captured *capture.CapturedRequest, opts Options) ([]mutation, error) {
+	payloads := generate(opts.Generators)
+	selected := func(field string) bool {
+		return len(opts.Fields) == 0 || slices.Contains(opts.Fields, field)
+	}
+
+	var mutations []mutation
+	for _, part := range opts.Parts {
+		switch part {
+		case "query":
+			u, err := url.Parse(captured.URL)
+			if err != nil {
+				return nil, fmt.Errorf("capture %s: %w", captured.ID, err)
+			}
+			query := u.Query()
+			for _, name := range sortedKeys(query) {
+				if !selected(name) {
+					continue
+				}
+				for _, p := range payloads {
+					mutated := url.Values{}
+					for k, v := range query {
+						mutated[k] = v
+					}
+					mutated.Set(name, p.Text())
+					mu := *u
+					mu.RawQuery = mutated.Encode()
+					req := *captured
+					req.URL = mu.String()
+					mutations = append(mutations, mutation{part, name, p, &req})
+				}
+			}
+
+		case "json":
+			if http.Header(captured.RequestHeaders).Get("Content-Encoding") != "" {
+				continue
+			}
+			var body interface{}
+			decoder := json.NewDecoder(strings.NewReader(string(captured.RequestBody)))
+			decoder.UseNumber()
+			if err := decoder.Decode(&body); err != nil {
+				continue
+			}
+			for _, path := range leaves(body, "") {
+				if !selected(path) {
+					continue
+				}
+				for _, p := range payloads {
+					mutated, err := json.Marshal(replaceLeaf(body, "", path, p.Value))
+					if err != nil {
+						return nil, err
+					}
+					req := *captured
+					req.RequestBody = mutated
+					mutations = append(mutations, mutation{part, path, p, &req})
+				}
+			}
+
+		case "headers":
+			for _, name := range sortedKeys(captured.RequestHeaders) {
+				canonical := http.CanonicalHeaderKey(name)
+				if !selected(canonical) && !selected(name) {
+					continue
+				}
+				switch canonical {
+				case "Host", "Content-Length", "Content-Encoding", "Transfer-Encoding", "Connection",
+					"Proxy-Connection", "Proxy-Authorization", "Keep-Alive", "Te", "Trailer", "Upgrade":
+					continue
+				}
+				for _, p := range payloads {
+					headers := make(map[string][]string, len(captured.RequestHeaders))
+					for k, v := range captured.RequestHeaders {
+						headers[k] = v
+					}
+					headers[name] = []string{p.Text()}
+					req := *captured
+					req.RequestHeaders = headers
+					mutations = append(mutations, mutation{part, canonical, p, &req})
+				}
+			}
+		}
+	}
+	return mutations, nil
+}
+
+// leaves returns the paths of the scalar values in a decoded JSON document
+func leaves(v interface{}, path string) []string {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		var paths []string
+		for _, key := range sortedKeys(v) {
+			child := key
+			if path != "" {
+				child = path + "." + key
+			}
+			paths = append(paths, leaves(v[key], child)...)
+		}
+		return paths
+	case []interface{}:
+		var paths []string
+		for i, item := range v {
+			paths = append(paths, leaves(item, path+"["+strconv.Itoa(i)+"]")...)
+		}
+		return paths
+	}
+	if path == "" {
+		return nil
+	}
+	return []string{path}
+}
+
+// replaceLeaf returns a copy of v with the value at target replaced
+func replaceLeaf(v interface{}, path, target string, value interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for key, child := range v {
+			childPath := key
+			if path != "" {
+				childPath = path + "." + key
+			}
+			out[key] = replaceLeaf(child, childPath, target, value)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, child := range v {
+			out[i] = replaceLeaf(child, path+"["+strconv.Itoa(i)+"]", target, value)
+		}
+		return out
+	}
+	if path == target {
+		return value
+	}
+	return v
+}
+
+// send makes one request and summarizes the response
+func send(ctx context.Context, client *http.Client, captured *capture.CapturedRequest, target string) Response {
+	var resp Response
+	start := time.Now()
+	defer func() { resp.DurationMS = time.Since(start).Milliseconds() }()
+
+	req, err := replay.NewRequest(ctx, captured, target)
+	if err != nil {
+		resp.Error = err.Error()
+		return resp
+	}
+	r, err := client.Do(req)
+	if err != nil {
+		resp.Error = err.Error()
+		return resp
+	}
+	defer r.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxShapeBody))
+	if err != nil {
+		resp.Error = err.Error()
+		return resp
+	}
+	rest, _ := io.Copy(io.Discard, r.Body)
+	resp.StatusCode = r.StatusCode
+	resp.Size = int64(len(body)) + rest
+	if decoded, err := capture.DecodeBody(r.Header.Get("Content-Encoding"), body, maxShapeBody); err == nil {
+		body = decoded
+	}
+	resp.Shape = shape(r.Header.Get("Content-Type"), body)
+	return resp
+}
+
+// shape describes a response body's structure without its values: the
+// keys and value types of a JSON document, or else the media type
+func shape(contentType string, body []byte) string {
+	if len(body) == 0 {
+		return "empty"
+	}
+	var doc interface{}
+	if json.Unmarshal(body, &doc) == nil {
+		return jsonShape(doc, 0)
+	}
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		return mediaType
+	}
+	return "unknown"
+}
+
+// jsonShape renders the structure of a decoded JSON value, a few levels
+// deep; arrays are described by their first element
+func jsonShape(v interface{}, depth int) string {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if depth >= 4 {
+			return "{...}"
+		}
+		fields := make([]string, 0, len(v))
+		for _, key := range sortedKeys(v) {
+			fields = append(fields, key+":"+jsonShape(v[key], depth+1))
+		}
+		return "{" + strings.Join(fields, ",") + "}"
+	case []interface{}:
+		if len(v) == 0 || depth >= 4 {
+			return "[]"
+		}
+		return "[" + jsonShape(v[0], depth+1) + "]"
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "bool"
+	}
+	return "null"
+}
+
+// sortedKeys returns a map's keys in order, for a stable mutation order
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
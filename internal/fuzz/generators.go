@@ -0,0 +1,70 @@
+package fuzz
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// Payload is one generated value. JSON fields receive Value (a number or
+// a string); query parameters and headers receive its text.
+type Payload struct {
+	Generator string
+	Label     string
+	Value     interface{}
+}
+
+// Text returns the payload as it is sent in a query parameter or header
+func (p Payload) Text() string {
+	switch v := p.Value.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	}
+	return ""
+}
+
+// Generators names the built-in payload generators
+var Generators = []string{"boundary", "long", "injection"}
+
+// generate returns the payloads of the named generators
+func generate(names []string) []Payload {
+	var payloads []Payload
+	for _, name := range names {
+		switch name {
+		case "boundary":
+			for _, n := range []string{
+				"0", "-1", "2147483647", "2147483648", "-2147483649",
+				"9223372036854775807", "9223372036854775808", "1e308", "-0.0000001",
+			} {
+				payloads = append(payloads, Payload{Generator: name, Label: n, Value: json.Number(n)})
+			}
+			payloads = append(payloads, Payload{Generator: name, Label: `""`, Value: ""})
+
+		case "long":
+			for _, n := range []int{256, 4096, 65536} {
+				payloads = append(payloads, Payload{
+					Generator: name,
+					Label:     "A x " + strconv.Itoa(n),
+					Value:     strings.Repeat("A", n),
+				})
+			}
+
+		case "injection":
+			for _, s := range []string{
+				`' OR '1'='1`,
+				`"; DROP TABLE users; --`,
+				`<script>alert(1)</script>`,
+				`../../../../etc/passwd`,
+				`{{7*7}}${7*7}`,
+				`; id`,
+				`%00`,
+				`{"$gt": ""}`,
+			} {
+				payloads = append(payloads, Payload{Generator: name, Label: s, Value: s})
+			}
+		}
+	}
+	return payloads
+}
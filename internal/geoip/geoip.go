@@ -0,0 +1,75 @@
+// Package geoip maps IP addresses to their autonomous system and country
+// using MaxMind DB files, such as GeoLite2-ASN and GeoLite2-Country
+package geoip
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+)
+
+// Info is what the databases know about an address
+type Info struct {
+	ASN     uint   `json:"asn,omitempty"`
+	Org     string `json:"org,omitempty"`
+	Country string `json:"country,omitempty"`
+}
+
+// DB answers lookups from one or more MaxMind DB files; each fills in the
+// fields it has
+type DB struct {
+	readers []*reader
+}
+
+// Open loads the .mmdb files at paths into memory
+func Open(paths []string) (*DB, error) {
+	db := &DB{}
+	for _, path := range paths {
+		file, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		r, err := newReader(file)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		db.readers = append(db.readers, r)
+	}
+	return db, nil
+}
+
+// Lookup returns the ASN, organization and ISO country code of ip. Fields
+// no database covers are left empty.
+func (db *DB) Lookup(ip string) Info {
+	var info Info
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return info
+	}
+	for _, r := range db.readers {
+		record, err := r.lookup(addr)
+		if err != nil || record == nil {
+			continue
+		}
+		if asn, ok := record["autonomous_system_number"].(uint64); ok && info.ASN == 0 {
+			info.ASN = uint(asn)
+		}
+		if org, ok := record["autonomous_system_organization"].(string); ok && info.Org == "" {
+			info.Org = org
+		}
+		if info.Country == "" {
+			info.Country = isoCode(record, "country")
+		}
+		if info.Country == "" {
+			info.Country = isoCode(record, "registered_country")
+		}
+	}
+	return info
+}
+
+// isoCode returns record[key].iso_code
+func isoCode(record map[string]interface{}, key string) string {
+	place, _ := record[key].(map[string]interface{})
+	code, _ := place["iso_code"].(string)
+	return code
+}
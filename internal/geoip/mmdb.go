@@ -0,0 +1,322 @@
+package geoip
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+)
+
+// metadataMarker precedes the metadata map at the end of a MaxMind DB file
+var metadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// dataSectionSeparator is the run of zero bytes between the search tree
+// and the data section
+const dataSectionSeparator = 16
+
+// reader looks up addresses in one MaxMind DB (.mmdb) file, as described
+// in the MaxMind DB format specification 2.0
+type reader struct {
+	databaseType string
+	nodeCount    uint
+	recordSize   uint
+	ipVersion    uint
+	tree         []byte
+	data         []byte
+	// ipv4Start is the node reached after the 96 zero bits that prefix
+	// IPv4 addresses in an IPv6 tree
+	ipv4Start uint
+}
+
+// newReader parses the metadata and layout of an .mmdb file
+func newReader(file []byte) (*reader, error) {
+	i := bytes.LastIndex(file, metadataMarker)
+	if i < 0 {
+		return nil, errors.New("not a MaxMind DB file (no metadata)")
+	}
+	d := decoder{buf: file[i+len(metadataMarker):]}
+	value, _, err := d.decode(0)
+	if err != nil {
+		return nil, fmt.Errorf("metadata: %w", err)
+	}
+	meta, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("metadata is not a map")
+	}
+
+	r := &reader{}
+	r.databaseType, _ = meta["database_type"].(string)
+	nodeCount, _ := meta["node_count"].(uint64)
+	recordSize, _ := meta["record_size"].(uint64)
+	ipVersion, _ := meta["ip_version"].(uint64)
+	r.nodeCount, r.recordSize, r.ipVersion = uint(nodeCount), uint(recordSize), uint(ipVersion)
+	if r.recordSize != 24 && r.recordSize != 28 && r.recordSize != 32 {
+		return nil, fmt.Errorf("unsupported record size %d", r.recordSize)
+	}
+	if r.ipVersion != 4 && r.ipVersion != 6 {
+		return nil, fmt.Errorf("unsupported IP version %d", r.ipVersion)
+	}
+
+	treeSize := r.nodeCount * r.recordSize / 4
+	if treeSize+dataSectionSeparator > uint(i) {
+		return nil, errors.New("search tree is larger than the file")
+	}
+	r.tree = file[:treeSize]
+	r.data = file[treeSize+dataSectionSeparator : i]
+
+	if r.ipVersion == 6 {
+		node := uint(0)
+		for range 96 {
+			if node >= r.nodeCount {
+				break
+			}
+			node = r.record(node, 0)
+		}
+		r.ipv4Start = node
+	}
+	return r, nil
+}
+
+// lookup returns the record for ip, or nil when the database has none
+func (r *reader) lookup(ip netip.Addr) (map[string]interface{}, error) {
+	ip = ip.Unmap()
+	var bits []byte
+	node := uint(0)
+	switch {
+	case ip.Is4() && r.ipVersion == 6:
+		b := ip.As4()
+		bits, node = b[:], r.ipv4Start
+	case ip.Is4():
+		b := ip.As4()
+		bits = b[:]
+	case r.ipVersion == 4:
+		return nil, nil
+	default:
+		b := ip.As16()
+		bits = b[:]
+	}
+
+	for i := 0; i < len(bits)*8 && node < r.nodeCount; i++ {
+		node = r.record(node, uint(bits[i/8]>>(7-i%8))&1)
+	}
+	if node <= r.nodeCount {
+		return nil, nil
+	}
+
+	offset := node - r.nodeCount - dataSectionSeparator
+	d := decoder{buf: r.data}
+	value, _, err := d.decode(offset)
+	if err != nil {
+		return nil, err
+	}
+	record, _ := value.(map[string]interface{})
+	return record, nil
+}
+
+// record reads the left (bit 0) or right (bit 1) record of a tree node
+func (r *reader) record(node, bit uint) uint {
+	switch r.recordSize {
+	case 24:
+		b := r.tree[node*6+bit*3:]
+		return uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+	case 28:
+		b := r.tree[node*7:]
+		if bit == 0 {
+			return uint(b[3]>>4)<<24 | uint(b[0])<<16 | uint(b[1])<<8 | uint(b[2])
+		}
+		return uint(b[3]&0x0f)<<24 | uint(b[4])<<16 | uint(b[5])<<8 | uint(b[6])
+	default:
+		return uint(binary.BigEndian.Uint32(r.tree[node*8+bit*4:]))
+	}
+}
+
+// decoder reads values from a MaxMind DB data section. Unsigned integers
+// decode as uint64, signed ones as int64, and floats as float64.
+type decoder struct {
+	buf []byte
+}
+
+// Data field types
+const (
+	typeExtended = iota
+	typePointer
+	typeString
+	typeDouble
+	typeBytes
+	typeUint16
+	typeUint32
+	typeMap
+	typeInt32
+	typeUint64
+	typeUint128
+	typeArray
+	typeContainer
+	typeEndMarker
+	typeBool
+	typeFloat
+)
+
+// maxDepth bounds nesting, so a corrupt file cannot recurse forever
+const maxDepth = 32
+
+// decode returns the value at offset and the offset after it
+func (d *decoder) decode(offset uint) (interface{}, uint, error) {
+	return d.decodeDepth(offset, 0)
+}
+
+func (d *decoder) decodeDepth(offset uint, depth int) (interface{}, uint, error) {
+	if depth > maxDepth {
+		return nil, 0, errors.New("data nested too deeply")
+	}
+	ctrl, err := d.byteAt(offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	offset++
+
+	kind := uint(ctrl >> 5)
+	if kind == typePointer {
+		pointer, next, err := d.pointer(ctrl, offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		value, _, err := d.decodeDepth(pointer, depth+1)
+		return value, next, err
+	}
+	if kind == typeExtended {
+		ext, err := d.byteAt(offset)
+		if err != nil {
+			return nil, 0, err
+		}
+		kind = 7 + uint(ext)
+		offset++
+	}
+
+	size := uint(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		b, err := d.bytes(offset, n)
+		if err != nil {
+			return nil, 0, err
+		}
+		offset += n
+		var extra uint
+		for _, c := range b {
+			extra = extra<<8 | uint(c)
+		}
+		size = [...]uint{29, 285, 65821}[n-1] + extra
+	}
+
+	switch kind {
+	case typeString, typeBytes:
+		b, err := d.bytes(offset, size)
+		if err != nil {
+			return nil, 0, err
+		}
+		if kind == typeString {
+			return string(b), offset + size, nil
+		}
+		return append([]byte(nil), b...), offset + size, nil
+
+	case typeDouble, typeFloat:
+		b, err := d.bytes(offset, size)
+		if err != nil {
+			return nil, 0, err
+		}
+		switch {
+		case kind == typeDouble && size == 8:
+			return math.Float64frombits(binary.BigEndian.Uint64(b)), offset + size, nil
+		case kind == typeFloat && size == 4:
+			return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), offset + size, nil
+		}
+		return nil, 0, fmt.Errorf("invalid float size %d", size)
+
+	case typeUint16, typeUint32, typeUint64, typeUint128, typeInt32:
+		if size > 16 {
+			return nil, 0, fmt.Errorf("invalid integer size %d", size)
+		}
+		b, err := d.bytes(offset, size)
+		if err != nil {
+			return nil, 0, err
+		}
+		var n uint64
+		for _, c := range b {
+			n = n<<8 | uint64(c)
+		}
+		if kind == typeInt32 {
+			return int64(int32(uint32(n))), offset + size, nil
+		}
+		return n, offset + size, nil
+
+	case typeMap:
+		m := make(map[string]interface{}, size)
+		for range size {
+			key, next, err := d.decodeDepth(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			name, ok := key.(string)
+			if !ok {
+				return nil, 0, errors.New("map key is not a string")
+			}
+			value, next, err := d.decodeDepth(next, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			m[name] = value
+			offset = next
+		}
+		return m, offset, nil
+
+	case typeArray:
+		a := make([]interface{}, 0, min(size, 1024))
+		for range size {
+			value, next, err := d.decodeDepth(offset, depth+1)
+			if err != nil {
+				return nil, 0, err
+			}
+			a = append(a, value)
+			offset = next
+		}
+		return a, offset, nil
+
+	case typeBool:
+		return size != 0, offset, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported data type %d", kind)
+}
+
+// pointer decodes a pointer's target offset from its control byte and
+// the bytes after it
+func (d *decoder) pointer(ctrl byte, offset uint) (uint, uint, error) {
+	n := uint(ctrl>>3)&3 + 1
+	b, err := d.bytes(offset, n)
+	if err != nil {
+		return 0, 0, err
+	}
+	var p uint
+	if n < 4 {
+		p = uint(ctrl & 7)
+	}
+	for _, c := range b {
+		p = p<<8 | uint(c)
+	}
+	p += [...]uint{0, 2048, 526336, 0}[n-1]
+	return p, offset + n, nil
+}
+
+func (d *decoder) byteAt(offset uint) (byte, error) {
+	if offset >= uint(len(d.buf)) {
+		return 0, errors.New("unexpected end of data")
+	}
+	return d.buf[offset], nil
+}
+
+func (d *decoder) bytes(offset, n uint) ([]byte, error) {
+	if offset+n > uint(len(d.buf)) || offset+n < offset {
+		return nil, errors.New("unexpected end of data")
+	}
+	return d.buf[offset : offset+n], nil
+}
@@ -0,0 +1,61 @@
+package graphql
+
+import (
+	"fmt"
+	"math"
+)
+
+// Args are the arguments of a field, or the fields of an input object,
+// with variables substituted. Values are as decoded from JSON or the
+// query: bool, int or float64, string, []interface{} and
+// map[string]interface{}.
+type Args map[string]interface{}
+
+// String returns a string argument, or "" when it is absent
+func (a Args) String(name string) (string, error) {
+	switch v := a[name].(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	}
+	return "", fmt.Errorf("argument %s must be a String", name)
+}
+
+// Int returns an integer argument, or def when it is absent
+func (a Args) Int(name string, def int) (int, error) {
+	switch v := a[name].(type) {
+	case nil:
+		return def, nil
+	case int:
+		return v, nil
+	case float64:
+		// JSON variables decode as float64
+		if v == math.Trunc(v) && math.Abs(v) <= math.MaxInt32 {
+			return int(v), nil
+		}
+	}
+	return 0, fmt.Errorf("argument %s must be an Int", name)
+}
+
+// Bool returns a boolean argument and whether it was given
+func (a Args) Bool(name string) (value, ok bool, err error) {
+	switch v := a[name].(type) {
+	case nil:
+		return false, false, nil
+	case bool:
+		return v, true, nil
+	}
+	return false, false, fmt.Errorf("argument %s must be a Boolean", name)
+}
+
+// Object returns an input object argument, or nil when it is absent
+func (a Args) Object(name string) (Args, error) {
+	switch v := a[name].(type) {
+	case nil:
+		return nil, nil
+	case map[string]interface{}:
+		return Args(v), nil
+	}
+	return nil, fmt.Errorf("argument %s must be an input object", name)
+}
@@ -0,0 +1,380 @@
+// Package graphql executes GraphQL queries against a schema of Go
+// resolvers: operations with variables, aliases, fragments and the @skip
+// and @include directives. Only queries are supported, and introspection
+// is limited to __typename; schemas publish their SDL instead.
+package graphql
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// maxDepth bounds selection nesting, including through fragments
+const maxDepth = 20
+
+// ResolveFunc returns the value of a field of source
+type ResolveFunc func(source interface{}, args Args) (interface{}, error)
+
+// Field is a field of an object type. Type is its GraphQL type, e.g.
+// "[Capture!]!"; when it names an object type, the value is resolved
+// further with that type's fields.
+type Field struct {
+	Type    string
+	Resolve ResolveFunc
+}
+
+// Object is an object type
+type Object struct {
+	Name   string
+	Fields map[string]*Field
+}
+
+// Schema is a query type, the object types reachable from it, and the
+// SDL describing them to clients
+type Schema struct {
+	query *Object
+	types map[string]*Object
+	sdl   string
+}
+
+// NewSchema returns a schema rooted at query
+func NewSchema(sdl string, query *Object, types ...*Object) *Schema {
+	s := &Schema{query: query, types: map[string]*Object{query.Name: query}, sdl: sdl}
+	for _, t := range types {
+		s.types[t.Name] = t
+	}
+	return s
+}
+
+// SDL returns the schema definition
+func (s *Schema) SDL() string {
+	return s.sdl
+}
+
+// Request is a GraphQL request as posted by clients
+type Request struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName,omitempty"`
+	Variables     map[string]interface{} `json:"variables,omitempty"`
+}
+
+// Response is a GraphQL response. Data is nil when the request could not
+// be executed at all.
+type Response struct {
+	Data   interface{} `json:"data"`
+	Errors []Error     `json:"errors,omitempty"`
+}
+
+// Error is a request error, or a field error with the path of the field
+type Error struct {
+	Message string        `json:"message"`
+	Path    []interface{} `json:"path,omitempty"`
+}
+
+// Execute runs the operation a request names, or its only operation.
+// Query fields resolve with root as their source.
+func (s *Schema) Execute(req Request, root interface{}) Response {
+	doc, err := parse(req.Query)
+	if err != nil {
+		return Response{Errors: []Error{{Message: err.Error()}}}
+	}
+
+	var op *operation
+	for _, candidate := range doc.operations {
+		if req.OperationName == "" || candidate.name == req.OperationName {
+			if op != nil {
+				return Response{Errors: []Error{{Message: "operationName is required for documents with several operations"}}}
+			}
+			op = candidate
+		}
+	}
+	if op == nil {
+		return Response{Errors: []Error{{Message: fmt.Sprintf("unknown operation %q", req.OperationName)}}}
+	}
+	if op.kind != "query" {
+		return Response{Errors: []Error{{Message: op.kind + " operations are not supported"}}}
+	}
+
+	vars := make(map[string]interface{}, len(op.variables))
+	declared := make(map[string]bool, len(op.variables))
+	for _, def := range op.variables {
+		declared[def.name] = true
+		v, ok := req.Variables[def.name]
+		switch {
+		case ok:
+			vars[def.name] = v
+		case def.hasDef:
+			vars[def.name] = def.def
+		case def.nonNull:
+			return Response{Errors: []Error{{Message: fmt.Sprintf("variable $%s is required", def.name)}}}
+		}
+	}
+
+	e := &executor{schema: s, doc: doc, vars: vars, declared: declared}
+	data := e.selectionSet(s.query, root, op.selection, nil, 0)
+	return Response{Data: data, Errors: e.errors}
+}
+
+// executor holds the state of one request
+type executor struct {
+	schema   *Schema
+	doc      *document
+	vars     map[string]interface{}
+	declared map[string]bool
+	errors   []Error
+}
+
+func (e *executor) fail(path []interface{}, format string, args ...interface{}) {
+	e.errors = append(e.errors, Error{Message: fmt.Sprintf(format, args...), Path: append([]interface{}(nil), path...)})
+}
+
+// selectionSet resolves the selected fields of source as type obj
+func (e *executor) selectionSet(obj *Object, source interface{}, set []selection, path []interface{}, depth int) *orderedMap {
+	result := &orderedMap{values: make(map[string]interface{})}
+	if depth > maxDepth {
+		e.fail(path, "query is nested more than %d levels deep", maxDepth)
+		return result
+	}
+
+	fields := &orderedFields{byAlias: make(map[string][]selection)}
+	if err := e.collect(obj, set, fields, make(map[string]bool)); err != nil {
+		e.fail(path, "%v", err)
+		return result
+	}
+
+	for _, alias := range fields.aliases {
+		sels := fields.byAlias[alias]
+		first := sels[0]
+		fieldPath := append(path, alias)
+		if first.name == "__typename" {
+			result.set(alias, obj.Name)
+			continue
+		}
+		field, ok := obj.Fields[first.name]
+		if !ok {
+			e.fail(fieldPath, "cannot query field %q on type %s", first.name, obj.Name)
+			result.set(alias, nil)
+			continue
+		}
+
+		// Repeated selections of one field merge their subfields
+		var sub []selection
+		for _, sel := range sels {
+			sub = append(sub, sel.selection...)
+		}
+		named := strings.Trim(field.Type, "[]!")
+		if _, isObject := e.schema.types[named]; isObject != (len(sub) > 0) {
+			if isObject {
+				e.fail(fieldPath, "field %q of type %s must have a selection of subfields", first.name, named)
+			} else {
+				e.fail(fieldPath, "field %q of type %s has no subfields", first.name, named)
+			}
+			result.set(alias, nil)
+			continue
+		}
+
+		args, err := e.resolveValue(first.args)
+		if err != nil {
+			e.fail(fieldPath, "%v", err)
+			result.set(alias, nil)
+			continue
+		}
+		value, err := field.Resolve(source, Args(args.(map[string]interface{})))
+		if err != nil {
+			e.fail(fieldPath, "%v", err)
+			result.set(alias, nil)
+			continue
+		}
+		result.set(alias, e.complete(field.Type, value, sub, fieldPath, depth))
+	}
+	return result
+}
+
+// complete shapes a resolved value by its type: lists element by
+// element, objects by their selection, scalars as they are
+func (e *executor) complete(typ string, value interface{}, set []selection, path []interface{}, depth int) interface{} {
+	if isNil(value) {
+		return nil
+	}
+	typ = strings.TrimSuffix(typ, "!")
+
+	if strings.HasPrefix(typ, "[") {
+		elem := typ[1 : len(typ)-1]
+		v := reflect.ValueOf(value)
+		if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+			e.fail(path, "internal error: %s is not a list", typ)
+			return nil
+		}
+		list := make([]interface{}, v.Len())
+		for i := range list {
+			list[i] = e.complete(elem, v.Index(i).Interface(), set, append(path, i), depth)
+		}
+		return list
+	}
+
+	if obj, ok := e.schema.types[typ]; ok {
+		return e.selectionSet(obj, value, set, path, depth+1)
+	}
+	return value
+}
+
+// orderedFields groups the fields of a selection set by response name,
+// in the order they first appear
+type orderedFields struct {
+	aliases []string
+	byAlias map[string][]selection
+}
+
+// collect flattens fragments into fields, applying @skip and @include
+func (e *executor) collect(obj *Object, set []selection, fields *orderedFields, visited map[string]bool) error {
+	for _, sel := range set {
+		include, err := e.included(sel.directives)
+		if err != nil {
+			return err
+		}
+		if !include {
+			continue
+		}
+
+		switch {
+		case sel.spread != "":
+			if visited[sel.spread] {
+				continue
+			}
+			visited[sel.spread] = true
+			frag, ok := e.doc.fragments[sel.spread]
+			if !ok {
+				return fmt.Errorf("unknown fragment %q", sel.spread)
+			}
+			if frag.on != obj.Name {
+				return fmt.Errorf("fragment %q on %s cannot apply to %s", sel.spread, frag.on, obj.Name)
+			}
+			if err := e.collect(obj, frag.selection, fields, visited); err != nil {
+				return err
+			}
+		case sel.inline:
+			if sel.on != "" && sel.on != obj.Name {
+				return fmt.Errorf("inline fragment on %s cannot apply to %s", sel.on, obj.Name)
+			}
+			if err := e.collect(obj, sel.selection, fields, visited); err != nil {
+				return err
+			}
+		default:
+			if _, seen := fields.byAlias[sel.alias]; !seen {
+				fields.aliases = append(fields.aliases, sel.alias)
+			} else if fields.byAlias[sel.alias][0].name != sel.name {
+				return fmt.Errorf("%q selects both %s and %s", sel.alias, fields.byAlias[sel.alias][0].name, sel.name)
+			}
+			fields.byAlias[sel.alias] = append(fields.byAlias[sel.alias], sel)
+		}
+	}
+	return nil
+}
+
+// included evaluates @skip(if:) and @include(if:)
+func (e *executor) included(dirs []directive) (bool, error) {
+	for _, d := range dirs {
+		if d.name != "skip" && d.name != "include" {
+			return false, fmt.Errorf("unknown directive @%s", d.name)
+		}
+		v, err := e.resolveValue(d.args["if"])
+		if err != nil {
+			return false, err
+		}
+		cond, ok := v.(bool)
+		if !ok {
+			return false, fmt.Errorf("@%s needs a Boolean if argument", d.name)
+		}
+		if cond == (d.name == "skip") {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// resolveValue substitutes variables in an argument value
+func (e *executor) resolveValue(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case variable:
+		if !e.declared[string(v)] {
+			return nil, fmt.Errorf("variable $%s is not defined", string(v))
+		}
+		return e.vars[string(v)], nil
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			var err error
+			if list[i], err = e.resolveValue(item); err != nil {
+				return nil, err
+			}
+		}
+		return list, nil
+	case map[string]interface{}:
+		obj := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			resolved, err := e.resolveValue(item)
+			if err != nil {
+				return nil, err
+			}
+			// A variable the request leaves unset leaves the field out
+			if name, ok := item.(variable); ok {
+				if _, set := e.vars[string(name)]; !set {
+					continue
+				}
+			}
+			obj[k] = resolved
+		}
+		return obj, nil
+	case enumValue:
+		return string(v), nil
+	}
+	return v, nil
+}
+
+func isNil(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	switch rv := reflect.ValueOf(v); rv.Kind() {
+	case reflect.Pointer, reflect.Map, reflect.Slice, reflect.Interface:
+		return rv.IsNil()
+	}
+	return false
+}
+
+// orderedMap is a response object, keeping fields in selection order
+type orderedMap struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func (m *orderedMap) set(key string, value interface{}) {
+	if _, ok := m.values[key]; !ok {
+		m.keys = append(m.keys, key)
+	}
+	m.values[key] = value
+}
+
+// MarshalJSON writes the fields in order
+func (m *orderedMap) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, k := range m.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(k)
+		buf.Write(key)
+		buf.WriteByte(':')
+		value, err := json.Marshal(m.values[k])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,114 @@
+package graphql
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+type testItem struct {
+	Name string
+	Tags []string
+}
+
+func testSchema() *Schema {
+	item := &Object{Name: "Item", Fields: map[string]*Field{
+		"name": {Type: "String!", Resolve: func(source interface{}, args Args) (interface{}, error) {
+			return source.(testItem).Name, nil
+		}},
+		"tags": {Type: "[String!]!", Resolve: func(source interface{}, args Args) (interface{}, error) {
+			return source.(testItem).Tags, nil
+		}},
+	}}
+	query := &Object{Name: "Query", Fields: map[string]*Field{
+		"items": {Type: "[Item!]!", Resolve: func(source interface{}, args Args) (interface{}, error) {
+			limit, err := args.Int("limit", 10)
+			if err != nil {
+				return nil, err
+			}
+			items := source.([]testItem)
+			if limit < len(items) {
+				items = items[:limit]
+			}
+			return items, nil
+		}},
+		"echo": {Type: "String", Resolve: func(source interface{}, args Args) (interface{}, error) {
+			if filter, err := args.Object("filter"); err != nil || filter != nil {
+				return fmt.Sprint(filter), err
+			}
+			return args.String("text")
+		}},
+	}}
+	return NewSchema("type Query { items(limit: Int): [Item!]! echo(text: String): String }", query, item)
+}
+
+func TestExecute(t *testing.T) {
+	root := []testItem{{Name: "a", Tags: []string{"x"}}, {Name: "b"}}
+	tests := []struct {
+		name string
+		req  Request
+		want string
+	}{
+		{"shorthand", Request{Query: "{ items { name } }"}, `{"data":{"items":[{"name":"a"},{"name":"b"}]}}`},
+		{"alias and argument", Request{Query: `query { first: items(limit: 1) { name tags } }`}, `{"data":{"first":[{"name":"a","tags":["x"]}]}}`},
+		{"variables", Request{Query: `query Q($n: Int = 5) { items(limit: $n) { name } }`, Variables: map[string]interface{}{"n": 1.0}}, `{"data":{"items":[{"name":"a"}]}}`},
+		{"default variable", Request{Query: `query Q($n: Int = 1) { items(limit: $n) { name } }`}, `{"data":{"items":[{"name":"a"}]}}`},
+		{"fragment", Request{Query: `{ items(limit: 1) { ...F } } fragment F on Item { name }`}, `{"data":{"items":[{"name":"a"}]}}`},
+		{"inline fragment", Request{Query: `{ items(limit: 1) { ... on Item { name } } }`}, `{"data":{"items":[{"name":"a"}]}}`},
+		{"skip and include", Request{Query: `{ items(limit: 1) { name @skip(if: true) tags @include(if: true) } }`}, `{"data":{"items":[{"tags":["x"]}]}}`},
+		{"typename", Request{Query: `{ __typename }`}, `{"data":{"__typename":"Query"}}`},
+		{"strings", Request{Query: `{ a: echo(text: "q\"é\n") b: echo(text: """ block """) }`}, `{"data":{"a":"q\"é\n","b":"block"}}`},
+		{"input object", Request{Query: `{ echo(filter: {k: [1, 2.5, true, null, E]}) }`}, `{"data":{"echo":"map[k:[1 2.5 true \u003cnil\u003e E]]"}}`},
+		{"operation name", Request{Query: `query A { __typename } query B { echo(text: "b") }`, OperationName: "B"}, `{"data":{"echo":"b"}}`},
+		{"unknown field", Request{Query: `{ nope }`}, `{"data":{"nope":null},"errors":[{"message":"cannot query field \"nope\" on type Query","path":["nope"]}]}`},
+		{"missing subfields", Request{Query: `{ items }`}, `{"data":{"items":null},"errors":[{"message":"field \"items\" of type Item must have a selection of subfields","path":["items"]}]}`},
+		{"required variable", Request{Query: `query($n: Int!) { items(limit: $n) { name } }`}, `{"data":null,"errors":[{"message":"variable $n is required"}]}`},
+		{"mutation", Request{Query: `mutation { x }`}, `{"data":null,"errors":[{"message":"mutation operations are not supported"}]}`},
+		{"syntax error", Request{Query: `{ items( }`}, `{"data":null,"errors":[{"message":"syntax error at offset 9: unexpected \"}\""}]}`},
+		{"unterminated string", Request{Query: `{ echo(text: "x) }`}, `{"data":null,"errors":[{"message":"syntax error at offset 13: unterminated string"}]}`},
+	}
+	schema := testSchema()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := json.Marshal(schema.Execute(tt.req, root))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Fatalf("got  %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRejectsDeepNesting(t *testing.T) {
+	for _, query := range []string{
+		strings.Repeat("{ a ", 100000) + strings.Repeat("}", 100000),
+		"{ echo(text: " + strings.Repeat("[", 100000) + strings.Repeat("]", 100000) + ") }",
+		"query($v: " + strings.Repeat("[", 100000) + "Int" + strings.Repeat("]", 100000) + ") { __typename }",
+	} {
+		if _, err := parse(query); err == nil || !strings.Contains(err.Error(), "nested more than") {
+			t.Errorf("deeply nested query parsed with error %v", err)
+		}
+	}
+}
+
+func FuzzExecute(f *testing.F) {
+	for _, seed := range []string{
+		"{ items { name } }",
+		`query Q($n: Int = 5) { items(limit: $n) { ...F @include(if: true) } } fragment F on Item { name tags }`,
+		`{ echo(text: "aA", filter: {k: [1, -2.5e3, """x"""]}) }`,
+		"# comment\n{ __typename, ... on Query { __typename } }",
+	} {
+		f.Add(seed)
+	}
+	schema := testSchema()
+	root := []testItem{{Name: "a", Tags: []string{"x"}}}
+	f.Fuzz(func(t *testing.T, query string) {
+		resp := schema.Execute(Request{Query: query, Variables: map[string]interface{}{"n": 1.0}}, root)
+		if _, err := json.Marshal(resp); err != nil {
+			t.Fatalf("response does not marshal: %v", err)
+		}
+	})
+}
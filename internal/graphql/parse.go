@@ -0,0 +1,622 @@
+package graphql
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// document is a parsed GraphQL request document
+type document struct {
+	operations []*operation
+	fragments  map[string]*fragment
+}
+
+type operation struct {
+	kind      string // query, mutation or subscription
+	name      string
+	variables []variableDef
+	selection []selection
+}
+
+type variableDef struct {
+	name    string
+	def     interface{}
+	hasDef  bool
+	nonNull bool
+}
+
+type fragment struct {
+	on        string
+	selection []selection
+}
+
+// selection is a field, a fragment spread (spread set) or an inline
+// fragment (inline set)
+type selection struct {
+	alias      string
+	name       string
+	args       map[string]interface{}
+	directives []directive
+	selection  []selection
+
+	spread string
+	inline bool
+	on     string
+}
+
+type directive struct {
+	name string
+	args map[string]interface{}
+}
+
+// variable is a $name reference inside an argument value
+type variable string
+
+// enumValue is a bare name used as an argument value
+type enumValue string
+
+// token kinds
+const (
+	tokEOF = iota
+	tokPunct
+	tokName
+	tokInt
+	tokFloat
+	tokString
+)
+
+type token struct {
+	kind  int
+	value string
+	pos   int
+}
+
+// maxParseDepth bounds nesting of selections, values and list types
+// while parsing, which recurses once per level; execution allows less
+const maxParseDepth = 64
+
+type parser struct {
+	src   string
+	pos   int
+	tok   token
+	depth int
+}
+
+// enter steps one level deeper; leave must be called on the way out
+func (p *parser) enter() error {
+	if p.depth++; p.depth > maxParseDepth {
+		return fmt.Errorf("syntax error at offset %d: nested more than %d levels deep", p.tok.pos, maxParseDepth)
+	}
+	return nil
+}
+
+func (p *parser) leave() {
+	p.depth--
+}
+
+// parse parses a request document
+func parse(src string) (*document, error) {
+	p := &parser{src: src}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	doc := &document{fragments: make(map[string]*fragment)}
+	for p.tok.kind != tokEOF {
+		switch {
+		case p.isPunct("{"):
+			sel, err := p.selectionSet()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, &operation{kind: "query", selection: sel})
+		case p.tok.kind == tokName && p.tok.value == "fragment":
+			name, frag, err := p.fragmentDef()
+			if err != nil {
+				return nil, err
+			}
+			if _, dup := doc.fragments[name]; dup {
+				return nil, fmt.Errorf("fragment %q is defined twice", name)
+			}
+			doc.fragments[name] = frag
+		case p.tok.kind == tokName && (p.tok.value == "query" || p.tok.value == "mutation" || p.tok.value == "subscription"):
+			op, err := p.operationDef()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, op)
+		default:
+			return nil, p.unexpected()
+		}
+	}
+	if len(doc.operations) == 0 {
+		return nil, fmt.Errorf("document has no operation")
+	}
+	return doc, nil
+}
+
+func (p *parser) operationDef() (*operation, error) {
+	op := &operation{kind: p.tok.value}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	if p.tok.kind == tokName {
+		op.name = p.tok.value
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+	}
+	if p.isPunct("(") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		for !p.isPunct(")") {
+			def, err := p.variableDef()
+			if err != nil {
+				return nil, err
+			}
+			op.variables = append(op.variables, def)
+		}
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := p.directives(); err != nil {
+		return nil, err
+	}
+	sel, err := p.selectionSet()
+	op.selection = sel
+	return op, err
+}
+
+func (p *parser) variableDef() (variableDef, error) {
+	var def variableDef
+	if err := p.expect("$"); err != nil {
+		return def, err
+	}
+	name, err := p.name()
+	if err != nil {
+		return def, err
+	}
+	def.name = name
+	if err := p.expect(":"); err != nil {
+		return def, err
+	}
+	if def.nonNull, err = p.typeRef(); err != nil {
+		return def, err
+	}
+	if p.isPunct("=") {
+		if err := p.next(); err != nil {
+			return def, err
+		}
+		if def.def, err = p.value(true); err != nil {
+			return def, err
+		}
+		def.hasDef = true
+	}
+	_, err = p.directives()
+	return def, err
+}
+
+// typeRef skips a type reference, reporting whether it is non-null
+func (p *parser) typeRef() (bool, error) {
+	if err := p.enter(); err != nil {
+		return false, err
+	}
+	defer p.leave()
+	if p.isPunct("[") {
+		if err := p.next(); err != nil {
+			return false, err
+		}
+		if _, err := p.typeRef(); err != nil {
+			return false, err
+		}
+		if err := p.expect("]"); err != nil {
+			return false, err
+		}
+	} else if _, err := p.name(); err != nil {
+		return false, err
+	}
+	if p.isPunct("!") {
+		return true, p.next()
+	}
+	return false, nil
+}
+
+func (p *parser) fragmentDef() (string, *fragment, error) {
+	if err := p.next(); err != nil {
+		return "", nil, err
+	}
+	name, err := p.name()
+	if err != nil {
+		return "", nil, err
+	}
+	if name == "on" {
+		return "", nil, fmt.Errorf("fragment cannot be named \"on\"")
+	}
+	if p.tok.kind != tokName || p.tok.value != "on" {
+		return "", nil, p.unexpected()
+	}
+	if err := p.next(); err != nil {
+		return "", nil, err
+	}
+	frag := &fragment{}
+	if frag.on, err = p.name(); err != nil {
+		return "", nil, err
+	}
+	if _, err := p.directives(); err != nil {
+		return "", nil, err
+	}
+	frag.selection, err = p.selectionSet()
+	return name, frag, err
+}
+
+func (p *parser) selectionSet() ([]selection, error) {
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer p.leave()
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var set []selection
+	for !p.isPunct("}") {
+		sel, err := p.selection()
+		if err != nil {
+			return nil, err
+		}
+		set = append(set, sel)
+	}
+	return set, p.next()
+}
+
+func (p *parser) selection() (selection, error) {
+	var sel selection
+	var err error
+	if p.isPunct("...") {
+		if err := p.next(); err != nil {
+			return sel, err
+		}
+		if p.tok.kind == tokName && p.tok.value != "on" {
+			sel.spread = p.tok.value
+			if err := p.next(); err != nil {
+				return sel, err
+			}
+			sel.directives, err = p.directives()
+			return sel, err
+		}
+		sel.inline = true
+		if p.tok.kind == tokName {
+			if err := p.next(); err != nil {
+				return sel, err
+			}
+			if sel.on, err = p.name(); err != nil {
+				return sel, err
+			}
+		}
+		if sel.directives, err = p.directives(); err != nil {
+			return sel, err
+		}
+		sel.selection, err = p.selectionSet()
+		return sel, err
+	}
+
+	if sel.name, err = p.name(); err != nil {
+		return sel, err
+	}
+	if p.isPunct(":") {
+		if err := p.next(); err != nil {
+			return sel, err
+		}
+		sel.alias = sel.name
+		if sel.name, err = p.name(); err != nil {
+			return sel, err
+		}
+	}
+	if sel.alias == "" {
+		sel.alias = sel.name
+	}
+	if sel.args, err = p.arguments(); err != nil {
+		return sel, err
+	}
+	if sel.directives, err = p.directives(); err != nil {
+		return sel, err
+	}
+	if p.isPunct("{") {
+		sel.selection, err = p.selectionSet()
+	}
+	return sel, err
+}
+
+func (p *parser) arguments() (map[string]interface{}, error) {
+	args := map[string]interface{}{}
+	if !p.isPunct("(") {
+		return args, nil
+	}
+	if err := p.next(); err != nil {
+		return nil, err
+	}
+	for !p.isPunct(")") {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		if args[name], err = p.value(false); err != nil {
+			return nil, err
+		}
+	}
+	return args, p.next()
+}
+
+func (p *parser) directives() ([]directive, error) {
+	var dirs []directive
+	for p.isPunct("@") {
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		args, err := p.arguments()
+		if err != nil {
+			return nil, err
+		}
+		dirs = append(dirs, directive{name: name, args: args})
+	}
+	return dirs, nil
+}
+
+// value parses an argument value; constant values may not reference
+// variables
+func (p *parser) value(constant bool) (interface{}, error) {
+	if err := p.enter(); err != nil {
+		return nil, err
+	}
+	defer p.leave()
+	tok := p.tok
+	switch {
+	case tok.kind == tokPunct && tok.value == "$" && !constant:
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		name, err := p.name()
+		return variable(name), err
+	case tok.kind == tokPunct && tok.value == "[":
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		list := []interface{}{}
+		for !p.isPunct("]") {
+			v, err := p.value(constant)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return list, p.next()
+	case tok.kind == tokPunct && tok.value == "{":
+		if err := p.next(); err != nil {
+			return nil, err
+		}
+		obj := map[string]interface{}{}
+		for !p.isPunct("}") {
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			if obj[name], err = p.value(constant); err != nil {
+				return nil, err
+			}
+		}
+		return obj, p.next()
+	case tok.kind == tokInt:
+		n, err := strconv.ParseInt(tok.value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid integer %s", tok.value)
+		}
+		return int(n), p.next()
+	case tok.kind == tokFloat:
+		f, err := strconv.ParseFloat(tok.value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %s", tok.value)
+		}
+		return f, p.next()
+	case tok.kind == tokString:
+		return tok.value, p.next()
+	case tok.kind == tokName:
+		var v interface{}
+		switch tok.value {
+		case "true":
+			v = true
+		case "false":
+			v = false
+		case "null":
+			v = nil
+		default:
+			v = enumValue(tok.value)
+		}
+		return v, p.next()
+	}
+	return nil, p.unexpected()
+}
+
+func (p *parser) isPunct(s string) bool {
+	return p.tok.kind == tokPunct && p.tok.value == s
+}
+
+func (p *parser) expect(s string) error {
+	if !p.isPunct(s) {
+		return p.unexpected()
+	}
+	return p.next()
+}
+
+func (p *parser) name() (string, error) {
+	if p.tok.kind != tokName {
+		return "", p.unexpected()
+	}
+	name := p.tok.value
+	return name, p.next()
+}
+
+func (p *parser) unexpected() error {
+	if p.tok.kind == tokEOF {
+		return fmt.Errorf("syntax error: unexpected end of document")
+	}
+	return fmt.Errorf("syntax error at offset %d: unexpected %q", p.tok.pos, p.tok.value)
+}
+
+// next reads the following token, skipping whitespace, commas and
+// comments
+func (p *parser) next() error {
+	for p.pos < len(p.src) {
+		c := p.src[p.pos]
+		if c == '#' {
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' && p.src[p.pos] != '\r' {
+				p.pos++
+			}
+			continue
+		}
+		if c != ' ' && c != '\t' && c != '\n' && c != '\r' && c != ',' {
+			break
+		}
+		p.pos++
+	}
+	start := p.pos
+	if p.pos >= len(p.src) {
+		p.tok = token{kind: tokEOF, pos: start}
+		return nil
+	}
+
+	c := p.src[p.pos]
+	switch {
+	case strings.HasPrefix(p.src[p.pos:], "..."):
+		p.pos += 3
+		p.tok = token{kind: tokPunct, value: "...", pos: start}
+	case strings.IndexByte("!$()&:=@[]{}|", c) >= 0:
+		p.pos++
+		p.tok = token{kind: tokPunct, value: string(c), pos: start}
+	case c == '_' || isLetter(c):
+		for p.pos < len(p.src) && (p.src[p.pos] == '_' || isLetter(p.src[p.pos]) || isDigit(p.src[p.pos])) {
+			p.pos++
+		}
+		p.tok = token{kind: tokName, value: p.src[start:p.pos], pos: start}
+	case c == '-' || isDigit(c):
+		return p.number()
+	case c == '"':
+		return p.string()
+	default:
+		return fmt.Errorf("syntax error at offset %d: unexpected character %q", start, c)
+	}
+	return nil
+}
+
+func (p *parser) number() error {
+	start := p.pos
+	if p.src[p.pos] == '-' {
+		p.pos++
+	}
+	digits := func() {
+		for p.pos < len(p.src) && isDigit(p.src[p.pos]) {
+			p.pos++
+		}
+	}
+	digits()
+	kind := tokInt
+	if p.pos < len(p.src) && p.src[p.pos] == '.' {
+		kind = tokFloat
+		p.pos++
+		digits()
+	}
+	if p.pos < len(p.src) && (p.src[p.pos] == 'e' || p.src[p.pos] == 'E') {
+		kind = tokFloat
+		p.pos++
+		if p.pos < len(p.src) && (p.src[p.pos] == '+' || p.src[p.pos] == '-') {
+			p.pos++
+		}
+		digits()
+	}
+	p.tok = token{kind: kind, value: p.src[start:p.pos], pos: start}
+	return nil
+}
+
+// string reads a quoted or """block""" string
+func (p *parser) string() error {
+	start := p.pos
+	if strings.HasPrefix(p.src[p.pos:], `"""`) {
+		end := strings.Index(p.src[p.pos+3:], `"""`)
+		if end < 0 {
+			return fmt.Errorf("syntax error at offset %d: unterminated string", start)
+		}
+		raw := p.src[p.pos+3 : p.pos+3+end]
+		p.pos += end + 6
+		p.tok = token{kind: tokString, value: strings.TrimSpace(raw), pos: start}
+		return nil
+	}
+
+	var b strings.Builder
+	p.pos++
+	for {
+		if p.pos >= len(p.src) || p.src[p.pos] == '\n' {
+			return fmt.Errorf("syntax error at offset %d: unterminated string", start)
+		}
+		c := p.src[p.pos]
+		if c == '"' {
+			p.pos++
+			break
+		}
+		if c != '\\' {
+			b.WriteByte(c)
+			p.pos++
+			continue
+		}
+		if p.pos+1 >= len(p.src) {
+			return fmt.Errorf("syntax error at offset %d: unterminated string", start)
+		}
+		esc := p.src[p.pos+1]
+		p.pos += 2
+		switch esc {
+		case '"', '\\', '/':
+			b.WriteByte(esc)
+		case 'b':
+			b.WriteByte('\b')
+		case 'f':
+			b.WriteByte('\f')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case 'u':
+			if p.pos+4 > len(p.src) {
+				return fmt.Errorf("syntax error at offset %d: bad unicode escape", p.pos)
+			}
+			r, err := strconv.ParseUint(p.src[p.pos:p.pos+4], 16, 32)
+			if err != nil {
+				return fmt.Errorf("syntax error at offset %d: bad unicode escape", p.pos)
+			}
+			b.WriteRune(rune(r))
+			p.pos += 4
+		default:
+			return fmt.Errorf("syntax error at offset %d: bad escape \\%c", p.pos-1, esc)
+		}
+	}
+	p.tok = token{kind: tokString, value: b.String(), pos: start}
+	return nil
+}
+
+func isLetter(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
@@ -0,0 +1,188 @@
+// Package grpc serves gRPC over cleartext HTTP/2 with net/http alone:
+// message framing, status trailers and a small protobuf wire codec, enough
+// for hand-written services without generated code
+package grpc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// maxMessageSize bounds a request message
+const maxMessageSize = 4 << 20
+
+// Code is a gRPC status code
+type Code int
+
+// Status codes used by this package and its services
+const (
+	OK                 Code = 0
+	Canceled           Code = 1
+	Unknown            Code = 2
+	InvalidArgument    Code = 3
+	NotFound           Code = 5
+	PermissionDenied   Code = 7
+	ResourceExhausted  Code = 8
+	FailedPrecondition Code = 9
+	Unimplemented      Code = 12
+	Internal           Code = 13
+	Unauthenticated    Code = 16
+)
+
+// Status is an error carrying a gRPC status code
+type Status struct {
+	Code    Code
+	Message string
+}
+
+func (s *Status) Error() string {
+	return fmt.Sprintf("grpc status %d: %s", s.Code, s.Message)
+}
+
+// Errorf returns a Status error
+func Errorf(code Code, format string, args ...interface{}) error {
+	return &Status{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// UnaryHandler answers a request message with one response message
+type UnaryHandler func(r *http.Request, in []byte) ([]byte, error)
+
+// StreamHandler answers a request message with any number of response
+// messages passed to send, until it returns
+type StreamHandler func(r *http.Request, in []byte, send func([]byte) error) error
+
+// Server dispatches gRPC calls by method path, /package.Service/Method
+type Server struct {
+	unary  map[string]UnaryHandler
+	stream map[string]StreamHandler
+}
+
+// NewServer returns a server with no methods
+func NewServer() *Server {
+	return &Server{
+		unary:  make(map[string]UnaryHandler),
+		stream: make(map[string]StreamHandler),
+	}
+}
+
+// Unary registers a unary method
+func (s *Server) Unary(method string, h UnaryHandler) {
+	s.unary[method] = h
+}
+
+// Stream registers a server-streaming method
+func (s *Server) Stream(method string, h StreamHandler) {
+	s.stream[method] = h
+}
+
+// ServeHTTP handles one gRPC call. Requests must come over HTTP/2 with
+// an uncompressed message.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "gRPC requests only", http.StatusUnsupportedMediaType)
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+
+	unary, isUnary := s.unary[r.URL.Path]
+	stream, isStream := s.stream[r.URL.Path]
+	if !isUnary && !isStream {
+		writeStatus(w, Errorf(Unimplemented, "unknown method %s", r.URL.Path))
+		return
+	}
+
+	in, err := readMessage(r.Body)
+	if err != nil {
+		writeStatus(w, err)
+		return
+	}
+
+	if isUnary {
+		out, err := unary(r, in)
+		if err == nil {
+			err = writeMessage(w, out)
+		}
+		writeStatus(w, err)
+		return
+	}
+
+	flusher, _ := w.(http.Flusher)
+	err = stream(r, in, func(out []byte) error {
+		if err := writeMessage(w, out); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	})
+	if err != nil && r.Context().Err() != nil {
+		err = Errorf(Canceled, "call canceled")
+	}
+	writeStatus(w, err)
+}
+
+// readMessage reads the single length-prefixed message of a request
+func readMessage(body io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(body, prefix[:]); err != nil {
+		return nil, Errorf(InvalidArgument, "missing request message")
+	}
+	if prefix[0] != 0 {
+		return nil, Errorf(Unimplemented, "compressed messages are not supported")
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if size > maxMessageSize {
+		return nil, Errorf(ResourceExhausted, "request message of %d bytes exceeds %d", size, maxMessageSize)
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(body, msg); err != nil {
+		return nil, Errorf(InvalidArgument, "truncated request message")
+	}
+	return msg, nil
+}
+
+// writeMessage writes one length-prefixed, uncompressed message
+func writeMessage(w io.Writer, msg []byte) error {
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	_, err := w.Write(append(frame, msg...))
+	return err
+}
+
+// writeStatus ends a call with the grpc-status and grpc-message trailers
+// for err; errors other than Status are reported as Unknown
+func writeStatus(w http.ResponseWriter, err error) {
+	code, msg := OK, ""
+	if err != nil {
+		var status *Status
+		if errors.As(err, &status) {
+			code, msg = status.Code, status.Message
+		} else {
+			code, msg = Unknown, err.Error()
+		}
+	}
+	w.Header().Set(http.TrailerPrefix+"Grpc-Status", strconv.Itoa(int(code)))
+	if msg != "" {
+		w.Header().Set(http.TrailerPrefix+"Grpc-Message", percentEncode(msg))
+	}
+}
+
+// percentEncode escapes a status message for the grpc-message trailer
+func percentEncode(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < 0x20 || c > 0x7e || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,178 @@
+package grpc
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Protobuf wire types
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+// Encoder builds a protobuf message field by field. Zero values are
+// left out, as proto3 does.
+type Encoder struct {
+	buf []byte
+}
+
+// Bytes returns the encoded message
+func (e *Encoder) Bytes() []byte {
+	return e.buf
+}
+
+func (e *Encoder) tag(field, wire int) {
+	e.buf = binary.AppendUvarint(e.buf, uint64(field)<<3|uint64(wire))
+}
+
+// Uint64 encodes an unsigned varint field
+func (e *Encoder) Uint64(field int, v uint64) {
+	if v != 0 {
+		e.tag(field, wireVarint)
+		e.buf = binary.AppendUvarint(e.buf, v)
+	}
+}
+
+// Int64 encodes an int64 or int32 field; negative values take ten bytes,
+// as in protobuf
+func (e *Encoder) Int64(field int, v int64) {
+	e.Uint64(field, uint64(v))
+}
+
+// Bool encodes a bool field
+func (e *Encoder) Bool(field int, v bool) {
+	if v {
+		e.Uint64(field, 1)
+	}
+}
+
+// String encodes a string field
+func (e *Encoder) String(field int, v string) {
+	if v != "" {
+		e.tag(field, wireBytes)
+		e.buf = binary.AppendUvarint(e.buf, uint64(len(v)))
+		e.buf = append(e.buf, v...)
+	}
+}
+
+// Strings encodes a repeated string field, empty strings included
+func (e *Encoder) Strings(field int, vs []string) {
+	for _, v := range vs {
+		e.tag(field, wireBytes)
+		e.buf = binary.AppendUvarint(e.buf, uint64(len(v)))
+		e.buf = append(e.buf, v...)
+	}
+}
+
+// RawBytes encodes a bytes field
+func (e *Encoder) RawBytes(field int, v []byte) {
+	if len(v) > 0 {
+		e.tag(field, wireBytes)
+		e.buf = binary.AppendUvarint(e.buf, uint64(len(v)))
+		e.buf = append(e.buf, v...)
+	}
+}
+
+// Message encodes an embedded message field built by fn. Unlike scalar
+// fields, an empty message is still written, so repeated entries keep
+// their count.
+func (e *Encoder) Message(field int, fn func(*Encoder)) {
+	var sub Encoder
+	fn(&sub)
+	e.tag(field, wireBytes)
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(sub.buf)))
+	e.buf = append(e.buf, sub.buf...)
+}
+
+// Field is one decoded field: Varint for varint and fixed-width wire
+// types, Data for length-delimited ones
+type Field struct {
+	Number int
+	Varint uint64
+	Data   []byte
+}
+
+// Int64 returns the field as an int64 or int32
+func (f Field) Int64() int64 {
+	return int64(f.Varint)
+}
+
+// Bool returns the field as a bool
+func (f Field) Bool() bool {
+	return f.Varint != 0
+}
+
+// String returns the field as a string
+func (f Field) String() string {
+	return string(f.Data)
+}
+
+var errTruncated = errors.New("truncated protobuf message")
+
+// Decode calls fn for each field of a protobuf message, in wire order
+func Decode(data []byte, fn func(Field) error) error {
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		if n <= 0 {
+			return errTruncated
+		}
+		data = data[n:]
+		field := Field{Number: int(key >> 3)}
+		if field.Number <= 0 || key>>3 > math.MaxInt32 {
+			return fmt.Errorf("invalid protobuf field number %d", key>>3)
+		}
+
+		switch key & 7 {
+		case wireVarint:
+			if field.Varint, n = binary.Uvarint(data); n <= 0 {
+				return errTruncated
+			}
+			data = data[n:]
+		case wireFixed64:
+			if len(data) < 8 {
+				return errTruncated
+			}
+			field.Varint, data = binary.LittleEndian.Uint64(data), data[8:]
+		case wireFixed32:
+			if len(data) < 4 {
+				return errTruncated
+			}
+			field.Varint, data = uint64(binary.LittleEndian.Uint32(data)), data[4:]
+		case wireBytes:
+			size, n := binary.Uvarint(data)
+			if n <= 0 || size > uint64(len(data)-n) {
+				return errTruncated
+			}
+			field.Data, data = data[n:n+int(size)], data[n+int(size):]
+		default:
+			return fmt.Errorf("unsupported protobuf wire type %d", key&7)
+		}
+		if err := fn(field); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DecodeMap decodes a map<string, string> entry, adding it to m
+func DecodeMap(data []byte, m map[string]string) error {
+	var key, value string
+	err := Decode(data, func(f Field) error {
+		switch f.Number {
+		case 1:
+			key = f.String()
+		case 2:
+			value = f.String()
+		}
+		return nil
+	})
+	if err == nil {
+		m[key] = value
+	}
+	return err
+}
@@ -0,0 +1,137 @@
+package grpc
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestEncoder(t *testing.T) {
+	var e Encoder
+	e.Uint64(1, 150)
+	e.Int64(2, -1)
+	e.Bool(3, true)
+	e.Bool(4, false)
+	e.String(5, "hi")
+	e.String(6, "")
+	e.Strings(7, []string{"", "a"})
+	e.RawBytes(8, []byte{0xff})
+	e.Message(9, func(*Encoder) {})
+	e.Message(10, func(sub *Encoder) { sub.Uint64(1, 1) })
+
+	want := "\x08\x96\x01" +
+		"\x10\xff\xff\xff\xff\xff\xff\xff\xff\xff\x01" +
+		"\x18\x01" +
+		"\x2a\x02hi" +
+		"\x3a\x00\x3a\x01a" +
+		"\x42\x01\xff" +
+		"\x4a\x00" +
+		"\x52\x02\x08\x01"
+	if got := string(e.Bytes()); got != want {
+		t.Fatalf("encoded %q, want %q", got, want)
+	}
+}
+
+func TestDecode(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		want    []Field
+		wantErr bool
+	}{
+		{name: "empty"},
+		{name: "varint", data: "\x08\x96\x01", want: []Field{{Number: 1, Varint: 150}}},
+		{name: "negative int", data: "\x10\xff\xff\xff\xff\xff\xff\xff\xff\xff\x01", want: []Field{{Number: 2, Varint: 1<<64 - 1}}},
+		{name: "fixed64", data: "\x19\x01\x00\x00\x00\x00\x00\x00\x00", want: []Field{{Number: 3, Varint: 1}}},
+		{name: "fixed32", data: "\x25\x02\x00\x00\x00", want: []Field{{Number: 4, Varint: 2}}},
+		{name: "bytes", data: "\x2a\x02hi\x2a\x00", want: []Field{{Number: 5, Data: []byte("hi")}, {Number: 5, Data: []byte{}}}},
+		{name: "large field number", data: "\xf8\xff\xff\xff\x0f\x01", want: []Field{{Number: 1<<29 - 1, Varint: 1}}},
+		{name: "field zero", data: "\x00\x01", wantErr: true},
+		{name: "field number too large", data: "\x80\x80\x80\x80\x80\x80\x01\x00", wantErr: true},
+		{name: "truncated key", data: "\x80", wantErr: true},
+		{name: "truncated varint", data: "\x08\x96", wantErr: true},
+		{name: "truncated fixed64", data: "\x19\x01", wantErr: true},
+		{name: "truncated fixed32", data: "\x25\x01", wantErr: true},
+		{name: "bytes past end", data: "\x2a\x05hi", wantErr: true},
+		{name: "huge length", data: "\x2a\xff\xff\xff\xff\xff\xff\xff\xff\xff\x01", wantErr: true},
+		{name: "group", data: "\x0b\x0c", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []Field
+			err := Decode([]byte(tt.data), func(f Field) error {
+				got = append(got, f)
+				return nil
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("decoded %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeMap(t *testing.T) {
+	var e Encoder
+	e.String(1, "k")
+	e.String(2, "v")
+	m := map[string]string{}
+	if err := DecodeMap(e.Bytes(), m); err != nil || m["k"] != "v" {
+		t.Fatalf("decoded %v, %v", m, err)
+	}
+	if err := DecodeMap([]byte("\x0a\x05k"), m); err == nil {
+		t.Fatal("truncated entry decoded")
+	}
+}
+
+func TestReadMessage(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want string
+		code Code
+	}{
+		{"message", "\x00\x00\x00\x00\x02\x08\x01", "\x08\x01", OK},
+		{"empty message", "\x00\x00\x00\x00\x00", "", OK},
+		{"missing prefix", "\x00\x00", "", InvalidArgument},
+		{"compressed", "\x01\x00\x00\x00\x00", "", Unimplemented},
+		{"too large", "\x00\xff\xff\xff\xff", "", ResourceExhausted},
+		{"truncated", "\x00\x00\x00\x00\x05\x08", "", InvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readMessage(bytes.NewReader([]byte(tt.body)))
+			if tt.code != OK {
+				if status, ok := err.(*Status); !ok || status.Code != tt.code {
+					t.Fatalf("error %v, want code %d", err, tt.code)
+				}
+				return
+			}
+			if err != nil || string(got) != tt.want {
+				t.Fatalf("read %q, %v", got, err)
+			}
+		})
+	}
+}
+
+func FuzzDecode(f *testing.F) {
+	for _, seed := range []string{
+		"\x08\x96\x01",
+		"\x19\x01\x00\x00\x00\x00\x00\x00\x00\x25\x02\x00\x00\x00",
+		"\x2a\x02hi\x52\x02\x08\x01",
+		"\x2a\xff\xff\xff\xff\xff\xff\xff\xff\xff\x01",
+	} {
+		f.Add([]byte(seed))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		Decode(data, func(field Field) error {
+			if field.Number <= 0 || len(field.Data) > len(data) {
+				t.Fatalf("decoded field %d with %d bytes from %d", field.Number, len(field.Data), len(data))
+			}
+			return nil
+		})
+		DecodeMap(data, map[string]string{})
+	})
+}
@@ -0,0 +1,219 @@
+package hostmatch
+
+import (
+	"errors"
+	"strings"
+	"unicode/utf8"
+)
+
+// Punycode parameters (RFC 3492)
+const (
+	punyBase        = 36
+	punyTMin        = 1
+	punyTMax        = 26
+	punySkew        = 38
+	punyDamp        = 700
+	punyInitialBias = 72
+	punyInitialN    = 128
+	punyMaxInt      = 1<<31 - 1
+
+	// acePrefix marks a punycode-encoded label
+	acePrefix = "xn--"
+)
+
+var errPunycode = errors.New("invalid punycode")
+
+// labelDots are the full stops IDNA treats as label separators
+var labelDots = strings.NewReplacer("。", ".", "．", ".", "｡", ".")
+
+// ToASCII returns host with each internationalized label lowercased and
+// punycode-encoded ("bücher.example" becomes "xn--bcher-kva.example").
+// ASCII labels are lowercased. No Unicode normalization beyond case is
+// applied.
+func ToASCII(host string) string {
+	host = labelDots.Replace(host)
+	labels := strings.Split(host, ".")
+	for i, label := range labels {
+		label = strings.ToLower(label)
+		if !isASCII(label) {
+			if encoded, err := punyEncode(label); err == nil {
+				label = acePrefix + encoded
+			}
+		}
+		labels[i] = label
+	}
+	return strings.Join(labels, ".")
+}
+
+// ToUnicode returns host with each punycode label decoded
+// ("xn--bcher-kva.example" becomes "bücher.example"). Labels that do not
+// decode are kept as they are.
+func ToUnicode(host string) string {
+	labels := strings.Split(host, ".")
+	for i, label := range labels {
+		if len(label) > len(acePrefix) && strings.EqualFold(label[:len(acePrefix)], acePrefix) {
+			if decoded, err := punyDecode(label[len(acePrefix):]); err == nil {
+				labels[i] = decoded
+			}
+		}
+	}
+	return strings.Join(labels, ".")
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// punyAdapt is the bias adaptation function of RFC 3492 section 6.1
+func punyAdapt(delta, numPoints int, first bool) int {
+	if first {
+		delta /= punyDamp
+	} else {
+		delta /= 2
+	}
+	delta += delta / numPoints
+	k := 0
+	for delta > ((punyBase-punyTMin)*punyTMax)/2 {
+		delta /= punyBase - punyTMin
+		k += punyBase
+	}
+	return k + (punyBase-punyTMin+1)*delta/(delta+punySkew)
+}
+
+// punyThreshold clamps k - bias to [tmin, tmax]
+func punyThreshold(k, bias int) int {
+	return min(max(k-bias, punyTMin), punyTMax)
+}
+
+func punyDigit(d int) byte {
+	if d < 26 {
+		return byte('a' + d)
+	}
+	return byte('0' + d - 26)
+}
+
+func punyDigitValue(c byte) (int, bool) {
+	switch {
+	case c >= 'a' && c <= 'z':
+		return int(c - 'a'), true
+	case c >= 'A' && c <= 'Z':
+		return int(c - 'A'), true
+	case c >= '0' && c <= '9':
+		return int(c-'0') + 26, true
+	}
+	return 0, false
+}
+
+// punyEncode encodes a label as punycode, without the ACE prefix
+func punyEncode(label string) (string, error) {
+	runes := []rune(label)
+	out := make([]byte, 0, len(label)+8)
+	for _, r := range runes {
+		if r < utf8.RuneSelf {
+			out = append(out, byte(r))
+		}
+	}
+	basic := len(out)
+	handled := basic
+	if basic > 0 {
+		out = append(out, '-')
+	}
+
+	n, delta, bias := punyInitialN, 0, punyInitialBias
+	for handled < len(runes) {
+		m := punyMaxInt
+		for _, r := range runes {
+			if int(r) >= n && int(r) < m {
+				m = int(r)
+			}
+		}
+		if (m - n) > (punyMaxInt-delta)/(handled+1) {
+			return "", errPunycode
+		}
+		delta += (m - n) * (handled + 1)
+		n = m
+		for _, r := range runes {
+			if int(r) < n {
+				delta++
+			}
+			if int(r) != n {
+				continue
+			}
+			q := delta
+			for k := punyBase; ; k += punyBase {
+				t := punyThreshold(k, bias)
+				if q < t {
+					break
+				}
+				out = append(out, punyDigit(t+(q-t)%(punyBase-t)))
+				q = (q - t) / (punyBase - t)
+			}
+			out = append(out, punyDigit(q))
+			bias = punyAdapt(delta, handled+1, handled == basic)
+			delta = 0
+			handled++
+		}
+		delta++
+		n++
+	}
+	return string(out), nil
+}
+
+// punyDecode decodes a punycode label, without the ACE prefix
+func punyDecode(encoded string) (string, error) {
+	var output []rune
+	pos := 0
+	if b := strings.LastIndexByte(encoded, '-'); b >= 0 {
+		for i := 0; i < b; i++ {
+			if encoded[i] >= utf8.RuneSelf {
+				return "", errPunycode
+			}
+			output = append(output, rune(encoded[i]))
+		}
+		pos = b + 1
+	}
+
+	n, i, bias := punyInitialN, 0, punyInitialBias
+	for pos < len(encoded) {
+		oldi, w := i, 1
+		for k := punyBase; ; k += punyBase {
+			if pos >= len(encoded) {
+				return "", errPunycode
+			}
+			digit, ok := punyDigitValue(encoded[pos])
+			pos++
+			if !ok || digit > (punyMaxInt-i)/w {
+				return "", errPunycode
+			}
+			i += digit * w
+			t := punyThreshold(k, bias)
+			if digit < t {
+				break
+			}
+			if w > punyMaxInt/(punyBase-t) {
+				return "", errPunycode
+			}
+			w *= punyBase - t
+		}
+		length := len(output) + 1
+		bias = punyAdapt(i-oldi, length, oldi == 0)
+		if i/length > punyMaxInt-n {
+			return "", errPunycode
+		}
+		n += i / length
+		i %= length
+		if !utf8.ValidRune(rune(n)) {
+			return "", errPunycode
+		}
+		output = append(output, 0)
+		copy(output[i+1:], output[i:])
+		output[i] = rune(n)
+		i++
+	}
+	return string(output), nil
+}
@@ -0,0 +1,86 @@
+package hostmatch
+
+import "testing"
+
+// punySamples are the sample strings of RFC 3492 section 7.1
+var punySamples = []struct {
+	name, unicode, encoded string
+}{
+	{"A Arabic (Egyptian)", "ليهمابتكلموشعربي؟", "egbpdaj6bu4bxfgehfvwxn"},
+	{"B Chinese (simplified)", "他们为什么不说中文", "ihqwcrb4cv8a8dqg056pqjye"},
+	{"C Chinese (traditional)", "他們爲什麽不說中文", "ihqwctvzc91f659drss3x8bo0yb"},
+	{"D Czech", "Pročprostěnemluvíčesky", "Proprostnemluvesky-uyb24dma41a"},
+	{"E Hebrew", "למההםפשוטלאמדבריםעברית", "4dbcagdahymbxekheh6e0a7fei0b"},
+	{"F Hindi (Devanagari)", "यहलोगहिन्दीक्योंनहींबोलसकतेहैं", "i1baa7eci9glrd9b2ae1bj0hfcgg6iyaf8o0a1dig0cd"},
+	{"G Japanese", "なぜみんな日本語を話してくれないのか", "n8jok5ay5dzabd5bym9f0cm5685rrjetr6pdxa"},
+	{"H Korean", "세계의모든사람들이한국어를이해한다면얼마나좋을까", "989aomsvi5e83db1d2a355cv1e0vak1dwrv93d5xbh15a0dt30a5jpsd879ccm6fea98c"},
+	// The RFC shows this one with a mixed-case annotation ("baDot"),
+	// which encoders do not emit
+	{"I Russian", "почемужеонинеговорятпорусски", "b1abfaaepdrnnbgefbadotcwatmq2g4l"},
+	{"J Spanish", "PorquénopuedensimplementehablarenEspañol", "PorqunopuedensimplementehablarenEspaol-fmd56a"},
+	{"K Vietnamese", "TạisaohọkhôngthểchỉnóitiếngViệt", "TisaohkhngthchnitingVit-kjcr8268qyxafd2f1b9g"},
+	{"L 3nenBgumikinpachisensei", "3年B組金八先生", "3B-ww4c5e180e575a65lsy2b"},
+	{"M amuronamie-with-SUPER-MONKEYS", "安室奈美恵-with-SUPER-MONKEYS", "-with-SUPER-MONKEYS-pc58ag80a8qai00g7n9n"},
+	{"N Hello-Another-Way-sorezorenobasho", "Hello-Another-Way-それぞれの場所", "Hello-Another-Way--fc4qua05auwb3674vfr0b"},
+	{"O hitotsuyanenoshita2", "ひとつ屋根の下2", "2-u9tlzr9756bt3uc0v"},
+	{"P MajideKoisuru5byoumae", "MajiでKoiする5秒前", "MajiKoi5-783gue6qz075azm5e"},
+	{"Q pafiidederunba", "パフィーdeルンバ", "de-jg4avhby1noc0d"},
+	{"R sonosupiidode", "そのスピードで", "d9juau41awczczp"},
+	{"S -> $1.00 <-", "-> $1.00 <-", "-> $1.00 <--"},
+}
+
+func TestPunyEncode(t *testing.T) {
+	for _, tc := range punySamples {
+		got, err := punyEncode(tc.unicode)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if got != tc.encoded {
+			t.Errorf("%s: encoded as %q, want %q", tc.name, got, tc.encoded)
+		}
+	}
+}
+
+func TestPunyDecode(t *testing.T) {
+	for _, tc := range punySamples {
+		got, err := punyDecode(tc.encoded)
+		if err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+			continue
+		}
+		if got != tc.unicode {
+			t.Errorf("%s: decoded as %q, want %q", tc.name, got, tc.unicode)
+		}
+	}
+	// Surrogates are not code points
+	if got, err := punyDecode("ib9b"); err == nil {
+		t.Errorf("surrogate decoded as %q", got)
+	}
+	// Digits are case-insensitive
+	if got, err := punyDecode("b1abfaaepdrnnbgefbaDotcwatmq2g4l"); err != nil || got != "почемужеонинеговорятпорусски" {
+		t.Errorf("mixed-case digits decoded as %q, %v", got, err)
+	}
+}
+
+func FuzzPunyDecode(f *testing.F) {
+	for _, tc := range punySamples {
+		f.Add(tc.encoded)
+	}
+	f.Add("zzzzzzzzzzzzzzzzzzzzzzzzz")
+	f.Add("a-")
+	f.Fuzz(func(t *testing.T, encoded string) {
+		decoded, err := punyDecode(encoded)
+		if err != nil {
+			return
+		}
+		reencoded, err := punyEncode(decoded)
+		if err != nil {
+			t.Fatalf("decoded %q to %q, which does not encode: %v", encoded, decoded, err)
+		}
+		again, err := punyDecode(reencoded)
+		if err != nil || again != decoded {
+			t.Fatalf("%q decoded to %q, re-encoded as %q, decoded again to %q (%v)", encoded, decoded, reencoded, again, err)
+		}
+	})
+}
@@ -0,0 +1,84 @@
+package hostmatch
+
+import (
+	"net"
+	"net/url"
+	"strings"
+)
+
+// Match reports whether host matches pattern. Patterns are case-insensitive
+// and may be an exact host ("api.example.com"), a wildcard covering a domain
+// and all of its subdomains ("*.example.com"), or "*" for every host. Any
+// port on host is ignored, and internationalized names match in either
+// their Unicode or punycode form.
+func Match(pattern, host string) bool {
+	pattern = ToASCII(strings.TrimSpace(pattern))
+	host = Normalize(host)
+
+	switch {
+	case pattern == "*":
+		return true
+	case strings.HasPrefix(pattern, "*."):
+		suffix := pattern[1:]
+		return host == suffix[1:] || strings.HasSuffix(host, suffix)
+	default:
+		return host == pattern
+	}
+}
+
+// MatchAny reports whether host matches any of the patterns
+func MatchAny(patterns []string, host string) bool {
+	for _, pattern := range patterns {
+		if Match(pattern, host) {
+			return true
+		}
+	}
+	return false
+}
+
+// Normalize returns the canonical form of host: lowercased, punycode for
+// internationalized labels, and without any port or trailing dot
+func Normalize(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimPrefix(strings.TrimSuffix(host, "]"), "[")
+	return strings.TrimSuffix(ToASCII(host), ".")
+}
+
+// Canonical returns host:port in canonical form for a URL scheme: the
+// host normalized, and the port kept only when it is not the scheme's
+// default
+func Canonical(hostport, scheme string) string {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host, port = hostport, ""
+	}
+	host = Normalize(host)
+	if port == "" || port == defaultPorts[strings.ToLower(scheme)] {
+		if strings.Contains(host, ":") {
+			return "[" + host + "]"
+		}
+		return host
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// CanonicalURL returns rawURL with its host in canonical form, or rawURL
+// itself when it does not parse
+func CanonicalURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return rawURL
+	}
+	u.Host = Canonical(u.Host, u.Scheme)
+	return u.String()
+}
+
+// defaultPorts are the ports schemes use when a URL gives none
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"ws":    "80",
+	"https": "443",
+	"wss":   "443",
+}
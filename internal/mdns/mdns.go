@@ -0,0 +1,251 @@
+// Package mdns advertises a DNS-SD service over multicast DNS (RFC 6762,
+// RFC 6763) so devices on the local network can discover it.
+package mdns
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+const (
+	typePTR = 12
+	typeTXT = 16
+	typeA   = 1
+	typeSRV = 33
+	typeANY = 255
+
+	classIN    = 1
+	cacheFlush = 0x8000
+
+	ttl = 120
+)
+
+var group = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// Service is a DNS-SD service instance
+type Service struct {
+	// Instance is the human-readable name, e.g. "Go Proxy on laptop"
+	Instance string
+	// Type is the service type, e.g. "_http-proxy._tcp"
+	Type string
+	// Host is the bare host name, advertised as Host.local
+	Host string
+	IP   net.IP
+	Port int
+	// TXT holds key=value pairs
+	TXT []string
+}
+
+func (s Service) typeName() string     { return s.Type + ".local." }
+func (s Service) instanceName() string { return s.Instance + "." + s.typeName() }
+func (s Service) hostName() string     { return s.Host + ".local." }
+
+// Advertise answers queries for s and announces it until ctx is done,
+// then sends a goodbye so caches drop it
+func Advertise(ctx context.Context, s Service) error {
+	if s.IP.To4() == nil {
+		return errors.New("mdns: an IPv4 address is required")
+	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		// Announce twice, a second apart, as RFC 6762 section 8.3 asks
+		for i := 0; i < 2; i++ {
+			send(conn, s.response(ttl))
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(time.Second):
+			}
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		send(conn, s.response(0))
+		conn.Close()
+	}()
+
+	buf := make([]byte, 9000)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if s.asked(buf[:n]) {
+			send(conn, s.response(ttl))
+		}
+	}
+}
+
+func send(conn *net.UDPConn, msg []byte) {
+	if _, err := conn.WriteToUDP(msg, group); err != nil {
+		log.Printf("mDNS send failed: %v", err)
+	}
+}
+
+// asked reports whether msg is a query with a question about s
+func (s Service) asked(msg []byte) bool {
+	if len(msg) < 12 || msg[2]&0x80 != 0 {
+		return false
+	}
+	questions := int(binary.BigEndian.Uint16(msg[4:6]))
+	off := 12
+	for i := 0; i < questions; i++ {
+		name, next, ok := readName(msg, off)
+		if !ok || next+4 > len(msg) {
+			return false
+		}
+		qtype := binary.BigEndian.Uint16(msg[next:])
+		off = next + 4
+
+		switch {
+		case strings.EqualFold(name, "_services._dns-sd._udp.local."),
+			strings.EqualFold(name, s.typeName()) && (qtype == typePTR || qtype == typeANY),
+			strings.EqualFold(name, s.instanceName()),
+			strings.EqualFold(name, s.hostName()) && (qtype == typeA || qtype == typeANY):
+			return true
+		}
+	}
+	return false
+}
+
+// maxName bounds a name's wire length (RFC 1035 section 2.3.4), so
+// compression pointers cannot expand a small message into long names
+const maxName = 255
+
+// readName reads a possibly compressed name at off, returning it with a
+// trailing dot and the offset after it
+func readName(msg []byte, off int) (string, int, bool) {
+	var labels []string
+	next, length := -1, 1
+	for jumps := 0; jumps < 16; {
+		if off >= len(msg) {
+			return "", 0, false
+		}
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, ".") + ".", next, true
+		case n&0xC0 == 0xC0:
+			if off+1 >= len(msg) {
+				return "", 0, false
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3FFF)
+			jumps++
+		case n&0xC0 != 0:
+			// The 0x40 and 0x80 label types are reserved
+			return "", 0, false
+		default:
+			length += 1 + n
+			if off+1+n > len(msg) || length > maxName {
+				return "", 0, false
+			}
+			labels = append(labels, string(msg[off+1:off+1+n]))
+			off += 1 + n
+		}
+	}
+	return "", 0, false
+}
+
+// response builds an authoritative answer with every record of s
+func (s Service) response(ttl uint32) []byte {
+	msg := []byte{0, 0, 0x84, 0, 0, 0, 0, 5, 0, 0, 0, 0}
+
+	msg = appendRecord(msg, "_services._dns-sd._udp.local.", typePTR, classIN, ttl, appendName(nil, s.typeName()))
+	msg = appendRecord(msg, s.typeName(), typePTR, classIN, ttl, appendName(nil, s.instanceName()))
+
+	srv := binary.BigEndian.AppendUint16(nil, 0) // priority
+	srv = binary.BigEndian.AppendUint16(srv, 0)  // weight
+	srv = binary.BigEndian.AppendUint16(srv, uint16(s.Port))
+	msg = appendRecord(msg, s.instanceName(), typeSRV, classIN|cacheFlush, ttl, appendName(srv, s.hostName()))
+
+	var txt []byte
+	for _, kv := range s.TXT {
+		if len(kv) > 255 {
+			kv = kv[:255]
+		}
+		txt = append(txt, byte(len(kv)))
+		txt = append(txt, kv...)
+	}
+	if len(txt) == 0 {
+		txt = []byte{0}
+	}
+	msg = appendRecord(msg, s.instanceName(), typeTXT, classIN|cacheFlush, ttl, txt)
+	msg = appendRecord(msg, s.hostName(), typeA, classIN|cacheFlush, ttl, s.IP.To4())
+	return msg
+}
+
+func appendRecord(msg []byte, name string, rtype, class uint16, ttl uint32, data []byte) []byte {
+	msg = appendName(msg, name)
+	msg = binary.BigEndian.AppendUint16(msg, rtype)
+	msg = binary.BigEndian.AppendUint16(msg, class)
+	msg = binary.BigEndian.AppendUint32(msg, ttl)
+	msg = binary.BigEndian.AppendUint16(msg, uint16(len(data)))
+	return append(msg, data...)
+}
+
+// appendName appends name uncompressed. The instance label may contain
+// dots, so only the type and domain labels are split.
+func appendName(b []byte, name string) []byte {
+	for _, label := range splitName(name) {
+		if len(label) > 63 {
+			label = label[:63]
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+func splitName(name string) []string {
+	name = strings.TrimSuffix(name, ".")
+	// Service labels start with '_'; anything before the first of them is
+	// the instance name, kept whole
+	if i := strings.Index(name, "._"); i > 0 && !strings.HasPrefix(name, "_") {
+		return append([]string{name[:i]}, strings.Split(name[i+1:], ".")...)
+	}
+	return strings.Split(name, ".")
+}
+
+// LocalIPv4 returns the first IPv4 address of an up, non-loopback
+// interface, as other devices on the network would reach this host
+func LocalIPv4() (net.IP, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok {
+				if ip := ipnet.IP.To4(); ip != nil && !ip.IsLinkLocalUnicast() {
+					return ip, nil
+				}
+			}
+		}
+	}
+	return nil, errors.New("no non-loopback IPv4 address found")
+}
@@ -0,0 +1,127 @@
+package mdns
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+// query builds an mDNS query with one question for name
+func query(name string, qtype byte) []byte {
+	msg := []byte{0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	msg = appendName(msg, name)
+	return append(msg, 0, qtype, 0, classIN)
+}
+
+var testService = Service{
+	Instance: "Go Proxy on laptop",
+	Type:     "_http-proxy._tcp",
+	Host:     "laptop",
+	IP:       net.IPv4(192, 168, 1, 20),
+	Port:     8080,
+}
+
+func TestReadName(t *testing.T) {
+	header := strings.Repeat("\x00", 12)
+	for _, tc := range []struct {
+		name string
+		msg  string
+		off  int
+		want string
+		next int
+		ok   bool
+	}{
+		{"plain", header + "\x05local\x00", 12, "local.", 19, true},
+		{"root", header + "\x00", 12, ".", 13, true},
+		{"pointer", header + "\x05local\x00\x06laptop\xc0\x0c", 12 + 7, "laptop.local.", 28, true},
+		{"empty", header, 12, "", 0, false},
+		{"truncated label", header + "\x05loc", 12, "", 0, false},
+		{"missing terminator", header + "\x05local", 12, "", 0, false},
+		{"truncated pointer", header + "\x05local\xc0", 12, "", 0, false},
+		{"pointer past end", header + "\xc0\xff", 12, "", 0, false},
+		{"pointer to itself", header + "\xc0\x0c", 12, "", 0, false},
+		{"pointer loop", header + "\x01a\xc0\x10\x01b\xc0\x0c", 12, "", 0, false},
+		{"reserved label type", header + "\x45local\x00", 12, "", 0, false},
+	} {
+		name, next, ok := readName([]byte(tc.msg), tc.off)
+		if ok != tc.ok || name != tc.want || next != tc.next {
+			t.Errorf("%s: readName = %q, %d, %v, want %q, %d, %v", tc.name, name, next, ok, tc.want, tc.next, tc.ok)
+		}
+	}
+}
+
+func TestReadNameBoundsLength(t *testing.T) {
+	// Each pass through the loop adds a 63-byte label, so the name would
+	// grow with every jump if its length were not bounded
+	msg := []byte(strings.Repeat("\x00", 12) + "\x3f" + strings.Repeat("a", 63) + "\xc0\x0c")
+	if name, _, ok := readName(msg, 12); ok {
+		t.Fatalf("looping name read as %d bytes", len(name))
+	}
+
+	label := "\x3f" + strings.Repeat("a", 63)
+	long := strings.Repeat("\x00", 12) + strings.Repeat(label, 3) + "\x3d" + strings.Repeat("a", 61) + "\x00"
+	if _, _, ok := readName([]byte(long), 12); !ok {
+		t.Fatal("255-byte name rejected")
+	}
+	if _, _, ok := readName([]byte(long[:len(long)-63]+"\x3e"+strings.Repeat("a", 62)+"\x00"), 12); ok {
+		t.Fatal("256-byte name accepted")
+	}
+}
+
+func TestAsked(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		msg  []byte
+		want bool
+	}{
+		{"service type", query("_http-proxy._tcp.local.", typePTR), true},
+		{"any type", query("_http-proxy._tcp.local.", typeANY), true},
+		{"browse", query("_services._dns-sd._udp.local.", typePTR), true},
+		{"host address", query("laptop.local.", typeA), true},
+		{"host text", query("laptop.local.", typeTXT), false},
+		{"other service", query("_ipp._tcp.local.", typePTR), false},
+		{"response", append([]byte{0, 0, 0x84}, query("laptop.local.", typeA)[3:]...), false},
+		{"short header", []byte{0, 0, 0, 0}, false},
+		{"truncated question", query("laptop.local.", typeA)[:20], false},
+		{"missing type", query("laptop.local.", typeA)[:len(query("laptop.local.", typeA))-4], false},
+	} {
+		if got := testService.asked(tc.msg); got != tc.want {
+			t.Errorf("%s: asked = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestResponseAnswersItsQuestions(t *testing.T) {
+	msg := testService.response(ttl)
+	off := 12
+	var names []string
+	for range 5 {
+		name, next, ok := readName(msg, off)
+		if !ok || next+10 > len(msg) {
+			t.Fatalf("record %d does not parse", len(names))
+		}
+		names = append(names, name)
+		off = next + 10 + int(msg[next+8])<<8 + int(msg[next+9])
+	}
+	if off != len(msg) {
+		t.Fatalf("%d bytes after the last record", len(msg)-off)
+	}
+	want := []string{
+		"_services._dns-sd._udp.local.",
+		"_http-proxy._tcp.local.",
+		"Go Proxy on laptop._http-proxy._tcp.local.",
+		"Go Proxy on laptop._http-proxy._tcp.local.",
+		"laptop.local.",
+	}
+	if strings.Join(names, "|") != strings.Join(want, "|") {
+		t.Errorf("record names = %q, want %q", names, want)
+	}
+}
+
+func FuzzAsked(f *testing.F) {
+	f.Add(query("_http-proxy._tcp.local.", typePTR))
+	f.Add([]byte(strings.Repeat("\x00", 5) + "\x01" + strings.Repeat("\x00", 6) + "\x01a\xc0\x10\x01b\xc0\x0c"))
+	f.Fuzz(func(t *testing.T, msg []byte) {
+		testService.asked(msg)
+	})
+}
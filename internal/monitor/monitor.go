@@ -0,0 +1,270 @@
+// Package monitor turns captured flows into synthetic monitors: a saved
+// set of captures replayed on a schedule against a target, with each run
+// kept as a series and failures reported to webhooks
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+	"github.com/adamdrake/go_proxy/internal/replay"
+	"github.com/adamdrake/go_proxy/internal/webhook"
+	"github.com/google/uuid"
+)
+
+// maxRuns is how many runs of a monitor are kept
+const maxRuns = 100
+
+// replayTimeout bounds each replayed request
+const replayTimeout = 30 * time.Second
+
+// Spec describes a monitor to create
+type Spec struct {
+	Name     string `json:"name"`
+	Schedule string `json:"schedule"`
+	// Target replaces the captured scheme and host, e.g.
+	// https://staging.example.com (empty replays to the captured hosts)
+	Target string `json:"target,omitempty"`
+	// Webhook is notified of this monitor's failures besides the
+	// proxy-wide webhooks
+	Webhook string `json:"webhook,omitempty"`
+	// TokenRefresh logs in again when a replay gets 401
+	TokenRefresh *replay.TokenRefresh `json:"token_refresh,omitempty"`
+}
+
+// Monitor is the state of a scheduled replay
+type Monitor struct {
+	Spec
+	ID         string    `json:"id"`
+	RequestIDs []string  `json:"request_ids"`
+	Created    time.Time `json:"created"`
+	NextRun    time.Time `json:"next_run"`
+	Runs       int       `json:"runs"`
+	Failing    bool      `json:"failing"`
+	LastRun    *Run      `json:"last_run,omitempty"`
+}
+
+// Run is one replay of a monitor's captures, in capture order
+type Run struct {
+	Time       time.Time       `json:"time"`
+	OK         bool            `json:"ok"`
+	DurationMS int64           `json:"duration_ms"`
+	Failures   int             `json:"failures"`
+	Results    []replay.Result `json:"results"`
+}
+
+// monitor is a scheduled replay and its run series
+type monitor struct {
+	Monitor
+	schedule  Schedule
+	captures  []*capture.CapturedRequest
+	refresher *replay.Refresher
+	history   []Run
+	cancel    context.CancelFunc
+
+	// runMu keeps scheduled and on-demand runs from overlapping
+	runMu sync.Mutex
+}
+
+// Scheduler runs monitors
+type Scheduler struct {
+	mu       sync.Mutex
+	monitors map[string]*monitor
+	notifier *webhook.Notifier
+	client   *http.Client
+}
+
+// NewScheduler returns a scheduler reporting failures through notifier
+func NewScheduler(notifier *webhook.Notifier) *Scheduler {
+	return &Scheduler{
+		monitors: make(map[string]*monitor),
+		notifier: notifier,
+		client:   replay.NewClient(replayTimeout),
+	}
+}
+
+// Add schedules a monitor replaying captures
+func (s *Scheduler) Add(spec Spec, captures []*capture.CapturedRequest) (Monitor, error) {
+	schedule, err := ParseSchedule(spec.Schedule)
+	if err != nil {
+		return Monitor{}, err
+	}
+	if len(captures) == 0 {
+		return Monitor{}, fmt.Errorf("a monitor needs at least one capture")
+	}
+	if spec.Target != "" {
+		if _, err := replay.NewRequest(context.Background(), captures[0], spec.Target); err != nil {
+			return Monitor{}, err
+		}
+	}
+
+	var refresher *replay.Refresher
+	if spec.TokenRefresh != nil {
+		if refresher, err = replay.NewRefresher(*spec.TokenRefresh); err != nil {
+			return Monitor{}, err
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m := &monitor{
+		Monitor: Monitor{
+			Spec:    spec,
+			ID:      uuid.New().String(),
+			Created: time.Now(),
+		},
+		schedule:  schedule,
+		captures:  captures,
+		refresher: refresher,
+		cancel:    cancel,
+	}
+	if m.Name == "" {
+		m.Name = m.ID
+	}
+	for _, c := range captures {
+		m.RequestIDs = append(m.RequestIDs, c.ID)
+	}
+
+	s.mu.Lock()
+	s.monitors[m.ID] = m
+	m.NextRun = schedule.Next(time.Now())
+	state := m.Monitor
+	s.mu.Unlock()
+
+	go s.loop(ctx, m)
+	return state, nil
+}
+
+// loop runs m at its scheduled times until it is removed
+func (s *Scheduler) loop(ctx context.Context, m *monitor) {
+	for {
+		s.mu.Lock()
+		next := m.NextRun
+		s.mu.Unlock()
+		if next.IsZero() {
+			return
+		}
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		s.mu.Lock()
+		m.NextRun = m.schedule.Next(time.Now())
+		s.mu.Unlock()
+		s.run(ctx, m)
+	}
+}
+
+// run replays m's captures once, records the run and notifies webhooks
+// when the monitor starts failing or recovers
+func (s *Scheduler) run(ctx context.Context, m *monitor) Run {
+	m.runMu.Lock()
+	defer m.runMu.Unlock()
+
+	run := Run{Time: time.Now(), OK: true}
+	for _, captured := range m.captures {
+		result := replay.Send(ctx, s.client, captured, m.Target, m.refresher)
+		if !result.OK {
+			run.OK = false
+			run.Failures++
+		}
+		run.Results = append(run.Results, result)
+	}
+	run.DurationMS = time.Since(run.Time).Milliseconds()
+
+	s.mu.Lock()
+	m.history = append(m.history, run)
+	if len(m.history) > maxRuns {
+		m.history = m.history[len(m.history)-maxRuns:]
+	}
+	m.Runs++
+	m.LastRun = &run
+	wasFailing := m.Failing
+	m.Failing = !run.OK
+	state := m.Monitor
+	s.mu.Unlock()
+
+	switch {
+	case !run.OK && !wasFailing:
+		s.notifier.Notify(webhook.Event{
+			Type:    webhook.EventMonitorFailed,
+			Time:    run.Time,
+			Summary: fmt.Sprintf("Monitor %s failed: %d of %d requests", state.Name, run.Failures, len(run.Results)),
+			Data:    map[string]interface{}{"monitor": state, "run": run},
+			Key:     "monitor/" + state.ID,
+		}, state.Webhook)
+	case run.OK && wasFailing:
+		s.notifier.Notify(webhook.Event{
+			Type:     webhook.EventMonitorRecovered,
+			Time:     run.Time,
+			Summary:  fmt.Sprintf("Monitor %s recovered", state.Name),
+			Data:     map[string]interface{}{"monitor": state},
+			Key:      "monitor/" + state.ID,
+			Resolved: true,
+		}, state.Webhook)
+	}
+	return run
+}
+
+// List returns all monitors, oldest first
+func (s *Scheduler) List() []Monitor {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	result := make([]Monitor, 0, len(s.monitors))
+	for _, m := range s.monitors {
+		result = append(result, m.Monitor)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Created.Before(result[j].Created) })
+	return result
+}
+
+// Get returns a monitor and its runs, oldest first
+func (s *Scheduler) Get(id string) (Monitor, []Run, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.monitors[id]
+	if !ok {
+		return Monitor{}, nil, false
+	}
+	return m.Monitor, append([]Run(nil), m.history...), true
+}
+
+// RunNow replays a monitor immediately, outside its schedule
+func (s *Scheduler) RunNow(ctx context.Context, id string) (Run, bool) {
+	s.mu.Lock()
+	m, ok := s.monitors[id]
+	s.mu.Unlock()
+	if !ok {
+		return Run{}, false
+	}
+	return s.run(ctx, m), true
+}
+
+// Remove stops and deletes a monitor
+func (s *Scheduler) Remove(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	m, ok := s.monitors[id]
+	if ok {
+		m.cancel()
+		delete(s.monitors, id)
+	}
+	return ok
+}
+
+// Close stops all monitors
+func (s *Scheduler) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, m := range s.monitors {
+		m.cancel()
+		delete(s.monitors, id)
+	}
+}
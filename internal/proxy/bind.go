@@ -0,0 +1,112 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/adamdrake/go_proxy/internal/hostmatch"
+)
+
+// BindAddr is the local source address used for upstream connections. It
+// may carry one address per family when taken from an interface.
+type BindAddr struct {
+	IPv4 net.IP
+	IPv6 net.IP
+}
+
+// IsZero reports whether no source address is configured
+func (b BindAddr) IsZero() bool {
+	return b.IPv4 == nil && b.IPv6 == nil
+}
+
+// For returns the source address to use when dialing remote, or nil if the
+// binding has no address of that family
+func (b BindAddr) For(remote net.IP) net.IP {
+	if remote.To4() != nil {
+		return b.IPv4
+	}
+	return b.IPv6
+}
+
+// String returns the configured addresses for logging
+func (b BindAddr) String() string {
+	var parts []string
+	if b.IPv4 != nil {
+		parts = append(parts, b.IPv4.String())
+	}
+	if b.IPv6 != nil {
+		parts = append(parts, b.IPv6.String())
+	}
+	return strings.Join(parts, ",")
+}
+
+// ParseBindAddr parses an IP address or a network interface name (e.g. "en0"
+// or "utun3"), in which case the interface's first address of each family is used
+func ParseBindAddr(s string) (BindAddr, error) {
+	s = strings.TrimSpace(s)
+	if ip := net.ParseIP(s); ip != nil {
+		if ip.To4() != nil {
+			return BindAddr{IPv4: ip}, nil
+		}
+		return BindAddr{IPv6: ip}, nil
+	}
+
+	iface, err := net.InterfaceByName(s)
+	if err != nil {
+		return BindAddr{}, fmt.Errorf("%q is neither an IP address nor an interface: %w", s, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return BindAddr{}, fmt.Errorf("reading addresses of %s: %w", s, err)
+	}
+
+	var bind BindAddr
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		if ipNet.IP.To4() != nil {
+			if bind.IPv4 == nil {
+				bind.IPv4 = ipNet.IP
+			}
+		} else if bind.IPv6 == nil {
+			bind.IPv6 = ipNet.IP
+		}
+	}
+	if bind.IsZero() {
+		return BindAddr{}, fmt.Errorf("interface %s has no usable addresses", s)
+	}
+	return bind, nil
+}
+
+// BindRule binds upstream connections for matching hosts to a source address
+type BindRule struct {
+	Pattern string
+	Addr    BindAddr
+}
+
+// ParseBindRule parses a "host-pattern=address-or-interface" rule
+func ParseBindRule(s string) (BindRule, error) {
+	pattern, addr, ok := strings.Cut(s, "=")
+	if !ok || strings.TrimSpace(pattern) == "" {
+		return BindRule{}, fmt.Errorf("bind rule %q must be of the form pattern=address", s)
+	}
+	bind, err := ParseBindAddr(addr)
+	if err != nil {
+		return BindRule{}, err
+	}
+	return BindRule{Pattern: strings.TrimSpace(pattern), Addr: bind}, nil
+}
+
+// bindAddrFor returns the source binding for host: the first matching rule,
+// otherwise the global binding
+func (h *Handler) bindAddrFor(host string) BindAddr {
+	for _, rule := range h.bindRules {
+		if hostmatch.Match(rule.Pattern, host) {
+			return rule.Addr
+		}
+	}
+	return h.bindOutbound
+}
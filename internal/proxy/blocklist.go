@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+)
+
+// blocked checks a request against the filter lists, returning the filter
+// that matched. In dry-run mode the match is recorded on captured and the
+// request is let through.
+func (h *Handler) blocked(captured *capture.CapturedRequest, targetURL string, header http.Header) (string, bool) {
+	if h.blocklist == nil {
+		return "", false
+	}
+	referer := header.Get("Referer")
+	if referer == "" {
+		referer = header.Get("Origin")
+	}
+	rule, ok := h.blocklist.Match(targetURL, referer)
+	if ok && h.dryRun() {
+		wouldBlock(captured, "filter list: "+rule)
+		return "", false
+	}
+	return rule, ok
+}
+
+// recordBlocked stores a capture for a request stopped by a filter list.
+// prepare runs on the capture worker, as for record.
+func (h *Handler) recordBlocked(captured *capture.CapturedRequest, rule string, startTime time.Time, prepare func()) {
+	captured.Blocked = true
+	captured.BlockReason = "filter list: " + rule
+	captured.RecordActions(capture.ActionRecord{Type: capture.ActionBlock, Detail: captured.BlockReason})
+	captured.Duration = time.Since(startTime)
+	h.record(captured, prepare)
+}
+
+// closeBlocked drops a blocked tunnel's client connection without a
+// response. HTTP/2 streams, which cannot be hijacked, are refused instead.
+func closeBlocked(w http.ResponseWriter) {
+	conn, _, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	conn.Close()
+}
@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+	"github.com/adamdrake/go_proxy/internal/rules"
+)
+
+// isTextContentType reports whether a Content-Type names a textual format
+// that body rewriting can safely edit
+func isTextContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if strings.HasPrefix(mediaType, "text/") ||
+		strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml") {
+		return true
+	}
+	switch mediaType {
+	case "application/json", "application/javascript", "application/xml",
+		"application/xhtml+xml", "application/x-www-form-urlencoded", "image/svg+xml":
+		return true
+	}
+	return false
+}
+
+// isHTMLContentType reports whether a Content-Type names an HTML document
+func isHTMLContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (mediaType == "text/html" || mediaType == "application/xhtml+xml")
+}
+
+// editResponseBody runs edit over a buffered response's decoded body when
+// accept approves its Content-Type. A compressed body that changes is sent
+// uncompressed; the length headers are updated to match. A body that would
+// decode to more than limit bytes is returned unedited.
+func editResponseBody(header http.Header, body []byte, limit int64, accept func(string) bool, edit func([]byte) ([]byte, []capture.ActionRecord)) ([]byte, []capture.ActionRecord) {
+	if len(body) == 0 || !accept(header.Get("Content-Type")) {
+		return body, nil
+	}
+	decoded, err := capture.DecodeBody(header.Get("Content-Encoding"), body, limit)
+	if err != nil {
+		return body, nil
+	}
+
+	edited, actions := edit(decoded)
+	if len(actions) == 0 {
+		return body, nil
+	}
+
+	header.Del("Content-Encoding")
+	header.Set("Content-Length", strconv.Itoa(len(edited)))
+	return edited, actions
+}
+
+// rewriteResponseBody applies the outcome's body replacements and HTML
+// injections to a buffered response, decoding at most limit bytes
+func rewriteResponseBody(header http.Header, body []byte, limit int64, outcome *rules.Outcome) ([]byte, []capture.ActionRecord) {
+	var actions, edits []capture.ActionRecord
+	if outcome.ReplacesBody() {
+		body, edits = editResponseBody(header, body, limit, isTextContentType, outcome.ReplaceBody)
+		actions = append(actions, edits...)
+	}
+	if outcome.InjectsHTML() {
+		body, edits = editResponseBody(header, body, limit, isHTMLContentType, outcome.InjectHTML)
+		actions = append(actions, edits...)
+	}
+	return body, actions
+}
+
+// RewriteResponse applies the response-side rules of an outcome to a
+// buffered response as the proxy does, recording what was done and what
+// dry-run rules would have done on captured. header is edited in place;
+// the possibly rewritten body is returned. Bodies that decode to more than
+// limit bytes are left unedited.
+func RewriteResponse(outcome *rules.Outcome, requestHeader, header http.Header, body []byte, limit int64, captured *capture.CapturedRequest) []byte {
+	body, actions := rewriteResponseBody(header, body, limit, outcome)
+	captured.RecordActions(actions...)
+	dryRunResponseBody(captured, header, body, limit, outcome)
+	captured.RecordActions(outcome.RelaxResponse(requestHeader, header)...)
+	captured.RecordActions(outcome.RewriteSetCookies(header)...)
+	captured.RecordActions(outcome.RewriteHeaders(header)...)
+	dryRunResponseHeaders(captured, requestHeader, header, outcome)
+	return body
+}
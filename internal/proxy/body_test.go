@@ -0,0 +1,38 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"testing"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+)
+
+func TestEditResponseBodyLeavesOversizedBody(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(bytes.Repeat([]byte("a"), 1<<20))
+	zw.Close()
+	body := buf.Bytes()
+
+	edit := func(b []byte) ([]byte, []capture.ActionRecord) {
+		return []byte("edited"), []capture.ActionRecord{{}}
+	}
+	for _, tc := range []struct {
+		limit  int64
+		edited bool
+	}{
+		{limit: 1 << 10, edited: false},
+		{limit: 1 << 20, edited: true},
+	} {
+		header := http.Header{"Content-Type": {"text/plain"}, "Content-Encoding": {"gzip"}}
+		got, actions := editResponseBody(header, body, tc.limit, isTextContentType, edit)
+		if edited := len(actions) > 0; edited != tc.edited {
+			t.Fatalf("limit %d: edited = %v, want %v", tc.limit, edited, tc.edited)
+		}
+		if !tc.edited && (!bytes.Equal(got, body) || header.Get("Content-Encoding") != "gzip") {
+			t.Errorf("limit %d: oversized body was changed", tc.limit)
+		}
+	}
+}
@@ -0,0 +1,367 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/adamdrake/go_proxy/internal/hostmatch"
+)
+
+// Bypass modes: what the proxy does with requests to bypassed hosts
+const (
+	// BypassDirect forwards them without capturing or rewriting them
+	BypassDirect = "direct"
+	// BypassRefuse answers them with 403
+	BypassRefuse = "refuse"
+)
+
+// bypassEntry is one entry of a bypass list
+type bypassEntry struct {
+	all    bool
+	prefix netip.Prefix
+	// domain is ".example.com"; bare entries also match the domain itself
+	domain    string
+	matchHost bool
+	port      string
+}
+
+// Bypass keeps hosts out of capture entirely, with NO_PROXY semantics:
+// "example.com" covers the domain and its subdomains, ".example.com" and
+// "*.example.com" only the subdomains, "10.0.0.0/8" and "10.1.2.3" IP
+// literal hosts, "*" everything, and a ":port" suffix limits an entry to
+// one port. Host names are not resolved.
+type Bypass struct {
+	mu      sync.RWMutex
+	list    []string
+	entries []bypassEntry
+	mode    string
+
+	bypassed atomic.Int64
+}
+
+// NewBypass returns a bypass list in mode (BypassDirect when empty)
+func NewBypass(list []string, mode string) (*Bypass, error) {
+	b := &Bypass{}
+	if err := b.Set(list, mode); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// ParseBypassList splits a NO_PROXY-style list on commas and whitespace
+func ParseBypassList(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n'
+	})
+}
+
+// ParseBypassMode checks a bypass mode, defaulting to BypassDirect
+func ParseBypassMode(s string) (string, error) {
+	switch s {
+	case "", BypassDirect:
+		return BypassDirect, nil
+	case BypassRefuse:
+		return BypassRefuse, nil
+	}
+	return "", fmt.Errorf("invalid bypass mode %q (want %s or %s)", s, BypassDirect, BypassRefuse)
+}
+
+// Set replaces the list and mode
+func (b *Bypass) Set(list []string, mode string) error {
+	mode, err := ParseBypassMode(mode)
+	if err != nil {
+		return err
+	}
+	var (
+		kept    []string
+		entries []bypassEntry
+	)
+	for _, s := range list {
+		s = hostmatch.ToASCII(strings.TrimSpace(s))
+		if s == "" {
+			continue
+		}
+		e, err := parseBypassEntry(s)
+		if err != nil {
+			return err
+		}
+		kept = append(kept, s)
+		entries = append(entries, e)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.list, b.entries, b.mode = kept, entries, mode
+	return nil
+}
+
+// parseBypassEntry parses one entry of a bypass list
+func parseBypassEntry(s string) (bypassEntry, error) {
+	if s == "*" {
+		return bypassEntry{all: true}, nil
+	}
+	if prefix, err := netip.ParsePrefix(s); err == nil {
+		return bypassEntry{prefix: prefix.Masked()}, nil
+	}
+
+	host, port := s, ""
+	if h, p, err := net.SplitHostPort(s); err == nil {
+		if _, err := strconv.ParseUint(p, 10, 16); err != nil {
+			return bypassEntry{}, fmt.Errorf("invalid port in bypass entry %q", s)
+		}
+		host, port = h, p
+	}
+	host = strings.TrimSuffix(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"), ".")
+	if addr, err := netip.ParseAddr(host); err == nil {
+		return bypassEntry{prefix: netip.PrefixFrom(addr, addr.BitLen()), port: port}, nil
+	}
+
+	host = strings.TrimPrefix(host, "*")
+	if host == "" || host == "." || strings.ContainsAny(host, "*/") {
+		return bypassEntry{}, fmt.Errorf("invalid bypass entry %q", s)
+	}
+	e := bypassEntry{domain: host, port: port}
+	if !strings.HasPrefix(host, ".") {
+		e.domain, e.matchHost = "."+host, true
+	}
+	return e, nil
+}
+
+// List returns the entries and mode
+func (b *Bypass) List() ([]string, string) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return append([]string{}, b.list...), b.mode
+}
+
+// Bypassed returns how many requests and tunnels have bypassed capture
+func (b *Bypass) Bypassed() int64 {
+	return b.bypassed.Load()
+}
+
+// Match reports whether a host, with an optional port (defaultPort when
+// absent), is bypassed, and in which mode
+func (b *Bypass) Match(hostport, defaultPort string) (string, bool) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host, port = hostport, defaultPort
+	}
+	host = hostmatch.Normalize(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]"))
+	addr, addrErr := netip.ParseAddr(host)
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, e := range b.entries {
+		if e.port != "" && e.port != port {
+			continue
+		}
+		switch {
+		case e.all:
+		case e.prefix.IsValid():
+			if addrErr != nil || !e.prefix.Contains(addr.Unmap()) {
+				continue
+			}
+		case addrErr == nil:
+			continue
+		case !strings.HasSuffix(host, e.domain) && !(e.matchHost && host == e.domain[1:]):
+			continue
+		}
+		b.bypassed.Add(1)
+		return b.mode, true
+	}
+	return "", false
+}
+
+// bypassed serves requests to bypassed hosts, reporting whether r was one.
+// Connectivity checks are always answered by the proxy.
+func (h *Handler) bypassed(w http.ResponseWriter, r *http.Request) bool {
+	var host, port string
+	switch {
+	case isCheckRequest(r):
+		return false
+	case isConnectUDP(r):
+		target, err := parseMasqueTarget(r.URL.Path)
+		if err != nil {
+			return false
+		}
+		host = target
+	case r.Method == http.MethodConnect:
+		host, port = r.Host, "443"
+	case r.URL.IsAbs():
+		host, port = r.URL.Host, "80"
+		if r.URL.Scheme == "https" {
+			port = "443"
+		}
+	default:
+		host, port = r.Host, "80"
+	}
+	mode, ok := h.bypass.Match(host, port)
+	if ok {
+		h.serveBypassed(w, r, host, mode)
+	}
+	return ok
+}
+
+// serveBypassed handles a request to a bypassed host without recording
+// it: refused, or forwarded or tunneled as is. UDP and HTTP/2 WebSocket
+// tunnels are refused in either mode.
+func (h *Handler) serveBypassed(w http.ResponseWriter, r *http.Request, host, mode string) {
+	if mode == BypassRefuse || isConnectUDP(r) || r.Header.Get(":protocol") != "" {
+		log.Printf("[BYPASS] Refused %s %s", r.Method, host)
+		http.Error(w, "Forbidden: host is excluded from this proxy", http.StatusForbidden)
+		return
+	}
+	if r.Method == http.MethodConnect {
+		h.tunnelBypassed(w, r, host)
+		return
+	}
+
+	outReq, err := http.NewRequestWithContext(r.Context(), r.Method, h.buildTargetURL(r), r.Body)
+	if err != nil {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	outReq.ContentLength = r.ContentLength
+	copyHeaders(outReq.Header, r.Header)
+	removeHopByHopHeaders(outReq.Header)
+	if isWebSocketUpgrade(r) {
+		outReq.Header.Set("Connection", "Upgrade")
+		outReq.Header.Set("Upgrade", r.Header.Get("Upgrade"))
+	}
+	outReq = outReq.WithContext(withUpstreamHost(outReq.Context(), outReq.URL.Hostname()))
+
+	resp, err := h.httpClient.Do(outReq)
+	if err != nil {
+		if r.Context().Err() == nil {
+			log.Printf("[BYPASS] %s %s failed: %v", r.Method, host, err)
+			http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		}
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		spliceBypassed(w, resp)
+		return
+	}
+	copyHeaders(w.Header(), resp.Header)
+	removeHopByHopHeaders(w.Header())
+	w.WriteHeader(resp.StatusCode)
+
+	flusher, _ := w.(http.Flusher)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			// Don't pass a cut-off body on as if it were whole
+			panic(http.ErrAbortHandler)
+		}
+	}
+}
+
+// spliceBypassed completes an upgrade with the client and joins its
+// connection to the upgraded upstream one
+func spliceBypassed(w http.ResponseWriter, resp *http.Response) {
+	upstream, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	client, buffered, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	client.SetDeadline(time.Time{})
+
+	var head bytes.Buffer
+	fmt.Fprintf(&head, "HTTP/1.1 %s\r\n", resp.Status)
+	resp.Header.Write(&head)
+	head.WriteString("\r\n")
+	if _, err := client.Write(head.Bytes()); err != nil {
+		client.Close()
+		return
+	}
+	pipe(buffered.Reader, client, client.Close, upstream)
+}
+
+// tunnelBypassed opens a CONNECT tunnel without recording it. The port
+// policy still applies.
+func (h *Handler) tunnelBypassed(w http.ResponseWriter, r *http.Request, host string) {
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "443")
+	}
+	_, portStr, _ := net.SplitHostPort(host)
+	if port, err := strconv.Atoi(portStr); err != nil || !h.connectPorts.Allows(port) {
+		http.Error(w, "Forbidden: CONNECT to this port is not allowed", http.StatusForbidden)
+		return
+	}
+
+	targetConn, err := h.dialTimeoutContext(withTimeouts(r.Context(), h.timeoutsFor(host)), "tcp", host)
+	if err != nil {
+		log.Printf("[BYPASS] Failed to connect to %s: %v", host, err)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	defer targetConn.Close()
+
+	if r.ProtoMajor == 2 {
+		stream, err := openStream(w)
+		if err != nil {
+			return
+		}
+		pipe(r.Body, stream, r.Body.Close, targetConn)
+		return
+	}
+
+	client, buffered, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	client.SetDeadline(time.Time{})
+	if _, err := client.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		client.Close()
+		return
+	}
+	pipe(buffered.Reader, client, client.Close, targetConn)
+}
+
+// pipe copies between a client and an upstream until either side is
+// done, then closes both
+func pipe(fromClient io.Reader, toClient io.Writer, closeClient func() error, upstream io.ReadWriteCloser) {
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(upstream, fromClient)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(toClient, upstream)
+		done <- struct{}{}
+	}()
+	<-done
+	closeClient()
+	upstream.Close()
+	<-done
+}
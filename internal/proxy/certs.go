@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+)
+
+// Probe and reverse lookup results are reused for hostInfoTTL
+const (
+	hostInfoTTL       = time.Hour
+	certProbeTimeout  = 10 * time.Second
+	reverseDNSTimeout = 2 * time.Second
+)
+
+// certProbe fetches the certificate chains of tunneled hosts over
+// connections of its own, since the tunnel's TLS is opaque to the proxy.
+// Chains are cached per address.
+type certProbe struct {
+	dial  func(ctx context.Context, network, addr string) (net.Conn, error)
+	mu    sync.Mutex
+	cache map[string]*certProbeResult
+}
+
+type certProbeResult struct {
+	done    chan struct{}
+	certs   []capture.CertInfo
+	fetched time.Time
+}
+
+func newCertProbe(dial func(ctx context.Context, network, addr string) (net.Conn, error)) *certProbe {
+	return &certProbe{dial: dial, cache: make(map[string]*certProbeResult)}
+}
+
+// start fetches the chain addr presents for serverName in the background,
+// unless a recent one is cached. The returned function waits for it and
+// stores it on captured; it is meant as the prepare step of record.
+func (p *certProbe) start(captured *capture.CapturedRequest, serverName, addr string) func() {
+	key := serverName + "|" + addr
+	p.mu.Lock()
+	result, ok := p.cache[key]
+	if !ok || (!result.fetched.IsZero() && time.Since(result.fetched) > hostInfoTTL) {
+		result = &certProbeResult{done: make(chan struct{})}
+		p.cache[key] = result
+		go p.fetch(result, serverName, addr)
+	}
+	p.mu.Unlock()
+
+	return func() {
+		<-result.done
+		captured.UpstreamCerts = result.certs
+	}
+}
+
+// fetch completes a TLS handshake without verifying the chain, so that
+// expired and mismatched certificates can be reported
+func (p *certProbe) fetch(result *certProbeResult, serverName, addr string) {
+	defer func() {
+		// Failures are retried once the entry expires too
+		p.mu.Lock()
+		result.fetched = time.Now()
+		p.mu.Unlock()
+		close(result.done)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), certProbeTimeout)
+	defer cancel()
+
+	conn, err := p.dial(ctx, "tcp", addr)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	config := &tls.Config{InsecureSkipVerify: true}
+	if net.ParseIP(serverName) == nil {
+		config.ServerName = serverName
+	}
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		return
+	}
+	result.certs = capture.CertChain(tlsConn.ConnectionState().PeerCertificates)
+}
+
+// reverseDNS looks up and caches the PTR names of upstream addresses
+type reverseDNS struct {
+	resolver *net.Resolver
+	mu       sync.Mutex
+	cache    map[string]reverseDNSEntry
+}
+
+type reverseDNSEntry struct {
+	names   []string
+	fetched time.Time
+}
+
+func newReverseDNS() *reverseDNS {
+	return &reverseDNS{resolver: net.DefaultResolver, cache: make(map[string]reverseDNSEntry)}
+}
+
+// lookup returns the names ip resolves back to, without trailing dots
+func (r *reverseDNS) lookup(ip string) []string {
+	r.mu.Lock()
+	entry, ok := r.cache[ip]
+	r.mu.Unlock()
+	if ok && time.Since(entry.fetched) < hostInfoTTL {
+		return entry.names
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), reverseDNSTimeout)
+	defer cancel()
+	names, _ := r.resolver.LookupAddr(ctx, ip)
+	for i, name := range names {
+		names[i] = strings.TrimSuffix(name, ".")
+	}
+
+	r.mu.Lock()
+	r.cache[ip] = reverseDNSEntry{names: names, fetched: time.Now()}
+	r.mu.Unlock()
+	return names
+}
@@ -0,0 +1,39 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/adamdrake/go_proxy/internal/hostmatch"
+)
+
+// CheckHost is a name that only resolves through the proxy: the proxy
+// answers requests for it itself, so a page that can fetch
+// http://go-proxy.check/ knows its traffic is flowing through the proxy.
+// These requests are not captured.
+const CheckHost = "go-proxy.check"
+
+// isCheckRequest reports whether r is addressed to CheckHost
+func isCheckRequest(r *http.Request) bool {
+	host := r.Host
+	if r.URL.IsAbs() {
+		host = r.URL.Host
+	}
+	return hostmatch.Normalize(host) == CheckHost
+}
+
+// serveCheck answers a connectivity check with what the proxy saw of the
+// client
+func (h *Handler) serveCheck(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"proxied":     true,
+		"client_addr": r.RemoteAddr,
+		"tenant":      tenantFrom(r.Context()),
+		"user_agent":  r.UserAgent(),
+		"time":        time.Now().UTC(),
+	})
+}
@@ -0,0 +1,228 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Circuit states
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half-open"
+)
+
+// errCircuitOpen is returned when a host's circuit is failing fast
+var errCircuitOpen = errors.New("circuit breaker open")
+
+// CircuitBreakerConfig controls per-host circuit breaking
+type CircuitBreakerConfig struct {
+	// Threshold is the number of consecutive failures that opens a
+	// host's circuit; zero disables circuit breaking
+	Threshold int
+	// Cooldown is how long an open circuit fails fast before letting a
+	// single trial request through
+	Cooldown time.Duration
+}
+
+// CircuitState is a point-in-time view of one host's circuit
+type CircuitState struct {
+	Host                string     `json:"host"`
+	State               string     `json:"state"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	Trips               int64      `json:"trips"`
+	Rejected            int64      `json:"rejected"`
+	LastError           string     `json:"last_error,omitempty"`
+	OpenedAt            *time.Time `json:"opened_at,omitempty"`
+	RetryAt             *time.Time `json:"retry_at,omitempty"`
+}
+
+// circuit tracks a single upstream host
+type circuit struct {
+	state     string
+	failures  int
+	openedAt  time.Time
+	trialSent bool
+	trips     int64
+	rejected  int64
+	lastError string
+}
+
+// circuitHost returns the host:port a circuit is kept under, so that
+// plain requests (whose URL may leave out the default port) and tunnels
+// to one upstream share a circuit
+func circuitHost(host, scheme string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return strings.ToLower(host)
+	}
+	port := "80"
+	if scheme == "https" || scheme == "wss" {
+		port = "443"
+	}
+	return net.JoinHostPort(strings.ToLower(strings.Trim(host, "[]")), port)
+}
+
+// CircuitBreakers holds a circuit per upstream host
+type CircuitBreakers struct {
+	config CircuitBreakerConfig
+
+	mu       sync.Mutex
+	circuits map[string]*circuit
+}
+
+// NewCircuitBreakers creates an empty set of circuits
+func NewCircuitBreakers(config CircuitBreakerConfig) *CircuitBreakers {
+	return &CircuitBreakers{
+		config:   config,
+		circuits: make(map[string]*circuit),
+	}
+}
+
+// Enabled reports whether circuit breaking is configured
+func (b *CircuitBreakers) Enabled() bool {
+	return b.config.Threshold > 0
+}
+
+// Allow reports whether a request to host may proceed. Once an open
+// circuit's cooldown has passed, one trial request is let through.
+func (b *CircuitBreakers) Allow(host string) error {
+	if !b.Enabled() {
+		return nil
+	}
+	host = strings.ToLower(host)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, ok := b.circuits[host]
+	if !ok {
+		return nil
+	}
+
+	switch c.state {
+	case CircuitOpen:
+		if time.Since(c.openedAt) < b.config.Cooldown {
+			c.rejected++
+			return errCircuitOpen
+		}
+		c.state = CircuitHalfOpen
+		c.trialSent = true
+		return nil
+	case CircuitHalfOpen:
+		if c.trialSent {
+			c.rejected++
+			return errCircuitOpen
+		}
+		c.trialSent = true
+	}
+	return nil
+}
+
+// Success records a healthy response from host, closing its circuit
+func (b *CircuitBreakers) Success(host string) {
+	if !b.Enabled() {
+		return
+	}
+	host = strings.ToLower(host)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if c, ok := b.circuits[host]; ok {
+		c.state = CircuitClosed
+		c.failures = 0
+		c.trialSent = false
+	}
+}
+
+// Release gives up a request let through by Allow that ended without a
+// verdict on the host, such as one the client aborted, so a half-open
+// circuit lets the next request through as its trial
+func (b *CircuitBreakers) Release(host string) {
+	if !b.Enabled() {
+		return
+	}
+	host = strings.ToLower(host)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if c, ok := b.circuits[host]; ok && c.state == CircuitHalfOpen {
+		c.trialSent = false
+	}
+}
+
+// Failure records a failed request to host, opening its circuit once the
+// threshold is reached or when a half-open trial fails
+func (b *CircuitBreakers) Failure(host, reason string) {
+	if !b.Enabled() {
+		return
+	}
+	host = strings.ToLower(host)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	c, ok := b.circuits[host]
+	if !ok {
+		c = &circuit{state: CircuitClosed}
+		b.circuits[host] = c
+	}
+
+	c.failures++
+	c.lastError = reason
+	if c.state == CircuitHalfOpen || (c.state == CircuitClosed && c.failures >= b.config.Threshold) {
+		c.state = CircuitOpen
+		c.openedAt = time.Now()
+		c.trialSent = false
+		c.trips++
+	}
+}
+
+// Reset closes every circuit
+func (b *CircuitBreakers) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.circuits = make(map[string]*circuit)
+}
+
+// Snapshot returns the state of every tracked host sorted by host
+func (b *CircuitBreakers) Snapshot() []CircuitState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	result := make([]CircuitState, 0, len(b.circuits))
+	for host, c := range b.circuits {
+		state := CircuitState{
+			Host:                host,
+			State:               c.state,
+			ConsecutiveFailures: c.failures,
+			Trips:               c.trips,
+			Rejected:            c.rejected,
+			LastError:           c.lastError,
+		}
+		if c.state != CircuitClosed {
+			openedAt := c.openedAt
+			retryAt := c.openedAt.Add(b.config.Cooldown)
+			state.OpenedAt = &openedAt
+			state.RetryAt = &retryAt
+		}
+		result = append(result, state)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Host < result[j].Host
+	})
+	return result
+}
+
+// isUpstreamFailure reports whether a response status counts against a
+// host's circuit
+func isUpstreamFailure(status int) bool {
+	return status == 502 || status == 503 || status == 504
+}
@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCircuitHost(t *testing.T) {
+	tests := []struct {
+		host, scheme, want string
+	}{
+		{"Example.com", "http", "example.com:80"},
+		{"example.com", "https", "example.com:443"},
+		{"example.com:8443", "https", "example.com:8443"},
+		{"[::1]", "http", "[::1]:80"},
+	}
+	for _, tt := range tests {
+		if got := circuitHost(tt.host, tt.scheme); got != tt.want {
+			t.Errorf("circuitHost(%q, %q) = %q, want %q", tt.host, tt.scheme, got, tt.want)
+		}
+	}
+}
+
+func TestCircuitReleaseFreesTrial(t *testing.T) {
+	b := NewCircuitBreakers(CircuitBreakerConfig{Threshold: 1, Cooldown: time.Millisecond})
+	host := circuitHost("example.com", "https")
+	b.Failure(host, "connection refused")
+	time.Sleep(2 * time.Millisecond)
+
+	if err := b.Allow(host); err != nil {
+		t.Fatalf("trial after cooldown rejected: %v", err)
+	}
+	if err := b.Allow(host); err == nil {
+		t.Fatal("second request let through while the trial is out")
+	}
+
+	// The client aborts the trial: the next request becomes the trial
+	b.Release(host)
+	if err := b.Allow(host); err != nil {
+		t.Fatalf("request after released trial rejected: %v", err)
+	}
+	b.Success(host)
+	if err := b.Allow(host); err != nil {
+		t.Fatalf("closed circuit rejected a request: %v", err)
+	}
+}
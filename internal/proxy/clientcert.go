@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"strings"
+
+	"github.com/adamdrake/go_proxy/internal/hostmatch"
+)
+
+// ClientCertRule presents a client certificate to upstream hosts matching
+// Pattern. Only connections the proxy terminates itself can use it; CONNECT
+// tunnels carry the client's own end-to-end TLS.
+type ClientCertRule struct {
+	Pattern     string
+	Certificate tls.Certificate
+	// Identity is a human-readable name for the certificate (its subject CN)
+	Identity string
+}
+
+// LoadClientCertRule parses a "host-pattern=cert.pem,key.pem" rule and loads
+// the key pair
+func LoadClientCertRule(s string) (ClientCertRule, error) {
+	pattern, files, ok := strings.Cut(s, "=")
+	certFile, keyFile, hasKey := strings.Cut(files, ",")
+	if !ok || !hasKey || strings.TrimSpace(pattern) == "" {
+		return ClientCertRule{}, fmt.Errorf("client cert rule %q must be of the form pattern=cert.pem,key.pem", s)
+	}
+
+	cert, err := tls.LoadX509KeyPair(strings.TrimSpace(certFile), strings.TrimSpace(keyFile))
+	if err != nil {
+		return ClientCertRule{}, err
+	}
+
+	return ClientCertRule{
+		Pattern:     strings.TrimSpace(pattern),
+		Certificate: cert,
+		Identity:    certIdentity(cert),
+	}, nil
+}
+
+// certIdentity returns the subject common name of a certificate's leaf
+func certIdentity(cert tls.Certificate) string {
+	if len(cert.Certificate) == 0 {
+		return ""
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return ""
+	}
+	if leaf.Subject.CommonName != "" {
+		return leaf.Subject.CommonName
+	}
+	return leaf.Subject.String()
+}
+
+type upstreamHostKey struct{}
+
+// withUpstreamHost records the destination host on an outgoing request's
+// context, where the TLS handshake can find it
+func withUpstreamHost(ctx context.Context, host string) context.Context {
+	return context.WithValue(ctx, upstreamHostKey{}, host)
+}
+
+// clientCertFor returns the first client certificate rule matching host
+func (h *Handler) clientCertFor(host string) *ClientCertRule {
+	for i := range h.clientCerts {
+		if hostmatch.Match(h.clientCerts[i].Pattern, host) {
+			return &h.clientCerts[i]
+		}
+	}
+	return nil
+}
+
+// getClientCertificate selects the client certificate for the host being
+// handshaked with. An empty certificate means none is sent.
+func (h *Handler) getClientCertificate(info *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	host, _ := info.Context().Value(upstreamHostKey{}).(string)
+	if rule := h.clientCertFor(host); rule != nil {
+		return &rule.Certificate, nil
+	}
+	return &tls.Certificate{}, nil
+}
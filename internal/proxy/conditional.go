@@ -0,0 +1,28 @@
+package proxy
+
+import (
+	"net/http"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+)
+
+// linkNotModified points a 304 capture at the stored 200 capture its
+// validators matched and, when enabled, gives it that capture's body. It
+// runs on the capture worker, after the request headers are cloned.
+func (h *Handler) linkNotModified(captured *capture.CapturedRequest) {
+	if captured.StatusCode != http.StatusNotModified {
+		return
+	}
+	header := http.Header(captured.RequestHeaders)
+	store, _ := h.tenantFor(captured.Tenant)
+	prior := store.FindValidated(captured.Host, captured.URL, header.Get("If-None-Match"), header.Get("If-Modified-Since"))
+	if prior == nil {
+		return
+	}
+	captured.NotModifiedOf = prior.ID
+	if h.attach304Bodies && len(captured.ResponseBody) == 0 && len(prior.ResponseBody) > 0 {
+		// Bodies are never modified once stored, so sharing is safe
+		captured.ResponseBody = prior.ResponseBody
+		captured.CachedBody = true
+	}
+}
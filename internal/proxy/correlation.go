@@ -0,0 +1,24 @@
+package proxy
+
+import (
+	"net/http"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+)
+
+// correlate gives the exchange a correlation ID: the one the client sent
+// in the correlation header, or the capture ID. It is forwarded upstream,
+// stored on the capture and returned to the client, so captures can be
+// joined with backend logs.
+func (h *Handler) correlate(w http.ResponseWriter, r, outReq *http.Request, captured *capture.CapturedRequest) {
+	if h.correlationHeader == "" {
+		return
+	}
+	id := r.Header.Get(h.correlationHeader)
+	if id == "" {
+		id = captured.ID
+	}
+	captured.CorrelationID = id
+	outReq.Header.Set(h.correlationHeader, id)
+	w.Header().Set(h.correlationHeader, id)
+}
@@ -0,0 +1,278 @@
+package proxy
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+)
+
+// CrawlConfig controls crawl assist mode, which keeps scrapers polite
+type CrawlConfig struct {
+	// Delay is the minimum time between requests to the same host; zero
+	// disables pacing unless robots.txt sets a Crawl-delay
+	Delay time.Duration
+	// MaxWait is the longest a request is held for its slot before it is
+	// refused with 429
+	MaxWait time.Duration
+	// Robots checks requests against each host's robots.txt, flagging
+	// disallowed ones on the capture and honoring Crawl-delay
+	Robots bool
+	// EnforceRobots refuses disallowed requests with 403 instead of only
+	// flagging them
+	EnforceRobots bool
+	// UserAgent is the product token matched against robots.txt groups;
+	// empty uses the request's User-Agent
+	UserAgent string
+}
+
+// Enabled reports whether any crawl assist feature is on
+func (c CrawlConfig) Enabled() bool {
+	return c.Delay > 0 || c.Robots
+}
+
+// robotsTTL is how long a fetched robots.txt is trusted
+const robotsTTL = time.Hour
+
+// crawler paces requests per host and caches robots.txt files
+type crawler struct {
+	config CrawlConfig
+	client *http.Client
+
+	mu     sync.Mutex
+	next   map[string]time.Time
+	robots map[string]*robotsEntry
+}
+
+// robotsEntry is a robots.txt fetch, shared by concurrent requests
+type robotsEntry struct {
+	ready   chan struct{}
+	robots  *robotsTxt
+	fetched time.Time
+}
+
+func newCrawler(config CrawlConfig, client *http.Client) *crawler {
+	if config.MaxWait <= 0 {
+		config.MaxWait = 30 * time.Second
+	}
+	return &crawler{
+		config: config,
+		client: client,
+		next:   make(map[string]time.Time),
+		robots: make(map[string]*robotsEntry),
+	}
+}
+
+// reserve claims the host's next request slot, returning how long to wait
+// for it. It reports false, without claiming, when the wait would exceed
+// MaxWait.
+func (c *crawler) reserve(host string, delay time.Duration) (time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	slot := now
+	if next := c.next[host]; next.After(now) {
+		slot = next
+	}
+	wait := slot.Sub(now)
+	if wait > c.config.MaxWait {
+		return wait, false
+	}
+	c.next[host] = slot.Add(delay)
+	return wait, true
+}
+
+// backoff holds off requests to host until the given time
+func (c *crawler) backoff(host string, until time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if until.After(c.next[host]) {
+		c.next[host] = until
+	}
+}
+
+// robotsFor returns the robots.txt of the URL's origin, fetching it at most
+// once per robotsTTL. Hosts without a readable robots.txt allow everything.
+func (c *crawler) robotsFor(ctx context.Context, u *url.URL) *robotsTxt {
+	origin := u.Scheme + "://" + u.Host
+
+	c.mu.Lock()
+	entry, ok := c.robots[origin]
+	if ok {
+		select {
+		case <-entry.ready:
+			if time.Since(entry.fetched) > robotsTTL {
+				ok = false
+			}
+		default:
+		}
+	}
+	if !ok {
+		entry = &robotsEntry{ready: make(chan struct{})}
+		c.robots[origin] = entry
+		go c.fetchRobots(origin, entry)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-entry.ready:
+		return entry.robots
+	case <-ctx.Done():
+		return &robotsTxt{}
+	}
+}
+
+// fetchRobots downloads and parses an origin's robots.txt
+func (c *crawler) fetchRobots(origin string, entry *robotsEntry) {
+	defer close(entry.ready)
+	entry.robots = &robotsTxt{}
+	entry.fetched = time.Now()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, origin+"/robots.txt", nil)
+	if err != nil {
+		return
+	}
+	if c.config.UserAgent != "" {
+		req.Header.Set("User-Agent", c.config.UserAgent)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		entry.robots = parseRobots(resp.Body)
+	}
+}
+
+// productToken extracts the crawler name from a User-Agent header
+func productToken(userAgent string) string {
+	token, _, _ := strings.Cut(strings.TrimSpace(userAgent), "/")
+	token, _, _ = strings.Cut(token, " ")
+	return token
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds or as an
+// HTTP date
+func parseRetryAfter(value string, now time.Time) (time.Time, bool) {
+	if value == "" {
+		return time.Time{}, false
+	}
+	if secs, err := strconv.Atoi(strings.TrimSpace(value)); err == nil && secs >= 0 {
+		return now.Add(time.Duration(secs) * time.Second), true
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+// crawlGate applies robots.txt and per-host pacing to an outgoing request,
+// holding it until its slot. It reports false when it answered the client
+// itself.
+func (h *Handler) crawlGate(w http.ResponseWriter, r, outReq *http.Request, captured *capture.CapturedRequest, startTime time.Time) bool {
+	if h.crawl == nil {
+		return true
+	}
+	config := h.crawl.config
+	host := outReq.URL.Host
+	requestHeader := r.Header
+	dryRun := h.dryRun()
+	refuse := func(status int, reason string) bool {
+		if dryRun {
+			wouldBlock(captured, reason)
+			return true
+		}
+		http.Error(w, http.StatusText(status)+": "+reason, status)
+		captured.StatusCode = status
+		captured.Blocked = true
+		captured.BlockReason = reason
+		captured.RecordActions(capture.ActionRecord{Type: capture.ActionBlock, Detail: reason})
+		captured.Duration = time.Since(startTime)
+		h.record(captured, func() {
+			captured.RequestHeaders = cloneHeaders(requestHeader)
+		})
+		return false
+	}
+
+	delay := config.Delay
+	if config.Robots {
+		agent := config.UserAgent
+		if agent == "" {
+			agent = outReq.Header.Get("User-Agent")
+		}
+		group := h.crawl.robotsFor(outReq.Context(), outReq.URL).group(productToken(agent))
+		delay = max(delay, group.crawlDelay)
+		if rule, ok := group.disallowedBy(outReq.URL.RequestURI()); ok {
+			captured.RobotsDisallowed = rule.String()
+			if config.EnforceRobots {
+				log.Printf("[HTTP] Refused %s: robots.txt %s", outReq.URL, rule)
+				return refuse(http.StatusForbidden, "disallowed by robots.txt ("+rule.String()+")")
+			}
+		}
+	}
+
+	// A dry run still claims slots, so the waits it records are those of
+	// the queue paced requests would form
+	wait, ok := h.crawl.reserve(host, delay)
+	if !ok {
+		if !dryRun {
+			w.Header().Set("Retry-After", strconv.Itoa(int(wait.Seconds()+1)))
+		}
+		return refuse(http.StatusTooManyRequests, "crawl pacing: next slot for "+host+" in "+wait.Round(time.Second).String())
+	}
+	if wait <= 0 {
+		return true
+	}
+	if dryRun {
+		captured.RecordWouldApply(capture.ActionRecord{Type: capture.ActionCrawl, Detail: "paced " + wait.Round(time.Millisecond).String()})
+		return true
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-r.Context().Done():
+		captured.ClientAborted = true
+		captured.Duration = time.Since(startTime)
+		h.record(captured, func() {
+			captured.RequestHeaders = cloneHeaders(requestHeader)
+		})
+		return false
+	}
+	captured.RecordActions(capture.ActionRecord{Type: capture.ActionCrawl, Detail: "paced " + wait.Round(time.Millisecond).String()})
+	return true
+}
+
+// crawlObserve holds off further requests to a host that answered 429 or
+// 503 with Retry-After
+func (h *Handler) crawlObserve(host string, resp *http.Response, captured *capture.CapturedRequest) {
+	if h.crawl == nil {
+		return
+	}
+	if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+		return
+	}
+	until, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+	if !ok {
+		return
+	}
+	h.crawl.backoff(host, until)
+	action := capture.ActionRecord{Type: capture.ActionCrawl, Detail: "holding " + host + " until " + until.Format(time.RFC3339)}
+	if h.dryRun() {
+		captured.RecordWouldApply(action)
+	} else {
+		captured.RecordActions(action)
+	}
+}
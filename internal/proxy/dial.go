@@ -0,0 +1,217 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// IPMode controls which address families are used for upstream connections
+type IPMode string
+
+const (
+	// IPModeDual races IPv6 and IPv4 using Happy Eyeballs (RFC 6555)
+	IPModeDual IPMode = "dual"
+	// IPModePreferIPv4 tries every IPv4 address before falling back to IPv6
+	IPModePreferIPv4 IPMode = "prefer-ipv4"
+	// IPModePreferIPv6 tries every IPv6 address before falling back to IPv4
+	IPModePreferIPv6 IPMode = "prefer-ipv6"
+	// IPModeIPv4Only never dials IPv6 addresses
+	IPModeIPv4Only IPMode = "ipv4-only"
+	// IPModeIPv6Only never dials IPv4 addresses
+	IPModeIPv6Only IPMode = "ipv6-only"
+)
+
+// happyEyeballsDelay is how long the primary family gets before the
+// fallback family is raced against it
+const happyEyeballsDelay = 300 * time.Millisecond
+
+// ParseIPMode validates an IP mode name
+func ParseIPMode(s string) (IPMode, error) {
+	switch mode := IPMode(s); mode {
+	case IPModeDual, IPModePreferIPv4, IPModePreferIPv6, IPModeIPv4Only, IPModeIPv6Only:
+		return mode, nil
+	case "":
+		return IPModeDual, nil
+	default:
+		return "", fmt.Errorf("unknown IP mode %q", s)
+	}
+}
+
+// dialContext opens upstream connections for both the HTTP transport and
+// CONNECT tunnels. The host is resolved (through the DNS cache when enabled)
+// and the addresses are dialed according to the configured IP mode.
+func (h *Handler) dialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	var ips []net.IPAddr
+	if h.dnsCache != nil {
+		ips, err = h.dnsCache.LookupIPAddr(ctx, host)
+	} else {
+		ips, err = net.DefaultResolver.LookupIPAddr(ctx, host)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	bind := h.bindAddrFor(host)
+	primary, fallback := splitByFamily(ips, h.ipMode)
+	if len(primary) == 0 && len(fallback) == 0 {
+		return nil, &net.DNSError{Err: fmt.Sprintf("no addresses allowed by IP mode %s", h.ipMode), Name: host, IsNotFound: true}
+	}
+
+	switch h.ipMode {
+	case IPModeDual:
+		return h.dialParallel(ctx, network, port, bind, primary, fallback)
+	default:
+		return h.dialSerial(ctx, network, port, bind, append(primary, fallback...))
+	}
+}
+
+// splitByFamily orders resolved addresses into a primary and a fallback list
+func splitByFamily(ips []net.IPAddr, mode IPMode) (primary, fallback []net.IPAddr) {
+	var v4, v6 []net.IPAddr
+	for _, ip := range ips {
+		if ip.IP.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+
+	switch mode {
+	case IPModePreferIPv4:
+		return v4, v6
+	case IPModePreferIPv6:
+		return v6, v4
+	case IPModeIPv4Only:
+		return v4, nil
+	case IPModeIPv6Only:
+		return v6, nil
+	default:
+		// Dual stack: the family of the first resolved address goes first
+		if len(ips) > 0 && ips[0].IP.To4() != nil {
+			return v4, v6
+		}
+		return v6, v4
+	}
+}
+
+// dialSerial tries each address in order until one connects
+func (h *Handler) dialSerial(ctx context.Context, network, port string, bind BindAddr, ips []net.IPAddr) (net.Conn, error) {
+	var firstErr error
+	for _, ip := range ips {
+		dialer := h.dialer
+		if !bind.IsZero() {
+			local := bind.For(ip.IP)
+			if local == nil {
+				// Never leak traffic out of another interface
+				if firstErr == nil {
+					firstErr = fmt.Errorf("no outbound bind address of the same family as %s", ip.IP)
+				}
+				continue
+			}
+			bound := *h.dialer
+			if strings.HasPrefix(network, "udp") {
+				bound.LocalAddr = &net.UDPAddr{IP: local}
+			} else {
+				bound.LocalAddr = &net.TCPAddr{IP: local}
+			}
+			dialer = &bound
+		}
+
+		conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if firstErr == nil {
+		firstErr = fmt.Errorf("no addresses to dial")
+	}
+	return nil, firstErr
+}
+
+// dialParallel races the primary addresses against the fallback addresses,
+// giving the primary family a head start
+func (h *Handler) dialParallel(ctx context.Context, network, port string, bind BindAddr, primary, fallback []net.IPAddr) (net.Conn, error) {
+	if len(fallback) == 0 {
+		return h.dialSerial(ctx, network, port, bind, primary)
+	}
+	if len(primary) == 0 {
+		return h.dialSerial(ctx, network, port, bind, fallback)
+	}
+
+	type result struct {
+		conn    net.Conn
+		err     error
+		primary bool
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan result, 2)
+	race := func(ips []net.IPAddr, isPrimary bool) {
+		conn, err := h.dialSerial(ctx, network, port, bind, ips)
+		results <- result{conn: conn, err: err, primary: isPrimary}
+	}
+
+	go race(primary, true)
+
+	fallbackTimer := time.NewTimer(happyEyeballsDelay)
+	defer fallbackTimer.Stop()
+
+	var primaryErr, fallbackErr error
+	fallbackStarted := false
+	for pending := 1; pending > 0; {
+		select {
+		case <-fallbackTimer.C:
+			if !fallbackStarted {
+				fallbackStarted = true
+				pending++
+				go race(fallback, false)
+			}
+
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				// Close the loser if it connects after we return
+				if pending > 0 {
+					go func() {
+						if late := <-results; late.conn != nil {
+							late.conn.Close()
+						}
+					}()
+				}
+				return res.conn, nil
+			}
+			if res.primary {
+				primaryErr = res.err
+			} else {
+				fallbackErr = res.err
+			}
+			if !fallbackStarted {
+				// Primary failed fast; start the fallback immediately
+				fallbackStarted = true
+				pending++
+				go race(fallback, false)
+			}
+		}
+	}
+
+	if primaryErr != nil {
+		return nil, primaryErr
+	}
+	return nil, fallbackErr
+}
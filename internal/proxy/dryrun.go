@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"net/http"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+	"github.com/adamdrake/go_proxy/internal/rules"
+)
+
+// In dry-run mode rules, header rules, filter lists, third-party and
+// secret blocking and crawl pacing are evaluated as usual, but what they
+// would have done is recorded in the capture's WouldApply instead of done.
+// Single rules can be put in dry-run mode on their own.
+
+// dryRun reports whether the proxy's blocking and pacing features only
+// record what they would do
+func (h *Handler) dryRun() bool {
+	return h.rules.DryRun()
+}
+
+// wouldBlock records a block that dry-run mode let through
+func wouldBlock(captured *capture.CapturedRequest, reason string) {
+	captured.RecordWouldApply(capture.ActionRecord{Type: capture.ActionBlock, Detail: reason})
+}
+
+// dryRunResponseHeaders records the header changes the dry-run rules would
+// have made to a response, working on copies
+func dryRunResponseHeaders(captured *capture.CapturedRequest, requestHeader, header http.Header, outcome *rules.Outcome) {
+	shadow := outcome.Shadow()
+	if shadow == nil {
+		return
+	}
+	captured.RecordWouldApply(shadow.RelaxResponse(requestHeader, header.Clone())...)
+	captured.RecordWouldApply(shadow.RewriteSetCookies(header.Clone())...)
+	captured.RecordWouldApply(shadow.RewriteHeaders(header.Clone())...)
+}
+
+// dryRunResponseBody records the body rewrites the dry-run rules would
+// have made to the response body as relayed
+func dryRunResponseBody(captured *capture.CapturedRequest, header http.Header, body []byte, limit int64, outcome *rules.Outcome) {
+	shadow := outcome.Shadow()
+	if shadow == nil || !rewritesBody(header, shadow) {
+		return
+	}
+	_, actions := rewriteResponseBody(header.Clone(), body, limit, shadow)
+	captured.RecordWouldApply(actions...)
+}
@@ -0,0 +1,18 @@
+package proxy
+
+import "net/http"
+
+// faithfulRequest undoes what net/http would otherwise add to outReq on
+// top of the client's request r. Header order and casing are kept by the
+// ordered transport, and compression is never requested upstream.
+func faithfulRequest(outReq, r *http.Request) {
+	// A present but empty User-Agent stops net/http sending its own
+	if _, ok := r.Header["User-Agent"]; !ok {
+		outReq.Header["User-Agent"] = nil
+	}
+
+	// HTTP/2 requests still go upstream as HTTP/1.1
+	if r.ProtoMajor == 1 {
+		outReq.Proto, outReq.ProtoMajor, outReq.ProtoMinor = r.Proto, r.ProtoMajor, r.ProtoMinor
+	}
+}
@@ -0,0 +1,404 @@
+package proxy
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+	"github.com/google/uuid"
+)
+
+// udpForwardIdle is how long a UDP forward session lives without traffic
+const udpForwardIdle = 60 * time.Second
+
+// Forward relays a local port to a fixed target at layer 4
+type Forward struct {
+	// Network is "tcp" or "udp"
+	Network    string
+	ListenAddr string
+	Target     string
+	// Protocol optionally decodes the session: MailSMTP or MailIMAP
+	Protocol string
+}
+
+// ParseForward parses "[bind:]port:host:port", e.g. "5432:db.internal:5432"
+// or "127.0.0.1:5353:10.0.0.2:53"
+func ParseForward(network, s string) (Forward, error) {
+	// Split from the right so IPv6 targets in brackets keep their colons
+	i := strings.LastIndex(s, ":")
+	if i < 0 {
+		return Forward{}, fmt.Errorf("forward %q must be of the form [bind:]port:host:port", s)
+	}
+	targetPort, rest := s[i+1:], s[:i]
+
+	var listen, targetHost string
+	if strings.HasSuffix(rest, "]") {
+		j := strings.LastIndex(rest, ":[")
+		if j < 0 {
+			return Forward{}, fmt.Errorf("forward %q has an unterminated IPv6 target", s)
+		}
+		listen, targetHost = rest[:j], strings.Trim(rest[j+1:], "[]")
+	} else {
+		j := strings.LastIndex(rest, ":")
+		if j < 0 {
+			return Forward{}, fmt.Errorf("forward %q must be of the form [bind:]port:host:port", s)
+		}
+		listen, targetHost = rest[:j], rest[j+1:]
+	}
+
+	if _, err := strconv.ParseUint(targetPort, 10, 16); err != nil || targetHost == "" {
+		return Forward{}, fmt.Errorf("forward %q has an invalid target", s)
+	}
+	if !strings.Contains(listen, ":") {
+		listen = ":" + listen
+	}
+	if _, port, err := net.SplitHostPort(listen); err != nil || port == "" {
+		return Forward{}, fmt.Errorf("forward %q has an invalid listen address", s)
+	}
+
+	return Forward{
+		Network:    network,
+		ListenAddr: listen,
+		Target:     net.JoinHostPort(targetHost, targetPort),
+	}, nil
+}
+
+// String describes the forward for logs
+func (f Forward) String() string {
+	network := f.Network
+	if f.Protocol != "" {
+		network = f.Protocol
+	}
+	return fmt.Sprintf("%s %s -> %s", network, f.ListenAddr, f.Target)
+}
+
+// sampler keeps the first bytes of one direction of a stream
+type sampler struct {
+	limit int
+	buf   []byte
+}
+
+func (s *sampler) add(p []byte) {
+	if room := s.limit - len(s.buf); room > 0 {
+		if len(p) > room {
+			p = p[:room]
+		}
+		s.buf = append(s.buf, p...)
+	}
+}
+
+// dump renders the sample like hexdump -C
+func (s *sampler) dump() string {
+	if len(s.buf) == 0 {
+		return ""
+	}
+	return hex.Dump(s.buf)
+}
+
+// countingWriter counts and samples bytes on their way to w, optionally
+// passing them to an observer
+type countingWriter struct {
+	w       io.Writer
+	n       int64
+	sample  sampler
+	observe func([]byte)
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.sample.add(p[:n])
+	if c.observe != nil {
+		c.observe(p[:n])
+	}
+	return n, err
+}
+
+// forwarders runs the L4 forward listeners and tracks live connections so
+// they can be closed on shutdown
+type forwarders struct {
+	handler    *Handler
+	sampleSize int
+	mailBodies bool
+
+	mu        sync.Mutex
+	closed    bool
+	listeners []io.Closer
+	conns     map[io.Closer]struct{}
+}
+
+// start opens every forward's listener
+func (f *forwarders) start(forwards []Forward) error {
+	for _, fwd := range forwards {
+		switch fwd.Network {
+		case "tcp":
+			ln, err := net.Listen("tcp", fwd.ListenAddr)
+			if err != nil {
+				return fmt.Errorf("forward %s: %w", fwd, err)
+			}
+			f.track(ln, true)
+			go f.serveTCP(ln, fwd)
+		case "udp":
+			pc, err := net.ListenPacket("udp", fwd.ListenAddr)
+			if err != nil {
+				return fmt.Errorf("forward %s: %w", fwd, err)
+			}
+			f.track(pc, true)
+			go f.serveUDP(pc, fwd)
+		default:
+			return fmt.Errorf("forward %s: unknown network", fwd)
+		}
+		log.Printf("Forwarding %s", fwd)
+	}
+	return nil
+}
+
+// track registers a listener or connection, closing it immediately if
+// the forwarders are already shut down
+func (f *forwarders) track(c io.Closer, listener bool) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		c.Close()
+		return false
+	}
+	if listener {
+		f.listeners = append(f.listeners, c)
+	} else {
+		if f.conns == nil {
+			f.conns = make(map[io.Closer]struct{})
+		}
+		f.conns[c] = struct{}{}
+	}
+	return true
+}
+
+func (f *forwarders) untrack(c io.Closer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.conns, c)
+}
+
+// close stops the listeners and live connections
+func (f *forwarders) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.closed = true
+	for _, ln := range f.listeners {
+		ln.Close()
+	}
+	for c := range f.conns {
+		c.Close()
+	}
+	f.listeners, f.conns = nil, nil
+}
+
+// newCapture starts a capture for a forwarded connection
+func (f *forwarders) newCapture(fwd Forward, client net.Addr) *capture.CapturedRequest {
+	captured := capture.NewCapturedRequest()
+	captured.ID = uuid.New().String()
+	scheme := fwd.Network
+	if fwd.Protocol != "" {
+		scheme = fwd.Protocol
+	}
+	captured.Method = strings.ToUpper(scheme)
+	captured.Host = fwd.Target
+	captured.URL = scheme + "://" + fwd.Target
+	captured.Proto = strings.ToUpper(fwd.Network)
+	captured.IsTunnel = true
+	captured.ClientAddr = client.String()
+	return captured
+}
+
+// dial connects to a forward's target with the proxy's dialing settings
+func (f *forwarders) dial(fwd Forward) (net.Conn, error) {
+	h := f.handler
+	ctx := withTimeouts(context.Background(), h.timeoutsFor(fwd.Target))
+	return h.dialTimeoutContext(ctx, fwd.Network, fwd.Target)
+}
+
+func (f *forwarders) serveTCP(ln net.Listener, fwd Forward) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go f.forwardTCP(conn, fwd)
+	}
+}
+
+// forwardTCP relays one TCP connection and records it when it closes
+func (f *forwarders) forwardTCP(clientConn net.Conn, fwd Forward) {
+	startTime := time.Now()
+	defer clientConn.Close()
+	if !f.track(clientConn, false) {
+		return
+	}
+	defer f.untrack(clientConn)
+
+	captured := f.newCapture(fwd, clientConn.RemoteAddr())
+
+	targetConn, err := f.dial(fwd)
+	if err != nil {
+		log.Printf("[FORWARD] Failed to connect to %s: %v", fwd.Target, err)
+		captured.Error = err.Error()
+		captured.Duration = time.Since(startTime)
+		f.handler.record(captured, nil)
+		return
+	}
+	defer targetConn.Close()
+
+	sent := &countingWriter{w: targetConn, sample: sampler{limit: f.sampleSize}}
+	received := &countingWriter{w: clientConn, sample: sampler{limit: f.sampleSize}}
+
+	var mail *mailTap
+	var mqtt *mqttTap
+	if fwd.Protocol != "" {
+		mail = newMailTap(fwd.Protocol, f.mailBodies, int(f.handler.maxRequestSize))
+		sent.observe, received.observe = mail.fromClient, mail.fromServer
+	} else {
+		mqtt = &mqttTap{}
+		sent.observe, received.observe = mqtt.fromClient, mqtt.fromServer
+	}
+
+	done := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(sent, clientConn)
+		done <- err
+	}()
+	go func() {
+		_, err := io.Copy(received, targetConn)
+		done <- err
+	}()
+
+	if err := <-done; err != nil && !errors.Is(err, net.ErrClosed) {
+		captured.Error = err.Error()
+	}
+	clientConn.Close()
+	targetConn.Close()
+	<-done
+
+	captured.BytesSent = sent.n
+	captured.BytesReceived = received.n
+	captured.PayloadSentSample = sent.sample.dump()
+	captured.PayloadReceivedSample = received.sample.dump()
+	if mail != nil {
+		captured.Mail = mail.result()
+	}
+	if mqtt != nil {
+		captured.MQTT = mqtt.result()
+	}
+	captured.Duration = time.Since(startTime)
+	f.handler.record(captured, nil)
+}
+
+// udpSession is the upstream socket for one client address
+type udpSession struct {
+	conn     net.Conn
+	captured *capture.CapturedRequest
+	started  time.Time
+
+	// sent is written by the listener goroutine, the rest by the reply
+	// goroutine
+	sent     countingWriter
+	received sampler
+	recvN    int64
+}
+
+func (f *forwarders) serveUDP(pc net.PacketConn, fwd Forward) {
+	var mu sync.Mutex
+	sessions := make(map[string]*udpSession)
+
+	buf := make([]byte, maxUDPPayload)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+
+		// Writes happen under the lock so a session's counters are final
+		// once it has been removed
+		mu.Lock()
+		key := addr.String()
+		s, ok := sessions[key]
+		if !ok {
+			s = f.openUDPSession(pc, fwd, addr, func() {
+				mu.Lock()
+				delete(sessions, key)
+				mu.Unlock()
+			})
+			if s != nil {
+				sessions[key] = s
+			}
+		}
+		if s != nil {
+			s.sent.Write(buf[:n])
+		}
+		mu.Unlock()
+	}
+}
+
+// openUDPSession dials the target for a new client address and relays
+// replies until the session goes idle. remove is called before the session
+// is recorded.
+func (f *forwarders) openUDPSession(pc net.PacketConn, fwd Forward, addr net.Addr, remove func()) *udpSession {
+	s := &udpSession{
+		captured: f.newCapture(fwd, addr),
+		started:  time.Now(),
+		received: sampler{limit: f.sampleSize},
+	}
+
+	conn, err := f.dial(fwd)
+	if err != nil {
+		log.Printf("[FORWARD] Failed to reach %s: %v", fwd.Target, err)
+		s.captured.Error = err.Error()
+		f.handler.record(s.captured, nil)
+		return nil
+	}
+	if !f.track(conn, false) {
+		return nil
+	}
+	s.conn = conn
+	s.sent = countingWriter{w: conn, sample: sampler{limit: f.sampleSize}}
+
+	go func() {
+		defer f.untrack(conn)
+		defer conn.Close()
+
+		buf := make([]byte, maxUDPPayload)
+		for {
+			conn.SetReadDeadline(time.Now().Add(udpForwardIdle))
+			n, err := conn.Read(buf)
+			if err != nil {
+				var netErr net.Error
+				if !(errors.As(err, &netErr) && netErr.Timeout()) && !errors.Is(err, net.ErrClosed) {
+					s.captured.Error = err.Error()
+				}
+				break
+			}
+			s.received.add(buf[:n])
+			s.recvN += int64(n)
+			pc.WriteTo(buf[:n], addr)
+		}
+
+		remove()
+		s.captured.BytesSent = s.sent.n
+		s.captured.BytesReceived = s.recvN
+		s.captured.PayloadSentSample = s.sent.sample.dump()
+		s.captured.PayloadReceivedSample = s.received.dump()
+		s.captured.Duration = time.Since(s.started)
+		f.handler.record(s.captured, nil)
+	}()
+	return s
+}
@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+)
+
+// HTTP/2 clients can't hand over their connection, so tunnels and
+// WebSockets run over the request stream itself: the request body carries
+// client bytes and the response body carries server bytes.
+
+// streamWriter writes to an HTTP/2 response, flushing every write so
+// tunneled bytes aren't held in the response buffer
+type streamWriter struct {
+	w  http.ResponseWriter
+	rc *http.ResponseController
+}
+
+func (s streamWriter) Write(p []byte) (int, error) {
+	n, err := s.w.Write(p)
+	if err == nil {
+		err = s.rc.Flush()
+	}
+	return n, err
+}
+
+// openStream sends a 200 response and returns a writer for the stream,
+// lifting server deadlines meant for ordinary requests
+func openStream(w http.ResponseWriter) (io.Writer, error) {
+	rc := http.NewResponseController(w)
+	rc.SetReadDeadline(time.Time{})
+	rc.SetWriteDeadline(time.Time{})
+
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return nil, err
+	}
+	return streamWriter{w: w, rc: rc}, nil
+}
+
+// tunnelStream relays a CONNECT tunnel over an HTTP/2 stream. prepare is
+// passed on to record.
+func (h *Handler) tunnelStream(w http.ResponseWriter, r *http.Request, targetConn net.Conn, captured *capture.CapturedRequest, startTime time.Time, prepare func()) {
+	client, err := openStream(w)
+	if err != nil {
+		log.Printf("[CONNECT] Failed to open stream: %v", err)
+		captured.StatusCode = http.StatusInternalServerError
+		captured.Duration = time.Since(startTime)
+		h.record(captured, prepare)
+		return
+	}
+	captured.StatusCode = http.StatusOK
+
+	log.Printf("[CONNECT] Tunnel established to %s over %s", r.Host, r.Proto)
+
+	done := make(chan struct{}, 2)
+	mqtt := &mqttTap{}
+	go func() {
+		io.Copy(&countingWriter{w: targetConn, observe: mqtt.fromClient}, r.Body)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(&countingWriter{w: client, observe: mqtt.fromServer}, targetConn)
+		done <- struct{}{}
+	}()
+
+	// Either direction finishing ends the tunnel; closing both ends
+	// unblocks the other copy before the stream is torn down
+	<-done
+	targetConn.Close()
+	r.Body.Close()
+	<-done
+
+	captured.Duration = time.Since(startTime)
+	captured.MQTT = mqtt.result()
+	h.record(captured, prepare)
+
+	log.Printf("[CONNECT] Tunnel closed to %s (duration: %s)", r.Host, captured.Duration)
+}
+
+// handleExtendedConnect serves RFC 8441 extended CONNECT, which HTTP/2
+// clients use to open WebSockets. The request is forwarded upstream as an
+// HTTP/1.1 upgrade and relayed like any other WebSocket.
+func (h *Handler) handleExtendedConnect(w http.ResponseWriter, r *http.Request) {
+	protocol := r.Header.Get(":protocol")
+	if protocol != "websocket" {
+		http.Error(w, "Unsupported CONNECT protocol "+protocol, http.StatusNotImplemented)
+		return
+	}
+
+	upgrade := r.Clone(r.Context())
+	upgrade.Method = http.MethodGet
+	upgrade.Header.Del(":protocol")
+	upgrade.Header.Set("Connection", "Upgrade")
+	upgrade.Header.Set("Upgrade", "websocket")
+
+	// HTTP/2 WebSockets have no key handshake; HTTP/1.1 servers need one
+	var key [16]byte
+	rand.Read(key[:])
+	upgrade.Header.Set("Sec-WebSocket-Key", base64.StdEncoding.EncodeToString(key[:]))
+
+	h.handleHTTP(w, upgrade)
+}
@@ -1,55 +1,330 @@
 package proxy
 
 import (
+	"cmp"
+	"context"
+	"crypto/tls"
 	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/adamdrake/go_proxy/internal/anomaly"
+	"github.com/adamdrake/go_proxy/internal/blocklist"
 	"github.com/adamdrake/go_proxy/internal/capture"
+	"github.com/adamdrake/go_proxy/internal/dnscache"
+	"github.com/adamdrake/go_proxy/internal/export"
+	"github.com/adamdrake/go_proxy/internal/geoip"
+	"github.com/adamdrake/go_proxy/internal/hostmatch"
+	"github.com/adamdrake/go_proxy/internal/rules"
+	"github.com/adamdrake/go_proxy/internal/webhook"
 	"github.com/google/uuid"
 )
 
 // Handler handles incoming proxy requests
 type Handler struct {
-	store          *capture.Store
-	httpClient     *http.Client
-	maxRequestSize int64
+	store                *capture.Store
+	pipeline             *capture.Pipeline
+	tenants              map[string]*tenantStore
+	tenantCredentials    bool
+	httpClient           *http.Client
+	maxRequestSize       int64
+	dialer               *net.Dialer
+	tlsConfig            *tls.Config
+	upstreamHTTP2        bool
+	timeouts             Timeouts
+	timeoutRules         []TimeoutRule
+	ipMode               IPMode
+	bindOutbound         BindAddr
+	bindRules            []BindRule
+	connectPorts         PortPolicy
+	connectUDPPorts      PortPolicy
+	mediaPlaceholderSize int64
+	blocklist            *blocklist.List
+	parties              *Parties
+	bypass               *Bypass
+	warc                 *export.WARCWriter
+	geoip                *geoip.DB
+	rdns                 *reverseDNS
+	certProbe            *certProbe
+	captureRaw           bool
+	preserveHeaderOrder  bool
+	faithful             bool
+	correlationHeader    string
+	attach304Bodies      bool
+	uploads              *uploadSpool
+	scanPII              bool
+	scanSecrets          bool
+	blockSecrets         bool
+	notifier             *webhook.Notifier
+	anomalies            *anomaly.Detector
+	crawl                *crawler
+	clientCerts          []ClientCertRule
+	addHeaders           []HeaderValue
+	removeHeaders        []string
+	retry                RetryPolicy
+	circuits             *CircuitBreakers
+	dnsCache             *dnscache.Cache
+	rules                *rules.Engine
+	websockets           *WebSockets
+	session              atomic.Pointer[string]
+	tunnels              atomic.Int64
+	pool                 *ConnPool
 }
 
 // NewHandler creates a new request handler
-func NewHandler(store *capture.Store, maxRequestSize int64) *Handler {
+func NewHandler(store *capture.Store, config Config) *Handler {
+	h := &Handler{
+		store:          store,
+		pipeline:       capture.NewPipeline(store, config.CaptureWorkers, config.CaptureQueueSize),
+		maxRequestSize: config.MaxRequestSize,
+		pool:           newConnPool(),
+		dialer: &net.Dialer{
+			KeepAlive: 30 * time.Second,
+		},
+		timeouts:             DefaultTimeouts(),
+		timeoutRules:         config.TimeoutRules,
+		ipMode:               config.IPMode,
+		bindOutbound:         config.BindOutbound,
+		bindRules:            config.BindRules,
+		connectPorts:         config.ConnectPorts,
+		connectUDPPorts:      config.ConnectUDPPorts,
+		mediaPlaceholderSize: config.MediaPlaceholderSize,
+		blocklist:            config.Blocklist,
+		parties:              NewParties(config.FirstParty, config.BlockThirdParty),
+		bypass:               config.Bypass,
+		warc:                 config.WARC,
+		geoip:                config.GeoIP,
+		captureRaw:           config.CaptureRaw,
+		preserveHeaderOrder:  config.PreserveHeaderOrder || config.Faithful,
+		faithful:             config.Faithful,
+		correlationHeader:    config.CorrelationHeader,
+		attach304Bodies:      config.Attach304Bodies,
+		scanPII:              config.ScanPII,
+		scanSecrets:          config.ScanSecrets || config.BlockSecrets,
+		blockSecrets:         config.BlockSecrets,
+		notifier:             config.Notifier,
+		anomalies:            config.Anomalies,
+		uploads:              newUploadSpool(config.UploadSpoolSize, config.UploadDir, config.UploadRetention, config.CaptureKey),
+		clientCerts:          config.ClientCerts,
+		addHeaders:           config.AddHeaders,
+		removeHeaders:        config.RemoveHeaders,
+		retry:                config.Retry,
+		circuits:             NewCircuitBreakers(config.CircuitBreaker),
+		rules:                rules.NewEngine(),
+		websockets:           NewWebSockets(),
+	}
+
+	h.SetSession(config.Session)
+	if h.bypass == nil {
+		h.bypass = &Bypass{mode: BypassDirect}
+	}
+	h.rules.SetDryRun(config.DryRun)
+
+	h.tenants = make(map[string]*tenantStore, len(config.Tenants))
+	for _, t := range config.Tenants {
+		store := capture.NewStore(t.MaxRequests)
+		h.tenants[t.Name] = &tenantStore{
+			Tenant:   t,
+			store:    store,
+			pipeline: capture.NewPipeline(store, config.CaptureWorkers, config.CaptureQueueSize),
+		}
+		h.tenantCredentials = h.tenantCredentials || t.Username != ""
+	}
+
+	if config.Timeouts != nil {
+		h.timeouts = h.timeouts.merge(*config.Timeouts)
+	}
+
+	h.tlsConfig = config.UpstreamTLS.clientTLSConfig()
+	h.upstreamHTTP2 = config.UpstreamHTTP2 && !config.CaptureRaw
+	if len(h.clientCerts) > 0 {
+		h.tlsConfig.GetClientCertificate = h.getClientCertificate
+	}
+
+	if config.DNSCache {
+		h.dnsCache = dnscache.New(config.DNSCacheConfig)
+	}
+	if config.ReverseDNS {
+		h.rdns = newReverseDNS()
+	}
+	if config.ProbeTunnelCerts {
+		h.certProbe = newCertProbe(h.dialTimeoutContext)
+	}
+
 	// Create an HTTP client that doesn't follow redirects
 	// (we want to capture and forward them as-is)
-	client := &http.Client{
+	// Timeouts are enforced per phase and per request; see timeouts.go
+	transport := &http.Transport{
+		DialContext:         h.recordingDialer(h.dialTimeoutContext),
+		DialTLSContext:      h.recordingDialer(h.dialTLSContext),
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 10,
+		IdleConnTimeout:     90 * time.Second,
+		DisableCompression:  config.Faithful,
+		ForceAttemptHTTP2:   h.upstreamHTTP2,
+	}
+	h.httpClient = &http.Client{
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
 			return http.ErrUseLastResponse
 		},
-		Timeout: 60 * time.Second,
-		Transport: &http.Transport{
-			MaxIdleConns:        100,
-			MaxIdleConnsPerHost: 10,
-			IdleConnTimeout:     90 * time.Second,
+		Transport: &orderedTransport{
+			base:    transport,
+			dial:    transport.DialContext,
+			dialTLS: transport.DialTLSContext,
 		},
 	}
 
-	return &Handler{
-		store:          store,
-		httpClient:     client,
-		maxRequestSize: maxRequestSize,
+	// Map-remote health checks dial like proxied requests, through the
+	// DNS cache, bind addresses, IP mode and upstream TLS settings
+	h.rules.SetHealthClient(&http.Client{Transport: &http.Transport{
+		DialContext: h.dialTimeoutContext,
+		DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return h.dialTLSContext(withHTTP1Only(ctx), network, addr)
+		},
+		MaxIdleConns:    10,
+		IdleConnTimeout: 90 * time.Second,
+	}})
+
+	if config.Crawl.Enabled() {
+		// robots.txt fetches follow redirects, as RFC 9309 asks
+		h.crawl = newCrawler(config.Crawl, &http.Client{Transport: h.httpClient.Transport})
+	}
+
+	return h
+}
+
+// record hands a finished capture to the capture pipeline. Analysis of the
+// capture runs on the pipeline worker after prepare.
+func (h *Handler) record(captured *capture.CapturedRequest, prepare func()) {
+	analyze := func() {
+		if prepare != nil {
+			prepare()
+		}
+		capture.SniffContent(captured)
+		capture.DecodeDoH(captured)
+		capture.RecordHints(captured)
+		captured.Credentials = capture.DetectCredentials(captured)
+		captured.Findings = append(capture.AnalyzeSecurity(captured), capture.AnalyzeCerts(captured)...)
+		if h.scanPII {
+			captured.PIIFindings = capture.ScanPII(captured)
+		}
+		if h.rdns != nil && captured.UpstreamIP != "" {
+			captured.UpstreamPTR = h.rdns.lookup(captured.UpstreamIP)
+		}
+		if h.geoip != nil && captured.UpstreamIP != "" {
+			info := h.geoip.Lookup(captured.UpstreamIP)
+			captured.UpstreamASN, captured.UpstreamOrg, captured.UpstreamCountry = info.ASN, info.Org, info.Country
+		}
+		if h.warc != nil {
+			if _, err := h.warc.Write(captured); err != nil {
+				log.Printf("Error writing WARC record for %s: %v", captured.URL, err)
+			}
+		}
+		if h.anomalies != nil {
+			h.anomalies.Observe(captured)
+		}
+	}
+	_, pipeline := h.tenantFor(captured.Tenant)
+	if !pipeline.Submit(captured, analyze) {
+		log.Printf("Capture queue full, dropped %s %s", captured.Method, captured.URL)
 	}
 }
 
+// Pipeline returns the background capture pipeline
+func (h *Handler) Pipeline() *capture.Pipeline {
+	return h.pipeline
+}
+
+// Circuits returns the per-host circuit breakers
+func (h *Handler) Circuits() *CircuitBreakers {
+	return h.circuits
+}
+
+// Rules returns the rule engine applied to forwarded requests
+func (h *Handler) Rules() *rules.Engine {
+	return h.rules
+}
+
+// WebSockets returns the live WebSocket connections
+func (h *Handler) WebSockets() *WebSockets {
+	return h.websockets
+}
+
+// Parties returns the first-/third-party classifier
+func (h *Handler) Parties() *Parties {
+	return h.parties
+}
+
+// Bypass returns the hosts kept out of capture
+func (h *Handler) Bypass() *Bypass {
+	return h.bypass
+}
+
+// DNSCache returns the upstream DNS cache, or nil when caching is disabled
+func (h *Handler) DNSCache() *dnscache.Cache {
+	return h.dnsCache
+}
+
+// ConnPool returns the upstream connection pool tracker
+func (h *Handler) ConnPool() *ConnPool {
+	return h.pool
+}
+
+// ActiveTunnels returns the number of CONNECT tunnels open right now
+func (h *Handler) ActiveTunnels() int64 {
+	return h.tunnels.Load()
+}
+
 // ServeHTTP implements the http.Handler interface
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Raw capture covers HTTP/1 requests; stop recording connections that
+	// carry HTTP/2 frames or are about to become tunnels
+	if c := clientWire(r); c != nil && (r.ProtoMajor != 1 || r.Method == http.MethodConnect || isConnectUDP(r)) {
+		c.stop()
+	}
+
+	tenant, ok := h.selectTenant(r)
+	if !ok {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="go_proxy"`)
+		http.Error(w, "Proxy Authentication Required", http.StatusProxyAuthRequired)
+		return
+	}
+	r = r.WithContext(withTenant(r.Context(), tenant))
+
+	// Excluded hosts never reach capture
+	if h.bypassed(w, r) {
+		return
+	}
+
 	// Handle CONNECT method for HTTPS tunneling
+	if r.Method == http.MethodConnect || isConnectUDP(r) {
+		h.tunnels.Add(1)
+		defer h.tunnels.Add(-1)
+	}
+	if isConnectUDP(r) {
+		h.handleConnectUDP(w, r)
+		return
+	}
 	if r.Method == http.MethodConnect {
+		if r.Header.Get(":protocol") != "" {
+			h.handleExtendedConnect(w, r)
+			return
+		}
 		h.handleConnect(w, r)
 		return
 	}
 
+	// Answer onboarding connectivity checks without forwarding them
+	if isCheckRequest(r) {
+		h.serveCheck(w, r)
+		return
+	}
+
 	// Handle regular HTTP requests
 	h.handleHTTP(w, r)
 }
@@ -62,25 +337,82 @@ func (h *Handler) handleHTTP(w http.ResponseWriter, r *http.Request) {
 	captured := capture.NewCapturedRequest()
 	captured.ID = uuid.New().String()
 	captured.Method = r.Method
-	captured.Host = r.Host
+	captured.SetHost(r.Host, cmp.Or(r.URL.Scheme, "http"))
 	captured.Proto = r.Proto
 	captured.IsHTTPS = false
 	captured.IsTunnel = false
 	captured.ClientAddr = r.RemoteAddr
+	if c := clientWire(r); c != nil {
+		captured.ClientConnReused = c.exchanges.Add(1) > 1
+	}
+	captured.Tags = takeTags(r.Header)
+	captured.Tenant = tenantFrom(r.Context())
+	captured.Session = h.Session()
 
 	// Build the target URL
 	targetURL := h.buildTargetURL(r)
-	captured.URL = targetURL
+	captured.URL = hostmatch.CanonicalURL(targetURL)
 	captured.Path = r.URL.Path
+	captured.Range = r.Header.Get("Range")
+
+	// Answer ads and trackers with an empty response
+	if rule, ok := h.blocked(captured, targetURL, r.Header); ok {
+		log.Printf("[HTTP] Blocked %s %s by filter %s", r.Method, targetURL, rule)
+		w.WriteHeader(http.StatusNoContent)
+		captured.StatusCode = http.StatusNoContent
+		requestHeader := r.Header
+		h.recordBlocked(captured, rule, startTime, func() {
+			captured.RequestHeaders = cloneHeaders(requestHeader)
+		})
+		return
+	}
 
-	// Copy request headers
-	captured.RequestHeaders = cloneHeaders(r.Header)
+	// Refuse third parties when only first-party traffic is allowed
+	if h.classifyParty(captured, r.Host) {
+		log.Printf("[HTTP] Blocked third-party %s %s", r.Method, targetURL)
+		http.Error(w, "Forbidden: third-party request blocked", http.StatusForbidden)
+		captured.StatusCode = http.StatusForbidden
+		requestHeader := r.Header
+		h.recordThirdPartyBlocked(captured, startTime, func() {
+			captured.RequestHeaders = cloneHeaders(requestHeader)
+		})
+		return
+	}
 
-	// Read request body if present
+	// Read request body if present; large uploads are spooled to disk
 	var requestBody []byte
-	if r.Body != nil && r.ContentLength > 0 {
-		requestBody, _ = io.ReadAll(io.LimitReader(r.Body, h.maxRequestSize))
+	var upload *capture.Upload
+	switch {
+	case h.uploads != nil && r.Body != nil && r.ContentLength != 0:
+		var err error
+		requestBody, upload, err = h.uploads.read(r.Body)
+		if err != nil {
+			h.uploadFailed(w, r, captured, startTime, err)
+			return
+		}
+		captured.RequestBody = requestBody
+		captured.Upload = upload
+		if upload != nil {
+			captured.RequestBodySHA256 = upload.SHA256
+		} else {
+			captured.RequestBodySHA256 = bodySHA256(requestBody)
+		}
+	case r.Body != nil && r.ContentLength > 0:
+		body := newHashingReader(r.Body)
+		requestBody, _ = io.ReadAll(io.LimitReader(body, h.maxRequestSize))
+		body.drain()
 		captured.RequestBody = requestBody
+		captured.RequestBodySHA256 = body.sum()
+		captured.RequestBodyTruncated = body.n > int64(len(requestBody))
+	}
+
+	// Keep the request as the client sent it
+	if c := clientWire(r); c != nil {
+		raw, truncated := c.takeRequest(r)
+		captured.RequestHeaderOrder = headerFields(raw)
+		if h.captureRaw {
+			captured.RawRequest, captured.RawTruncated = raw, truncated
+		}
 	}
 
 	// Create the outgoing request
@@ -90,38 +422,238 @@ func (h *Handler) handleHTTP(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Bad Request", http.StatusBadRequest)
 		return
 	}
+	if upload != nil {
+		defer h.uploads.done(upload)
+		if err := h.uploads.forward(outReq, upload); err != nil {
+			h.uploadFailed(w, r, captured, startTime, err)
+			return
+		}
+		defer outReq.Body.Close()
+	}
+
+	// Catch credentials leaving the device
+	if h.scanSecrets && h.checkSecrets(w, r, captured, requestBody, startTime) {
+		return
+	}
 
 	// Copy headers to outgoing request
 	copyHeaders(outReq.Header, r.Header)
 
 	// Remove hop-by-hop headers
 	removeHopByHopHeaders(outReq.Header)
+	websocket := isWebSocketUpgrade(r)
+	if websocket {
+		prepareWebSocketUpgrade(outReq.Header)
+	}
+	if h.faithful {
+		faithfulRequest(outReq, r)
+	}
+
+	h.correlate(w, r, outReq, captured)
+
+	// Apply -add-header / -remove-header rules
+	if h.dryRun() {
+		captured.RecordWouldApply(h.applyHeaderRules(outReq.Header.Clone())...)
+	} else {
+		captured.RecordActions(h.applyHeaderRules(outReq.Header)...)
+	}
+
+	// Apply rules from the rules API
+	outcome := h.rules.ApplyRequest(outReq)
+	defer outcome.Done()
+	captured.RecordActions(outcome.Actions...)
+	captured.RecordWouldApply(outcome.WouldApply...)
+	captured.Backend = outcome.Backend
+
+	// Let the dialers pick the client certificate and timeouts for the
+	// final host
+	timeouts := h.timeoutsFor(outReq.URL.Host)
+	if outcome.Timeouts != nil {
+		timeouts = timeouts.merge(timeoutsFromOverride(outcome.Timeouts))
+	}
+	ctx := withUpstreamHost(outReq.Context(), outReq.URL.Hostname())
+	if h.preserveHeaderOrder && captured.RequestHeaderOrder != nil {
+		ctx = withHeaderOrder(ctx, captured.RequestHeaderOrder)
+	}
+	if websocket {
+		ctx = withHTTP1Only(ctx)
+	}
+	outReq = outReq.WithContext(withTimeouts(ctx, timeouts))
+
+	// Crawl assist: robots.txt and per-host pacing
+	if !h.crawlGate(w, r, outReq, captured, startTime) {
+		return
+	}
+
+	// Fail fast while the host's circuit is open
+	circuitKey := circuitHost(outReq.URL.Host, outReq.URL.Scheme)
+	if err := h.circuits.Allow(circuitKey); err != nil {
+		log.Printf("[HTTP] %s %s -> circuit open, failing fast", r.Method, targetURL)
+		http.Error(w, "Service Unavailable: upstream circuit open", http.StatusServiceUnavailable)
+		captured.StatusCode = http.StatusServiceUnavailable
+		captured.Error = err.Error()
+		captured.RecordActions(capture.ActionRecord{Type: capture.ActionCircuitBreaker, Detail: "failed fast for " + circuitKey})
+		captured.Duration = time.Since(startTime)
+		requestHeader := r.Header
+		h.record(captured, func() {
+			captured.RequestHeaders = cloneHeaders(requestHeader)
+		})
+		return
+	}
 
 	// Forward the request
-	resp, err := h.httpClient.Do(outReq)
+	outReq, upstreamWire := traceUpstreamWire(outReq)
+	outReq, earlyHints := traceEarlyHints(outReq)
+	outReq, upstreamConn, releaseConn := h.pool.trace(outReq)
+	defer releaseConn()
+
+	resp, err := h.doWithRetry(outReq, captured, outcome)
+	switch {
+	case err != nil && r.Context().Err() != nil:
+		// The client gave up, which says nothing about the host
+		h.circuits.Release(circuitKey)
+	case err != nil:
+		h.circuits.Failure(circuitKey, err.Error())
+	case isUpstreamFailure(resp.StatusCode):
+		h.circuits.Failure(circuitKey, resp.Status)
+	default:
+		h.circuits.Success(circuitKey)
+	}
+	if err == nil {
+		h.crawlObserve(outReq.URL.Host, resp, captured)
+	}
 	if err != nil {
+		if r.Context().Err() != nil {
+			// The client went away; the canceled context already
+			// stopped the upstream request
+			captured.ClientAborted = true
+			captured.Duration = time.Since(startTime)
+			requestHeader := r.Header
+			h.record(captured, func() {
+				captured.RequestHeaders = cloneHeaders(requestHeader)
+			})
+			log.Printf("[HTTP] %s %s -> client aborted before response (%s)", r.Method, targetURL, captured.Duration)
+			return
+		}
 		log.Printf("Error forwarding request: %v", err)
 		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		captured.StatusCode = http.StatusBadGateway
+		captured.Error = err.Error()
+		captured.Duration = time.Since(startTime)
+		requestHeader := r.Header
+		h.record(captured, func() {
+			captured.RequestHeaders = cloneHeaders(requestHeader)
+		})
 		return
 	}
 	defer resp.Body.Close()
+	upstream, wire := upstreamWire()
+	restoreTLSState(resp, wire)
+	if upstream != nil {
+		captured.UpstreamIP = remoteIP(upstream)
+	}
+	captured.UpstreamProto = resp.Proto
+	var wait time.Duration
+	captured.UpstreamConnReused, wait = upstreamConn()
+	captured.UpstreamConnWaitMS = float64(wait.Microseconds()) / 1000
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		// Both connections stop speaking HTTP; keep the handshake only
+		if wire != nil {
+			raw, _ := wire.take()
+			captured.ResponseHeaderOrder = responseHeaderFields(raw)
+			if h.captureRaw {
+				captured.RawResponse = raw
+			}
+		}
+		if c := clientWire(r); c != nil {
+			c.stop()
+		}
+		h.relayWebSocket(w, r, resp, captured, outcome, startTime)
+		return
+	}
+
+	h.substituteMedia(resp, captured)
 
 	// Capture response
 	captured.StatusCode = resp.StatusCode
-	captured.ResponseHeaders = cloneHeaders(resp.Header)
+	captured.Hints = capture.ParseLinkHints(earlyHints(), targetURL, true)
+	captured.ContentRange = resp.Header.Get("Content-Range")
+	recordTLSState(captured, resp.TLS)
+	if resp.TLS != nil {
+		if rule := h.clientCertFor(outReq.URL.Hostname()); rule != nil {
+			captured.ClientCertIdentity = rule.Identity
+		}
+	}
 
-	// Read response body
-	responseBody, err := io.ReadAll(io.LimitReader(resp.Body, h.maxRequestSize))
-	if err != nil {
+	// Bodies are relayed as they arrive, unless a rewrite rule needs the
+	// whole body; partial content is never rewritten
+	received := newHashingReader(resp.Body)
+	if resp.StatusCode == http.StatusPartialContent || !rewritesBody(resp.Header, outcome) {
+		h.streamResponse(w, r, resp, received, nil, wire, outcome, captured, startTime)
+		return
+	}
+
+	// Read response body; one too large to keep whole is relayed
+	// unchanged
+	responseBody, err := io.ReadAll(io.LimitReader(received, h.maxRequestSize+1))
+	if err == nil && int64(len(responseBody)) > h.maxRequestSize {
+		h.streamResponse(w, r, resp, received, responseBody, wire, outcome, captured, startTime)
+		return
+	}
+	captured.ResponseBodySHA256 = received.sum()
+	upstreamFailed := err != nil && r.Context().Err() == nil
+	if upstreamFailed {
 		log.Printf("Error reading response: %v", err)
+		captured.Error = err.Error()
+	}
+	if err == nil {
+		var actions []capture.ActionRecord
+		responseBody, actions = rewriteResponseBody(resp.Header, responseBody, h.maxRequestSize, outcome)
+		captured.RecordActions(actions...)
+		dryRunResponseBody(captured, resp.Header, responseBody, h.maxRequestSize, outcome)
 	}
 	captured.ResponseBody = responseBody
+	if wire != nil {
+		raw, truncated := wire.take()
+		captured.ResponseHeaderOrder = responseHeaderFields(raw)
+		if h.captureRaw {
+			captured.RawResponse = raw
+			captured.RawTruncated = captured.RawTruncated || truncated
+		}
+	}
+	captured.RecordActions(outcome.RelaxResponse(r.Header, resp.Header)...)
+	captured.RecordActions(outcome.RewriteSetCookies(resp.Header)...)
+	captured.RecordActions(outcome.RewriteHeaders(resp.Header)...)
+	dryRunResponseHeaders(captured, r.Header, resp.Header, outcome)
 
 	// Calculate duration
 	captured.Duration = time.Since(startTime)
 
-	// Store the captured request
-	h.store.Add(captured)
+	// Headers are cloned on the capture worker
+	requestHeader, responseHeader := r.Header, resp.Header
+	store := func() {
+		h.record(captured, func() {
+			captured.RequestHeaders = cloneHeaders(requestHeader)
+			captured.ResponseHeaders = cloneHeaders(responseHeader)
+			h.linkNotModified(captured)
+		})
+	}
+
+	// If the client disconnected mid-response, keep what was received and
+	// don't write to the dead connection
+	if r.Context().Err() != nil {
+		captured.ClientAborted = true
+		store()
+		log.Printf("[HTTP] %s %s -> %d client aborted after %d bytes (%s)", r.Method, targetURL, resp.StatusCode, len(responseBody), captured.Duration)
+		return
+	}
+
+	// Don't pass a cut-off body on as if it were whole
+	if upstreamFailed {
+		store()
+		panic(http.ErrAbortHandler)
+	}
 
 	// Log the request
 	log.Printf("[HTTP] %s %s -> %d (%s)", r.Method, targetURL, resp.StatusCode, captured.Duration)
@@ -129,12 +661,21 @@ func (h *Handler) handleHTTP(w http.ResponseWriter, r *http.Request) {
 	// Copy response headers to client
 	copyHeaders(w.Header(), resp.Header)
 	removeHopByHopHeaders(w.Header())
+	if captured.CorrelationID != "" {
+		// Replace any copy the upstream echoed back
+		w.Header().Set(h.correlationHeader, captured.CorrelationID)
+	}
 
 	// Write status code
 	w.WriteHeader(resp.StatusCode)
 
 	// Write response body
-	w.Write(responseBody)
+	if _, err := w.Write(responseBody); err != nil {
+		captured.ClientAborted = true
+	}
+
+	// Store the captured request
+	store()
 }
 
 // buildTargetURL constructs the target URL from the request
@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+	"github.com/adamdrake/go_proxy/internal/rules"
+)
+
+// BenchmarkHandlerForward measures a forwarded HTTP request through the
+// handler without the client-side network hop
+func BenchmarkHandlerForward(b *testing.B) {
+	body := strings.Repeat("x", 4096)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, body)
+	}))
+	defer upstream.Close()
+
+	// Keep request logging out of the results
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	config := DefaultConfig()
+	config.CaptureQueueSize = 100000
+	handler := NewHandler(capture.NewStore(10000), config)
+	defer handler.Pipeline().Close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			req := httptest.NewRequest(http.MethodGet, upstream.URL+"/bench", nil)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK {
+				b.Fatalf("unexpected status %d", rec.Code)
+			}
+		}
+	})
+}
+
+func TestMapRemoteFailsOver(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.Path)
+	}))
+	defer upstream.Close()
+	dead := httptest.NewServer(http.NotFoundHandler())
+	dead.Close()
+
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	config := DefaultConfig()
+	config.Retry = RetryPolicy{}
+	store := capture.NewStore(10)
+	handler := NewHandler(store, config)
+	defer handler.Pipeline().Close()
+	rule, err := handler.Rules().Add(rules.Rule{
+		Enabled:   true,
+		Match:     rules.Match{Host: "backend.test"},
+		MapRemote: &rules.MapRemote{Backends: []string{dead.URL + "/v1", upstream.URL + "/v2"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://backend.test/path", nil))
+		if rec.Code != http.StatusOK || rec.Body.String() != "/v2/path" {
+			t.Fatalf("request %d: %d %q", i, rec.Code, rec.Body.String())
+		}
+	}
+
+	got, _ := handler.Rules().Get(rule.ID)
+	if health := got.MapRemote.Health; health[0].Healthy || health[0].LastError == "" || !health[1].Healthy {
+		t.Fatalf("backend health %+v, want the refusing backend down", health)
+	}
+}
@@ -0,0 +1,50 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+)
+
+// hashingReader computes the SHA-256 of everything read through it
+type hashingReader struct {
+	r    io.Reader
+	hash hash.Hash
+	n    int64
+}
+
+func newHashingReader(r io.Reader) *hashingReader {
+	return &hashingReader{r: r, hash: sha256.New()}
+}
+
+func (h *hashingReader) Read(p []byte) (int, error) {
+	n, err := h.r.Read(p)
+	h.hash.Write(p[:n])
+	h.n += int64(n)
+	return n, err
+}
+
+// drain reads the rest of the stream so the hash covers all of it, even
+// past the part kept for the capture
+func (h *hashingReader) drain() error {
+	_, err := io.Copy(io.Discard, h)
+	return err
+}
+
+// sum returns the hex SHA-256 of what was read, or "" if nothing was
+func (h *hashingReader) sum() string {
+	if h.n == 0 {
+		return ""
+	}
+	return hex.EncodeToString(h.hash.Sum(nil))
+}
+
+// bodySHA256 returns the hex SHA-256 of a body, or "" if it is empty
+func bodySHA256(body []byte) string {
+	if len(body) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,222 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"strconv"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+)
+
+// headerOrderKey carries the client's header order in outgoing request
+// contexts
+type headerOrderKey struct{}
+
+// withHeaderOrder asks the transport to send a request's headers in the
+// order and case of fields
+func withHeaderOrder(ctx context.Context, fields []capture.HeaderField) context.Context {
+	return context.WithValue(ctx, headerOrderKey{}, fields)
+}
+
+// headerOrderFrom returns the header order requested for ctx, if any
+func headerOrderFrom(ctx context.Context) []capture.HeaderField {
+	fields, _ := ctx.Value(headerOrderKey{}).([]capture.HeaderField)
+	return fields
+}
+
+// orderedTransport writes HTTP/1.1 requests itself when their context
+// carries a header order, since net/http sends headers sorted and in
+// canonical case. Ordered requests get a fresh connection each, closed
+// with the response; everything else goes to the pooled base transport.
+type orderedTransport struct {
+	base    http.RoundTripper
+	dial    func(context.Context, string, string) (net.Conn, error)
+	dialTLS func(context.Context, string, string) (net.Conn, error)
+}
+
+func (t *orderedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	order := headerOrderFrom(req.Context())
+	if order == nil || (req.URL.Scheme != "http" && req.URL.Scheme != "https") {
+		return t.base.RoundTrip(req)
+	}
+	if req.Body != nil {
+		defer req.Body.Close()
+	}
+
+	ctx := req.Context()
+	dial, port := t.dial, "80"
+	if req.URL.Scheme == "https" {
+		dial, port = t.dialTLS, "443"
+	}
+	if p := req.URL.Port(); p != "" {
+		port = p
+	}
+	conn, err := dial(withHTTP1Only(ctx), "tcp", net.JoinHostPort(req.URL.Hostname(), port))
+	if err != nil {
+		return nil, err
+	}
+	if trace := httptrace.ContextClientTrace(ctx); trace != nil && trace.GotConn != nil {
+		trace.GotConn(httptrace.GotConnInfo{Conn: conn})
+	}
+
+	// Cancellation and timeouts reach the exchange by closing the
+	// connection under it
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	fail := func(err error) (*http.Response, error) {
+		stop()
+		conn.Close()
+		return nil, err
+	}
+
+	bw := bufio.NewWriter(conn)
+	if err := writeOrderedRequest(bw, req, order); err != nil {
+		return fail(err)
+	}
+	if err := bw.Flush(); err != nil {
+		return fail(err)
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	for err == nil && resp.StatusCode < 200 && resp.StatusCode != http.StatusSwitchingProtocols {
+		// Interim responses are not forwarded
+		resp.Body.Close()
+		resp, err = http.ReadResponse(br, req)
+	}
+	if err != nil {
+		return fail(err)
+	}
+
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		resp.Body = &orderedUpgrade{Reader: br, conn: conn, stop: stop}
+	} else {
+		resp.Body = &orderedBody{ReadCloser: resp.Body, conn: conn, stop: stop}
+	}
+	return resp, nil
+}
+
+// writeOrderedRequest writes req as HTTP/1.1 (or HTTP/1.0, if req asks
+// for it) with its header lines in the order and case of fields. Values
+// come from req.Header, so rules and hop-by-hop removal still apply:
+// fields no longer present are dropped, and headers the client did not
+// send follow in sorted order.
+func writeOrderedRequest(w *bufio.Writer, req *http.Request, fields []capture.HeaderField) error {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	length := ""
+	if req.ContentLength > 0 {
+		length = strconv.FormatInt(req.ContentLength, 10)
+	}
+	connection := "close"
+	if v := req.Header.Get("Connection"); v != "" {
+		connection = v
+	}
+
+	proto := "HTTP/1.1"
+	if req.ProtoMajor == 1 && req.ProtoMinor == 0 {
+		proto = "HTTP/1.0"
+	}
+	fmt.Fprintf(w, "%s %s %s\r\n", req.Method, req.URL.RequestURI(), proto)
+
+	used := make(map[string]int)
+	var sentHost, sentLength, sentConnection bool
+	for _, f := range fields {
+		switch key := http.CanonicalHeaderKey(f.Name); key {
+		case "Host":
+			if !sentHost {
+				fmt.Fprintf(w, "%s: %s\r\n", f.Name, host)
+				sentHost = true
+			}
+		case "Content-Length":
+			if !sentLength && req.ContentLength >= 0 {
+				fmt.Fprintf(w, "%s: %d\r\n", f.Name, max(req.ContentLength, 0))
+				sentLength = true
+			}
+		case "Connection":
+			if !sentConnection {
+				fmt.Fprintf(w, "%s: %s\r\n", f.Name, connection)
+				sentConnection = true
+			}
+		case "Transfer-Encoding":
+			// The body is forwarded with a length
+		default:
+			values := req.Header[key]
+			if i := used[key]; i < len(values) {
+				fmt.Fprintf(w, "%s: %s\r\n", f.Name, values[i])
+				used[key] = i + 1
+			}
+		}
+	}
+
+	if !sentHost {
+		fmt.Fprintf(w, "Host: %s\r\n", host)
+	}
+	keys := make([]string, 0, len(req.Header))
+	for key := range req.Header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		switch key {
+		case "Host", "Content-Length", "Connection", "Transfer-Encoding":
+			continue
+		}
+		for _, v := range req.Header[key][used[key]:] {
+			fmt.Fprintf(w, "%s: %s\r\n", key, v)
+		}
+	}
+	if !sentLength && length != "" {
+		fmt.Fprintf(w, "Content-Length: %s\r\n", length)
+	}
+	if !sentConnection {
+		fmt.Fprintf(w, "Connection: %s\r\n", connection)
+	}
+	w.WriteString("\r\n")
+
+	if req.Body != nil && req.ContentLength > 0 {
+		if _, err := io.CopyN(w, req.Body, req.ContentLength); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// orderedBody closes an ordered request's connection with its response
+// body
+type orderedBody struct {
+	io.ReadCloser
+	conn net.Conn
+	stop func() bool
+}
+
+func (b *orderedBody) Close() error {
+	b.stop()
+	err := b.ReadCloser.Close()
+	b.conn.Close()
+	return err
+}
+
+// orderedUpgrade is the read-write body of a 101 response to an ordered
+// request, as the websocket relay expects
+type orderedUpgrade struct {
+	*bufio.Reader
+	conn net.Conn
+	stop func() bool
+}
+
+func (u *orderedUpgrade) Write(p []byte) (int, error) {
+	return u.conn.Write(p)
+}
+
+func (u *orderedUpgrade) Close() error {
+	u.stop()
+	return u.conn.Close()
+}
@@ -0,0 +1,45 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+)
+
+// HeaderValue is a single header to inject into forwarded requests
+type HeaderValue struct {
+	Name  string
+	Value string
+}
+
+// ParseHeaderValue parses a "Name: value" header specification
+func ParseHeaderValue(s string) (HeaderValue, error) {
+	name, value, ok := strings.Cut(s, ":")
+	name = strings.TrimSpace(name)
+	if !ok || name == "" {
+		return HeaderValue{}, fmt.Errorf("header %q must be of the form 'Name: value'", s)
+	}
+	return HeaderValue{
+		Name:  http.CanonicalHeaderKey(name),
+		Value: strings.TrimSpace(value),
+	}, nil
+}
+
+// applyHeaderRules strips and injects the globally configured headers on an
+// outgoing request. Removals run first so a header can be replaced.
+func (h *Handler) applyHeaderRules(header http.Header) []capture.ActionRecord {
+	var actions []capture.ActionRecord
+	for _, name := range h.removeHeaders {
+		if _, ok := header[http.CanonicalHeaderKey(name)]; ok {
+			header.Del(name)
+			actions = append(actions, capture.ActionRecord{Type: capture.ActionHeader, Detail: "removed " + http.CanonicalHeaderKey(name)})
+		}
+	}
+	for _, add := range h.addHeaders {
+		header.Set(add.Name, add.Value)
+		actions = append(actions, capture.ActionRecord{Type: capture.ActionHeader, Detail: "set " + add.Name})
+	}
+	return actions
+}
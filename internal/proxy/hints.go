@@ -0,0 +1,31 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"sync"
+)
+
+// traceEarlyHints collects the Link headers of 103 Early Hints responses
+// to req. The returned function reports them.
+func traceEarlyHints(req *http.Request) (*http.Request, func() []string) {
+	var mu sync.Mutex
+	var links []string
+	trace := &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			if code == http.StatusEarlyHints {
+				mu.Lock()
+				links = append(links, header.Values("Link")...)
+				mu.Unlock()
+			}
+			return nil
+		},
+	}
+	ctx := httptrace.WithClientTrace(req.Context(), trace)
+	return req.WithContext(ctx), func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return links
+	}
+}
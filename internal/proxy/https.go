@@ -5,6 +5,7 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/adamdrake/go_proxy/internal/capture"
@@ -21,13 +22,16 @@ func (h *Handler) handleConnect(w http.ResponseWriter, r *http.Request) {
 	captured := capture.NewCapturedRequest()
 	captured.ID = uuid.New().String()
 	captured.Method = "CONNECT"
-	captured.Host = r.Host
-	captured.URL = "https://" + r.Host
+	captured.SetHost(r.Host, "https")
+	captured.URL = "https://" + captured.Host
 	captured.Path = ""
 	captured.Proto = r.Proto
 	captured.IsHTTPS = true
 	captured.IsTunnel = true
 	captured.ClientAddr = r.RemoteAddr
+	captured.Tags = takeTags(r.Header)
+	captured.Tenant = tenantFrom(r.Context())
+	captured.Session = h.Session()
 	captured.RequestHeaders = cloneHeaders(r.Header)
 
 	// Parse host and port
@@ -37,17 +41,79 @@ func (h *Handler) handleConnect(w http.ResponseWriter, r *http.Request) {
 		host = net.JoinHostPort(host, "443")
 	}
 
+	// Enforce the CONNECT port policy so the proxy can't be used as an
+	// arbitrary TCP relay
+	_, portStr, _ := net.SplitHostPort(host)
+	if port, err := strconv.Atoi(portStr); err != nil || !h.connectPorts.Allows(port) {
+		log.Printf("[CONNECT] Blocked tunnel to %s: port not allowed", host)
+		http.Error(w, "Forbidden: CONNECT to this port is not allowed", http.StatusForbidden)
+		captured.StatusCode = http.StatusForbidden
+		captured.Blocked = true
+		captured.BlockReason = "connect port " + portStr + " not allowed"
+		captured.RecordActions(capture.ActionRecord{Type: capture.ActionBlock, Detail: captured.BlockReason})
+		captured.Duration = time.Since(startTime)
+		h.record(captured, nil)
+		return
+	}
+
+	// Drop tunnels to ad and tracker hosts
+	hostname, _, _ := net.SplitHostPort(host)
+	if rule, ok := h.blocked(captured, "https://"+hostname+"/", r.Header); ok {
+		log.Printf("[CONNECT] Blocked tunnel to %s by filter %s", host, rule)
+		closeBlocked(w)
+		h.recordBlocked(captured, rule, startTime, nil)
+		return
+	}
+	if h.classifyParty(captured, hostname) {
+		log.Printf("[CONNECT] Blocked third-party tunnel to %s", host)
+		closeBlocked(w)
+		h.recordThirdPartyBlocked(captured, startTime, nil)
+		return
+	}
+
+	// Fail fast while the host's circuit is open
+	if err := h.circuits.Allow(host); err != nil {
+		log.Printf("[CONNECT] Circuit open for %s, failing fast", host)
+		http.Error(w, "Service Unavailable: upstream circuit open", http.StatusServiceUnavailable)
+		captured.StatusCode = http.StatusServiceUnavailable
+		captured.Error = err.Error()
+		captured.RecordActions(capture.ActionRecord{Type: capture.ActionCircuitBreaker, Detail: "failed fast for " + host})
+		captured.Duration = time.Since(startTime)
+		h.record(captured, nil)
+		return
+	}
+
 	// Connect to the target server
-	targetConn, err := net.DialTimeout("tcp", host, 30*time.Second)
+	dialCtx := withTimeouts(r.Context(), h.timeoutsFor(host))
+	targetConn, err := h.dialTimeoutContext(dialCtx, "tcp", host)
 	if err != nil {
+		if r.Context().Err() != nil {
+			h.circuits.Release(host)
+		} else {
+			h.circuits.Failure(host, err.Error())
+		}
+		captured.Error = err.Error()
 		log.Printf("[CONNECT] Failed to connect to %s: %v", host, err)
 		http.Error(w, "Bad Gateway", http.StatusBadGateway)
 		captured.StatusCode = http.StatusBadGateway
 		captured.Duration = time.Since(startTime)
-		h.store.Add(captured)
+		h.record(captured, nil)
 		return
 	}
 	defer targetConn.Close()
+	h.circuits.Success(host)
+	captured.UpstreamIP = remoteIP(targetConn)
+
+	// The tunnel's TLS is opaque; fetch the certificate separately
+	var waitCerts func()
+	if h.certProbe != nil {
+		waitCerts = h.certProbe.start(captured, hostname, host)
+	}
+
+	if r.ProtoMajor == 2 {
+		h.tunnelStream(w, r, targetConn, captured, startTime, waitCerts)
+		return
+	}
 
 	// Hijack the client connection
 	hijacker, ok := w.(http.Hijacker)
@@ -56,7 +122,7 @@ func (h *Handler) handleConnect(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		captured.StatusCode = http.StatusInternalServerError
 		captured.Duration = time.Since(startTime)
-		h.store.Add(captured)
+		h.record(captured, nil)
 		return
 	}
 
@@ -66,7 +132,7 @@ func (h *Handler) handleConnect(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		captured.StatusCode = http.StatusInternalServerError
 		captured.Duration = time.Since(startTime)
-		h.store.Add(captured)
+		h.record(captured, nil)
 		return
 	}
 	defer clientConn.Close()
@@ -77,7 +143,7 @@ func (h *Handler) handleConnect(w http.ResponseWriter, r *http.Request) {
 		log.Printf("[CONNECT] Failed to send 200 response: %v", err)
 		captured.StatusCode = http.StatusInternalServerError
 		captured.Duration = time.Since(startTime)
-		h.store.Add(captured)
+		h.record(captured, nil)
 		return
 	}
 
@@ -88,14 +154,16 @@ func (h *Handler) handleConnect(w http.ResponseWriter, r *http.Request) {
 	// Create a channel to track when piping is done
 	done := make(chan struct{}, 2)
 
-	// Pipe data between client and target (bidirectional)
+	// Pipe data between client and target (bidirectional), watching
+	// for plaintext MQTT
+	mqtt := &mqttTap{}
 	go func() {
-		io.Copy(targetConn, clientConn)
+		io.Copy(&countingWriter{w: targetConn, observe: mqtt.fromClient}, clientConn)
 		done <- struct{}{}
 	}()
 
 	go func() {
-		io.Copy(clientConn, targetConn)
+		io.Copy(&countingWriter{w: clientConn, observe: mqtt.fromServer}, targetConn)
 		done <- struct{}{}
 	}()
 
@@ -104,7 +172,8 @@ func (h *Handler) handleConnect(w http.ResponseWriter, r *http.Request) {
 
 	// Calculate final duration
 	captured.Duration = time.Since(startTime)
-	h.store.Add(captured)
+	captured.MQTT = mqtt.result()
+	h.record(captured, waitCerts)
 
 	log.Printf("[CONNECT] Tunnel closed to %s (duration: %s)", r.Host, captured.Duration)
 }
@@ -0,0 +1,288 @@
+package proxy
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+	"github.com/adamdrake/go_proxy/internal/rules"
+)
+
+// Mail forwards understand enough SMTP and IMAP to record the plaintext
+// part of a session: commands, replies and SMTP envelopes. Traffic is
+// relayed unchanged; recording stops once STARTTLS succeeds. Credentials
+// are always redacted and message bodies are redacted unless enabled.
+
+// Mail protocols a forward can decode
+const (
+	MailSMTP = "smtp"
+	MailIMAP = "imap"
+)
+
+// maxMailLines caps the transcript kept for one session
+const maxMailLines = 500
+
+// maxMailLine caps a single buffered line
+const maxMailLine = 8 * 1024
+
+// mailTap observes both directions of a mail session
+type mailTap struct {
+	protocol     string
+	keepBodies   bool
+	maxBodyBytes int
+
+	mu      sync.Mutex
+	session capture.MailSession
+	client  lineSplitter
+	server  lineSplitter
+
+	// encrypted is set once STARTTLS succeeds
+	encrypted bool
+	// startTLSTag is the pending STARTTLS command ("" for SMTP, the tag for
+	// IMAP), valid while startTLS is set
+	startTLS    bool
+	startTLSTag string
+	// authPending redacts client lines during an AUTH exchange
+	authPending bool
+	authTag     string
+
+	// SMTP state
+	inData   bool
+	dataSent bool
+	envelope *capture.MailEnvelope
+	body     bytes.Buffer
+}
+
+func newMailTap(protocol string, keepBodies bool, maxBodyBytes int) *mailTap {
+	t := &mailTap{protocol: protocol, keepBodies: keepBodies, maxBodyBytes: maxBodyBytes}
+	t.client.onLine = t.clientLine
+	t.server.onLine = t.serverLine
+	return t
+}
+
+// fromClient and fromServer observe bytes relayed in each direction
+func (t *mailTap) fromClient(p []byte) { t.feed(&t.client, p) }
+func (t *mailTap) fromServer(p []byte) { t.feed(&t.server, p) }
+
+func (t *mailTap) feed(s *lineSplitter, p []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.encrypted {
+		s.write(p)
+	}
+}
+
+// result returns the recorded session
+func (t *mailTap) result() *capture.MailSession {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.flushEnvelope()
+	session := t.session
+	session.StartTLS = t.encrypted
+	return &session
+}
+
+func (t *mailTap) record(direction, line string) {
+	if len(t.session.Transcript) < maxMailLines {
+		t.session.Transcript = append(t.session.Transcript, capture.MailLine{Direction: direction, Line: line})
+	}
+}
+
+func (t *mailTap) clientLine(line string) {
+	if t.protocol == MailSMTP {
+		t.smtpClientLine(line)
+	} else {
+		t.imapClientLine(line)
+	}
+}
+
+func (t *mailTap) serverLine(line string) {
+	if t.protocol == MailSMTP {
+		t.smtpServerLine(line)
+	} else {
+		t.imapServerLine(line)
+	}
+}
+
+func (t *mailTap) smtpClientLine(line string) {
+	if t.inData {
+		if line == "." {
+			t.inData = false
+			t.record(rules.Upstream, ".")
+			t.flushEnvelope()
+			return
+		}
+		if t.envelope != nil {
+			t.envelope.Size += len(line) + 2
+			if t.keepBodies && t.body.Len() < t.maxBodyBytes {
+				t.body.WriteString(strings.TrimPrefix(line, "."))
+				t.body.WriteString("\r\n")
+			}
+		}
+		return
+	}
+	if t.authPending {
+		t.record(rules.Upstream, "[redacted]")
+		return
+	}
+
+	verb, arg, _ := strings.Cut(line, " ")
+	switch strings.ToUpper(verb) {
+	case "AUTH":
+		mech, _, hasResponse := strings.Cut(arg, " ")
+		if hasResponse {
+			line = verb + " " + mech + " [redacted]"
+		}
+		t.authPending = true
+	case "MAIL":
+		t.flushEnvelope()
+		t.envelope = &capture.MailEnvelope{From: smtpPath(arg)}
+	case "RCPT":
+		if t.envelope != nil {
+			t.envelope.To = append(t.envelope.To, smtpPath(arg))
+		}
+	case "DATA":
+		t.dataSent = true
+	case "STARTTLS":
+		t.startTLS = true
+	}
+	t.record(rules.Upstream, line)
+}
+
+func (t *mailTap) smtpServerLine(line string) {
+	t.record(rules.Downstream, line)
+
+	// Only the last line of a multi-line reply ("250 OK" vs "250-...")
+	// completes it
+	if len(line) < 3 || (len(line) > 3 && line[3] == '-') {
+		return
+	}
+	code := line[:3]
+	switch {
+	case t.authPending && code != "334":
+		t.authPending = false
+	case t.dataSent:
+		t.dataSent = false
+		t.inData = code == "354"
+	case t.startTLS:
+		t.startTLS = false
+		t.encrypted = code == "220"
+	}
+}
+
+// smtpPath extracts the address from "FROM:<a@b> SIZE=..."
+func smtpPath(arg string) string {
+	if i := strings.IndexByte(arg, '<'); i >= 0 {
+		if j := strings.IndexByte(arg[i:], '>'); j >= 0 {
+			return arg[i+1 : i+j]
+		}
+	}
+	_, addr, _ := strings.Cut(arg, ":")
+	return strings.TrimSpace(addr)
+}
+
+// flushEnvelope finishes the current SMTP message
+func (t *mailTap) flushEnvelope() {
+	if t.envelope == nil {
+		return
+	}
+	if t.keepBodies {
+		t.envelope.Body = t.body.String()
+	} else if t.envelope.Size > 0 {
+		t.envelope.Body = "[redacted]"
+	}
+	t.session.Envelopes = append(t.session.Envelopes, *t.envelope)
+	t.envelope = nil
+	t.body.Reset()
+}
+
+func (t *mailTap) imapClientLine(line string) {
+	if t.authPending {
+		t.record(rules.Upstream, "[redacted]")
+		return
+	}
+
+	tag, rest, _ := strings.Cut(line, " ")
+	command, args, _ := strings.Cut(rest, " ")
+	switch strings.ToUpper(command) {
+	case "LOGIN":
+		user, _, _ := strings.Cut(args, " ")
+		line = tag + " " + command + " " + user + " [redacted]"
+	case "AUTHENTICATE":
+		mech, _, hasResponse := strings.Cut(args, " ")
+		if hasResponse {
+			line = tag + " " + command + " " + mech + " [redacted]"
+		}
+		t.authPending, t.authTag = true, tag
+	case "STARTTLS":
+		t.startTLS, t.startTLSTag = true, tag
+	}
+	t.record(rules.Upstream, line)
+}
+
+func (t *mailTap) imapServerLine(line string) {
+	t.record(rules.Downstream, line)
+
+	tag, rest, _ := strings.Cut(line, " ")
+	status, _, _ := strings.Cut(rest, " ")
+	switch {
+	case t.authPending && tag == t.authTag:
+		t.authPending = false
+	case t.startTLS && tag == t.startTLSTag:
+		t.startTLS = false
+		t.encrypted = strings.EqualFold(status, "OK")
+	}
+}
+
+// lineSplitter turns a byte stream into CRLF-terminated lines, skipping
+// IMAP literals ("{123}" at the end of a line announces 123 raw bytes)
+type lineSplitter struct {
+	onLine func(string)
+	buf    []byte
+	skip   int
+}
+
+func (s *lineSplitter) write(p []byte) {
+	for len(p) > 0 {
+		if s.skip > 0 {
+			n := min(s.skip, len(p))
+			s.skip -= n
+			p = p[n:]
+			continue
+		}
+
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			if len(s.buf) < maxMailLine {
+				s.buf = append(s.buf, p...)
+			}
+			return
+		}
+		s.buf = append(s.buf, p[:i]...)
+		p = p[i+1:]
+
+		line := string(bytes.TrimSuffix(s.buf, []byte("\r")))
+		s.buf = s.buf[:0]
+		s.skip = literalSize(line)
+		s.onLine(line)
+	}
+}
+
+// literalSize returns n for a line ending in an IMAP literal {n} or {n+}
+func literalSize(line string) int {
+	if !strings.HasSuffix(line, "}") {
+		return 0
+	}
+	i := strings.LastIndexByte(line, '{')
+	if i < 0 {
+		return 0
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(line[i+1:len(line)-1], "+"))
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
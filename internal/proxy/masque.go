@@ -0,0 +1,303 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+	"github.com/google/uuid"
+)
+
+// CONNECT-UDP (RFC 9298) lets clients such as HTTP/3 apps send UDP through
+// the proxy. Datagrams travel inside DATAGRAM capsules (RFC 9297) on an
+// HTTP/1.1 upgraded connection or an HTTP/2 extended CONNECT stream. The
+// proxy sees only the encrypted QUIC packets, so captures record the target
+// and byte counts.
+
+// masqueUDPPrefix is the path prefix of the default URI template,
+// /.well-known/masque/udp/{target_host}/{target_port}/
+const masqueUDPPrefix = "/.well-known/masque/udp/"
+
+// capsuleDatagram is the DATAGRAM capsule type
+const capsuleDatagram = 0x00
+
+// maxUDPPayload bounds datagrams read from capsules and upstream sockets
+const maxUDPPayload = 65527
+
+// isConnectUDP reports whether r asks to proxy UDP, either as an HTTP/1.1
+// upgrade or as HTTP/2 extended CONNECT
+func isConnectUDP(r *http.Request) bool {
+	if !strings.HasPrefix(r.URL.Path, masqueUDPPrefix) {
+		return false
+	}
+	if r.Method == http.MethodConnect {
+		return r.Header.Get(":protocol") == "connect-udp"
+	}
+	return r.Method == http.MethodGet && strings.EqualFold(r.Header.Get("Upgrade"), "connect-udp")
+}
+
+// parseMasqueTarget extracts host:port from a CONNECT-UDP request path
+func parseMasqueTarget(path string) (string, error) {
+	parts := strings.Split(strings.TrimPrefix(path, masqueUDPPrefix), "/")
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return "", fmt.Errorf("CONNECT-UDP path must be %s{host}/{port}/", masqueUDPPrefix)
+	}
+	// IPv6 literals arrive with their colons percent-encoded
+	host, err := url.PathUnescape(parts[0])
+	if err != nil {
+		return "", fmt.Errorf("invalid CONNECT-UDP host: %w", err)
+	}
+	port, err := strconv.Atoi(parts[1])
+	if err != nil || port < 1 || port > 65535 {
+		return "", fmt.Errorf("invalid CONNECT-UDP port %q", parts[1])
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port)), nil
+}
+
+// readVarint reads a QUIC variable-length integer (RFC 9000 section 16)
+func readVarint(r io.ByteReader) (uint64, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	v := uint64(b & 0x3f)
+	for n := 1<<(b>>6) - 1; n > 0; n-- {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, io.ErrUnexpectedEOF
+		}
+		v = v<<8 | uint64(b)
+	}
+	return v, nil
+}
+
+// appendVarint appends v as a QUIC variable-length integer
+func appendVarint(b []byte, v uint64) []byte {
+	switch {
+	case v < 1<<6:
+		return append(b, byte(v))
+	case v < 1<<14:
+		return append(b, byte(v>>8)|0x40, byte(v))
+	case v < 1<<30:
+		return append(b, byte(v>>24)|0x80, byte(v>>16), byte(v>>8), byte(v))
+	default:
+		return append(b, byte(v>>56)|0xc0, byte(v>>48), byte(v>>40), byte(v>>32),
+			byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+	}
+}
+
+// readDatagram returns the UDP payload of the next DATAGRAM capsule,
+// skipping other capsule types and context IDs other than 0
+func readDatagram(r *bufio.Reader) ([]byte, error) {
+	for {
+		typ, err := readVarint(r)
+		if err != nil {
+			return nil, err
+		}
+		length, err := readVarint(r)
+		if err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if length > maxUDPPayload+8 {
+			return nil, fmt.Errorf("capsule of %d bytes exceeds limit", length)
+		}
+		value := make([]byte, length)
+		if _, err := io.ReadFull(r, value); err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if typ != capsuleDatagram {
+			continue
+		}
+
+		vr := bytes.NewReader(value)
+		contextID, err := readVarint(vr)
+		if err != nil || contextID != 0 {
+			continue
+		}
+		return value[len(value)-vr.Len():], nil
+	}
+}
+
+// writeDatagram writes payload as a DATAGRAM capsule with context ID 0
+func writeDatagram(w io.Writer, payload []byte) error {
+	buf := appendVarint(make([]byte, 0, len(payload)+10), capsuleDatagram)
+	buf = appendVarint(buf, uint64(len(payload)+1))
+	buf = append(buf, 0) // context ID
+	buf = append(buf, payload...)
+	_, err := w.Write(buf)
+	return err
+}
+
+// handleConnectUDP proxies UDP datagrams between the client and a target
+func (h *Handler) handleConnectUDP(w http.ResponseWriter, r *http.Request) {
+	startTime := time.Now()
+
+	captured := capture.NewCapturedRequest()
+	captured.ID = uuid.New().String()
+	captured.Method = "CONNECT-UDP"
+	captured.Proto = r.Proto
+	captured.Path = r.URL.Path
+	captured.IsTunnel = true
+	captured.ClientAddr = r.RemoteAddr
+	captured.Tags = takeTags(r.Header)
+	captured.Tenant = tenantFrom(r.Context())
+	captured.Session = h.Session()
+	captured.RequestHeaders = cloneHeaders(r.Header)
+
+	target, err := parseMasqueTarget(r.URL.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		captured.URL = r.URL.String()
+		captured.StatusCode = http.StatusBadRequest
+		captured.Error = err.Error()
+		captured.Duration = time.Since(startTime)
+		h.record(captured, nil)
+		return
+	}
+	captured.SetHost(target, "udp")
+	captured.URL = "udp://" + captured.Host
+
+	// UDP targets are limited like CONNECT ports so the proxy isn't an open
+	// UDP relay
+	_, portStr, _ := net.SplitHostPort(target)
+	if port, _ := strconv.Atoi(portStr); !h.connectUDPPorts.Allows(port) {
+		log.Printf("[CONNECT-UDP] Blocked %s: port not allowed", target)
+		http.Error(w, "Forbidden: CONNECT-UDP to this port is not allowed", http.StatusForbidden)
+		captured.StatusCode = http.StatusForbidden
+		captured.Blocked = true
+		captured.BlockReason = "connect-udp port " + portStr + " not allowed"
+		captured.RecordActions(capture.ActionRecord{Type: capture.ActionBlock, Detail: captured.BlockReason})
+		captured.Duration = time.Since(startTime)
+		h.record(captured, nil)
+		return
+	}
+	if h.classifyParty(captured, target) {
+		log.Printf("[CONNECT-UDP] Blocked third-party %s", target)
+		http.Error(w, "Forbidden: third-party request blocked", http.StatusForbidden)
+		captured.StatusCode = http.StatusForbidden
+		h.recordThirdPartyBlocked(captured, startTime, nil)
+		return
+	}
+
+	dialCtx := withTimeouts(r.Context(), h.timeoutsFor(target))
+	udpConn, err := h.dialTimeoutContext(dialCtx, "udp", target)
+	if err != nil {
+		log.Printf("[CONNECT-UDP] Failed to reach %s: %v", target, err)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		captured.StatusCode = http.StatusBadGateway
+		captured.Error = err.Error()
+		captured.Duration = time.Since(startTime)
+		h.record(captured, nil)
+		return
+	}
+	defer udpConn.Close()
+	captured.UpstreamIP = remoteIP(udpConn)
+
+	// Open the capsule stream with the client
+	var clientReader io.Reader
+	var clientWriter io.Writer
+	var closeClient func() error
+	if r.ProtoMajor == 2 {
+		w.Header().Set("Capsule-Protocol", "?1")
+		stream, err := openStream(w)
+		if err != nil {
+			captured.ClientAborted = true
+			captured.Duration = time.Since(startTime)
+			h.record(captured, nil)
+			return
+		}
+		captured.StatusCode = http.StatusOK
+		clientReader, clientWriter, closeClient = r.Body, stream, r.Body.Close
+	} else {
+		hijacker, ok := w.(http.Hijacker)
+		if !ok {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			captured.StatusCode = http.StatusInternalServerError
+			captured.Duration = time.Since(startTime)
+			h.record(captured, nil)
+			return
+		}
+		clientConn, clientBuf, err := hijacker.Hijack()
+		if err != nil {
+			log.Printf("[CONNECT-UDP] Failed to hijack connection: %v", err)
+			captured.StatusCode = http.StatusInternalServerError
+			captured.Error = err.Error()
+			captured.Duration = time.Since(startTime)
+			h.record(captured, nil)
+			return
+		}
+		defer clientConn.Close()
+		clientConn.SetDeadline(time.Time{})
+
+		_, err = clientConn.Write([]byte("HTTP/1.1 101 Switching Protocols\r\n" +
+			"Connection: Upgrade\r\nUpgrade: connect-udp\r\nCapsule-Protocol: ?1\r\n\r\n"))
+		if err != nil {
+			captured.ClientAborted = true
+			captured.Duration = time.Since(startTime)
+			h.record(captured, nil)
+			return
+		}
+		captured.StatusCode = http.StatusSwitchingProtocols
+		clientReader, clientWriter, closeClient = clientBuf.Reader, clientConn, clientConn.Close
+	}
+
+	log.Printf("[CONNECT-UDP] Proxying to %s over %s", target, r.Proto)
+
+	var sent, received int64
+	done := make(chan error, 2)
+	go func() {
+		br := bufio.NewReader(clientReader)
+		for {
+			payload, err := readDatagram(br)
+			if err != nil {
+				done <- err
+				return
+			}
+			// A datagram the target refuses is lost, as UDP would lose it
+			if n, err := udpConn.Write(payload); err == nil {
+				sent += int64(n)
+			}
+		}
+	}()
+	go func() {
+		buf := make([]byte, maxUDPPayload)
+		for {
+			n, err := udpConn.Read(buf)
+			if err != nil {
+				done <- err
+				return
+			}
+			if err := writeDatagram(clientWriter, buf[:n]); err != nil {
+				done <- err
+				return
+			}
+			received += int64(n)
+		}
+	}()
+
+	// The client closing its stream ends the session; closing both ends
+	// stops the other direction
+	if err := <-done; err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+		captured.Error = err.Error()
+	}
+	closeClient()
+	udpConn.Close()
+	<-done
+
+	captured.BytesSent = sent
+	captured.BytesReceived = received
+	captured.Duration = time.Since(startTime)
+	h.record(captured, nil)
+
+	log.Printf("[CONNECT-UDP] Closed %s (sent %d, received %d bytes, %s)", target, sent, received, captured.Duration)
+}
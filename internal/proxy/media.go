@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+)
+
+// Placeholder bodies for large media responses, keyed by the Content-Type
+// they are served with
+var (
+	placeholderPNG  = encodePlaceholder(func(w io.Writer, m image.Image) error { return png.Encode(w, m) })
+	placeholderGIF  = encodePlaceholder(func(w io.Writer, m image.Image) error { return gif.Encode(w, m, nil) })
+	placeholderJPEG = encodePlaceholder(func(w io.Writer, m image.Image) error { return jpeg.Encode(w, m, nil) })
+	placeholderMP4  = emptyMP4()
+)
+
+// encodePlaceholder encodes a transparent 1x1 image
+func encodePlaceholder(encode func(io.Writer, image.Image) error) []byte {
+	var b bytes.Buffer
+	encode(&b, image.NewNRGBA(image.Rect(0, 0, 1, 1)))
+	return b.Bytes()
+}
+
+// emptyMP4 builds an MP4 file with a zero-length movie and no tracks
+func emptyMP4() []byte {
+	box := func(typ string, payload []byte) []byte {
+		b := binary.BigEndian.AppendUint32(nil, uint32(8+len(payload)))
+		return append(append(b, typ...), payload...)
+	}
+
+	ftyp := box("ftyp", []byte("isom\x00\x00\x02\x00isomiso2mp41"))
+
+	mvhd := make([]byte, 100)
+	binary.BigEndian.PutUint32(mvhd[12:], 1000)       // timescale
+	binary.BigEndian.PutUint32(mvhd[20:], 0x00010000) // rate 1.0
+	binary.BigEndian.PutUint16(mvhd[24:], 0x0100)     // volume 1.0
+	for i, v := range []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000} {
+		binary.BigEndian.PutUint32(mvhd[36+4*i:], v) // identity matrix
+	}
+	binary.BigEndian.PutUint32(mvhd[96:], 1) // next track ID
+
+	return append(ftyp, box("moov", box("mvhd", mvhd))...)
+}
+
+// mediaPlaceholder returns the placeholder for a media type and the
+// Content-Type to serve it with, or false for non-media types
+func mediaPlaceholder(mediaType string) ([]byte, string, bool) {
+	switch {
+	case mediaType == "image/svg+xml":
+		// Text, and usually small
+		return nil, "", false
+	case mediaType == "image/gif":
+		return placeholderGIF, "image/gif", true
+	case mediaType == "image/jpeg":
+		return placeholderJPEG, "image/jpeg", true
+	case strings.HasPrefix(mediaType, "image/"):
+		return placeholderPNG, "image/png", true
+	case strings.HasPrefix(mediaType, "video/"):
+		return placeholderMP4, "video/mp4", true
+	}
+	return nil, "", false
+}
+
+// substituteMedia swaps the body of an image or video response of at least
+// mediaPlaceholderSize bytes for a tiny placeholder before it is read,
+// sparing the client and the store. Partial responses become complete
+// ones. The original size is counted by draining the body only when the
+// upstream did not declare it.
+func (h *Handler) substituteMedia(resp *http.Response, captured *capture.CapturedRequest) {
+	if h.mediaPlaceholderSize <= 0 || resp.Request.Method == http.MethodHead {
+		return
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent {
+		return
+	}
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return
+	}
+	placeholder, contentType, ok := mediaPlaceholder(mediaType)
+	if !ok {
+		return
+	}
+
+	size := resp.ContentLength
+	if size < 0 || resp.Header.Get("Content-Encoding") != "" {
+		head, err := io.ReadAll(io.LimitReader(resp.Body, h.mediaPlaceholderSize))
+		if err != nil || int64(len(head)) < h.mediaPlaceholderSize {
+			// Small enough to keep; put back what was read
+			resp.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(head), resp.Body), resp.Body}
+			return
+		}
+		rest, _ := io.Copy(io.Discard, io.LimitReader(resp.Body, h.maxRequestSize))
+		size = int64(len(head)) + rest
+	}
+	if size < h.mediaPlaceholderSize {
+		return
+	}
+	resp.Body.Close()
+
+	resp.Body = io.NopCloser(bytes.NewReader(placeholder))
+	resp.ContentLength = int64(len(placeholder))
+	if resp.StatusCode == http.StatusPartialContent {
+		resp.StatusCode = http.StatusOK
+		resp.Status = "200 OK"
+		resp.Header.Del("Content-Range")
+	}
+	for _, name := range []string{"Content-Encoding", "Accept-Ranges", "ETag", "Last-Modified"} {
+		resp.Header.Del(name)
+	}
+	resp.Header.Set("Content-Type", contentType)
+	resp.Header.Set("Content-Length", strconv.Itoa(len(placeholder)))
+	// Keep the placeholder out of the client's cache
+	resp.Header.Set("Cache-Control", "no-store")
+
+	captured.OriginalSize = size
+	captured.RecordActions(capture.ActionRecord{
+		Type:   capture.ActionMediaPlaceholder,
+		Detail: fmt.Sprintf("replaced %d byte %s body", size, mediaType),
+	})
+}
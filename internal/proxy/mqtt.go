@@ -0,0 +1,365 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+	"github.com/adamdrake/go_proxy/internal/rules"
+)
+
+// Tunnels, port forwards and WebSockets are watched for MQTT: a stream
+// whose client opens with an MQTT CONNECT packet is decoded packet by
+// packet into events on the connection's capture. Traffic is relayed
+// unchanged, and anything else stops being watched after its first bytes.
+
+// maxMQTTEvents caps the events kept for one connection
+const maxMQTTEvents = 1000
+
+// maxMQTTPacket caps a packet buffered for decoding; decoding stops at a
+// larger one
+const maxMQTTPacket = 1 << 20
+
+// mqttPayloadSample is how much of each PUBLISH payload is kept
+const mqttPayloadSample = 256
+
+// MQTT packet types
+var mqttPacketTypes = [...]string{
+	"RESERVED", "CONNECT", "CONNACK", "PUBLISH", "PUBACK", "PUBREC", "PUBREL", "PUBCOMP",
+	"SUBSCRIBE", "SUBACK", "UNSUBSCRIBE", "UNSUBACK", "PINGREQ", "PINGRESP", "DISCONNECT", "AUTH",
+}
+
+const (
+	mqttConnect     = 1
+	mqttConnack     = 2
+	mqttPublish     = 3
+	mqttSubscribe   = 8
+	mqttSuback      = 9
+	mqttUnsubscribe = 10
+	mqttUnsuback    = 11
+	mqttPingreq     = 12
+	mqttPingresp    = 13
+	mqttDisconnect  = 14
+	mqttAuth        = 15
+)
+
+// errMQTTTruncated reports a packet whose fields run past its end
+var errMQTTTruncated = errors.New("mqtt packet truncated")
+
+// mqttTap watches both directions of a stream for MQTT
+type mqttTap struct {
+	mu       sync.Mutex
+	detected bool
+	// off is set once the stream is known not to be MQTT, or decoding
+	// has stopped
+	off     bool
+	client  []byte
+	server  []byte
+	session capture.MQTTSession
+}
+
+// fromClient and fromServer observe bytes relayed in each direction
+func (t *mqttTap) fromClient(p []byte) { t.feed(rules.Upstream, p) }
+func (t *mqttTap) fromServer(p []byte) { t.feed(rules.Downstream, p) }
+
+func (t *mqttTap) feed(direction string, p []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.off {
+		return
+	}
+
+	buf := &t.client
+	if direction == rules.Downstream {
+		// MQTT clients speak first
+		if !t.detected {
+			t.stop()
+			return
+		}
+		buf = &t.server
+	}
+	*buf = append(*buf, p...)
+
+	if !t.detected {
+		switch mqttConnectPrefix(*buf) {
+		case prefixNo:
+			t.stop()
+			return
+		case prefixMore:
+			return
+		}
+		t.detected = true
+	}
+
+	consumed := 0
+	for {
+		typ, flags, body, n, err := nextMQTTPacket((*buf)[consumed:])
+		if err != nil {
+			t.session.Truncated = true
+			t.stop()
+			return
+		}
+		if n == 0 {
+			break
+		}
+		t.packet(direction, typ, flags, body)
+		consumed += n
+	}
+	if consumed > 0 {
+		// Keep only the partial packet, in a buffer of its own
+		*buf = append([]byte(nil), (*buf)[consumed:]...)
+	}
+}
+
+// stop gives up on the stream
+func (t *mqttTap) stop() {
+	t.off = true
+	t.client, t.server = nil, nil
+}
+
+// result returns the decoded session, or nil when the stream was not MQTT
+func (t *mqttTap) result() *capture.MQTTSession {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.detected {
+		return nil
+	}
+	session := t.session
+	session.Events = append([]capture.MQTTEvent(nil), t.session.Events...)
+	return &session
+}
+
+// Outcomes of mqttConnectPrefix
+const (
+	prefixNo = iota
+	prefixMore
+	prefixYes
+)
+
+// mqttConnectPrefix reports whether b starts like an MQTT CONNECT packet:
+// type 1, a remaining length, and the protocol name MQTT (3.1.1 and 5) or
+// MQIsdp (3.1)
+func mqttConnectPrefix(b []byte) int {
+	if len(b) == 0 {
+		return prefixMore
+	}
+	if b[0] != mqttConnect<<4 {
+		return prefixNo
+	}
+	i := 1
+	for ; ; i++ {
+		if i >= len(b) {
+			return prefixMore
+		}
+		if i > 4 {
+			return prefixNo
+		}
+		if b[i]&0x80 == 0 {
+			break
+		}
+	}
+	rest := b[i+1:]
+	for _, name := range []string{"\x00\x04MQTT", "\x00\x06MQIsdp"} {
+		n := min(len(rest), len(name))
+		if string(rest[:n]) == name[:n] {
+			if n == len(name) {
+				return prefixYes
+			}
+			return prefixMore
+		}
+	}
+	return prefixNo
+}
+
+// nextMQTTPacket splits the first packet off b. n is 0 while the packet
+// is incomplete.
+func nextMQTTPacket(b []byte) (typ, flags byte, body []byte, n int, err error) {
+	if len(b) < 2 {
+		return 0, 0, nil, 0, nil
+	}
+	var length, shift int
+	i := 1
+	for {
+		if i >= len(b) {
+			return 0, 0, nil, 0, nil
+		}
+		if i > 4 {
+			return 0, 0, nil, 0, errors.New("mqtt remaining length too long")
+		}
+		length |= int(b[i]&0x7f) << shift
+		shift += 7
+		i++
+		if b[i-1]&0x80 == 0 {
+			break
+		}
+	}
+	if length > maxMQTTPacket {
+		return 0, 0, nil, 0, errors.New("mqtt packet too large")
+	}
+	if len(b) < i+length {
+		return 0, 0, nil, 0, nil
+	}
+	return b[0] >> 4, b[0] & 0x0f, b[i : i+length], i + length, nil
+}
+
+// packet records one packet
+func (t *mqttTap) packet(direction string, typ, flags byte, body []byte) {
+	if typ == mqttPingreq || typ == mqttPingresp {
+		return
+	}
+	event := capture.MQTTEvent{
+		Timestamp: time.Now(),
+		Direction: direction,
+		Type:      mqttPacketTypes[typ],
+	}
+	r := &mqttReader{b: body}
+	v5 := t.session.Version == 5
+
+	switch typ {
+	case mqttConnect:
+		r.string() // protocol name
+		level := r.byte()
+		connectFlags := r.byte()
+		r.uint16() // keep alive
+		if level == 5 {
+			r.properties()
+		}
+		t.session.Version = int(level)
+		t.session.ClientID = r.string()
+		if connectFlags&0x04 != 0 {
+			if level == 5 {
+				r.properties()
+			}
+			event.Topic = r.string() // will topic
+			r.binary()               // will payload
+		}
+		if connectFlags&0x80 != 0 {
+			t.session.Username = r.string()
+		}
+	case mqttConnack:
+		r.byte() // session present
+		event.Codes = []int{int(r.byte())}
+	case mqttPublish:
+		event.QoS = int(flags>>1) & 3
+		event.Retain = flags&1 != 0
+		event.Topic = r.string()
+		if event.QoS > 0 {
+			event.PacketID = r.uint16()
+		}
+		if v5 {
+			r.properties()
+		}
+		payload := r.rest()
+		event.PayloadSize = len(payload)
+		event.PayloadSample = append([]byte(nil), payload[:min(len(payload), mqttPayloadSample)]...)
+	case mqttSubscribe, mqttUnsubscribe:
+		event.PacketID = r.uint16()
+		if v5 {
+			r.properties()
+		}
+		for r.err == nil && len(r.b) > 0 {
+			f := capture.MQTTFilter{Filter: r.string()}
+			if typ == mqttSubscribe {
+				f.QoS = int(r.byte() & 3)
+			}
+			event.Filters = append(event.Filters, f)
+		}
+	case mqttSuback, mqttUnsuback:
+		event.PacketID = r.uint16()
+		if v5 {
+			r.properties()
+		}
+		for _, code := range r.rest() {
+			event.Codes = append(event.Codes, int(code))
+		}
+	case mqttDisconnect, mqttAuth:
+		if len(body) > 0 {
+			event.Codes = []int{int(r.byte())}
+		}
+	default:
+		// PUBACK, PUBREC, PUBREL and PUBCOMP, with a reason code in v5
+		event.PacketID = r.uint16()
+		if len(r.b) > 0 {
+			event.Codes = []int{int(r.byte())}
+		}
+	}
+	if r.err != nil {
+		// Keep what was read; the stream framing is still intact
+		event.Type += " (malformed)"
+	}
+
+	if len(t.session.Events) >= maxMQTTEvents {
+		t.session.Truncated = true
+		return
+	}
+	t.session.Events = append(t.session.Events, event)
+}
+
+// mqttReader reads the fields of a packet body, remembering the first
+// error
+type mqttReader struct {
+	b   []byte
+	err error
+}
+
+func (r *mqttReader) take(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > len(r.b) {
+		r.err = errMQTTTruncated
+		r.b = nil
+		return nil
+	}
+	p := r.b[:n]
+	r.b = r.b[n:]
+	return p
+}
+
+func (r *mqttReader) byte() byte {
+	if p := r.take(1); p != nil {
+		return p[0]
+	}
+	return 0
+}
+
+func (r *mqttReader) uint16() uint16 {
+	if p := r.take(2); p != nil {
+		return binary.BigEndian.Uint16(p)
+	}
+	return 0
+}
+
+// binary reads length-prefixed bytes
+func (r *mqttReader) binary() []byte {
+	return r.take(int(r.uint16()))
+}
+
+func (r *mqttReader) string() string {
+	return string(r.binary())
+}
+
+// properties skips an MQTT 5 property list
+func (r *mqttReader) properties() {
+	var length, shift int
+	for i := 0; i < 4; i++ {
+		b := r.byte()
+		length |= int(b&0x7f) << shift
+		shift += 7
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	r.take(length)
+}
+
+func (r *mqttReader) rest() []byte {
+	if r.err != nil {
+		return nil
+	}
+	p := r.b
+	r.b = nil
+	return p
+}
@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+	"github.com/adamdrake/go_proxy/internal/rules"
+)
+
+// mqttPacket frames body as a packet of the given type and flags
+func mqttPacket(typ, flags byte, body string) string {
+	b := []byte{typ<<4 | flags}
+	n := len(body)
+	for {
+		c := byte(n & 0x7f)
+		if n >>= 7; n > 0 {
+			c |= 0x80
+		}
+		b = append(b, c)
+		if n == 0 {
+			break
+		}
+	}
+	return string(b) + body
+}
+
+// mqttString encodes a length-prefixed string
+func mqttString(s string) string {
+	return string([]byte{byte(len(s) >> 8), byte(len(s))}) + s
+}
+
+func TestMQTTTap(t *testing.T) {
+	connect311 := mqttPacket(mqttConnect, 0, mqttString("MQTT")+"\x04\x80\x00\x3c"+mqttString("client-1")+mqttString("user"))
+	tests := []struct {
+		name   string
+		client []string
+		server []string
+		want   *capture.MQTTSession
+	}{
+		{
+			name:   "not mqtt",
+			client: []string{"GET / HTTP/1.1\r\n"},
+		},
+		{
+			name:   "server speaks first",
+			server: []string{"220 smtp"},
+		},
+		{
+			name: "3.1.1 session split across reads",
+			client: []string{
+				connect311[:3], connect311[3:],
+				mqttPacket(mqttSubscribe, 2, "\x00\x01"+mqttString("a/#")+"\x01"+mqttString("b")+"\x00"),
+				mqttPacket(mqttPublish, 3, mqttString("a/b")+"\x00\x02hello"),
+				mqttPacket(mqttPingreq, 0, ""),
+				mqttPacket(mqttDisconnect, 0, ""),
+			},
+			server: []string{
+				"",
+				mqttPacket(mqttConnack, 0, "\x00\x00"),
+				mqttPacket(mqttSuback, 0, "\x00\x01\x01\x80"),
+				mqttPacket(4, 0, "\x00\x02"),
+			},
+			want: &capture.MQTTSession{Version: 4, ClientID: "client-1", Username: "user", Events: []capture.MQTTEvent{
+				{Direction: rules.Upstream, Type: "CONNECT"},
+				{Direction: rules.Downstream, Type: "CONNACK", Codes: []int{0}},
+				{Direction: rules.Upstream, Type: "SUBSCRIBE", PacketID: 1, Filters: []capture.MQTTFilter{{Filter: "a/#", QoS: 1}, {Filter: "b"}}},
+				{Direction: rules.Downstream, Type: "SUBACK", PacketID: 1, Codes: []int{1, 128}},
+				{Direction: rules.Upstream, Type: "PUBLISH", Topic: "a/b", QoS: 1, Retain: true, PacketID: 2, PayloadSize: 5, PayloadSample: []byte("hello")},
+				{Direction: rules.Downstream, Type: "PUBACK", PacketID: 2},
+				{Direction: rules.Upstream, Type: "DISCONNECT"},
+			}},
+		},
+		{
+			name: "5 with properties and a will",
+			client: []string{
+				mqttPacket(mqttConnect, 0, mqttString("MQTT")+"\x05\x04\x00\x3c\x00"+mqttString("c5")+"\x00"+mqttString("will/t")+mqttString("bye")),
+				mqttPacket(mqttPublish, 0, mqttString("t")+"\x02\x01\x01"+"x"),
+			},
+			want: &capture.MQTTSession{Version: 5, ClientID: "c5", Events: []capture.MQTTEvent{
+				{Direction: rules.Upstream, Type: "CONNECT", Topic: "will/t"},
+				{Direction: rules.Upstream, Type: "PUBLISH", Topic: "t", PayloadSize: 1, PayloadSample: []byte("x")},
+			}},
+		},
+		{
+			name: "3.1 protocol name",
+			client: []string{
+				mqttPacket(mqttConnect, 0, mqttString("MQIsdp")+"\x03\x00\x00\x3c"+mqttString("old")),
+			},
+			want: &capture.MQTTSession{Version: 3, ClientID: "old", Events: []capture.MQTTEvent{
+				{Direction: rules.Upstream, Type: "CONNECT"},
+			}},
+		},
+		{
+			name: "malformed packet keeps the stream",
+			client: []string{
+				connect311,
+				mqttPacket(mqttPublish, 0, "\x00\x09ab"),
+				mqttPacket(mqttDisconnect, 0, ""),
+			},
+			want: &capture.MQTTSession{Version: 4, ClientID: "client-1", Username: "user", Events: []capture.MQTTEvent{
+				{Direction: rules.Upstream, Type: "CONNECT"},
+				{Direction: rules.Upstream, Type: "PUBLISH (malformed)"},
+				{Direction: rules.Upstream, Type: "DISCONNECT"},
+			}},
+		},
+		{
+			name:   "oversized packet",
+			client: []string{connect311, "\x30\xff\xff\xff\x7f"},
+			want: &capture.MQTTSession{Version: 4, ClientID: "client-1", Username: "user", Truncated: true, Events: []capture.MQTTEvent{
+				{Direction: rules.Upstream, Type: "CONNECT"},
+			}},
+		},
+		{
+			name:   "remaining length too long",
+			client: []string{connect311, "\x30\xff\xff\xff\xff\x01"},
+			want: &capture.MQTTSession{Version: 4, ClientID: "client-1", Username: "user", Truncated: true, Events: []capture.MQTTEvent{
+				{Direction: rules.Upstream, Type: "CONNECT"},
+			}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tap := &mqttTap{}
+			for i := 0; i < max(len(tt.client), len(tt.server)); i++ {
+				if i < len(tt.client) {
+					tap.fromClient([]byte(tt.client[i]))
+				}
+				if i < len(tt.server) && tt.server[i] != "" {
+					tap.fromServer([]byte(tt.server[i]))
+				}
+			}
+			got := tap.result()
+			if got != nil {
+				for i := range got.Events {
+					got.Events[i].Timestamp = tt.want.Events[i].Timestamp
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func FuzzMQTTTap(f *testing.F) {
+	connect := mqttPacket(mqttConnect, 0, mqttString("MQTT")+"\x05\xc4\x00\x3c\x00"+mqttString("c")+"\x00"+mqttString("w")+mqttString("p")+mqttString("u"))
+	f.Add([]byte(connect+mqttPacket(mqttPublish, 2, mqttString("t")+"\x00\x01\x00x")), []byte(mqttPacket(mqttConnack, 0, "\x00\x00\x00")), 7)
+	f.Add([]byte(connect+mqttPacket(mqttSubscribe, 2, "\x00\x01\x00"+mqttString("a")+"\x01")), []byte(mqttPacket(mqttSuback, 0, "\x00\x01\x00\x01")), 3)
+	f.Fuzz(func(t *testing.T, client, server []byte, chunk int) {
+		if chunk <= 0 || chunk > 64 {
+			chunk = 64
+		}
+		tap := &mqttTap{}
+		for len(client) > 0 || len(server) > 0 {
+			n := min(chunk, len(client))
+			tap.fromClient(client[:n])
+			client = client[n:]
+			n = min(chunk, len(server))
+			tap.fromServer(server[:n])
+			server = server[n:]
+		}
+		if session := tap.result(); session != nil && len(session.Events) > maxMQTTEvents {
+			t.Fatalf("%d events kept", len(session.Events))
+		}
+	})
+}
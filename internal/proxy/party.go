@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+	"github.com/adamdrake/go_proxy/internal/hostmatch"
+)
+
+// Parties classifies captures as first- or third-party against per-session
+// lists of first-party domains, and optionally blocks third parties
+type Parties struct {
+	mu sync.RWMutex
+	// domains maps a session to its first-party domains; "" holds the
+	// default for sessions without their own list
+	domains    map[string][]string
+	blockThird atomic.Bool
+}
+
+// NewParties returns a classifier with a default first-party list
+func NewParties(domains []string, blockThirdParty bool) *Parties {
+	p := &Parties{domains: make(map[string][]string)}
+	p.SetFirstParty("", domains)
+	p.blockThird.Store(blockThirdParty)
+	return p
+}
+
+// SetFirstParty replaces session's first-party domains; each covers its
+// subdomains. An empty list makes the session fall back to the default.
+func (p *Parties) SetFirstParty(session string, domains []string) {
+	var normalized []string
+	for _, d := range domains {
+		d = strings.TrimPrefix(hostmatch.Normalize(strings.TrimSpace(d)), "*.")
+		if d != "" {
+			normalized = append(normalized, d)
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(normalized) == 0 {
+		delete(p.domains, session)
+		return
+	}
+	p.domains[session] = normalized
+}
+
+// FirstParty returns every configured list by session, "" being the
+// default
+func (p *Parties) FirstParty() map[string][]string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	lists := make(map[string][]string, len(p.domains))
+	for session, domains := range p.domains {
+		lists[session] = append([]string(nil), domains...)
+	}
+	return lists
+}
+
+// Classify returns capture.PartyFirst or capture.PartyThird for a host
+// seen in session, or "" when no first-party list applies
+func (p *Parties) Classify(session, host string) string {
+	p.mu.RLock()
+	domains, ok := p.domains[session]
+	if !ok {
+		domains = p.domains[""]
+	}
+	p.mu.RUnlock()
+	if len(domains) == 0 {
+		return ""
+	}
+
+	for _, d := range domains {
+		if hostmatch.Match("*."+d, host) {
+			return capture.PartyFirst
+		}
+	}
+	return capture.PartyThird
+}
+
+// BlockThirdParty reports whether requests to third parties are refused
+func (p *Parties) BlockThirdParty() bool {
+	return p.blockThird.Load()
+}
+
+// SetBlockThirdParty turns blocking of third-party requests on or off
+func (p *Parties) SetBlockThirdParty(block bool) {
+	p.blockThird.Store(block)
+}
+
+// classifyParty stamps captured with its party and reports whether it is
+// a third party that must be blocked. In dry-run mode the block is only
+// recorded.
+func (h *Handler) classifyParty(captured *capture.CapturedRequest, host string) bool {
+	captured.Party = h.parties.Classify(captured.Session, host)
+	if captured.Party != capture.PartyThird || !h.parties.BlockThirdParty() {
+		return false
+	}
+	if h.dryRun() {
+		wouldBlock(captured, "third party")
+		return false
+	}
+	return true
+}
+
+// recordThirdPartyBlocked stores a capture for a request refused because
+// its host is not first-party. prepare runs on the capture worker, as
+// for record.
+func (h *Handler) recordThirdPartyBlocked(captured *capture.CapturedRequest, startTime time.Time, prepare func()) {
+	captured.Blocked = true
+	captured.BlockReason = "third party"
+	captured.RecordActions(capture.ActionRecord{Type: capture.ActionBlock, Detail: captured.BlockReason})
+	captured.Duration = time.Since(startTime)
+	h.record(captured, prepare)
+}
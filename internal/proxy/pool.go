@@ -0,0 +1,185 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ConnPool follows the upstream connections of the forwarding transport:
+// which are open per host, which of them carry requests right now, and
+// how requests got their connection. A connection is idle while open with
+// no request in flight, whatever its protocol.
+type ConnPool struct {
+	mu    sync.Mutex
+	conns map[net.Conn]*pooledConn
+
+	// Requests given a connection, those given one that carried earlier
+	// requests, and the time spent waiting for one
+	requests int64
+	reused   int64
+	waitSum  time.Duration
+	waitMax  time.Duration
+}
+
+// pooledConn is the state of one open connection
+type pooledConn struct {
+	host     string
+	inFlight int
+}
+
+// ConnPoolStats is a point-in-time view of the pool
+type ConnPoolStats struct {
+	Requests    int64   `json:"requests"`
+	Reused      int64   `json:"reused"`
+	New         int64   `json:"new"`
+	ReuseRatio  float64 `json:"reuse_ratio"`
+	WaitAvgMS   float64 `json:"wait_avg_ms"`
+	WaitMaxMS   float64 `json:"wait_max_ms"`
+	WaitTotalMS float64 `json:"wait_total_ms"`
+
+	// Connections open now, split into idle and active
+	Open   int `json:"open"`
+	Idle   int `json:"idle"`
+	Active int `json:"active"`
+
+	// Per upstream host:port, most connections first
+	Hosts []HostConns `json:"hosts"`
+}
+
+// HostConns counts the open connections to one upstream address
+type HostConns struct {
+	Host   string `json:"host"`
+	Open   int    `json:"open"`
+	Idle   int    `json:"idle"`
+	Active int    `json:"active"`
+}
+
+func newConnPool() *ConnPool {
+	return &ConnPool{conns: make(map[net.Conn]*pooledConn)}
+}
+
+// opened adds a connection dialed to host, as the transport holds it, and
+// arranges for its removal when closer, c itself or the connection under
+// it, closes
+func (p *ConnPool) opened(c net.Conn, closer *wireConn, host string) {
+	p.mu.Lock()
+	p.conns[c] = &pooledConn{host: host}
+	p.mu.Unlock()
+	closer.onClose = func() {
+		p.mu.Lock()
+		delete(p.conns, c)
+		p.mu.Unlock()
+	}
+}
+
+// trace follows how req gets its connection. The returned function
+// reports whether the connection was reused and how long the request
+// waited for it; done must be called once the exchange is over.
+func (p *ConnPool) trace(req *http.Request) (*http.Request, func() (bool, time.Duration), func()) {
+	var mu sync.Mutex
+	var start time.Time
+	var reused bool
+	var wait time.Duration
+	var held []net.Conn
+	trace := &httptrace.ClientTrace{
+		GetConn: func(string) {
+			mu.Lock()
+			start = time.Now()
+			mu.Unlock()
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			mu.Lock()
+			reused, wait = info.Reused, 0
+			if !start.IsZero() {
+				wait = time.Since(start)
+			}
+			c := info.Conn
+			held = append(held, c)
+			mu.Unlock()
+
+			p.mu.Lock()
+			p.requests++
+			if info.Reused {
+				p.reused++
+			}
+			p.waitSum += wait
+			p.waitMax = max(p.waitMax, wait)
+			if pc := p.conns[c]; pc != nil {
+				pc.inFlight++
+			}
+			p.mu.Unlock()
+		},
+	}
+	ctx := httptrace.WithClientTrace(req.Context(), trace)
+	result := func() (bool, time.Duration) {
+		mu.Lock()
+		defer mu.Unlock()
+		return reused, wait
+	}
+	done := func() {
+		mu.Lock()
+		conns := held
+		held = nil
+		mu.Unlock()
+
+		p.mu.Lock()
+		for _, c := range conns {
+			if pc := p.conns[c]; pc != nil && pc.inFlight > 0 {
+				pc.inFlight--
+			}
+		}
+		p.mu.Unlock()
+	}
+	return req.WithContext(ctx), result, done
+}
+
+// Stats returns the current pool counters
+func (p *ConnPool) Stats() ConnPoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stats := ConnPoolStats{
+		Requests:    p.requests,
+		Reused:      p.reused,
+		New:         p.requests - p.reused,
+		WaitMaxMS:   float64(p.waitMax.Microseconds()) / 1000,
+		WaitTotalMS: float64(p.waitSum.Microseconds()) / 1000,
+		Hosts:       []HostConns{},
+	}
+	if p.requests > 0 {
+		stats.ReuseRatio = float64(p.reused) / float64(p.requests)
+		stats.WaitAvgMS = float64((p.waitSum / time.Duration(p.requests)).Microseconds()) / 1000
+	}
+
+	byHost := make(map[string]*HostConns)
+	for _, pc := range p.conns {
+		h := byHost[pc.host]
+		if h == nil {
+			h = &HostConns{Host: pc.host}
+			byHost[pc.host] = h
+		}
+		h.Open++
+		if pc.inFlight > 0 {
+			h.Active++
+		} else {
+			h.Idle++
+		}
+	}
+	for _, h := range byHost {
+		stats.Open += h.Open
+		stats.Idle += h.Idle
+		stats.Active += h.Active
+		stats.Hosts = append(stats.Hosts, *h)
+	}
+	sort.Slice(stats.Hosts, func(i, j int) bool {
+		if stats.Hosts[i].Open != stats.Hosts[j].Open {
+			return stats.Hosts[i].Open > stats.Hosts[j].Open
+		}
+		return stats.Hosts[i].Host < stats.Hosts[j].Host
+	})
+	return stats
+}
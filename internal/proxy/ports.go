@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// PortRange is an inclusive range of TCP ports
+type PortRange struct {
+	Low  int
+	High int
+}
+
+// Contains reports whether port falls within the range
+func (r PortRange) Contains(port int) bool {
+	return port >= r.Low && port <= r.High
+}
+
+// PortPolicy restricts which destination ports CONNECT may target.
+// An empty policy allows every port.
+type PortPolicy []PortRange
+
+// Allows reports whether the policy permits port
+func (p PortPolicy) Allows(port int) bool {
+	if len(p) == 0 {
+		return true
+	}
+	for _, r := range p {
+		if r.Contains(port) {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns the policy in the format accepted by ParsePortPolicy
+func (p PortPolicy) String() string {
+	if len(p) == 0 {
+		return "any"
+	}
+	parts := make([]string, len(p))
+	for i, r := range p {
+		if r.Low == r.High {
+			parts[i] = strconv.Itoa(r.Low)
+		} else {
+			parts[i] = fmt.Sprintf("%d-%d", r.Low, r.High)
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// ParsePortPolicy parses a comma-separated list of ports and ranges such as
+// "443,8443,9000-9100". "any" or "*" allows every port.
+func ParsePortPolicy(s string) (PortPolicy, error) {
+	s = strings.TrimSpace(s)
+	if s == "any" || s == "*" {
+		return nil, nil
+	}
+
+	var policy PortPolicy
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		lowStr, highStr, isRange := strings.Cut(part, "-")
+		if !isRange {
+			highStr = lowStr
+		}
+		low, err := parsePort(lowStr)
+		if err != nil {
+			return nil, err
+		}
+		high, err := parsePort(highStr)
+		if err != nil {
+			return nil, err
+		}
+		if low > high {
+			return nil, fmt.Errorf("invalid port range %q", part)
+		}
+		policy = append(policy, PortRange{Low: low, High: high})
+	}
+
+	if len(policy) == 0 {
+		return nil, fmt.Errorf("empty port policy")
+	}
+	return policy, nil
+}
+
+// parsePort parses a single TCP port number
+func parsePort(s string) (int, error) {
+	port, err := strconv.Atoi(strings.TrimSpace(s))
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid port %q", s)
+	}
+	return port, nil
+}
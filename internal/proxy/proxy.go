@@ -2,13 +2,21 @@ package proxy
 
 import (
 	"context"
-	"crypto/tls"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	"time"
 
+	"github.com/adamdrake/go_proxy/internal/allowlist"
+	"github.com/adamdrake/go_proxy/internal/anomaly"
+	"github.com/adamdrake/go_proxy/internal/blocklist"
 	"github.com/adamdrake/go_proxy/internal/capture"
+	"github.com/adamdrake/go_proxy/internal/dnscache"
+	"github.com/adamdrake/go_proxy/internal/export"
+	"github.com/adamdrake/go_proxy/internal/geoip"
+	"github.com/adamdrake/go_proxy/internal/rules"
+	"github.com/adamdrake/go_proxy/internal/webhook"
 )
 
 // Config holds the proxy server configuration
@@ -17,46 +25,220 @@ type Config struct {
 	ReadTimeout    time.Duration
 	WriteTimeout   time.Duration
 	MaxRequestSize int64
+
+	// Client networks allowed to connect to the proxy listeners (empty
+	// allows all)
+	AllowClients allowlist.List
+
+	// Accept cleartext HTTP/2 (prior knowledge) from clients alongside
+	// HTTP/1.1
+	HTTP2 bool
+
+	// Background capture storage
+	CaptureWorkers   int
+	CaptureQueueSize int
+
+	// Keep HTTP/1 requests and responses exactly as they crossed the wire
+	CaptureRaw bool
+
+	// Forward HTTP/1 request headers in the order and case the client
+	// sent them
+	PreserveHeaderOrder bool
+
+	// Forward requests with as few proxy-made changes as possible: header
+	// order and case kept, no Accept-Encoding or User-Agent added, and the
+	// client's HTTP/1 version used upstream
+	Faithful bool
+
+	// Header carrying a per-request correlation ID to the upstream and
+	// back to the client (empty disables)
+	CorrelationHeader string
+
+	// Give 304 captures the body of the 200 capture they revalidated
+	Attach304Bodies bool
+
+	// Flag captures containing likely personal data (emails, card
+	// numbers, national IDs)
+	ScanPII bool
+
+	// Flag outgoing requests carrying credentials (cloud keys, API
+	// tokens, private keys); with BlockSecrets they are not forwarded
+	ScanSecrets  bool
+	BlockSecrets bool
+
+	// Receives events such as detected secrets; nil drops them
+	Notifier *webhook.Notifier
+
+	// Compares each host's traffic over rolling windows and reports
+	// anomalies; nil leaves detection off
+	Anomalies *anomaly.Detector
+
+	// Request bodies larger than UploadSpoolSize bytes are streamed to
+	// files in UploadDir (default: the system temp directory) and kept for
+	// UploadRetention, or removed once forwarded if that is zero
+	UploadSpoolSize int64
+	UploadDir       string
+	UploadRetention time.Duration
+
+	// AES-256 key encrypting capture data written to disk (spooled
+	// uploads); nil leaves it in plaintext
+	CaptureKey []byte
+
+	// Address families used for upstream connections
+	IPMode IPMode
+
+	// Local source address for upstream connections, optionally per host
+	BindOutbound BindAddr
+	BindRules    []BindRule
+
+	// Destination ports CONNECT may target (empty allows all)
+	ConnectPorts PortPolicy
+
+	// Destination ports CONNECT-UDP may target (empty allows all)
+	ConnectUDPPorts PortPolicy
+
+	// TLS settings for connections to upstream servers
+	UpstreamTLS UpstreamTLSConfig
+
+	// Offer HTTP/2 to HTTPS upstreams through ALPN. Requests that need
+	// HTTP/1.1 (ordered headers, WebSocket upgrades) still get it, and
+	// CaptureRaw turns HTTP/2 off, since raw capture records HTTP/1 bytes.
+	UpstreamHTTP2 bool
+
+	// Client certificates presented to mTLS-protected upstream hosts
+	ClientCerts []ClientCertRule
+
+	// Upstream timeouts, globally and per host pattern. Nil Timeouts, or
+	// negative fields of it, keep the defaults from DefaultTimeouts.
+	Timeouts     *Timeouts
+	TimeoutRules []TimeoutRule
+
+	// Retries of failed upstream requests
+	Retry RetryPolicy
+
+	// Per-host fail-fast after repeated upstream failures
+	CircuitBreaker CircuitBreakerConfig
+
+	// Headers injected into / stripped from every forwarded request
+	AddHeaders    []HeaderValue
+	RemoveHeaders []string
+
+	// Layer 4 port forwards, and how many bytes of each direction to keep
+	// as a hex dump (0 keeps none)
+	Forwards          []Forward
+	ForwardSampleSize int
+
+	// Keep message bodies sent through SMTP forwards instead of redacting
+	// them
+	MailBodies bool
+
+	// Replace image and video responses of at least this many bytes with
+	// tiny placeholders (0 disables)
+	MediaPlaceholderSize int64
+
+	// Crawl assist: per-host pacing, Retry-After and robots.txt
+	Crawl CrawlConfig
+
+	// Ad and tracker filter lists; matching requests are blocked
+	Blocklist *blocklist.List
+
+	// First-party domains (each covering its subdomains) for sessions
+	// without their own list; captures to other hosts are third-party,
+	// and refused with BlockThirdParty
+	FirstParty      []string
+	BlockThirdParty bool
+
+	// Hosts kept out of capture entirely, forwarded untouched or refused;
+	// nil bypasses nothing
+	Bypass *Bypass
+
+	// DryRun evaluates rules, header rules, filter lists, third-party and
+	// secret blocking and crawl pacing without enforcing them, recording
+	// what they would have done on each capture
+	DryRun bool
+
+	// MaxMind databases for the ASN and country of upstream addresses;
+	// nil records the address only
+	GeoIP *geoip.DB
+
+	// Look up the reverse DNS names of upstream addresses
+	ReverseDNS bool
+
+	// Fetch the certificate chain of tunneled hosts over a separate
+	// connection, so tunnels get certificate details and warnings too
+	ProbeTunnelCerts bool
+
+	// Archive every completed exchange to a WARC file as it is captured
+	WARC *export.WARCWriter
+
+	// Isolated capture namespaces, each with its own store
+	Tenants []Tenant
+
+	// Recording session captures are stamped with until changed through
+	// SetSession (empty for none)
+	Session string
+
+	// Upstream DNS caching
+	DNSCache       bool
+	DNSCacheConfig dnscache.Config
 }
 
 // DefaultConfig returns a Config with sensible defaults
 func DefaultConfig() Config {
 	return Config{
-		ListenAddr:     ":8080",
-		ReadTimeout:    30 * time.Second,
-		WriteTimeout:   30 * time.Second,
-		MaxRequestSize: 10 * 1024 * 1024, // 10MB
+		ListenAddr:       ":8080",
+		ReadTimeout:      30 * time.Second,
+		WriteTimeout:     30 * time.Second,
+		MaxRequestSize:   10 * 1024 * 1024, // 10MB
+		HTTP2:            true,
+		UpstreamHTTP2:    true,
+		CaptureWorkers:   2,
+		CaptureQueueSize: 1024,
+		IPMode:           IPModeDual,
+		ConnectPorts:     PortPolicy{{Low: 443, High: 443}},
+		ConnectUDPPorts:  PortPolicy{{Low: 443, High: 443}},
+		DNSCache:         true,
+		DNSCacheConfig:   dnscache.DefaultConfig(),
 	}
 }
 
 // Server is the main proxy server
 type Server struct {
-	config  Config
-	store   *capture.Store
-	handler *Handler
-	server  *http.Server
+	config   Config
+	store    *capture.Store
+	handler  *Handler
+	server   *http.Server
+	forwards *forwarders
+
+	// Servers for tenants' own listeners
+	tenantServers []*http.Server
 }
 
 // NewServer creates a new proxy server
 func NewServer(config Config, store *capture.Store) *Server {
-	handler := NewHandler(store, config.MaxRequestSize)
+	handler := NewHandler(store, config)
 
 	return &Server{
 		config:  config,
 		store:   store,
 		handler: handler,
+		forwards: &forwarders{
+			handler:    handler,
+			sampleSize: config.ForwardSampleSize,
+			mailBodies: config.MailBodies,
+		},
 	}
 }
 
 // Start begins listening for proxy requests
 func (s *Server) Start() error {
-	s.server = &http.Server{
-		Addr:         s.config.ListenAddr,
-		Handler:      s.handler,
-		ReadTimeout:  s.config.ReadTimeout,
-		WriteTimeout: s.config.WriteTimeout,
-		// Disable HTTP/2 for proxy compatibility
-		TLSNextProto: make(map[string]func(*http.Server, *tls.Conn, http.Handler)),
+	s.server = s.newHTTPServer()
+
+	if err := s.forwards.start(s.config.Forwards); err != nil {
+		return err
+	}
+	if err := s.startTenantListeners(); err != nil {
+		return err
 	}
 
 	listener, err := net.Listen("tcp", s.config.ListenAddr)
@@ -64,20 +246,136 @@ func (s *Server) Start() error {
 		return err
 	}
 
-	log.Printf("Proxy server listening on %s", s.config.ListenAddr)
+	return s.Serve(listener)
+}
+
+// Serve accepts proxy connections on an existing listener
+func (s *Server) Serve(listener net.Listener) error {
+	if s.server == nil {
+		s.server = s.newHTTPServer()
+	}
+
+	log.Printf("Proxy server listening on %s", listener.Addr())
+
+	// Client connections are recorded for header order and raw capture
+	listener = allowlist.Listener(listener, s.config.AllowClients)
+	listener = &wireListener{Listener: listener, limit: wireLimit(s.config.CaptureRaw, s.config.MaxRequestSize)}
 
 	return s.server.Serve(listener)
 }
 
-// Shutdown gracefully stops the server
+// newHTTPServer builds the http.Server that dispatches to the proxy handler
+func (s *Server) newHTTPServer() *http.Server {
+	// The listener is cleartext, so HTTP/2 clients must use prior
+	// knowledge; HTTP/1.1 clients are unaffected
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(s.config.HTTP2)
+
+	return &http.Server{
+		Addr:         s.config.ListenAddr,
+		Handler:      s.handler,
+		ReadTimeout:  s.config.ReadTimeout,
+		WriteTimeout: s.config.WriteTimeout,
+		Protocols:    protocols,
+		ConnContext:  withClientWire,
+	}
+}
+
+// Shutdown gracefully stops the server and flushes queued captures
 func (s *Server) Shutdown(ctx context.Context) error {
+	var err error
 	if s.server != nil {
-		return s.server.Shutdown(ctx)
+		err = s.server.Shutdown(ctx)
 	}
-	return nil
+	for _, server := range s.tenantServers {
+		server.Shutdown(ctx)
+	}
+	s.forwards.close()
+	s.handler.Pipeline().Close()
+	for _, t := range s.handler.tenants {
+		t.pipeline.Close()
+	}
+	return err
+}
+
+// CaptureStats returns the capture pipeline counters
+func (s *Server) CaptureStats() capture.PipelineStats {
+	return s.handler.Pipeline().Stats()
+}
+
+// ActiveTunnels returns the number of CONNECT tunnels open right now
+func (s *Server) ActiveTunnels() int64 {
+	return s.handler.ActiveTunnels()
+}
+
+// ConnPool returns the upstream connection pool tracker
+func (s *Server) ConnPool() *ConnPool {
+	return s.handler.ConnPool()
+}
+
+// MaxBodySize returns how many bytes of each body a capture keeps
+func (s *Server) MaxBodySize() int64 {
+	return s.config.MaxRequestSize
 }
 
 // Store returns the capture store
 func (s *Server) Store() *capture.Store {
 	return s.store
 }
+
+// DNSCache returns the upstream DNS cache, or nil when caching is disabled
+func (s *Server) DNSCache() *dnscache.Cache {
+	return s.handler.DNSCache()
+}
+
+// TenantStore returns the capture store of the named tenant ("" for the
+// default store), or nil if there is no such tenant
+func (s *Server) TenantStore(name string) *capture.Store {
+	return s.handler.TenantStore(name)
+}
+
+// Tenants returns the configured tenants, by name
+func (s *Server) Tenants() []Tenant {
+	return s.handler.Tenants()
+}
+
+// Rules returns the rule engine applied to forwarded requests
+func (s *Server) Rules() *rules.Engine {
+	return s.handler.Rules()
+}
+
+// WebSockets returns the live WebSocket connections
+func (s *Server) WebSockets() *WebSockets {
+	return s.handler.WebSockets()
+}
+
+// Circuits returns the per-host circuit breakers
+func (s *Server) Circuits() *CircuitBreakers {
+	return s.handler.Circuits()
+}
+
+// Parties returns the first-/third-party classifier
+func (s *Server) Parties() *Parties {
+	return s.handler.Parties()
+}
+
+// Bypass returns the hosts kept out of capture
+func (s *Server) Bypass() *Bypass {
+	return s.handler.Bypass()
+}
+
+// Session returns the recording session new captures are stamped with
+func (s *Server) Session() string {
+	return s.handler.Session()
+}
+
+// SetSession starts stamping new captures with name (empty for none)
+func (s *Server) SetSession(name string) {
+	s.handler.SetSession(name)
+}
+
+// OpenUpload reads back the full body of a spooled upload
+func (s *Server) OpenUpload(upload *capture.Upload) (io.ReadCloser, error) {
+	return s.handler.OpenUpload(upload)
+}
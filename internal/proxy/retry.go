@@ -0,0 +1,199 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+	"github.com/adamdrake/go_proxy/internal/rules"
+)
+
+// RetryPolicy controls retries of failed upstream requests
+type RetryPolicy struct {
+	// MaxRetries is the number of retries after the first attempt; zero disables retries
+	MaxRetries int
+	// Backoff is the delay before the first retry, doubling for each one after
+	Backoff time.Duration
+	// MaxBackoff caps the delay between attempts
+	MaxBackoff time.Duration
+	// RetryOnConnect retries connection-level failures (dial, DNS). Nothing
+	// reached the upstream, so these are retried for every method.
+	RetryOnConnect bool
+	// RetryOnTimeout retries idempotent requests that timed out
+	RetryOnTimeout bool
+	// RetryOnStatus retries idempotent requests answered with these codes
+	RetryOnStatus map[int]bool
+}
+
+// ParseRetryOn parses a comma-separated list of retry conditions into the
+// policy: "connect", "timeout", "5xx", or individual status codes
+func (p *RetryPolicy) ParseRetryOn(s string) error {
+	p.RetryOnConnect = false
+	p.RetryOnTimeout = false
+	p.RetryOnStatus = make(map[int]bool)
+
+	for _, cond := range strings.Split(s, ",") {
+		cond = strings.TrimSpace(strings.ToLower(cond))
+		switch cond {
+		case "":
+		case "connect":
+			p.RetryOnConnect = true
+		case "timeout":
+			p.RetryOnTimeout = true
+		case "5xx":
+			for code := 500; code <= 599; code++ {
+				p.RetryOnStatus[code] = true
+			}
+		default:
+			code, err := strconv.Atoi(cond)
+			if err != nil || code < 100 || code > 599 {
+				return fmt.Errorf("unknown retry condition %q", cond)
+			}
+			p.RetryOnStatus[code] = true
+		}
+	}
+	return nil
+}
+
+// isIdempotent reports whether a method may be safely repeated (RFC 9110)
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace,
+		http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// isConnectError reports whether err happened before the request was sent
+func isConnectError(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// isTimeout reports whether err is a timeout
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// shouldRetry decides whether an attempt's outcome warrants another try
+func (p RetryPolicy) shouldRetry(method string, resp *http.Response, err error) bool {
+	if err != nil {
+		if p.RetryOnConnect && isConnectError(err) {
+			return true
+		}
+		return p.RetryOnTimeout && isTimeout(err) && isIdempotent(method)
+	}
+	return p.RetryOnStatus[resp.StatusCode] && isIdempotent(method)
+}
+
+// delay returns the backoff before retry number n (1-based)
+func (p RetryPolicy) delay(n int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < n && (p.MaxBackoff <= 0 || d < p.MaxBackoff); i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	return d
+}
+
+// doWithRetry sends outReq, retrying according to the policy. A request
+// map-remote routed whose connection fails is sent to another backend
+// straight away, without counting as a retry. Every attempt is recorded
+// on the capture when retries or failover are possible.
+func (h *Handler) doWithRetry(outReq *http.Request, captured *capture.CapturedRequest, routing *rules.Outcome) (*http.Response, error) {
+	policy := h.retry
+	if policy.MaxRetries <= 0 && !routing.Balanced() {
+		return h.doAttempt(outReq)
+	}
+
+	failovers := 0
+	for attempt := 1; ; attempt++ {
+		req := outReq
+		if attempt > 1 {
+			req = outReq.Clone(outReq.Context())
+			if outReq.GetBody != nil {
+				body, err := outReq.GetBody()
+				if err != nil {
+					return nil, err
+				}
+				req.Body = body
+			}
+		}
+
+		start := time.Now()
+		resp, err := h.doAttempt(req)
+
+		record := capture.Attempt{
+			Number:     attempt,
+			DurationMS: time.Since(start).Milliseconds(),
+		}
+		if err != nil {
+			record.Error = err.Error()
+		} else {
+			record.StatusCode = resp.StatusCode
+		}
+		captured.Attempts = append(captured.Attempts, record)
+
+		if err != nil && isConnectError(err) && outReq.Context().Err() == nil && routing.Failover(outReq, err) {
+			log.Printf("[HTTP] %s %s attempt %d failed (%s), failing over to %s", req.Method, req.URL, attempt, err, routing.Backend)
+			captured.Backend = routing.Backend
+			failovers++
+			continue
+		}
+		if attempt-failovers > policy.MaxRetries || !policy.shouldRetry(req.Method, resp, err) {
+			return resp, err
+		}
+
+		// Discard the response we're about to retry
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+			resp.Body.Close()
+		}
+
+		log.Printf("[HTTP] %s %s attempt %d failed (%s), retrying", req.Method, req.URL, attempt, attemptOutcome(record))
+
+		if err := sleepContext(outReq.Context(), policy.delay(attempt)); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// attemptOutcome summarises an attempt for logging
+func attemptOutcome(a capture.Attempt) string {
+	if a.Error != "" {
+		return a.Error
+	}
+	return strconv.Itoa(a.StatusCode)
+}
+
+// sleepContext waits for d or until ctx is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
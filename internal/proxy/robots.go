@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// robotsGroup is one user-agent group of a robots.txt file
+type robotsGroup struct {
+	agents     []string
+	rules      []robotsRule
+	crawlDelay time.Duration
+}
+
+// robotsRule is a single Allow or Disallow line
+type robotsRule struct {
+	allow   bool
+	pattern string
+}
+
+func (r robotsRule) String() string {
+	if r.allow {
+		return "Allow: " + r.pattern
+	}
+	return "Disallow: " + r.pattern
+}
+
+// robotsTxt is a parsed robots.txt file (RFC 9309)
+type robotsTxt struct {
+	groups []robotsGroup
+}
+
+// parseRobots reads a robots.txt file. Unknown lines are ignored.
+func parseRobots(r io.Reader) *robotsTxt {
+	robots := &robotsTxt{}
+	var current *robotsGroup
+	inAgents := false
+
+	scanner := bufio.NewScanner(io.LimitReader(r, 512*1024))
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		switch key {
+		case "user-agent":
+			if !inAgents {
+				robots.groups = append(robots.groups, robotsGroup{})
+				current = &robots.groups[len(robots.groups)-1]
+				inAgents = true
+			}
+			current.agents = append(current.agents, strings.ToLower(value))
+		case "allow", "disallow":
+			inAgents = false
+			if current == nil || value == "" {
+				continue
+			}
+			current.rules = append(current.rules, robotsRule{allow: key == "allow", pattern: value})
+		case "crawl-delay":
+			inAgents = false
+			if current == nil {
+				continue
+			}
+			if secs, err := strconv.ParseFloat(value, 64); err == nil && secs > 0 {
+				current.crawlDelay = time.Duration(secs * float64(time.Second))
+			}
+		default:
+			inAgents = false
+		}
+	}
+	return robots
+}
+
+// group merges the groups that apply to a crawler's product token: those
+// naming it, or the "*" groups when none do
+func (r *robotsTxt) group(agent string) robotsGroup {
+	agent = strings.ToLower(agent)
+	var named, wildcard robotsGroup
+	for _, g := range r.groups {
+		var target *robotsGroup
+		for _, a := range g.agents {
+			if agent != "" && a != "*" && strings.Contains(agent, a) {
+				target = &named
+				break
+			}
+			if a == "*" {
+				target = &wildcard
+			}
+		}
+		if target == nil {
+			continue
+		}
+		target.agents = append(target.agents, g.agents...)
+		target.rules = append(target.rules, g.rules...)
+		target.crawlDelay = max(target.crawlDelay, g.crawlDelay)
+	}
+	if len(named.agents) > 0 {
+		return named
+	}
+	return wildcard
+}
+
+// disallowedBy returns the rule that disallows path, if any. The longest
+// matching pattern wins and Allow wins ties.
+func (g robotsGroup) disallowedBy(path string) (robotsRule, bool) {
+	if path == "/robots.txt" {
+		return robotsRule{}, false
+	}
+
+	best, found := robotsRule{}, false
+	for _, rule := range g.rules {
+		if !robotsMatch(rule.pattern, path) {
+			continue
+		}
+		if !found || len(rule.pattern) > len(best.pattern) ||
+			(len(rule.pattern) == len(best.pattern) && rule.allow) {
+			best, found = rule, true
+		}
+	}
+	return best, found && !best.allow
+}
+
+// robotsMatch matches a robots.txt path pattern, where '*' matches any run
+// of characters and a trailing '$' anchors the end
+func robotsMatch(pattern, path string) bool {
+	anchored := strings.HasSuffix(pattern, "$")
+	parts := strings.Split(strings.TrimSuffix(pattern, "$"), "*")
+	if !strings.HasPrefix(path, parts[0]) {
+		return false
+	}
+	return robotsMatchRest(path[len(parts[0]):], parts[1:], anchored)
+}
+
+// robotsMatchRest matches the parts following a wildcard
+func robotsMatchRest(s string, parts []string, anchored bool) bool {
+	if len(parts) == 0 {
+		return !anchored || s == ""
+	}
+	for i := 0; i <= len(s); i++ {
+		if strings.HasPrefix(s[i:], parts[0]) && robotsMatchRest(s[i+len(parts[0]):], parts[1:], anchored) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+	"github.com/adamdrake/go_proxy/internal/webhook"
+)
+
+// checkSecrets scans an outgoing request for credentials, records and
+// reports any it finds, and answers the client with 403 when secrets are
+// blocked. It reports whether the request was refused.
+func (h *Handler) checkSecrets(w http.ResponseWriter, r *http.Request, captured *capture.CapturedRequest, body []byte, startTime time.Time) bool {
+	findings := capture.ScanSecrets(captured.URL, r.Header, body)
+	if len(findings) == 0 {
+		return false
+	}
+	captured.SecretFindings = findings
+	types := strings.Join(capture.SecretTypes(findings), ", ")
+	log.Printf("[HTTP] %s %s carries credentials: %s", r.Method, captured.Host, types)
+
+	// The URL may hold the secret itself, so events carry the host only
+	if h.notifier != nil {
+		h.notifier.Notify(webhook.Event{
+			Type:    webhook.EventSecretDetected,
+			Summary: fmt.Sprintf("%s sent to %s", types, captured.Host),
+			Data: map[string]interface{}{
+				"request_id": captured.ID,
+				"method":     captured.Method,
+				"host":       captured.Host,
+				"findings":   findings,
+				"blocked":    h.blockSecrets && !h.dryRun(),
+			},
+		})
+	}
+	if !h.blockSecrets {
+		return false
+	}
+	if h.dryRun() {
+		wouldBlock(captured, "secret: "+types)
+		return false
+	}
+
+	http.Error(w, "Forbidden: request carries credentials ("+types+")", http.StatusForbidden)
+	captured.StatusCode = http.StatusForbidden
+	captured.Blocked = true
+	captured.BlockReason = "secret: " + types
+	captured.RecordActions(capture.ActionRecord{Type: capture.ActionBlock, Detail: captured.BlockReason})
+	captured.Duration = time.Since(startTime)
+	requestHeader := r.Header
+	h.record(captured, func() {
+		captured.RequestHeaders = cloneHeaders(requestHeader)
+	})
+	return true
+}
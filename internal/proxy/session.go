@@ -0,0 +1,17 @@
+package proxy
+
+// Session returns the recording session new captures are stamped with,
+// empty when none is active
+func (h *Handler) Session() string {
+	if name := h.session.Load(); name != nil {
+		return *name
+	}
+	return ""
+}
+
+// SetSession stamps captures from now on with name, so that recordings
+// (e.g. of app version N and N+1) can be told apart and compared. An
+// empty name ends the session.
+func (h *Handler) SetSession(name string) {
+	h.session.Store(&name)
+}
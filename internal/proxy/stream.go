@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+	"github.com/adamdrake/go_proxy/internal/rules"
+)
+
+// rewritesBody reports whether the outcome's body rules apply to a
+// response with header, so its body must be buffered whole
+func rewritesBody(header http.Header, outcome *rules.Outcome) bool {
+	contentType := header.Get("Content-Type")
+	return (outcome.ReplacesBody() && isTextContentType(contentType)) ||
+		(outcome.InjectsHTML() && isHTMLContentType(contentType))
+}
+
+// streamResponse relays a response to the client as it arrives rather
+// than buffering it whole, so downloads show progress and large bodies
+// are not held in memory. Up to maxRequestSize bytes are kept for the
+// capture; body rewrite rules do not apply. head holds bytes already read
+// from received.
+//
+// The client's framing follows the upstream's: a Content-Length is passed
+// on, and a body without one, chunked or ended by the upstream closing,
+// goes out chunked (close-delimited to HTTP/1.0 clients), so the client's
+// connection stays usable. An upstream failing mid-body aborts the
+// response, so the client does not take a cut-off body for a whole one.
+func (h *Handler) streamResponse(w http.ResponseWriter, r *http.Request, resp *http.Response, received *hashingReader, head []byte, wire *wireConn, outcome *rules.Outcome, captured *capture.CapturedRequest, startTime time.Time) {
+	captured.RecordActions(outcome.RelaxResponse(r.Header, resp.Header)...)
+	captured.RecordActions(outcome.RewriteSetCookies(resp.Header)...)
+	captured.RecordActions(outcome.RewriteHeaders(resp.Header)...)
+	dryRunResponseHeaders(captured, r.Header, resp.Header, outcome)
+
+	copyHeaders(w.Header(), resp.Header)
+	removeHopByHopHeaders(w.Header())
+	if captured.CorrelationID != "" {
+		w.Header().Set(h.correlationHeader, captured.CorrelationID)
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	flusher, _ := w.(http.Flusher)
+	var body []byte
+	relay := func(p []byte) bool {
+		keep := max(min(int64(len(p)), h.maxRequestSize-int64(len(body))), 0)
+		body = append(body, p[:keep]...)
+		if _, err := w.Write(p); err != nil {
+			captured.ClientAborted = true
+			return false
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return true
+	}
+
+	upstreamFailed := false
+	if len(head) == 0 || relay(head) {
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := received.Read(buf)
+			if n > 0 && !relay(buf[:n]) {
+				break
+			}
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				if r.Context().Err() != nil {
+					captured.ClientAborted = true
+				} else {
+					log.Printf("Error reading response: %v", err)
+					captured.Error = err.Error()
+					upstreamFailed = true
+				}
+				break
+			}
+		}
+	}
+	captured.ResponseBody = body
+	captured.ResponseBodySHA256 = received.sum()
+	captured.ResponseBodyTruncated = received.n > int64(len(body))
+	if !captured.ResponseBodyTruncated && !upstreamFailed && resp.StatusCode != http.StatusPartialContent {
+		dryRunResponseBody(captured, resp.Header, body, h.maxRequestSize, outcome)
+	}
+	if wire != nil {
+		raw, truncated := wire.take()
+		captured.ResponseHeaderOrder = responseHeaderFields(raw)
+		if h.captureRaw {
+			captured.RawResponse = raw
+			captured.RawTruncated = captured.RawTruncated || truncated
+		}
+	}
+
+	captured.Duration = time.Since(startTime)
+	if captured.ContentRange != "" {
+		log.Printf("[HTTP] %s %s -> %d %s (%d bytes, %s)", r.Method, captured.URL, resp.StatusCode, captured.ContentRange, received.n, captured.Duration)
+	} else {
+		log.Printf("[HTTP] %s %s -> %d (%s)", r.Method, captured.URL, resp.StatusCode, captured.Duration)
+	}
+
+	requestHeader, responseHeader := r.Header, resp.Header
+	h.record(captured, func() {
+		captured.RequestHeaders = cloneHeaders(requestHeader)
+		captured.ResponseHeaders = cloneHeaders(responseHeader)
+		h.linkNotModified(captured)
+	})
+
+	if upstreamFailed {
+		panic(http.ErrAbortHandler)
+	}
+}
@@ -0,0 +1,250 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+	"github.com/adamdrake/go_proxy/internal/rules"
+)
+
+// startProxy serves a proxy with the default configuration on a loopback
+// port until the test ends
+func startProxy(tb testing.TB) (*Server, string) {
+	tb.Helper()
+	return startProxyWith(tb, DefaultConfig())
+}
+
+// startProxyWith serves a proxy with config on a loopback port until the
+// test ends
+func startProxyWith(tb testing.TB, config Config) (*Server, string) {
+	tb.Helper()
+	config.ListenAddr = "127.0.0.1:0"
+	server := NewServer(config, capture.NewStore(1000))
+
+	listener, err := net.Listen("tcp", config.ListenAddr)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	go server.Serve(listener)
+	tb.Cleanup(func() { server.Shutdown(tb.Context()) })
+	return server, listener.Addr().String()
+}
+
+// rawUpstream answers every connection with response, written as is,
+// and closes it
+func rawUpstream(t *testing.T, response string) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				http.ReadRequest(bufio.NewReader(conn))
+				io.WriteString(conn, response)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// proxyClient speaks HTTP/1.x to the proxy over one connection
+type proxyClient struct {
+	conn net.Conn
+	br   *bufio.Reader
+}
+
+func dialProxy(t *testing.T, addr string) *proxyClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	t.Cleanup(func() { conn.Close() })
+	return &proxyClient{conn: conn, br: bufio.NewReader(conn)}
+}
+
+// get sends a proxy-form GET for target and returns the response head
+func (c *proxyClient) get(t *testing.T, proto, target string, header ...string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(c.conn, "GET %s %s\r\nHost: %s\r\n", target, proto, req.URL.Host)
+	for _, line := range header {
+		fmt.Fprintf(c.conn, "%s\r\n", line)
+	}
+	io.WriteString(c.conn, "\r\n")
+
+	resp, err := http.ReadResponse(c.br, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// waitCaptures waits for the store to hold n captures and returns them,
+// oldest first
+func waitCaptures(t *testing.T, store *capture.Store, n int) []*capture.CapturedRequest {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if all := store.GetAll(); len(all) >= n {
+			return all
+		}
+	}
+	t.Fatalf("store holds %d captures, want %d", store.Count(), n)
+	return nil
+}
+
+func readAll(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading body: %v", err)
+	}
+	return string(body)
+}
+
+func TestStreamResponseFraming(t *testing.T) {
+	body := strings.Repeat("0123456789", 10000)
+
+	identity := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+		io.WriteString(w, body)
+	}))
+	defer identity.Close()
+
+	chunked := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < len(body); i += 30000 {
+			io.WriteString(w, body[i:min(i+30000, len(body))])
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer chunked.Close()
+
+	closeDelimited := "http://" + rawUpstream(t, "HTTP/1.0 200 OK\r\nContent-Type: text/plain\r\n\r\n"+body)
+
+	tests := []struct {
+		name          string
+		url           string
+		contentLength int64
+	}{
+		{"identity", identity.URL, int64(len(body))},
+		{"chunked", chunked.URL, -1},
+		{"close-delimited", closeDelimited, -1},
+	}
+
+	_, addr := startProxy(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := dialProxy(t, addr)
+			for i := 0; i < 2; i++ {
+				resp := client.get(t, "HTTP/1.1", tt.url+"/")
+				if resp.StatusCode != http.StatusOK {
+					t.Fatalf("status = %d, want 200", resp.StatusCode)
+				}
+				if resp.ContentLength != tt.contentLength {
+					t.Errorf("Content-Length = %d, want %d", resp.ContentLength, tt.contentLength)
+				}
+				if tt.contentLength < 0 && (len(resp.TransferEncoding) != 1 || resp.TransferEncoding[0] != "chunked") {
+					t.Errorf("Transfer-Encoding = %v, want chunked", resp.TransferEncoding)
+				}
+				if resp.Close {
+					t.Errorf("response %d closes the client connection", i+1)
+				}
+				if got := readAll(t, resp); got != body {
+					t.Fatalf("body is %d bytes, want %d", len(got), len(body))
+				}
+			}
+		})
+	}
+
+	t.Run("close-delimited to HTTP/1.0", func(t *testing.T) {
+		client := dialProxy(t, addr)
+		resp := client.get(t, "HTTP/1.0", closeDelimited+"/")
+		if len(resp.TransferEncoding) != 0 {
+			t.Errorf("Transfer-Encoding = %v, want none", resp.TransferEncoding)
+		}
+		if !resp.Close && resp.ContentLength < 0 {
+			t.Error("body without length does not close the connection")
+		}
+		if got := readAll(t, resp); got != body {
+			t.Fatalf("body is %d bytes, want %d", len(got), len(body))
+		}
+	})
+}
+
+func TestStreamResponseUpstreamCut(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+	}{
+		{"identity", "HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\n0123456789"},
+		{"chunked", "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\na\r\n0123456789\r\n"},
+	}
+
+	_, addr := startProxy(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upstream := "http://" + rawUpstream(t, tt.response)
+			client := dialProxy(t, addr)
+			resp := client.get(t, "HTTP/1.1", upstream+"/")
+			body, err := io.ReadAll(resp.Body)
+			if err == nil {
+				t.Fatalf("cut-off body of %d bytes read as whole", len(body))
+			}
+		})
+	}
+}
+
+func TestStreamResponsePartialContent(t *testing.T) {
+	content := "0123456789abcdef"
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(content))
+	}))
+	defer upstream.Close()
+
+	server, addr := startProxy(t)
+	// Partial content is relayed untouched even where a rewrite applies
+	if _, err := server.handler.Rules().Add(rules.Rule{
+		Enabled:     true,
+		BodyReplace: &rules.BodyReplace{Find: "2345", Replace: "XXXX"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	client := dialProxy(t, addr)
+	resp := client.get(t, "HTTP/1.1", upstream.URL+"/file", "Range: bytes=2-5")
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("status = %d, want 206", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Content-Range"); got != "bytes 2-5/16" {
+		t.Errorf("Content-Range = %q, want bytes 2-5/16", got)
+	}
+	if got := readAll(t, resp); got != "2345" {
+		t.Errorf("body = %q, want 2345", got)
+	}
+
+	captured := waitCaptures(t, server.Store(), 1)[0]
+	if captured.ContentRange != "bytes 2-5/16" || string(captured.ResponseBody) != "2345" {
+		t.Errorf("capture has Content-Range %q and body %q", captured.ContentRange, captured.ResponseBody)
+	}
+}
@@ -0,0 +1,26 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+)
+
+// TagHeader lets clients label their own traffic, e.g. a test framework
+// marking the requests of one scenario. Its values are recorded as capture
+// tags and the header is never forwarded.
+const TagHeader = "X-GoProxy-Tag"
+
+// takeTags removes the tag header from header and returns its
+// comma-separated values
+func takeTags(header http.Header) []string {
+	var tags []string
+	for _, value := range header.Values(TagHeader) {
+		for _, tag := range strings.Split(value, ",") {
+			if tag = strings.TrimSpace(tag); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	header.Del(TagHeader)
+	return tags
+}
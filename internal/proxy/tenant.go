@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/adamdrake/go_proxy/internal/allowlist"
+	"github.com/adamdrake/go_proxy/internal/capture"
+)
+
+// Tenant is an isolated capture namespace on a shared proxy. Clients
+// reach it by authenticating with its proxy credentials or by connecting
+// to its own listener; their captures go to its store only.
+type Tenant struct {
+	Name        string
+	Username    string
+	Password    string
+	ListenAddr  string
+	MaxRequests int
+}
+
+// ParseTenant parses "name:key=value,...", with keys user, password,
+// listen and max, e.g. "alice:user=alice,password=s3cret,max=500"
+func ParseTenant(s string) (Tenant, error) {
+	name, spec, _ := strings.Cut(s, ":")
+	t := Tenant{Name: strings.TrimSpace(name)}
+	if t.Name == "" {
+		return Tenant{}, fmt.Errorf("tenant %q must be of the form name:key=value,...", s)
+	}
+
+	for _, part := range strings.Split(spec, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(part, "=")
+		if !ok {
+			return Tenant{}, fmt.Errorf("invalid tenant option %q", part)
+		}
+		switch key {
+		case "user":
+			t.Username = value
+		case "password":
+			t.Password = value
+		case "listen":
+			t.ListenAddr = value
+		case "max":
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				return Tenant{}, fmt.Errorf("invalid tenant max %q", value)
+			}
+			t.MaxRequests = n
+		default:
+			return Tenant{}, fmt.Errorf("unknown tenant option %q (want user, password, listen or max)", key)
+		}
+	}
+
+	if t.Username == "" && t.ListenAddr == "" {
+		return Tenant{}, fmt.Errorf("tenant %s needs a user or a listen address", t.Name)
+	}
+	if (t.Username == "") != (t.Password == "") {
+		return Tenant{}, fmt.Errorf("tenant %s needs both user and password", t.Name)
+	}
+	return t, nil
+}
+
+// tenantStore is a tenant's capture store and the pipeline feeding it
+type tenantStore struct {
+	Tenant
+	store    *capture.Store
+	pipeline *capture.Pipeline
+}
+
+type tenantKey struct{}
+
+// withTenant marks a request context with the tenant its captures
+// belong to
+func withTenant(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, name)
+}
+
+// tenantFrom returns the tenant on ctx, or "" for the default store
+func tenantFrom(ctx context.Context) string {
+	name, _ := ctx.Value(tenantKey{}).(string)
+	return name
+}
+
+// selectTenant picks the tenant a proxy request belongs to: the one whose
+// credentials it presents, else the one owning the listener it arrived
+// on, else the default store. It reports false for credentials matching
+// no tenant.
+func (h *Handler) selectTenant(r *http.Request) (string, bool) {
+	auth := r.Header.Get("Proxy-Authorization")
+	if auth == "" || !h.tenantCredentials {
+		return tenantFrom(r.Context()), true
+	}
+	user, password, ok := (&http.Request{Header: http.Header{"Authorization": {auth}}}).BasicAuth()
+	if !ok {
+		return "", false
+	}
+	for name, t := range h.tenants {
+		if t.Username == "" {
+			continue
+		}
+		userOK := subtle.ConstantTimeCompare([]byte(user), []byte(t.Username)) == 1
+		passwordOK := subtle.ConstantTimeCompare([]byte(password), []byte(t.Password)) == 1
+		if userOK && passwordOK {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// tenantFor returns the store and pipeline of a tenant, falling back to
+// the default ones
+func (h *Handler) tenantFor(name string) (*capture.Store, *capture.Pipeline) {
+	if t, ok := h.tenants[name]; ok {
+		return t.store, t.pipeline
+	}
+	return h.store, h.pipeline
+}
+
+// TenantStore returns the capture store of the named tenant ("" for the
+// default store), or nil if there is no such tenant
+func (h *Handler) TenantStore(name string) *capture.Store {
+	if name == "" {
+		return h.store
+	}
+	if t, ok := h.tenants[name]; ok {
+		return t.store
+	}
+	return nil
+}
+
+// Tenants returns the configured tenants, by name
+func (h *Handler) Tenants() []Tenant {
+	tenants := make([]Tenant, 0, len(h.tenants))
+	for _, t := range h.tenants {
+		tenants = append(tenants, t.Tenant)
+	}
+	sort.Slice(tenants, func(i, j int) bool { return tenants[i].Name < tenants[j].Name })
+	return tenants
+}
+
+// startTenantListeners serves tenants that have their own listener, with
+// every connection on it marked as the tenant's
+func (s *Server) startTenantListeners() error {
+	for _, t := range s.config.Tenants {
+		if t.ListenAddr == "" {
+			continue
+		}
+		listener, err := net.Listen("tcp", t.ListenAddr)
+		if err != nil {
+			return fmt.Errorf("tenant %s: %w", t.Name, err)
+		}
+		log.Printf("Tenant %s listening on %s", t.Name, listener.Addr())
+
+		name := t.Name
+		server := s.newHTTPServer()
+		server.Addr = t.ListenAddr
+		server.ConnContext = func(ctx context.Context, c net.Conn) context.Context {
+			return withTenant(withClientWire(ctx, c), name)
+		}
+		s.tenantServers = append(s.tenantServers, server)
+		listener = allowlist.Listener(listener, s.config.AllowClients)
+		go server.Serve(&wireListener{Listener: listener, limit: wireLimit(s.config.CaptureRaw, s.config.MaxRequestSize)})
+	}
+	return nil
+}
@@ -0,0 +1,316 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adamdrake/go_proxy/internal/hostmatch"
+	"github.com/adamdrake/go_proxy/internal/rules"
+)
+
+// Timeouts bounds each phase of an upstream exchange. Zero means no limit;
+// a negative field is unset, so as an override it keeps the value
+// underneath (see Unset).
+type Timeouts struct {
+	// Connect covers DNS resolution and TCP connection setup
+	Connect time.Duration
+	// TLSHandshake covers the TLS handshake with the upstream server
+	TLSHandshake time.Duration
+	// ResponseHeader is how long to wait for response headers once the
+	// request has been sent
+	ResponseHeader time.Duration
+	// BodyRead is how long reading the response body may take
+	BodyRead time.Duration
+}
+
+// Unset marks a phase an override leaves alone
+const Unset time.Duration = -1
+
+// UnsetTimeouts returns an override that changes no phase
+func UnsetTimeouts() Timeouts {
+	return Timeouts{Connect: Unset, TLSHandshake: Unset, ResponseHeader: Unset, BodyRead: Unset}
+}
+
+// DefaultTimeouts returns the global upstream timeouts. Body reads are
+// unlimited, since downloads and streams last as long as they need to;
+// per-host and per-rule overrides can bound them.
+func DefaultTimeouts() Timeouts {
+	return Timeouts{
+		Connect:        30 * time.Second,
+		TLSHandshake:   10 * time.Second,
+		ResponseHeader: 60 * time.Second,
+	}
+}
+
+// merge returns t with every set field of o applied on top, zero
+// included
+func (t Timeouts) merge(o Timeouts) Timeouts {
+	if o.Connect >= 0 {
+		t.Connect = o.Connect
+	}
+	if o.TLSHandshake >= 0 {
+		t.TLSHandshake = o.TLSHandshake
+	}
+	if o.ResponseHeader >= 0 {
+		t.ResponseHeader = o.ResponseHeader
+	}
+	if o.BodyRead >= 0 {
+		t.BodyRead = o.BodyRead
+	}
+	return t
+}
+
+// timeoutsFromOverride converts a rule's timeout override; phases it
+// does not name stay unset
+func timeoutsFromOverride(o *rules.TimeoutOverride) Timeouts {
+	seconds := func(s *float64) time.Duration {
+		if s == nil {
+			return Unset
+		}
+		return time.Duration(*s * float64(time.Second))
+	}
+	return Timeouts{
+		Connect:        seconds(o.ConnectSeconds),
+		TLSHandshake:   seconds(o.TLSHandshakeSeconds),
+		ResponseHeader: seconds(o.ResponseHeaderSeconds),
+		BodyRead:       seconds(o.BodyReadSeconds),
+	}
+}
+
+// TimeoutRule overrides timeouts for hosts matching Pattern
+type TimeoutRule struct {
+	Pattern  string
+	Timeouts Timeouts
+}
+
+// ParseTimeoutRule parses "pattern=phase:duration,..." where phase is
+// connect, tls, header or body, e.g. "*.cdn.example=header:2m,body:30m".
+// A duration of 0 lifts the limit; phases not named keep the global value.
+func ParseTimeoutRule(s string) (TimeoutRule, error) {
+	pattern, spec, ok := strings.Cut(s, "=")
+	if !ok || strings.TrimSpace(pattern) == "" {
+		return TimeoutRule{}, fmt.Errorf("timeout rule %q must be of the form pattern=phase:duration,...", s)
+	}
+
+	t := UnsetTimeouts()
+	for _, part := range strings.Split(spec, ",") {
+		phase, value, ok := strings.Cut(strings.TrimSpace(part), ":")
+		if !ok {
+			return TimeoutRule{}, fmt.Errorf("invalid timeout %q", part)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil {
+			return TimeoutRule{}, fmt.Errorf("invalid timeout %q: %w", part, err)
+		}
+		if d < 0 {
+			return TimeoutRule{}, fmt.Errorf("invalid timeout %q: must not be negative", part)
+		}
+		switch strings.TrimSpace(phase) {
+		case "connect":
+			t.Connect = d
+		case "tls":
+			t.TLSHandshake = d
+		case "header":
+			t.ResponseHeader = d
+		case "body":
+			t.BodyRead = d
+		default:
+			return TimeoutRule{}, fmt.Errorf("unknown timeout phase %q (want connect, tls, header or body)", phase)
+		}
+	}
+	return TimeoutRule{Pattern: strings.TrimSpace(pattern), Timeouts: t}, nil
+}
+
+// timeoutsFor returns the global timeouts with the first matching host
+// rule applied
+func (h *Handler) timeoutsFor(host string) Timeouts {
+	for _, rule := range h.timeoutRules {
+		if hostmatch.Match(rule.Pattern, host) {
+			return h.timeouts.merge(rule.Timeouts)
+		}
+	}
+	return h.timeouts
+}
+
+type timeoutsKey struct{}
+
+// withTimeouts attaches the effective timeouts to an outgoing request's
+// context, where the dialers find them
+func withTimeouts(ctx context.Context, t Timeouts) context.Context {
+	return context.WithValue(ctx, timeoutsKey{}, t)
+}
+
+// timeoutsFrom returns the timeouts on ctx, or the global timeouts
+func (h *Handler) timeoutsFrom(ctx context.Context) Timeouts {
+	if t, ok := ctx.Value(timeoutsKey{}).(Timeouts); ok {
+		return t
+	}
+	return h.timeouts
+}
+
+// timeoutError reports which phase of an exchange timed out
+type timeoutError struct {
+	phase   string
+	timeout time.Duration
+}
+
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("upstream %s timeout after %s", e.phase, e.timeout)
+}
+
+// Timeout marks the error as a timeout for net.Error checks
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+// dialTimeoutContext dials with the connect timeout from ctx
+func (h *Handler) dialTimeoutContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	t := h.timeoutsFrom(ctx)
+	if t.Connect > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.Connect)
+		defer cancel()
+	}
+
+	conn, err := h.dialContext(ctx, network, addr)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: &timeoutError{phase: "connect", timeout: t.Connect}}
+	}
+	return conn, err
+}
+
+// dialTLSContext dials and performs the TLS handshake with the handshake
+// timeout from ctx. HTTP/2 is offered through ALPN unless it is off or
+// ctx asks for HTTP/1.1; the TCP connection under an HTTP/2 one is
+// wrapped so the pool learns when it closes.
+func (h *Handler) dialTLSContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := h.dialTimeoutContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	offerH2 := h.upstreamHTTP2 && !http1Only(ctx)
+	if offerH2 {
+		conn = &wireConn{Conn: conn}
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	config := h.tlsConfig.Clone()
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+	if offerH2 {
+		config.NextProtos = []string{"h2", "http/1.1"}
+	}
+
+	t := h.timeoutsFrom(ctx)
+	hsCtx := ctx
+	if t.TLSHandshake > 0 {
+		var cancel context.CancelFunc
+		hsCtx, cancel = context.WithTimeout(ctx, t.TLSHandshake)
+		defer cancel()
+	}
+
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(hsCtx); err != nil {
+		conn.Close()
+		if hsCtx.Err() == context.DeadlineExceeded {
+			return nil, &timeoutError{phase: "TLS handshake", timeout: t.TLSHandshake}
+		}
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// doAttempt sends a single request, enforcing the response-header and
+// body-read timeouts from its context
+func (h *Handler) doAttempt(req *http.Request) (*http.Response, error) {
+	t := h.timeoutsFrom(req.Context())
+
+	ctx, cancel := context.WithCancelCause(req.Context())
+	var timer *time.Timer
+	if t.ResponseHeader > 0 {
+		timer = time.AfterFunc(t.ResponseHeader, func() {
+			cancel(&timeoutError{phase: "response header", timeout: t.ResponseHeader})
+		})
+	}
+
+	resp, err := h.httpClient.Do(req.WithContext(ctx))
+	if timer != nil {
+		timer.Stop()
+	}
+	if err != nil {
+		cause := context.Cause(ctx)
+		cancel(nil)
+		if te, ok := cause.(*timeoutError); ok {
+			return nil, te
+		}
+		return nil, err
+	}
+
+	// Upgraded connections stay open until the relay closes them
+	if rwc, ok := resp.Body.(io.ReadWriteCloser); ok && resp.StatusCode == http.StatusSwitchingProtocols {
+		resp.Body = &upgradedBody{ReadWriteCloser: rwc, cancel: cancel}
+		return resp, nil
+	}
+
+	body := &timeoutBody{ReadCloser: resp.Body, ctx: ctx, cancel: cancel}
+	if t.BodyRead > 0 {
+		body.timer = time.AfterFunc(t.BodyRead, func() {
+			cancel(&timeoutError{phase: "body read", timeout: t.BodyRead})
+		})
+	}
+	resp.Body = body
+	return resp, nil
+}
+
+// timeoutBody reports body-read timeouts and releases the attempt's
+// context when closed
+type timeoutBody struct {
+	io.ReadCloser
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	timer  *time.Timer
+	once   sync.Once
+}
+
+func (b *timeoutBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil && err != io.EOF {
+		if te, ok := context.Cause(b.ctx).(*timeoutError); ok {
+			return n, te
+		}
+	}
+	return n, err
+}
+
+func (b *timeoutBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() {
+		if b.timer != nil {
+			b.timer.Stop()
+		}
+		b.cancel(nil)
+	})
+	return err
+}
+
+// upgradedBody releases the attempt's context when an upgraded connection
+// is closed
+type upgradedBody struct {
+	io.ReadWriteCloser
+	cancel context.CancelCauseFunc
+}
+
+func (b *upgradedBody) Close() error {
+	b.cancel(nil)
+	return b.ReadWriteCloser.Close()
+}
@@ -0,0 +1,39 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+	"github.com/adamdrake/go_proxy/internal/rules"
+)
+
+func TestZeroTimeoutLiftsLimit(t *testing.T) {
+	h := NewHandler(capture.NewStore(1), Config{Timeouts: &Timeouts{Connect: 0, TLSHandshake: Unset, ResponseHeader: 0, BodyRead: Unset}})
+	want := Timeouts{TLSHandshake: DefaultTimeouts().TLSHandshake}
+	if h.timeouts != want {
+		t.Fatalf("global timeouts %+v, want %+v", h.timeouts, want)
+	}
+
+	rule, err := ParseTimeoutRule("*.example.com=tls:0,body:5m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.timeoutRules = []TimeoutRule{rule}
+	want = Timeouts{BodyRead: 5 * time.Minute}
+	if got := h.timeoutsFor("a.example.com"); got != want {
+		t.Fatalf("host timeouts %+v, want %+v", got, want)
+	}
+
+	zero := 0.0
+	got := want.merge(timeoutsFromOverride(&rules.TimeoutOverride{BodyReadSeconds: &zero}))
+	if got != (Timeouts{}) {
+		t.Fatalf("rule override gave %+v, want no limits", got)
+	}
+}
+
+func TestParseTimeoutRuleRejectsNegative(t *testing.T) {
+	if _, err := ParseTimeoutRule("*=connect:-1s"); err == nil {
+		t.Fatal("negative timeout accepted")
+	}
+}
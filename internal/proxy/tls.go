@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+)
+
+// UpstreamTLSConfig controls TLS for connections the proxy makes to servers
+type UpstreamTLSConfig struct {
+	// MinVersion is a tls.VersionTLS* constant; zero uses the Go default
+	MinVersion uint16
+	// CipherSuites restricts TLS 1.0-1.2 cipher suites; empty uses the Go default
+	CipherSuites []uint16
+	// RootCAs replaces the system roots when set
+	RootCAs *x509.CertPool
+	// InsecureSkipVerify disables certificate verification entirely
+	InsecureSkipVerify bool
+}
+
+// http1OnlyKey marks outgoing request contexts whose connections must
+// speak HTTP/1.1
+type http1OnlyKey struct{}
+
+// withHTTP1Only keeps HTTP/2 from being negotiated on connections dialed
+// for ctx, for requests HTTP/2 cannot carry (WebSocket upgrades, headers
+// written in the client's order)
+func withHTTP1Only(ctx context.Context) context.Context {
+	return context.WithValue(ctx, http1OnlyKey{}, true)
+}
+
+func http1Only(ctx context.Context) bool {
+	only, _ := ctx.Value(http1OnlyKey{}).(bool)
+	return only
+}
+
+// clientTLSConfig builds the tls.Config used by the upstream transport
+func (c UpstreamTLSConfig) clientTLSConfig() *tls.Config {
+	if c.InsecureSkipVerify {
+		log.Println("WARNING: upstream TLS certificate verification is DISABLED (-upstream-insecure).")
+		log.Println("WARNING: the proxy will accept any certificate, including from attackers. Use only for testing.")
+	}
+
+	return &tls.Config{
+		MinVersion:         c.MinVersion,
+		CipherSuites:       c.CipherSuites,
+		RootCAs:            c.RootCAs,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+}
+
+// ParseTLSVersion parses "1.0", "1.1", "1.2" or "1.3"
+func ParseTLSVersion(s string) (uint16, error) {
+	switch strings.TrimPrefix(strings.ToLower(strings.TrimSpace(s)), "tls") {
+	case "":
+		return 0, nil
+	case "1.0", "10":
+		return tls.VersionTLS10, nil
+	case "1.1", "11":
+		return tls.VersionTLS11, nil
+	case "1.2", "12":
+		return tls.VersionTLS12, nil
+	case "1.3", "13":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("unknown TLS version %q", s)
+	}
+}
+
+// ParseCipherSuites parses a comma-separated list of cipher suite names as
+// reported by tls.CipherSuiteName (e.g. "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256")
+func ParseCipherSuites(s string) ([]uint16, error) {
+	known := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+	for _, suite := range tls.InsecureCipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+
+	var ids []uint16
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// LoadCertPool reads a PEM bundle of CA certificates
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
+
+// recordTLSState stores the negotiated TLS parameters on a capture
+func recordTLSState(captured *capture.CapturedRequest, state *tls.ConnectionState) {
+	if state == nil {
+		return
+	}
+	captured.TLSVersion = tls.VersionName(state.Version)
+	captured.TLSCipherSuite = tls.CipherSuiteName(state.CipherSuite)
+	captured.UpstreamCerts = capture.CertChain(state.PeerCertificates)
+}
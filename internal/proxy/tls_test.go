@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"crypto/x509"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUpstreamProtocolNegotiation(t *testing.T) {
+	upstream := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	}))
+	upstream.EnableHTTP2 = true
+	upstream.StartTLS()
+	defer upstream.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(upstream.Certificate())
+
+	tests := []struct {
+		name   string
+		config func(*Config)
+		header []string
+		want   string
+	}{
+		{"default", func(*Config) {}, nil, "HTTP/2.0"},
+		{"off", func(c *Config) { c.UpstreamHTTP2 = false }, nil, "HTTP/1.1"},
+		{"raw capture", func(c *Config) { c.CaptureRaw = true }, nil, "HTTP/1.1"},
+		{"ordered headers", func(c *Config) { c.PreserveHeaderOrder = true }, []string{"X-First: 1"}, "HTTP/1.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := DefaultConfig()
+			config.UpstreamTLS.RootCAs = roots
+			tt.config(&config)
+			server, addr := startProxyWith(t, config)
+
+			client := dialProxy(t, addr)
+			for i := 0; i < 2; i++ {
+				resp := client.get(t, "HTTP/1.1", upstream.URL+"/", tt.header...)
+				if got := readAll(t, resp); got != tt.want {
+					t.Fatalf("upstream saw %s, want %s", got, tt.want)
+				}
+			}
+
+			captures := waitCaptures(t, server.Store(), 2)
+			for _, c := range captures {
+				if c.UpstreamProto != tt.want {
+					t.Errorf("upstream_proto = %q, want %q", c.UpstreamProto, tt.want)
+				}
+				if c.UpstreamIP != "127.0.0.1" {
+					t.Errorf("upstream_ip = %q, want 127.0.0.1", c.UpstreamIP)
+				}
+			}
+			if tt.want == "HTTP/2.0" {
+				if !captures[1].UpstreamConnReused {
+					t.Error("second HTTP/2 request did not reuse the connection")
+				}
+				if open := server.ConnPool().Stats().Open; open != 1 {
+					t.Errorf("pool has %d open connections, want 1", open)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,209 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+	"github.com/adamdrake/go_proxy/internal/seal"
+)
+
+// uploadHeadSize is how much of a spooled upload is kept in memory as the
+// capture's request body
+const uploadHeadSize = 64 * 1024
+
+// uploadFilePrefix names spooled upload files, so the janitor only ever
+// removes its own
+const uploadFilePrefix = "go_proxy-upload-"
+
+// uploadSpool streams request bodies above a threshold to temporary files
+// instead of memory, hashing them on the way. Files are forwarded from disk
+// and kept for the retention period so they can be downloaded from the API.
+type uploadSpool struct {
+	threshold int64
+	dir       string
+	retention time.Duration
+
+	// key, when set, encrypts files at rest
+	key []byte
+}
+
+// newUploadSpool returns a spool for bodies larger than threshold bytes, or
+// nil when threshold is zero. With a retention period, a janitor removes
+// older files; without one, files are removed once forwarded.
+func newUploadSpool(threshold int64, dir string, retention time.Duration, key []byte) *uploadSpool {
+	if threshold <= 0 {
+		return nil
+	}
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	s := &uploadSpool{threshold: threshold, dir: dir, retention: retention, key: key}
+	if retention > 0 {
+		go s.janitor()
+	}
+	return s
+}
+
+// read reads body, returning it in memory when it fits the threshold and
+// otherwise spooling it to a file described by the returned Upload, whose
+// first bytes come back as data
+func (s *uploadSpool) read(body io.Reader) (data []byte, upload *capture.Upload, err error) {
+	data, err = io.ReadAll(io.LimitReader(body, s.threshold+1))
+	if err != nil || int64(len(data)) <= s.threshold {
+		return data, nil, err
+	}
+
+	f, err := os.CreateTemp(s.dir, uploadFilePrefix+"*")
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	var dst io.Writer = f
+	var sealed *seal.Writer
+	if s.key != nil {
+		if sealed, err = seal.NewWriter(f, s.key); err != nil {
+			os.Remove(f.Name())
+			return nil, nil, err
+		}
+		dst = sealed
+	}
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(dst, hash), io.MultiReader(bytes.NewReader(data), body))
+	if err == nil && sealed != nil {
+		err = sealed.Close()
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, nil, err
+	}
+
+	upload = &capture.Upload{
+		Size:      size,
+		SHA256:    hex.EncodeToString(hash.Sum(nil)),
+		File:      f.Name(),
+		Encrypted: s.key != nil,
+	}
+	return data[:min(len(data), uploadHeadSize)], upload, nil
+}
+
+// done releases a spooled upload after forwarding when files are not
+// retained
+func (s *uploadSpool) done(upload *capture.Upload) {
+	if upload != nil && s.retention <= 0 {
+		os.Remove(upload.File)
+	}
+}
+
+// janitor removes spooled files older than the retention period
+func (s *uploadSpool) janitor() {
+	ticker := time.NewTicker(min(s.retention, time.Minute))
+	defer ticker.Stop()
+	for range ticker.C {
+		entries, err := os.ReadDir(s.dir)
+		if err != nil {
+			continue
+		}
+		for _, entry := range entries {
+			if !strings.HasPrefix(entry.Name(), uploadFilePrefix) {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil || time.Since(info.ModTime()) < s.retention {
+				continue
+			}
+			path := filepath.Join(s.dir, entry.Name())
+			if err := os.Remove(path); err != nil {
+				log.Printf("Failed to remove spooled upload %s: %v", path, err)
+			}
+		}
+	}
+}
+
+// open reads a spooled upload back, decrypting it if needed. Only files
+// the spool wrote are opened: captures can come from imports, and their
+// File must not reach anywhere else on disk.
+func (s *uploadSpool) open(upload *capture.Upload) (io.ReadCloser, error) {
+	if !s.owns(upload.File) {
+		return nil, fmt.Errorf("%s is not a spooled upload", upload.File)
+	}
+	f, err := os.Open(upload.File)
+	if err != nil || !upload.Encrypted {
+		return f, err
+	}
+	if s.key == nil {
+		f.Close()
+		return nil, errors.New("spooled upload is encrypted and no capture key is configured")
+	}
+	r, err := seal.NewReader(f, s.key)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{r, f}, nil
+}
+
+// owns reports whether path names a spool file directly in the spool
+// directory
+func (s *uploadSpool) owns(path string) bool {
+	dir, err := filepath.Abs(s.dir)
+	if err != nil {
+		return false
+	}
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	return filepath.Dir(path) == dir && strings.HasPrefix(filepath.Base(path), uploadFilePrefix)
+}
+
+// forward makes req send a spooled upload from its file
+func (s *uploadSpool) forward(req *http.Request, upload *capture.Upload) error {
+	body, err := s.open(upload)
+	if err != nil {
+		return err
+	}
+	req.Body = body
+	req.ContentLength = upload.Size
+	req.GetBody = func() (io.ReadCloser, error) {
+		return s.open(upload)
+	}
+	return nil
+}
+
+// OpenUpload reads back the full body of a spooled upload
+func (h *Handler) OpenUpload(upload *capture.Upload) (io.ReadCloser, error) {
+	if h.uploads == nil {
+		return nil, errors.New("upload spooling is disabled")
+	}
+	return h.uploads.open(upload)
+}
+
+// uploadFailed answers and records a request whose body could not be
+// spooled or read back
+func (h *Handler) uploadFailed(w http.ResponseWriter, r *http.Request, captured *capture.CapturedRequest, startTime time.Time, err error) {
+	log.Printf("[HTTP] %s %s -> upload spool failed: %v", r.Method, captured.URL, err)
+	http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	captured.StatusCode = http.StatusInternalServerError
+	captured.Error = err.Error()
+	captured.Duration = time.Since(startTime)
+	requestHeader := r.Header
+	h.record(captured, func() {
+		captured.RequestHeaders = cloneHeaders(requestHeader)
+	})
+}
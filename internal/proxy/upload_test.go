@@ -0,0 +1,41 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+)
+
+func TestUploadSpoolOpensOnlyItsFiles(t *testing.T) {
+	dir := t.TempDir()
+	spool := &uploadSpool{threshold: 1, dir: dir}
+	own := filepath.Join(dir, uploadFilePrefix+"1")
+	other := filepath.Join(dir, "secret")
+	for _, path := range []string{own, other} {
+		if err := os.WriteFile(path, []byte("data"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		file string
+		ok   bool
+	}{
+		{own, true},
+		{other, false},
+		{filepath.Join(dir, "sub", "..", uploadFilePrefix+"1"), true},
+		{filepath.Join(dir, "..", uploadFilePrefix+"1"), false},
+		{"/etc/passwd", false},
+	}
+	for _, tt := range tests {
+		f, err := spool.open(&capture.Upload{File: tt.file})
+		if f != nil {
+			f.Close()
+		}
+		if (err == nil) != tt.ok {
+			t.Errorf("open(%s) error = %v, want success %v", tt.file, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,597 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+	"github.com/adamdrake/go_proxy/internal/rules"
+)
+
+// maxWebSocketMessages caps the messages kept on a single capture
+const maxWebSocketMessages = 1000
+
+// WebSocket opcodes (RFC 6455 section 5.2)
+const (
+	wsOpContinuation = 0x0
+	wsOpText         = 0x1
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+)
+
+// ErrWebSocketNotFound is returned for unknown or closed connections
+var ErrWebSocketNotFound = errors.New("websocket connection not found")
+
+// isWebSocketUpgrade reports whether r asks to upgrade to WebSocket
+func isWebSocketUpgrade(r *http.Request) bool {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, v := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// prepareWebSocketUpgrade restores the upgrade headers removed as
+// hop-by-hop. Extensions are stripped so frames stay uncompressed and can
+// be captured and rewritten.
+func prepareWebSocketUpgrade(header http.Header) {
+	header.Set("Connection", "Upgrade")
+	header.Set("Upgrade", "websocket")
+	header.Del("Sec-WebSocket-Extensions")
+}
+
+// wsFrame is a single WebSocket frame with its payload unmasked
+type wsFrame struct {
+	fin     bool
+	opcode  byte
+	payload []byte
+}
+
+// readWSFrame reads one frame, rejecting payloads larger than limit
+func readWSFrame(r io.Reader, limit int64) (wsFrame, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return wsFrame{}, err
+	}
+	if head[0]&0x70 != 0 {
+		return wsFrame{}, errors.New("websocket frame uses reserved bits")
+	}
+	f := wsFrame{fin: head[0]&0x80 != 0, opcode: head[0] & 0x0f}
+
+	n := uint64(head[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return wsFrame{}, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return wsFrame{}, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if n > uint64(limit) {
+		return wsFrame{}, fmt.Errorf("websocket frame of %d bytes exceeds limit", n)
+	}
+
+	var key [4]byte
+	masked := head[1]&0x80 != 0
+	if masked {
+		if _, err := io.ReadFull(r, key[:]); err != nil {
+			return wsFrame{}, err
+		}
+	}
+	f.payload = make([]byte, n)
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		return wsFrame{}, err
+	}
+	if masked {
+		for i := range f.payload {
+			f.payload[i] ^= key[i%4]
+		}
+	}
+	return f, nil
+}
+
+// writeWSFrame writes f, masking it with a fresh key when mask is set
+func writeWSFrame(w io.Writer, f wsFrame, mask bool) error {
+	buf := make([]byte, 0, 14+len(f.payload))
+	b0 := f.opcode
+	if f.fin {
+		b0 |= 0x80
+	}
+	buf = append(buf, b0)
+
+	var maskBit byte
+	if mask {
+		maskBit = 0x80
+	}
+	switch n := len(f.payload); {
+	case n < 126:
+		buf = append(buf, maskBit|byte(n))
+	case n <= 0xffff:
+		buf = append(buf, maskBit|126)
+		buf = binary.BigEndian.AppendUint16(buf, uint16(n))
+	default:
+		buf = append(buf, maskBit|127)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(n))
+	}
+
+	if !mask {
+		buf = append(buf, f.payload...)
+	} else {
+		var key [4]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return err
+		}
+		buf = append(buf, key[:]...)
+		start := len(buf)
+		buf = append(buf, f.payload...)
+		for i := range buf[start:] {
+			buf[start+i] ^= key[i%4]
+		}
+	}
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// wsMessageType names a data or close opcode
+func wsMessageType(opcode byte) string {
+	switch opcode {
+	case wsOpText:
+		return "text"
+	case wsOpBinary:
+		return "binary"
+	case wsOpClose:
+		return "close"
+	}
+	return fmt.Sprintf("opcode-%d", opcode)
+}
+
+// wsPeer is the writing end towards one side of a relayed connection.
+// Writes are serialized so injected messages never interleave with relayed
+// frames.
+type wsPeer struct {
+	mu sync.Mutex
+	w  io.Writer
+	// Frames sent to servers must be masked
+	mask bool
+}
+
+func (p *wsPeer) send(f wsFrame) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return writeWSFrame(p.w, f, p.mask)
+}
+
+// webSocketSession relays one upgraded connection
+type webSocketSession struct {
+	id         string
+	url        string
+	started    time.Time
+	outcome    *rules.Outcome
+	maxMessage int64
+
+	// client receives downstream messages, server upstream ones
+	client *wsPeer
+	server *wsPeer
+
+	// mqtt decodes MQTT carried in binary messages
+	mqtt *mqttTap
+
+	mu        sync.Mutex
+	messages  []capture.WebSocketMessage
+	count     int
+	rewritten int
+	dropped   int
+	injected  int
+
+	// Messages dry-run rules would have rewritten or dropped
+	wouldRewrite int
+	wouldDrop    int
+}
+
+// peer returns the side a message travelling in direction is written to
+func (s *webSocketSession) peer(direction string) *wsPeer {
+	if direction == rules.Upstream {
+		return s.server
+	}
+	return s.client
+}
+
+// add records a message on the session
+func (s *webSocketSession) add(msg capture.WebSocketMessage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.count++
+	switch {
+	case msg.Injected:
+		s.injected++
+	case msg.Dropped:
+		s.dropped++
+	case msg.Modified:
+		s.rewritten++
+	}
+	switch {
+	case msg.WouldDrop:
+		s.wouldDrop++
+	case msg.WouldRuleID != "":
+		s.wouldRewrite++
+	}
+	if len(s.messages) < maxWebSocketMessages {
+		s.messages = append(s.messages, msg)
+	}
+}
+
+// pump reads frames from src and relays them in direction until src fails.
+// Fragmented messages are reassembled and forwarded as a single frame so
+// rewrites see the whole payload.
+func (s *webSocketSession) pump(src io.Reader, direction string) error {
+	dst := s.peer(direction)
+
+	var opcode byte
+	var message []byte
+	for {
+		f, err := readWSFrame(src, s.maxMessage)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case f.opcode >= wsOpClose:
+			// Control frames may arrive between fragments and are
+			// passed through untouched
+			if err := dst.send(f); err != nil {
+				return err
+			}
+			if f.opcode == wsOpClose {
+				s.add(capture.WebSocketMessage{
+					Timestamp: time.Now(),
+					Direction: direction,
+					Type:      wsMessageType(f.opcode),
+					Payload:   f.payload,
+				})
+			}
+			continue
+		case f.opcode == wsOpContinuation:
+			if opcode == 0 {
+				return errors.New("websocket continuation frame without a message")
+			}
+			message = append(message, f.payload...)
+		default:
+			opcode = f.opcode
+			message = f.payload
+		}
+
+		if int64(len(message)) > s.maxMessage {
+			return fmt.Errorf("websocket message exceeds %d bytes", s.maxMessage)
+		}
+		if !f.fin {
+			continue
+		}
+
+		if err := s.relay(dst, direction, opcode, message); err != nil {
+			return err
+		}
+		opcode, message = 0, nil
+	}
+}
+
+// relay applies rewrite rules to a complete message and forwards it
+func (s *webSocketSession) relay(dst *wsPeer, direction string, opcode byte, payload []byte) error {
+	msg := capture.WebSocketMessage{
+		Timestamp: time.Now(),
+		Direction: direction,
+		Type:      wsMessageType(opcode),
+	}
+
+	out, ruleID, drop := s.outcome.RewriteMessage(direction, payload)
+	msg.RuleID = ruleID
+	if drop {
+		msg.Dropped = true
+		msg.Payload = payload
+		s.add(msg)
+		return nil
+	}
+
+	msg.Modified = ruleID != ""
+	msg.Payload = out
+	if shadow := s.outcome.Shadow(); shadow != nil {
+		_, msg.WouldRuleID, msg.WouldDrop = shadow.RewriteMessage(direction, out)
+	}
+	s.add(msg)
+	s.observe(direction, opcode, out)
+	return dst.send(wsFrame{fin: true, opcode: opcode, payload: out})
+}
+
+// inject sends a synthetic message in direction
+func (s *webSocketSession) inject(direction string, binary bool, payload []byte) error {
+	opcode := byte(wsOpText)
+	if binary {
+		opcode = wsOpBinary
+	}
+	if err := s.peer(direction).send(wsFrame{fin: true, opcode: opcode, payload: payload}); err != nil {
+		return err
+	}
+	s.add(capture.WebSocketMessage{
+		Timestamp: time.Now(),
+		Direction: direction,
+		Type:      wsMessageType(opcode),
+		Payload:   payload,
+		Injected:  true,
+	})
+	s.observe(direction, opcode, payload)
+	return nil
+}
+
+// observe passes binary messages sent on to the MQTT decoder
+func (s *webSocketSession) observe(direction string, opcode byte, payload []byte) {
+	if s.mqtt == nil || opcode != wsOpBinary {
+		return
+	}
+	if direction == rules.Upstream {
+		s.mqtt.fromClient(payload)
+	} else {
+		s.mqtt.fromServer(payload)
+	}
+}
+
+// actions summarizes rule activity for the capture: what rules did, and
+// what dry-run rules would have done
+func (s *webSocketSession) actions() (applied, would []capture.ActionRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return wsActions(s.rewritten, s.dropped, s.injected), wsActions(s.wouldRewrite, s.wouldDrop, 0)
+}
+
+func wsActions(rewritten, dropped, injected int) []capture.ActionRecord {
+	var parts []string
+	if rewritten > 0 {
+		parts = append(parts, fmt.Sprintf("rewrote %d", rewritten))
+	}
+	if dropped > 0 {
+		parts = append(parts, fmt.Sprintf("dropped %d", dropped))
+	}
+	if injected > 0 {
+		parts = append(parts, fmt.Sprintf("injected %d", injected))
+	}
+	if len(parts) == 0 {
+		return nil
+	}
+	return []capture.ActionRecord{{
+		Type:   capture.ActionWebSocket,
+		Detail: strings.Join(parts, ", ") + " messages",
+	}}
+}
+
+// info describes the session for the API
+func (s *webSocketSession) info(withMessages bool) WebSocketSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	info := WebSocketSession{
+		ID:           s.id,
+		URL:          s.url,
+		Started:      s.started,
+		MessageCount: s.count,
+	}
+	if withMessages {
+		info.Messages = append([]capture.WebSocketMessage(nil), s.messages...)
+	}
+	return info
+}
+
+// WebSocketSession describes a live WebSocket connection. ID is the ID the
+// connection's capture is stored under once it closes.
+type WebSocketSession struct {
+	ID           string                     `json:"id"`
+	URL          string                     `json:"url"`
+	Started      time.Time                  `json:"started"`
+	MessageCount int                        `json:"message_count"`
+	Messages     []capture.WebSocketMessage `json:"messages,omitempty"`
+}
+
+// WebSockets tracks live WebSocket connections
+type WebSockets struct {
+	mu       sync.RWMutex
+	sessions map[string]*webSocketSession
+}
+
+// NewWebSockets creates an empty connection registry
+func NewWebSockets() *WebSockets {
+	return &WebSockets{sessions: make(map[string]*webSocketSession)}
+}
+
+func (ws *WebSockets) add(s *webSocketSession) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ws.sessions[s.id] = s
+}
+
+func (ws *WebSockets) remove(id string) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	delete(ws.sessions, id)
+}
+
+// List returns the live connections, oldest first, without messages
+func (ws *WebSockets) List() []WebSocketSession {
+	ws.mu.RLock()
+	defer ws.mu.RUnlock()
+
+	result := make([]WebSocketSession, 0, len(ws.sessions))
+	for _, s := range ws.sessions {
+		result = append(result, s.info(false))
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Started.Before(result[j].Started)
+	})
+	return result
+}
+
+// Get returns a live connection with the messages relayed so far
+func (ws *WebSockets) Get(id string) (WebSocketSession, bool) {
+	ws.mu.RLock()
+	s, ok := ws.sessions[id]
+	ws.mu.RUnlock()
+	if !ok {
+		return WebSocketSession{}, false
+	}
+	return s.info(true), true
+}
+
+// Inject sends a synthetic text or binary message over a live connection,
+// "downstream" to the client or "upstream" to the server
+func (ws *WebSockets) Inject(id, direction string, binary bool, payload []byte) error {
+	if direction != rules.Upstream && direction != rules.Downstream {
+		return fmt.Errorf("unknown direction %q (want %s or %s)", direction, rules.Upstream, rules.Downstream)
+	}
+
+	ws.mu.RLock()
+	s, ok := ws.sessions[id]
+	ws.mu.RUnlock()
+	if !ok {
+		return ErrWebSocketNotFound
+	}
+	return s.inject(direction, binary, payload)
+}
+
+// relayWebSocket completes a WebSocket upgrade with the client and relays
+// messages between it and the upstream server until either side closes.
+// The capture is stored when the connection ends.
+func (h *Handler) relayWebSocket(w http.ResponseWriter, r *http.Request, resp *http.Response, captured *capture.CapturedRequest, outcome *rules.Outcome, startTime time.Time) {
+	requestHeader, responseHeader := r.Header, resp.Header
+	store := func() {
+		captured.Duration = time.Since(startTime)
+		h.record(captured, func() {
+			captured.RequestHeaders = cloneHeaders(requestHeader)
+			captured.ResponseHeaders = cloneHeaders(responseHeader)
+		})
+	}
+
+	upstream, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		captured.StatusCode = http.StatusBadGateway
+		captured.Error = "upstream upgrade did not return a connection"
+		store()
+		return
+	}
+
+	var clientReader io.Reader
+	var clientWriter io.Writer
+	var closeClient func() error
+	if r.ProtoMajor == 2 {
+		// RFC 8441: a 200 response turns the stream into the WebSocket
+		for key, values := range resp.Header {
+			switch http.CanonicalHeaderKey(key) {
+			case "Connection", "Upgrade", "Sec-Websocket-Accept":
+				continue
+			}
+			w.Header()[key] = values
+		}
+		stream, err := openStream(w)
+		if err != nil {
+			captured.ClientAborted = true
+			store()
+			return
+		}
+		captured.StatusCode = http.StatusOK
+		clientReader, clientWriter, closeClient = r.Body, stream, r.Body.Close
+	} else {
+		hijacker, ok := w.(http.Hijacker)
+		if !ok {
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			captured.StatusCode = http.StatusInternalServerError
+			captured.Error = "websocket upgrade not supported on this connection"
+			store()
+			return
+		}
+		clientConn, clientBuf, err := hijacker.Hijack()
+		if err != nil {
+			log.Printf("[WS] Failed to hijack connection: %v", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			captured.StatusCode = http.StatusInternalServerError
+			captured.Error = err.Error()
+			store()
+			return
+		}
+		defer clientConn.Close()
+		clientConn.SetDeadline(time.Time{})
+
+		// Complete the handshake with the client
+		var head bytes.Buffer
+		fmt.Fprintf(&head, "HTTP/1.1 %s\r\n", resp.Status)
+		resp.Header.Write(&head)
+		head.WriteString("\r\n")
+		captured.StatusCode = resp.StatusCode
+		if _, err := clientConn.Write(head.Bytes()); err != nil {
+			captured.ClientAborted = true
+			store()
+			return
+		}
+		clientReader, clientWriter, closeClient = clientBuf.Reader, clientConn, clientConn.Close
+	}
+
+	session := &webSocketSession{
+		id:         captured.ID,
+		url:        captured.URL,
+		started:    time.Now(),
+		outcome:    outcome,
+		maxMessage: h.maxRequestSize,
+		client:     &wsPeer{w: clientWriter},
+		server:     &wsPeer{w: upstream, mask: true},
+		mqtt:       &mqttTap{},
+	}
+	h.websockets.add(session)
+	defer h.websockets.remove(session.id)
+
+	log.Printf("[WS] %s upgraded", captured.URL)
+
+	done := make(chan error, 2)
+	go func() { done <- session.pump(clientReader, rules.Upstream) }()
+	go func() { done <- session.pump(upstream, rules.Downstream) }()
+
+	// Either side failing or closing ends the connection; closing both
+	// ends stops the other pump
+	if err := <-done; err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+		captured.Error = err.Error()
+	}
+	closeClient()
+	upstream.Close()
+	<-done
+
+	session.mu.Lock()
+	captured.WebSocketMessages = session.messages
+	session.mu.Unlock()
+	captured.MQTT = session.mqtt.result()
+	applied, would := session.actions()
+	captured.RecordActions(applied...)
+	captured.RecordWouldApply(would...)
+
+	log.Printf("[WS] %s closed after %d messages (%s)", captured.URL, session.count, time.Since(startTime))
+	store()
+}
@@ -0,0 +1,320 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+)
+
+// wireHeadroom is added to the body size limit to bound a connection's
+// wire buffer, leaving room for the message head and chunk framing
+const wireHeadroom = 64 * 1024
+
+// wireLimit bounds a connection's wire buffer. Without raw capture only
+// message heads are needed, for header order.
+func wireLimit(captureRaw bool, maxRequestSize int64) int {
+	if captureRaw {
+		return int(maxRequestSize) + wireHeadroom
+	}
+	return wireHeadroom
+}
+
+// wireConn keeps a copy of the bytes read from a connection while
+// recording, so captures can show messages exactly as they were sent
+type wireConn struct {
+	net.Conn
+	limit int
+
+	mu        sync.Mutex
+	recording bool
+	buf       []byte
+	truncated bool
+
+	// Requests received on a client connection so far
+	exchanges atomic.Int64
+
+	// onClose is called once when an upstream connection closes
+	onClose   func()
+	closeOnce sync.Once
+}
+
+func (c *wireConn) Close() error {
+	err := c.Conn.Close()
+	if c.onClose != nil {
+		c.closeOnce.Do(c.onClose)
+	}
+	return err
+}
+
+func (c *wireConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.mu.Lock()
+		if c.recording {
+			keep := n
+			if room := c.limit - len(c.buf); keep > room {
+				keep = max(room, 0)
+				c.truncated = true
+			}
+			c.buf = append(c.buf, p[:keep]...)
+		}
+		c.mu.Unlock()
+	}
+	return n, err
+}
+
+// start discards anything recorded and records from now on
+func (c *wireConn) start() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.recording = true
+	c.buf = c.buf[:0]
+	c.truncated = false
+}
+
+// stop ends recording, for connections that turn into tunnels or stop
+// speaking HTTP/1
+func (c *wireConn) stop() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.recording = false
+	c.buf = nil
+}
+
+// take returns what was recorded and stops recording
+func (c *wireConn) take() ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := bytes.Clone(c.buf)
+	truncated := c.truncated
+	c.recording = false
+	c.buf = c.buf[:0]
+	c.truncated = false
+	return out, truncated
+}
+
+// takeRequest cuts r's request line, headers and body framing from the
+// recorded bytes, keeping anything after it (a pipelined request). Bytes
+// before the request line are leftovers of an earlier request's unread
+// body and are dropped.
+func (c *wireConn) takeRequest(r *http.Request) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	start := bytes.Index(c.buf, []byte(r.Method+" "+r.RequestURI+" "))
+	if start < 0 {
+		c.buf = c.buf[:0]
+		return nil, false
+	}
+	data := c.buf[start:]
+
+	end := len(data)
+	if headEnd := bytes.Index(data, []byte("\r\n\r\n")); headEnd >= 0 {
+		headEnd += 4
+		body := data[headEnd:]
+		switch {
+		case len(r.TransferEncoding) > 0 && r.TransferEncoding[0] == "chunked":
+			end = headEnd + chunkedLength(body)
+		case r.ContentLength > 0:
+			end = headEnd + min(int(r.ContentLength), len(body))
+		default:
+			end = headEnd
+		}
+	}
+
+	out := bytes.Clone(data[:end])
+	truncated := c.truncated
+	c.buf = append(c.buf[:0], data[end:]...)
+	c.truncated = false
+	return out, truncated
+}
+
+// chunkedLength returns the length of the chunked body at the start of b,
+// including its framing and trailers, or len(b) if it is incomplete
+func chunkedLength(b []byte) int {
+	pos := 0
+	for {
+		lineEnd := bytes.Index(b[pos:], []byte("\r\n"))
+		if lineEnd < 0 {
+			return len(b)
+		}
+		sizeField, _, _ := strings.Cut(string(b[pos:pos+lineEnd]), ";")
+		size, err := strconv.ParseInt(strings.TrimSpace(sizeField), 16, 64)
+		if err != nil || size < 0 {
+			return len(b)
+		}
+		pos += lineEnd + 2
+
+		if size == 0 {
+			// trailers, then an empty line
+			if bytes.HasPrefix(b[pos:], []byte("\r\n")) {
+				return pos + 2
+			}
+			if i := bytes.Index(b[pos:], []byte("\r\n\r\n")); i >= 0 {
+				return pos + i + 4
+			}
+			return len(b)
+		}
+		if int64(len(b)-pos) < size+2 {
+			return len(b)
+		}
+		pos += int(size) + 2
+	}
+}
+
+// wireListener wraps accepted client connections in recording wireConns
+type wireListener struct {
+	net.Listener
+	limit int
+}
+
+func (l *wireListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &wireConn{Conn: conn, limit: l.limit, recording: true}, nil
+}
+
+// wireConnKey carries a client connection's wireConn in request contexts
+type wireConnKey struct{}
+
+// clientWire returns the recording client connection of r, if any
+func clientWire(r *http.Request) *wireConn {
+	c, _ := r.Context().Value(wireConnKey{}).(*wireConn)
+	return c
+}
+
+// recordingDialer wraps upstream connections from dial for raw capture
+// and header order. Recording starts when a request is assigned the
+// connection. HTTP/2 connections are left unwrapped: their frames are
+// not recorded, and the transport only speaks HTTP/2 over a *tls.Conn.
+func (h *Handler) recordingDialer(dial func(context.Context, string, string) (net.Conn, error)) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		if tc, ok := conn.(*tls.Conn); ok && tc.ConnectionState().NegotiatedProtocol == "h2" {
+			if under, ok := tc.NetConn().(*wireConn); ok {
+				h.pool.opened(tc, under, addr)
+			}
+			return tc, nil
+		}
+		wc := &wireConn{Conn: conn, limit: wireLimit(h.captureRaw, h.maxRequestSize)}
+		h.pool.opened(wc, wc, addr)
+		return wc, nil
+	}
+}
+
+// traceUpstreamWire arranges for the connection that carries req to record
+// the response. The returned function reports the connection used, and
+// the recording one, which HTTP/2 connections are not.
+func traceUpstreamWire(req *http.Request) (*http.Request, func() (net.Conn, *wireConn)) {
+	var mu sync.Mutex
+	var conn net.Conn
+	var wire *wireConn
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			c, ok := info.Conn.(*wireConn)
+			if ok {
+				c.start()
+			}
+			mu.Lock()
+			conn = info.Conn
+			if ok {
+				wire = c
+			}
+			mu.Unlock()
+		},
+	}
+	ctx := httptrace.WithClientTrace(req.Context(), trace)
+	return req.WithContext(ctx), func() (net.Conn, *wireConn) {
+		mu.Lock()
+		defer mu.Unlock()
+		return conn, wire
+	}
+}
+
+// restoreTLSState fills in resp.TLS, which the transport leaves empty when
+// the TLS connection is wrapped for recording
+func restoreTLSState(resp *http.Response, conn *wireConn) {
+	if resp.TLS != nil || conn == nil {
+		return
+	}
+	if tc, ok := conn.Conn.(*tls.Conn); ok {
+		state := tc.ConnectionState()
+		resp.TLS = &state
+	}
+}
+
+// withClientWire is the http.Server ConnContext hook that exposes
+// recording client connections to handlers
+func withClientWire(ctx context.Context, c net.Conn) context.Context {
+	if wc, ok := c.(*wireConn); ok {
+		return context.WithValue(ctx, wireConnKey{}, wc)
+	}
+	return ctx
+}
+
+// headerFields parses the header lines of the HTTP/1 message head at the
+// start of raw, in order and with their original case. Folded lines are
+// joined to the field they continue.
+func headerFields(raw []byte) []capture.HeaderField {
+	head, _, _ := bytes.Cut(raw, []byte("\r\n\r\n"))
+	lines := strings.Split(string(head), "\r\n")
+	var fields []capture.HeaderField
+	for _, line := range lines[1:] {
+		if line == "" {
+			break
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			last := &fields[len(fields)-1]
+			last.Value += " " + strings.TrimSpace(line)
+			continue
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		fields = append(fields, capture.HeaderField{Name: name, Value: strings.TrimSpace(value)})
+	}
+	return fields
+}
+
+// responseHeaderFields is headerFields for a recorded response, skipping
+// any interim 1xx responses before the final one
+func responseHeaderFields(raw []byte) []capture.HeaderField {
+	for {
+		status, _, _ := bytes.Cut(raw, []byte("\r\n"))
+		_, code, _ := strings.Cut(string(status), " ")
+		interim := strings.HasPrefix(code, "1") && !strings.HasPrefix(code, "101")
+		_, rest, ok := bytes.Cut(raw, []byte("\r\n\r\n"))
+		if !interim || !ok {
+			return headerFields(raw)
+		}
+		raw = rest
+	}
+}
+
+// remoteIP returns the address a connection reached, without the port
+func remoteIP(conn net.Conn) string {
+	addr := conn.RemoteAddr()
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
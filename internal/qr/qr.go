@@ -0,0 +1,450 @@
+// Package qr renders QR codes (ISO/IEC 18004) in byte mode at error
+// correction level M, for versions 1 to 10, which holds up to 213 bytes:
+// enough for setup URLs.
+package qr
+
+import (
+	"errors"
+	"image"
+	"image/color"
+)
+
+// ErrTooLong is returned for data that does not fit a version 10 code
+var ErrTooLong = errors.New("qr: data too long")
+
+// version describes the block structure of a version at level M
+type version struct {
+	ecPerBlock int
+	// blocks holds the data codeword count of each block
+	blocks    []int
+	alignment []int
+}
+
+var versions = []version{
+	1:  {10, []int{16}, nil},
+	2:  {16, []int{28}, []int{6, 18}},
+	3:  {26, []int{44}, []int{6, 22}},
+	4:  {18, []int{32, 32}, []int{6, 26}},
+	5:  {24, []int{43, 43}, []int{6, 30}},
+	6:  {16, []int{27, 27, 27, 27}, []int{6, 34}},
+	7:  {18, []int{31, 31, 31, 31}, []int{6, 22, 38}},
+	8:  {22, []int{38, 38, 39, 39}, []int{6, 24, 42}},
+	9:  {22, []int{36, 36, 36, 37, 37}, []int{6, 26, 46}},
+	10: {26, []int{43, 43, 43, 43, 44}, []int{6, 28, 50}},
+}
+
+func (v version) dataCodewords() int {
+	n := 0
+	for _, b := range v.blocks {
+		n += b
+	}
+	return n
+}
+
+// Code is a QR code symbol
+type Code struct {
+	// Size is the width and height in modules
+	Size    int
+	modules [][]bool
+	// function marks modules that are not data
+	function [][]bool
+}
+
+// Dark reports whether the module at column x, row y is dark
+func (c *Code) Dark(x, y int) bool {
+	return c.modules[y][x]
+}
+
+// Encode returns the smallest QR code holding data
+func Encode(data []byte) (*Code, error) {
+	ver := 0
+	for v := 1; v < len(versions); v++ {
+		countBits := 8
+		if v >= 10 {
+			countBits = 16
+		}
+		if 4+countBits+8*len(data) <= 8*versions[v].dataCodewords() {
+			ver = v
+			break
+		}
+	}
+	if ver == 0 {
+		return nil, ErrTooLong
+	}
+	v := versions[ver]
+
+	codewords := interleave(v, dataCodewords(data, ver, v.dataCodewords()))
+
+	size := 17 + 4*ver
+	c := &Code{Size: size, modules: grid(size), function: grid(size)}
+	c.drawFunctionPatterns(ver, v)
+	c.drawCodewords(codewords)
+
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		c.applyMask(mask)
+		c.drawFormat(mask)
+		if p := c.penalty(); bestPenalty < 0 || p < bestPenalty {
+			best, bestPenalty = mask, p
+		}
+		c.applyMask(mask) // masking twice undoes it
+	}
+	c.applyMask(best)
+	c.drawFormat(best)
+	return c, nil
+}
+
+func grid(size int) [][]bool {
+	g := make([][]bool, size)
+	for i := range g {
+		g[i] = make([]bool, size)
+	}
+	return g
+}
+
+// dataCodewords encodes data in byte mode and pads it to n codewords
+func dataCodewords(data []byte, ver, n int) []byte {
+	var bits bitBuffer
+	bits.append(0x4, 4)
+	if ver >= 10 {
+		bits.append(len(data), 16)
+	} else {
+		bits.append(len(data), 8)
+	}
+	for _, b := range data {
+		bits.append(int(b), 8)
+	}
+	bits.append(0, min(4, 8*n-len(bits)))
+	bits.append(0, (8-len(bits)%8)%8)
+
+	out := make([]byte, 0, n)
+	for i := 0; i < len(bits); i += 8 {
+		var b byte
+		for _, bit := range bits[i : i+8] {
+			b = b<<1 | bit
+		}
+		out = append(out, b)
+	}
+	for pad := byte(0xEC); len(out) < n; pad ^= 0xEC ^ 0x11 {
+		out = append(out, pad)
+	}
+	return out
+}
+
+type bitBuffer []byte
+
+func (b *bitBuffer) append(value, n int) {
+	for i := n - 1; i >= 0; i-- {
+		*b = append(*b, byte(value>>i&1))
+	}
+}
+
+// interleave splits data into the version's blocks, adds each block's
+// error correction and interleaves the result
+func interleave(v version, data []byte) []byte {
+	gen := generator(v.ecPerBlock)
+	var blocks, ecc [][]byte
+	for _, n := range v.blocks {
+		blocks = append(blocks, data[:n])
+		ecc = append(ecc, remainder(data[:n], gen))
+		data = data[n:]
+	}
+
+	var out []byte
+	longest := v.blocks[len(v.blocks)-1]
+	for i := 0; i < longest; i++ {
+		for _, b := range blocks {
+			if i < len(b) {
+				out = append(out, b[i])
+			}
+		}
+	}
+	for i := 0; i < v.ecPerBlock; i++ {
+		for _, e := range ecc {
+			out = append(out, e[i])
+		}
+	}
+	return out
+}
+
+// gfMul multiplies in GF(256) with the QR polynomial 0x11D
+func gfMul(a, b byte) byte {
+	var p byte
+	for ; b > 0; b >>= 1 {
+		if b&1 != 0 {
+			p ^= a
+		}
+		carry := a & 0x80
+		a <<= 1
+		if carry != 0 {
+			a ^= 0x1D
+		}
+	}
+	return p
+}
+
+// generator returns the Reed-Solomon generator polynomial of the given
+// degree, highest coefficient first, without the leading 1
+func generator(degree int) []byte {
+	g := make([]byte, degree)
+	g[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range g {
+			g[j] = gfMul(g[j], root)
+			if j+1 < len(g) {
+				g[j] ^= g[j+1]
+			}
+		}
+		root = gfMul(root, 2)
+	}
+	return g
+}
+
+// remainder returns the error correction codewords of data
+func remainder(data, gen []byte) []byte {
+	r := make([]byte, len(gen))
+	for _, b := range data {
+		factor := b ^ r[0]
+		copy(r, r[1:])
+		r[len(r)-1] = 0
+		for i := range r {
+			r[i] ^= gfMul(gen[i], factor)
+		}
+	}
+	return r
+}
+
+func (c *Code) set(x, y int, dark bool) {
+	c.modules[y][x] = dark
+	c.function[y][x] = true
+}
+
+func (c *Code) drawFunctionPatterns(ver int, v version) {
+	size := c.Size
+	for i := 0; i < size; i++ {
+		c.set(6, i, i%2 == 0)
+		c.set(i, 6, i%2 == 0)
+	}
+
+	c.drawFinder(3, 3)
+	c.drawFinder(size-4, 3)
+	c.drawFinder(3, size-4)
+
+	last := len(v.alignment) - 1
+	for i, x := range v.alignment {
+		for j, y := range v.alignment {
+			// Skip the three corners taken by finders
+			if (i == 0 && j == 0) || (i == 0 && j == last) || (i == last && j == 0) {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					c.set(x+dx, y+dy, max(abs(dx), abs(dy)) != 1)
+				}
+			}
+		}
+	}
+
+	// Reserve the format areas; drawFormat fills them in
+	c.drawFormat(0)
+
+	if ver >= 7 {
+		rem := ver
+		for i := 0; i < 12; i++ {
+			rem = rem<<1 ^ (rem>>11)*0x1F25
+		}
+		bits := ver<<12 | rem
+		for i := 0; i < 18; i++ {
+			dark := bits>>i&1 != 0
+			a, b := size-11+i%3, i/3
+			c.set(a, b, dark)
+			c.set(b, a, dark)
+		}
+	}
+}
+
+// drawFinder draws a finder pattern and its separator centred on x, y
+func (c *Code) drawFinder(x, y int) {
+	for dy := -4; dy <= 4; dy++ {
+		for dx := -4; dx <= 4; dx++ {
+			xx, yy := x+dx, y+dy
+			if xx < 0 || xx >= c.Size || yy < 0 || yy >= c.Size {
+				continue
+			}
+			d := max(abs(dx), abs(dy))
+			c.set(xx, yy, d != 2 && d != 4)
+		}
+	}
+}
+
+// drawFormat draws both copies of the format information for level M
+// and mask
+func (c *Code) drawFormat(mask int) {
+	data := 0<<3 | mask // level M is 00
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = rem<<1 ^ (rem>>9)*0x537
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return bits>>i&1 != 0 }
+
+	for i := 0; i <= 5; i++ {
+		c.set(8, i, bit(i))
+	}
+	c.set(8, 7, bit(6))
+	c.set(8, 8, bit(7))
+	c.set(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		c.set(14-i, 8, bit(i))
+	}
+
+	size := c.Size
+	for i := 0; i < 8; i++ {
+		c.set(size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		c.set(8, size-15+i, bit(i))
+	}
+	c.set(8, size-8, true)
+}
+
+// drawCodewords places codewords in the zigzag data order
+func (c *Code) drawCodewords(data []byte) {
+	size := c.Size
+	i := 0
+	for right := size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = size - 1 - vert
+				}
+				if !c.function[y][x] && i < len(data)*8 {
+					c.modules[y][x] = data[i>>3]>>(7-i&7)&1 != 0
+					i++
+				}
+			}
+		}
+	}
+}
+
+func (c *Code) applyMask(mask int) {
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			var flip bool
+			switch mask {
+			case 0:
+				flip = (x+y)%2 == 0
+			case 1:
+				flip = y%2 == 0
+			case 2:
+				flip = x%3 == 0
+			case 3:
+				flip = (x+y)%3 == 0
+			case 4:
+				flip = (x/3+y/2)%2 == 0
+			case 5:
+				flip = x*y%2+x*y%3 == 0
+			case 6:
+				flip = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				flip = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if flip && !c.function[y][x] {
+				c.modules[y][x] = !c.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores the symbol with the four mask evaluation rules
+func (c *Code) penalty() int {
+	size := c.Size
+	score := 0
+	at := func(x, y int, transpose bool) bool {
+		if transpose {
+			return c.modules[x][y]
+		}
+		return c.modules[y][x]
+	}
+
+	for _, transpose := range []bool{false, true} {
+		for y := 0; y < size; y++ {
+			run := 1
+			for x := 1; x <= size; x++ {
+				if x < size && at(x, y, transpose) == at(x-1, y, transpose) {
+					run++
+					continue
+				}
+				if run >= 5 {
+					score += 3 + run - 5
+				}
+				run = 1
+			}
+			// Finder-like 1:1:3:1:1 runs with four light modules beside them
+			for x := 0; x+11 <= size; x++ {
+				var line [11]bool
+				for k := range line {
+					line[k] = at(x+k, y, transpose)
+				}
+				if line == [11]bool{true, false, true, true, true, false, true, false, false, false, false} ||
+					line == [11]bool{false, false, false, false, true, false, true, true, true, false, true} {
+					score += 40
+				}
+			}
+		}
+	}
+
+	dark := 0
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			if c.modules[y][x] {
+				dark++
+			}
+			if x+1 < size && y+1 < size {
+				m := c.modules[y][x]
+				if m == c.modules[y][x+1] && m == c.modules[y+1][x] && m == c.modules[y+1][x+1] {
+					score += 3
+				}
+			}
+		}
+	}
+	total := size * size
+	score += abs(dark*20-total*10) / total * 10
+	return score
+}
+
+// Image renders the code with scale pixels per module and the standard
+// four-module quiet zone
+func (c *Code) Image(scale int) image.Image {
+	if scale < 1 {
+		scale = 1
+	}
+	width := (c.Size + 8) * scale
+	img := image.NewPaletted(image.Rect(0, 0, width, width), color.Palette{color.White, color.Black})
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if !c.modules[y][x] {
+				continue
+			}
+			for dy := 0; dy < scale; dy++ {
+				for dx := 0; dx < scale; dx++ {
+					img.SetColorIndex((x+4)*scale+dx, (y+4)*scale+dy, 1)
+				}
+			}
+		}
+	}
+	return img
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
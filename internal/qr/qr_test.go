@@ -0,0 +1,298 @@
+package qr
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// setupURL is a typical payload: the PAC URL the setup page encodes
+const setupURL = "http://192.168.1.20:8080/proxy.pac"
+
+// goldenSetupURL is the symbol for setupURL, as decode reads it back. A
+// deliberate change to mask selection changes it; anything else that
+// does is a regression.
+var goldenSetupURL = []string{
+	"#######..#...###.#.#..#######",
+	"#.....#...##.####.#...#.....#",
+	"#.###.#.#..#.#.#..#...#.###.#",
+	"#.###.#.#..##.##.##.#.#.###.#",
+	"#.###.#.#.#....##..#..#.###.#",
+	"#.....#.#.#.#.....#...#.....#",
+	"#######.#.#.#.#.#.#.#.#######",
+	"........####..#.#.#..........",
+	"#.#####..####....####.#####..",
+	"##.###.##...####.###..#.#...#",
+	"#.#..##.#.#.######.....##....",
+	"#..#.#.#######.....#.##.#..#.",
+	"#..########.#.##.#.###.#.##..",
+	"##.###.....##...#..#..#.#.#.#",
+	"#..####..#.##..##.#..##...#..",
+	"..###.....##..##..#..#.#...#.",
+	".#...##........#.#..##....#..",
+	"##..#..#...#.##.#..#.##.###.#",
+	"#.#.###.#.#.####.##...#..##..",
+	"#..#...##....#.#..##.##.#..#.",
+	"#.##.##..#.#..####..#####.###",
+	"........#..#....#####...#####",
+	"#######..###...#.#.##.#.###..",
+	"#.....#.#####.#.#...#...#..##",
+	"#.###.#.##.......#..########.",
+	"#.###.#.##.#.##..#..##.#...##",
+	"#.###.#.###..####.###.#.##.#.",
+	"#.....#...####.#..#.##.##..#.",
+	"#######.#.###...##.......##..",
+}
+
+func render(c *Code) []string {
+	rows := make([]string, c.Size)
+	for y := range rows {
+		var b strings.Builder
+		for x := 0; x < c.Size; x++ {
+			if c.Dark(x, y) {
+				b.WriteByte('#')
+			} else {
+				b.WriteByte('.')
+			}
+		}
+		rows[y] = b.String()
+	}
+	return rows
+}
+
+func TestEncodeGolden(t *testing.T) {
+	c, err := Encode([]byte(setupURL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := render(c)
+	if strings.Join(got, "\n") != strings.Join(goldenSetupURL, "\n") {
+		t.Errorf("symbol for %q changed:\n%s", setupURL, strings.Join(got, "\n"))
+	}
+}
+
+// TestRemainder checks the Reed-Solomon codewords against the worked
+// example of ISO/IEC 18004 Annex I (version 1-M, "01234567")
+func TestRemainder(t *testing.T) {
+	data := []byte{0x10, 0x20, 0x0C, 0x56, 0x61, 0x80, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11, 0xEC, 0x11}
+	want := []byte{0xA5, 0x24, 0xD4, 0xC1, 0xED, 0x36, 0xC7, 0x87, 0x2C, 0x55}
+	if got := remainder(data, generator(10)); !bytes.Equal(got, want) {
+		t.Errorf("error correction = % X, want % X", got, want)
+	}
+}
+
+// formatM holds the format information strings for level M by mask,
+// from the standard's table, most significant bit first
+var formatM = []string{
+	"101010000010010", "101000100100101", "101111001111100", "101101101001011",
+	"100010111111001", "100000011001110", "100111110010111", "100101010100000",
+}
+
+// versionInfo holds the version information for versions 7 to 10
+var versionInfo = map[int]int{7: 0x07C94, 8: 0x085BC, 9: 0x09A99, 10: 0x0A4D3}
+
+func TestEncodeDecodes(t *testing.T) {
+	for _, n := range []int{0, 1, 14, 15, 16, 60, 100, 150, 200, 213} {
+		data := bytes.Repeat([]byte(setupURL), n/len(setupURL)+1)[:n]
+		c, err := Encode(data)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", n, err)
+		}
+		if got := decode(t, c); !bytes.Equal(got, data) {
+			t.Fatalf("%d bytes: decoded %q", n, got)
+		}
+	}
+	if _, err := Encode(make([]byte, 214)); err != ErrTooLong {
+		t.Errorf("214 bytes: err = %v, want ErrTooLong", err)
+	}
+}
+
+// decode reads a symbol back as a scanner would, independently of how
+// Encode lays it out
+func decode(t *testing.T, c *Code) []byte {
+	t.Helper()
+	size := c.Size
+	ver := (size - 17) / 4
+	v := versions[ver]
+
+	// Format information, first copy: row 8 left to right, then column 8
+	// bottom to top, skipping the timing patterns
+	var format strings.Builder
+	for x := 0; x <= 8; x++ {
+		if x != 6 {
+			format.WriteByte(bit(c.Dark(x, 8)))
+		}
+	}
+	for y := 7; y >= 0; y-- {
+		if y != 6 {
+			format.WriteByte(bit(c.Dark(8, y)))
+		}
+	}
+	// Second copy: column 8 bottom to top, then row 8 left to right
+	var second strings.Builder
+	for y := size - 1; y >= size-7; y-- {
+		second.WriteByte(bit(c.Dark(8, y)))
+	}
+	for x := size - 8; x < size; x++ {
+		second.WriteByte(bit(c.Dark(x, 8)))
+	}
+	if format.String() != second.String() {
+		t.Fatalf("format copies differ: %s, %s", format.String(), second.String())
+	}
+	mask := -1
+	for m, f := range formatM {
+		if f == format.String() {
+			mask = m
+		}
+	}
+	if mask < 0 {
+		t.Fatalf("format %s is not level M", format.String())
+	}
+	if !c.Dark(8, size-8) {
+		t.Fatal("dark module missing")
+	}
+
+	reserved := grid(size)
+	fill := func(x0, y0, w, h int) {
+		for y := y0; y < y0+h; y++ {
+			for x := x0; x < x0+w; x++ {
+				reserved[y][x] = true
+			}
+		}
+	}
+	fill(0, 0, 9, 9)
+	fill(size-8, 0, 8, 9)
+	fill(0, size-8, 9, 8)
+	fill(6, 0, 1, size)
+	fill(0, 6, size, 1)
+	for _, x := range v.alignment {
+		for _, y := range v.alignment {
+			topLeft := x < 9 && y < 9
+			topRight := x > size-9 && y < 9
+			bottomLeft := x < 9 && y > size-9
+			if !topLeft && !topRight && !bottomLeft {
+				fill(x-2, y-2, 5, 5)
+			}
+		}
+	}
+	if ver >= 7 {
+		fill(size-11, 0, 3, 6)
+		fill(0, size-11, 6, 3)
+		info := 0
+		for i := 17; i >= 0; i-- {
+			info = info<<1 | int(bit(c.Dark(size-11+i%3, i/3))-'0')
+		}
+		if info != versionInfo[ver] {
+			t.Fatalf("version information %05X, want %05X", info, versionInfo[ver])
+		}
+	}
+
+	var bits []byte
+	upward := true
+	for col := size - 1; col > 0; col -= 2 {
+		if col == 6 {
+			col--
+		}
+		for k := 0; k < size; k++ {
+			y := k
+			if upward {
+				y = size - 1 - k
+			}
+			for _, x := range []int{col, col - 1} {
+				if reserved[y][x] {
+					continue
+				}
+				dark := c.Dark(x, y)
+				if masked(mask, y, x) {
+					dark = !dark
+				}
+				bits = append(bits, bit(dark)-'0')
+			}
+		}
+		upward = !upward
+	}
+	var codewords []byte
+	for i := 0; i+8 <= len(bits); i += 8 {
+		var b byte
+		for _, x := range bits[i : i+8] {
+			b = b<<1 | x
+		}
+		codewords = append(codewords, b)
+	}
+
+	// Undo the interleaving and check each block's error correction
+	blocks := make([][]byte, len(v.blocks))
+	pos := 0
+	for i := 0; i < v.blocks[len(v.blocks)-1]; i++ {
+		for b, n := range v.blocks {
+			if i < n {
+				blocks[b] = append(blocks[b], codewords[pos])
+				pos++
+			}
+		}
+	}
+	gen := generator(v.ecPerBlock)
+	var data []byte
+	for b, block := range blocks {
+		for i := 0; i < v.ecPerBlock; i++ {
+			if codewords[pos+i*len(blocks)+b] != remainder(block, gen)[i] {
+				t.Fatalf("block %d error correction mismatch", b)
+			}
+		}
+		data = append(data, block...)
+	}
+
+	var r bitBuffer
+	for _, b := range data {
+		r.append(int(b), 8)
+	}
+	read := func(n int) int {
+		v := 0
+		for _, b := range r[:n] {
+			v = v<<1 | int(b)
+		}
+		r = r[n:]
+		return v
+	}
+	if mode := read(4); mode != 0x4 {
+		t.Fatalf("mode %04b, want byte mode", mode)
+	}
+	count := 8
+	if ver >= 10 {
+		count = 16
+	}
+	out := make([]byte, read(count))
+	for i := range out {
+		out[i] = byte(read(8))
+	}
+	return out
+}
+
+func bit(dark bool) byte {
+	if dark {
+		return '1'
+	}
+	return '0'
+}
+
+// masked reports whether mask flips the module at row i, column j
+func masked(mask, i, j int) bool {
+	switch mask {
+	case 0:
+		return (i+j)%2 == 0
+	case 1:
+		return i%2 == 0
+	case 2:
+		return j%3 == 0
+	case 3:
+		return (i+j)%3 == 0
+	case 4:
+		return (i/2+j/3)%2 == 0
+	case 5:
+		return i*j%2+i*j%3 == 0
+	case 6:
+		return (i*j%2+i*j%3)%2 == 0
+	default:
+		return ((i+j)%2+i*j%3)%2 == 0
+	}
+}
@@ -0,0 +1,100 @@
+package replay
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// jsonPathStep is one member name or array index of a path
+type jsonPathStep struct {
+	name  string
+	index int
+	isIdx bool
+}
+
+// parseJSONPath parses the JSONPath subset of member and index steps:
+// $.data.tokens[0].value, $['access-token'], or access_token
+func parseJSONPath(path string) ([]jsonPathStep, error) {
+	rest := strings.TrimPrefix(strings.TrimSpace(path), "$")
+	var steps []jsonPathStep
+	for rest != "" {
+		switch {
+		case strings.HasPrefix(rest, "['") || strings.HasPrefix(rest, `["`):
+			quote := rest[1]
+			end := strings.IndexByte(rest[2:], quote)
+			if end < 0 || !strings.HasPrefix(rest[2+end+1:], "]") {
+				return nil, fmt.Errorf("invalid JSONPath %q", path)
+			}
+			steps = append(steps, jsonPathStep{name: rest[2 : 2+end]})
+			rest = rest[2+end+2:]
+		case rest[0] == '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("invalid JSONPath %q", path)
+			}
+			i, err := strconv.Atoi(rest[1:end])
+			if err != nil || i < 0 {
+				return nil, fmt.Errorf("invalid JSONPath index in %q", path)
+			}
+			steps = append(steps, jsonPathStep{index: i, isIdx: true})
+			rest = rest[end+1:]
+		default:
+			rest = strings.TrimPrefix(rest, ".")
+			end := strings.IndexAny(rest, ".[")
+			if end < 0 {
+				end = len(rest)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("invalid JSONPath %q", path)
+			}
+			steps = append(steps, jsonPathStep{name: rest[:end]})
+			rest = rest[end:]
+		}
+	}
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("empty JSONPath %q", path)
+	}
+	return steps, nil
+}
+
+// extractJSON returns the string (or number) at steps in a JSON document
+func extractJSON(data []byte, steps []jsonPathStep) (string, error) {
+	var v interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&v); err != nil {
+		return "", fmt.Errorf("response is not JSON: %w", err)
+	}
+	for _, step := range steps {
+		switch node := v.(type) {
+		case map[string]interface{}:
+			if step.isIdx {
+				return "", fmt.Errorf("index [%d] applied to an object", step.index)
+			}
+			var ok bool
+			if v, ok = node[step.name]; !ok {
+				return "", fmt.Errorf("no member %q", step.name)
+			}
+		case []interface{}:
+			if !step.isIdx {
+				return "", fmt.Errorf("member %q applied to an array", step.name)
+			}
+			if step.index >= len(node) {
+				return "", fmt.Errorf("no element [%d]", step.index)
+			}
+			v = node[step.index]
+		default:
+			return "", fmt.Errorf("path continues past a %T", v)
+		}
+	}
+	switch value := v.(type) {
+	case string:
+		return value, nil
+	case json.Number:
+		return value.String(), nil
+	}
+	return "", fmt.Errorf("value at path is a %T, not a string", v)
+}
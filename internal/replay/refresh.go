@@ -0,0 +1,134 @@
+package replay
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// maxLoginResponse bounds the login response read for a token
+const maxLoginResponse = 1 << 20
+
+// TokenRefresh describes how to log in again when a replay is rejected
+// with 401: a login request template, where the token is in its JSON
+// response, and where the token goes in replays. ${NAME} in the URL,
+// headers and body is replaced with the environment variable NAME, so
+// credentials need not be stored in the template.
+type TokenRefresh struct {
+	Method  string            `json:"method,omitempty"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Body    string            `json:"body,omitempty"`
+
+	// TokenPath is a JSONPath into the login response, e.g.
+	// $.access_token or $.data.tokens[0].value
+	TokenPath string `json:"token_path"`
+
+	// Header set on replays (default Authorization) to Format with
+	// {token} replaced (default "Bearer {token}")
+	Header string `json:"header,omitempty"`
+	Format string `json:"format,omitempty"`
+}
+
+// envVar matches ${NAME} references in a refresh template
+var envVar = regexp.MustCompile(`\$\{(\w+)\}`)
+
+func expandEnv(s string) string {
+	return envVar.ReplaceAllStringFunc(s, func(ref string) string {
+		return os.Getenv(ref[2 : len(ref)-1])
+	})
+}
+
+// Refresher runs a TokenRefresh and substitutes the token it obtains
+// into replays. It is safe for concurrent use.
+type Refresher struct {
+	config TokenRefresh
+	path   []jsonPathStep
+
+	mu    sync.Mutex
+	token string
+}
+
+// NewRefresher validates config and returns a refresher with no token
+// yet; the first 401 triggers a login
+func NewRefresher(config TokenRefresh) (*Refresher, error) {
+	if config.URL == "" {
+		return nil, fmt.Errorf("token refresh needs a login url")
+	}
+	path, err := parseJSONPath(config.TokenPath)
+	if err != nil {
+		return nil, fmt.Errorf("token refresh: %w", err)
+	}
+	if config.Method == "" {
+		config.Method = http.MethodPost
+	}
+	if config.Header == "" {
+		config.Header = "Authorization"
+	}
+	if config.Format == "" {
+		config.Format = "Bearer {token}"
+	}
+	return &Refresher{config: config, path: path}, nil
+}
+
+// apply sets the current token on req, if one was obtained
+func (r *Refresher) apply(req *http.Request) {
+	r.mu.Lock()
+	token := r.token
+	r.mu.Unlock()
+	if token != "" {
+		req.Header.Set(r.config.Header, strings.ReplaceAll(r.config.Format, "{token}", token))
+	}
+}
+
+// refresh logs in and keeps the new token. stale is the token the failed
+// replay used; when another replay has already replaced it, that token
+// is kept instead of logging in again.
+func (r *Refresher) refresh(ctx context.Context, client *http.Client, stale string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.token != stale {
+		return nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, r.config.Method, expandEnv(r.config.URL), strings.NewReader(expandEnv(r.config.Body)))
+	if err != nil {
+		return fmt.Errorf("login request: %w", err)
+	}
+	for name, value := range r.config.Headers {
+		req.Header.Set(name, expandEnv(value))
+	}
+	if r.config.Body != "" && req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("login request: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxLoginResponse))
+	if err != nil {
+		return fmt.Errorf("login response: %w", err)
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("login request: status %d", resp.StatusCode)
+	}
+	token, err := extractJSON(body, r.path)
+	if err != nil {
+		return fmt.Errorf("login response: %w", err)
+	}
+	r.token = token
+	return nil
+}
+
+// current returns the token in use
+func (r *Refresher) current() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.token
+}
@@ -0,0 +1,152 @@
+// Package replay re-sends captured requests, as recorded or against
+// another target such as a staging host
+package replay
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+)
+
+// Result is the outcome of replaying one capture
+type Result struct {
+	RequestID string `json:"request_id"`
+	Method    string `json:"method"`
+	URL       string `json:"url"`
+
+	// Status of the replay and of the captured response it repeats
+	StatusCode     int `json:"status_code,omitempty"`
+	ExpectedStatus int `json:"expected_status,omitempty"`
+
+	DurationMS int64  `json:"duration_ms"`
+	Size       int64  `json:"size"`
+	Error      string `json:"error,omitempty"`
+
+	// Set when a 401 led to a token refresh and a retry
+	TokenRefreshed bool `json:"token_refreshed,omitempty"`
+
+	// OK is set when a response arrived with a status below 400 or the
+	// same status as captured
+	OK bool `json:"ok"`
+}
+
+// skipHeaders are not resent: hop-by-hop headers, proxy credentials,
+// and headers the client recomputes
+var skipHeaders = map[string]bool{
+	"Connection":          true,
+	"Keep-Alive":          true,
+	"Proxy-Authorization": true,
+	"Proxy-Connection":    true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+	"Content-Length":      true,
+	"Host":                true,
+}
+
+// NewClient returns a client for replays. Redirects are not followed:
+// each capture is one hop, and a redirect is replayed as its own capture.
+func NewClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// NewRequest rebuilds captured as an outgoing request. A non-empty target
+// (scheme://host[:port][/prefix]) replaces the captured scheme and host
+// and prefixes the path.
+func NewRequest(ctx context.Context, captured *capture.CapturedRequest, target string) (*http.Request, error) {
+	if captured.IsTunnel {
+		return nil, fmt.Errorf("capture %s is an opaque tunnel", captured.ID)
+	}
+	u, err := url.Parse(captured.URL)
+	if err != nil {
+		return nil, fmt.Errorf("capture %s: %w", captured.ID, err)
+	}
+	if target != "" {
+		t, err := url.Parse(target)
+		if err != nil || (t.Scheme != "http" && t.Scheme != "https") || t.Host == "" {
+			return nil, fmt.Errorf("invalid target %q", target)
+		}
+		u.Scheme, u.Host = t.Scheme, t.Host
+		u.Path = strings.TrimSuffix(t.Path, "/") + u.Path
+		u.RawPath = ""
+	}
+
+	req, err := http.NewRequestWithContext(ctx, captured.Method, u.String(), bytes.NewReader(captured.RequestBody))
+	if err != nil {
+		return nil, fmt.Errorf("capture %s: %w", captured.ID, err)
+	}
+	for name, values := range captured.RequestHeaders {
+		if !skipHeaders[http.CanonicalHeaderKey(name)] {
+			req.Header[name] = append([]string(nil), values...)
+		}
+	}
+	return req, nil
+}
+
+// Send replays captured with client and reports the outcome. With a
+// refresher, replays carry its token, and a 401 triggers a login and one
+// retry with the new token.
+func Send(ctx context.Context, client *http.Client, captured *capture.CapturedRequest, target string, refresher *Refresher) Result {
+	result := Result{
+		RequestID:      captured.ID,
+		Method:         captured.Method,
+		URL:            captured.URL,
+		ExpectedStatus: captured.StatusCode,
+	}
+
+	start := time.Now()
+	var stale string
+	if refresher != nil {
+		stale = refresher.current()
+	}
+	err := send(ctx, client, captured, target, refresher, &result)
+	if err == nil && result.StatusCode == http.StatusUnauthorized && refresher != nil {
+		if err = refresher.refresh(ctx, client, stale); err != nil {
+			err = fmt.Errorf("token refresh: %w", err)
+		} else {
+			result.TokenRefreshed = true
+			err = send(ctx, client, captured, target, refresher, &result)
+		}
+	}
+	result.DurationMS = time.Since(start).Milliseconds()
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.OK = result.StatusCode < 400 || result.StatusCode == captured.StatusCode
+	return result
+}
+
+// send makes one attempt, recording the URL, status and size in result
+func send(ctx context.Context, client *http.Client, captured *capture.CapturedRequest, target string, refresher *Refresher, result *Result) error {
+	req, err := NewRequest(ctx, captured, target)
+	if err != nil {
+		return err
+	}
+	if refresher != nil {
+		refresher.apply(req)
+	}
+	result.URL = req.URL.String()
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	result.StatusCode = resp.StatusCode
+	result.Size, err = io.Copy(io.Discard, resp.Body)
+	return err
+}
@@ -0,0 +1,286 @@
+package rules
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Load-balancing strategies for MapRemote
+const (
+	StrategyRoundRobin       = "round-robin"
+	StrategyLeastConnections = "least-connections"
+)
+
+// defaultHealthInterval is used when a health path is set without an
+// interval. It is also how long a backend that refused a connection is
+// left out when it has no health checks to bring it back.
+const defaultHealthInterval = 10 * time.Second
+
+// healthTimeout bounds a single health check
+const healthTimeout = 5 * time.Second
+
+// MapRemote sends matching requests to one of several backends instead of
+// the host the client asked for
+type MapRemote struct {
+	// Backends are base URLs such as "http://10.0.0.5:8080"
+	Backends []string `json:"backends"`
+	// Strategy is "round-robin" (default) or "least-connections"
+	Strategy string `json:"strategy,omitempty"`
+	// HealthPath enables active health checks against each backend
+	HealthPath string `json:"health_path,omitempty"`
+	// HealthIntervalSeconds is the time between health checks
+	HealthIntervalSeconds int `json:"health_interval_seconds,omitempty"`
+
+	// Health reports backend state when rules are listed
+	Health []BackendHealth `json:"health,omitempty"`
+}
+
+// BackendHealth is the observed state of one backend
+type BackendHealth struct {
+	URL               string `json:"url"`
+	Healthy           bool   `json:"healthy"`
+	ActiveConnections int64  `json:"active_connections"`
+	Served            int64  `json:"served"`
+	LastError         string `json:"last_error,omitempty"`
+}
+
+// validate checks the backend list and strategy
+func (m *MapRemote) validate() error {
+	if len(m.Backends) == 0 {
+		return fmt.Errorf("map_remote requires at least one backend")
+	}
+	for _, raw := range m.Backends {
+		u, err := url.Parse(raw)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid map_remote backend %q", raw)
+		}
+	}
+	switch m.Strategy {
+	case "", StrategyRoundRobin, StrategyLeastConnections:
+	default:
+		return fmt.Errorf("unknown map_remote strategy %q", m.Strategy)
+	}
+	return nil
+}
+
+// backend is a single upstream target in a pool
+type backend struct {
+	url     *url.URL
+	healthy atomic.Bool
+	// downUntil is when a backend marked down by a failed request is
+	// tried again, in Unix nanoseconds
+	downUntil atomic.Int64
+	active    atomic.Int64
+	served    atomic.Int64
+
+	mu      sync.Mutex
+	lastErr string
+}
+
+// up reports whether the backend should receive traffic
+func (b *backend) up() bool {
+	return b.healthy.Load() && time.Now().UnixNano() >= b.downUntil.Load()
+}
+
+// setError records the outcome of a health check or request
+func (b *backend) setError(msg string) {
+	b.mu.Lock()
+	b.lastErr = msg
+	b.mu.Unlock()
+}
+
+// backendPool balances requests across a MapRemote's backends
+type backendPool struct {
+	backends []*backend
+	strategy string
+	next     atomic.Uint64
+	// downFor is how long a failed request takes a backend out of rotation
+	downFor time.Duration
+
+	stopOnce sync.Once
+	stop     chan struct{}
+}
+
+// newBackendPool creates a pool and starts health checks if configured,
+// sent with client or, when it is nil, a plain client
+func newBackendPool(m *MapRemote, client *http.Client) *backendPool {
+	p := &backendPool{
+		strategy: m.Strategy,
+		downFor:  defaultHealthInterval,
+		stop:     make(chan struct{}),
+	}
+	for _, raw := range m.Backends {
+		u, _ := url.Parse(raw) // validated already
+		b := &backend{url: u}
+		b.healthy.Store(true)
+		p.backends = append(p.backends, b)
+	}
+
+	if m.HealthPath != "" {
+		interval := time.Duration(m.HealthIntervalSeconds) * time.Second
+		if interval <= 0 {
+			interval = defaultHealthInterval
+		}
+		p.downFor = interval
+		if client == nil {
+			client = &http.Client{}
+		}
+		go p.healthLoop(client, m.HealthPath, interval)
+	}
+	return p
+}
+
+// pick selects a backend, preferring healthy ones. If every backend is
+// unhealthy, all are considered so traffic still flows.
+func (p *backendPool) pick() *backend {
+	candidates := p.up(nil)
+	if len(candidates) == 0 {
+		candidates = p.backends
+	}
+	return p.choose(candidates)
+}
+
+// up returns the backends that should receive traffic, other than skip
+func (p *backendPool) up(skip *backend) []*backend {
+	candidates := make([]*backend, 0, len(p.backends))
+	for _, b := range p.backends {
+		if b != skip && b.up() {
+			candidates = append(candidates, b)
+		}
+	}
+	return candidates
+}
+
+// choose applies the pool's strategy to candidates
+func (p *backendPool) choose(candidates []*backend) *backend {
+	if p.strategy == StrategyLeastConnections {
+		best := candidates[0]
+		for _, b := range candidates[1:] {
+			if b.active.Load() < best.active.Load() {
+				best = b
+			}
+		}
+		return best
+	}
+
+	i := p.next.Add(1) - 1
+	return candidates[i%uint64(len(candidates))]
+}
+
+// healthLoop probes every backend until the pool is closed
+func (p *backendPool) healthLoop(client *http.Client, path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		for _, b := range p.backends {
+			p.check(client, b, path)
+		}
+		select {
+		case <-ticker.C:
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// check probes one backend's health endpoint
+func (p *backendPool) check(client *http.Client, b *backend, path string) {
+	target := b.url.ResolveReference(&url.URL{Path: path})
+
+	ctx, cancel := context.WithTimeout(context.Background(), healthTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		b.healthy.Store(false)
+		b.setError(err.Error())
+		return
+	}
+	resp, err := client.Do(req)
+	errMsg := ""
+	switch {
+	case err != nil:
+		errMsg = err.Error()
+	case resp.StatusCode >= 400:
+		errMsg = "health check returned " + resp.Status
+	}
+	if resp != nil {
+		resp.Body.Close()
+	}
+
+	b.healthy.Store(errMsg == "")
+	if errMsg == "" {
+		b.downUntil.Store(0)
+	}
+	b.setError(errMsg)
+}
+
+// health returns the state of every backend
+func (p *backendPool) health() []BackendHealth {
+	result := make([]BackendHealth, len(p.backends))
+	for i, b := range p.backends {
+		b.mu.Lock()
+		lastErr := b.lastErr
+		b.mu.Unlock()
+		result[i] = BackendHealth{
+			URL:               b.url.String(),
+			Healthy:           b.up(),
+			ActiveConnections: b.active.Load(),
+			Served:            b.served.Load(),
+			LastError:         lastErr,
+		}
+	}
+	return result
+}
+
+// close stops health checks
+func (p *backendPool) close() {
+	p.stopOnce.Do(func() {
+		close(p.stop)
+	})
+}
+
+// route points req, whose path before routing is path, at b and takes
+// one of its connection slots; release gives the slot back
+func (p *backendPool) route(req *http.Request, path string, b *backend) {
+	b.active.Add(1)
+	b.served.Add(1)
+
+	req.URL.Scheme = b.url.Scheme
+	req.URL.Host = b.url.Host
+	req.URL.Path = path
+	if prefix := b.url.Path; prefix != "" && prefix != "/" {
+		req.URL.Path = singleJoiningSlash(prefix, path)
+	}
+	req.Host = ""
+}
+
+// release gives back a connection slot taken by route
+func (p *backendPool) release(b *backend) {
+	b.active.Add(-1)
+}
+
+// markDown takes b out of rotation after a request to it failed with err.
+// Health checks bring it back sooner when it recovers.
+func (p *backendPool) markDown(b *backend, err error) {
+	b.downUntil.Store(time.Now().Add(p.downFor).UnixNano())
+	b.setError(err.Error())
+}
+
+// singleJoiningSlash joins two URL paths with exactly one slash
+func singleJoiningSlash(a, b string) string {
+	aslash := len(a) > 0 && a[len(a)-1] == '/'
+	bslash := len(b) > 0 && b[0] == '/'
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
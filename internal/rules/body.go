@@ -0,0 +1,82 @@
+package rules
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+)
+
+// BodyReplace substitutes text in the bodies of matching text responses.
+// Exactly one of Find and Pattern must be set.
+type BodyReplace struct {
+	// Find is a literal string to replace
+	Find string `json:"find,omitempty"`
+	// Pattern is a regular expression to replace
+	Pattern string `json:"pattern,omitempty"`
+	// Replace replaces every match; with Pattern, $1-style groups expand
+	Replace string `json:"replace"`
+
+	re *regexp.Regexp
+}
+
+// validate checks the replacement and compiles its pattern
+func (b *BodyReplace) validate() error {
+	if (b.Find == "") == (b.Pattern == "") {
+		return fmt.Errorf("body replace requires exactly one of find or pattern")
+	}
+	if b.Find != "" {
+		b.re = regexp.MustCompile(regexp.QuoteMeta(b.Find))
+		return nil
+	}
+	re, err := regexp.Compile(b.Pattern)
+	if err != nil {
+		return fmt.Errorf("invalid body replace pattern: %w", err)
+	}
+	b.re = re
+	return nil
+}
+
+// apply replaces every match in body, returning the result and the number
+// of matches
+func (b *BodyReplace) apply(body []byte) ([]byte, int) {
+	n := len(b.re.FindAllIndex(body, -1))
+	if n == 0 {
+		return body, 0
+	}
+	if b.Find != "" {
+		return b.re.ReplaceAllLiteral(body, []byte(b.Replace)), n
+	}
+	return b.re.ReplaceAll(body, []byte(b.Replace)), n
+}
+
+// bodyReplace is a replacement bound to the rule that defined it
+type bodyReplace struct {
+	ruleID  string
+	replace *BodyReplace
+}
+
+// ReplaceBody applies the body replacements of the matching rules to a
+// decoded response body, in rule order, returning the new body and an
+// action for each rule that changed it
+func (o *Outcome) ReplaceBody(body []byte) ([]byte, []capture.ActionRecord) {
+	var actions []capture.ActionRecord
+	for _, br := range o.bodyReplace {
+		var n int
+		body, n = br.replace.apply(body)
+		if n == 0 {
+			continue
+		}
+		actions = append(actions, capture.ActionRecord{
+			Type:   capture.ActionBodyReplace,
+			RuleID: br.ruleID,
+			Detail: fmt.Sprintf("%d replacement(s)", n),
+		})
+	}
+	return body, actions
+}
+
+// ReplacesBody reports whether any matching rule rewrites response bodies
+func (o *Outcome) ReplacesBody() bool {
+	return len(o.bodyReplace) > 0
+}
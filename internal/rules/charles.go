@@ -0,0 +1,246 @@
+package rules
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// Charles rewrite rule types that have a native equivalent
+const (
+	charlesAddHeader    = 1
+	charlesModifyHeader = 2
+	charlesRemoveHeader = 3
+	charlesHost         = 4
+	charlesBody         = 7
+)
+
+// charlesSet is a Charles Proxy rewrite set: the locations it applies to
+// and its rewrite rules
+type charlesSet struct {
+	Active    bool              `xml:"active"`
+	Name      string            `xml:"name"`
+	Locations []charlesLocation `xml:"hosts>locationPatterns>locationMatch"`
+	Rules     []charlesRule     `xml:"rules>rewriteRule"`
+}
+
+// charlesLocation is a location a rewrite set applies to
+type charlesLocation struct {
+	Enabled  bool   `xml:"enabled"`
+	Protocol string `xml:"location>protocol"`
+	Host     string `xml:"location>host"`
+	Port     string `xml:"location>port"`
+	Path     string `xml:"location>path"`
+	Query    string `xml:"location>query"`
+}
+
+// charlesRule is one rewrite rule of a set
+type charlesRule struct {
+	Active           bool   `xml:"active"`
+	RuleType         int    `xml:"ruleType"`
+	MatchHeader      string `xml:"matchHeader"`
+	MatchValue       string `xml:"matchValue"`
+	MatchHeaderRegex bool   `xml:"matchHeaderRegex"`
+	MatchValueRegex  bool   `xml:"matchValueRegex"`
+	MatchRequest     bool   `xml:"matchRequest"`
+	MatchResponse    bool   `xml:"matchResponse"`
+	NewHeader        string `xml:"newHeader"`
+	NewValue         string `xml:"newValue"`
+	CaseSensitive    bool   `xml:"caseSensitive"`
+}
+
+// url is the location as a wildcard URL pattern
+func (l charlesLocation) url() string {
+	host := l.Host
+	if host == "" {
+		host = "*"
+	}
+	if l.Port != "" && l.Port != "*" {
+		host += ":" + l.Port
+	}
+	path := l.Path
+	if path == "" {
+		path = "/*"
+	} else if !strings.HasPrefix(path, "/") && !strings.HasPrefix(path, "*") {
+		path = "/" + path
+	}
+	if l.Query != "" {
+		path += "?" + l.Query
+	}
+	return host + path
+}
+
+// importCharles translates rewrite sets, from a rewrite settings export or
+// a full configuration, into one rule per location and rewrite rule
+func importCharles(data []byte, result *ImportResult) error {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	found := false
+	for {
+		tok, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("invalid Charles XML: %w", err)
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok || start.Name.Local != "rewriteSet" {
+			continue
+		}
+		var set charlesSet
+		if err := decoder.DecodeElement(&set, &start); err != nil {
+			return fmt.Errorf("invalid Charles rewrite set: %w", err)
+		}
+		found = true
+		importCharlesSet(set, result)
+	}
+	if !found {
+		return fmt.Errorf("no Charles rewrite sets found")
+	}
+	return nil
+}
+
+// importCharlesSet translates the rules of one rewrite set
+func importCharlesSet(set charlesSet, result *ImportResult) {
+	name := set.Name
+	if name == "" {
+		name = "Charles rewrite"
+	}
+	locations := set.Locations
+	if len(locations) == 0 {
+		// A set without locations applies everywhere
+		locations = []charlesLocation{{Enabled: true}}
+	}
+	for i, rule := range set.Rules {
+		ruleName := fmt.Sprintf("%s #%d", name, i+1)
+		for _, loc := range locations {
+			if !loc.Enabled {
+				continue
+			}
+			native, ok := translateCharlesRule(ruleName, rule, loc, result)
+			if !ok {
+				break
+			}
+			m, exact := matchWildcardURL(loc.url())
+			native.Name = ruleName
+			if len(locations) > 1 {
+				native.Name += " (" + loc.url() + ")"
+			}
+			native.Enabled = set.Active && rule.Active
+			native.Match = m
+			result.add(native, exact)
+		}
+	}
+}
+
+// translateCharlesRule builds the native actions of a rewrite rule,
+// reporting false with a warning when there are none
+func translateCharlesRule(name string, rule charlesRule, loc charlesLocation, result *ImportResult) (Rule, bool) {
+	var native Rule
+	request := rule.MatchRequest || !rule.MatchResponse
+	response := rule.MatchResponse
+
+	switch rule.RuleType {
+	case charlesAddHeader, charlesModifyHeader, charlesRemoveHeader:
+		if rule.MatchHeaderRegex {
+			result.warnf("%s: header name patterns are not supported, skipped", name)
+			return native, false
+		}
+		h := &HeaderRewrite{}
+		set := func(header, value string) {
+			if request {
+				h.Set = setHeader(h.Set, header, value)
+			}
+			if response {
+				h.ResponseSet = setHeader(h.ResponseSet, header, value)
+			}
+		}
+		remove := func(header string) {
+			if request {
+				h.Remove = append(h.Remove, header)
+			}
+			if response {
+				h.ResponseRemove = append(h.ResponseRemove, header)
+			}
+		}
+		switch rule.RuleType {
+		case charlesAddHeader:
+			set(rule.NewHeader, rule.NewValue)
+		case charlesRemoveHeader:
+			if rule.MatchValue != "" {
+				result.warnf("%s: the header is removed whatever its value", name)
+			}
+			remove(rule.MatchHeader)
+		case charlesModifyHeader:
+			if rule.MatchValue != "" {
+				result.warnf("%s: the header is replaced whatever its value", name)
+			}
+			header := rule.NewHeader
+			if header == "" {
+				header = rule.MatchHeader
+			}
+			if rule.NewValue == "" {
+				result.warnf("%s: renaming a header and keeping its value is not supported, skipped", name)
+				return native, false
+			}
+			if !strings.EqualFold(header, rule.MatchHeader) {
+				remove(rule.MatchHeader)
+			}
+			set(header, rule.NewValue)
+		}
+		native.Headers = h
+
+	case charlesHost:
+		if rule.MatchValue != "" && !strings.EqualFold(rule.MatchValue, loc.Host) {
+			result.warnf("%s: the host is replaced on every request at the location", name)
+		}
+		scheme := strings.ToLower(loc.Protocol)
+		if scheme != "http" && scheme != "https" {
+			scheme = "https"
+			result.warnf("%s: no protocol in the location, mapping to https", name)
+		}
+		native.MapRemote = &MapRemote{Backends: []string{scheme + "://" + rule.NewValue}}
+
+	case charlesBody:
+		if !response {
+			result.warnf("%s: request body rewrites are not supported, skipped", name)
+			return native, false
+		}
+		if request {
+			result.warnf("%s: only the response body is rewritten", name)
+		}
+		native.BodyReplace = charlesBodyReplace(rule)
+
+	default:
+		result.warnf("%s: Charles rule type %d is not supported, skipped", name, rule.RuleType)
+		return native, false
+	}
+	return native, true
+}
+
+// charlesBodyReplace translates a body rewrite. An empty match replaces
+// the whole body.
+func charlesBodyReplace(rule charlesRule) *BodyReplace {
+	switch {
+	case rule.MatchValue == "":
+		return &BodyReplace{Pattern: `(?s)\A.*\z`, Replace: strings.ReplaceAll(rule.NewValue, "$", "$$")}
+	case rule.MatchValueRegex:
+		return &BodyReplace{Pattern: rule.MatchValue, Replace: rule.NewValue}
+	case !rule.CaseSensitive:
+		return &BodyReplace{Pattern: "(?i)" + regexp.QuoteMeta(rule.MatchValue), Replace: strings.ReplaceAll(rule.NewValue, "$", "$$")}
+	default:
+		return &BodyReplace{Find: rule.MatchValue, Replace: rule.NewValue}
+	}
+}
+
+// setHeader adds a header to a set, creating it if needed
+func setHeader(set map[string]string, name, value string) map[string]string {
+	if set == nil {
+		set = map[string]string{}
+	}
+	set[name] = value
+	return set
+}
@@ -0,0 +1,176 @@
+package rules
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+)
+
+// CookieRewrite adds, deletes and rewrites cookies on matching requests and
+// the Set-Cookie headers of their responses
+type CookieRewrite struct {
+	// Set adds or overwrites request cookies
+	Set map[string]string `json:"set,omitempty"`
+	// Delete removes request cookies by name
+	Delete []string `json:"delete,omitempty"`
+
+	// ResponseSet overwrites the value of Set-Cookie headers by name,
+	// keeping their attributes, or adds a session cookie
+	ResponseSet map[string]string `json:"response_set,omitempty"`
+	// ResponseDelete removes Set-Cookie headers by name
+	ResponseDelete []string `json:"response_delete,omitempty"`
+	// StripSecure removes the Secure attribute so cookies work over plain
+	// HTTP
+	StripSecure bool `json:"strip_secure,omitempty"`
+	// StripSameSite removes the SameSite attribute
+	StripSameSite bool `json:"strip_samesite,omitempty"`
+}
+
+// validate checks that the rewrite does something
+func (c *CookieRewrite) validate() error {
+	if len(c.Set) == 0 && len(c.Delete) == 0 && len(c.ResponseSet) == 0 &&
+		len(c.ResponseDelete) == 0 && !c.StripSecure && !c.StripSameSite {
+		return fmt.Errorf("cookies rule has no changes")
+	}
+	return nil
+}
+
+// applyRequest edits the Cookie header, describing each change
+func (c *CookieRewrite) applyRequest(header http.Header) []string {
+	if len(c.Set) == 0 && len(c.Delete) == 0 {
+		return nil
+	}
+
+	// Parse by hand rather than with http.Request.Cookies, which drops
+	// pairs it considers invalid
+	var pairs []string
+	for _, line := range header.Values("Cookie") {
+		for _, pair := range strings.Split(line, ";") {
+			if pair = strings.TrimSpace(pair); pair != "" {
+				pairs = append(pairs, pair)
+			}
+		}
+	}
+
+	var changes []string
+	kept := pairs[:0]
+	for _, pair := range pairs {
+		name, _, _ := strings.Cut(pair, "=")
+		if contains(c.Delete, name) {
+			changes = append(changes, "deleted request cookie "+name)
+			continue
+		}
+		if _, ok := c.Set[name]; ok {
+			continue
+		}
+		kept = append(kept, pair)
+	}
+	for _, name := range sortedKeys(c.Set) {
+		kept = append(kept, name+"="+c.Set[name])
+		changes = append(changes, "set request cookie "+name)
+	}
+
+	if len(changes) == 0 {
+		return nil
+	}
+	header.Del("Cookie")
+	if len(kept) > 0 {
+		header.Set("Cookie", strings.Join(kept, "; "))
+	}
+	return changes
+}
+
+// applyResponse edits the Set-Cookie headers, describing each change
+func (c *CookieRewrite) applyResponse(header http.Header) []string {
+	var changes []string
+	var out []string
+	seen := make(map[string]bool)
+
+	for _, line := range header.Values("Set-Cookie") {
+		pair, attrs, _ := strings.Cut(line, ";")
+		name, _, _ := strings.Cut(strings.TrimSpace(pair), "=")
+		seen[name] = true
+
+		if contains(c.ResponseDelete, name) {
+			changes = append(changes, "deleted Set-Cookie "+name)
+			continue
+		}
+		if value, ok := c.ResponseSet[name]; ok {
+			pair = name + "=" + value
+			changes = append(changes, "set response cookie "+name)
+		}
+
+		var kept []string
+		for _, attr := range strings.Split(attrs, ";") {
+			attr = strings.TrimSpace(attr)
+			key, _, _ := strings.Cut(attr, "=")
+			switch {
+			case attr == "":
+				continue
+			case c.StripSecure && strings.EqualFold(key, "Secure"):
+				changes = append(changes, "stripped Secure from "+name)
+				continue
+			case c.StripSameSite && strings.EqualFold(key, "SameSite"):
+				changes = append(changes, "stripped SameSite from "+name)
+				continue
+			}
+			kept = append(kept, attr)
+		}
+		out = append(out, strings.Join(append([]string{pair}, kept...), "; "))
+	}
+
+	for _, name := range sortedKeys(c.ResponseSet) {
+		if !seen[name] {
+			out = append(out, name+"="+c.ResponseSet[name]+"; Path=/")
+			changes = append(changes, "added response cookie "+name)
+		}
+	}
+
+	if len(changes) > 0 {
+		header["Set-Cookie"] = out
+	}
+	return changes
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// cookieRewrite is a rewrite bound to the rule that defined it
+type cookieRewrite struct {
+	ruleID  string
+	rewrite *CookieRewrite
+}
+
+// RewriteSetCookies applies the response-side cookie rewrites of the
+// matching rules, returning an action for each rule that changed something
+func (o *Outcome) RewriteSetCookies(header http.Header) []capture.ActionRecord {
+	var actions []capture.ActionRecord
+	for _, cr := range o.cookies {
+		if changes := cr.rewrite.applyResponse(header); len(changes) > 0 {
+			actions = append(actions, capture.ActionRecord{
+				Type:   capture.ActionCookies,
+				RuleID: cr.ruleID,
+				Detail: strings.Join(changes, "; "),
+			})
+		}
+	}
+	return actions
+}
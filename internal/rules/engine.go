@@ -0,0 +1,243 @@
+package rules
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+	"github.com/google/uuid"
+)
+
+// Outcome describes what the rule engine did to a request
+type Outcome struct {
+	Actions []capture.ActionRecord
+	// Backend is the map-remote backend chosen for the request, if any
+	Backend string
+	// Timeouts is the override from the last matching rule that sets one
+	Timeouts *TimeoutOverride
+	// WouldApply are the request-side actions of matching dry-run rules
+	WouldApply []capture.ActionRecord
+
+	// shadow collects the dry-run rules, which see a copy of the request;
+	// dry is set on it
+	shadow *Outcome
+	dry    bool
+
+	webSocket   []webSocketRewrite
+	bodyReplace []bodyReplace
+	relax       []relaxHeaders
+	inject      []injectHTML
+	cookies     []cookieRewrite
+	headers     []headerRewrite
+
+	// pool and backend are the map-remote routing, path the request path
+	// before it, for failing over
+	pool    *backendPool
+	backend *backend
+	path    string
+}
+
+// Shadow returns the outcome of the matching dry-run rules, nil when
+// there are none. Its response-side methods must be given copies, and
+// the actions they return recorded as would-apply.
+func (o *Outcome) Shadow() *Outcome {
+	return o.shadow
+}
+
+// Done must be called once the exchange has finished
+func (o *Outcome) Done() {
+	if o.backend != nil {
+		o.pool.release(o.backend)
+		o.backend = nil
+	}
+}
+
+// Balanced reports whether a map-remote rule routed the request, so a
+// failed connection can fail over to another backend
+func (o *Outcome) Balanced() bool {
+	return o.backend != nil
+}
+
+// Failover marks the backend req was routed to as down after connecting
+// to it failed with err, and routes req to another backend that is up.
+// It reports false, leaving req alone, when there is none.
+func (o *Outcome) Failover(req *http.Request, err error) bool {
+	if o.backend == nil {
+		return false
+	}
+	o.pool.markDown(o.backend, err)
+	candidates := o.pool.up(o.backend)
+	if len(candidates) == 0 {
+		return false
+	}
+	o.pool.release(o.backend)
+	o.backend = o.pool.choose(candidates)
+	o.pool.route(req, o.path, o.backend)
+	o.Backend = o.backend.url.String()
+	return true
+}
+
+// Engine holds the active rule set and applies it to forwarded traffic
+type Engine struct {
+	mu    sync.RWMutex
+	rules []*Rule
+
+	// healthClient sends map-remote health checks
+	healthClient atomic.Pointer[http.Client]
+
+	// dryRun evaluates every rule as if it were a dry-run rule
+	dryRun atomic.Bool
+}
+
+// NewEngine creates an empty rule engine
+func NewEngine() *Engine {
+	return &Engine{}
+}
+
+// List returns a copy of all rules in evaluation order
+func (e *Engine) List() []Rule {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	result := make([]Rule, len(e.rules))
+	for i, rule := range e.rules {
+		result[i] = rule.view()
+	}
+	return result
+}
+
+// Get returns a copy of the rule with the given ID
+func (e *Engine) Get(id string) (Rule, bool) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	for _, rule := range e.rules {
+		if rule.ID == id {
+			return rule.view(), true
+		}
+	}
+	return Rule{}, false
+}
+
+// Add validates and appends a rule, assigning an ID if it has none
+func (e *Engine) Add(rule Rule) (Rule, error) {
+	if err := rule.Validate(); err != nil {
+		return Rule{}, err
+	}
+	if rule.ID == "" {
+		rule.ID = uuid.New().String()
+	}
+
+	rule.start(e.healthClient.Load())
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.rules = append(e.rules, &rule)
+	return rule.view(), nil
+}
+
+// Update replaces the rule with the same ID, reporting whether it existed
+func (e *Engine) Update(rule Rule) (bool, error) {
+	if err := rule.Validate(); err != nil {
+		return false, err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for i, existing := range e.rules {
+		if existing.ID == rule.ID {
+			existing.stop()
+			rule.start(e.healthClient.Load())
+			e.rules[i] = &rule
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Remove deletes a rule by ID, reporting whether it existed
+func (e *Engine) Remove(id string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for i, rule := range e.rules {
+		if rule.ID == id {
+			rule.stop()
+			e.rules = append(e.rules[:i], e.rules[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Clear removes all rules
+func (e *Engine) Clear() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, rule := range e.rules {
+		rule.stop()
+	}
+	e.rules = nil
+}
+
+// SetHealthClient sets the client map-remote health checks are sent with,
+// so they reach backends the way proxied requests do. Rules added before
+// it is set check with a plain client.
+func (e *Engine) SetHealthClient(client *http.Client) {
+	e.healthClient.Store(client)
+}
+
+// DryRun reports whether every rule is evaluated without being enforced
+func (e *Engine) DryRun() bool {
+	return e.dryRun.Load()
+}
+
+// SetDryRun turns dry-run mode for all rules on or off. The proxy's
+// blocking and pacing features follow the same mode.
+func (e *Engine) SetDryRun(dryRun bool) {
+	e.dryRun.Store(dryRun)
+}
+
+// ApplyRequest runs every enabled, matching rule against an outgoing
+// request in order. The first matching map-remote rule picks the backend.
+// Dry-run rules are applied to a copy of the request, into the outcome's
+// shadow. Callers must call Done on the outcome when the exchange
+// finishes.
+func (e *Engine) ApplyRequest(req *http.Request) *Outcome {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	out, _ := applyRules(e.rules, req, e.dryRun.Load())
+	return out
+}
+
+// applyRules runs rules against req as ApplyRequest does, also returning
+// the rules that matched
+func applyRules(rules []*Rule, req *http.Request, dryRun bool) (*Outcome, []*Rule) {
+	out := &Outcome{}
+	var matched []*Rule
+	var dryReq *http.Request
+	for _, rule := range rules {
+		if !rule.Enabled || !rule.Match.Matches(req) {
+			continue
+		}
+		matched = append(matched, rule)
+		if dryRun || rule.DryRun {
+			if out.shadow == nil {
+				out.shadow = &Outcome{dry: true}
+				dryReq = req.Clone(req.Context())
+			}
+			rule.applyRequest(dryReq, out.shadow)
+			continue
+		}
+		rule.applyRequest(req, out)
+	}
+	if out.shadow != nil {
+		out.WouldApply = out.shadow.Actions
+	}
+	return out, matched
+}
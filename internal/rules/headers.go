@@ -0,0 +1,83 @@
+package rules
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+)
+
+// HeaderRewrite sets and removes headers on matching requests and their
+// responses. Removals run first so a header can be replaced.
+type HeaderRewrite struct {
+	// Set adds or overwrites request headers
+	Set map[string]string `json:"set,omitempty"`
+	// Remove deletes request headers by name
+	Remove []string `json:"remove,omitempty"`
+
+	// ResponseSet adds or overwrites response headers
+	ResponseSet map[string]string `json:"response_set,omitempty"`
+	// ResponseRemove deletes response headers by name
+	ResponseRemove []string `json:"response_remove,omitempty"`
+}
+
+// validate checks that the rewrite does something
+func (h *HeaderRewrite) validate() error {
+	if len(h.Set) == 0 && len(h.Remove) == 0 && len(h.ResponseSet) == 0 && len(h.ResponseRemove) == 0 {
+		return fmt.Errorf("headers rule has no changes")
+	}
+	for _, name := range append(sortedKeys(h.Set), sortedKeys(h.ResponseSet)...) {
+		if name == "" || strings.ContainsAny(name, " :\r\n") {
+			return fmt.Errorf("invalid header name %q", name)
+		}
+	}
+	return nil
+}
+
+// applyRequest edits request headers, describing each change
+func (h *HeaderRewrite) applyRequest(header http.Header) []string {
+	return editHeaders(header, h.Remove, h.Set)
+}
+
+// applyResponse edits response headers, describing each change
+func (h *HeaderRewrite) applyResponse(header http.Header) []string {
+	return editHeaders(header, h.ResponseRemove, h.ResponseSet)
+}
+
+func editHeaders(header http.Header, remove []string, set map[string]string) []string {
+	var changes []string
+	for _, name := range remove {
+		if _, ok := header[http.CanonicalHeaderKey(name)]; ok {
+			header.Del(name)
+			changes = append(changes, "removed "+http.CanonicalHeaderKey(name))
+		}
+	}
+	for _, name := range sortedKeys(set) {
+		header.Set(name, set[name])
+		changes = append(changes, "set "+http.CanonicalHeaderKey(name))
+	}
+	return changes
+}
+
+// headerRewrite is a rewrite bound to the rule that defined it
+type headerRewrite struct {
+	ruleID  string
+	rewrite *HeaderRewrite
+}
+
+// RewriteHeaders applies the response-side header rewrites of the
+// matching rules, returning an action for each rule that changed something
+func (o *Outcome) RewriteHeaders(header http.Header) []capture.ActionRecord {
+	var actions []capture.ActionRecord
+	for _, hr := range o.headers {
+		if changes := hr.rewrite.applyResponse(header); len(changes) > 0 {
+			actions = append(actions, capture.ActionRecord{
+				Type:   capture.ActionHeader,
+				RuleID: hr.ruleID,
+				Detail: strings.Join(changes, "; "),
+			})
+		}
+	}
+	return actions
+}
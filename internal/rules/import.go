@@ -0,0 +1,173 @@
+package rules
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Formats of other tools' rule exports that Import translates
+const (
+	FormatCharles   = "charles"
+	FormatProxyman  = "proxyman"
+	FormatModHeader = "modheader"
+)
+
+// ImportResult holds the native rules translated from another tool's
+// export, with notes on what could not be carried over. Rules whose
+// conditions the native match cannot express exactly are disabled, so they
+// never apply to more traffic than intended.
+type ImportResult struct {
+	Format   string   `json:"format"`
+	Rules    []Rule   `json:"rules"`
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// warnf adds a warning, once
+func (r *ImportResult) warnf(format string, args ...interface{}) {
+	if msg := fmt.Sprintf(format, args...); !contains(r.Warnings, msg) {
+		r.Warnings = append(r.Warnings, msg)
+	}
+}
+
+// add appends a rule, disabling it with a warning when its match is
+// broader than the original's
+func (r *ImportResult) add(rule Rule, exact bool) {
+	if !exact && rule.Enabled {
+		rule.Enabled = false
+		r.warnf("%s: imported disabled, its URL pattern can only be matched approximately", rule.Name)
+	}
+	r.Rules = append(r.Rules, rule)
+}
+
+// Import translates a rule export of Charles Proxy (rewrite sets, XML),
+// Proxyman (JSON) or ModHeader (JSON profiles) into native rules. An
+// empty format is detected from the data. The rules are not validated.
+func Import(format string, data []byte) (ImportResult, error) {
+	if format == "" {
+		format = detectFormat(data)
+	}
+	result := ImportResult{Format: format, Rules: []Rule{}}
+	var err error
+	switch format {
+	case FormatCharles:
+		err = importCharles(data, &result)
+	case FormatProxyman:
+		err = importProxyman(data, &result)
+	case FormatModHeader:
+		err = importModHeader(data, &result)
+	default:
+		return result, fmt.Errorf("unknown import format %q (want %s, %s or %s)", format, FormatCharles, FormatProxyman, FormatModHeader)
+	}
+	return result, err
+}
+
+// detectFormat guesses the tool an export comes from: Charles writes XML,
+// ModHeader a list of profiles with headers, and Proxyman anything else
+func detectFormat(data []byte) string {
+	data = bytes.TrimSpace(data)
+	if bytes.HasPrefix(data, []byte("<")) {
+		return FormatCharles
+	}
+	var probe interface{}
+	if json.Unmarshal(data, &probe) != nil {
+		return ""
+	}
+	if obj, ok := probe.(map[string]interface{}); ok {
+		if _, ok := obj["profiles"]; ok {
+			return FormatModHeader
+		}
+	}
+	if list, ok := probe.([]interface{}); ok && len(list) > 0 {
+		if obj, ok := list[0].(map[string]interface{}); ok {
+			for _, key := range []string{"headers", "respHeaders", "requestHeaders", "responseHeaders"} {
+				if _, ok := obj[key]; ok {
+					return FormatModHeader
+				}
+			}
+		}
+	}
+	return FormatProxyman
+}
+
+// matchWildcardURL translates a URL pattern with * wildcards, such as
+// "https://*.example.com/api/*", into a native match. The scheme and port
+// are not matched. It reports false when the match is broader than the
+// pattern: wildcards inside a host label or a path, or a query.
+func matchWildcardURL(pattern string) (Match, bool) {
+	rest := strings.TrimSpace(pattern)
+	if i := strings.Index(rest, "://"); i >= 0 {
+		rest = rest[i+3:]
+	}
+	host, path := rest, ""
+	if i := strings.IndexByte(rest, '/'); i >= 0 {
+		host, path = rest[:i], rest[i:]
+	}
+	exact := true
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		query := path[i+1:]
+		path = path[:i]
+		exact = query == "" || query == "*"
+	}
+
+	var m Match
+	if h := hostWithoutPort(host); h != "" && h != "*" {
+		if strings.Contains(strings.TrimPrefix(h, "*."), "*") {
+			exact = false
+			// Keep the part after the last wildcard label, if any
+			if i := strings.LastIndex(h, "*."); i >= 0 {
+				m.Host = h[i:]
+			}
+		} else {
+			m.Host = h
+		}
+	}
+
+	if i := strings.IndexByte(path, '*'); i >= 0 {
+		exact = exact && i == len(path)-1
+		path = path[:i]
+	}
+	if path != "" && path != "/" {
+		m.PathPrefix = path
+	}
+	return m, exact
+}
+
+// hostWithoutPort strips a port from a host pattern
+func hostWithoutPort(host string) string {
+	if i := strings.LastIndexByte(host, ':'); i >= 0 && !strings.Contains(host[i:], "]") {
+		return host[:i]
+	}
+	return host
+}
+
+// regexMeta are characters left in a regular expression that a wildcard
+// pattern cannot express
+var regexMeta = regexp.MustCompile(`[\\^$+?()\[\]{}|]`)
+
+// matchRegexURL translates a URL regular expression into a native match
+// when it is a wildcard pattern in disguise, such as
+// ".*://api\.example\.com/.*". It reports false when the match is
+// broader than the expression.
+func matchRegexURL(expr string) (Match, bool) {
+	s := strings.TrimSuffix(strings.TrimPrefix(expr, "^"), "$")
+	s = strings.ReplaceAll(s, ".*", "*")
+	s = strings.ReplaceAll(s, `\.`, ".")
+	s = strings.ReplaceAll(s, `\/`, "/")
+	s = strings.ReplaceAll(s, "https?", "http")
+	if regexMeta.MatchString(s) {
+		return Match{}, false
+	}
+	// An unanchored expression matches anywhere in the URL
+	if !strings.HasPrefix(expr, "^") && !strings.HasPrefix(s, "*") && !strings.Contains(s, "://") {
+		return Match{}, false
+	}
+	m, exact := matchWildcardURL(s)
+	if !strings.HasSuffix(expr, "$") && !strings.HasSuffix(s, "*") {
+		// Without an end anchor the last part is a prefix
+		exact = exact && m.PathPrefix != ""
+	}
+	return m, exact
+}
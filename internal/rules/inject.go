@@ -0,0 +1,91 @@
+package rules
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+)
+
+// Injection positions in an HTML document
+const (
+	// InjectBodyEnd places the snippet before </body>
+	InjectBodyEnd = "body"
+	// InjectHeadEnd places the snippet before </head>
+	InjectHeadEnd = "head"
+)
+
+// InjectHTML inserts a snippet, such as a debug toolbar script, into
+// matching HTML responses. Documents without the closing tag are left alone.
+type InjectHTML struct {
+	Snippet string `json:"snippet"`
+	// Position is "body" (default, before </body>) or "head" (before
+	// </head>)
+	Position string `json:"position,omitempty"`
+}
+
+// validate checks the injection
+func (i *InjectHTML) validate() error {
+	if i.Snippet == "" {
+		return fmt.Errorf("inject requires a snippet")
+	}
+	switch i.Position {
+	case "", InjectBodyEnd, InjectHeadEnd:
+	default:
+		return fmt.Errorf("unknown inject position %q (want %s or %s)", i.Position, InjectBodyEnd, InjectHeadEnd)
+	}
+	return nil
+}
+
+// apply inserts the snippet before the last closing tag, reporting whether
+// the tag was found
+func (i *InjectHTML) apply(body []byte) ([]byte, bool) {
+	tag := []byte("</body")
+	if i.Position == InjectHeadEnd {
+		tag = []byte("</head")
+	}
+	at := bytes.LastIndex(bytes.ToLower(body), tag)
+	if at < 0 {
+		return body, false
+	}
+
+	out := make([]byte, 0, len(body)+len(i.Snippet))
+	out = append(out, body[:at]...)
+	out = append(out, i.Snippet...)
+	return append(out, body[at:]...), true
+}
+
+// injectHTML is an injection bound to the rule that defined it
+type injectHTML struct {
+	ruleID string
+	inject *InjectHTML
+}
+
+// InjectHTML applies the injections of the matching rules to a decoded
+// HTML body, in rule order, returning the new body and an action for each
+// snippet inserted
+func (o *Outcome) InjectHTML(body []byte) ([]byte, []capture.ActionRecord) {
+	var actions []capture.ActionRecord
+	for _, ih := range o.inject {
+		var ok bool
+		body, ok = ih.inject.apply(body)
+		if !ok {
+			continue
+		}
+		position := ih.inject.Position
+		if position == "" {
+			position = InjectBodyEnd
+		}
+		actions = append(actions, capture.ActionRecord{
+			Type:   capture.ActionInjectHTML,
+			RuleID: ih.ruleID,
+			Detail: fmt.Sprintf("%d bytes at end of %s", len(ih.inject.Snippet), position),
+		})
+	}
+	return body, actions
+}
+
+// InjectsHTML reports whether any matching rule injects into HTML bodies
+func (o *Outcome) InjectsHTML() bool {
+	return len(o.inject) > 0
+}
@@ -0,0 +1,138 @@
+package rules
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+)
+
+// modHeaderProfile is a ModHeader profile: headers to change on requests
+// and responses, and the URL filters that limit them
+type modHeaderProfile struct {
+	Title           string            `json:"title"`
+	Headers         []modHeaderEntry  `json:"headers"`
+	RequestHeaders  []modHeaderEntry  `json:"requestHeaders"`
+	RespHeaders     []modHeaderEntry  `json:"respHeaders"`
+	ResponseHeaders []modHeaderEntry  `json:"responseHeaders"`
+	Filters         []modHeaderFilter `json:"filters"`
+	URLReplacements []modHeaderEntry  `json:"urlReplacements"`
+}
+
+// modHeaderEntry is a header or URL replacement. An empty header value
+// removes the header.
+type modHeaderEntry struct {
+	Enabled *bool  `json:"enabled"`
+	Name    string `json:"name"`
+	Value   string `json:"value"`
+}
+
+// modHeaderFilter limits a profile to matching URLs
+type modHeaderFilter struct {
+	Enabled  *bool  `json:"enabled"`
+	Type     string `json:"type"`
+	URLRegex string `json:"urlRegex"`
+}
+
+// on reports whether an entry is enabled, as it is unless set otherwise
+func on(enabled *bool) bool {
+	return enabled == nil || *enabled
+}
+
+// importModHeader translates ModHeader profiles, as a list or under
+// "profiles", into one rule per profile and URL filter
+func importModHeader(data []byte, result *ImportResult) error {
+	var profiles []modHeaderProfile
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		var export struct {
+			Profiles []modHeaderProfile `json:"profiles"`
+		}
+		if err := json.Unmarshal(data, &export); err != nil {
+			return fmt.Errorf("invalid ModHeader JSON: %w", err)
+		}
+		profiles = export.Profiles
+	}
+	for i, profile := range profiles {
+		importModHeaderProfile(i, profile, result)
+	}
+	return nil
+}
+
+// importModHeaderProfile translates one profile
+func importModHeaderProfile(index int, profile modHeaderProfile, result *ImportResult) {
+	name := profile.Title
+	if name == "" {
+		name = fmt.Sprintf("Profile %d", index+1)
+	}
+	name = "ModHeader: " + name
+
+	h := &HeaderRewrite{}
+	for _, e := range append(profile.Headers, profile.RequestHeaders...) {
+		if !on(e.Enabled) || e.Name == "" {
+			continue
+		}
+		if e.Value == "" {
+			h.Remove = append(h.Remove, e.Name)
+		} else {
+			h.Set = setHeader(h.Set, e.Name, e.Value)
+		}
+	}
+	for _, e := range append(profile.RespHeaders, profile.ResponseHeaders...) {
+		if !on(e.Enabled) || e.Name == "" {
+			continue
+		}
+		if e.Value == "" {
+			h.ResponseRemove = append(h.ResponseRemove, e.Name)
+		} else {
+			h.ResponseSet = setHeader(h.ResponseSet, e.Name, e.Value)
+		}
+	}
+
+	// Each URL filter widens the profile, so each gets its own rule
+	matches, exact := []Match{{}}, true
+	var urlFilters []Match
+	for _, f := range profile.Filters {
+		if !on(f.Enabled) {
+			continue
+		}
+		if f.Type != "" && f.Type != "urls" {
+			result.warnf("%s: %s filters are not supported", name, f.Type)
+			exact = false
+			continue
+		}
+		m, ok := matchRegexURL(f.URLRegex)
+		exact = exact && ok
+		urlFilters = append(urlFilters, m)
+	}
+	if len(urlFilters) > 0 {
+		matches = urlFilters
+	}
+
+	if len(h.Set) > 0 || len(h.Remove) > 0 || len(h.ResponseSet) > 0 || len(h.ResponseRemove) > 0 {
+		for _, m := range matches {
+			result.add(Rule{Name: name, Enabled: true, Match: m, Headers: h}, exact)
+		}
+	}
+
+	for _, e := range profile.URLReplacements {
+		if !on(e.Enabled) {
+			continue
+		}
+		from, err := url.Parse(e.Name)
+		if err != nil || from.Host == "" || (from.Path != "" && from.Path != "/") {
+			result.warnf("%s: only origin URL replacements are supported, skipped %q", name, e.Name)
+			continue
+		}
+		for _, m := range matches {
+			if m.Host != "" && m.Host != from.Hostname() {
+				continue
+			}
+			m.Host = from.Hostname()
+			result.add(Rule{
+				Name:      name + " (" + e.Name + ")",
+				Enabled:   true,
+				Match:     m,
+				MapRemote: &MapRemote{Backends: []string{e.Value}},
+			}, exact)
+		}
+	}
+}
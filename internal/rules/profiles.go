@@ -0,0 +1,88 @@
+package rules
+
+import (
+	"net/http"
+	"sort"
+)
+
+// DeviceProfile is a set of request headers that impersonate a client
+type DeviceProfile struct {
+	Name        string            `json:"name"`
+	Description string            `json:"description"`
+	Headers     map[string]string `json:"headers"`
+}
+
+// clientHintHeaders are removed for profiles that don't send them, so a
+// Chromium client's hints don't contradict a spoofed non-Chromium agent
+var clientHintHeaders = []string{
+	"Sec-Ch-Ua",
+	"Sec-Ch-Ua-Mobile",
+	"Sec-Ch-Ua-Platform",
+}
+
+// profiles are the built-in device profiles
+var profiles = map[string]DeviceProfile{
+	"iphone-safari": {
+		Name:        "iphone-safari",
+		Description: "Safari on iPhone (iOS 17)",
+		Headers: map[string]string{
+			"User-Agent":      "Mozilla/5.0 (iPhone; CPU iPhone OS 17_4 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4 Mobile/15E148 Safari/604.1",
+			"Accept":          "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8",
+			"Accept-Language": "en-US,en;q=0.9",
+		},
+	},
+	"android-chrome": {
+		Name:        "android-chrome",
+		Description: "Chrome on Android (Pixel)",
+		Headers: map[string]string{
+			"User-Agent":         "Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Mobile Safari/537.36",
+			"Accept":             "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,image/apng,*/*;q=0.8",
+			"Accept-Language":    "en-US,en;q=0.9",
+			"Sec-Ch-Ua":          `"Chromium";v="124", "Google Chrome";v="124", "Not-A.Brand";v="99"`,
+			"Sec-Ch-Ua-Mobile":   "?1",
+			"Sec-Ch-Ua-Platform": `"Android"`,
+		},
+	},
+	"googlebot": {
+		Name:        "googlebot",
+		Description: "Googlebot smartphone crawler",
+		Headers: map[string]string{
+			"User-Agent":      "Mozilla/5.0 (Linux; Android 6.0.1; Nexus 5X Build/MMB29P) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Mobile Safari/537.36 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)",
+			"Accept":          "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8",
+			"Accept-Language": "en-US",
+		},
+	},
+	"curl": {
+		Name:        "curl",
+		Description: "curl command-line client",
+		Headers: map[string]string{
+			"User-Agent": "curl/8.7.1",
+			"Accept":     "*/*",
+		},
+	},
+}
+
+// apply rewrites header to match the profile
+func (p DeviceProfile) apply(header http.Header) {
+	for _, name := range clientHintHeaders {
+		header.Del(name)
+	}
+	if p.Headers["Accept-Language"] == "" {
+		header.Del("Accept-Language")
+	}
+	for name, value := range p.Headers {
+		header.Set(name, value)
+	}
+}
+
+// Profiles returns the built-in device profiles sorted by name
+func Profiles() []DeviceProfile {
+	result := make([]DeviceProfile, 0, len(profiles))
+	for _, p := range profiles {
+		result = append(result, p)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
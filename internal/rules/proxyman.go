@@ -0,0 +1,131 @@
+package rules
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// proxymanRule is a rule exported from one of Proxyman's tools
+type proxymanRule struct {
+	Name      string `json:"name"`
+	IsEnabled *bool  `json:"isEnabled"`
+	URL       string `json:"url"`
+	Method    string `json:"method"`
+	IsRegex   bool   `json:"isRegex"`
+	// Tool names the tool a rule belongs to in a combined export
+	Tool string `json:"tool"`
+
+	// ToURL and Destination are a Map Remote rule's target
+	ToURL       string               `json:"toURL"`
+	Destination *proxymanDestination `json:"destination"`
+}
+
+// proxymanDestination is a Map Remote target given by parts
+type proxymanDestination struct {
+	Scheme string `json:"scheme"`
+	Host   string `json:"host"`
+	Port   int    `json:"port"`
+	Path   string `json:"path"`
+}
+
+// importProxyman translates Proxyman rules: a list of rules, a list tagged
+// with their tool, or an object of lists keyed by tool. Map Remote rules
+// become map_remote rules; the other tools have no native equivalent.
+func importProxyman(data []byte, result *ImportResult) error {
+	var list []proxymanRule
+	if err := json.Unmarshal(data, &list); err == nil {
+		for _, rule := range list {
+			importProxymanRule(rule.Tool, rule, result)
+		}
+		return nil
+	}
+
+	var byTool map[string]json.RawMessage
+	if err := json.Unmarshal(data, &byTool); err != nil {
+		return fmt.Errorf("invalid Proxyman JSON: %w", err)
+	}
+	if raw, ok := byTool["rules"]; ok && len(byTool) == 1 {
+		if err := json.Unmarshal(raw, &list); err != nil {
+			return fmt.Errorf("invalid Proxyman rules: %w", err)
+		}
+		for _, rule := range list {
+			importProxymanRule(rule.Tool, rule, result)
+		}
+		return nil
+	}
+	tools := make([]string, 0, len(byTool))
+	for tool := range byTool {
+		tools = append(tools, tool)
+	}
+	sort.Strings(tools)
+	for _, tool := range tools {
+		list = nil
+		if err := json.Unmarshal(byTool[tool], &list); err != nil {
+			result.warnf("Proxyman %s: not a list of rules, skipped", tool)
+			continue
+		}
+		for _, rule := range list {
+			importProxymanRule(tool, rule, result)
+		}
+	}
+	return nil
+}
+
+// importProxymanRule translates one rule of a tool. Untagged rules with a
+// target are taken as Map Remote rules.
+func importProxymanRule(tool string, rule proxymanRule, result *ImportResult) {
+	name := rule.Name
+	if name == "" {
+		name = rule.URL
+	}
+	name = "Proxyman: " + name
+	normalized := strings.ToLower(strings.NewReplacer(" ", "", "-", "", "_", "").Replace(tool))
+	if normalized == "" && (rule.ToURL != "" || rule.Destination != nil) {
+		normalized = "mapremote"
+	}
+	if normalized != "mapremote" {
+		if tool == "" {
+			tool = "unknown tool"
+		}
+		result.warnf("%s: %s rules are not supported, skipped", name, tool)
+		return
+	}
+
+	target := rule.ToURL
+	if d := rule.Destination; target == "" && d != nil {
+		u := url.URL{Scheme: d.Scheme, Host: d.Host, Path: d.Path}
+		if u.Scheme == "" {
+			u.Scheme = "https"
+		}
+		if d.Port != 0 {
+			u.Host = fmt.Sprintf("%s:%d", d.Host, d.Port)
+		}
+		target = u.String()
+	}
+	if target == "" {
+		result.warnf("%s: no destination, skipped", name)
+		return
+	}
+
+	var (
+		m     Match
+		exact bool
+	)
+	if rule.IsRegex {
+		m, exact = matchRegexURL(rule.URL)
+	} else {
+		m, exact = matchWildcardURL(rule.URL)
+	}
+	if rule.Method != "" && !strings.EqualFold(rule.Method, "ANY") {
+		m.Method = strings.ToUpper(rule.Method)
+	}
+	result.add(Rule{
+		Name:      name,
+		Enabled:   rule.IsEnabled == nil || *rule.IsEnabled,
+		Match:     m,
+		MapRemote: &MapRemote{Backends: []string{target}},
+	}, exact)
+}
@@ -0,0 +1,93 @@
+package rules
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+)
+
+// RelaxHeaders strips or loosens browser security headers on matching
+// responses, so pages can be embedded or have debug scripts injected
+type RelaxHeaders struct {
+	// CSP removes Content-Security-Policy and its report-only variant
+	CSP bool `json:"csp,omitempty"`
+	// FrameOptions removes X-Frame-Options
+	FrameOptions bool `json:"frame_options,omitempty"`
+	// CORS allows the requesting origin with credentials, and whatever
+	// method and headers a preflight asks for
+	CORS bool `json:"cors,omitempty"`
+}
+
+// validate checks that the rule relaxes something
+func (x *RelaxHeaders) validate() error {
+	if !x.CSP && !x.FrameOptions && !x.CORS {
+		return fmt.Errorf("relax requires at least one of csp, frame_options or cors")
+	}
+	return nil
+}
+
+// apply edits the response headers, describing each change
+func (x *RelaxHeaders) apply(requestHeader, header http.Header) []string {
+	var changes []string
+	remove := func(names ...string) {
+		for _, name := range names {
+			if _, ok := header[name]; ok {
+				header.Del(name)
+				changes = append(changes, "removed "+name)
+			}
+		}
+	}
+
+	if x.CSP {
+		remove("Content-Security-Policy", "Content-Security-Policy-Report-Only")
+	}
+	if x.FrameOptions {
+		remove("X-Frame-Options")
+	}
+	if x.CORS {
+		// A wildcard cannot be combined with credentials, so reflect the
+		// origin when there is one
+		if origin := requestHeader.Get("Origin"); origin != "" {
+			header.Set("Access-Control-Allow-Origin", origin)
+			header.Set("Access-Control-Allow-Credentials", "true")
+			header.Add("Vary", "Origin")
+			changes = append(changes, "allowed origin "+origin)
+		} else {
+			header.Set("Access-Control-Allow-Origin", "*")
+			changes = append(changes, "allowed any origin")
+		}
+		if method := requestHeader.Get("Access-Control-Request-Method"); method != "" {
+			header.Set("Access-Control-Allow-Methods", method)
+			if headers := requestHeader.Values("Access-Control-Request-Headers"); len(headers) > 0 {
+				header.Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+			}
+		}
+	}
+	return changes
+}
+
+// relaxHeaders is a relaxation bound to the rule that defined it
+type relaxHeaders struct {
+	ruleID string
+	relax  *RelaxHeaders
+}
+
+// RelaxResponse applies the header relaxations of the matching rules to a
+// response, returning an action for each rule that changed it
+func (o *Outcome) RelaxResponse(requestHeader, header http.Header) []capture.ActionRecord {
+	var actions []capture.ActionRecord
+	for _, rh := range o.relax {
+		changes := rh.relax.apply(requestHeader, header)
+		if len(changes) == 0 {
+			continue
+		}
+		actions = append(actions, capture.ActionRecord{
+			Type:   capture.ActionRelaxHeaders,
+			RuleID: rh.ruleID,
+			Detail: strings.Join(changes, "; "),
+		})
+	}
+	return actions
+}
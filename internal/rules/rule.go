@@ -0,0 +1,214 @@
+package rules
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/adamdrake/go_proxy/internal/capture"
+	"github.com/adamdrake/go_proxy/internal/hostmatch"
+)
+
+// Rule modifies forwarded traffic matching its conditions
+type Rule struct {
+	ID      string `json:"id"`
+	Name    string `json:"name,omitempty"`
+	Enabled bool   `json:"enabled"`
+	Match   Match  `json:"match"`
+
+	// DryRun evaluates the rule and records what it would have done
+	// without touching traffic
+	DryRun bool `json:"dry_run,omitempty"`
+
+	// DeviceProfile rewrites request headers to impersonate a device
+	DeviceProfile string `json:"device_profile,omitempty"`
+
+	// MapRemote sends the request to one of a set of backends
+	MapRemote *MapRemote `json:"map_remote,omitempty"`
+
+	// Timeouts overrides upstream timeouts for matching requests
+	Timeouts *TimeoutOverride `json:"timeouts,omitempty"`
+
+	// WebSocket rewrites or drops messages on matching WebSocket connections
+	WebSocket *WebSocketRewrite `json:"websocket,omitempty"`
+
+	// BodyReplace substitutes text in matching responses' bodies
+	BodyReplace *BodyReplace `json:"body_replace,omitempty"`
+
+	// Relax strips or loosens security headers on matching responses
+	Relax *RelaxHeaders `json:"relax,omitempty"`
+
+	// Inject inserts a snippet into matching HTML responses
+	Inject *InjectHTML `json:"inject,omitempty"`
+
+	// Cookies rewrites request cookies and response Set-Cookie headers
+	Cookies *CookieRewrite `json:"cookies,omitempty"`
+
+	// Headers sets and removes request and response headers
+	Headers *HeaderRewrite `json:"headers,omitempty"`
+
+	pool *backendPool
+}
+
+// TimeoutOverride replaces upstream timeouts for matching requests. Unset
+// fields keep the configured value; zero lifts the limit.
+type TimeoutOverride struct {
+	ConnectSeconds        *float64 `json:"connect_seconds,omitempty"`
+	TLSHandshakeSeconds   *float64 `json:"tls_handshake_seconds,omitempty"`
+	ResponseHeaderSeconds *float64 `json:"response_header_seconds,omitempty"`
+	BodyReadSeconds       *float64 `json:"body_read_seconds,omitempty"`
+}
+
+// Match selects the requests a rule applies to. Empty fields match anything.
+type Match struct {
+	// Host is a host pattern ("api.example.com", "*.example.com", "*")
+	Host string `json:"host,omitempty"`
+	// PathPrefix matches the start of the request path
+	PathPrefix string `json:"path_prefix,omitempty"`
+	// Method matches the request method (case-insensitive)
+	Method string `json:"method,omitempty"`
+}
+
+// Matches reports whether r satisfies the conditions
+func (m Match) Matches(r *http.Request) bool {
+	if m.Host != "" && !hostmatch.Match(m.Host, r.URL.Host) {
+		return false
+	}
+	if m.PathPrefix != "" && !strings.HasPrefix(r.URL.Path, m.PathPrefix) {
+		return false
+	}
+	if m.Method != "" && !strings.EqualFold(m.Method, r.Method) {
+		return false
+	}
+	return true
+}
+
+// Validate checks that the rule is well formed
+func (r *Rule) Validate() error {
+	if r.DeviceProfile != "" {
+		if _, ok := profiles[r.DeviceProfile]; !ok {
+			return fmt.Errorf("unknown device profile %q", r.DeviceProfile)
+		}
+	}
+	if r.MapRemote != nil {
+		if err := r.MapRemote.validate(); err != nil {
+			return err
+		}
+	}
+	if r.WebSocket != nil {
+		if err := r.WebSocket.validate(); err != nil {
+			return err
+		}
+	}
+	if r.BodyReplace != nil {
+		if err := r.BodyReplace.validate(); err != nil {
+			return err
+		}
+	}
+	if r.Relax != nil {
+		if err := r.Relax.validate(); err != nil {
+			return err
+		}
+	}
+	if r.Inject != nil {
+		if err := r.Inject.validate(); err != nil {
+			return err
+		}
+	}
+	if r.Cookies != nil {
+		if err := r.Cookies.validate(); err != nil {
+			return err
+		}
+	}
+	if r.Headers != nil {
+		if err := r.Headers.validate(); err != nil {
+			return err
+		}
+	}
+	if t := r.Timeouts; t != nil {
+		for _, s := range []*float64{t.ConnectSeconds, t.TLSHandshakeSeconds, t.ResponseHeaderSeconds, t.BodyReadSeconds} {
+			if s != nil && *s < 0 {
+				return fmt.Errorf("timeouts must not be negative")
+			}
+		}
+	}
+	return nil
+}
+
+// start allocates runtime state such as backend pools, whose health
+// checks use healthClient
+func (r *Rule) start(healthClient *http.Client) {
+	if r.MapRemote != nil {
+		r.pool = newBackendPool(r.MapRemote, healthClient)
+	}
+}
+
+// stop releases runtime state
+func (r *Rule) stop() {
+	if r.pool != nil {
+		r.pool.close()
+	}
+}
+
+// view returns a copy of the rule for API output, including live state
+func (r *Rule) view() Rule {
+	out := *r
+	if r.MapRemote != nil && r.pool != nil {
+		m := *r.MapRemote
+		m.Health = r.pool.health()
+		out.MapRemote = &m
+	}
+	return out
+}
+
+// applyRequest performs the rule's request-side actions, recording them
+// on the outcome
+func (r *Rule) applyRequest(req *http.Request, out *Outcome) {
+	if r.DeviceProfile != "" {
+		profiles[r.DeviceProfile].apply(req.Header)
+		out.Actions = append(out.Actions, r.action(capture.ActionDeviceProfile, r.DeviceProfile))
+	}
+	if r.Timeouts != nil {
+		out.Timeouts = r.Timeouts
+	}
+	if r.WebSocket != nil {
+		out.webSocket = append(out.webSocket, webSocketRewrite{ruleID: r.ID, rewrite: r.WebSocket})
+	}
+	if r.BodyReplace != nil {
+		out.bodyReplace = append(out.bodyReplace, bodyReplace{ruleID: r.ID, replace: r.BodyReplace})
+	}
+	if r.Relax != nil {
+		out.relax = append(out.relax, relaxHeaders{ruleID: r.ID, relax: r.Relax})
+	}
+	if r.Inject != nil {
+		out.inject = append(out.inject, injectHTML{ruleID: r.ID, inject: r.Inject})
+	}
+	if r.Cookies != nil {
+		if changes := r.Cookies.applyRequest(req.Header); len(changes) > 0 {
+			out.Actions = append(out.Actions, r.action(capture.ActionCookies, strings.Join(changes, "; ")))
+		}
+		out.cookies = append(out.cookies, cookieRewrite{ruleID: r.ID, rewrite: r.Cookies})
+	}
+	if r.Headers != nil {
+		if changes := r.Headers.applyRequest(req.Header); len(changes) > 0 {
+			out.Actions = append(out.Actions, r.action(capture.ActionHeader, strings.Join(changes, "; ")))
+		}
+		out.headers = append(out.headers, headerRewrite{ruleID: r.ID, rewrite: r.Headers})
+	}
+	if r.pool != nil && out.Backend == "" && out.dry {
+		// Routing counts against the backends, so a dry run only names them
+		out.Backend = strings.Join(r.MapRemote.Backends, ", ")
+		out.Actions = append(out.Actions, r.action(capture.ActionMapRemote, "one of "+out.Backend))
+	}
+	if r.pool != nil && out.Backend == "" {
+		out.pool, out.backend, out.path = r.pool, r.pool.pick(), req.URL.Path
+		r.pool.route(req, out.path, out.backend)
+		out.Backend = out.backend.url.String()
+		out.Actions = append(out.Actions, r.action(capture.ActionMapRemote, out.Backend))
+	}
+}
+
+// action builds an ActionRecord attributed to the rule
+func (r *Rule) action(typ, detail string) capture.ActionRecord {
+	return capture.ActionRecord{Type: typ, RuleID: r.ID, Detail: detail}
+}
@@ -0,0 +1,49 @@
+package rules
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+)
+
+// Evaluate applies a candidate rule set to req as the engine would,
+// without installing it, so rules can be tried out before they are added.
+// Each rule is validated first. Map-remote rules route to their backends
+// as if all were healthy, without health checks. It returns the outcome
+// and the indexes in set of the rules that matched; dryRun evaluates every
+// rule as a dry-run rule. The outcome's Done has been called.
+func Evaluate(set []Rule, req *http.Request, dryRun bool) (*Outcome, []int, error) {
+	candidates := make([]*Rule, len(set))
+	for i := range set {
+		rule := set[i]
+		// Validation compiles patterns into the rule; keep them off rules
+		// shared with an engine
+		if rule.BodyReplace != nil {
+			replace := *rule.BodyReplace
+			rule.BodyReplace = &replace
+		}
+		if rule.WebSocket != nil {
+			rewrite := *rule.WebSocket
+			rule.WebSocket = &rewrite
+		}
+		if err := rule.Validate(); err != nil {
+			return nil, nil, fmt.Errorf("rule %d: %w", i, err)
+		}
+		if rule.MapRemote != nil {
+			m := *rule.MapRemote
+			m.HealthPath = ""
+			rule.pool = newBackendPool(&m, nil)
+		}
+		candidates[i] = &rule
+	}
+
+	out, matched := applyRules(candidates, req, dryRun)
+	out.Done()
+	indexes := make([]int, 0, len(matched))
+	for i, rule := range candidates {
+		if slices.Contains(matched, rule) {
+			indexes = append(indexes, i)
+		}
+	}
+	return out, indexes, nil
+}
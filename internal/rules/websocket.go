@@ -0,0 +1,82 @@
+package rules
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// WebSocket message directions
+const (
+	// Upstream messages travel from the client to the server
+	Upstream = "upstream"
+	// Downstream messages travel from the server to the client
+	Downstream = "downstream"
+)
+
+// WebSocketRewrite modifies or drops messages on WebSocket connections whose
+// handshake matches the rule
+type WebSocketRewrite struct {
+	// Direction limits the rewrite to "upstream" or "downstream" messages;
+	// empty applies it to both
+	Direction string `json:"direction,omitempty"`
+	// Pattern is a regular expression matched against message payloads
+	Pattern string `json:"pattern"`
+	// Replace replaces every match, with $1-style group expansion
+	Replace string `json:"replace,omitempty"`
+	// Drop discards matching messages instead of rewriting them
+	Drop bool `json:"drop,omitempty"`
+
+	re *regexp.Regexp
+}
+
+// validate checks the rewrite and compiles its pattern
+func (w *WebSocketRewrite) validate() error {
+	switch w.Direction {
+	case "", Upstream, Downstream:
+	default:
+		return fmt.Errorf("unknown websocket direction %q (want %s or %s)", w.Direction, Upstream, Downstream)
+	}
+	if w.Pattern == "" {
+		return fmt.Errorf("websocket rewrite requires a pattern")
+	}
+	re, err := regexp.Compile(w.Pattern)
+	if err != nil {
+		return fmt.Errorf("invalid websocket pattern: %w", err)
+	}
+	w.re = re
+	return nil
+}
+
+// webSocketRewrite is a rewrite bound to the rule that defined it
+type webSocketRewrite struct {
+	ruleID  string
+	rewrite *WebSocketRewrite
+}
+
+// RewriteMessage applies the WebSocket rewrites of the rules that matched
+// the handshake to a single message, in rule order. It returns the new
+// payload, the ID of the last rule that changed it ("" if none), and
+// whether the message should be dropped.
+func (o *Outcome) RewriteMessage(direction string, payload []byte) ([]byte, string, bool) {
+	var ruleID string
+	for _, ws := range o.webSocket {
+		w := ws.rewrite
+		if w.Direction != "" && w.Direction != direction {
+			continue
+		}
+		if !w.re.Match(payload) {
+			continue
+		}
+		ruleID = ws.ruleID
+		if w.Drop {
+			return nil, ruleID, true
+		}
+		payload = w.re.ReplaceAll(payload, []byte(w.Replace))
+	}
+	return payload, ruleID, false
+}
+
+// RewritesWebSocket reports whether any matching rule rewrites messages
+func (o *Outcome) RewritesWebSocket() bool {
+	return len(o.webSocket) > 0
+}
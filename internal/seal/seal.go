@@ -0,0 +1,200 @@
+// Package seal encrypts capture data written to disk. Streams are split
+// into chunks sealed with AES-256-GCM; the last chunk is marked so a
+// truncated file fails to decrypt rather than reading as complete.
+package seal
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// KeySize is the length of keys in bytes
+const KeySize = 32
+
+// chunkSize is the plaintext size of every chunk but the last
+const chunkSize = 64 * 1024
+
+// magic starts every sealed stream
+var magic = []byte("GPXSEAL1")
+
+// ErrFormat reports a stream that is not sealed or was cut short
+var ErrFormat = errors.New("seal: not a sealed stream or truncated")
+
+// ParseKey decodes a 256-bit key given as hex or base64
+func ParseKey(s string) ([]byte, error) {
+	s = strings.TrimSpace(s)
+	if key, err := hex.DecodeString(s); err == nil && len(key) == KeySize {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(s); err == nil && len(key) == KeySize {
+		return key, nil
+	}
+	return nil, fmt.Errorf("seal: key must be %d bytes, hex or base64 encoded", KeySize)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// nonce derives chunk n's nonce from the stream's random prefix
+func nonce(prefix []byte, n uint32) []byte {
+	out := make([]byte, 12)
+	copy(out, prefix)
+	binary.BigEndian.PutUint32(out[8:], n)
+	return out
+}
+
+// additional data distinguishing the last chunk from the others
+var (
+	middleChunk = []byte{0}
+	lastChunk   = []byte{1}
+)
+
+// Writer encrypts a stream. Close must be called to seal the last chunk.
+type Writer struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	prefix []byte
+	n      uint32
+	buf    []byte
+	err    error
+}
+
+// NewWriter starts a sealed stream on w
+func NewWriter(w io.Writer, key []byte) (*Writer, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, 8)
+	rand.Read(prefix)
+	if _, err := w.Write(append(append([]byte{}, magic...), prefix...)); err != nil {
+		return nil, err
+	}
+	return &Writer{w: w, aead: aead, prefix: prefix, buf: make([]byte, 0, chunkSize)}, nil
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	written := 0
+	for len(p) > 0 {
+		if len(w.buf) == chunkSize {
+			if w.err = w.seal(middleChunk); w.err != nil {
+				return written, w.err
+			}
+		}
+		n := copy(w.buf[len(w.buf):chunkSize], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close seals the last chunk. It does not close the underlying writer.
+func (w *Writer) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	w.err = w.seal(lastChunk)
+	if w.err == nil {
+		w.err = errors.New("seal: write after close")
+		return nil
+	}
+	return w.err
+}
+
+func (w *Writer) seal(kind []byte) error {
+	out := w.aead.Seal(nil, nonce(w.prefix, w.n), w.buf, kind)
+	w.n++
+	w.buf = w.buf[:0]
+	_, err := w.w.Write(out)
+	return err
+}
+
+// Reader decrypts a sealed stream
+type Reader struct {
+	r      *bufio.Reader
+	aead   cipher.AEAD
+	prefix []byte
+	n      uint32
+	plain  []byte
+	done   bool
+}
+
+// NewReader opens the sealed stream r
+func NewReader(r io.Reader, key []byte) (*Reader, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, len(magic)+8)
+	if _, err := io.ReadFull(r, header); err != nil || string(header[:len(magic)]) != string(magic) {
+		return nil, ErrFormat
+	}
+	return &Reader{
+		r:      bufio.NewReaderSize(r, chunkSize+aead.Overhead()+1),
+		aead:   aead,
+		prefix: header[len(magic):],
+	}, nil
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+// open decrypts the next chunk; a short chunk, or a full one with nothing
+// after it, is the last
+func (r *Reader) open() error {
+	sealed := make([]byte, chunkSize+r.aead.Overhead())
+	n, err := io.ReadFull(r.r, sealed)
+	switch {
+	case err == io.EOF:
+		return ErrFormat
+	case err == io.ErrUnexpectedEOF:
+		r.done = true
+	case err != nil:
+		return err
+	default:
+		if _, err := r.r.Peek(1); err == io.EOF {
+			r.done = true
+		}
+	}
+
+	kind := middleChunk
+	if r.done {
+		kind = lastChunk
+	}
+	plain, err := r.aead.Open(nil, nonce(r.prefix, r.n), sealed[:n], kind)
+	if err != nil {
+		return ErrFormat
+	}
+	r.n++
+	r.plain = plain
+	return nil
+}
@@ -0,0 +1,100 @@
+package seal
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+)
+
+func testKey(t *testing.T) []byte {
+	t.Helper()
+	key := make([]byte, KeySize)
+	rand.Read(key)
+	return key
+}
+
+func sealBytes(t *testing.T, key, plain []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(plain); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func openBytes(key, sealed []byte) ([]byte, error) {
+	r, err := NewReader(bytes.NewReader(sealed), key)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(r)
+}
+
+// sealedChunk is the size of a full chunk on disk
+const sealedChunk = chunkSize + 16
+
+// headerSize is the magic and nonce prefix before the first chunk
+var headerSize = len(magic) + 8
+
+func TestRoundTrip(t *testing.T) {
+	key := testKey(t)
+	for _, size := range []int{0, 1, chunkSize - 1, chunkSize, chunkSize + 1, 3*chunkSize + 5} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+		got, err := openBytes(key, sealBytes(t, key, plain))
+		if err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Fatalf("%d bytes: round trip changed the data", size)
+		}
+	}
+}
+
+func TestTruncatedStreamRejected(t *testing.T) {
+	key := testKey(t)
+	for _, size := range []int{chunkSize, chunkSize + 1, 2 * chunkSize} {
+		sealed := sealBytes(t, key, make([]byte, size))
+		// Drop the last chunk, leaving only whole middle chunks
+		chunks := (len(sealed) - headerSize - 1) / sealedChunk
+		cut := sealed[:headerSize+chunks*sealedChunk]
+		if _, err := openBytes(key, cut); !errors.Is(err, ErrFormat) {
+			t.Errorf("%d bytes without the last chunk: err = %v, want ErrFormat", size, err)
+		}
+	}
+	sealed := sealBytes(t, key, []byte("short"))
+	if _, err := openBytes(key, sealed[:len(sealed)-1]); !errors.Is(err, ErrFormat) {
+		t.Errorf("cut inside the last chunk: err = %v, want ErrFormat", err)
+	}
+}
+
+func TestReorderedChunksRejected(t *testing.T) {
+	key := testKey(t)
+	sealed := sealBytes(t, key, make([]byte, 2*chunkSize+10))
+	first := sealed[headerSize : headerSize+sealedChunk]
+	second := sealed[headerSize+sealedChunk : headerSize+2*sealedChunk]
+
+	swapped := append([]byte{}, sealed[:headerSize]...)
+	swapped = append(swapped, second...)
+	swapped = append(swapped, first...)
+	swapped = append(swapped, sealed[headerSize+2*sealedChunk:]...)
+	if _, err := openBytes(key, swapped); !errors.Is(err, ErrFormat) {
+		t.Errorf("swapped chunks: err = %v, want ErrFormat", err)
+	}
+}
+
+func TestWrongKeyRejected(t *testing.T) {
+	sealed := sealBytes(t, testKey(t), []byte("capture data"))
+	if _, err := openBytes(testKey(t), sealed); !errors.Is(err, ErrFormat) {
+		t.Errorf("wrong key: err = %v, want ErrFormat", err)
+	}
+}
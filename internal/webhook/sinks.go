@@ -0,0 +1,245 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/smtp"
+	"path"
+	"strings"
+	"time"
+)
+
+// pagerDutyURL is the PagerDuty Events API v2 endpoint
+const pagerDutyURL = "https://events.pagerduty.com/v2/enqueue"
+
+// Sink delivers events somewhere people will see them
+type Sink interface {
+	Send(ctx context.Context, event Event) error
+}
+
+// SinkConfig declares a sink in a -notify-config file. Which fields apply
+// depends on Type.
+type SinkConfig struct {
+	// webhook, slack, email or pagerduty
+	Type string `json:"type"`
+
+	// Name identifies the sink in logs (default: its type)
+	Name string `json:"name,omitempty"`
+
+	// Event types to deliver, with * wildcards such as "monitor.*"
+	// (empty delivers every event)
+	Events []string `json:"events,omitempty"`
+
+	// webhook and slack: the URL to post to; pagerduty: overrides the
+	// Events API endpoint
+	URL string `json:"url,omitempty"`
+
+	// email: SMTP server as host:port, optional credentials for PLAIN
+	// auth, sender and recipients
+	SMTP     string   `json:"smtp,omitempty"`
+	Username string   `json:"username,omitempty"`
+	Password string   `json:"password,omitempty"`
+	From     string   `json:"from,omitempty"`
+	To       []string `json:"to,omitempty"`
+
+	// pagerduty: integration key of the service, and the severity of
+	// triggered incidents (critical, error, warning or info; default
+	// error)
+	RoutingKey string `json:"routing_key,omitempty"`
+	Severity   string `json:"severity,omitempty"`
+}
+
+// ParseSinks reads a -notify-config file: a JSON array of sinks
+func ParseSinks(data []byte) ([]SinkConfig, error) {
+	var configs []SinkConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, err
+	}
+	for i, c := range configs {
+		if _, err := c.New(); err != nil {
+			return nil, fmt.Errorf("sink %d: %w", i+1, err)
+		}
+		for _, pattern := range c.Events {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("sink %d: bad event pattern %q", i+1, pattern)
+			}
+		}
+	}
+	return configs, nil
+}
+
+// New returns the sink c describes
+func (c SinkConfig) New() (Sink, error) {
+	switch c.Type {
+	case "webhook":
+		if c.URL == "" {
+			return nil, fmt.Errorf("webhook sink needs a url")
+		}
+		return &webhookSink{url: c.URL, client: &http.Client{}}, nil
+	case "slack":
+		if c.URL == "" {
+			return nil, fmt.Errorf("slack sink needs the url of an incoming webhook")
+		}
+		return &slackSink{url: c.URL, client: &http.Client{}}, nil
+	case "email":
+		if c.SMTP == "" || c.From == "" || len(c.To) == 0 {
+			return nil, fmt.Errorf("email sink needs smtp, from and to")
+		}
+		if _, _, err := net.SplitHostPort(c.SMTP); err != nil {
+			return nil, fmt.Errorf("email sink smtp: %v", err)
+		}
+		return &emailSink{config: c}, nil
+	case "pagerduty":
+		if c.RoutingKey == "" {
+			return nil, fmt.Errorf("pagerduty sink needs a routing_key")
+		}
+		severity := c.Severity
+		switch severity {
+		case "":
+			severity = "error"
+		case "critical", "error", "warning", "info":
+		default:
+			return nil, fmt.Errorf("pagerduty severity %q is not critical, error, warning or info", severity)
+		}
+		url := c.URL
+		if url == "" {
+			url = pagerDutyURL
+		}
+		return &pagerDutySink{url: url, routingKey: c.RoutingKey, severity: severity, client: &http.Client{}}, nil
+	}
+	return nil, fmt.Errorf("unknown sink type %q (want webhook, slack, email or pagerduty)", c.Type)
+}
+
+// wants reports whether the sink delivers events of type typ
+func (c SinkConfig) wants(typ string) bool {
+	if len(c.Events) == 0 {
+		return true
+	}
+	for _, pattern := range c.Events {
+		if ok, _ := path.Match(pattern, typ); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// webhookSink posts events as JSON, like -webhook URLs
+type webhookSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s *webhookSink) Send(ctx context.Context, event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return postJSON(ctx, s.client, s.url, body)
+}
+
+// slackSink posts a message to a Slack incoming webhook
+type slackSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s *slackSink) Send(ctx context.Context, event Event) error {
+	icon := ":rotating_light:"
+	if event.Resolved {
+		icon = ":white_check_mark:"
+	}
+	body, err := json.Marshal(map[string]string{
+		"text": fmt.Sprintf("%s *%s* %s", icon, event.Type, event.Summary),
+	})
+	if err != nil {
+		return err
+	}
+	return postJSON(ctx, s.client, s.url, body)
+}
+
+// emailSink mails events through an SMTP server
+type emailSink struct {
+	config SinkConfig
+}
+
+func (s *emailSink) Send(ctx context.Context, event Event) error {
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", s.config.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(s.config.To, ", "))
+	fmt.Fprintf(&msg, "Subject: [go_proxy] %s\r\n", strings.NewReplacer("\r", " ", "\n", " ").Replace(event.Summary))
+	fmt.Fprintf(&msg, "Date: %s\r\n", event.Time.Format(time.RFC1123Z))
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&msg, "%s\r\n\r\nEvent: %s\r\nTime: %s\r\n", event.Summary, event.Type, event.Time.Format(time.RFC3339))
+	if event.Data != nil {
+		data, err := json.MarshalIndent(event.Data, "", "  ")
+		if err != nil {
+			return err
+		}
+		msg.WriteString("\r\n")
+		msg.Write(bytes.ReplaceAll(data, []byte("\n"), []byte("\r\n")))
+		msg.WriteString("\r\n")
+	}
+
+	var auth smtp.Auth
+	if s.config.Username != "" {
+		host, _, _ := net.SplitHostPort(s.config.SMTP)
+		auth = smtp.PlainAuth("", s.config.Username, s.config.Password, host)
+	}
+	// net/smtp takes no context; run it aside so a stuck server does not
+	// outlive the delivery timeout
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(s.config.SMTP, auth, s.config.From, s.config.To, msg.Bytes())
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// pagerDutySink triggers and resolves PagerDuty incidents through the
+// Events API v2. Events with a Key share an incident, so a recovery
+// resolves the failure it follows.
+type pagerDutySink struct {
+	url        string
+	routingKey string
+	severity   string
+	client     *http.Client
+}
+
+func (s *pagerDutySink) Send(ctx context.Context, event Event) error {
+	body := map[string]interface{}{
+		"routing_key":  s.routingKey,
+		"event_action": "trigger",
+	}
+	if event.Key != "" {
+		body["dedup_key"] = event.Key
+	}
+	if event.Resolved {
+		if event.Key == "" {
+			// Nothing to resolve
+			return nil
+		}
+		body["event_action"] = "resolve"
+	} else {
+		body["payload"] = map[string]interface{}{
+			"summary":        event.Summary,
+			"source":         "go_proxy",
+			"severity":       s.severity,
+			"timestamp":      event.Time.Format(time.RFC3339),
+			"class":          event.Type,
+			"custom_details": event.Data,
+		}
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	return postJSON(ctx, s.client, s.url, data)
+}
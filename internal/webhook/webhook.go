@@ -0,0 +1,134 @@
+// Package webhook delivers proxy events, such as failing monitors, to
+// HTTP endpoints as JSON, and to notification sinks such as Slack, email
+// and PagerDuty
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// deliveryTimeout bounds a single webhook POST
+const deliveryTimeout = 10 * time.Second
+
+// Event types
+const (
+	EventMonitorFailed    = "monitor.failed"
+	EventMonitorRecovered = "monitor.recovered"
+	EventSecretDetected   = "secret.detected"
+
+	// Anomaly events start an anomaly, or end it when Resolved
+	EventAnomalyErrorSpike   = "anomaly.error_spike"
+	EventAnomalyLatencySpike = "anomaly.latency_spike"
+	EventAnomalyTrafficDrop  = "anomaly.traffic_drop"
+)
+
+// Event is the JSON body posted to webhooks
+type Event struct {
+	Type    string      `json:"type"`
+	Time    time.Time   `json:"time"`
+	Summary string      `json:"summary"`
+	Data    interface{} `json:"data,omitempty"`
+
+	// Key identifies the condition an event is about, such as a monitor,
+	// so sinks tracking incidents can pair a failure with its recovery
+	Key string `json:"key,omitempty"`
+
+	// Resolved marks an event ending a condition, such as a recovery
+	Resolved bool `json:"resolved,omitempty"`
+}
+
+// Notifier posts events to a set of webhook URLs and sinks
+type Notifier struct {
+	urls   []string
+	sinks  []configuredSink
+	client *http.Client
+}
+
+// configuredSink is a sink with the configuration it was made from
+type configuredSink struct {
+	config SinkConfig
+	sink   Sink
+}
+
+// New returns a notifier posting to urls; with none, events are dropped
+func New(urls []string) *Notifier {
+	return &Notifier{urls: urls, client: &http.Client{Timeout: deliveryTimeout}}
+}
+
+// AddSink delivers events matching config to the sink it describes
+func (n *Notifier) AddSink(config SinkConfig) error {
+	sink, err := config.New()
+	if err != nil {
+		return err
+	}
+	if config.Name == "" {
+		config.Name = config.Type
+	}
+	n.sinks = append(n.sinks, configuredSink{config: config, sink: sink})
+	return nil
+}
+
+// Notify posts event to every configured webhook, and to extra URLs such
+// as a monitor's own webhook, and sends it to the sinks that want it, in
+// the background. Failures are logged.
+func (n *Notifier) Notify(event Event, extra ...string) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Webhook event %s: %v", event.Type, err)
+		return
+	}
+	urls := append([]string(nil), n.urls...)
+	for _, u := range extra {
+		if u != "" {
+			urls = append(urls, u)
+		}
+	}
+	for _, u := range urls {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), deliveryTimeout)
+			defer cancel()
+			if err := postJSON(ctx, n.client, u, body); err != nil {
+				log.Printf("Webhook %s for %s: %v", u, event.Type, err)
+			}
+		}()
+	}
+	for _, s := range n.sinks {
+		if !s.config.wants(event.Type) {
+			continue
+		}
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), deliveryTimeout)
+			defer cancel()
+			if err := s.sink.Send(ctx, event); err != nil {
+				log.Printf("Notification sink %s for %s: %v", s.config.Name, event.Type, err)
+			}
+		}()
+	}
+}
+
+// postJSON delivers one JSON body
+func postJSON(ctx context.Context, client *http.Client, url string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}